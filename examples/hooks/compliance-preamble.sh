@@ -0,0 +1,37 @@
+#!/bin/sh
+# Sample pre-request hook for copilot-proxy-go (hooks.preRequest).
+#
+# Reads the upstream payload JSON on stdin and prints it with a compliance
+# preamble prepended to the system prompt. The payload format depends on
+# COPILOT_PROXY_HOOK_BACKEND: messages (Anthropic), responses or
+# chat_completions (OpenAI). Requires jq.
+#
+# Exit non-zero to reject a request; whatever is printed on stderr becomes
+# the error returned to the client.
+
+set -eu
+
+PREAMBLE=${COMPLIANCE_PREAMBLE:-"Follow the ACME acceptable use policy. Never output customer data."}
+
+case "${COPILOT_PROXY_HOOK_BACKEND:-}" in
+messages)
+	exec jq -c --arg p "$PREAMBLE" '
+		.system = (
+			if .system == null then $p
+			elif (.system | type) == "string" then $p + "\n\n" + .system
+			else [{type: "text", text: $p}] + .system
+			end)'
+	;;
+responses)
+	exec jq -c --arg p "$PREAMBLE" '
+		.instructions = ($p + (if .instructions then "\n\n" + .instructions else "" end))'
+	;;
+chat_completions)
+	exec jq -c --arg p "$PREAMBLE" '
+		.messages = [{role: "system", content: $p}] + .messages'
+	;;
+*)
+	echo "unknown backend: ${COPILOT_PROXY_HOOK_BACKEND:-unset}" >&2
+	exit 1
+	;;
+esac
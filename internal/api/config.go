@@ -1,13 +1,8 @@
 package api
 
 import (
-	"context"
 	"fmt"
-	"io"
-	"log/slog"
 	"net/http"
-	"regexp"
-	"time"
 
 	"github.com/google/uuid"
 
@@ -34,89 +29,57 @@ func GetBaseURL(accountType string) string {
 	}
 }
 
-// FetchVSCodeVersion scrapes the AUR PKGBUILD for the latest VS Code version.
-// Falls back to FallbackVSCodeVersion on any error.
-func FetchVSCodeVersion() string {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	url := "https://aur.archlinux.org/cgit/aur.git/plain/PKGBUILD?h=visual-studio-code-bin"
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		slog.Warn("failed to create VS Code version request", "error", err)
-		return FallbackVSCodeVersion
-	}
+// IdentityHeaders returns the headers that identify the editor to Copilot
+// and GitHub, with the versions s currently uses.
+func IdentityHeaders(s *state.State) http.Header {
+	h := http.Header{}
+	setIdentityHeaders(h, s)
+	return h
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		slog.Warn("failed to fetch VS Code version", "error", err)
-		return FallbackVSCodeVersion
+func setIdentityHeaders(h http.Header, s *state.State) {
+	chatVersion := s.GetCopilotChatVersion()
+	if chatVersion == "" {
+		chatVersion = CopilotChatVersion
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Warn("failed to read VS Code version response", "error", err)
-		return FallbackVSCodeVersion
+	apiVersion := s.GetGitHubAPIVersion()
+	if apiVersion == "" {
+		apiVersion = GitHubAPIVersion
 	}
-
-	re := regexp.MustCompile(`pkgver=(\d+\.\d+\.\d+)`)
-	matches := re.FindSubmatch(body)
-	if len(matches) < 2 {
-		slog.Warn("failed to parse VS Code version from PKGBUILD")
-		return FallbackVSCodeVersion
-	}
-
-	version := string(matches[1])
-	return version
+	h.Set("Editor-Version", "vscode/"+s.GetVSCodeVersion())
+	h.Set("Editor-Plugin-Version", "copilot-chat/"+chatVersion)
+	h.Set("User-Agent", "GitHubCopilotChat/"+chatVersion)
+	h.Set("X-Github-Api-Version", apiVersion)
 }
 
-// BuildCopilotHeaders builds the standard headers for Copilot API requests.
-func BuildCopilotHeaders(copilotToken, vsCodeVersion string) http.Header {
+// BuildCopilotHeaders builds the standard headers for Copilot API requests,
+// with the Copilot token and editor versions of s. X-Request-Id is random;
+// requests sent for a client replace it with the ID of their logical
+// request (see service.RequestIDs).
+func BuildCopilotHeaders(s *state.State) http.Header {
 	h := http.Header{}
-	h.Set("Authorization", "Bearer "+copilotToken)
+	h.Set("Authorization", "Bearer "+s.GetCopilotToken())
 	h.Set("Content-Type", "application/json")
 	h.Set("Copilot-Integration-Id", "vscode-chat")
-	h.Set("Editor-Version", "vscode/"+vsCodeVersion)
-	h.Set("Editor-Plugin-Version", "copilot-chat/"+CopilotChatVersion)
-	h.Set("User-Agent", "GitHubCopilotChat/"+CopilotChatVersion)
+	setIdentityHeaders(h, s)
 	h.Set("Openai-Intent", "conversation-agent")
-	h.Set("X-Github-Api-Version", GitHubAPIVersion)
 	h.Set("X-Request-Id", uuid.New().String())
 	h.Set("X-Vscode-User-Agent-Library-Version", "electron-fetch")
 	return h
 }
 
-// BuildCopilotHeadersFromState builds headers using global state.
-func BuildCopilotHeadersFromState() http.Header {
-	return BuildCopilotHeaders(
-		state.Global.GetCopilotToken(),
-		state.Global.GetVSCodeVersion(),
-	)
-}
-
-// BuildGitHubHeaders builds the standard headers for GitHub API requests.
-func BuildGitHubHeaders(githubToken, vsCodeVersion string) http.Header {
+// BuildGitHubHeaders builds the standard headers for GitHub API requests
+// with githubToken, identifying the editor with the versions of s.
+func BuildGitHubHeaders(s *state.State, githubToken string) http.Header {
 	h := http.Header{}
 	h.Set("Authorization", "token "+githubToken)
 	h.Set("Accept", "application/json")
 	h.Set("Content-Type", "application/json")
-	h.Set("Editor-Version", "vscode/"+vsCodeVersion)
-	h.Set("Editor-Plugin-Version", "copilot-chat/"+CopilotChatVersion)
-	h.Set("User-Agent", "GitHubCopilotChat/"+CopilotChatVersion)
-	h.Set("X-Github-Api-Version", GitHubAPIVersion)
+	setIdentityHeaders(h, s)
 	h.Set("X-Vscode-User-Agent-Library-Version", "electron-fetch")
 	return h
 }
 
-// BuildGitHubHeadersFromState builds GitHub headers using global state.
-func BuildGitHubHeadersFromState() http.Header {
-	return BuildGitHubHeaders(
-		state.Global.GetGithubToken(),
-		state.Global.GetVSCodeVersion(),
-	)
-}
-
 // SetInitiatorHeader sets the X-Initiator header based on whether the request
 // is user-initiated or agent-initiated.
 func SetInitiatorHeader(h http.Header, isAgent bool) {
@@ -127,7 +90,7 @@ func SetInitiatorHeader(h http.Header, isAgent bool) {
 	}
 }
 
-// CopilotURL builds a full Copilot API URL.
-func CopilotURL(path string) string {
-	return fmt.Sprintf("%s%s", GetBaseURL(state.Global.GetAccountType()), path)
+// CopilotURL builds a full Copilot API URL for the account type of s.
+func CopilotURL(s *state.State, path string) string {
+	return fmt.Sprintf("%s%s", GetBaseURL(s.GetAccountType()), path)
 }
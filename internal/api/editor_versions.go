@@ -0,0 +1,275 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// versionCacheTTL is how long a looked-up version is used before it is
+// looked up again.
+const versionCacheTTL = 24 * time.Hour
+
+// vsCodeLookupWait is how long startup waits for a VS Code version lookup
+// before going on with the cached or fallback version.
+const vsCodeLookupWait = time.Second
+
+const marketplaceQueryURL = "https://marketplace.visualstudio.com/_apis/public/gallery/extensionquery"
+
+// vsCodeVersionSources look up the latest VS Code version, tried in order.
+var vsCodeVersionSources = []struct {
+	name  string
+	fetch func(ctx context.Context) (string, error)
+}{
+	{"update API", fetchVSCodeVersionUpdateAPI},
+	{"AUR", fetchVSCodeVersionAUR},
+}
+
+// cachedVersion is a version cache file.
+type cachedVersion struct {
+	Version   string    `json:"version"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// readVersionCache returns the cached version at path and whether it is
+// still fresh. The version is "" when there is no readable cache.
+func readVersionCache(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var c cachedVersion
+	if json.Unmarshal(data, &c) != nil {
+		return "", false
+	}
+	return c.Version, time.Since(c.FetchedAt) < versionCacheTTL
+}
+
+func writeVersionCache(path, version string) {
+	data, _ := json.Marshal(cachedVersion{Version: version, FetchedAt: time.Now()})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		slog.Warn("failed to cache version", "path", path, "error", err)
+	}
+}
+
+// CachedVSCodeVersion returns the VS Code version last looked up, or ""
+// if there is none.
+func CachedVSCodeVersion() string {
+	v, _ := readVersionCache(state.VSCodeVersionPath())
+	return v
+}
+
+// VSCodeVersion returns the latest VS Code version. A version cached less
+// than versionCacheTTL ago is used as is. Otherwise the sources are tried
+// in order, waiting at most vsCodeLookupWait: a lookup that takes longer
+// finishes in the background and calls onUpdate, while the stale cached
+// version, or FallbackVSCodeVersion, is returned.
+func VSCodeVersion(onUpdate func(string)) string {
+	path := state.VSCodeVersionPath()
+	cached, fresh := readVersionCache(path)
+	if fresh {
+		return cached
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		v := lookupVSCodeVersion()
+		if v != "" {
+			writeVersionCache(path, v)
+		}
+		result <- v
+	}()
+
+	current := cached
+	if current == "" {
+		current = FallbackVSCodeVersion
+	}
+	select {
+	case v := <-result:
+		if v != "" {
+			return v
+		}
+		return current
+	case <-time.After(vsCodeLookupWait):
+		slog.Info("VS Code version lookup still running, using " + current)
+		go func() {
+			if v := <-result; v != "" && v != current {
+				slog.Info("VS Code version: " + v)
+				onUpdate(v)
+			}
+		}()
+		return current
+	}
+}
+
+// lookupVSCodeVersion tries each source in turn and returns the first
+// version found, or "" if none answers.
+func lookupVSCodeVersion() string {
+	for _, src := range vsCodeVersionSources {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		v, err := src.fetch(ctx)
+		cancel()
+		if err == nil {
+			return v
+		}
+		slog.Warn("failed to fetch VS Code version", "source", src.name, "error", err)
+	}
+	return ""
+}
+
+// fetchVSCodeVersionUpdateAPI asks the VS Code update service for the
+// stable releases, newest first.
+func fetchVSCodeVersionUpdateAPI(ctx context.Context) (string, error) {
+	body, err := getVersionSource(ctx, "https://update.code.visualstudio.com/api/releases/stable")
+	if err != nil {
+		return "", err
+	}
+	var releases []string
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return "", err
+	}
+	if len(releases) == 0 || !vsCodeVersionRe.MatchString(releases[0]) {
+		return "", errors.New("no release in update API response")
+	}
+	return releases[0], nil
+}
+
+// fetchVSCodeVersionAUR scrapes the AUR PKGBUILD of visual-studio-code-bin.
+func fetchVSCodeVersionAUR(ctx context.Context) (string, error) {
+	body, err := getVersionSource(ctx, "https://aur.archlinux.org/cgit/aur.git/plain/PKGBUILD?h=visual-studio-code-bin")
+	if err != nil {
+		return "", err
+	}
+	matches := pkgverRe.FindSubmatch(body)
+	if len(matches) < 2 {
+		return "", errors.New("no pkgver in PKGBUILD")
+	}
+	return string(matches[1]), nil
+}
+
+var (
+	vsCodeVersionRe = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	pkgverRe        = regexp.MustCompile(`pkgver=(\d+\.\d+\.\d+)`)
+)
+
+func getVersionSource(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{Message: "version lookup failed", StatusCode: resp.StatusCode}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// CachedCopilotChatVersion returns the copilot-chat version last looked up
+// on the marketplace, or "" if there is none.
+func CachedCopilotChatVersion() string {
+	v, _ := readVersionCache(state.CopilotChatVersionPath())
+	return v
+}
+
+// LatestCopilotChatVersion returns the cached marketplace version of the
+// copilot-chat extension, or "" if there is none. When the cache is
+// missing or stale, it is refreshed in the background and onUpdate is
+// called with the new version, so startup never waits on the marketplace.
+func LatestCopilotChatVersion(onUpdate func(string)) string {
+	path := state.CopilotChatVersionPath()
+	cached, fresh := readVersionCache(path)
+	if !fresh {
+		go func() {
+			v, err := fetchCopilotChatVersion()
+			if err != nil {
+				slog.Warn("failed to look up copilot-chat version", "error", err)
+				return
+			}
+			writeVersionCache(path, v)
+			if v != cached {
+				slog.Info("copilot-chat version: " + v)
+				onUpdate(v)
+			}
+		}()
+	}
+	return cached
+}
+
+// fetchCopilotChatVersion queries the VS Code marketplace for the latest
+// stable release of the copilot-chat extension.
+func fetchCopilotChatVersion() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// filterType 7 is the extension name; flags include versions and
+	// their properties, which mark pre-releases
+	query, _ := json.Marshal(map[string]any{
+		"filters": []any{map[string]any{
+			"criteria": []any{map[string]any{"filterType": 7, "value": "GitHub.copilot-chat"}},
+			"pageSize": 1,
+		}},
+		"flags": 0x11,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, marketplaceQueryURL, bytes.NewReader(query))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json;api-version=3.0-preview.1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPError{Message: "marketplace query failed", StatusCode: resp.StatusCode}
+	}
+
+	var result struct {
+		Results []struct {
+			Extensions []struct {
+				Versions []struct {
+					Version    string `json:"version"`
+					Properties []struct {
+						Key   string `json:"key"`
+						Value string `json:"value"`
+					} `json:"properties"`
+				} `json:"versions"`
+			} `json:"extensions"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&result); err != nil {
+		return "", err
+	}
+	// Versions are newest first
+	for _, r := range result.Results {
+		for _, ext := range r.Extensions {
+		versions:
+			for _, v := range ext.Versions {
+				for _, p := range v.Properties {
+					if p.Key == "Microsoft.VisualStudio.Code.PreRelease" && p.Value == "true" {
+						continue versions
+					}
+				}
+				if v.Version != "" {
+					return v.Version, nil
+				}
+			}
+		}
+	}
+	return "", errors.New("no copilot-chat release in marketplace response")
+}
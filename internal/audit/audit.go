@@ -0,0 +1,249 @@
+// Package audit writes an append-only, tamper-evident JSONL audit trail.
+// Each line carries an HMAC over its content and the previous line's HMAC,
+// so edited, reordered or removed lines break the chain. A small head file
+// next to the log records the last sequence number and HMAC so that
+// truncating the end of the log is detected too.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one audited request. Prompt and response are recorded as
+// hashes only, never content.
+type Entry struct {
+	Seq          int64     `json:"seq"`
+	Time         time.Time `json:"time"`
+	KeyLabel     string    `json:"key_label,omitempty"`
+	Endpoint     string    `json:"endpoint"`
+	ClientIP     string    `json:"client_ip,omitempty"` // token endpoints only
+	Model        string    `json:"model,omitempty"`
+	RoutedModel  string    `json:"routed_model,omitempty"`
+	Status       int       `json:"status"`
+	PromptHash   string    `json:"prompt_hash,omitempty"` // empty for token endpoints
+	ResponseHash string    `json:"response_hash,omitempty"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+	CachedTokens int64     `json:"cached_tokens"`
+	Approval     string    `json:"approval,omitempty"` // approved, rejected; empty without manual approval
+	Prev         string    `json:"prev"`               // HMAC of the previous line
+}
+
+// hmacField is appended to each line after the HMAC'd content.
+const hmacField = `,"hmac":"`
+
+// head is the content of the head file.
+type head struct {
+	Seq  int64  `json:"seq"`
+	HMAC string `json:"hmac"`
+}
+
+// Writer appends entries to an audit log.
+type Writer struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+	key  []byte
+	seq  int64
+	prev string
+}
+
+// Open opens the audit log at path for appending, continuing the chain of
+// an existing log.
+func Open(path string, key []byte) (*Writer, error) {
+	w := &Writer{path: path, key: key}
+	if last, err := lastLine(path); err != nil {
+		return nil, err
+	} else if last != nil {
+		var e struct {
+			Seq  int64  `json:"seq"`
+			HMAC string `json:"hmac"`
+		}
+		if err := json.Unmarshal(last, &e); err != nil || e.HMAC == "" {
+			return nil, fmt.Errorf("audit log %s: last line is not a valid entry", path)
+		}
+		w.seq, w.prev = e.Seq, e.HMAC
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	w.f = f
+	return w, nil
+}
+
+// Append writes e as the next line in the chain, filling in Seq and Prev.
+func (w *Writer) Append(e Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e.Seq = w.seq + 1
+	e.Prev = w.prev
+	e.Time = e.Time.UTC()
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	mac := sign(w.key, content)
+
+	line := make([]byte, 0, len(content)+len(hmacField)+len(mac)+3)
+	line = append(line, content[:len(content)-1]...)
+	line = append(line, hmacField...)
+	line = append(line, mac...)
+	line = append(line, "\"}\n"...)
+	if _, err := w.f.Write(line); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	w.seq, w.prev = e.Seq, mac
+
+	data, _ := json.Marshal(head{Seq: w.seq, HMAC: w.prev})
+	if err := os.WriteFile(HeadPath(w.path), data, 0600); err != nil {
+		return fmt.Errorf("writing audit head: %w", err)
+	}
+	return nil
+}
+
+// Close closes the log file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// HeadPath returns the head file path for an audit log.
+func HeadPath(path string) string {
+	return path + ".head"
+}
+
+// Verify checks the HMAC chain of the audit log at path and returns the
+// number of entries. Without the head file, truncation of the end of the
+// log can't be detected; headMissing reports that case.
+func Verify(path string, key []byte) (entries int64, headMissing bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	prev := ""
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		i := bytes.LastIndex(line, []byte(hmacField))
+		if i < 0 || !bytes.HasSuffix(line, []byte("\"}")) {
+			return entries, false, fmt.Errorf("line %d: missing hmac", n)
+		}
+		mac := string(line[i+len(hmacField) : len(line)-2])
+		content := append(append([]byte(nil), line[:i]...), '}')
+
+		var e Entry
+		if err := json.Unmarshal(content, &e); err != nil {
+			return entries, false, fmt.Errorf("line %d: %w", n, err)
+		}
+		if e.Seq != entries+1 {
+			return entries, false, fmt.Errorf("line %d: sequence %d, expected %d (lines removed or reordered)", n, e.Seq, entries+1)
+		}
+		if e.Prev != prev {
+			return entries, false, fmt.Errorf("line %d: chain broken (previous hmac doesn't match)", n)
+		}
+		if !hmac.Equal([]byte(mac), []byte(sign(key, content))) {
+			return entries, false, fmt.Errorf("line %d: hmac mismatch (line modified or wrong key)", n)
+		}
+		prev = mac
+		entries++
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, false, err
+	}
+
+	data, err := os.ReadFile(HeadPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, true, nil
+	} else if err != nil {
+		return entries, false, err
+	}
+	var h head
+	if err := json.Unmarshal(data, &h); err != nil {
+		return entries, false, fmt.Errorf("reading head file: %w", err)
+	}
+	if h.Seq != entries || h.HMAC != prev {
+		return entries, false, fmt.Errorf("log ends at entry %d but head file records entry %d (log truncated)", entries, h.Seq)
+	}
+	return entries, false, nil
+}
+
+// ReadKey reads the hex-encoded HMAC key from path.
+func ReadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid audit key in %s", path)
+	}
+	return key, nil
+}
+
+// LoadKey reads the HMAC key from path, creating a random one if the file
+// doesn't exist.
+func LoadKey(path string) ([]byte, error) {
+	key, err := ReadKey(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("writing audit key: %w", err)
+	}
+	return key, nil
+}
+
+// Hash returns the hex SHA-256 of data, prefixed with the algorithm.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func sign(key, content []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write(content)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// lastLine returns the last non-empty line of the file at path, or nil if
+// it doesn't exist or is empty.
+func lastLine(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return data, nil
+}
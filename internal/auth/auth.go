@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
@@ -123,14 +125,15 @@ func PollAccessToken(deviceCode string, interval int) (string, error) {
 	}
 }
 
-// FetchCopilotToken exchanges a GitHub token for a Copilot API token.
-func FetchCopilotToken(githubToken, vsCodeVersion string) (*CopilotTokenResponse, error) {
+// FetchCopilotToken exchanges a GitHub token for a Copilot API token,
+// identifying the editor with the versions of s.
+func FetchCopilotToken(s *state.State, githubToken string) (*CopilotTokenResponse, error) {
 	req, err := http.NewRequest(http.MethodGet, "https://api.github.com/copilot_internal/v2/token", nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating copilot token request: %w", err)
 	}
 
-	headers := api.BuildGitHubHeaders(githubToken, vsCodeVersion)
+	headers := api.BuildGitHubHeaders(s, githubToken)
 	req.Header = headers
 
 	resp, err := http.DefaultClient.Do(req)
@@ -152,13 +155,13 @@ func FetchCopilotToken(githubToken, vsCodeVersion string) (*CopilotTokenResponse
 }
 
 // GetUser fetches the authenticated GitHub user's login.
-func GetUser(githubToken, vsCodeVersion string) (string, error) {
+func GetUser(s *state.State, githubToken string) (string, error) {
 	req, err := http.NewRequest(http.MethodGet, "https://api.github.com/user", nil)
 	if err != nil {
 		return "", fmt.Errorf("creating user request: %w", err)
 	}
 
-	headers := api.BuildGitHubHeaders(githubToken, vsCodeVersion)
+	headers := api.BuildGitHubHeaders(s, githubToken)
 	req.Header = headers
 
 	resp, err := http.DefaultClient.Do(req)
@@ -180,27 +183,29 @@ func GetUser(githubToken, vsCodeVersion string) (string, error) {
 	return user.Login, nil
 }
 
-// SaveToken writes the GitHub token to disk.
-func SaveToken(token string) error {
-	return os.WriteFile(state.TokenPath(), []byte(token), 0600)
+// SaveToken writes the GitHub token to the app directory of s.
+func SaveToken(s *state.State, token string) error {
+	return os.WriteFile(s.TokenPath(), []byte(token), 0600)
 }
 
-// LoadToken reads the GitHub token from disk.
-func LoadToken() (string, error) {
-	data, err := os.ReadFile(state.TokenPath())
+// LoadToken reads the GitHub token from the app directory of s.
+func LoadToken(s *state.State) (string, error) {
+	data, err := os.ReadFile(s.TokenPath())
 	if err != nil {
 		return "", err
 	}
 	return strings.TrimSpace(string(data)), nil
 }
 
-// SetupAuth orchestrates the full authentication flow:
+// SetupAuth orchestrates the full authentication flow of the proxy
+// instance with state s:
 // 1. Use provided token, or load from file, or run device code flow
 // 2. Store token in state and on disk
 // 3. Fetch Copilot token
-// 4. Start auto-refresh
-func SetupAuth(providedToken string) error {
-	if err := state.EnsurePaths(); err != nil {
+// 4. Start auto-refresh, until ctx is done; refresh failures are notified
+// with the config of ctx (see notify.Send)
+func SetupAuth(ctx context.Context, s *state.State, providedToken string) error {
+	if err := s.EnsurePaths(); err != nil {
 		return fmt.Errorf("ensuring paths: %w", err)
 	}
 
@@ -208,7 +213,7 @@ func SetupAuth(providedToken string) error {
 
 	// Try loading from file if not provided
 	if githubToken == "" {
-		loaded, err := LoadToken()
+		loaded, err := LoadToken(s)
 		if err == nil && loaded != "" {
 			githubToken = loaded
 			slog.Info("loaded GitHub token from file")
@@ -237,36 +242,37 @@ func SetupAuth(providedToken string) error {
 	}
 
 	// Save token to disk
-	if err := SaveToken(githubToken); err != nil {
+	if err := SaveToken(s, githubToken); err != nil {
 		slog.Warn("failed to save GitHub token", "error", err)
 	}
 
-	state.Global.SetGithubToken(githubToken)
-	vsCodeVersion := state.Global.GetVSCodeVersion()
+	s.SetGithubToken(githubToken)
 
-	if state.Global.GetShowToken() {
+	if s.GetShowToken() {
 		slog.Info("GitHub token", "token", githubToken)
 	}
 
 	// Fetch initial Copilot token
-	copilotToken, err := FetchCopilotToken(githubToken, vsCodeVersion)
+	copilotToken, err := FetchCopilotToken(s, githubToken)
 	if err != nil {
 		return fmt.Errorf("fetching copilot token: %w", err)
 	}
-	state.Global.SetCopilotToken(copilotToken.Token)
+	s.SetCopilotToken(copilotToken.Token)
+	s.SetCopilotTokenExpiresAt(time.Unix(copilotToken.ExpiresAt, 0))
 
-	if state.Global.GetShowToken() {
+	if s.GetShowToken() {
 		slog.Info("Copilot token", "token", copilotToken.Token)
 	}
 
 	// Start auto-refresh
-	StartTokenRefresh(copilotToken.RefreshIn)
+	StartTokenRefresh(ctx, s, copilotToken.RefreshIn)
 
 	return nil
 }
 
-// StartTokenRefresh starts a goroutine that refreshes the Copilot token periodically.
-func StartTokenRefresh(refreshIn int) {
+// StartTokenRefresh starts a goroutine that refreshes the Copilot token of
+// s periodically, until ctx is done.
+func StartTokenRefresh(ctx context.Context, s *state.State, refreshIn int) {
 	refreshDuration := time.Duration(refreshIn-60) * time.Second
 	if refreshDuration < 30*time.Second {
 		refreshDuration = 30 * time.Second
@@ -274,23 +280,29 @@ func StartTokenRefresh(refreshIn int) {
 
 	go func() {
 		for {
-			time.Sleep(refreshDuration)
+			if !sleep(ctx, refreshDuration) {
+				return
+			}
 
-			githubToken := state.Global.GetGithubToken()
-			vsCodeVersion := state.Global.GetVSCodeVersion()
+			githubToken := s.GetGithubToken()
 
 			slog.Info("refreshing Copilot token...")
-			copilotToken, err := FetchCopilotToken(githubToken, vsCodeVersion)
+			copilotToken, err := FetchCopilotToken(s, githubToken)
 			if err != nil {
 				slog.Error("failed to refresh Copilot token", "error", err)
+				notify.Send(ctx, notify.EventAuthFailure, "Copilot token refresh failed",
+					"The Copilot token couldn't be refreshed; requests fail once it expires. Error: "+err.Error())
 				// Retry in 30 seconds on failure
-				time.Sleep(30 * time.Second)
+				if !sleep(ctx, 30*time.Second) {
+					return
+				}
 				continue
 			}
 
-			state.Global.SetCopilotToken(copilotToken.Token)
+			s.SetCopilotToken(copilotToken.Token)
+			s.SetCopilotTokenExpiresAt(time.Unix(copilotToken.ExpiresAt, 0))
 
-			if state.Global.GetShowToken() {
+			if s.GetShowToken() {
 				slog.Info("refreshed Copilot token", "token", copilotToken.Token)
 			} else {
 				slog.Info("Copilot token refreshed successfully")
@@ -304,3 +316,15 @@ func StartTokenRefresh(refreshIn int) {
 		}
 	}()
 }
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// SetupEditorIdentity sets the editor versions s sends upstream, from
+// editorIdentity in cfg or else looked up. Without lookup (debug), nothing
+// is fetched: unpinned versions are the cached or built-in ones.
+func SetupEditorIdentity(s *state.State, cfg *config.Config, lookup bool) {
+	identity := cfg.EditorIdentity
+
+	vsVer := identity.VSCodeVersion
+	if vsVer == "" {
+		if lookup {
+			vsVer = api.VSCodeVersion(s.SetVSCodeVersion)
+		} else if vsVer = api.CachedVSCodeVersion(); vsVer == "" {
+			vsVer = api.FallbackVSCodeVersion
+		}
+	}
+	s.SetVSCodeVersion(vsVer)
+
+	chatVer := identity.CopilotChatVersion
+	if chatVer == "" && identity.FetchCopilotChatVersion {
+		if lookup {
+			chatVer = api.LatestCopilotChatVersion(s.SetCopilotChatVersion)
+		} else {
+			chatVer = api.CachedCopilotChatVersion()
+		}
+	}
+	s.SetCopilotChatVersion(chatVer)
+	s.SetGitHubAPIVersion(identity.APIVersion)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// AccountTypeAuto selects the account type from the detected Copilot plan.
+const AccountTypeAuto = "auto"
+
+// ValidAccountTypes are the accepted values for --account-type.
+var ValidAccountTypes = []string{AccountTypeAuto, "individual", "business", "enterprise"}
+
+// CopilotPlan is the subset of the copilot_internal/user response that
+// identifies the subscription.
+type CopilotPlan struct {
+	Plan string `json:"copilot_plan"`
+	SKU  string `json:"access_type_sku"`
+}
+
+// AccountType maps the plan onto the account type that selects the Copilot
+// API base URL.
+func (p *CopilotPlan) AccountType() string {
+	plan := strings.ToLower(p.Plan)
+	sku := strings.ToLower(p.SKU)
+	switch {
+	case plan == "enterprise" || strings.Contains(sku, "enterprise"):
+		return "enterprise"
+	case plan == "business" || strings.Contains(sku, "business"):
+		return "business"
+	default:
+		return "individual"
+	}
+}
+
+// String describes the plan for logs, e.g. "business (copilot_for_business_seat)".
+func (p *CopilotPlan) String() string {
+	if p.SKU == "" {
+		return p.Plan
+	}
+	return fmt.Sprintf("%s (%s)", p.Plan, p.SKU)
+}
+
+// FetchCopilotPlan reads the plan and SKU from copilot_internal/user.
+func FetchCopilotPlan(s *state.State, githubToken string) (*CopilotPlan, error) {
+	req, err := http.NewRequest(http.MethodGet, "https://api.github.com/copilot_internal/user", nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating copilot user request: %w", err)
+	}
+
+	req.Header = api.BuildGitHubHeaders(s, githubToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching copilot user: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("copilot user request failed with status %d", resp.StatusCode)
+	}
+
+	var plan CopilotPlan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("decoding copilot user response: %w", err)
+	}
+	return &plan, nil
+}
+
+// ResolveAccountType detects the Copilot plan of s's account and reconciles
+// it with the requested account type. With "auto" the detected type is
+// applied; with an explicit type a mismatch is logged loudly but the
+// requested type is kept. Must run after SetupAuth.
+func ResolveAccountType(s *state.State, requested string) {
+	plan, err := FetchCopilotPlan(s, s.GetGithubToken())
+	if err != nil {
+		if requested == AccountTypeAuto {
+			slog.Warn("could not detect Copilot plan, assuming individual account", "error", err)
+			s.SetAccountType("individual")
+		} else {
+			slog.Warn("could not detect Copilot plan", "error", err)
+		}
+		return
+	}
+
+	s.SetCopilotPlan(plan.String())
+	detected := plan.AccountType()
+
+	switch {
+	case requested == AccountTypeAuto:
+		s.SetAccountType(detected)
+		slog.Info("detected Copilot plan " + plan.String() + ", using account type " + detected)
+	case requested != detected:
+		slog.Warn(fmt.Sprintf("--account-type=%s does not match your Copilot plan %s (expected %s); requests may fail with 404. Use --account-type=auto or --account-type=%s",
+			requested, plan.String(), detected, detected))
+	}
+}
@@ -0,0 +1,479 @@
+// Package batch emulates the OpenAI Files and Batch APIs for chat
+// completions. Uploaded JSONL inputs, batch jobs and their output files are
+// persisted as files in one directory; jobs run in the background by
+// dispatching each request line back through the proxy's router, so they
+// get the same authentication, rate limiting and handling as a client
+// request. Jobs still running when the proxy stops resume on the next start.
+package batch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// Endpoint is the only endpoint batches can target.
+const Endpoint = "/v1/chat/completions"
+
+// CompletionWindow is the only supported completion window.
+const CompletionWindow = "24h"
+
+// MaxFileBytes caps uploaded files, as OpenAI does.
+const MaxFileBytes = 200 << 20
+
+// Batch statuses.
+const (
+	StatusValidating = "validating"
+	StatusFailed     = "failed"
+	StatusInProgress = "in_progress"
+	StatusFinalizing = "finalizing"
+	StatusCompleted  = "completed"
+	StatusExpired    = "expired"
+	StatusCancelling = "cancelling"
+	StatusCancelled  = "cancelled"
+)
+
+// File is an OpenAI file object.
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"` // batch or batch_output
+}
+
+// Batch is an OpenAI batch object.
+type Batch struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Endpoint         string            `json:"endpoint"`
+	Errors           *Errors           `json:"errors"`
+	InputFileID      string            `json:"input_file_id"`
+	CompletionWindow string            `json:"completion_window"`
+	Status           string            `json:"status"`
+	OutputFileID     *string           `json:"output_file_id"`
+	ErrorFileID      *string           `json:"error_file_id"`
+	CreatedAt        int64             `json:"created_at"`
+	InProgressAt     *int64            `json:"in_progress_at"`
+	ExpiresAt        int64             `json:"expires_at"`
+	FinalizingAt     *int64            `json:"finalizing_at"`
+	CompletedAt      *int64            `json:"completed_at"`
+	FailedAt         *int64            `json:"failed_at"`
+	ExpiredAt        *int64            `json:"expired_at"`
+	CancellingAt     *int64            `json:"cancelling_at"`
+	CancelledAt      *int64            `json:"cancelled_at"`
+	RequestCounts    RequestCounts     `json:"request_counts"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// Errors lists the validation errors of a failed batch.
+type Errors struct {
+	Object string      `json:"object"`
+	Data   []LineError `json:"data"`
+}
+
+// LineError is a validation error for one input line.
+type LineError struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Param   *string `json:"param"`
+	Line    *int    `json:"line"`
+}
+
+// RequestCounts counts a batch's requests.
+type RequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// CreateRequest is the body of POST /v1/batches.
+type CreateRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// storedFile and storedBatch are the on-disk records. Owner is a hash of
+// the API key that created the object; only that key can see it.
+type storedFile struct {
+	File
+	Owner string `json:"owner,omitempty"`
+}
+
+type storedBatch struct {
+	Batch
+	Owner string `json:"owner,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// Store holds the files and batches of a proxy instance.
+type Store struct {
+	sync.Mutex
+	dir      string
+	dispatch http.Handler
+	config   *config.Store
+	files    map[string]*storedFile
+	batches  map[string]*storedBatch
+}
+
+// Open loads files and batches from dir and resumes unfinished batches.
+// Requests are served by dispatch, normally the proxy's router, with the
+// API keys of cfg.
+func Open(dir string, dispatch http.Handler, cfg *config.Store) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:      dir,
+		dispatch: dispatch,
+		config:   cfg,
+		files:    make(map[string]*storedFile),
+		batches:  make(map[string]*storedBatch),
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(name, "file-"):
+			var f storedFile
+			if err := json.Unmarshal(data, &f); err != nil {
+				slog.Warn("skipping unreadable batch file record", "file", name, "error", err)
+				continue
+			}
+			s.files[f.ID] = &f
+		case strings.HasPrefix(name, "batch_"):
+			var b storedBatch
+			if err := json.Unmarshal(data, &b); err != nil {
+				slog.Warn("skipping unreadable batch record", "file", name, "error", err)
+				continue
+			}
+			s.batches[b.ID] = &b
+		}
+	}
+
+	for _, b := range s.batches {
+		switch b.Status {
+		case StatusValidating, StatusInProgress, StatusFinalizing, StatusCancelling:
+			slog.Info("resuming batch", "id", b.ID, "status", b.Status)
+			s.startLocked(b)
+		}
+	}
+	return s, nil
+}
+
+// Owner returns the owner tag for an API key ("" when auth is disabled).
+func Owner(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateFile stores an uploaded file.
+func (s *Store) CreateFile(owner, filename, purpose string, r io.Reader) (File, error) {
+	if purpose != "batch" {
+		return File{}, badRequest("purpose must be \"batch\"")
+	}
+	if s.dir == "" {
+		return File{}, &api.HTTPError{Message: "batch storage unavailable", StatusCode: http.StatusServiceUnavailable}
+	}
+
+	id := newID("file-")
+	path := s.contentPath(id)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return File{}, err
+	}
+	n, err := io.Copy(out, io.LimitReader(r, MaxFileBytes+1))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > MaxFileBytes {
+		err = badRequest(fmt.Sprintf("file exceeds %d bytes", MaxFileBytes))
+	}
+	if err != nil {
+		os.Remove(path)
+		return File{}, err
+	}
+
+	f := &storedFile{
+		File: File{
+			ID:        id,
+			Object:    "file",
+			Bytes:     n,
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+		},
+		Owner: owner,
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err := s.saveLocked(f.ID, f); err != nil {
+		os.Remove(path)
+		return File{}, err
+	}
+	s.files[id] = f
+	return f.File, nil
+}
+
+// GetFile returns a file's metadata.
+func (s *Store) GetFile(owner, id string) (File, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.fileLocked(owner, id)
+	if err != nil {
+		return File{}, err
+	}
+	return f.File, nil
+}
+
+// OpenFile opens a file's content.
+func (s *Store) OpenFile(owner, id string) (*os.File, File, error) {
+	meta, err := s.GetFile(owner, id)
+	if err != nil {
+		return nil, File{}, err
+	}
+	f, err := os.Open(s.contentPath(id))
+	return f, meta, err
+}
+
+// ListFiles returns the owner's files, newest first, optionally filtered
+// by purpose.
+func (s *Store) ListFiles(owner, purpose string) []File {
+	s.Lock()
+	defer s.Unlock()
+	list := []File{}
+	for _, f := range s.files {
+		if f.Owner == owner && (purpose == "" || f.Purpose == purpose) {
+			list = append(list, f.File)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt > list[j].CreatedAt
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list
+}
+
+// DeleteFile deletes a file. Files used by a running batch can't be
+// deleted.
+func (s *Store) DeleteFile(owner, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.fileLocked(owner, id); err != nil {
+		return err
+	}
+	for _, b := range s.batches {
+		if b.InputFileID == id && b.cancel != nil {
+			return badRequest("file " + id + " is used by running batch " + b.ID)
+		}
+	}
+	delete(s.files, id)
+	os.Remove(s.contentPath(id))
+	return os.Remove(s.metaPath(id))
+}
+
+// Create creates a batch and starts it.
+func (s *Store) Create(owner string, req CreateRequest) (Batch, error) {
+	if req.Endpoint != Endpoint {
+		return Batch{}, badRequest("endpoint must be " + Endpoint)
+	}
+	if req.CompletionWindow != CompletionWindow {
+		return Batch{}, badRequest("completion_window must be " + CompletionWindow)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	f, err := s.fileLocked(owner, req.InputFileID)
+	if err != nil {
+		return Batch{}, err
+	}
+	if f.Purpose != "batch" {
+		return Batch{}, badRequest("input file " + f.ID + " must have purpose \"batch\"")
+	}
+
+	now := time.Now()
+	b := &storedBatch{
+		Batch: Batch{
+			ID:               newID("batch_"),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileID:      req.InputFileID,
+			CompletionWindow: req.CompletionWindow,
+			Status:           StatusValidating,
+			CreatedAt:        now.Unix(),
+			ExpiresAt:        now.Add(24 * time.Hour).Unix(),
+			Metadata:         req.Metadata,
+		},
+		Owner: owner,
+	}
+	if err := s.saveLocked(b.ID, b); err != nil {
+		return Batch{}, err
+	}
+	s.batches[b.ID] = b
+	s.startLocked(b)
+	return b.Batch, nil
+}
+
+// Get returns a batch.
+func (s *Store) Get(owner, id string) (Batch, error) {
+	s.Lock()
+	defer s.Unlock()
+	b, err := s.batchLocked(owner, id)
+	if err != nil {
+		return Batch{}, err
+	}
+	return b.Batch, nil
+}
+
+// List returns up to limit of the owner's batches, newest first, starting
+// after the batch with ID after. hasMore reports whether more remain.
+func (s *Store) List(owner, after string, limit int) (list []Batch, hasMore bool) {
+	s.Lock()
+	defer s.Unlock()
+	list = []Batch{}
+	for _, b := range s.batches {
+		if b.Owner == owner {
+			list = append(list, b.Batch)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt > list[j].CreatedAt
+		}
+		return list[i].ID > list[j].ID
+	})
+	if after != "" {
+		for i, b := range list {
+			if b.ID == after {
+				list = list[i+1:]
+				break
+			}
+		}
+	}
+	if len(list) > limit {
+		return list[:limit], true
+	}
+	return list, false
+}
+
+// Cancel cancels a batch. Requests in flight are aborted; results so far
+// are kept in the output files.
+func (s *Store) Cancel(owner, id string) (Batch, error) {
+	s.Lock()
+	defer s.Unlock()
+	b, err := s.batchLocked(owner, id)
+	if err != nil {
+		return Batch{}, err
+	}
+	switch b.Status {
+	case StatusValidating, StatusInProgress, StatusFinalizing:
+	case StatusCancelling:
+		return b.Batch, nil
+	default:
+		return Batch{}, &api.HTTPError{
+			Message:    "cannot cancel batch " + id + " with status " + b.Status,
+			StatusCode: http.StatusConflict,
+		}
+	}
+	b.Status = StatusCancelling
+	b.CancellingAt = timestamp(time.Now())
+	if err := s.saveLocked(b.ID, b); err != nil {
+		slog.Error("failed to save batch", "id", b.ID, "error", err)
+	}
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return b.Batch, nil
+}
+
+func (s *Store) fileLocked(owner, id string) (*storedFile, error) {
+	f, ok := s.files[id]
+	if !ok || f.Owner != owner {
+		return nil, notFound("No such File object: " + id)
+	}
+	return f, nil
+}
+
+func (s *Store) batchLocked(owner, id string) (*storedBatch, error) {
+	b, ok := s.batches[id]
+	if !ok || b.Owner != owner {
+		return nil, notFound("No such Batch object: " + id)
+	}
+	return b, nil
+}
+
+// saveLocked writes an object's record atomically.
+func (s *Store) saveLocked(id string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.metaPath(id) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.metaPath(id))
+}
+
+func (s *Store) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *Store) contentPath(id string) string {
+	return filepath.Join(s.dir, id+".jsonl")
+}
+
+func newID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+func timestamp(t time.Time) *int64 {
+	unix := t.Unix()
+	return &unix
+}
+
+func badRequest(msg string) error {
+	return &api.HTTPError{Message: msg, StatusCode: http.StatusBadRequest}
+}
+
+func notFound(msg string) error {
+	return &api.HTTPError{Message: msg, StatusCode: http.StatusNotFound}
+}
@@ -0,0 +1,24 @@
+package batch
+
+import "context"
+
+type storeKey struct{}
+
+// unavailable answers requests without a store: it lists nothing and
+// rejects uploads with a 503.
+var unavailable = &Store{}
+
+// WithStore returns a context whose request is served from s.
+func WithStore(ctx context.Context, s *Store) context.Context {
+	return context.WithValue(ctx, storeKey{}, s)
+}
+
+// FromContext returns the store of the proxy instance serving ctx's
+// request. Without one (the batches directory couldn't be opened) it
+// returns a store that lists nothing and rejects uploads.
+func FromContext(ctx context.Context) *Store {
+	if s, ok := ctx.Value(storeKey{}).(*Store); ok {
+		return s
+	}
+	return unavailable
+}
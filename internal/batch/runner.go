@@ -0,0 +1,456 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRateLimitRetries bounds retries of a request rejected with 429.
+	maxRateLimitRetries = 10
+	// maxRetryWait caps the wait before retrying a 429.
+	maxRetryWait = time.Minute
+)
+
+// inputLine is one request of a batch input file.
+type inputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// resultLine is one line of a batch output or error file, in OpenAI's
+// format.
+type resultLine struct {
+	ID       string         `json:"id"`
+	CustomID string         `json:"custom_id"`
+	Response *lineResponse  `json:"response"`
+	Error    *lineErrorBody `json:"error"`
+}
+
+type lineResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type lineErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// startLocked runs b in the background.
+func (s *Store) startLocked(b *storedBatch) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	if b.Status == StatusCancelling {
+		cancel()
+	}
+	go s.run(ctx, b.ID)
+}
+
+// run validates the input of a batch, executes its remaining requests and
+// finalizes it.
+func (s *Store) run(ctx context.Context, id string) {
+	s.Lock()
+	b := s.batches[id]
+	owner, inputID, expires := b.Owner, b.InputFileID, time.Unix(b.ExpiresAt, 0)
+	s.Unlock()
+
+	ctx, cancel := context.WithDeadline(ctx, expires)
+	defer cancel()
+
+	lines, lineErrs, err := readInput(s.contentPath(inputID))
+	if err != nil {
+		lineErrs = []LineError{{Code: "invalid_input_file", Message: err.Error()}}
+	}
+	if len(lineErrs) > 0 {
+		s.update(id, func(b *storedBatch) {
+			b.Status = StatusFailed
+			b.FailedAt = timestamp(time.Now())
+			b.Errors = &Errors{Object: "list", Data: lineErrs}
+			b.cancel = nil
+		})
+		slog.Warn("batch failed validation", "id", id, "errors", len(lineErrs))
+		return
+	}
+
+	out := newResultFiles(s.dir, id)
+	defer out.close()
+	done, completed, failed := out.resume()
+	s.update(id, func(b *storedBatch) {
+		if b.Status == StatusValidating {
+			b.Status = StatusInProgress
+			b.InProgressAt = timestamp(time.Now())
+		}
+		b.RequestCounts = RequestCounts{Total: len(lines), Completed: completed, Failed: failed}
+	})
+	slog.Info("batch started", "id", id, "requests", len(lines), "done", len(done))
+
+	queue := make(chan inputLine)
+	var wg sync.WaitGroup
+	for range s.config.Get().BatchWorkers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range queue {
+				res, ok := s.execute(ctx, owner, line)
+				if ctx.Err() != nil {
+					// Canceled or expired mid-request; not a result
+					continue
+				}
+				if err := out.write(res, ok); err != nil {
+					slog.Error("failed to write batch result", "id", id, "error", err)
+				}
+				s.update(id, func(b *storedBatch) {
+					if ok {
+						b.RequestCounts.Completed++
+					} else {
+						b.RequestCounts.Failed++
+					}
+				})
+			}
+		}()
+	}
+feed:
+	for _, line := range lines {
+		if done[line.CustomID] {
+			continue
+		}
+		select {
+		case queue <- line:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	out.close()
+
+	s.finalize(id, out, ctx.Err())
+}
+
+// finalize publishes the result files of a batch and sets its final status.
+func (s *Store) finalize(id string, out *resultFiles, ctxErr error) {
+	s.update(id, func(b *storedBatch) {
+		if b.Status == StatusInProgress {
+			b.Status = StatusFinalizing
+			b.FinalizingAt = timestamp(time.Now())
+		}
+	})
+
+	s.Lock()
+	defer s.Unlock()
+	b := s.batches[id]
+	b.OutputFileID = s.publishLocked(out.path(true), id+"_output.jsonl", b.Owner)
+	b.ErrorFileID = s.publishLocked(out.path(false), id+"_error.jsonl", b.Owner)
+
+	now := timestamp(time.Now())
+	switch {
+	case b.Status == StatusCancelling:
+		b.Status = StatusCancelled
+		b.CancelledAt = now
+	case errors.Is(ctxErr, context.DeadlineExceeded):
+		b.Status = StatusExpired
+		b.ExpiredAt = now
+	default:
+		b.Status = StatusCompleted
+		b.CompletedAt = now
+	}
+	b.cancel = nil
+	if err := s.saveLocked(b.ID, b); err != nil {
+		slog.Error("failed to save batch", "id", id, "error", err)
+	}
+	slog.Info("batch finished", "id", id, "status", b.Status,
+		"completed", b.RequestCounts.Completed, "failed", b.RequestCounts.Failed)
+}
+
+// publishLocked turns a result file into a batch_output file object, or
+// returns nil if it is missing or empty.
+func (s *Store) publishLocked(path, filename, owner string) *string {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		os.Remove(path)
+		return nil
+	}
+	f := &storedFile{
+		File: File{
+			ID:        newID("file-"),
+			Object:    "file",
+			Bytes:     info.Size(),
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   "batch_output",
+		},
+		Owner: owner,
+	}
+	if err := os.Rename(path, s.contentPath(f.ID)); err != nil {
+		slog.Error("failed to publish batch results", "path", path, "error", err)
+		return nil
+	}
+	if err := s.saveLocked(f.ID, f); err != nil {
+		slog.Error("failed to save batch output file", "id", f.ID, "error", err)
+	}
+	s.files[f.ID] = f
+	return &f.ID
+}
+
+// update applies fn to a batch under the store lock and saves it.
+func (s *Store) update(id string, fn func(b *storedBatch)) {
+	s.Lock()
+	defer s.Unlock()
+	b := s.batches[id]
+	fn(b)
+	if err := s.saveLocked(b.ID, b); err != nil {
+		slog.Error("failed to save batch", "id", id, "error", err)
+	}
+}
+
+// readInput parses and validates a batch input file. Request bodies are
+// rewritten as non-streaming.
+func readInput(path string) ([]inputLine, []LineError, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var lines []inputLine
+	var errs []LineError
+	seen := make(map[string]bool)
+	fail := func(n int, code, param, msg string) {
+		e := LineError{Code: code, Message: msg, Line: &n}
+		if param != "" {
+			e.Param = &param
+		}
+		errs = append(errs, e)
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxFileBytes)
+	for n := 1; scanner.Scan(); n++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var line inputLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			fail(n, "invalid_json", "", "line is not valid JSON: "+err.Error())
+			continue
+		}
+		switch {
+		case line.CustomID == "":
+			fail(n, "missing_required_parameter", "custom_id", "custom_id is required")
+			continue
+		case seen[line.CustomID]:
+			fail(n, "duplicate_custom_id", "custom_id", "custom_id "+line.CustomID+" is used more than once")
+			continue
+		case line.Method != http.MethodPost:
+			fail(n, "invalid_method", "method", "method must be POST")
+			continue
+		case line.URL != Endpoint:
+			fail(n, "invalid_url", "url", "url must be "+Endpoint)
+			continue
+		}
+		seen[line.CustomID] = true
+
+		dec := json.NewDecoder(bytes.NewReader(line.Body))
+		dec.UseNumber()
+		var body map[string]any
+		if dec.Decode(&body) != nil || body == nil {
+			fail(n, "invalid_request", "body", "body must be a JSON object")
+			continue
+		}
+		delete(body, "stream")
+		delete(body, "stream_options")
+		line.Body, _ = json.Marshal(body)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines) == 0 && len(errs) == 0 {
+		errs = append(errs, LineError{Code: "empty_file", Message: "input file has no requests"})
+	}
+	return lines, errs, nil
+}
+
+// execute sends one request through the router, retrying rate-limit
+// rejections. ok reports a 2xx response.
+func (s *Store) execute(ctx context.Context, owner string, line inputLine) (res resultLine, ok bool) {
+	res = resultLine{ID: newID("batch_req_"), CustomID: line.CustomID}
+	requestID := newID("req_")
+
+	var rw *responseBuffer
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, Endpoint, bytes.NewReader(line.Body))
+		if err != nil {
+			res.Error = &lineErrorBody{Code: "internal_error", Message: err.Error()}
+			return res, false
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-Id", requestID)
+		if key := s.apiKeyFor(owner); key != "" {
+			req.Header.Set("x-api-key", key)
+		}
+
+		rw = &responseBuffer{header: make(http.Header), status: http.StatusOK}
+		s.dispatch.ServeHTTP(rw, req)
+		if rw.status != http.StatusTooManyRequests || attempt == maxRateLimitRetries {
+			break
+		}
+		select {
+		case <-time.After(retryAfter(rw.header)):
+		case <-ctx.Done():
+			return res, false
+		}
+	}
+
+	body := json.RawMessage(bytes.TrimSpace(rw.body.Bytes()))
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	res.Response = &lineResponse{StatusCode: rw.status, RequestID: requestID, Body: body}
+	return res, rw.status >= 200 && rw.status < 300
+}
+
+// apiKeyFor returns the configured API key with the given owner tag.
+func (s *Store) apiKeyFor(owner string) string {
+	if owner == "" {
+		return ""
+	}
+	for _, k := range s.config.Get().GetAPIKeys() {
+		if Owner(k) == owner {
+			return k
+		}
+	}
+	return ""
+}
+
+// retryAfter parses a Retry-After header: seconds or a Go duration, as
+// the rate limiter sends.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return time.Second
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	return min(max(d, 100*time.Millisecond), maxRetryWait)
+}
+
+// responseBuffer captures a dispatched response.
+type responseBuffer struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rb *responseBuffer) Header() http.Header { return rb.header }
+
+func (rb *responseBuffer) WriteHeader(status int) {
+	if !rb.wroteHeader {
+		rb.wroteHeader = true
+		rb.status = status
+	}
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	rb.WriteHeader(http.StatusOK)
+	return rb.body.Write(p)
+}
+
+// resultFiles appends to the in-progress output and error files of a batch.
+type resultFiles struct {
+	mu     sync.Mutex
+	dir    string
+	id     string
+	output *os.File
+	errors *os.File
+}
+
+func newResultFiles(dir, id string) *resultFiles {
+	return &resultFiles{dir: dir, id: id}
+}
+
+// path returns the in-progress output (ok) or error file path.
+func (rf *resultFiles) path(ok bool) string {
+	if ok {
+		return filepath.Join(rf.dir, rf.id+".output.jsonl")
+	}
+	return filepath.Join(rf.dir, rf.id+".errors.jsonl")
+}
+
+// resume returns the custom IDs already recorded by an earlier run, with
+// counts of successes and failures.
+func (rf *resultFiles) resume() (done map[string]bool, completed, failed int) {
+	done = make(map[string]bool)
+	for _, ok := range []bool{true, false} {
+		data, err := os.ReadFile(rf.path(ok))
+		if err != nil {
+			continue
+		}
+		for _, raw := range bytes.Split(data, []byte("\n")) {
+			var res resultLine
+			if json.Unmarshal(raw, &res) != nil || res.CustomID == "" {
+				continue
+			}
+			done[res.CustomID] = true
+			if ok {
+				completed++
+			} else {
+				failed++
+			}
+		}
+	}
+	return done, completed, failed
+}
+
+// write appends a result to the output file (ok) or the error file.
+func (rf *resultFiles) write(res resultLine, ok bool) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	f := &rf.errors
+	if ok {
+		f = &rf.output
+	}
+	if *f == nil {
+		if *f, err = os.OpenFile(rf.path(ok), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			return fmt.Errorf("opening batch results: %w", err)
+		}
+	}
+	_, err = (*f).Write(append(data, '\n'))
+	return err
+}
+
+func (rf *resultFiles) close() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	for _, f := range []**os.File{&rf.output, &rf.errors} {
+		if *f != nil {
+			(*f).Close()
+			*f = nil
+		}
+	}
+}
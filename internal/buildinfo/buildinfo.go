@@ -0,0 +1,80 @@
+// Package buildinfo describes the running build, for /api/stats, /healthz,
+// the debug command and the X-Copilot-Proxy-Version header. Release builds
+// set the variables with -ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/tonghaoch/copilot-proxy-go/internal/buildinfo.Version=1.2.3 \
+//	  -X github.com/tonghaoch/copilot-proxy-go/internal/buildinfo.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/tonghaoch/copilot-proxy-go/internal/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them, the commit and date come from the VCS stamp go build
+// embeds when building in a git checkout.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set with -ldflags -X.
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`     // commit time from the VCS stamp, or the -ldflags build date
+	Modified  bool   `json:"modified,omitempty"` // built from a checkout with uncommitted changes
+	GoVersion string `json:"go_version"`
+}
+
+var (
+	once sync.Once
+	info Info
+)
+
+// Get returns the build info.
+func Get() Info {
+	once.Do(func() {
+		info = Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	})
+	return info
+}
+
+// Short returns the version with the first 12 characters of the commit,
+// e.g. "1.2.3 (0123456789ab)".
+func (i Info) Short() string {
+	if i.Commit == "" {
+		return i.Version
+	}
+	commit := i.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if i.Modified {
+		commit += "-dirty"
+	}
+	return i.Version + " (" + commit + ")"
+}
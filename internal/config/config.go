@@ -2,9 +2,13 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
@@ -13,21 +17,532 @@ import (
 type Config struct {
 	Auth                  AuthConfig        `json:"auth"`
 	ExtraPrompts          map[string]string `json:"extraPrompts"`
+	// PromptPresets are named extra prompts a /v1/messages request selects
+	// with the X-Extra-Prompt header instead of its model's extraPrompts.
+	PromptPresets map[string]string `json:"promptPresets,omitempty"`
 	SmallModel            string            `json:"smallModel"`
 	ModelReasoningEfforts map[string]string `json:"modelReasoningEfforts"`
 	UseFunctionApplyPatch bool              `json:"useFunctionApplyPatch"`
 	CompactUseSmallModel  bool              `json:"compactUseSmallModel"`
+	// ModelToolParallelism forces parallel_tool_calls per model; false
+	// disables parallel calls even when the client asks for them.
+	ModelToolParallelism map[string]bool `json:"modelToolParallelism,omitempty"`
+	// ModelPricing is each model's price in USD per million tokens, as
+	// reported by /api/models/info. Copilot doesn't bill per token.
+	ModelPricing map[string]ModelPrice `json:"modelPricing,omitempty"`
+	// ModelConcurrency caps concurrent upstream requests per model; the
+	// "default" entry applies to models without their own. Further
+	// requests wait for a slot. Unset or 0 = unlimited.
+	ModelConcurrency map[string]int `json:"modelConcurrency,omitempty"`
+	// ModelSamplingParams decides per model what happens to a client's
+	// temperature and top_p: "forward" sends them as given, "clamp" limits
+	// them to the range the model accepts, "omit" drops them. The
+	// "default" entry applies to models without their own; unset, the
+	// policy is derived from the model's capabilities.
+	ModelSamplingParams map[string]string `json:"modelSamplingParams,omitempty"`
+	// ModelOverrides patches the metadata Copilot's model list gives a
+	// model, for models listed without limits or endpoints: per model ID,
+	// a JSON object deep-merged onto the listed model (see
+	// state.SetModelOverrides), such as
+	// {"capabilities": {"limits": {"max_output_tokens": 32000}}}.
+	ModelOverrides map[string]json.RawMessage `json:"modelOverrides,omitempty"`
+	// PremiumMultipliers is how many premium requests a user-initiated
+	// request to each model costs, for the premium accounting in
+	// /api/stats. Models without an entry use the multiplier in Copilot's
+	// model list, then the "default" entry, then 1.
+	PremiumMultipliers map[string]float64 `json:"premiumMultipliers,omitempty"`
+	// PremiumDivergenceThreshold flags the premium accounting once the
+	// premium requests computed locally and those Copilot's quota counted
+	// differ by more than this many (default 5).
+	PremiumDivergenceThreshold float64 `json:"premiumDivergenceThreshold,omitempty"`
+	// SessionPinning handles a model change within a Claude Code session
+	// (metadata.user_id): "off" (default), "strip" to drop thinking blocks
+	// signed by the previous model, or "pin" to keep routing to the
+	// session's first model.
+	SessionPinning string `json:"sessionPinning,omitempty"`
+	// AnthropicVersionCheck handles an anthropic-version header the proxy
+	// doesn't support on /v1/messages and count_tokens: "reject" (default)
+	// answers with an invalid_request_error, "warn" logs it and proceeds.
+	AnthropicVersionCheck string `json:"anthropicVersionCheck,omitempty"`
+	// AdvertiseModelSuffixes lists model suffixes (such as "@low" or
+	// "#nothink") whose variants /v1/models lists next to each model, so
+	// model pickers show them. Suffixes work whether listed or not.
+	AdvertiseModelSuffixes []string `json:"advertiseModelSuffixes,omitempty"`
+	// ToolSchemaSanitization controls rewriting of tool input schemas that
+	// Copilot rejects: "off", "standard" (default), or "strict".
+	ToolSchemaSanitization string `json:"toolSchemaSanitization,omitempty"`
+	// DropInvalidTools drops a tool whose schema cannot be sanitized instead
+	// of forwarding it and letting the whole request fail upstream.
+	DropInvalidTools bool `json:"dropInvalidTools,omitempty"`
+	// MaxTools and MaxToolSchemaTokens limit the tool definitions sent with
+	// a Messages request (0 = unlimited). Requests over a limit are rejected
+	// unless TrimTools is set, in which case definitions are summarized.
+	MaxTools            int  `json:"maxTools,omitempty"`
+	MaxToolSchemaTokens int  `json:"maxToolSchemaTokens,omitempty"`
+	TrimTools           bool `json:"trimTools,omitempty"`
+	// RepairToolPairs repairs Messages histories with unpaired tool_use or
+	// tool_result blocks instead of rejecting them: orphaned tool_results
+	// are dropped and empty ones are added for unanswered tool_uses.
+	RepairToolPairs bool `json:"repairToolPairs,omitempty"`
+	// ForwardUnknownFields forwards top-level /v1/messages fields the proxy
+	// doesn't model to the translated backends, keyed by field name; the
+	// value renames the field ("" keeps the name). Unlisted unknown fields
+	// are dropped with a warning.
+	ForwardUnknownFields map[string]string `json:"forwardUnknownFields,omitempty"`
+	// MidConversationSystem controls system messages after the start of an
+	// OpenAI conversation: "merge" (default) folds them into the adjacent
+	// user message as a <system-reminder> block, "keep" forwards them as-is.
+	MidConversationSystem string `json:"midConversationSystem,omitempty"`
+	// ChatCompletionFanOut honors n > 1 on non-streaming chat completions by
+	// sending n upstream requests; each one counts against quota.
+	ChatCompletionFanOut bool `json:"chatCompletionFanOut,omitempty"`
+	// FoldThinkingIntoContent moves the reasoning of /chat/completions
+	// responses into the message content, inside <thinking> tags, for
+	// clients that ignore reasoning_text. The X-Fold-Thinking header
+	// overrides it per request.
+	FoldThinkingIntoContent bool `json:"foldThinkingIntoContent,omitempty"`
+	// LogprobsModels lists models known to return logprobs. Requests for
+	// them are always forwarded, even after a response without logprobs.
+	LogprobsModels []string `json:"logprobsModels,omitempty"`
+	// Response store limits for previous_response_id emulation on
+	// /responses (0 = default: 1000 entries, 60 minutes, 64 MB).
+	ResponseStoreMaxEntries int `json:"responseStoreMaxEntries,omitempty"`
+	ResponseStoreTTLMinutes int `json:"responseStoreTTLMinutes,omitempty"`
+	ResponseStoreMaxMB      int `json:"responseStoreMaxMB,omitempty"`
+	// StreamCoalesceMs merges consecutive text/thinking deltas on translated
+	// /v1/messages streams for up to this many milliseconds (0 = off).
+	StreamCoalesceMs int `json:"streamCoalesceMs,omitempty"`
+	// EagerTextBlocks opens a text block on a translated Responses stream
+	// as soon as a message item is added, before its first text delta, so
+	// clients show output sooner.
+	EagerTextBlocks bool `json:"eagerTextBlocks,omitempty"`
+	// MaxStreamOutputTokens aborts a translated /v1/messages stream once its
+	// estimated output exceeds this many tokens (0 = off).
+	MaxStreamOutputTokens int `json:"maxStreamOutputTokens,omitempty"`
+	// SalvagePartialStreams ends a translated /v1/messages stream that
+	// fails after sending text as a normal end_turn instead of an error.
+	SalvagePartialStreams bool `json:"salvagePartialStreams,omitempty"`
+	// MaxSSEEventBytes fails an upstream stream when one of its events is
+	// larger than this (0 = default: 16 MB).
+	MaxSSEEventBytes int `json:"maxSSEEventBytes,omitempty"`
+	// MaxStreamBufferBytes caps the bytes a response may hold buffered but
+	// not yet sent, e.g. for a slow WebSocket client (0 = default: 64 MB).
+	MaxStreamBufferBytes int `json:"maxStreamBufferBytes,omitempty"`
+	// ResponseCache caches deterministic non-streaming responses.
+	ResponseCache ResponseCacheConfig `json:"responseCache,omitzero"`
+	// Idempotency bounds the responses kept for Idempotency-Key replays.
+	Idempotency IdempotencyConfig `json:"idempotency,omitzero"`
+	// Hedging sends a duplicate of slow non-streaming small-model requests.
+	Hedging HedgingConfig `json:"hedging,omitzero"`
+	// Redactions are applied in order to user, system and tool-result text
+	// before it is forwarded upstream.
+	Redactions []RedactionRule `json:"redactions,omitempty"`
+	// Audit appends a tamper-evident record of each completion request.
+	Audit AuditConfig `json:"audit,omitzero"`
+	// Approval holds rules that skip the start --manual prompt.
+	Approval ApprovalConfig `json:"approval,omitzero"`
+	// CORS is the cross-origin policy for browser clients.
+	CORS CORSConfig `json:"cors,omitzero"`
+	// Hooks are external commands that rewrite upstream payloads.
+	Hooks HooksConfig `json:"hooks,omitzero"`
+	// History records prompt and response text of every completion
+	// request in a local, searchable file. Off by default: it stores
+	// conversation content on disk.
+	History HistoryConfig `json:"history,omitzero"`
+	// AlternateUpstreams are OpenAI-compatible endpoints, tried in order,
+	// that serve chat completions while Copilot is down (see Failover).
+	AlternateUpstreams []AlternateUpstream `json:"alternateUpstreams,omitempty"`
+	// Failover decides when Copilot counts as down.
+	Failover FailoverConfig `json:"failover,omitzero"`
+	// Notifications alert on premium quota use, the Copilot circuit
+	// breaker and Copilot token refresh failures.
+	Notifications NotificationsConfig `json:"notifications,omitzero"`
+	// RateLimitWarnPercent logs a warning when a Copilot response reports
+	// less than this percentage of a rate limit remaining (default 10).
+	RateLimitWarnPercent int `json:"rateLimitWarnPercent,omitempty"`
+	// Telemetry exports OpenTelemetry traces of proxied requests.
+	Telemetry TelemetryConfig `json:"telemetry,omitzero"`
+	// BatchConcurrency is how many requests of a /v1/batches job run at
+	// once (default 1: sequential).
+	BatchConcurrency int `json:"batchConcurrency,omitempty"`
+	// MCP configures the optional MCP server (start --mcp).
+	MCP MCPConfig `json:"mcp,omitzero"`
+	// ImageProcessing validates and downscales images on the translated
+	// /v1/messages backends.
+	ImageProcessing ImageProcessingConfig `json:"imageProcessing,omitzero"`
+	// ResponsesInstructions controls how the system prompt of a /v1/messages
+	// request becomes Responses API instructions.
+	ResponsesInstructions ResponsesInstructionsConfig `json:"responsesInstructions,omitzero"`
+	// Timeouts bound upstream requests per client endpoint.
+	Timeouts TimeoutsConfig `json:"timeouts,omitzero"`
+	// CodexPhaseModels get the codex channel "phase" on assistant turns
+	// sent to the Responses API. A model matches when its name contains an
+	// entry (default: gpt-5.3-codex).
+	CodexPhaseModels []string `json:"codexPhaseModels,omitempty"`
+	// ReasoningSummaryFallback keeps the summaries of Responses API
+	// reasoning as assistant text when a conversation continues on a Chat
+	// Completions model, instead of dropping them.
+	ReasoningSummaryFallback bool `json:"reasoningSummaryFallback,omitempty"`
+	// LogRouting selects the handler log files: "handler" (default) or
+	// "model", a file per handler and model.
+	LogRouting string `json:"logRouting,omitempty"`
+	// Coordination shares rate limiting and metrics between instances.
+	Coordination CoordinationConfig `json:"coordination,omitzero"`
+	// EditorIdentity overrides the editor versions sent to Copilot.
+	EditorIdentity EditorIdentityConfig `json:"editorIdentity,omitzero"`
+	// Debug enables request options meant for debugging the proxy.
+	Debug DebugConfig `json:"debug,omitzero"`
+	DisableUpdateCheck    bool              `json:"disableUpdateCheck,omitempty"`
 }
 
 type AuthConfig struct {
 	APIKeys []string `json:"apiKeys"`
+	// PublicHealthz lets GET /healthz bypass API-key authentication.
+	PublicHealthz bool `json:"publicHealthz,omitempty"`
+	// ExposeToken enables GET /token and GET /token/github, which hand out
+	// the live Copilot and GitHub tokens. They always require an API key,
+	// so they stay closed without APIKeys.
+	ExposeToken bool `json:"exposeToken,omitempty"`
+	// KeyOptions holds per-API-key settings, keyed by the API key.
+	KeyOptions map[string]KeyOptions `json:"keyOptions,omitempty"`
 }
 
-var (
-	current *Config
-	mu      sync.RWMutex
+// ResponseCacheConfig configures the opt-in cache for non-streaming
+// /v1/messages and /chat/completions responses. Only requests with
+// temperature 0, or for a model listed in Models, are cached.
+type ResponseCacheConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// TTL is a duration such as "10m" (default 10m).
+	TTL string `json:"ttl,omitempty"`
+	// MaxEntries caps the cache size, evicting least recently used entries
+	// (default 500).
+	MaxEntries int `json:"maxEntries,omitempty"`
+	// MaxBodyBytes skips caching larger responses (default 1 MiB).
+	MaxBodyBytes int `json:"maxBodyBytes,omitempty"`
+	// Models are cached at any temperature.
+	Models []string `json:"models,omitempty"`
+}
+
+// IdempotencyConfig bounds the cache of responses to requests sent with
+// an Idempotency-Key header.
+type IdempotencyConfig struct {
+	// TTL is a duration such as "1h" (default 1h).
+	TTL string `json:"ttl,omitempty"`
+	// MaxEntries caps the cache, evicting least recently used keys
+	// (default 1000).
+	MaxEntries int `json:"maxEntries,omitempty"`
+}
+
+// HedgingConfig configures hedged upstream requests: when a non-streaming
+// request without tools for one of Models gets no response within DelayMs,
+// a duplicate is sent and the first response wins. Hedging can double usage.
+type HedgingConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// DelayMs is how long to wait before hedging (default 3000).
+	DelayMs int `json:"delayMs,omitempty"`
+	// Models eligible for hedging (default: smallModel).
+	Models []string `json:"models,omitempty"`
+}
+
+// CORSConfig configures the cross-origin policy of the server.
+type CORSConfig struct {
+	// AllowedOrigins may call the proxy from a browser; "*" allows any.
+	// Default: any origin when bound to a loopback host (start --host),
+	// none (same-origin only) otherwise.
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// AllowedHeaders are the request headers allowed (default "*").
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	// AllowCredentials allows cookies and Authorization with credentialed
+	// requests; it can't be combined with the "*" origin.
+	AllowCredentials bool `json:"allowCredentials,omitempty"`
+	// MaxAge is how long, in seconds, browsers cache a preflight
+	// response (default 300).
+	MaxAge int `json:"maxAge,omitempty"`
+}
+
+// HooksConfig configures the external request hooks.
+type HooksConfig struct {
+	// PreRequest commands run in order on every translated /v1/messages
+	// payload: each reads the payload JSON on stdin and prints the payload
+	// to send on stdout. A non-zero exit rejects the request with the
+	// command's stderr.
+	PreRequest []string `json:"preRequest,omitempty"`
+	// TimeoutMs bounds each hook run (default 5000).
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+}
+
+// HistoryConfig configures the transcript history.
+type HistoryConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// MaxMB caps the history file; the oldest entries are dropped first
+	// (default 100).
+	MaxMB int `json:"maxMB,omitempty"`
+	// RetentionDays drops entries older than this (default 30).
+	RetentionDays int `json:"retentionDays,omitempty"`
+}
+
+// TelemetryConfig configures OpenTelemetry tracing. Tracing is off
+// without an endpoint.
+type TelemetryConfig struct {
+	// OTLPEndpoint is the OTLP/HTTP collector URL, such as
+	// http://localhost:4318; /v1/traces is appended unless it has a path.
+	OTLPEndpoint string `json:"otlpEndpoint,omitempty"`
+	// Headers are sent with every export, e.g. a collector API key.
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is the service.name of the exported spans (default
+	// "copilot-proxy").
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+// AlternateUpstream is an OpenAI-compatible Chat Completions endpoint,
+// such as a local Ollama or OpenRouter.
+type AlternateUpstream struct {
+	// Name identifies the upstream in logs and metrics (default: the host
+	// of BaseURL).
+	Name string `json:"name,omitempty"`
+	// BaseURL is the API root requests go to with /chat/completions
+	// appended, e.g. "http://localhost:11434/v1".
+	BaseURL string `json:"baseURL"`
+	// APIKey is sent as a bearer token when set.
+	APIKey string `json:"apiKey,omitempty"`
+	// Models maps requested models to the upstream's; "*" maps any other
+	// model. Without entries model names are sent unchanged; with entries,
+	// requests for an unmapped model skip this upstream.
+	Models map[string]string `json:"models,omitempty"`
+}
+
+// UpstreamName returns the name of u used in logs and metrics.
+func (u AlternateUpstream) UpstreamName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	if parsed, err := url.Parse(u.BaseURL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return u.BaseURL
+}
+
+// MapModel returns the model name u serves model as, or false when u
+// doesn't serve it.
+func (u AlternateUpstream) MapModel(model string) (string, bool) {
+	if len(u.Models) == 0 {
+		return model, true
+	}
+	if m, ok := u.Models[model]; ok {
+		return m, true
+	}
+	m, ok := u.Models["*"]
+	return m, ok
+}
+
+// FailoverConfig configures the circuit breaker on Copilot completion
+// requests. Once Threshold requests in a row fail with a network error or
+// a 5xx, chat completions go to the alternateUpstreams for CooldownSeconds;
+// then Copilot is tried again.
+type FailoverConfig struct {
+	// Threshold is the consecutive failures that open the circuit
+	// (default 3).
+	Threshold int `json:"threshold,omitempty"`
+	// CooldownSeconds is how long the circuit stays open (default 30).
+	CooldownSeconds int `json:"cooldownSeconds,omitempty"`
+}
+
+// Webhook formats for NotificationsConfig.WebhookFormat.
+const (
+	WebhookFormatAuto    = "auto" // from the URL: Slack, Discord, else json
+	WebhookFormatSlack   = "slack"
+	WebhookFormatDiscord = "discord"
+	WebhookFormatJSON    = "json"
 )
 
+// NotificationsConfig configures the alerts sent by the notify package.
+// Nothing is sent unless WebhookURL or Command is set.
+type NotificationsConfig struct {
+	// WebhookURL receives each notification as a POST.
+	WebhookURL string `json:"webhookURL,omitempty"`
+	// WebhookFormat is the body posted: slack, discord, json, or auto
+	// (the default) to pick from the URL.
+	WebhookFormat string `json:"webhookFormat,omitempty"`
+	// Command runs for each notification, with the notification JSON on
+	// stdin and COPILOT_PROXY_NOTIFY_* environment variables, e.g. a
+	// script calling notify-send. Must be an absolute path.
+	Command string `json:"command,omitempty"`
+	// QuotaPercent notifies once premium quota use reaches this
+	// percentage of the entitlement (default 90).
+	QuotaPercent int `json:"quotaPercent,omitempty"`
+	// IntervalMinutes is the least time between two notifications of the
+	// same event (default 30).
+	IntervalMinutes int `json:"intervalMinutes,omitempty"`
+}
+
+// ApprovalConfig configures auto-approval under start --manual.
+type ApprovalConfig struct {
+	// FollowUpMinutes auto-approves agent-initiated requests of a session
+	// (metadata.user_id) for this long after one of its user-initiated
+	// requests was approved (0 = off).
+	FollowUpMinutes int `json:"followUpMinutes,omitempty"`
+	// Endpoints are always approved: count_tokens, models, embeddings,
+	// usage, or a request path such as /v1/messages.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// ApproveAllMinutes is how long answering "a" at the prompt approves
+	// every request (default 10).
+	ApproveAllMinutes int `json:"approveAllMinutes,omitempty"`
+}
+
+// AuditConfig configures the audit log (see internal/audit).
+type AuditConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Path of the JSONL log (default: audit.jsonl in the data directory).
+	Path string `json:"path,omitempty"`
+}
+
+// MCPConfig configures the MCP server. Read-only tools are always
+// available; tools that change settings must be listed in AllowedTools.
+type MCPConfig struct {
+	AllowedTools []string `json:"allowedTools,omitempty"`
+}
+
+// ImageProcessingConfig configures image preprocessing: base64 images are
+// validated, their media type corrected from the content, and images over
+// a limit downscaled or re-encoded before they are sent upstream.
+type ImageProcessingConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// MaxBytes is the largest decoded image sent as is (default 5 MiB).
+	MaxBytes int `json:"maxBytes,omitempty"`
+	// MaxDimension is the longest side in pixels sent as is (default 2048).
+	MaxDimension int `json:"maxDimension,omitempty"`
+}
+
+// TimeoutsConfig bounds each upstream request, from sending it to the end of
+// reading its response (streams included), by the client endpoint it
+// serves. Values are durations such as "8m"; "0" disables the limit.
+// /v1/messages/count_tokens is answered locally and needs none.
+type TimeoutsConfig struct {
+	// Messages applies to /v1/messages on every backend (default 10m, or
+	// 20m at high or xhigh reasoning effort).
+	Messages string `json:"messages,omitempty"`
+	// ChatCompletions applies to /chat/completions (defaults as Messages).
+	ChatCompletions string `json:"chatCompletions,omitempty"`
+	// Responses applies to /responses (defaults as Messages).
+	Responses string `json:"responses,omitempty"`
+	// Embeddings applies to /embeddings (default 30s).
+	Embeddings string `json:"embeddings,omitempty"`
+}
+
+// Timeout endpoints, as named in TimeoutsConfig.
+const (
+	TimeoutMessages        = "messages"
+	TimeoutChatCompletions = "chatCompletions"
+	TimeoutResponses       = "responses"
+	TimeoutEmbeddings      = "embeddings"
+)
+
+// CoordinationConfig configures state shared by proxy instances behind a
+// load balancer. Read at startup.
+type CoordinationConfig struct {
+	// RedisURL enables the Redis backend, e.g. "redis://:password@host:6379/0"
+	// (rediss:// for TLS). Without it, each instance keeps its own state.
+	RedisURL string `json:"redisURL,omitempty"`
+	// Namespace prefixes every key (default "copilot-proxy").
+	Namespace string `json:"namespace,omitempty"`
+	// InstanceID names this instance in the recent request feed (default
+	// hostname:port).
+	InstanceID string `json:"instanceID,omitempty"`
+}
+
+// EditorIdentityConfig overrides the editor the proxy presents itself as in
+// the Editor-Version, Editor-Plugin-Version, User-Agent and
+// X-Github-Api-Version headers. Read at startup.
+type EditorIdentityConfig struct {
+	// VSCodeVersion pins the VS Code version instead of looking it up.
+	VSCodeVersion string `json:"vscodeVersion,omitempty"`
+	// CopilotChatVersion pins the copilot-chat extension version.
+	CopilotChatVersion string `json:"copilotChatVersion,omitempty"`
+	// APIVersion is the GitHub API version, a date such as "2025-10-01".
+	APIVersion string `json:"apiVersion,omitempty"`
+	// FetchCopilotChatVersion looks up the latest copilot-chat version on
+	// the VS Code marketplace, cached for a day, when none is pinned.
+	FetchCopilotChatVersion bool `json:"fetchCopilotChatVersion,omitempty"`
+}
+
+// DebugConfig enables debugging aids that are off by default because
+// clients could misuse them.
+type DebugConfig struct {
+	// AllowBackendOverride honors the X-Backend header (or ?backend=) on
+	// /v1/messages, forcing the backend a request is translated for.
+	AllowBackendOverride bool `json:"allowBackendOverride,omitempty"`
+}
+
+// ResponsesInstructionsConfig configures the instructions built for the
+// Responses backend.
+type ResponsesInstructionsConfig struct {
+	// Order is "legacy" (default: the extra prompt is appended to the first
+	// system block) or "cache" (system blocks in order, extra prompt last),
+	// which keeps the instruction prefix stable for upstream prompt caching.
+	Order string `json:"order,omitempty"`
+	// LogHashes logs the offset and prefix hash at each block boundary.
+	LogHashes bool `json:"logHashes,omitempty"`
+}
+
+// KeyOptions are settings applied to requests authenticated with one API key.
+type KeyOptions struct {
+	// DefaultInitiator ("agent" or "user") replaces the message-shape
+	// heuristic for requests without an X-Initiator header.
+	DefaultInitiator string `json:"defaultInitiator,omitempty"`
+	// SkipRedaction forwards this key's requests without applying
+	// redactions.
+	SkipRedaction bool `json:"skipRedaction,omitempty"`
+	// Label identifies the key in the audit log instead of its prefix.
+	Label string `json:"label,omitempty"`
+}
+
+// RedactionRule replaces matches of a regular expression (Go RE2 syntax).
+// Replacement may reference groups as $1 or ${name}.
+type RedactionRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// ModelPrice is a model's price in USD per million tokens.
+type ModelPrice struct {
+	InputPerMTok       float64 `json:"inputPerMTok"`
+	OutputPerMTok      float64 `json:"outputPerMTok"`
+	CachedInputPerMTok float64 `json:"cachedInputPerMTok,omitempty"`
+}
+
+// Store holds the config of a proxy instance: the file it's loaded from,
+// the command-line overrides applied on top and the effective config.
+type Store struct {
+	path func() string
+
+	mu      sync.RWMutex
+	current *Config
+
+	// persisted is the config as stored on disk, without env/flag overrides.
+	// MergeDefaults updates and saves this copy so overrides never leak into
+	// the file.
+	persisted *Config
+	sources   map[string]Source
+
+	// flagOverrides holds "path=value" pairs from the command line, applied
+	// on top of the environment by every Load.
+	flagOverrides [][2]string
+
+	// loadErr records the outcome of the last Load call for health reporting.
+	loadErr    error
+	loadCalled bool
+}
+
+// Global is the CLI's config store: the one Get and the other package
+// functions read, and the one the CLI's proxy instance serves with.
+var Global = &Store{path: state.ConfigPath}
+
+// NewStore returns a store for the config file at path, for a proxy
+// instance with a config of its own. It holds the defaults until Load.
+func NewStore(path string) *Store {
+	return &Store{path: func() string { return path }}
+}
+
 // defaultExtraPrompts are auto-merged into user config on startup.
 var defaultExtraPrompts = map[string]string{
 	"gpt-5-mini": `When exploring a codebase or searching for information, batch your tool calls for efficiency. Use multi_tool_use.parallel to run multiple tool calls simultaneously when they are independent of each other.`,
@@ -55,30 +570,60 @@ func defaultConfig() *Config {
 }
 
 // Load reads the config from disk, creating it with defaults if it doesn't exist.
-func Load() error {
-	configPath := state.ConfigPath()
+func Load() error { return Global.Load() }
+
+// Load reads s's config file, creating it with defaults if it doesn't
+// exist.
+func (s *Store) Load() error {
+	err := s.load()
+	s.mu.Lock()
+	s.loadErr = err
+	s.loadCalled = true
+	s.mu.Unlock()
+	return err
+}
+
+// LoadStatus reports whether Load has run and the error it returned, if any.
+// A config that failed to parse is reported as an error even though defaults
+// were applied.
+func LoadStatus() (loaded bool, err error) { return Global.LoadStatus() }
+
+// LoadStatus reports whether s.Load has run and the error it returned.
+func (s *Store) LoadStatus() (loaded bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loadCalled, s.loadErr
+}
+
+func (s *Store) load() error {
+	configPath := s.path()
 
 	data, err := os.ReadFile(configPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Create default config
-			cfg := defaultConfig()
-			if err := save(cfg); err != nil {
-				return err
-			}
-			mu.Lock()
-			current = cfg
-			mu.Unlock()
-			slog.Info("created default config", "path", configPath)
-			return nil
+		if !os.IsNotExist(err) {
+			return err
 		}
-		return err
+		// Create default config
+		cfg := defaultConfig()
+		if err := s.save(cfg); err != nil {
+			return err
+		}
+		slog.Info("created default config", "path", configPath)
+		s.setCurrent(cfg, make(map[string]Source))
+		return nil
+	}
+
+	for _, issue := range Validate(data, nil) {
+		slog.Warn("config: " + issue.String())
 	}
 
 	var cfg Config
+	var parseErr error
+	src := fileSources(data)
 	if err := json.Unmarshal(data, &cfg); err != nil {
-		slog.Warn("failed to parse config, using defaults", "error", err)
 		cfg = *defaultConfig()
+		src = make(map[string]Source)
+		parseErr = fmt.Errorf("parsing %s: %w", configPath, err)
 	}
 
 	// Apply defaults for missing fields
@@ -92,33 +637,159 @@ func Load() error {
 		cfg.ModelReasoningEfforts = map[string]string{"gpt-5-mini": "low"}
 	}
 
-	mu.Lock()
-	current = &cfg
-	mu.Unlock()
+	s.setCurrent(&cfg, src)
+	return parseErr
+}
 
-	return nil
+// setCurrent installs file as the persisted config and derives the effective
+// config by overlaying environment and command-line overrides.
+func (s *Store) setCurrent(file *Config, src map[string]Source) {
+	s.mu.RLock()
+	flags := s.flagOverrides
+	s.mu.RUnlock()
+
+	effective := file.clone()
+	for _, w := range applyOverrides(effective, src, flags) {
+		slog.Warn("config: " + w)
+	}
+
+	s.mu.Lock()
+	s.persisted = file
+	s.current = effective
+	s.sources = src
+	s.mu.Unlock()
+}
+
+// clone returns a deep copy of c.
+func (c *Config) clone() *Config {
+	out := *c
+	out.Auth.APIKeys = append([]string(nil), c.Auth.APIKeys...)
+	out.LogprobsModels = append([]string(nil), c.LogprobsModels...)
+	out.AdvertiseModelSuffixes = append([]string(nil), c.AdvertiseModelSuffixes...)
+	out.CodexPhaseModels = append([]string(nil), c.CodexPhaseModels...)
+	out.ResponseCache.Models = append([]string(nil), c.ResponseCache.Models...)
+	out.Hedging.Models = append([]string(nil), c.Hedging.Models...)
+	out.Approval.Endpoints = append([]string(nil), c.Approval.Endpoints...)
+	out.CORS.AllowedOrigins = append([]string(nil), c.CORS.AllowedOrigins...)
+	out.CORS.AllowedHeaders = append([]string(nil), c.CORS.AllowedHeaders...)
+	out.Hooks.PreRequest = append([]string(nil), c.Hooks.PreRequest...)
+	out.Redactions = append([]RedactionRule(nil), c.Redactions...)
+	if c.AlternateUpstreams != nil {
+		out.AlternateUpstreams = make([]AlternateUpstream, len(c.AlternateUpstreams))
+		for i, u := range c.AlternateUpstreams {
+			if u.Models != nil {
+				models := make(map[string]string, len(u.Models))
+				for k, v := range u.Models {
+					models[k] = v
+				}
+				u.Models = models
+			}
+			out.AlternateUpstreams[i] = u
+		}
+	}
+	if c.Telemetry.Headers != nil {
+		out.Telemetry.Headers = make(map[string]string, len(c.Telemetry.Headers))
+		for k, v := range c.Telemetry.Headers {
+			out.Telemetry.Headers[k] = v
+		}
+	}
+	out.MCP.AllowedTools = append([]string(nil), c.MCP.AllowedTools...)
+	if c.Auth.KeyOptions != nil {
+		out.Auth.KeyOptions = make(map[string]KeyOptions, len(c.Auth.KeyOptions))
+		for k, v := range c.Auth.KeyOptions {
+			out.Auth.KeyOptions[k] = v
+		}
+	}
+	out.ExtraPrompts = make(map[string]string, len(c.ExtraPrompts))
+	for k, v := range c.ExtraPrompts {
+		out.ExtraPrompts[k] = v
+	}
+	out.ModelReasoningEfforts = make(map[string]string, len(c.ModelReasoningEfforts))
+	for k, v := range c.ModelReasoningEfforts {
+		out.ModelReasoningEfforts[k] = v
+	}
+	if c.PromptPresets != nil {
+		out.PromptPresets = make(map[string]string, len(c.PromptPresets))
+		for k, v := range c.PromptPresets {
+			out.PromptPresets[k] = v
+		}
+	}
+	if c.ForwardUnknownFields != nil {
+		out.ForwardUnknownFields = make(map[string]string, len(c.ForwardUnknownFields))
+		for k, v := range c.ForwardUnknownFields {
+			out.ForwardUnknownFields[k] = v
+		}
+	}
+	if c.ModelToolParallelism != nil {
+		out.ModelToolParallelism = make(map[string]bool, len(c.ModelToolParallelism))
+		for k, v := range c.ModelToolParallelism {
+			out.ModelToolParallelism[k] = v
+		}
+	}
+	if c.ModelPricing != nil {
+		out.ModelPricing = make(map[string]ModelPrice, len(c.ModelPricing))
+		for k, v := range c.ModelPricing {
+			out.ModelPricing[k] = v
+		}
+	}
+	if c.ModelConcurrency != nil {
+		out.ModelConcurrency = make(map[string]int, len(c.ModelConcurrency))
+		for k, v := range c.ModelConcurrency {
+			out.ModelConcurrency[k] = v
+		}
+	}
+	if c.ModelSamplingParams != nil {
+		out.ModelSamplingParams = make(map[string]string, len(c.ModelSamplingParams))
+		for k, v := range c.ModelSamplingParams {
+			out.ModelSamplingParams[k] = v
+		}
+	}
+	if c.ModelOverrides != nil {
+		out.ModelOverrides = make(map[string]json.RawMessage, len(c.ModelOverrides))
+		for k, v := range c.ModelOverrides {
+			out.ModelOverrides[k] = append(json.RawMessage(nil), v...)
+		}
+	}
+	if c.PremiumMultipliers != nil {
+		out.PremiumMultipliers = make(map[string]float64, len(c.PremiumMultipliers))
+		for k, v := range c.PremiumMultipliers {
+			out.PremiumMultipliers[k] = v
+		}
+	}
+	return &out
 }
 
 // MergeDefaults merges default extraPrompts into the config without
 // overwriting existing entries, then saves back to disk.
-func MergeDefaults() {
-	mu.Lock()
-	defer mu.Unlock()
+func MergeDefaults() { Global.MergeDefaults() }
 
-	if current == nil {
+// MergeDefaults merges default extraPrompts into s's config, like the
+// package function.
+func (s *Store) MergeDefaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, persisted := s.current, s.persisted
+	if current == nil || persisted == nil {
 		return
 	}
 
+	// Overridden extraPrompts are used as given
+	overridden := s.sources["extraPrompts"] == SourceEnv || s.sources["extraPrompts"] == SourceFlag
+
 	changed := false
 	for k, v := range defaultExtraPrompts {
-		if _, exists := current.ExtraPrompts[k]; !exists {
-			current.ExtraPrompts[k] = v
+		if _, exists := persisted.ExtraPrompts[k]; !exists {
+			persisted.ExtraPrompts[k] = v
 			changed = true
 		}
+		if _, exists := current.ExtraPrompts[k]; !exists && !overridden {
+			current.ExtraPrompts[k] = v
+		}
 	}
 
 	if changed {
-		if err := save(current); err != nil {
+		if err := s.save(persisted); err != nil {
 			slog.Warn("failed to save config after merge", "error", err)
 		} else {
 			slog.Info("merged default extraPrompts into config")
@@ -126,43 +797,705 @@ func MergeDefaults() {
 	}
 }
 
-func save(cfg *Config) error {
+func (s *Store) save(cfg *Config) error {
 	data, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(state.ConfigPath(), data, 0600)
+	return os.WriteFile(s.path(), data, 0600)
 }
 
 // Get returns the current config. Thread-safe.
-func Get() *Config {
-	mu.RLock()
-	defer mu.RUnlock()
-	if current == nil {
+func Get() *Config { return Global.Get() }
+
+// Get returns s's current config. Thread-safe.
+func (s *Store) Get() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current == nil {
 		return defaultConfig()
 	}
-	return current
+	return s.current
+}
+
+// Update applies fn to a copy of the effective config and installs it.
+// Changes are runtime-only: they are never saved, and a reload replaces
+// them.
+func Update(fn func(c *Config)) { Global.Update(fn) }
+
+// Update applies fn to a copy of s's effective config and installs it,
+// like the package function.
+func (s *Store) Update(fn func(c *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *Config
+	if s.current == nil {
+		next = defaultConfig()
+	} else {
+		next = s.current.clone()
+	}
+	fn(next)
+	s.current = next
+}
+
+// Redacted returns a copy of cfg with API keys, including those of
+// alternate upstreams, and the Redis password masked, for display.
+func (c *Config) Redacted() *Config {
+	out := *c
+	out.Auth.APIKeys = make([]string, len(c.Auth.APIKeys))
+	for i, k := range c.Auth.APIKeys {
+		out.Auth.APIKeys[i] = redactSecret(k)
+	}
+	if c.Auth.KeyOptions != nil {
+		out.Auth.KeyOptions = make(map[string]KeyOptions, len(c.Auth.KeyOptions))
+		for k, v := range c.Auth.KeyOptions {
+			out.Auth.KeyOptions[redactSecret(k)] = v
+		}
+	}
+	if c.AlternateUpstreams != nil {
+		out.AlternateUpstreams = make([]AlternateUpstream, len(c.AlternateUpstreams))
+		for i, u := range c.AlternateUpstreams {
+			if u.APIKey != "" {
+				u.APIKey = redactSecret(u.APIKey)
+			}
+			out.AlternateUpstreams[i] = u
+		}
+	}
+	if c.Telemetry.Headers != nil {
+		out.Telemetry.Headers = make(map[string]string, len(c.Telemetry.Headers))
+		for k, v := range c.Telemetry.Headers {
+			out.Telemetry.Headers[k] = redactSecret(v)
+		}
+	}
+	if c.Notifications.WebhookURL != "" {
+		out.Notifications.WebhookURL = redactURLPath(c.Notifications.WebhookURL)
+	}
+	if u, err := url.Parse(c.Coordination.RedisURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "****")
+			out.Coordination.RedisURL = u.String()
+		}
+	}
+	return &out
+}
+
+// redactURLPath hides the path and query of a URL, where webhook URLs
+// carry their token.
+func redactURLPath(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redactSecret(s)
+	}
+	if u.Path == "" && u.RawQuery == "" {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/****"
+}
+
+// redactSecret keeps the first four characters of a secret.
+func redactSecret(s string) string {
+	if len(s) <= 4 {
+		return "****"
+	}
+	return s[:4] + "****"
 }
 
 // GetExtraPrompt returns the extra prompt for a model, if any.
-func GetExtraPrompt(model string) string {
-	cfg := Get()
+func (c *Config) GetExtraPrompt(model string) string {
+	cfg := c
 	return cfg.ExtraPrompts[model]
 }
 
 // GetReasoningEffort returns the reasoning effort for a model.
 // Defaults to "high" if not configured.
-func GetReasoningEffort(model string) string {
-	cfg := Get()
+func (c *Config) GetReasoningEffort(model string) string {
+	cfg := c
 	if effort, ok := cfg.ModelReasoningEfforts[model]; ok {
 		return effort
 	}
 	return "high"
 }
 
+// ApproveAllWindow returns how long answering "a" at the approval prompt
+// approves every request.
+func (c *Config) ApproveAllWindow() time.Duration {
+	if m := c.Approval.ApproveAllMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return 10 * time.Minute
+}
+
+// CORSMaxAge returns how long, in seconds, browsers cache a preflight
+// response.
+func (c *Config) CORSMaxAge() int {
+	if s := c.CORS.MaxAge; s > 0 {
+		return s
+	}
+	return 300
+}
+
+// HookTimeout returns how long a hook may run.
+func (c *Config) HookTimeout() time.Duration {
+	if ms := c.Hooks.TimeoutMs; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 5 * time.Second
+}
+
+// HistoryMaxBytes returns the size cap of the history file.
+func (c *Config) HistoryMaxBytes() int64 {
+	if mb := c.History.MaxMB; mb > 0 {
+		return int64(mb) << 20
+	}
+	return 100 << 20
+}
+
+// HistoryRetention returns how long history entries are kept.
+func (c *Config) HistoryRetention() time.Duration {
+	if d := c.History.RetentionDays; d > 0 {
+		return time.Duration(d) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+// FailoverThreshold returns how many consecutive Copilot failures open
+// the circuit.
+func (c *Config) FailoverThreshold() int {
+	if n := c.Failover.Threshold; n > 0 {
+		return n
+	}
+	return 3
+}
+
+// RateLimitWarnThreshold returns the remaining percentage of a Copilot rate
+// limit below which a warning is logged.
+func (c *Config) RateLimitWarnThreshold() int {
+	if p := c.RateLimitWarnPercent; p > 0 {
+		return p
+	}
+	return 10
+}
+
+// TelemetryServiceName returns the service.name of exported spans.
+func (c *Config) TelemetryServiceName() string {
+	if name := c.Telemetry.ServiceName; name != "" {
+		return name
+	}
+	return "copilot-proxy"
+}
+
+// FailoverCooldown returns how long the circuit stays open.
+func (c *Config) FailoverCooldown() time.Duration {
+	if s := c.Failover.CooldownSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// NotificationsEnabled reports whether notifications have somewhere to go.
+func (c *Config) NotificationsEnabled() bool {
+	n := c.Notifications
+	return n.WebhookURL != "" || n.Command != ""
+}
+
+// NotifyQuotaPercent returns the premium quota use, in percent, that
+// triggers a notification.
+func (c *Config) NotifyQuotaPercent() int {
+	if p := c.Notifications.QuotaPercent; p > 0 {
+		return p
+	}
+	return 90
+}
+
+// NotifyInterval returns the least time between two notifications of
+// the same event.
+func (c *Config) NotifyInterval() time.Duration {
+	if m := c.Notifications.IntervalMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return 30 * time.Minute
+}
+
+// GetWebhookFormat returns notifications.webhookFormat, "auto" if unset.
+func (c *Config) GetWebhookFormat() string {
+	if f := c.Notifications.WebhookFormat; f != "" {
+		return f
+	}
+	return WebhookFormatAuto
+}
+
+// GetModelPrice returns the configured price of model.
+func (c *Config) GetModelPrice(model string) (ModelPrice, bool) {
+	p, ok := c.ModelPricing[model]
+	return p, ok
+}
+
+// ModelConcurrencyDefault is the modelConcurrency key applying to models
+// without an entry of their own.
+const ModelConcurrencyDefault = "default"
+
+// ModelConcurrencyLimit returns how many upstream requests for model may
+// run at once (0 = unlimited).
+func (c *Config) ModelConcurrencyLimit(model string) int {
+	limits := c.ModelConcurrency
+	if n, ok := limits[model]; ok {
+		return n
+	}
+	return limits[ModelConcurrencyDefault]
+}
+
+// PremiumMultiplierDefault is the premiumMultipliers key applying to
+// models without their own entry or a multiplier from Copilot.
+const PremiumMultiplierDefault = "default"
+
+// PremiumMultiplier returns the premiumMultipliers entry of model; ok is
+// false without one. The "default" entry is not consulted.
+func (c *Config) PremiumMultiplier(model string) (float64, bool) {
+	m, ok := c.PremiumMultipliers[model]
+	return m, ok
+}
+
+// DefaultPremiumMultiplier returns the "default" premiumMultipliers entry,
+// or 1.
+func (c *Config) DefaultPremiumMultiplier() float64 {
+	if m, ok := c.PremiumMultipliers[PremiumMultiplierDefault]; ok {
+		return m
+	}
+	return 1
+}
+
+// GetPremiumDivergenceThreshold returns premiumDivergenceThreshold,
+// defaulting to 5 premium requests.
+func (c *Config) GetPremiumDivergenceThreshold() float64 {
+	if t := c.PremiumDivergenceThreshold; t > 0 {
+		return t
+	}
+	return 5
+}
+
+// Sampling parameter policies (modelSamplingParams).
+const (
+	SamplingForward = "forward"
+	SamplingClamp   = "clamp"
+	SamplingOmit    = "omit"
+)
+
+// ModelSamplingDefault is the modelSamplingParams key applying to models
+// without their own entry.
+const ModelSamplingDefault = "default"
+
+// ModelSamplingPolicy returns the modelSamplingParams policy for model,
+// falling back to the "default" entry; ok is false when neither is set.
+func (c *Config) ModelSamplingPolicy(model string) (string, bool) {
+	policies := c.ModelSamplingParams
+	if p, ok := policies[model]; ok {
+		return p, true
+	}
+	p, ok := policies[ModelSamplingDefault]
+	return p, ok
+}
+
+// ResolveParallelToolCalls decides the parallel_tool_calls value sent
+// upstream for model. A modelToolParallelism entry of false always wins; a
+// client preference (requested) comes next; then a true entry. Returns nil
+// when nothing applies, leaving the backend default.
+func (c *Config) ResolveParallelToolCalls(model string, requested *bool) *bool {
+	allowed, ok := c.ModelToolParallelism[model]
+	switch {
+	case ok && !allowed:
+		return &allowed
+	case requested != nil:
+		v := *requested
+		return &v
+	case ok:
+		return &allowed
+	}
+	return nil
+}
+
+// Tool schema sanitization levels.
+const (
+	SchemaSanitizeOff      = "off"
+	SchemaSanitizeStandard = "standard"
+	SchemaSanitizeStrict   = "strict"
+)
+
+// GetToolSchemaSanitization returns the configured sanitization level,
+// defaulting to "standard".
+func (c *Config) GetToolSchemaSanitization() string {
+	switch mode := c.ToolSchemaSanitization; mode {
+	case SchemaSanitizeOff, SchemaSanitizeStrict:
+		return mode
+	default:
+		return SchemaSanitizeStandard
+	}
+}
+
+// Session pinning modes.
+const (
+	SessionPinningOff   = "off"
+	SessionPinningStrip = "strip"
+	SessionPinningPin   = "pin"
+)
+
+// GetSessionPinning returns the configured session pinning mode,
+// defaulting to "off".
+func (c *Config) GetSessionPinning() string {
+	switch mode := c.SessionPinning; mode {
+	case SessionPinningStrip, SessionPinningPin:
+		return mode
+	default:
+		return SessionPinningOff
+	}
+}
+
+// Anthropic version check modes.
+const (
+	AnthropicVersionReject = "reject"
+	AnthropicVersionWarn   = "warn"
+)
+
+// GetAnthropicVersionCheck returns how unsupported anthropic-version
+// headers are handled, defaulting to "reject".
+func (c *Config) GetAnthropicVersionCheck() string {
+	if c.AnthropicVersionCheck == AnthropicVersionWarn {
+		return AnthropicVersionWarn
+	}
+	return AnthropicVersionReject
+}
+
+// Mid-conversation system message handling.
+const (
+	MidSystemMerge = "merge"
+	MidSystemKeep  = "keep"
+)
+
+// GetMidConversationSystem returns how non-leading system messages are
+// handled, defaulting to "merge".
+func (c *Config) GetMidConversationSystem() string {
+	if c.MidConversationSystem == MidSystemKeep {
+		return MidSystemKeep
+	}
+	return MidSystemMerge
+}
+
+// Responses instructions ordering.
+const (
+	InstructionsOrderLegacy = "legacy"
+	InstructionsOrderCache  = "cache"
+)
+
+// ResponsesInstructionsOrder returns the instructions ordering, defaulting
+// to "legacy".
+func (c *Config) ResponsesInstructionsOrder() string {
+	if c.ResponsesInstructions.Order == InstructionsOrderCache {
+		return InstructionsOrderCache
+	}
+	return InstructionsOrderLegacy
+}
+
+// Handler log routing.
+const (
+	LogRoutingHandler = "handler"
+	LogRoutingModel   = "model"
+)
+
+// ResponseStoreLimits returns the response store's entry cap, TTL, and byte
+// budget, applying defaults for unset fields.
+func (c *Config) ResponseStoreLimits() (maxEntries int, ttl time.Duration, maxBytes int) {
+	cfg := c
+	maxEntries, ttlMinutes, maxMB := cfg.ResponseStoreMaxEntries, cfg.ResponseStoreTTLMinutes, cfg.ResponseStoreMaxMB
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	if ttlMinutes <= 0 {
+		ttlMinutes = 60
+	}
+	if maxMB <= 0 {
+		maxMB = 64
+	}
+	return maxEntries, time.Duration(ttlMinutes) * time.Minute, maxMB << 20
+}
+
+// StreamCoalesceWindow returns how long translated stream deltas may be
+// buffered for merging; zero disables coalescing.
+func (c *Config) StreamCoalesceWindow() time.Duration {
+	if ms := c.StreamCoalesceMs; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 0
+}
+
+// SSEEventLimit returns the largest upstream SSE event accepted.
+func (c *Config) SSEEventLimit() int {
+	if n := c.MaxSSEEventBytes; n > 0 {
+		return n
+	}
+	return 16 << 20
+}
+
+// StreamBufferLimit returns how many bytes a response may hold buffered
+// but unsent before it is dropped.
+func (c *Config) StreamBufferLimit() int {
+	if n := c.MaxStreamBufferBytes; n > 0 {
+		return n
+	}
+	return 64 << 20
+}
+
+// ResponseCacheLimits returns the response cache's TTL, entry cap, and
+// per-response size limit, applying defaults for unset fields.
+func (c *Config) ResponseCacheLimits() (ttl time.Duration, maxEntries, maxBodyBytes int) {
+	rc := c.ResponseCache
+	ttl, err := time.ParseDuration(rc.TTL)
+	if err != nil || ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	maxEntries, maxBodyBytes = rc.MaxEntries, rc.MaxBodyBytes
+	if maxEntries <= 0 {
+		maxEntries = 500
+	}
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = 1 << 20
+	}
+	return ttl, maxEntries, maxBodyBytes
+}
+
+// IdempotencyLimits returns the idempotency cache settings with defaults
+// applied.
+func (c *Config) IdempotencyLimits() (ttl time.Duration, maxEntries int) {
+	ic := c.Idempotency
+	ttl, err := time.ParseDuration(ic.TTL)
+	if err != nil || ttl <= 0 {
+		ttl = time.Hour
+	}
+	maxEntries = ic.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	return ttl, maxEntries
+}
+
+// IsResponseCacheModel reports whether model is cached regardless of
+// temperature.
+func (c *Config) IsResponseCacheModel(model string) bool {
+	for _, m := range c.ResponseCache.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// HedgeDelay returns how long to wait before hedging a request.
+func (c *Config) HedgeDelay() time.Duration {
+	if ms := c.Hedging.DelayMs; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 3 * time.Second
+}
+
+// smallModelFallbacks are tried in order when smallModel is not in the
+// models list.
+var smallModelFallbacks = []string{"gpt-5-mini", "gpt-4.1", "gpt-4o-mini", "gpt-4o"}
+
+// smallModelWarned is the last smallModel substitution logged, so each is
+// logged once.
+var smallModelWarned struct {
+	sync.Mutex
+	key string
+}
+
+// EffectiveSmallModel returns smallModel, or when the models list of s
+// doesn't have it (GitHub removed it), the first of smallModelFallbacks
+// that it has. Before models are fetched, smallModel is trusted.
+func (c *Config) EffectiveSmallModel(s *state.State) string {
+	configured := c.SmallModel
+	if len(s.GetModels()) == 0 || s.FindModel(configured) != nil {
+		return configured
+	}
+	effective := configured
+	for _, m := range smallModelFallbacks {
+		if s.FindModel(m) != nil {
+			effective = m
+			break
+		}
+	}
+
+	smallModelWarned.Lock()
+	defer smallModelWarned.Unlock()
+	if key := configured + "\x00" + effective; smallModelWarned.key != key {
+		smallModelWarned.key = key
+		if effective == configured {
+			slog.Warn(fmt.Sprintf("smallModel %q is not in the Copilot models list and no fallback is available; compact and warmup requests will fail", configured))
+		} else {
+			slog.Warn(fmt.Sprintf("smallModel %q is not in the Copilot models list; using %q for compact and warmup requests", configured, effective))
+		}
+	}
+	return effective
+}
+
+// IsHedgeModel reports whether requests for model may be hedged. Without
+// hedging.models, only the small model (of s's models) is.
+func (c *Config) IsHedgeModel(s *state.State, model string) bool {
+	cfg := c
+	if len(cfg.Hedging.Models) == 0 {
+		return model == c.EffectiveSmallModel(s)
+	}
+	for _, m := range cfg.Hedging.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLogprobsModel reports whether model is in the logprobsModels allowlist.
+func (c *Config) IsLogprobsModel(model string) bool {
+	for _, m := range c.LogprobsModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCodexPhaseModels applies when codexPhaseModels is unset.
+var defaultCodexPhaseModels = []string{"gpt-5.3-codex"}
+
+// UsesCodexPhases reports whether assistant turns for model carry a codex
+// phase, per codexPhaseModels.
+func (c *Config) UsesCodexPhases(model string) bool {
+	models := c.CodexPhaseModels
+	if len(models) == 0 {
+		models = defaultCodexPhaseModels
+	}
+	for _, m := range models {
+		if m != "" && strings.Contains(model, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetKeyOptions returns the per-key settings for an API key, if any.
+func (c *Config) GetKeyOptions(apiKey string) KeyOptions {
+	if apiKey == "" {
+		return KeyOptions{}
+	}
+	return c.Auth.KeyOptions[apiKey]
+}
+
+// AuditLogPath returns the configured audit log path or the default, in
+// s's app directory.
+func (c *Config) AuditLogPath(s *state.State) string {
+	if p := c.Audit.Path; p != "" {
+		return p
+	}
+	return s.AuditLogPath()
+}
+
+// IsMCPToolAllowed reports whether the mutating MCP tool name is listed in
+// mcp.allowedTools.
+func (c *Config) IsMCPToolAllowed(name string) bool {
+	for _, t := range c.MCP.AllowedTools {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Model suffixes select per-request options from the model name; "@"
+// followed by a reasoning effort is the third kind.
+const (
+	ModelSuffixSmall   = "@small"
+	ModelSuffixNoThink = "#nothink"
+)
+
+// IsValidModelSuffix reports whether suffix is a model suffix.
+func IsValidModelSuffix(suffix string) bool {
+	effort, isEffort := strings.CutPrefix(suffix, "@")
+	return suffix == ModelSuffixSmall || suffix == ModelSuffixNoThink || isEffort && validEfforts[effort]
+}
+
+// IsValidReasoningEffort reports whether effort is accepted by the
+// backends.
+func IsValidReasoningEffort(effort string) bool {
+	return validEfforts[effort]
+}
+
+// BatchWorkers returns how many batch requests may run at once.
+func (c *Config) BatchWorkers() int {
+	if n := c.BatchConcurrency; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// ImageLimits returns the image processing limits, applying defaults for
+// unset fields.
+func (c *Config) ImageLimits() (maxBytes, maxDimension int) {
+	cfg := c.ImageProcessing
+	maxBytes, maxDimension = cfg.MaxBytes, cfg.MaxDimension
+	if maxBytes <= 0 {
+		maxBytes = 5 << 20
+	}
+	if maxDimension <= 0 {
+		maxDimension = 2048
+	}
+	return maxBytes, maxDimension
+}
+
+// UpstreamTimeout returns the timeout for an upstream request serving
+// endpoint (a Timeout* constant), or 0 for none. Without a configured value,
+// generation endpoints default to 10 minutes, doubled at high or xhigh
+// reasoning effort.
+func (c *Config) UpstreamTimeout(endpoint, effort string) time.Duration {
+	t := c.Timeouts
+	configured := map[string]string{
+		TimeoutMessages:        t.Messages,
+		TimeoutChatCompletions: t.ChatCompletions,
+		TimeoutResponses:       t.Responses,
+		TimeoutEmbeddings:      t.Embeddings,
+	}[endpoint]
+	if configured != "" {
+		if d, err := time.ParseDuration(configured); err == nil && d >= 0 {
+			return d
+		}
+	}
+	if endpoint == TimeoutEmbeddings {
+		return 30 * time.Second
+	}
+	if effort == "high" || effort == "xhigh" {
+		return 20 * time.Minute
+	}
+	return 10 * time.Minute
+}
+
+// CoordinationNamespace returns the key prefix for shared state.
+func (c *Config) CoordinationNamespace() string {
+	if ns := c.Coordination.Namespace; ns != "" {
+		return ns
+	}
+	return "copilot-proxy"
+}
+
+// KeyLabel returns a loggable name for an API key: its configured label,
+// or a redacted prefix.
+func (c *Config) KeyLabel(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	if label := c.GetKeyOptions(apiKey).Label; label != "" {
+		return label
+	}
+	return redactSecret(apiKey)
+}
+
 // GetAPIKeys returns the configured API keys (normalized).
-func GetAPIKeys() []string {
-	cfg := Get()
+func (c *Config) GetAPIKeys() []string {
+	cfg := c
 	return normalizeAPIKeys(cfg.Auth.APIKeys)
 }
 
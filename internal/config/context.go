@@ -0,0 +1,28 @@
+package config
+
+import "context"
+
+type storeKey struct{}
+
+// WithStore returns a context whose request is served with the config of
+// s.
+func WithStore(ctx context.Context, s *Store) context.Context {
+	return context.WithValue(ctx, storeKey{}, s)
+}
+
+// StoreFromContext returns the config store of the proxy instance serving
+// ctx's request. A context without one is a wiring bug, so it panics
+// rather than serve the request with another instance's config.
+func StoreFromContext(ctx context.Context) *Store {
+	s, ok := ctx.Value(storeKey{}).(*Store)
+	if !ok {
+		panic("config: context carries no proxy instance config")
+	}
+	return s
+}
+
+// FromContext returns the current config of the proxy instance serving
+// ctx's request (see StoreFromContext).
+func FromContext(ctx context.Context) *Config {
+	return StoreFromContext(ctx).Get()
+}
@@ -0,0 +1,648 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is prepended to every environment variable that overrides a
+// config field, e.g. COPILOT_PROXY_SMALL_MODEL.
+const EnvPrefix = "COPILOT_PROXY_"
+
+// Source identifies where the effective value of a config field came from.
+// Precedence, highest first: flag > env > file > default.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Field describes a config field that can be overridden from the
+// environment or the command line.
+type Field struct {
+	Path string // JSON path, e.g. "auth.apiKeys"
+	Env  string // environment variable name
+	set  func(cfg *Config, value string) error
+}
+
+// Fields lists every overridable config field in display order.
+var Fields = []Field{
+	{Path: "auth.apiKeys", Env: EnvPrefix + "API_KEYS", set: func(c *Config, v string) error {
+		c.Auth.APIKeys = splitList(v)
+		return nil
+	}},
+	{Path: "auth.publicHealthz", Env: EnvPrefix + "PUBLIC_HEALTHZ", set: func(c *Config, v string) error {
+		return parseBool(v, &c.Auth.PublicHealthz)
+	}},
+	{Path: "auth.exposeToken", Env: EnvPrefix + "EXPOSE_TOKEN", set: func(c *Config, v string) error {
+		return parseBool(v, &c.Auth.ExposeToken)
+	}},
+	{Path: "auth.keyOptions", Env: EnvPrefix + "KEY_OPTIONS", set: func(c *Config, v string) error {
+		var m map[string]KeyOptions
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			return fmt.Errorf("invalid JSON object: %w", err)
+		}
+		c.Auth.KeyOptions = m
+		return nil
+	}},
+	{Path: "extraPrompts", Env: EnvPrefix + "EXTRA_PROMPTS", set: func(c *Config, v string) error {
+		return parseMap(v, &c.ExtraPrompts)
+	}},
+	{Path: "promptPresets", Env: EnvPrefix + "PROMPT_PRESETS", set: func(c *Config, v string) error {
+		return parseMap(v, &c.PromptPresets)
+	}},
+	{Path: "smallModel", Env: EnvPrefix + "SMALL_MODEL", set: func(c *Config, v string) error {
+		c.SmallModel = strings.TrimSpace(v)
+		return nil
+	}},
+	{Path: "modelReasoningEfforts", Env: EnvPrefix + "MODEL_REASONING_EFFORTS", set: func(c *Config, v string) error {
+		return parseMap(v, &c.ModelReasoningEfforts)
+	}},
+	{Path: "modelToolParallelism", Env: EnvPrefix + "MODEL_TOOL_PARALLELISM", set: func(c *Config, v string) error {
+		m := make(map[string]bool)
+		if strings.HasPrefix(strings.TrimSpace(v), "{") {
+			if err := json.Unmarshal([]byte(v), &m); err != nil {
+				return fmt.Errorf("invalid JSON object: %w", err)
+			}
+			c.ModelToolParallelism = m
+			return nil
+		}
+		var raw map[string]string
+		if err := parseMap(v, &raw); err != nil {
+			return err
+		}
+		for model, allowed := range raw {
+			var b bool
+			if err := parseBool(allowed, &b); err != nil {
+				return fmt.Errorf("%s: %w", model, err)
+			}
+			m[model] = b
+		}
+		c.ModelToolParallelism = m
+		return nil
+	}},
+	{Path: "modelSamplingParams", Env: EnvPrefix + "MODEL_SAMPLING_PARAMS", set: func(c *Config, v string) error {
+		return parseMap(v, &c.ModelSamplingParams)
+	}},
+	{Path: "modelOverrides", Env: EnvPrefix + "MODEL_OVERRIDES", set: func(c *Config, v string) error {
+		m := make(map[string]json.RawMessage)
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			return fmt.Errorf("invalid JSON object: %w", err)
+		}
+		c.ModelOverrides = m
+		return nil
+	}},
+	{Path: "premiumMultipliers", Env: EnvPrefix + "PREMIUM_MULTIPLIERS", set: func(c *Config, v string) error {
+		var raw map[string]string
+		if err := parseMap(v, &raw); err != nil {
+			return err
+		}
+		m := make(map[string]float64, len(raw))
+		for model, s := range raw {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || f < 0 {
+				return fmt.Errorf("%s: expected a non-negative number, got %q", model, s)
+			}
+			m[model] = f
+		}
+		c.PremiumMultipliers = m
+		return nil
+	}},
+	{Path: "premiumDivergenceThreshold", Env: EnvPrefix + "PREMIUM_DIVERGENCE_THRESHOLD", set: func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("expected a non-negative number, got %q", v)
+		}
+		c.PremiumDivergenceThreshold = f
+		return nil
+	}},
+	{Path: "modelConcurrency", Env: EnvPrefix + "MODEL_CONCURRENCY", set: func(c *Config, v string) error {
+		m := make(map[string]int)
+		if strings.HasPrefix(strings.TrimSpace(v), "{") {
+			if err := json.Unmarshal([]byte(v), &m); err != nil {
+				return fmt.Errorf("invalid JSON object: %w", err)
+			}
+			c.ModelConcurrency = m
+			return nil
+		}
+		var raw map[string]string
+		if err := parseMap(v, &raw); err != nil {
+			return err
+		}
+		for model, limit := range raw {
+			var n int
+			if err := parseNonNegativeInt(limit, &n); err != nil {
+				return fmt.Errorf("%s: %w", model, err)
+			}
+			m[model] = n
+		}
+		c.ModelConcurrency = m
+		return nil
+	}},
+	{Path: "modelPricing", Env: EnvPrefix + "MODEL_PRICING", set: func(c *Config, v string) error {
+		m := make(map[string]ModelPrice)
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			return fmt.Errorf("invalid JSON object: %w", err)
+		}
+		c.ModelPricing = m
+		return nil
+	}},
+	{Path: "advertiseModelSuffixes", Env: EnvPrefix + "ADVERTISE_MODEL_SUFFIXES", set: func(c *Config, v string) error {
+		c.AdvertiseModelSuffixes = splitList(v)
+		return nil
+	}},
+	{Path: "sessionPinning", Env: EnvPrefix + "SESSION_PINNING", set: func(c *Config, v string) error {
+		switch v = strings.TrimSpace(v); v {
+		case SessionPinningOff, SessionPinningStrip, SessionPinningPin:
+			c.SessionPinning = v
+			return nil
+		}
+		return fmt.Errorf("expected off, strip, or pin, got %q", v)
+	}},
+	{Path: "anthropicVersionCheck", Env: EnvPrefix + "ANTHROPIC_VERSION_CHECK", set: func(c *Config, v string) error {
+		switch v = strings.TrimSpace(v); v {
+		case AnthropicVersionReject, AnthropicVersionWarn:
+			c.AnthropicVersionCheck = v
+			return nil
+		}
+		return fmt.Errorf("expected reject or warn, got %q", v)
+	}},
+	{Path: "toolSchemaSanitization", Env: EnvPrefix + "TOOL_SCHEMA_SANITIZATION", set: func(c *Config, v string) error {
+		switch v = strings.TrimSpace(v); v {
+		case SchemaSanitizeOff, SchemaSanitizeStandard, SchemaSanitizeStrict:
+			c.ToolSchemaSanitization = v
+			return nil
+		}
+		return fmt.Errorf("expected off, standard, or strict, got %q", v)
+	}},
+	{Path: "dropInvalidTools", Env: EnvPrefix + "DROP_INVALID_TOOLS", set: func(c *Config, v string) error {
+		return parseBool(v, &c.DropInvalidTools)
+	}},
+	{Path: "maxTools", Env: EnvPrefix + "MAX_TOOLS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.MaxTools)
+	}},
+	{Path: "maxToolSchemaTokens", Env: EnvPrefix + "MAX_TOOL_SCHEMA_TOKENS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.MaxToolSchemaTokens)
+	}},
+	{Path: "trimTools", Env: EnvPrefix + "TRIM_TOOLS", set: func(c *Config, v string) error {
+		return parseBool(v, &c.TrimTools)
+	}},
+	{Path: "repairToolPairs", Env: EnvPrefix + "REPAIR_TOOL_PAIRS", set: func(c *Config, v string) error {
+		return parseBool(v, &c.RepairToolPairs)
+	}},
+	{Path: "forwardUnknownFields", Env: EnvPrefix + "FORWARD_UNKNOWN_FIELDS", set: func(c *Config, v string) error {
+		return parseMap(v, &c.ForwardUnknownFields)
+	}},
+	{Path: "midConversationSystem", Env: EnvPrefix + "MID_CONVERSATION_SYSTEM", set: func(c *Config, v string) error {
+		switch v = strings.TrimSpace(v); v {
+		case MidSystemMerge, MidSystemKeep:
+			c.MidConversationSystem = v
+			return nil
+		}
+		return fmt.Errorf("expected merge or keep, got %q", v)
+	}},
+	{Path: "chatCompletionFanOut", Env: EnvPrefix + "CHAT_COMPLETION_FAN_OUT", set: func(c *Config, v string) error {
+		return parseBool(v, &c.ChatCompletionFanOut)
+	}},
+	{Path: "foldThinkingIntoContent", Env: EnvPrefix + "FOLD_THINKING_INTO_CONTENT", set: func(c *Config, v string) error {
+		return parseBool(v, &c.FoldThinkingIntoContent)
+	}},
+	{Path: "logprobsModels", Env: EnvPrefix + "LOGPROBS_MODELS", set: func(c *Config, v string) error {
+		c.LogprobsModels = splitList(v)
+		return nil
+	}},
+	{Path: "responseStoreMaxEntries", Env: EnvPrefix + "RESPONSE_STORE_MAX_ENTRIES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.ResponseStoreMaxEntries)
+	}},
+	{Path: "responseStoreTTLMinutes", Env: EnvPrefix + "RESPONSE_STORE_TTL_MINUTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.ResponseStoreTTLMinutes)
+	}},
+	{Path: "responseStoreMaxMB", Env: EnvPrefix + "RESPONSE_STORE_MAX_MB", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.ResponseStoreMaxMB)
+	}},
+	{Path: "streamCoalesceMs", Env: EnvPrefix + "STREAM_COALESCE_MS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.StreamCoalesceMs)
+	}},
+	{Path: "eagerTextBlocks", Env: EnvPrefix + "EAGER_TEXT_BLOCKS", set: func(c *Config, v string) error {
+		return parseBool(v, &c.EagerTextBlocks)
+	}},
+	{Path: "maxStreamOutputTokens", Env: EnvPrefix + "MAX_STREAM_OUTPUT_TOKENS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.MaxStreamOutputTokens)
+	}},
+	{Path: "salvagePartialStreams", Env: EnvPrefix + "SALVAGE_PARTIAL_STREAMS", set: func(c *Config, v string) error {
+		return parseBool(v, &c.SalvagePartialStreams)
+	}},
+	{Path: "maxSSEEventBytes", Env: EnvPrefix + "MAX_SSE_EVENT_BYTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.MaxSSEEventBytes)
+	}},
+	{Path: "maxStreamBufferBytes", Env: EnvPrefix + "MAX_STREAM_BUFFER_BYTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.MaxStreamBufferBytes)
+	}},
+	{Path: "responseCache.enabled", Env: EnvPrefix + "RESPONSE_CACHE_ENABLED", set: func(c *Config, v string) error {
+		return parseBool(v, &c.ResponseCache.Enabled)
+	}},
+	{Path: "responseCache.ttl", Env: EnvPrefix + "RESPONSE_CACHE_TTL", set: func(c *Config, v string) error {
+		v = strings.TrimSpace(v)
+		if _, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		c.ResponseCache.TTL = v
+		return nil
+	}},
+	{Path: "responseCache.maxEntries", Env: EnvPrefix + "RESPONSE_CACHE_MAX_ENTRIES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.ResponseCache.MaxEntries)
+	}},
+	{Path: "responseCache.maxBodyBytes", Env: EnvPrefix + "RESPONSE_CACHE_MAX_BODY_BYTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.ResponseCache.MaxBodyBytes)
+	}},
+	{Path: "idempotency.ttl", Env: EnvPrefix + "IDEMPOTENCY_TTL", set: func(c *Config, v string) error {
+		v = strings.TrimSpace(v)
+		if _, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		c.Idempotency.TTL = v
+		return nil
+	}},
+	{Path: "idempotency.maxEntries", Env: EnvPrefix + "IDEMPOTENCY_MAX_ENTRIES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Idempotency.MaxEntries)
+	}},
+	{Path: "responseCache.models", Env: EnvPrefix + "RESPONSE_CACHE_MODELS", set: func(c *Config, v string) error {
+		c.ResponseCache.Models = splitList(v)
+		return nil
+	}},
+	{Path: "hedging.enabled", Env: EnvPrefix + "HEDGING_ENABLED", set: func(c *Config, v string) error {
+		return parseBool(v, &c.Hedging.Enabled)
+	}},
+	{Path: "hedging.delayMs", Env: EnvPrefix + "HEDGING_DELAY_MS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Hedging.DelayMs)
+	}},
+	{Path: "hedging.models", Env: EnvPrefix + "HEDGING_MODELS", set: func(c *Config, v string) error {
+		c.Hedging.Models = splitList(v)
+		return nil
+	}},
+	{Path: "redactions", Env: EnvPrefix + "REDACTIONS", set: func(c *Config, v string) error {
+		var rules []RedactionRule
+		if err := json.Unmarshal([]byte(v), &rules); err != nil {
+			return fmt.Errorf("invalid JSON array: %w", err)
+		}
+		c.Redactions = rules
+		return nil
+	}},
+	{Path: "audit.enabled", Env: EnvPrefix + "AUDIT_ENABLED", set: func(c *Config, v string) error {
+		return parseBool(v, &c.Audit.Enabled)
+	}},
+	{Path: "audit.path", Env: EnvPrefix + "AUDIT_PATH", set: func(c *Config, v string) error {
+		c.Audit.Path = strings.TrimSpace(v)
+		return nil
+	}},
+	{Path: "approval.followUpMinutes", Env: EnvPrefix + "APPROVAL_FOLLOW_UP_MINUTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Approval.FollowUpMinutes)
+	}},
+	{Path: "approval.endpoints", Env: EnvPrefix + "APPROVAL_ENDPOINTS", set: func(c *Config, v string) error {
+		c.Approval.Endpoints = splitList(v)
+		return nil
+	}},
+	{Path: "approval.approveAllMinutes", Env: EnvPrefix + "APPROVAL_APPROVE_ALL_MINUTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Approval.ApproveAllMinutes)
+	}},
+	{Path: "cors.allowedOrigins", Env: EnvPrefix + "CORS_ALLOWED_ORIGINS", set: func(c *Config, v string) error {
+		c.CORS.AllowedOrigins = splitList(v)
+		return nil
+	}},
+	{Path: "cors.allowedHeaders", Env: EnvPrefix + "CORS_ALLOWED_HEADERS", set: func(c *Config, v string) error {
+		c.CORS.AllowedHeaders = splitList(v)
+		return nil
+	}},
+	{Path: "cors.allowCredentials", Env: EnvPrefix + "CORS_ALLOW_CREDENTIALS", set: func(c *Config, v string) error {
+		return parseBool(v, &c.CORS.AllowCredentials)
+	}},
+	{Path: "cors.maxAge", Env: EnvPrefix + "CORS_MAX_AGE", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.CORS.MaxAge)
+	}},
+	{Path: "hooks.preRequest", Env: EnvPrefix + "HOOKS_PRE_REQUEST", set: func(c *Config, v string) error {
+		c.Hooks.PreRequest = splitList(v)
+		return nil
+	}},
+	{Path: "hooks.timeoutMs", Env: EnvPrefix + "HOOKS_TIMEOUT_MS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Hooks.TimeoutMs)
+	}},
+	{Path: "alternateUpstreams", Env: EnvPrefix + "ALTERNATE_UPSTREAMS", set: func(c *Config, v string) error {
+		var upstreams []AlternateUpstream
+		if err := json.Unmarshal([]byte(v), &upstreams); err != nil {
+			return fmt.Errorf("invalid JSON array: %w", err)
+		}
+		c.AlternateUpstreams = upstreams
+		return nil
+	}},
+	{Path: "failover.threshold", Env: EnvPrefix + "FAILOVER_THRESHOLD", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Failover.Threshold)
+	}},
+	{Path: "failover.cooldownSeconds", Env: EnvPrefix + "FAILOVER_COOLDOWN_SECONDS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Failover.CooldownSeconds)
+	}},
+	{Path: "notifications.webhookURL", Env: EnvPrefix + "NOTIFICATIONS_WEBHOOK_URL", set: func(c *Config, v string) error {
+		c.Notifications.WebhookURL = v
+		return nil
+	}},
+	{Path: "notifications.webhookFormat", Env: EnvPrefix + "NOTIFICATIONS_WEBHOOK_FORMAT", set: func(c *Config, v string) error {
+		c.Notifications.WebhookFormat = v
+		return nil
+	}},
+	{Path: "notifications.command", Env: EnvPrefix + "NOTIFICATIONS_COMMAND", set: func(c *Config, v string) error {
+		c.Notifications.Command = v
+		return nil
+	}},
+	{Path: "notifications.quotaPercent", Env: EnvPrefix + "NOTIFICATIONS_QUOTA_PERCENT", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Notifications.QuotaPercent)
+	}},
+	{Path: "notifications.intervalMinutes", Env: EnvPrefix + "NOTIFICATIONS_INTERVAL_MINUTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.Notifications.IntervalMinutes)
+	}},
+	{Path: "rateLimitWarnPercent", Env: EnvPrefix + "RATE_LIMIT_WARN_PERCENT", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.RateLimitWarnPercent)
+	}},
+	{Path: "telemetry.otlpEndpoint", Env: EnvPrefix + "TELEMETRY_OTLP_ENDPOINT", set: func(c *Config, v string) error {
+		c.Telemetry.OTLPEndpoint = v
+		return nil
+	}},
+	{Path: "telemetry.headers", Env: EnvPrefix + "TELEMETRY_HEADERS", set: func(c *Config, v string) error {
+		return parseMap(v, &c.Telemetry.Headers)
+	}},
+	{Path: "telemetry.serviceName", Env: EnvPrefix + "TELEMETRY_SERVICE_NAME", set: func(c *Config, v string) error {
+		c.Telemetry.ServiceName = v
+		return nil
+	}},
+	{Path: "history.enabled", Env: EnvPrefix + "HISTORY_ENABLED", set: func(c *Config, v string) error {
+		return parseBool(v, &c.History.Enabled)
+	}},
+	{Path: "history.maxMB", Env: EnvPrefix + "HISTORY_MAX_MB", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.History.MaxMB)
+	}},
+	{Path: "history.retentionDays", Env: EnvPrefix + "HISTORY_RETENTION_DAYS", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.History.RetentionDays)
+	}},
+	{Path: "batchConcurrency", Env: EnvPrefix + "BATCH_CONCURRENCY", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.BatchConcurrency)
+	}},
+	{Path: "mcp.allowedTools", Env: EnvPrefix + "MCP_ALLOWED_TOOLS", set: func(c *Config, v string) error {
+		c.MCP.AllowedTools = splitList(v)
+		return nil
+	}},
+	{Path: "imageProcessing.enabled", Env: EnvPrefix + "IMAGE_PROCESSING_ENABLED", set: func(c *Config, v string) error {
+		return parseBool(v, &c.ImageProcessing.Enabled)
+	}},
+	{Path: "imageProcessing.maxBytes", Env: EnvPrefix + "IMAGE_PROCESSING_MAX_BYTES", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.ImageProcessing.MaxBytes)
+	}},
+	{Path: "imageProcessing.maxDimension", Env: EnvPrefix + "IMAGE_PROCESSING_MAX_DIMENSION", set: func(c *Config, v string) error {
+		return parseNonNegativeInt(v, &c.ImageProcessing.MaxDimension)
+	}},
+	{Path: "timeouts.messages", Env: EnvPrefix + "TIMEOUTS_MESSAGES", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.Timeouts.Messages)
+	}},
+	{Path: "timeouts.chatCompletions", Env: EnvPrefix + "TIMEOUTS_CHAT_COMPLETIONS", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.Timeouts.ChatCompletions)
+	}},
+	{Path: "timeouts.responses", Env: EnvPrefix + "TIMEOUTS_RESPONSES", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.Timeouts.Responses)
+	}},
+	{Path: "timeouts.embeddings", Env: EnvPrefix + "TIMEOUTS_EMBEDDINGS", set: func(c *Config, v string) error {
+		return parseDuration(v, &c.Timeouts.Embeddings)
+	}},
+	{Path: "codexPhaseModels", Env: EnvPrefix + "CODEX_PHASE_MODELS", set: func(c *Config, v string) error {
+		c.CodexPhaseModels = splitList(v)
+		return nil
+	}},
+	{Path: "reasoningSummaryFallback", Env: EnvPrefix + "REASONING_SUMMARY_FALLBACK", set: func(c *Config, v string) error {
+		return parseBool(v, &c.ReasoningSummaryFallback)
+	}},
+	{Path: "logRouting", Env: EnvPrefix + "LOG_ROUTING", set: func(c *Config, v string) error {
+		switch v = strings.TrimSpace(v); v {
+		case LogRoutingHandler, LogRoutingModel:
+			c.LogRouting = v
+			return nil
+		}
+		return fmt.Errorf("expected handler or model, got %q", v)
+	}},
+	{Path: "coordination.redisURL", Env: EnvPrefix + "COORDINATION_REDIS_URL", set: func(c *Config, v string) error {
+		c.Coordination.RedisURL = strings.TrimSpace(v)
+		return nil
+	}},
+	{Path: "coordination.namespace", Env: EnvPrefix + "COORDINATION_NAMESPACE", set: func(c *Config, v string) error {
+		c.Coordination.Namespace = strings.TrimSpace(v)
+		return nil
+	}},
+	{Path: "coordination.instanceID", Env: EnvPrefix + "COORDINATION_INSTANCE_ID", set: func(c *Config, v string) error {
+		c.Coordination.InstanceID = strings.TrimSpace(v)
+		return nil
+	}},
+	{Path: "editorIdentity.vscodeVersion", Env: EnvPrefix + "EDITOR_IDENTITY_VSCODE_VERSION", set: func(c *Config, v string) error {
+		return parseVersion(v, &c.EditorIdentity.VSCodeVersion)
+	}},
+	{Path: "editorIdentity.copilotChatVersion", Env: EnvPrefix + "EDITOR_IDENTITY_COPILOT_CHAT_VERSION", set: func(c *Config, v string) error {
+		return parseVersion(v, &c.EditorIdentity.CopilotChatVersion)
+	}},
+	{Path: "editorIdentity.apiVersion", Env: EnvPrefix + "EDITOR_IDENTITY_API_VERSION", set: func(c *Config, v string) error {
+		v = strings.TrimSpace(v)
+		if _, err := time.Parse(time.DateOnly, v); err != nil {
+			return fmt.Errorf("expected a date such as 2025-10-01, got %q", v)
+		}
+		c.EditorIdentity.APIVersion = v
+		return nil
+	}},
+	{Path: "editorIdentity.fetchCopilotChatVersion", Env: EnvPrefix + "EDITOR_IDENTITY_FETCH_COPILOT_CHAT_VERSION", set: func(c *Config, v string) error {
+		return parseBool(v, &c.EditorIdentity.FetchCopilotChatVersion)
+	}},
+	{Path: "debug.allowBackendOverride", Env: EnvPrefix + "DEBUG_ALLOW_BACKEND_OVERRIDE", set: func(c *Config, v string) error {
+		return parseBool(v, &c.Debug.AllowBackendOverride)
+	}},
+	{Path: "responsesInstructions.order", Env: EnvPrefix + "RESPONSES_INSTRUCTIONS_ORDER", set: func(c *Config, v string) error {
+		switch v = strings.TrimSpace(v); v {
+		case InstructionsOrderLegacy, InstructionsOrderCache:
+			c.ResponsesInstructions.Order = v
+			return nil
+		}
+		return fmt.Errorf("expected legacy or cache, got %q", v)
+	}},
+	{Path: "responsesInstructions.logHashes", Env: EnvPrefix + "RESPONSES_INSTRUCTIONS_LOG_HASHES", set: func(c *Config, v string) error {
+		return parseBool(v, &c.ResponsesInstructions.LogHashes)
+	}},
+	{Path: "useFunctionApplyPatch", Env: EnvPrefix + "USE_FUNCTION_APPLY_PATCH", set: func(c *Config, v string) error {
+		return parseBool(v, &c.UseFunctionApplyPatch)
+	}},
+	{Path: "compactUseSmallModel", Env: EnvPrefix + "COMPACT_USE_SMALL_MODEL", set: func(c *Config, v string) error {
+		return parseBool(v, &c.CompactUseSmallModel)
+	}},
+	{Path: "disableUpdateCheck", Env: EnvPrefix + "DISABLE_UPDATE_CHECK", set: func(c *Config, v string) error {
+		return parseBool(v, &c.DisableUpdateCheck)
+	}},
+}
+
+// SetFlagOverrides registers "field=value" overrides from the command line
+// (e.g. --set smallModel=gpt-4.1). Must be called before Load.
+func SetFlagOverrides(sets []string) error { return Global.SetFlagOverrides(sets) }
+
+// SetFlagOverrides registers "field=value" overrides applied by s.Load, like
+// the package function.
+func (s *Store) SetFlagOverrides(sets []string) error {
+	var parsed [][2]string
+	for _, set := range sets {
+		path, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return fmt.Errorf("invalid --set %q: expected field=value", set)
+		}
+		f := lookupField(path)
+		if f == nil {
+			return fmt.Errorf("invalid --set %q: unknown config field %q", set, path)
+		}
+		// Parse once up front so bad values fail fast instead of at load time
+		if err := f.set(defaultConfig(), value); err != nil {
+			return fmt.Errorf("invalid --set %q: %w", set, err)
+		}
+		parsed = append(parsed, [2]string{path, value})
+	}
+
+	s.mu.Lock()
+	s.flagOverrides = parsed
+	s.mu.Unlock()
+	return nil
+}
+
+// Sources returns the source of each overridable field's effective value,
+// keyed by JSON path.
+func Sources() map[string]Source { return Global.Sources() }
+
+// Sources returns the source of each overridable field of s's config.
+func (s *Store) Sources() map[string]Source {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]Source, len(Fields))
+	for _, f := range Fields {
+		out[f.Path] = SourceDefault
+	}
+	for k, v := range s.sources {
+		out[k] = v
+	}
+	return out
+}
+
+// applyOverrides overlays environment variables and then command-line
+// overrides onto cfg, recording each field's source. Invalid environment
+// values are skipped and returned as warnings.
+func applyOverrides(cfg *Config, src map[string]Source, flags [][2]string) []string {
+	var warnings []string
+	for _, f := range Fields {
+		v, ok := os.LookupEnv(f.Env)
+		if !ok {
+			continue
+		}
+		if err := f.set(cfg, v); err != nil {
+			warnings = append(warnings, fmt.Sprintf("ignoring %s: %v", f.Env, err))
+			continue
+		}
+		src[f.Path] = SourceEnv
+	}
+	for _, o := range flags {
+		// Validated by SetFlagOverrides
+		lookupField(o[0]).set(cfg, o[1])
+		src[o[0]] = SourceFlag
+	}
+	return warnings
+}
+
+// fileSources marks every overridable field present in the raw config file.
+func fileSources(data []byte) map[string]Source {
+	src := make(map[string]Source)
+	keys, _ := scanKeys(data)
+	for _, k := range keys {
+		if lookupField(k.path) != nil {
+			src[k.path] = SourceFile
+		}
+	}
+	return src
+}
+
+func lookupField(path string) *Field {
+	for i := range Fields {
+		if Fields[i].Path == path {
+			return &Fields[i]
+		}
+	}
+	return nil
+}
+
+func parseBool(v string, dst *bool) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("expected true or false, got %q", v)
+	}
+	*dst = b
+	return nil
+}
+
+func parseVersion(v string, dst *string) error {
+	v = strings.TrimSpace(v)
+	if !versionRe.MatchString(v) {
+		return fmt.Errorf("expected a version such as 1.109.3, got %q", v)
+	}
+	*dst = v
+	return nil
+}
+
+func parseNonNegativeInt(v string, dst *int) error {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return fmt.Errorf("expected a non-negative integer, got %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+// parseDuration accepts a non-negative duration such as "8m" or "0".
+func parseDuration(v string, dst *string) error {
+	v = strings.TrimSpace(v)
+	if d, err := time.ParseDuration(v); err != nil || d < 0 {
+		return fmt.Errorf("expected a duration such as \"8m\", got %q", v)
+	}
+	*dst = v
+	return nil
+}
+
+// splitList parses a comma-separated list, dropping empty entries.
+func splitList(v string) []string {
+	out := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// parseMap accepts either a JSON object or comma-separated key=value pairs.
+func parseMap(v string, dst *map[string]string) error {
+	m := make(map[string]string)
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			return fmt.Errorf("invalid JSON object: %w", err)
+		}
+	} else {
+		for _, pair := range splitList(v) {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	*dst = m
+	return nil
+}
@@ -0,0 +1,886 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Issue is a single problem found while validating a config file.
+type Issue struct {
+	Severity string // "error" or "warning"
+	Field    string // dotted JSON path, e.g. "auth.apiKeys"
+	Line     int    // 1-based line in the file, 0 if unknown
+	Message  string
+}
+
+func (i Issue) String() string {
+	loc := i.Field
+	if i.Line > 0 {
+		loc = fmt.Sprintf("line %d: %s", i.Line, i.Field)
+	}
+	if loc == "" {
+		return fmt.Sprintf("%s: %s", i.Severity, i.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", i.Severity, loc, i.Message)
+}
+
+// validEfforts are the reasoning effort values accepted by the backends.
+var validEfforts = map[string]bool{
+	"none": true, "minimal": true, "low": true, "medium": true, "high": true, "xhigh": true,
+}
+
+// versionRe matches the editor versions in editorIdentity.
+var versionRe = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// MutatingMCPTools are the MCP tools that change settings and must be
+// listed in mcp.allowedTools.
+var MutatingMCPTools = []string{"set_small_model", "switch_reasoning_effort"}
+
+// ApprovalEndpoints maps the names approval.endpoints accepts to their
+// request paths.
+var ApprovalEndpoints = map[string][]string{
+	"count_tokens": {"/v1/messages/count_tokens"},
+	"models":       {"/models", "/v1/models"},
+	"embeddings":   {"/embeddings", "/v1/embeddings"},
+	"usage":        {"/usage"},
+}
+
+// HasErrors reports whether any issue is an error (as opposed to a warning).
+func HasErrors(issues []Issue) bool {
+	for _, i := range issues {
+		if i.Severity == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks raw config.json contents. Unknown keys and suspicious values
+// are reported as warnings; syntax and type errors as errors. If models is
+// non-empty, model references are checked against it.
+func Validate(data []byte, models []string) []Issue {
+	var issues []Issue
+
+	// Syntax and type errors
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return append(issues, Issue{
+				Severity: "error",
+				Line:     lineAt(data, syntaxErr.Offset),
+				Message:  syntaxErr.Error(),
+			})
+		case errors.As(err, &typeErr):
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    typeErr.Field,
+				Line:     lineAt(data, typeErr.Offset),
+				Message:  fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value),
+			})
+		default:
+			return append(issues, Issue{Severity: "error", Message: err.Error()})
+		}
+	}
+
+	// Unknown keys (all of them, not just the first as DisallowUnknownFields would)
+	keys, err := scanKeys(data)
+	if err == nil {
+		for _, k := range keys {
+			if !knownPath(reflect.TypeOf(Config{}), strings.Split(k.path, ".")) {
+				issues = append(issues, Issue{
+					Severity: "warning",
+					Field:    k.path,
+					Line:     lineAt(data, k.offset),
+					Message:  "unknown key (ignored)" + suggest(k.path),
+				})
+			}
+		}
+	}
+
+	issues = append(issues, validateValues(&cfg, models, keys, data)...)
+	return issues
+}
+
+// validateValues checks semantic constraints on a decoded config.
+func validateValues(cfg *Config, models []string, keys []keyPos, data []byte) []Issue {
+	var issues []Issue
+	line := func(path string) int {
+		for _, k := range keys {
+			if k.path == path {
+				return lineAt(data, k.offset)
+			}
+		}
+		return 0
+	}
+
+	seen := make(map[string]bool)
+	for i, k := range cfg.Auth.APIKeys {
+		k = strings.TrimSpace(k)
+		field := fmt.Sprintf("auth.apiKeys[%d]", i)
+		if k == "" {
+			issues = append(issues, Issue{Severity: "warning", Field: field, Line: line("auth.apiKeys"), Message: "empty API key (ignored)"})
+			continue
+		}
+		if seen[k] {
+			issues = append(issues, Issue{Severity: "warning", Field: field, Line: line("auth.apiKeys"), Message: "duplicate API key"})
+		}
+		seen[k] = true
+	}
+
+	if cfg.Auth.ExposeToken && len(seen) == 0 {
+		issues = append(issues, Issue{
+			Severity: "warning",
+			Field:    "auth.exposeToken",
+			Line:     line("auth.exposeToken"),
+			Message:  "the token endpoints require an API key; without auth.apiKeys they refuse every request",
+		})
+	}
+
+	keyOptionKeys := make([]string, 0, len(cfg.Auth.KeyOptions))
+	for k := range cfg.Auth.KeyOptions {
+		keyOptionKeys = append(keyOptionKeys, k)
+	}
+	sort.Strings(keyOptionKeys)
+	for _, key := range keyOptionKeys {
+		opts := cfg.Auth.KeyOptions[key]
+		field := "auth.keyOptions." + redactSecret(key)
+		if opts.DefaultInitiator != "" && opts.DefaultInitiator != "agent" && opts.DefaultInitiator != "user" {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    field + ".defaultInitiator",
+				Line:     line("auth.keyOptions." + key),
+				Message:  fmt.Sprintf("invalid initiator %q (expected agent or user)", opts.DefaultInitiator),
+			})
+		}
+		if !seen[strings.TrimSpace(key)] {
+			issues = append(issues, Issue{Severity: "warning", Field: field, Line: line("auth.keyOptions." + key), Message: "options for a key that is not in auth.apiKeys"})
+		}
+	}
+
+	for _, model := range sortedKeys(cfg.ModelReasoningEfforts) {
+		effort := cfg.ModelReasoningEfforts[model]
+		if !validEfforts[effort] {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "modelReasoningEfforts." + model,
+				Line:     line("modelReasoningEfforts." + model),
+				Message:  fmt.Sprintf("invalid reasoning effort %q (expected none, minimal, low, medium, high, or xhigh)", effort),
+			})
+		}
+	}
+
+	switch cfg.SessionPinning {
+	case "", SessionPinningOff, SessionPinningStrip, SessionPinningPin:
+	default:
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "sessionPinning",
+			Line:     line("sessionPinning"),
+			Message:  fmt.Sprintf("invalid value %q (expected off, strip, or pin)", cfg.SessionPinning),
+		})
+	}
+
+	switch cfg.AnthropicVersionCheck {
+	case "", AnthropicVersionReject, AnthropicVersionWarn:
+	default:
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "anthropicVersionCheck",
+			Line:     line("anthropicVersionCheck"),
+			Message:  fmt.Sprintf("invalid value %q (expected reject or warn)", cfg.AnthropicVersionCheck),
+		})
+	}
+
+	switch cfg.ToolSchemaSanitization {
+	case "", SchemaSanitizeOff, SchemaSanitizeStandard, SchemaSanitizeStrict:
+	default:
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "toolSchemaSanitization",
+			Line:     line("toolSchemaSanitization"),
+			Message:  fmt.Sprintf("invalid value %q (expected off, standard, or strict)", cfg.ToolSchemaSanitization),
+		})
+	}
+
+	switch cfg.MidConversationSystem {
+	case "", MidSystemMerge, MidSystemKeep:
+	default:
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "midConversationSystem",
+			Line:     line("midConversationSystem"),
+			Message:  fmt.Sprintf("invalid value %q (expected merge or keep)", cfg.MidConversationSystem),
+		})
+	}
+
+	pricedModels := make([]string, 0, len(cfg.ModelPricing))
+	for model := range cfg.ModelPricing {
+		pricedModels = append(pricedModels, model)
+	}
+	sort.Strings(pricedModels)
+	for _, model := range pricedModels {
+		p := cfg.ModelPricing[model]
+		if p.InputPerMTok < 0 || p.OutputPerMTok < 0 || p.CachedInputPerMTok < 0 {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "modelPricing." + model,
+				Line:     line("modelPricing." + model),
+				Message:  "invalid price (expected 0 or a positive number)",
+			})
+		}
+	}
+
+	limitedModels := make([]string, 0, len(cfg.ModelConcurrency))
+	for model := range cfg.ModelConcurrency {
+		limitedModels = append(limitedModels, model)
+	}
+	sort.Strings(limitedModels)
+	for _, model := range limitedModels {
+		if cfg.ModelConcurrency[model] < 0 {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "modelConcurrency." + model,
+				Line:     line("modelConcurrency." + model),
+				Message:  "invalid limit (expected 0 or a positive integer)",
+			})
+		}
+	}
+
+	premiumModels := make([]string, 0, len(cfg.PremiumMultipliers))
+	for model := range cfg.PremiumMultipliers {
+		premiumModels = append(premiumModels, model)
+	}
+	sort.Strings(premiumModels)
+	for _, model := range premiumModels {
+		if cfg.PremiumMultipliers[model] < 0 {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "premiumMultipliers." + model,
+				Line:     line("premiumMultipliers." + model),
+				Message:  "invalid multiplier (expected 0 or a positive number)",
+			})
+		}
+	}
+	overridden := make([]string, 0, len(cfg.ModelOverrides))
+	for model := range cfg.ModelOverrides {
+		overridden = append(overridden, model)
+	}
+	sort.Strings(overridden)
+	for _, model := range overridden {
+		issues = append(issues, validateModelOverride("modelOverrides."+model, cfg.ModelOverrides[model], line)...)
+	}
+	if cfg.PremiumDivergenceThreshold < 0 {
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "premiumDivergenceThreshold",
+			Line:     line("premiumDivergenceThreshold"),
+			Message:  "invalid threshold (expected 0 or a positive number)",
+		})
+	}
+
+	sampledModels := make([]string, 0, len(cfg.ModelSamplingParams))
+	for model := range cfg.ModelSamplingParams {
+		sampledModels = append(sampledModels, model)
+	}
+	sort.Strings(sampledModels)
+	for _, model := range sampledModels {
+		switch p := cfg.ModelSamplingParams[model]; p {
+		case SamplingForward, SamplingClamp, SamplingOmit:
+		default:
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "modelSamplingParams." + model,
+				Line:     line("modelSamplingParams." + model),
+				Message:  fmt.Sprintf("invalid policy %q (expected forward, clamp, or omit)", p),
+			})
+		}
+	}
+
+	for i, e := range cfg.Approval.Endpoints {
+		if _, ok := ApprovalEndpoints[e]; !ok && !strings.HasPrefix(e, "/") {
+			field := fmt.Sprintf("approval.endpoints[%d]", i)
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    field,
+				Line:     line("approval.endpoints"),
+				Message:  fmt.Sprintf("unknown endpoint %q (expected count_tokens, models, embeddings, usage, or a path starting with /)", e),
+			})
+		}
+	}
+
+	for i, o := range cfg.CORS.AllowedOrigins {
+		field := fmt.Sprintf("cors.allowedOrigins[%d]", i)
+		switch {
+		case o == "*" && cfg.CORS.AllowCredentials:
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    field,
+				Line:     line("cors.allowedOrigins"),
+				Message:  `origin "*" can't be combined with allowCredentials (list the origins instead)`,
+			})
+		case o != "*" && !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://"):
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    field,
+				Line:     line("cors.allowedOrigins"),
+				Message:  fmt.Sprintf("invalid origin %q (expected \"*\" or scheme://host[:port])", o),
+			})
+		}
+	}
+
+	for i, path := range cfg.Hooks.PreRequest {
+		field := fmt.Sprintf("hooks.preRequest[%d]", i)
+		if !filepath.IsAbs(path) {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    field,
+				Line:     line("hooks.preRequest"),
+				Message:  fmt.Sprintf("hook %q must be an absolute path", path),
+			})
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			issues = append(issues, Issue{
+				Severity: "warning",
+				Field:    field,
+				Line:     line("hooks.preRequest"),
+				Message:  fmt.Sprintf("hook %q not found; requests will fail until it exists", path),
+			})
+		}
+	}
+
+	for i, suffix := range cfg.AdvertiseModelSuffixes {
+		if !IsValidModelSuffix(suffix) {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    fmt.Sprintf("advertiseModelSuffixes[%d]", i),
+				Line:     line("advertiseModelSuffixes"),
+				Message:  fmt.Sprintf("invalid model suffix %q (expected @<reasoning effort>, @small or #nothink)", suffix),
+			})
+		}
+	}
+
+	upstreamNames := make(map[string]bool)
+	for i, u := range cfg.AlternateUpstreams {
+		field := fmt.Sprintf("alternateUpstreams[%d]", i)
+		if parsed, err := url.Parse(u.BaseURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    field + ".baseURL",
+				Line:     line("alternateUpstreams"),
+				Message:  fmt.Sprintf("invalid base URL %q (expected http(s)://host[:port][/path])", u.BaseURL),
+			})
+			continue
+		}
+		if name := u.UpstreamName(); upstreamNames[name] {
+			issues = append(issues, Issue{
+				Severity: "warning",
+				Field:    field + ".name",
+				Line:     line("alternateUpstreams"),
+				Message:  fmt.Sprintf("duplicate upstream name %q; their metrics are combined", name),
+			})
+		} else {
+			upstreamNames[name] = true
+		}
+	}
+
+	if _, ok := cfg.PromptPresets["none"]; ok {
+		issues = append(issues, Issue{
+			Severity: "warning",
+			Field:    "promptPresets.none",
+			Line:     line("promptPresets.none"),
+			Message:  `preset "none" is unreachable: X-Extra-Prompt: none disables the extra prompt`,
+		})
+	}
+
+	if n := cfg.Notifications; n.WebhookURL != "" {
+		if u, err := url.Parse(n.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "notifications.webhookURL",
+				Line:     line("notifications.webhookURL"),
+				Message:  "invalid URL (expected http(s)://host/path)",
+			})
+		}
+	}
+	switch f := cfg.Notifications.WebhookFormat; f {
+	case "", WebhookFormatAuto, WebhookFormatSlack, WebhookFormatDiscord, WebhookFormatJSON:
+	default:
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "notifications.webhookFormat",
+			Line:     line("notifications.webhookFormat"),
+			Message:  fmt.Sprintf("invalid format %q (expected auto, slack, discord or json)", f),
+		})
+	}
+	if path := cfg.Notifications.Command; path != "" {
+		if !filepath.IsAbs(path) {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "notifications.command",
+				Line:     line("notifications.command"),
+				Message:  fmt.Sprintf("command %q must be an absolute path", path),
+			})
+		} else if info, err := os.Stat(path); err != nil || info.IsDir() {
+			issues = append(issues, Issue{
+				Severity: "warning",
+				Field:    "notifications.command",
+				Line:     line("notifications.command"),
+				Message:  fmt.Sprintf("command %q not found; notifications won't run it until it exists", path),
+			})
+		}
+	}
+	if p := cfg.Notifications.QuotaPercent; p > 100 {
+		issues = append(issues, Issue{
+			Severity: "warning",
+			Field:    "notifications.quotaPercent",
+			Line:     line("notifications.quotaPercent"),
+			Message:  fmt.Sprintf("%d%% is never reached; quota notifications are off", p),
+		})
+	}
+	if cfg.Telemetry.OTLPEndpoint != "" {
+		if u, err := url.Parse(cfg.Telemetry.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "telemetry.otlpEndpoint",
+				Line:     line("telemetry.otlpEndpoint"),
+				Message:  fmt.Sprintf("invalid URL %q (expected http(s)://host[:port][/path])", cfg.Telemetry.OTLPEndpoint),
+			})
+		}
+	}
+
+	if cfg.RateLimitWarnPercent > 100 {
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "rateLimitWarnPercent",
+			Line:     line("rateLimitWarnPercent"),
+			Message:  fmt.Sprintf("invalid percentage %d (expected 0-100)", cfg.RateLimitWarnPercent),
+		})
+	}
+
+	switch cfg.ResponsesInstructions.Order {
+	case "", InstructionsOrderLegacy, InstructionsOrderCache:
+	default:
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "responsesInstructions.order",
+			Line:     line("responsesInstructions.order"),
+			Message:  fmt.Sprintf("invalid value %q (expected legacy or cache)", cfg.ResponsesInstructions.Order),
+		})
+	}
+
+	switch cfg.LogRouting {
+	case "", LogRoutingHandler, LogRoutingModel:
+	default:
+		issues = append(issues, Issue{
+			Severity: "error",
+			Field:    "logRouting",
+			Line:     line("logRouting"),
+			Message:  fmt.Sprintf("invalid value %q (expected handler or model)", cfg.LogRouting),
+		})
+	}
+
+	for _, f := range []struct {
+		path  string
+		value int
+	}{
+		{"maxTools", cfg.MaxTools},
+		{"maxToolSchemaTokens", cfg.MaxToolSchemaTokens},
+		{"responseStoreMaxEntries", cfg.ResponseStoreMaxEntries},
+		{"responseStoreTTLMinutes", cfg.ResponseStoreTTLMinutes},
+		{"responseStoreMaxMB", cfg.ResponseStoreMaxMB},
+		{"streamCoalesceMs", cfg.StreamCoalesceMs},
+		{"maxStreamOutputTokens", cfg.MaxStreamOutputTokens},
+		{"maxSSEEventBytes", cfg.MaxSSEEventBytes},
+		{"maxStreamBufferBytes", cfg.MaxStreamBufferBytes},
+		{"responseCache.maxEntries", cfg.ResponseCache.MaxEntries},
+		{"responseCache.maxBodyBytes", cfg.ResponseCache.MaxBodyBytes},
+		{"idempotency.maxEntries", cfg.Idempotency.MaxEntries},
+		{"hedging.delayMs", cfg.Hedging.DelayMs},
+		{"approval.followUpMinutes", cfg.Approval.FollowUpMinutes},
+		{"approval.approveAllMinutes", cfg.Approval.ApproveAllMinutes},
+		{"cors.maxAge", cfg.CORS.MaxAge},
+		{"hooks.timeoutMs", cfg.Hooks.TimeoutMs},
+		{"history.maxMB", cfg.History.MaxMB},
+		{"history.retentionDays", cfg.History.RetentionDays},
+		{"failover.threshold", cfg.Failover.Threshold},
+		{"failover.cooldownSeconds", cfg.Failover.CooldownSeconds},
+		{"rateLimitWarnPercent", cfg.RateLimitWarnPercent},
+		{"notifications.quotaPercent", cfg.Notifications.QuotaPercent},
+		{"notifications.intervalMinutes", cfg.Notifications.IntervalMinutes},
+		{"batchConcurrency", cfg.BatchConcurrency},
+		{"imageProcessing.maxBytes", cfg.ImageProcessing.MaxBytes},
+		{"imageProcessing.maxDimension", cfg.ImageProcessing.MaxDimension},
+	} {
+		if f.value < 0 {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    f.path,
+				Line:     line(f.path),
+				Message:  fmt.Sprintf("invalid limit %d (expected 0 or a positive number)", f.value),
+			})
+		}
+	}
+	for i, rule := range cfg.Redactions {
+		field := fmt.Sprintf("redactions[%d]", i)
+		if rule.Pattern == "" {
+			issues = append(issues, Issue{Severity: "error", Field: field, Line: line("redactions"), Message: "empty pattern"})
+		} else if _, err := regexp.Compile(rule.Pattern); err != nil {
+			issues = append(issues, Issue{Severity: "error", Field: field, Line: line("redactions"), Message: fmt.Sprintf("invalid pattern: %v", err)})
+		}
+	}
+
+	for _, tool := range cfg.MCP.AllowedTools {
+		if !slices.Contains(MutatingMCPTools, tool) {
+			issues = append(issues, Issue{
+				Severity: "warning",
+				Field:    "mcp.allowedTools",
+				Line:     line("mcp.allowedTools"),
+				Message:  fmt.Sprintf("unknown MCP tool %q (expected %s)", tool, strings.Join(MutatingMCPTools, " or ")),
+			})
+		}
+	}
+
+	for _, t := range []struct {
+		field, value string
+	}{
+		{"responseCache.ttl", cfg.ResponseCache.TTL},
+		{"idempotency.ttl", cfg.Idempotency.TTL},
+	} {
+		if t.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(t.value); err != nil || d <= 0 {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    t.field,
+				Line:     line(t.field),
+				Message:  fmt.Sprintf("invalid duration %q (expected e.g. \"10m\")", t.value),
+			})
+		}
+	}
+	for _, t := range []struct {
+		field, value string
+	}{
+		{"timeouts.messages", cfg.Timeouts.Messages},
+		{"timeouts.chatCompletions", cfg.Timeouts.ChatCompletions},
+		{"timeouts.responses", cfg.Timeouts.Responses},
+		{"timeouts.embeddings", cfg.Timeouts.Embeddings},
+	} {
+		if t.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(t.value); err != nil || d < 0 {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    t.field,
+				Line:     line(t.field),
+				Message:  fmt.Sprintf("invalid duration %q (expected e.g. \"8m\", or \"0\" for no limit)", t.value),
+			})
+		}
+	}
+	if raw := cfg.Coordination.RedisURL; raw != "" {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "coordination.redisURL",
+				Line:     line("coordination.redisURL"),
+				Message:  "invalid URL (expected redis://[:password@]host:port[/db] or rediss://...)",
+			})
+		}
+	}
+	for _, v := range []struct{ field, value string }{
+		{"editorIdentity.vscodeVersion", cfg.EditorIdentity.VSCodeVersion},
+		{"editorIdentity.copilotChatVersion", cfg.EditorIdentity.CopilotChatVersion},
+	} {
+		if v.value != "" && !versionRe.MatchString(v.value) {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    v.field,
+				Line:     line(v.field),
+				Message:  fmt.Sprintf("invalid version %q (expected e.g. \"1.109.3\")", v.value),
+			})
+		}
+	}
+	if v := cfg.EditorIdentity.APIVersion; v != "" {
+		if _, err := time.Parse(time.DateOnly, v); err != nil {
+			issues = append(issues, Issue{
+				Severity: "error",
+				Field:    "editorIdentity.apiVersion",
+				Line:     line("editorIdentity.apiVersion"),
+				Message:  fmt.Sprintf("invalid API version %q (expected a date such as \"2025-10-01\")", v),
+			})
+		}
+	}
+	if cfg.TrimTools && cfg.MaxTools == 0 && cfg.MaxToolSchemaTokens == 0 {
+		issues = append(issues, Issue{Severity: "warning", Field: "trimTools", Line: line("trimTools"), Message: "has no effect without maxTools or maxToolSchemaTokens"})
+	}
+
+	if len(models) > 0 {
+		known := make(map[string]bool, len(models))
+		for _, m := range models {
+			known[m] = true
+		}
+		check := func(field, model string) {
+			if model != "" && !known[model] {
+				issues = append(issues, Issue{
+					Severity: "warning",
+					Field:    field,
+					Line:     line(field),
+					Message:  fmt.Sprintf("model %q is not in the Copilot models list", model),
+				})
+			}
+		}
+		check("smallModel", cfg.SmallModel)
+		for _, m := range sortedKeys(cfg.ModelReasoningEfforts) {
+			check("modelReasoningEfforts."+m, m)
+		}
+		for _, m := range sortedKeys(cfg.ExtraPrompts) {
+			check("extraPrompts."+m, m)
+		}
+		for _, m := range overridden {
+			check("modelOverrides."+m, m)
+		}
+		for _, m := range cfg.LogprobsModels {
+			check("logprobsModels", m)
+		}
+		for _, m := range cfg.ResponseCache.Models {
+			check("responseCache.models", m)
+		}
+		for _, m := range cfg.Hedging.Models {
+			check("hedging.models", m)
+		}
+	}
+
+	return issues
+}
+
+// validateModelOverride checks one modelOverrides entry: a JSON object
+// whose keys are fields of a Copilot model listing.
+func validateModelOverride(field string, raw json.RawMessage, line func(string) int) []Issue {
+	var issues []Issue
+	var patch map[string]any
+	if err := json.Unmarshal(raw, &patch); err != nil || patch == nil {
+		return append(issues, Issue{Severity: "error", Field: field, Line: line(field), Message: "expected a JSON object of model fields"})
+	}
+	if err := json.Unmarshal(raw, &state.Model{}); err != nil {
+		msg := err.Error()
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			msg = fmt.Sprintf("%s: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		issues = append(issues, Issue{Severity: "error", Field: field, Line: line(field), Message: msg})
+	}
+	var walk func(obj map[string]any, path []string)
+	walk = func(obj map[string]any, path []string) {
+		for _, k := range slices.Sorted(maps.Keys(obj)) {
+			p := append(slices.Clone(path), k)
+			switch {
+			case len(p) == 1 && k == "id":
+				issues = append(issues, Issue{Severity: "warning", Field: field + ".id", Line: line(field + ".id"), Message: "the model ID can't be overridden (ignored)"})
+			case !knownPath(reflect.TypeOf(state.Model{}), p):
+				f := field + "." + strings.Join(p, ".")
+				issues = append(issues, Issue{Severity: "warning", Field: f, Line: line(f), Message: "unknown model field (ignored)"})
+			default:
+				if sub, ok := obj[k].(map[string]any); ok {
+					walk(sub, p)
+				}
+			}
+		}
+	}
+	walk(patch, nil)
+	return issues
+}
+
+// keyPos is an object key found in the raw JSON with its byte offset.
+type keyPos struct {
+	path   string
+	offset int64
+}
+
+// scanKeys walks the JSON token stream and returns the dotted path of every
+// object key. Array elements do not add a path segment.
+func scanKeys(data []byte) ([]keyPos, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var keys []keyPos
+
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := tok.(json.Delim)
+		if !ok {
+			return nil
+		}
+		switch delim {
+		case '{':
+			for dec.More() {
+				offset := skipSeparators(data, dec.InputOffset())
+				keyTok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := keyTok.(string)
+				path := key
+				if prefix != "" {
+					path = prefix + "." + key
+				}
+				keys = append(keys, keyPos{path: path, offset: offset})
+				if err := walk(path); err != nil {
+					return err
+				}
+			}
+		case '[':
+			for dec.More() {
+				if err := walk(prefix); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = dec.Token() // closing delimiter
+		return err
+	}
+
+	if err := walk(""); err != nil && err != io.EOF {
+		return keys, err
+	}
+	return keys, nil
+}
+
+// knownPath reports whether a dotted key path maps onto a field of t.
+// Map-typed fields accept any key below them.
+func knownPath(t reflect.Type, parts []string) bool {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if len(parts) == 0 {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return true
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if jsonName(f) == parts[0] {
+				return knownPath(f.Type, parts[1:])
+			}
+		}
+	}
+	return false
+}
+
+func jsonName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "" {
+		return f.Name
+	}
+	return strings.Split(tag, ",")[0]
+}
+
+// suggest returns a "did you mean" hint for a misspelled key, picking the
+// sibling field with the smallest case-insensitive edit distance.
+func suggest(path string) string {
+	parts := strings.Split(path, ".")
+	t := reflect.TypeOf(Config{})
+	for _, p := range parts[:len(parts)-1] {
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			if jsonName(t.Field(i)) == p {
+				t = t.Field(i).Type
+				found = true
+				break
+			}
+		}
+		if !found || t.Kind() != reflect.Struct {
+			return ""
+		}
+	}
+	if t.Kind() != reflect.Struct {
+		return ""
+	}
+
+	last := strings.ToLower(parts[len(parts)-1])
+	best, bestDist := "", 3
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if d := editDistance(last, strings.ToLower(name)); d < bestDist {
+			best, bestDist = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" — did you mean %q?", best)
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// skipSeparators advances offset past whitespace and commas so it points at
+// the next token rather than the end of the previous one.
+func skipSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package coord
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+const (
+	// recentPerInstance caps each instance's recent request feed.
+	recentPerInstance = 200
+	// recentTTL expires the feed of an instance that stopped recording.
+	recentTTL = 24 * time.Hour
+)
+
+// Metrics is a state.SharedMetrics in Redis. Counters live in one hash;
+// each instance has its own recent request list, and a set names the
+// instances.
+type Metrics struct {
+	client    *Client
+	counters  string
+	instances string
+	instance  string
+	prefix    string
+}
+
+var _ state.SharedMetrics = (*Metrics)(nil)
+
+// NewMetrics returns a store keyed under namespace, recording as instance.
+func NewMetrics(client *Client, namespace, instance string) *Metrics {
+	return &Metrics{
+		client:    client,
+		counters:  namespace + ":metrics",
+		instances: namespace + ":instances",
+		instance:  instance,
+		prefix:    namespace + ":recent:",
+	}
+}
+
+func (m *Metrics) Add(counts map[string]int64, rec *state.RequestRecord) error {
+	var cmds [][]any
+	for name, n := range counts {
+		if n != 0 {
+			cmds = append(cmds, []any{"HINCRBY", m.counters, name, n})
+		}
+	}
+	if rec != nil {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		recent := m.prefix + m.instance
+		cmds = append(cmds,
+			[]any{"LPUSH", recent, data},
+			[]any{"LTRIM", recent, 0, recentPerInstance - 1},
+			[]any{"EXPIRE", recent, int(recentTTL.Seconds())},
+			[]any{"SADD", m.instances, m.instance},
+		)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	cmds = append(cmds, []any{"HSETNX", m.counters, state.MetricsEpochCounter, time.Now().Unix()})
+	replies, err := m.client.Pipeline(cmds)
+	if err != nil {
+		return err
+	}
+	for _, r := range replies {
+		if e, ok := r.(Error); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func (m *Metrics) Load() (map[string]int64, []state.RequestRecord, error) {
+	replies, err := m.client.Pipeline([][]any{
+		{"HGETALL", m.counters},
+		{"SMEMBERS", m.instances},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, _ := replies[0].([]any)
+	counts := make(map[string]int64, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].([]byte)
+		value, _ := fields[i+1].([]byte)
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err == nil {
+			counts[string(name)] = n
+		}
+	}
+
+	members, _ := replies[1].([]any)
+	if len(members) == 0 {
+		return counts, nil, nil
+	}
+	var cmds [][]any
+	for _, id := range members {
+		b, _ := id.([]byte)
+		cmds = append(cmds, []any{"LRANGE", m.prefix + string(b), 0, recentPerInstance - 1})
+	}
+	lists, err := m.client.Pipeline(cmds)
+	if err != nil {
+		return nil, nil, err
+	}
+	var recent []state.RequestRecord
+	for i, list := range lists {
+		items, _ := list.([]any)
+		if len(items) == 0 {
+			// Expired feed: forget the instance
+			b, _ := members[i].([]byte)
+			m.client.Do("SREM", m.instances, b)
+			continue
+		}
+		for _, item := range items {
+			data, _ := item.([]byte)
+			var rec state.RequestRecord
+			if json.Unmarshal(data, &rec) == nil {
+				recent = append(recent, rec)
+			}
+		}
+	}
+	return counts, recent, nil
+}
@@ -0,0 +1,43 @@
+package coord
+
+import (
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+)
+
+// RateLimit is a middleware.RateLimitStore shared through Redis: the first
+// instance to set the key admits its request, and the key expires when
+// the cooldown has passed.
+type RateLimit struct {
+	client *Client
+	key    string
+}
+
+var _ middleware.RateLimitStore = (*RateLimit)(nil)
+
+// NewRateLimit returns a store keyed under namespace.
+func NewRateLimit(client *Client, namespace string) *RateLimit {
+	return &RateLimit{client: client, key: namespace + ":ratelimit"}
+}
+
+func (r *RateLimit) Acquire(cooldown time.Duration) (time.Duration, error) {
+	// Retry once when the key expires between SET and PTTL
+	for range 2 {
+		ok, err := r.client.Do("SET", r.key, "1", "PX", max(cooldown.Milliseconds(), 1), "NX")
+		if err != nil {
+			return 0, err
+		}
+		if ok != nil {
+			return 0, nil
+		}
+		ttl, err := r.client.Do("PTTL", r.key)
+		if err != nil {
+			return 0, err
+		}
+		if ms, _ := ttl.(int64); ms > 0 {
+			return time.Duration(ms) * time.Millisecond, nil
+		}
+	}
+	return time.Millisecond, nil
+}
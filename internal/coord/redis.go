@@ -0,0 +1,282 @@
+// Package coord shares rate limiting and metrics between proxy instances
+// through Redis. It speaks just enough of the Redis protocol (RESP2) for
+// that, so the proxy needs no client library.
+package coord
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// commandTimeout bounds a command round trip, dialing included. Shared
+	// state is on the request path, so a slow Redis counts as unreachable.
+	commandTimeout = 2 * time.Second
+	// redialInterval spaces reconnection attempts while Redis is down, so
+	// requests fall back to local state without waiting on a dial each.
+	redialInterval = 5 * time.Second
+)
+
+// ErrUnavailable is returned while Redis is down between redial attempts.
+var ErrUnavailable = errors.New("redis unavailable")
+
+// Error is an error reply from Redis. It leaves the connection usable.
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Client is a Redis client over one connection. Commands are serialized;
+// a broken connection is redialed, at most every redialInterval.
+type Client struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+
+	mu       sync.Mutex
+	conn     net.Conn
+	rd       *bufio.Reader
+	lastDial time.Time
+	down     bool
+}
+
+// NewClient returns a client for a redis:// or rediss:// URL. It doesn't
+// connect until the first command.
+func NewClient(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	c := &Client{addr: u.Host}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("invalid redis URL: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis URL: database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Addr returns the server address, for logging.
+func (c *Client) Addr() string { return c.addr }
+
+// Do sends one command and returns its reply: a string for a status reply,
+// int64, []byte or nil for a bulk string, or []any.
+func (c *Client) Do(args ...any) (any, error) {
+	replies, err := c.Pipeline([][]any{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(Error); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends commands in one round trip and returns their replies in
+// order. An error reply is returned as an Error element; the error result
+// is for connection failures.
+func (c *Client) Pipeline(cmds [][]any) ([]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.connect(); err != nil {
+		return nil, c.fail(err)
+	}
+	c.conn.SetDeadline(time.Now().Add(commandTimeout))
+	replies, err := c.roundTrip(cmds)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, c.fail(err)
+	}
+	if c.down {
+		c.down = false
+		slog.Info("redis reachable again, using shared state", "addr", c.addr)
+	}
+	return replies, nil
+}
+
+func (c *Client) roundTrip(cmds [][]any) ([]any, error) {
+	var buf []byte
+	for _, args := range cmds {
+		buf = appendCommand(buf, args)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		reply, err := readReply(c.rd)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// connect dials and authenticates unless connected. The caller holds c.mu.
+func (c *Client) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	if time.Since(c.lastDial) < redialInterval {
+		return ErrUnavailable
+	}
+	c.lastDial = time.Now()
+
+	dialer := &net.Dialer{Timeout: commandTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.rd = conn, bufio.NewReader(conn)
+
+	var setup [][]any
+	if c.password != "" {
+		if c.username != "" {
+			setup = append(setup, []any{"AUTH", c.username, c.password})
+		} else {
+			setup = append(setup, []any{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		setup = append(setup, []any{"SELECT", c.db})
+	}
+	if len(setup) == 0 {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	replies, err := c.roundTrip(setup)
+	if err == nil {
+		for _, r := range replies {
+			if e, ok := r.(Error); ok {
+				err = e
+				break
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// fail logs the first failure of an outage. The caller holds c.mu.
+func (c *Client) fail(err error) error {
+	if !c.down && !errors.Is(err, ErrUnavailable) {
+		c.down = true
+		slog.Warn("redis unreachable, using local state", "addr", c.addr, "error", err)
+	}
+	return err
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func appendCommand(buf []byte, args []any) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		default:
+			s = fmt.Sprint(v)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(s)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, s...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+func readReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
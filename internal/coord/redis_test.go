@@ -0,0 +1,327 @@
+package coord
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// fakeRedis is a Redis server on a local listener that answers each
+// command with the raw RESP reply of its reply function.
+type fakeRedis struct {
+	ln    net.Listener
+	reply func(cmd []string) string
+
+	mu    sync.Mutex
+	cmds  [][]string
+	dials int
+	conns []net.Conn
+}
+
+func newFakeRedis(t *testing.T, reply func(cmd []string) string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, reply: reply}
+	t.Cleanup(func() {
+		ln.Close()
+		f.dropConns()
+	})
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.dials++
+		f.conns = append(f.conns, conn)
+		f.mu.Unlock()
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakeRedis) serveConn(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		cmd, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.cmds = append(f.cmds, cmd)
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, f.reply(cmd)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads one command as clients send it, an array of bulk
+// strings.
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		if line, err = rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(data[:size])
+	}
+	return cmd, nil
+}
+
+// dropConns closes the open connections, as a restarting Redis would.
+func (f *fakeRedis) dropConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) commands() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.cmds...)
+}
+
+func (f *fakeRedis) dialCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials
+}
+
+func (f *fakeRedis) client(t *testing.T, path string) *Client {
+	t.Helper()
+	c, err := NewClient("redis://" + f.ln.Addr().String() + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// unreachableAddr returns a local address nothing listens on.
+func unreachableAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestClientReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    any
+		wantErr error
+	}{
+		{"simple string", "+OK\r\n", "OK", nil},
+		{"error", "-WRONGTYPE wrong kind of value\r\n", nil, Error("WRONGTYPE wrong kind of value")},
+		{"integer", ":-42\r\n", int64(-42), nil},
+		{"bulk string", "$5\r\nhe\r\no\r\n", []byte("he\r\no"), nil},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, nil},
+		{"nil bulk string", "$-1\r\n", nil, nil},
+		{"array", "*3\r\n$1\r\na\r\n:7\r\n*1\r\n+nested\r\n", []any{[]byte("a"), int64(7), []any{"nested"}}, nil},
+		{"empty array", "*0\r\n", []any{}, nil},
+		{"nil array", "*-1\r\n", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRedis(t, func([]string) string { return tt.reply })
+			got, err := f.client(t, "").Do("GET", "key")
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reply = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientPipelineKeepsErrorReplies(t *testing.T) {
+	f := newFakeRedis(t, func(cmd []string) string {
+		if cmd[0] == "BAD" {
+			return "-ERR unknown command\r\n"
+		}
+		return ":1\r\n"
+	})
+	c := f.client(t, "")
+	replies, err := c.Pipeline([][]any{{"INCR", "a"}, {"BAD"}, {"INCR", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{int64(1), Error("ERR unknown command"), int64(1)}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("replies = %#v, want %#v", replies, want)
+	}
+	// An error reply leaves the connection usable
+	if _, err := c.Do("INCR", "c"); err != nil {
+		t.Errorf("command after an error reply: %v", err)
+	}
+	if n := f.dialCount(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+func TestClientSendsCommands(t *testing.T) {
+	f := newFakeRedis(t, func([]string) string { return "+OK\r\n" })
+	c := f.client(t, "")
+	c.Do("SET", "ns:key", []byte("a b\r\n"), "PX", int64(1500), "NX")
+
+	want := [][]string{{"SET", "ns:key", "a b\r\n", "PX", "1500", "NX"}}
+	if got := f.commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestClientAuthenticatesAndSelects(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		user    string
+		want    [][]string
+		authErr bool
+	}{
+		{"password", "/3", ":secret@", [][]string{{"AUTH", "secret"}, {"SELECT", "3"}, {"PING"}}, false},
+		{"user and password", "", "bob:secret@", [][]string{{"AUTH", "bob", "secret"}, {"PING"}}, false},
+		{"no credentials", "", "", [][]string{{"PING"}}, false},
+		{"rejected", "", ":wrong@", [][]string{{"AUTH", "wrong"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRedis(t, func(cmd []string) string {
+				if cmd[0] == "AUTH" && cmd[len(cmd)-1] != "secret" {
+					return "-WRONGPASS invalid password\r\n"
+				}
+				return "+OK\r\n"
+			})
+			c, err := NewClient("redis://" + tt.user + f.ln.Addr().String() + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			_, err = c.Do("PING")
+			if (err != nil) != tt.authErr {
+				t.Fatalf("error = %v, want error %v", err, tt.authErr)
+			}
+			if got := f.commands(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClientRejectsInvalidURLs(t *testing.T) {
+	for _, url := range []string{"http://localhost", "redis://localhost/db", "://"} {
+		if _, err := NewClient(url); err == nil {
+			t.Errorf("NewClient(%q) succeeded", url)
+		}
+	}
+	c, err := NewClient("rediss://cache.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr() != "cache.example:6379" || c.tls == nil {
+		t.Errorf("rediss URL: addr %q, tls %v; want the default port over TLS", c.Addr(), c.tls != nil)
+	}
+}
+
+func TestClientReconnectsAfterDrop(t *testing.T) {
+	f := newFakeRedis(t, func([]string) string { return "+PONG\r\n" })
+	c := f.client(t, "")
+	if _, err := c.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.dropConns()
+	if _, err := c.Do("PING"); err == nil {
+		t.Fatal("command on a dropped connection succeeded")
+	}
+	if _, err := c.Do("PING"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("error within the redial interval = %v, want ErrUnavailable", err)
+	}
+
+	c.mu.Lock()
+	c.lastDial = time.Now().Add(-redialInterval)
+	c.mu.Unlock()
+	if got, err := c.Do("PING"); err != nil || got != "PONG" {
+		t.Fatalf("after the redial interval: %v, %v; want PONG", got, err)
+	}
+	if n := f.dialCount(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+func TestFallbackToLocalWhenUnreachable(t *testing.T) {
+	c, err := NewClient("redis://" + unreachableAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := NewRateLimit(c, "ns").Acquire(time.Minute); err == nil {
+		t.Fatal("Acquire succeeded without Redis")
+	}
+	limiter := middleware.NewRateLimiter(60, false, NewRateLimit(c, "ns"))
+	h := limiter.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	var statuses []int
+	for range 2 {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+		statuses = append(statuses, w.Code)
+	}
+	if want := []int{http.StatusOK, http.StatusTooManyRequests}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %v, want %v from the local limit", statuses, want)
+	}
+
+	metrics := state.NewMetrics()
+	metrics.SetShared(NewMetrics(c, "ns", "a"), "a")
+	metrics.RecordRequest(state.RequestRecord{Endpoint: "messages", Model: "gpt-4.1"})
+	snap := metrics.Snapshot()
+	if snap.Aggregates.TotalRequests != 1 || len(snap.Recent) != 1 {
+		t.Errorf("snapshot has %d requests, %d recent; want this process's 1",
+			snap.Aggregates.TotalRequests, len(snap.Recent))
+	}
+}
@@ -0,0 +1,375 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+const (
+	unitName    = "copilot-proxy-go"
+	launchdName = "com.tonghaoch.copilot-proxy-go"
+)
+
+// passthroughEnv lists environment variables copied into the service
+// definition when set in the installing shell.
+var passthroughEnv = []string{
+	"XDG_DATA_HOME", state.DataDirEnv, state.ConfigEnv,
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+	"http_proxy", "https_proxy", "no_proxy",
+}
+
+// Options describes the service to manage.
+type Options struct {
+	// Args are passed to the "start" command, e.g. ["--port", "8080"].
+	Args []string
+	// DryRun prints what would be written/run without touching the system.
+	DryRun bool
+}
+
+// Service is a platform service definition.
+type Service struct {
+	Path     string // where the definition file lives
+	Contents string // rendered unit file / plist
+	System   bool   // root (system-wide) vs per-user scope
+}
+
+// Resolve renders the service definition for the current platform and scope.
+func Resolve(opts Options) (*Service, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("locating executable: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	data := templateData{
+		Name:       launchdName,
+		Exec:       exe,
+		Args:       append([]string{"start"}, opts.Args...),
+		WorkingDir: state.AppDir(),
+		Env:        collectEnv(),
+		LogDir:     state.LogDir(),
+	}
+
+	system := os.Geteuid() == 0
+	home, _ := os.UserHomeDir()
+
+	data.WantedBy = "default.target"
+	if system {
+		data.WantedBy = "multi-user.target"
+	}
+
+	var path string
+	var tmpl *template.Template
+	switch runtime.GOOS {
+	case "linux":
+		tmpl = systemdTemplate
+		if system {
+			path = filepath.Join("/etc/systemd/system", unitName+".service")
+		} else {
+			path = filepath.Join(home, ".config", "systemd", "user", unitName+".service")
+		}
+	case "darwin":
+		tmpl = launchdTemplate
+		if system {
+			path = filepath.Join("/Library/LaunchDaemons", launchdName+".plist")
+		} else {
+			path = filepath.Join(home, "Library", "LaunchAgents", launchdName+".plist")
+		}
+	default:
+		return nil, fmt.Errorf("service install is not supported on %s", runtime.GOOS)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("rendering service definition: %w", err)
+	}
+
+	return &Service{Path: path, Contents: buf.String(), System: system}, nil
+}
+
+// Install writes the service definition and loads it.
+func Install(opts Options) error {
+	svc, err := Resolve(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Printf("# %s\n%s\n", svc.Path, svc.Contents)
+		for _, c := range svc.installCommands() {
+			fmt.Printf("$ %s\n", strings.Join(c, " "))
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(svc.Path), 0755); err != nil {
+		return fmt.Errorf("creating service directory: %w", err)
+	}
+	if err := os.WriteFile(svc.Path, []byte(svc.Contents), 0644); err != nil {
+		return fmt.Errorf("writing service definition: %w", err)
+	}
+	fmt.Printf("  Wrote %s\n", svc.Path)
+
+	return runAll(svc.installCommands())
+}
+
+// Uninstall unloads the service and removes its definition.
+func Uninstall(opts Options) error {
+	svc, err := Resolve(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		for _, c := range svc.uninstallCommands() {
+			fmt.Printf("$ %s\n", strings.Join(c, " "))
+		}
+		fmt.Printf("$ rm %s\n", svc.Path)
+		return nil
+	}
+
+	// Unloading an already-stopped service fails; removal should still proceed
+	for _, c := range svc.uninstallCommands() {
+		run(c)
+	}
+	if err := os.Remove(svc.Path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing service definition: %w", err)
+	}
+	fmt.Printf("  Removed %s\n", svc.Path)
+
+	if runtime.GOOS == "linux" {
+		return run(svc.systemctl("daemon-reload"))
+	}
+	return nil
+}
+
+// Status prints the service manager's view of the service.
+func Status(opts Options) error {
+	svc, err := Resolve(opts)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(svc.Path); os.IsNotExist(err) {
+		fmt.Printf("  Not installed (%s does not exist)\n", svc.Path)
+		return nil
+	}
+	fmt.Printf("  Installed: %s\n\n", svc.Path)
+
+	switch runtime.GOOS {
+	case "linux":
+		return run(svc.systemctl("status", "--no-pager", unitName))
+	case "darwin":
+		return run([]string{"launchctl", "list", launchdName})
+	}
+	return nil
+}
+
+func (s *Service) systemctl(args ...string) []string {
+	cmd := []string{"systemctl"}
+	if !s.System {
+		cmd = append(cmd, "--user")
+	}
+	return append(cmd, args...)
+}
+
+func (s *Service) installCommands() [][]string {
+	switch runtime.GOOS {
+	case "linux":
+		return [][]string{
+			s.systemctl("daemon-reload"),
+			s.systemctl("enable", "--now", unitName),
+		}
+	case "darwin":
+		return [][]string{{"launchctl", "load", "-w", s.Path}}
+	}
+	return nil
+}
+
+func (s *Service) uninstallCommands() [][]string {
+	switch runtime.GOOS {
+	case "linux":
+		return [][]string{s.systemctl("disable", "--now", unitName)}
+	case "darwin":
+		return [][]string{{"launchctl", "unload", "-w", s.Path}}
+	}
+	return nil
+}
+
+func runAll(cmds [][]string) error {
+	for _, c := range cmds {
+		if err := run(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func run(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+type envVar struct {
+	Key   string
+	Value string
+}
+
+func collectEnv() []envVar {
+	var env []envVar
+	if home, err := os.UserHomeDir(); err == nil {
+		env = append(env, envVar{Key: "HOME", Value: home})
+	}
+	for _, k := range passthroughEnv {
+		if v := os.Getenv(k); v != "" {
+			env = append(env, envVar{Key: k, Value: v})
+		}
+	}
+	// Pin the service to the directory resolved at install time, e.g. one
+	// chosen with --data-dir or a reused legacy dir.
+	if os.Getenv(state.DataDirEnv) == "" {
+		env = append(env, envVar{Key: state.DataDirEnv, Value: state.AppDir()})
+	}
+	// Likewise a config file chosen with --config
+	if path, source := state.ResolveConfigPath(); source == "--config" {
+		env = append(env, envVar{Key: state.ConfigEnv, Value: path})
+	}
+	return env
+}
+
+type templateData struct {
+	Name       string
+	Exec       string
+	Args       []string
+	WorkingDir string
+	Env        []envVar
+	LogDir     string
+	WantedBy   string
+}
+
+var funcs = template.FuncMap{
+	"quote":   systemdQuote,
+	"arg":     systemdArg,
+	"spec":    systemdSpecifiers,
+	"xmlesc":  xmlEscape,
+	"joinArg": joinQuoted,
+}
+
+var systemdTemplate = template.Must(template.New("systemd").Funcs(funcs).Parse(`[Unit]
+Description=Copilot API proxy
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{arg .Exec}} {{joinArg .Args}}
+WorkingDirectory={{spec .WorkingDir}}
+{{- range .Env}}
+Environment={{quote (printf "%s=%s" .Key .Value)}}
+{{- end}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy={{.WantedBy}}
+`))
+
+var launchdTemplate = template.Must(template.New("launchd").Funcs(funcs).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>Label</key>
+  <string>{{.Name}}</string>
+  <key>ProgramArguments</key>
+  <array>
+    <string>{{xmlesc .Exec}}</string>
+{{- range .Args}}
+    <string>{{xmlesc .}}</string>
+{{- end}}
+  </array>
+  <key>WorkingDirectory</key>
+  <string>{{xmlesc .WorkingDir}}</string>
+  <key>EnvironmentVariables</key>
+  <dict>
+{{- range .Env}}
+    <key>{{xmlesc .Key}}</key>
+    <string>{{xmlesc .Value}}</string>
+{{- end}}
+  </dict>
+  <key>RunAtLoad</key>
+  <true/>
+  <key>KeepAlive</key>
+  <true/>
+  <key>StandardOutPath</key>
+  <string>{{xmlesc .LogDir}}/service.log</string>
+  <key>StandardErrorPath</key>
+  <string>{{xmlesc .LogDir}}/service.log</string>
+</dict>
+</plist>
+`))
+
+// systemdQuote quotes a value for a systemd unit file when needed, with %
+// escaped so systemd doesn't expand it as a specifier.
+func systemdQuote(s string) string {
+	s = systemdSpecifiers(s)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// systemdArg quotes an ExecStart word. On top of specifiers, systemd
+// expands $VAR there (but not in Environment=), so $ is escaped too.
+func systemdArg(s string) string {
+	return systemdQuote(strings.ReplaceAll(s, "$", "$$"))
+}
+
+// systemdSpecifiers escapes % so systemd doesn't expand it as a specifier
+// (%h, %u, ...).
+func systemdSpecifiers(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+func joinQuoted(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = systemdArg(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '"':
+			b.WriteString("&quot;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+)
+
+type activeRequestsResponse struct {
+	Requests []middleware.ActiveRequest `json:"requests"`
+}
+
+// ActiveRequests handles GET /api/requests/active — the in-flight
+// completion requests, oldest first.
+func ActiveRequests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(activeRequestsResponse{Requests: middleware.ListActiveRequests(r.Context())})
+}
+
+// CancelRequest handles POST /api/requests/{id}/cancel — cancels an
+// in-flight completion request: its upstream call ends and the client
+// gets a 499, or an error event if the stream already started. The ID
+// is the one GET /api/requests/active lists, which the proxy generates.
+func CancelRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := url.PathUnescape(chi.URLParam(r, "id"))
+	if err != nil || id == "" {
+		api.ForwardError(w, &api.HTTPError{Message: "invalid request ID", StatusCode: http.StatusBadRequest})
+		return
+	}
+	req, ok := middleware.CancelActiveRequest(r.Context(), id)
+	if !ok {
+		api.ForwardError(w, &api.HTTPError{
+			Message:    "no active request " + id,
+			StatusCode: http.StatusNotFound,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
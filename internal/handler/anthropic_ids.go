@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// anthropicMessageID returns the ID of an Anthropic message translated
+// from the upstream response upstreamID (chatcmpl-…, resp_…). Anthropic
+// SDKs expect the msg_ prefix, so the ID is derived from the upstream one,
+// and the same response always translates to the same ID; the upstream ID
+// itself goes in the message's upstream_id. Without an upstream ID, the ID
+// is random.
+func anthropicMessageID(upstreamID string) string {
+	switch {
+	case strings.HasPrefix(upstreamID, "msg_"):
+		return upstreamID
+	case upstreamID == "":
+		return "msg_" + randomBase36(24)
+	}
+	sum := sha256.Sum256([]byte(upstreamID))
+	return "msg_" + hex.EncodeToString(sum[:12])
+}
+
+// anthropicToolUseID returns the ID of a tool_use block for the upstream
+// tool call id (call_…), with the toolu_ prefix Anthropic SDKs expect.
+// The prefix is added rather than the ID replaced, so it stays readable
+// and the tool_result answering it carries the same ID back upstream.
+func anthropicToolUseID(id string) string {
+	if id == "" || strings.HasPrefix(id, "toolu_") {
+		return id
+	}
+	return "toolu_" + id
+}
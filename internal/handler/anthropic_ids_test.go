@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+var (
+	derivedMessageIDRe = regexp.MustCompile(`^msg_[0-9a-f]{24}$`)
+	messageIDRe        = regexp.MustCompile(`^msg_[0-9A-Za-z]+$`)
+)
+
+func TestAnthropicIDs(t *testing.T) {
+	if got := anthropicMessageID("chatcmpl-abc"); !derivedMessageIDRe.MatchString(got) {
+		t.Errorf("chatcmpl-abc: got %q", got)
+	}
+	if a, b := anthropicMessageID("resp_1"), anthropicMessageID("resp_1"); a != b {
+		t.Errorf("resp_1 translated to %q, then %q", a, b)
+	}
+	if a, b := anthropicMessageID("resp_1"), anthropicMessageID("resp_2"); a == b {
+		t.Errorf("resp_1 and resp_2 both translated to %q", a)
+	}
+	if got := anthropicMessageID("msg_01abc"); got != "msg_01abc" {
+		t.Errorf("msg_01abc: got %q, want it unchanged", got)
+	}
+	if a, b := anthropicMessageID(""), anthropicMessageID(""); !messageIDRe.MatchString(a) || a == b {
+		t.Errorf("without an upstream ID: got %q, then %q; want distinct msg_ IDs", a, b)
+	}
+
+	for id, want := range map[string]string{
+		"call_abc":     "toolu_call_abc",
+		"toolu_01abc":  "toolu_01abc",
+		"fc_1":         "toolu_fc_1",
+		"":             "",
+		"tooluse_xyz":  "toolu_tooluse_xyz",
+		"TOOLU_upper":  "toolu_TOOLU_upper",
+		"toolu_":       "toolu_",
+		"call-with-id": "toolu_call-with-id",
+	} {
+		if got := anthropicToolUseID(id); got != want {
+			t.Errorf("tool call %q: got %q, want %q", id, got, want)
+		}
+	}
+}
+
+// translatedIDs are the IDs of a /v1/messages response.
+type translatedIDs struct {
+	message, upstream string
+	toolUses          []string
+}
+
+func idsOf(t *testing.T, body string, stream bool) translatedIDs {
+	t.Helper()
+	var ids translatedIDs
+	if !stream {
+		var msg struct {
+			ID         string `json:"id"`
+			UpstreamID string `json:"upstream_id"`
+			Content    []struct {
+				Type, ID string
+			} `json:"content"`
+		}
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			t.Fatalf("decoding %s: %v", body, err)
+		}
+		ids.message, ids.upstream = msg.ID, msg.UpstreamID
+		for _, b := range msg.Content {
+			if b.Type == "tool_use" {
+				ids.toolUses = append(ids.toolUses, b.ID)
+			}
+		}
+		return ids
+	}
+	err := readSSE(testContext(context.Background()), strings.NewReader(body), func(eventType, data string) error {
+		var evt struct {
+			Message struct {
+				ID         string `json:"id"`
+				UpstreamID string `json:"upstream_id"`
+			} `json:"message"`
+			ContentBlock struct {
+				Type, ID string
+			} `json:"content_block"`
+		}
+		if err := json.Unmarshal([]byte(data), &evt); err != nil {
+			return err
+		}
+		switch eventType {
+		case "message_start":
+			ids.message, ids.upstream = evt.Message.ID, evt.Message.UpstreamID
+		case "content_block_start":
+			if evt.ContentBlock.Type == "tool_use" {
+				ids.toolUses = append(ids.toolUses, evt.ContentBlock.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// TestTranslatedIDPrefixes checks the msg_ and toolu_ prefixes of message
+// and tool_use IDs on every backend /v1/messages routes to, streaming and
+// not, and that the upstream ID of translated messages is kept.
+func TestTranslatedIDPrefixes(t *testing.T) {
+	responsesStream, err := servicetest.Transcript("testdata/fixtures/responses-eager-empty-message/input.sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		endpoint   string // the model's supported endpoint
+		upstream   string
+		stream     bool
+		reply      servicetest.Reply
+		upstreamID string // the upstream_id expected; empty for native messages
+	}{
+		{"chat completions", "/chat/completions", servicetest.ChatCompletions, false, servicetest.JSON(
+			`{"id":"chatcmpl-1","model":"MODEL","choices":[{"index":0,"message":{"role":"assistant","content":"ok","tool_calls":[{"id":"call_1","type":"function","function":{"name":"Read","arguments":"{}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":5,"completion_tokens":2}}`),
+			"chatcmpl-1"},
+		{"chat completions streaming", "/chat/completions", servicetest.ChatCompletions, true, servicetest.SSE(
+			`{"id":"chatcmpl-2","model":"MODEL","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_2","type":"function","function":{"name":"Read","arguments":"{}"}}]}}]}`,
+			`{"id":"chatcmpl-2","model":"MODEL","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":5,"completion_tokens":2}}`,
+			`[DONE]`),
+			"chatcmpl-2"},
+		{"responses", "/responses", servicetest.Responses, false, servicetest.JSON(
+			`{"id":"resp_3","object":"response","status":"completed","model":"MODEL","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"ok"}]},{"type":"function_call","id":"fc_3","call_id":"call_3","name":"Read","arguments":"{}"}],"usage":{"input_tokens":5,"output_tokens":2}}`),
+			"resp_3"},
+		{"responses streaming", "/responses", servicetest.Responses, true, responsesStream, "resp_1"},
+		{"messages", "/v1/messages", servicetest.Messages, false, servicetest.JSON(
+			`{"id":"msg_01native","type":"message","role":"assistant","model":"MODEL","content":[{"type":"tool_use","id":"toolu_01native","name":"Read","input":{}}],"stop_reason":"tool_use","usage":{"input_tokens":5,"output_tokens":2}}`),
+			""},
+		{"messages streaming", "/v1/messages", servicetest.Messages, true, servicetest.Reply{Events: []servicetest.Event{
+			{Name: "message_start", Data: `{"type":"message_start","message":{"id":"msg_01native","type":"message","role":"assistant","model":"MODEL","content":[],"usage":{"input_tokens":5,"output_tokens":0}}}`},
+			{Name: "content_block_start", Data: `{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_01native","name":"Read","input":{}}}`},
+			{Name: "content_block_stop", Data: `{"type":"content_block_stop","index":0}`},
+			{Name: "message_delta", Data: `{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":2}}`},
+			{Name: "message_stop", Data: `{"type":"message_stop"}`},
+		}}, ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := "ids-model-" + strconv.Itoa(i)
+			if tt.endpoint == "/v1/messages" {
+				model = "claude-ids-" + strconv.Itoa(i)
+			}
+			reply := tt.reply
+			reply.Body = replaceModel(reply.Body, model)
+			for j := range reply.Events {
+				reply.Events[j].Data = replaceModel(reply.Events[j].Data, model)
+			}
+			fake := &servicetest.Fake{}
+			fake.Script(tt.upstream, reply)
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: model, SupportedEndpoints: []string{tt.endpoint}})
+
+			body, _ := json.Marshal(map[string]any{
+				"model":      model,
+				"max_tokens": 1024,
+				"stream":     tt.stream,
+				"messages":   []map[string]any{{"role": "user", "content": "ids " + tt.name}},
+				"tools":      []map[string]any{{"name": "Read", "input_schema": map[string]any{"type": "object", "properties": map[string]any{}}}},
+			})
+			w := httptest.NewRecorder()
+			Messages(w, newRequest("POST", "/v1/messages", string(body)))
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			ids := idsOf(t, w.Body.String(), tt.stream)
+			if tt.upstreamID == "" {
+				if ids.message != "msg_01native" || ids.upstream != "" {
+					t.Errorf("native message ID %q, upstream_id %q; want msg_01native passed through", ids.message, ids.upstream)
+				}
+			} else {
+				if !derivedMessageIDRe.MatchString(ids.message) || ids.message != anthropicMessageID(tt.upstreamID) {
+					t.Errorf("message ID %q, want the msg_ ID derived from %s", ids.message, tt.upstreamID)
+				}
+				if ids.upstream != tt.upstreamID {
+					t.Errorf("upstream_id %q, want %q", ids.upstream, tt.upstreamID)
+				}
+			}
+			if len(ids.toolUses) != 1 {
+				t.Fatalf("tool_use IDs %v, want one", ids.toolUses)
+			}
+			if id := ids.toolUses[0]; !strings.HasPrefix(id, "toolu_") || id == "toolu_" {
+				t.Errorf("tool_use ID %q lacks the toolu_ prefix", id)
+			}
+		})
+	}
+}
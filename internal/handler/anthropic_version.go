@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// supportedAnthropicVersions are the anthropic-version values whose
+// request and stream shapes the proxy implements, newest first. The first
+// is assumed for requests without the header.
+var supportedAnthropicVersions = []string{"2023-06-01"}
+
+// negotiateAnthropicVersion checks the anthropic-version header of r and
+// echoes the version the request is handled as on w. An unsupported
+// version is answered with an invalid_request_error, returning false,
+// unless anthropicVersionCheck is "warn".
+func negotiateAnthropicVersion(w http.ResponseWriter, r *http.Request) bool {
+	version := strings.TrimSpace(r.Header.Get("Anthropic-Version"))
+	switch {
+	case version == "":
+		version = supportedAnthropicVersions[0]
+	case !slices.Contains(supportedAnthropicVersions, version):
+		if config.FromContext(r.Context()).GetAnthropicVersionCheck() == config.AnthropicVersionReject {
+			slog.Warn("rejecting unsupported anthropic-version", "version", version, "path", r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{
+				"type": "error",
+				"error": map[string]string{
+					"type": "invalid_request_error",
+					"message": "anthropic-version: " + version + " is not supported; supported versions: " +
+						strings.Join(supportedAnthropicVersions, ", "),
+				},
+			})
+			return false
+		}
+		slog.Warn("unsupported anthropic-version, handling as "+supportedAnthropicVersions[0], "version", version, "path", r.URL.Path)
+		version = supportedAnthropicVersions[0]
+	}
+	w.Header().Set("Anthropic-Version", version)
+	return true
+}
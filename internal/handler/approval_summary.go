@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// ApprovalSummary describes a completion request for the start --manual
+// prompt: the model after small-model routing, compact/warmup, initiator,
+// estimated input tokens, and whether it will consume premium requests.
+// It classifies the body as the handler will, without changing it.
+func ApprovalSummary(r *http.Request, body []byte) (middleware.RequestSummary, bool) {
+	s := middleware.RequestSummary{RequestType: "normal"}
+	var heuristicAgent bool
+	switch r.URL.Path {
+	case "/v1/messages":
+		var req AnthropicRequest
+		if json.Unmarshal(body, &req) != nil {
+			return s, false
+		}
+		betaHeader := r.Header.Get("Anthropic-Beta")
+		s.Model = req.Model
+		if isCompactRequest(&req) {
+			s.RequestType = "compact"
+		} else if isWarmupRequest(&req, betaHeader) {
+			s.RequestType = "warmup"
+		}
+		applySmallModelIfNeeded(r.Context(), &req, betaHeader)
+		s.RoutedModel = req.Model
+		heuristicAgent = detectSubagentMarker(req.Messages) != nil || isInitiatorAgent(req.Messages)
+		s.InputTokens, _ = estimateAnthropicTokens(r.Context(), &req, betaHeader)
+
+	case "/chat/completions", "/v1/chat/completions":
+		var req struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Role string `json:"role"`
+			} `json:"messages"`
+		}
+		if json.Unmarshal(body, &req) != nil {
+			return s, false
+		}
+		s.Model = req.Model
+		if n := len(req.Messages); n > 0 {
+			role := req.Messages[n-1].Role
+			heuristicAgent = role == "assistant" || role == "tool"
+		}
+		s.InputTokens = countStringTokens(string(body))
+
+	case "/responses", "/v1/responses":
+		var payload map[string]any
+		if json.Unmarshal(body, &payload) != nil {
+			return s, false
+		}
+		s.Model, _ = payload["model"].(string)
+		heuristicAgent = detectAgentInResponses(payload)
+		s.InputTokens = countStringTokens(string(body))
+
+	default:
+		return s, false
+	}
+
+	if s.RoutedModel == "" {
+		s.RoutedModel = s.Model
+	}
+	isAgent, _, err := resolveInitiator(r, heuristicAgent)
+	if err != nil {
+		isAgent = heuristicAgent // the handler will reject the header
+	}
+	s.Initiator = initiatorStr(isAgent)
+
+	// Copilot bills premium requests for user-initiated requests only
+	if !isAgent {
+		s.Premium = true
+		if m := state.FromContext(r.Context()).FindModel(s.RoutedModel); m != nil && m.Billing != nil {
+			s.Premium = m.Billing.IsPremium || m.Billing.Multiplier > 0
+			s.Multiplier = m.Billing.Multiplier
+		}
+	}
+	return s, true
+}
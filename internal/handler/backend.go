@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+)
+
+type backendKey struct{}
+
+// WithBackend returns a copy of ctx whose requests the handlers send to b.
+// server.New sets it from the instance's backend.
+func WithBackend(ctx context.Context, b service.Backend) context.Context {
+	return context.WithValue(ctx, backendKey{}, b)
+}
+
+// upstream returns the backend of ctx. A context without one is a wiring
+// bug, so it panics rather than send the request to another instance's
+// upstream.
+func upstream(ctx context.Context) service.Backend {
+	b, ok := ctx.Value(backendKey{}).(service.Backend)
+	if !ok {
+		panic("handler: context carries no proxy instance backend")
+	}
+	return b
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Backends a /v1/messages request can be translated for.
+var messagesBackends = []string{"messages", "responses", "chat_completions"}
+
+// resolveBackendOverride returns the backend forced for a /v1/messages
+// request to model by the X-Backend header, or else the backend query
+// parameter, and where it came from ("header" or "query"). Both empty
+// means no override. The override needs debug.allowBackendOverride (403
+// otherwise), and model must support the backend (400 naming the ones it
+// does).
+func resolveBackendOverride(r *http.Request, model *state.Model) (backend, source string, err error) {
+	backend, source = strings.TrimSpace(r.Header.Get("X-Backend")), "header"
+	if backend == "" {
+		backend, source = strings.TrimSpace(r.URL.Query().Get("backend")), "query"
+	}
+	if backend == "" {
+		return "", "", nil
+	}
+	if !config.FromContext(r.Context()).Debug.AllowBackendOverride {
+		return "", "", &api.HTTPError{
+			Message:    "backend override is disabled; set debug.allowBackendOverride to use X-Backend",
+			StatusCode: http.StatusForbidden,
+		}
+	}
+	backend = strings.ToLower(backend)
+	if !slices.Contains(messagesBackends, backend) {
+		return "", "", &api.HTTPError{
+			Message:    fmt.Sprintf("invalid backend %q (expected %s)", backend, strings.Join(messagesBackends, ", ")),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	supported := supportedBackends(model)
+	if !slices.Contains(supported, backend) {
+		name := "unknown model"
+		if model != nil {
+			name = "model " + model.ID
+		}
+		return "", "", &api.HTTPError{
+			Message:    fmt.Sprintf("%s doesn't support the %s backend (supported: %s)", name, backend, strings.Join(supported, ", ")),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	return backend, source, nil
+}
+
+// supportedBackends lists the backends model can be served by, in the
+// order selectBackend prefers them. A model that lists no endpoints, or
+// isn't known, is served by Chat Completions.
+func supportedBackends(model *state.Model) []string {
+	var out []string
+	if isMessagesSupported(model) {
+		out = append(out, "messages")
+	}
+	if isResponsesSupported(model) {
+		out = append(out, "responses")
+	}
+	if model == nil || len(model.SupportedEndpoints) == 0 || slices.Contains(model.SupportedEndpoints, "/chat/completions") {
+		out = append(out, "chat_completions")
+	}
+	return out
+}
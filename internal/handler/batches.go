@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/batch"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+)
+
+// listResponse is an OpenAI list object.
+type listResponse struct {
+	Object  string  `json:"object"`
+	Data    any     `json:"data"`
+	FirstID *string `json:"first_id,omitempty"`
+	LastID  *string `json:"last_id,omitempty"`
+	HasMore bool    `json:"has_more"`
+}
+
+// batchOwner returns the owner tag of the request's API key. Files and
+// batches are only visible to the key that created them.
+func batchOwner(r *http.Request) string {
+	return batch.Owner(middleware.APIKeyFromContext(r.Context()))
+}
+
+func writeBatchJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// CreateFile handles POST /v1/files — a multipart upload of a batch input
+// file (fields "file" and "purpose").
+func CreateFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, batch.MaxFileBytes+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		api.ForwardError(w, &api.HTTPError{Message: "invalid multipart upload: " + err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		api.ForwardError(w, &api.HTTPError{Message: "missing file", StatusCode: http.StatusBadRequest})
+		return
+	}
+	defer upload.Close()
+
+	f, err := batch.FromContext(r.Context()).CreateFile(batchOwner(r), header.Filename, r.FormValue("purpose"), upload)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	writeBatchJSON(w, f)
+}
+
+// ListFiles handles GET /v1/files (?purpose=).
+func ListFiles(w http.ResponseWriter, r *http.Request) {
+	writeBatchJSON(w, listResponse{Object: "list", Data: batch.FromContext(r.Context()).ListFiles(batchOwner(r), r.URL.Query().Get("purpose"))})
+}
+
+// GetFile handles GET /v1/files/{id}.
+func GetFile(w http.ResponseWriter, r *http.Request) {
+	f, err := batch.FromContext(r.Context()).GetFile(batchOwner(r), chi.URLParam(r, "id"))
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	writeBatchJSON(w, f)
+}
+
+// FileContent handles GET /v1/files/{id}/content.
+func FileContent(w http.ResponseWriter, r *http.Request) {
+	content, f, err := batch.FromContext(r.Context()).OpenFile(batchOwner(r), chi.URLParam(r, "id"))
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	defer content.Close()
+	w.Header().Set("Content-Type", "application/jsonl")
+	http.ServeContent(w, r, f.Filename, time.Unix(f.CreatedAt, 0), content)
+}
+
+// DeleteFile handles DELETE /v1/files/{id}.
+func DeleteFile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := batch.FromContext(r.Context()).DeleteFile(batchOwner(r), id); err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	writeBatchJSON(w, map[string]any{"id": id, "object": "file", "deleted": true})
+}
+
+// CreateBatch handles POST /v1/batches.
+func CreateBatch(w http.ResponseWriter, r *http.Request) {
+	var req batch.CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.ForwardError(w, &api.HTTPError{Message: "invalid request body: " + err.Error(), StatusCode: http.StatusBadRequest})
+		return
+	}
+	b, err := batch.FromContext(r.Context()).Create(batchOwner(r), req)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	writeBatchJSON(w, b)
+}
+
+// ListBatches handles GET /v1/batches (?after= ?limit=, default 20).
+func ListBatches(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			api.ForwardError(w, &api.HTTPError{Message: "limit must be between 1 and 100", StatusCode: http.StatusBadRequest})
+			return
+		}
+		limit = n
+	}
+
+	list, hasMore := batch.FromContext(r.Context()).List(batchOwner(r), r.URL.Query().Get("after"), limit)
+	resp := listResponse{Object: "list", Data: list, HasMore: hasMore}
+	if len(list) > 0 {
+		resp.FirstID, resp.LastID = &list[0].ID, &list[len(list)-1].ID
+	}
+	writeBatchJSON(w, resp)
+}
+
+// GetBatch handles GET /v1/batches/{id}.
+func GetBatch(w http.ResponseWriter, r *http.Request) {
+	b, err := batch.FromContext(r.Context()).Get(batchOwner(r), chi.URLParam(r, "id"))
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	writeBatchJSON(w, b)
+}
+
+// CancelBatch handles POST /v1/batches/{id}/cancel.
+func CancelBatch(w http.ResponseWriter, r *http.Request) {
+	b, err := batch.FromContext(r.Context()).Cancel(batchOwner(r), chi.URLParam(r, "id"))
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	writeBatchJSON(w, b)
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Caches holds what the handlers keep between the requests of one proxy
+// instance: the single-flight groups, the response cache, idempotent
+// responses, the Responses store, the session pins and the logprobs
+// probe. Each instance has its own, put on its requests' context with
+// WithCaches, so no instance is answered from another's entries.
+type Caches struct {
+	// Single-flight groups for idempotent, non-streaming endpoints
+	countTokens *requestGroup
+	warmup      *requestGroup
+	models      *requestGroup
+	usage       *requestGroup
+
+	responses  *responseCache
+	idempotent *idempotencyCache
+	stored     *responseStore
+	pins       *sessionPinStore
+	logprobs   *logprobsProbe
+}
+
+// NewCaches returns the empty caches of a new proxy instance with state
+// st.
+func NewCaches(st *state.State) *Caches {
+	return &Caches{
+		countTokens: newRequestGroup("count_tokens", countTokensCacheTTL),
+		warmup:      newRequestGroup("warmup", 0),
+		models:      newRequestGroup("models", 0),
+		usage:       newRequestGroup("usage", 0),
+		responses:   newResponseCache(),
+		idempotent:  newIdempotencyCache(),
+		stored:      newResponseStore(),
+		pins:        newSessionPinStore(st),
+		logprobs:    newLogprobsProbe(),
+	}
+}
+
+// Close drops every cached entry, for an instance that is shutting down.
+// Requests still in flight finish.
+func (c *Caches) Close() {
+	for _, g := range []*requestGroup{c.countTokens, c.warmup, c.models, c.usage} {
+		g.reset()
+	}
+	c.responses.reset()
+	c.idempotent.reset()
+	c.stored.reset()
+	c.pins.reset()
+	c.logprobs.reset()
+}
+
+type cachesKey struct{}
+
+// WithCaches returns a context whose requests the handlers serve with c.
+func WithCaches(ctx context.Context, c *Caches) context.Context {
+	return context.WithValue(ctx, cachesKey{}, c)
+}
+
+// cachesOf returns the caches of the proxy instance serving ctx's
+// request. A context without them is a wiring bug, so it panics rather
+// than answer from another instance's entries.
+func cachesOf(ctx context.Context) *Caches {
+	c, ok := ctx.Value(cachesKey{}).(*Caches)
+	if !ok {
+		panic("handler: context carries no proxy instance caches")
+	}
+	return c
+}
@@ -1,7 +1,9 @@
 package handler
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,8 +12,11 @@ import (
 
 	"encoding/json"
 
+	chimw "github.com/go-chi/chi/v5/middleware"
+
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
-	"github.com/tonghaoch/copilot-proxy-go/internal/logger"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
 	"github.com/tonghaoch/copilot-proxy-go/internal/service"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
@@ -22,18 +27,46 @@ import (
 func ChatCompletions(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	body, isStream, isAgent, err := service.ParseAndPatchChatCompletion(r.Body)
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+
+	// Configured redactions, before anything is parsed or forwarded
+	if rd := newRedactor(r); rd != nil {
+		raw = rd.body(raw, rd.chat)
+		rd.report(w, "chat_completions")
+	}
+
+	// Model suffixes (model@low, model@small, model#nothink)
+	raw = applyModelSuffixToBody(r.Context(), raw, false)
+
+	body, isStream, isAgent, n, err := service.ParseAndPatchChatCompletion(r.Context(), bytes.NewReader(raw))
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+
+	// X-Initiator header / per-key default override the heuristic
+	isAgent, initiatorOverride, err := resolveInitiator(r, isAgent)
 	if err != nil {
 		api.ForwardError(w, err)
 		return
 	}
 
-	logger.For("chat-completions").Log("stream=%v initiator=%s", isStream, initiatorStr(isAgent))
+	// X-Fold-Thinking / foldThinkingIntoContent
+	fold, err := resolveFoldThinking(r)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
 
 	// Parse model name for metrics
 	var parsed struct {
-		Model    string `json:"model"`
-		Messages []any  `json:"messages"`
+		Model           string `json:"model"`
+		Messages        []any  `json:"messages"`
+		ReasoningEffort string `json:"reasoning_effort"`
 	}
 	modelName := ""
 	if json.Unmarshal(body, &parsed) == nil {
@@ -45,37 +78,163 @@ func ChatCompletions(w http.ResponseWriter, r *http.Request) {
 	} else {
 		slog.Info("chat completion request", "stream", isStream, "initiator", initiatorStr(isAgent))
 	}
+	logRequest(r, "chat-completions", modelName, "model=%s stream=%v initiator=%s", modelName, isStream, initiatorStr(isAgent))
 
-	resp, err := service.ProxyChatCompletion(body, isAgent)
-	if err != nil {
+	// logprobs: reject models known not to return them
+	wantLogprobs := requestsLogprobs(body)
+	if wantLogprobs {
+		if err := checkLogprobsRequest(r.Context(), modelName); err != nil {
+			api.ForwardError(w, err)
+			return
+		}
+	}
+
+	// Base record for metrics
+	rec := state.RequestRecord{
+		RequestID:         chimw.GetReqID(r.Context()),
+		Timestamp:         start,
+		Endpoint:          "chat_completions",
+		Model:             modelName,
+		RoutedModel:       modelName,
+		Backend:           "chat_completions",
+		RequestType:       "normal",
+		Initiator:         initiatorStr(isAgent),
+		InitiatorOverride: initiatorOverride,
+		Streaming:         isStream,
+		Chaos:             middleware.ChaosFromContext(r.Context()),
+	}
+	middleware.DescribeActiveRequest(r.Context(), rec.Model, rec.Initiator)
+
+	effort := parsed.ReasoningEffort
+
+	if n > 1 {
+		chatCompletionFanOut(w, r, body, isAgent, n, wantLogprobs, fold, effort, rec)
+		return
+	}
+
+	if key, ok := chatCompletionCacheKey(config.FromContext(r.Context()), body, isStream, fold); ok {
+		hit := cachesOf(r.Context()).responses.serve(r.Context(), w, key, func(w http.ResponseWriter) {
+			proxyChatCompletion(w, r, body, isAgent, wantLogprobs, fold, effort, rec)
+		})
+		if hit {
+			rec.Cached = true
+			rec.LatencyMs = time.Since(start).Milliseconds()
+			rec.StatusCode = http.StatusOK
+			state.MetricsFromContext(r.Context()).RecordRequest(rec)
+		}
+		return
+	}
+	proxyChatCompletion(w, r, body, isAgent, wantLogprobs, fold, effort, rec)
+}
+
+// proxyChatCompletion sends a single chat completion upstream, writes the
+// response, with its reasoning folded into the content if fold, and
+// records metrics on top of rec.
+func proxyChatCompletion(w http.ResponseWriter, r *http.Request, body []byte, isAgent, wantLogprobs, fold bool, effort string, rec state.RequestRecord) {
+	recordError := func(err error) {
+		rec.LatencyMs = time.Since(rec.Timestamp).Milliseconds()
+		rec.StatusCode = errorStatus(err)
+		rec.Error = err.Error()
+		state.MetricsFromContext(r.Context()).RecordRequest(rec)
 		api.ForwardError(w, err)
+	}
+
+	call := startUpstreamCall(w, r, config.TimeoutChatCompletions, effort)
+	defer call.stop()
+	resp, err := upstream(r.Context()).ProxyChatCompletion(call.ctx, body, isAgent)
+	resp, err = call.guard(resp, err, &rec)
+	if err != nil {
+		recordError(err)
 		return
 	}
 	defer resp.Body.Close()
 
-	if isStream {
-		streamSSE(w, resp.Body)
+	if rec.Streaming {
+		span := startSpan(r, spanStream)
+		var folder *thinkingFolder
+		if fold {
+			folder = newThinkingFolder()
+		}
+		cw := call.clientStream(w)
+		streamSSE(r.Context(), cw, resp.Body, folder)
+		cw.end(&rec)
+		span.End()
 	} else {
-		forwardJSON(w, resp)
+		// Buffered for the usage headers, and so an empty logprobs result
+		// becomes an explicit error
+		data, err := io.ReadAll(resp.Body)
+		if err == nil && wantLogprobs {
+			err = checkLogprobsResponse(r.Context(), rec.Model, data)
+		}
+		if err != nil {
+			recordError(err)
+			return
+		}
+		recordChatUsage(data, &rec)
+		if fold {
+			data = foldThinkingResponse(data)
+		}
+		setUsageHeaders(w, &rec)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(data)
 	}
 
 	// Record metrics
-	state.Metrics.RecordRequest(state.RequestRecord{
-		Timestamp:   start,
-		Endpoint:    "chat_completions",
-		Model:       modelName,
-		RoutedModel: modelName,
-		Backend:     "chat_completions",
-		RequestType: "normal",
-		Initiator:   initiatorStr(isAgent),
-		Streaming:   isStream,
-		LatencyMs:   time.Since(start).Milliseconds(),
-		StatusCode:  resp.StatusCode,
+	rec.LatencyMs = time.Since(rec.Timestamp).Milliseconds()
+	rec.StatusCode = resp.StatusCode
+	state.MetricsFromContext(r.Context()).RecordRequest(rec)
+}
+
+// chatCompletionFanOut serves a non-streaming request with n > 1 by merging
+// n upstream completions (see service.ProxyChatCompletionFanOut).
+func chatCompletionFanOut(w http.ResponseWriter, r *http.Request, body []byte, isAgent bool, n int, wantLogprobs, fold bool, effort string, rec state.RequestRecord) {
+	slog.Info("fanning out chat completion", "model", rec.Model, "n", n)
+
+	rec.N = n
+	rec.StatusCode = http.StatusOK
+
+	call := startUpstreamCall(w, r, config.TimeoutChatCompletions, effort)
+	defer call.stop()
+	// Unlike a deduplicated call, a fan-out serves only this client, so
+	// its requests stop when the client goes away
+	stopAfter := context.AfterFunc(r.Context(), func() {
+		call.disconnected.Store(true)
+		call.cancel()
 	})
+	defer stopAfter()
+	merged, err := upstream(r.Context()).ProxyChatCompletionFanOut(call.ctx, body, isAgent, n)
+	call.recordConn(&rec)
+	call.recordRequestIDs(&rec)
+	call.recordServedBy(&rec)
+	call.recordRateLimit(&rec)
+	// Also on an error: the requests that completed used their tokens
+	recordChatUsage(merged, &rec)
+	err = call.check(err, &rec)
+	if err == nil && wantLogprobs {
+		err = checkLogprobsResponse(r.Context(), rec.Model, merged)
+	}
+	rec.LatencyMs = time.Since(rec.Timestamp).Milliseconds()
+	if err != nil {
+		rec.StatusCode = errorStatus(err)
+		rec.Error = err.Error()
+		state.MetricsFromContext(r.Context()).RecordRequest(rec)
+		api.ForwardError(w, err)
+		return
+	}
+	state.MetricsFromContext(r.Context()).RecordRequest(rec)
+	if fold {
+		merged = foldThinkingResponse(merged)
+	}
+
+	setUsageHeaders(w, &rec)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(merged)
 }
 
-// streamSSE proxies an SSE stream from the Copilot API to the client.
-func streamSSE(w http.ResponseWriter, body io.Reader) {
+// streamSSE proxies an SSE stream from the Copilot API to the client,
+// through fold unless it is nil.
+func streamSSE(ctx context.Context, w http.ResponseWriter, body io.Reader, fold *thinkingFolder) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
@@ -87,27 +246,39 @@ func streamSSE(w http.ResponseWriter, body io.Reader) {
 	w.Header().Set("Connection", "keep-alive")
 	w.WriteHeader(http.StatusOK)
 
-	scanner := bufio.NewScanner(body)
-	// Increase buffer size for large SSE events
-	scanner.Buffer(make([]byte, 0, 256*1024), 1024*1024)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		fmt.Fprintf(w, "%s\n", line)
+	rd := newSSELineReader(ctx, body)
+	for {
+		line, err := rd.readLine()
+		if errors.Is(err, errClientDisconnected) {
+			return
+		}
+		if err != nil && err != io.EOF {
+			slog.Error("SSE stream error", "error", err)
+			var tooLarge *sseEventTooLargeError
+			if errors.As(err, &tooLarge) || isRequestCanceled(err) {
+				// In the OpenAI stream error shape, ending the open event
+				data, _ := json.Marshal(map[string]any{
+					"error": map[string]string{"type": "api_error", "message": err.Error()},
+				})
+				fmt.Fprintf(w, "\ndata: %s\n\n", data)
+				flusher.Flush()
+			}
+			return
+		}
+		if fold != nil {
+			line = fold.line(line)
+		}
+		if line != "" || err == nil {
+			if _, werr := fmt.Fprintf(w, "%s\n", line); werr != nil {
+				return
+			}
+		}
 		// Flush after empty lines (SSE event boundary)
-		if line == "" {
+		if line == "" || err == io.EOF {
 			flusher.Flush()
 		}
+		if err == io.EOF {
+			return
+		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		slog.Error("SSE stream error", "error", err)
-	}
-}
-
-// forwardJSON forwards a non-streaming JSON response.
-func forwardJSON(w http.ResponseWriter, resp *http.Response) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
 }
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// hangingFanOut answers fan-outs with one completed response once ctx is
+// canceled, as the service does when the client leaves mid-request.
+type hangingFanOut struct {
+	servicetest.Fake
+	started chan struct{}
+}
+
+func (b *hangingFanOut) ProxyChatCompletionFanOut(ctx context.Context, body []byte, isAgent bool, n int) ([]byte, error) {
+	close(b.started)
+	<-ctx.Done()
+	return []byte(`{"choices":[{"index":0,"message":{"content":"done"}}],"usage":{"prompt_tokens":12,"completion_tokens":3}}`), ctx.Err()
+}
+
+func TestChatCompletionFanOutStopsWhenClientLeaves(t *testing.T) {
+	b := &hangingFanOut{started: make(chan struct{})}
+	useBackend(t, b)
+	useModels(t, state.Model{ID: "gpt-4.1", SupportedEndpoints: []string{"/chat/completions"}})
+	useConfig(t, func(c *config.Config) { c.ChatCompletionFanOut = true })
+
+	r := newRequest("POST", "/chat/completions", `{"model":"gpt-4.1","n":3,"messages":[{"role":"user","content":"hi"}]}`)
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ChatCompletions(httptest.NewRecorder(), r)
+	}()
+	<-b.started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fan-out kept running after the client left")
+	}
+
+	rec := recordOf(t, r)
+	if !rec.ClientDisconnected {
+		t.Error("record isn't marked client_disconnected")
+	}
+	if rec.InputTokens != 12 || rec.OutputTokens != 3 || rec.N != 3 {
+		t.Errorf("record tokens = %d/%d n=%d, want the completed response's 12/3 n=3", rec.InputTokens, rec.OutputTokens, rec.N)
+	}
+}
@@ -0,0 +1,253 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// endlessBackend streams events until the context of the upstream request
+// ends, and reports when it did.
+type endlessBackend struct {
+	*servicetest.Fake
+	prelude []string // SSE events sent first
+	event   string   // then sent every few milliseconds
+
+	once     sync.Once
+	canceled chan time.Time
+}
+
+func (b *endlessBackend) stream(ctx context.Context) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, e := range b.prelude {
+			if _, err := io.WriteString(pw, e); err != nil {
+				return
+			}
+		}
+		tick := time.NewTicker(2 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				b.once.Do(func() { b.canceled <- time.Now() })
+				pw.CloseWithError(ctx.Err())
+				return
+			case <-tick.C:
+				if _, err := io.WriteString(pw, b.event); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       pr,
+	}, nil
+}
+
+func (b *endlessBackend) ProxyChatCompletion(ctx context.Context, _ []byte, _ bool) (*http.Response, error) {
+	return b.stream(ctx)
+}
+
+func (b *endlessBackend) ProxyChatCompletionEx(ctx context.Context, _ []byte, _, _ bool) (*http.Response, error) {
+	return b.stream(ctx)
+}
+
+func (b *endlessBackend) ProxyMessages(ctx context.Context, _ []byte, _ string, _, _ bool) (*http.Response, error) {
+	return b.stream(ctx)
+}
+
+func (b *endlessBackend) ProxyResponses(ctx context.Context, _ []byte, _, _ bool) (*http.Response, error) {
+	return b.stream(ctx)
+}
+
+func sseEvent(name, data string) string {
+	if name == "" {
+		return "data: " + data + "\n\n"
+	}
+	return "event: " + name + "\ndata: " + data + "\n\n"
+}
+
+// TestClientDisconnectCancelsUpstream closes the client's connection after
+// a few events of each kind of stream and expects the upstream request to
+// be canceled promptly, and the request recorded as client_disconnected.
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	const anthropicBody = `{"model":"MODEL","max_tokens":1024,"stream":true,"messages":[{"role":"user","content":"disconnect"}]}`
+	var (
+		chatDelta      = sseEvent("", `{"id":"c1","model":"MODEL","choices":[{"index":0,"delta":{"content":"tok "}}]}`)
+		responsesStart = []string{
+			sseEvent("response.created", `{"type":"response.created","response":{"id":"resp_1","model":"MODEL","usage":null}}`),
+			sseEvent("response.output_item.added", `{"type":"response.output_item.added","output_index":0,"item":{"type":"message","id":"msg_1","role":"assistant","content":[]}}`),
+		}
+		responsesDelta = sseEvent("response.output_text.delta", `{"type":"response.output_text.delta","output_index":0,"content_index":0,"delta":"tok "}`)
+	)
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		path     string
+		endpoint string
+		body     string
+		prelude  []string
+		event    string
+	}{
+		{"chat completions", ChatCompletions, "/v1/chat/completions", "/chat/completions",
+			`{"model":"MODEL","stream":true,"messages":[{"role":"user","content":"disconnect"}]}`, nil, chatDelta},
+		{"messages via chat completions", Messages, "/v1/messages", "/chat/completions", anthropicBody, nil, chatDelta},
+		{"messages via responses", Messages, "/v1/messages", "/responses", anthropicBody, responsesStart, responsesDelta},
+		{"messages via messages", Messages, "/v1/messages", "/v1/messages", anthropicBody,
+			[]string{
+				sseEvent("message_start", `{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"MODEL","content":[],"usage":{"input_tokens":5,"output_tokens":0}}}`),
+				sseEvent("content_block_start", `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`),
+			},
+			sseEvent("content_block_delta", `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"tok "}}`)},
+		{"responses", Responses, "/v1/responses", "/responses",
+			`{"model":"MODEL","stream":true,"input":"disconnect"}`, responsesStart, responsesDelta},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := fmt.Sprintf("claude-disconnect-%d", i)
+			useModels(t, state.Model{ID: model, SupportedEndpoints: []string{tt.endpoint}})
+			useConfig(t, func(c *config.Config) { c.StreamCoalesceMs = 0 })
+			backend := &endlessBackend{Fake: &servicetest.Fake{}, event: replaceModel(tt.event, model), canceled: make(chan time.Time, 1)}
+			for _, e := range tt.prelude {
+				backend.prelude = append(backend.prelude, replaceModel(e, model))
+			}
+			useBackend(t, backend)
+
+			// The handler runs under a request ID known to the test, so its
+			// metrics record can be found once it returns
+			id := fmt.Sprintf("disconnect-%d-%d", i, requestIDs.Add(1))
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+				tt.handler(w, r.WithContext(testContext(context.WithValue(r.Context(), chimw.RequestIDKey, id))))
+			}))
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := replaceModel(tt.body, model)
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: proxy\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", tt.path, len(body), body)
+
+			// Read a few events, then go away
+			rd := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(rd, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			events := bufio.NewReader(resp.Body)
+			for n := 0; n < 5; {
+				line, err := events.ReadString('\n')
+				if err != nil {
+					t.Fatalf("after %d events: %v", n, err)
+				}
+				if strings.HasPrefix(line, "data:") {
+					n++
+				}
+			}
+			conn.Close()
+			closed := time.Now()
+
+			select {
+			case at := <-backend.canceled:
+				if d := at.Sub(closed); d > time.Second {
+					t.Errorf("upstream request canceled %v after the client left", d)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("upstream request not canceled after the client left")
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler still running after the upstream request was canceled")
+			}
+
+			var rec *state.RequestRecord
+			for _, r := range state.Metrics.Snapshot().Recent {
+				if r.RequestID == id {
+					rec = &r
+					break
+				}
+			}
+			if rec == nil {
+				t.Fatalf("no metrics record for %s", id)
+			}
+			if !rec.ClientDisconnected {
+				t.Errorf("record not marked client_disconnected: %+v", *rec)
+			}
+		})
+	}
+}
+
+// brokenWriter fails every write after the first n, like a connection
+// whose client went away.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	n, writes int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > w.n {
+		return 0, io.ErrClosedPipe
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+// TestClientStreamWriteError checks that a failed write to the client
+// cancels the upstream call at once, without waiting for the request
+// context, and that later writes don't reach the connection.
+func TestClientStreamWriteError(t *testing.T) {
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder(), n: 2}
+	call := startUpstreamCall(w, newRequest("POST", "/v1/messages", ""), config.TimeoutMessages, "")
+	defer call.stop()
+	cw := call.clientStream(w)
+
+	for i := range 2 {
+		if _, err := cw.Write([]byte("data: {}\n\n")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if call.ctx.Err() != nil {
+		t.Fatal("upstream call canceled while the client was reading")
+	}
+	if _, err := cw.Write([]byte("data: {}\n\n")); !errors.Is(err, errClientDisconnected) {
+		t.Fatalf("failed write: got %v, want errClientDisconnected", err)
+	}
+	if call.ctx.Err() == nil {
+		t.Error("upstream call not canceled by the failed write")
+	}
+	if _, err := cw.Write([]byte("data: {}\n\n")); !errors.Is(err, errClientDisconnected) || w.writes != 3 {
+		t.Errorf("write after the failure: got %v after %d writes, want errClientDisconnected without writing", err, w.writes)
+	}
+	if err := call.check(io.ErrUnexpectedEOF, nil); !errors.Is(err, errClientDisconnected) {
+		t.Errorf("check: got %v, want errClientDisconnected", err)
+	}
+	var rec state.RequestRecord
+	cw.end(&rec)
+	if !rec.ClientDisconnected {
+		t.Error("record not marked client_disconnected")
+	}
+}
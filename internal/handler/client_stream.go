@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// clientWriteTimeout bounds writing and flushing one event of a stream to
+// the client. A client that takes longer has stopped reading.
+const clientWriteTimeout = 10 * time.Second
+
+// errClientDisconnected ends a stream whose client went away.
+var errClientDisconnected = errors.New("client disconnected")
+
+// clientStream is the writer a stream is sent to the client through. Every
+// write and flush runs under a write deadline of clientWriteTimeout and
+// its error is checked, so a client that went away or stopped reading is
+// noticed on the first event it doesn't take, rather than when the
+// upstream stream ends. The client's request context ending (other than
+// by POST /api/requests/{id}/cancel) counts the same. Either way the
+// upstream call is canceled at once, and later writes fail without
+// touching the connection.
+//
+// Streams are never shared between clients, so ending the call on a
+// disconnect can't cut off anyone else.
+type clientStream struct {
+	http.ResponseWriter
+	conn      *http.ResponseController // of the innermost writer, which reports flush errors
+	call      *upstreamCall
+	stopAfter func() bool
+
+	mu  sync.Mutex
+	err error // set once the client is gone
+}
+
+// clientStream returns w wrapped for streaming the call's response. Call
+// end once the stream is written.
+func (c *upstreamCall) clientStream(w http.ResponseWriter) *clientStream {
+	s := &clientStream{ResponseWriter: w, conn: http.NewResponseController(innermostWriter(w)), call: c}
+	s.stopAfter = context.AfterFunc(c.client, func() {
+		if !middleware.CanceledFromContext(c.client) {
+			s.fail(c.client.Err())
+		}
+	})
+	return s
+}
+
+// innermostWriter unwraps the writers middleware put around the server's.
+func innermostWriter(w http.ResponseWriter) http.ResponseWriter {
+	for {
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return w
+		}
+		w = u.Unwrap()
+	}
+}
+
+func (s *clientStream) Write(p []byte) (int, error) {
+	if err := s.failed(); err != nil {
+		return 0, err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	n, err := s.ResponseWriter.Write(p)
+	if err != nil {
+		return n, s.fail(err)
+	}
+	return n, nil
+}
+
+func (s *clientStream) Flush() {
+	if s.failed() != nil {
+		return
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	// Middleware flushes don't report errors; the server's writer does,
+	// for what was just flushed through it
+	if err := s.conn.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.fail(err)
+	}
+}
+
+func (s *clientStream) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func (s *clientStream) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// fail marks the client gone, canceling the upstream call the first time,
+// and returns the error later writes get.
+func (s *clientStream) fail(cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = fmt.Errorf("%w: %v", errClientDisconnected, cause)
+		s.call.disconnected.Store(true)
+		s.call.cancel()
+		slog.Warn("client disconnected mid-stream, canceling upstream request",
+			"endpoint", s.call.endpoint, "request_id", s.call.requestID, "error", cause)
+	}
+	return s.err
+}
+
+// end stops watching the client, clears the write deadline so it doesn't
+// outlive the response on a kept-alive connection, and marks rec if the
+// client went away.
+func (s *clientStream) end(rec *state.RequestRecord) {
+	s.stopAfter()
+	if s.failed() == nil {
+		s.conn.SetWriteDeadline(time.Time{})
+	}
+	if s.call.disconnected.Load() && rec != nil {
+		rec.ClientDisconnected = true
+	}
+}
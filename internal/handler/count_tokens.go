@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"log/slog"
 	"math"
 	"net/http"
 	"strings"
 
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
@@ -16,21 +19,39 @@ type CountTokensResponse struct {
 }
 
 // CountTokens handles POST /v1/messages/count_tokens.
-// It translates the Anthropic payload to OpenAI format, then estimates
-// the token count using a simple heuristic (chars/4 approximation)
-// since full tiktoken support requires a separate Go library.
+// It translates the Anthropic payload as the backend serving the model
+// would (including its extra prompt), then estimates the token count using
+// a simple heuristic (chars/4 approximation) since full tiktoken support
+// requires a separate Go library.
+// Identical concurrent requests share one count, and results are cached
+// for a few seconds.
 func CountTokens(w http.ResponseWriter, r *http.Request) {
+	if !negotiateAnthropicVersion(w, r) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	anthropicBeta := r.Header.Get("Anthropic-Beta")
+
+	key := requestKey(normalizeJSON(body), []byte(anthropicBeta))
+	cachesOf(r.Context()).countTokens.serve(r.Context(), w, key, func(w http.ResponseWriter) {
+		countTokens(r.Context(), w, body, anthropicBeta)
+	})
+}
+
+// countTokens writes the token estimate for an Anthropic request body.
+func countTokens(ctx context.Context, w http.ResponseWriter, body []byte, anthropicBeta string) {
 	var req AnthropicRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(CountTokensResponse{InputTokens: 1})
 		return
 	}
 
-	model := state.Global.FindModel(req.Model)
-
-	// Translate to OpenAI format to count
-	ccReq, err := translateToOpenAI(&req, "")
+	count, err := estimateAnthropicTokens(ctx, &req, anthropicBeta)
 	if err != nil {
 		slog.Warn("count_tokens translation failed", "error", err)
 		w.Header().Set("Content-Type", "application/json")
@@ -38,13 +59,41 @@ func CountTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	anthropicBeta := r.Header.Get("Anthropic-Beta")
-	count := estimateTokens(ccReq, model, req.Model, req.Tools, anthropicBeta)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(CountTokensResponse{InputTokens: count})
 }
 
+// estimateAnthropicTokens estimates the input tokens of req, translated as
+// the backend serving its model will.
+func estimateAnthropicTokens(ctx context.Context, req *AnthropicRequest, anthropicBeta string) (int, error) {
+	req.applyModelSuffix(ctx)
+	model := state.FromContext(ctx).FindModel(req.Model)
+	switch selectBackend(model) {
+	case "responses":
+		payload, err := translateToResponses(ctx, req, req.extraPrompt(ctx))
+		if err != nil {
+			return 0, err
+		}
+		return estimateResponsesTokens(payload), nil
+	case "messages":
+		// Forwarded as is: no extra prompt or interleaved thinking
+		// protocol, so count it in OpenAI form without them
+		native := *req
+		native.Thinking = nil
+		ccReq, err := translateToOpenAI(ctx, &native, "")
+		if err != nil {
+			return 0, err
+		}
+		return estimateTokens(ccReq, model, req.Model, req.Tools, anthropicBeta), nil
+	default:
+		ccReq, err := translateToOpenAI(ctx, req, req.extraPrompt(ctx))
+		if err != nil {
+			return 0, err
+		}
+		return estimateTokens(ccReq, model, req.Model, req.Tools, anthropicBeta), nil
+	}
+}
+
 // estimateTokens estimates the total token count for a chat completion request.
 func estimateTokens(req *ChatCompletionRequest, model *state.Model, modelID string, anthropicTools []AnthropicTool, anthropicBeta string) int {
 	total := 0
@@ -107,6 +156,69 @@ func estimateTokens(req *ChatCompletionRequest, model *state.Model, modelID stri
 	return total
 }
 
+// estimateResponsesTokens estimates the total token count for a Responses
+// API payload. Encrypted reasoning is opaque and not counted.
+func estimateResponsesTokens(p *ResponsesPayload) int {
+	total := countStringTokens(p.Instructions)
+
+	for _, item := range p.Input {
+		total += 4 // item overhead (type, role, formatting)
+		total += countResponsesContentTokens(item.Content)
+		total += countResponsesContentTokens(item.Output)
+		total += countStringTokens(item.Name)
+		total += countStringTokens(item.Arguments)
+		for _, s := range item.Summary {
+			total += countStringTokens(s.Text)
+		}
+	}
+
+	for _, tool := range p.Tools {
+		toolJSON, _ := json.Marshal(tool)
+		total += countStringTokens(string(toolJSON))
+		total += 5 // tool definition overhead
+	}
+
+	if total < 1 {
+		total = 1
+	}
+	return total
+}
+
+// countResponsesContentTokens estimates tokens for Responses content: a
+// string, or parts of which images count 85 tokens each.
+func countResponsesContentTokens(content any) int {
+	switch v := content.(type) {
+	case nil:
+		return 0
+	case string:
+		return countStringTokens(v)
+	case []map[string]string:
+		total := 0
+		for _, part := range v {
+			total += countStringTokens(part["text"])
+		}
+		return total
+	case []any:
+		total := 0
+		for _, part := range v {
+			switch p := part.(type) {
+			case map[string]string:
+				total += countStringTokens(p["text"])
+			case map[string]any:
+				if p["type"] == "input_image" {
+					total += 85
+				} else if text, ok := p["text"].(string); ok {
+					total += countStringTokens(text)
+				}
+			}
+		}
+		return total
+	default:
+		data, _ := json.Marshal(v)
+		return countStringTokens(string(data))
+	}
+}
+
 // countContentTokens estimates tokens for message content (string or parts array).
 func countContentTokens(content any) int {
 	switch v := content.(type) {
@@ -140,8 +252,13 @@ func countStringTokens(s string) int {
 	if s == "" {
 		return 0
 	}
+	return tokensForChars(len(s))
+}
+
+// tokensForChars converts a byte count to estimated tokens.
+func tokensForChars(n int) int {
 	// ~4 chars per token is a reasonable approximation
-	return (len(s) + 3) / 4
+	return (n + 3) / 4
 }
 
 // countImageTokens counts images in content and returns 85 tokens per image.
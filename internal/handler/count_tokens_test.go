@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+var countCalls atomic.Int64
+
+// countTokensFor returns the /v1/messages/count_tokens answer for body. Each
+// call differs in metadata, which isn't counted, so none is served from the
+// short-lived count cache.
+func countTokensFor(t *testing.T, body string) int {
+	t.Helper()
+	body = strings.Replace(body, "{", fmt.Sprintf(`{"metadata":{"user_id":"count-%d"},`, countCalls.Add(1)), 1)
+	w := httptest.NewRecorder()
+	CountTokens(w, newRequest("POST", "/v1/messages/count_tokens", body))
+	var resp CountTokensResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("count_tokens: %v: %s", err, w.Body)
+	}
+	return resp.InputTokens
+}
+
+func TestCountTokensIncludesWhatIsSent(t *testing.T) {
+	extra := strings.Repeat("Prefer small, focused diffs. ", 40)
+	extraTokens := tokensForChars(len("\n\n" + extra))
+	thinkingTokens := tokensForChars(len(interleavedThinkingPrompt)) + tokensForChars(len(interleavedThinkingReminder))
+	claude := func(n int) int { return n * 115 / 100 }
+	tests := []struct {
+		name     string
+		model    string
+		endpoint string
+		vary     string // "extra prompt" or "thinking"
+		want     int    // tokens it adds, within 3
+	}{
+		{"chat completions", "gpt-4.1", "/chat/completions", "extra prompt", extraTokens},
+		{"responses", "gpt-5", "/responses", "extra prompt", extraTokens},
+		{"claude on chat completions", "claude-sonnet-4", "/chat/completions", "extra prompt", claude(extraTokens)},
+		{"claude on chat completions", "claude-sonnet-4", "/chat/completions", "thinking", claude(thinkingTokens)},
+		{"messages API", "claude-sonnet-4.5", "/v1/messages", "extra prompt", 0},
+		{"messages API", "claude-sonnet-4.5", "/v1/messages", "thinking", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+", "+tt.vary, func(t *testing.T) {
+			useModels(t, state.Model{ID: tt.model, SupportedEndpoints: []string{tt.endpoint}})
+			count := func(on bool) int {
+				prompts := map[string]string(nil)
+				thinking := ""
+				if on && tt.vary == "extra prompt" {
+					prompts = map[string]string{tt.model: extra}
+				}
+				if on && tt.vary == "thinking" {
+					thinking = `"thinking":{"type":"enabled","budget_tokens":512},`
+				}
+				useConfig(t, func(c *config.Config) { c.ExtraPrompts = prompts })
+				return countTokensFor(t, `{"model":"`+tt.model+`","max_tokens":1024,`+thinking+`"system":"You are a coding agent.","messages":[{"role":"user","content":"count these tokens"}]}`)
+			}
+			base, with := count(false), count(true)
+			if added := with - base; added < tt.want-3 || added > tt.want+3 {
+				t.Errorf("count went from %d to %d (+%d), want about +%d", base, with, added, tt.want)
+			}
+		})
+	}
+}
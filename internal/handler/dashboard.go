@@ -1,16 +1,71 @@
 package handler
 
 import (
-	_ "embed"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
 	"net/http"
+	"strings"
 )
 
-//go:embed dashboard.html
-var dashboardHTML []byte
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// dashboardAssets serves the static CSS/JS bundle under /dashboard/assets/.
+var dashboardAssets = func() http.Handler {
+	sub, err := fs.Sub(dashboardFS, "dashboard/assets")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/assets/", http.FileServer(http.FS(sub)))
+}()
+
+// dashboardETags maps each asset path under dashboard/assets to an ETag
+// of its content. Embedded files have no modification time, so without
+// it a browser could only refetch the whole asset or keep a stale one.
+var dashboardETags = func() map[string]string {
+	etags := map[string]string{}
+	err := fs.WalkDir(dashboardFS, "dashboard/assets", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := dashboardFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		etags[strings.TrimPrefix(path, "dashboard/assets/")] = `"` + hex.EncodeToString(sum[:8]) + `"`
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return etags
+}()
 
 // Dashboard serves the embedded usage dashboard HTML page.
+// The page fetches /usage, /models and /api/stats from the same origin.
 func Dashboard(w http.ResponseWriter, r *http.Request) {
+	page, err := dashboardFS.ReadFile("dashboard/index.html")
+	if err != nil {
+		http.Error(w, "dashboard not available", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
-	w.Write(dashboardHTML)
+	w.Write(page)
+}
+
+// DashboardAssets handles GET /dashboard/assets/* — serves the embedded
+// dashboard stylesheet and scripts. The asset URLs carry no version, so
+// browsers revalidate on every load and get a 304 while the ETag matches;
+// after an upgrade they fetch the new bundle at once.
+func DashboardAssets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	if etag, ok := dashboardETags[strings.TrimPrefix(r.URL.Path, "/dashboard/assets/")]; ok {
+		w.Header().Set("ETag", etag)
+	}
+	dashboardAssets.ServeHTTP(w, r)
 }
@@ -1,768 +1,3 @@
-<!DOCTYPE html>
-<html lang="en">
-<head>
-<meta charset="UTF-8">
-<meta name="viewport" content="width=device-width, initial-scale=1.0">
-<title>Copilot Proxy Dashboard</title>
-<style>
-  :root {
-    --bg: #0a0e17;
-    --bg-card: rgba(255,255,255,0.04);
-    --bg-card-hover: rgba(255,255,255,0.07);
-    --border: rgba(255,255,255,0.08);
-    --border-hover: rgba(255,255,255,0.15);
-    --fg: #e2e8f0;
-    --fg-dim: #94a3b8;
-    --fg-muted: #64748b;
-    --accent: #38bdf8;
-    --accent-glow: rgba(56,189,248,0.15);
-    --green: #4ade80;
-    --yellow: #fbbf24;
-    --red: #f87171;
-    --purple: #a78bfa;
-    --orange: #fb923c;
-    --ring-size: 100px;
-    --ring-stroke: 8;
-  }
-
-  * { box-sizing: border-box; margin: 0; padding: 0; }
-
-  body {
-    font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;
-    background: var(--bg);
-    color: var(--fg);
-    min-height: 100vh;
-    line-height: 1.5;
-  }
-
-  .backdrop {
-    position: fixed; inset: 0; z-index: -1;
-    background:
-      radial-gradient(ellipse 60% 40% at 20% 10%, rgba(56,189,248,0.08), transparent),
-      radial-gradient(ellipse 50% 50% at 80% 80%, rgba(167,139,250,0.06), transparent);
-  }
-
-  .container {
-    max-width: 960px;
-    margin: 0 auto;
-    padding: 2rem 1.5rem;
-  }
-
-  /* -- Header -- */
-  .header {
-    display: flex;
-    align-items: center;
-    justify-content: space-between;
-    margin-bottom: 2rem;
-    flex-wrap: wrap;
-    gap: 1rem;
-  }
-
-  .header-left {
-    display: flex;
-    align-items: center;
-    gap: 0.75rem;
-  }
-
-  .logo {
-    width: 32px; height: 32px;
-    border-radius: 8px;
-    background: linear-gradient(135deg, var(--accent), var(--purple));
-    display: flex; align-items: center; justify-content: center;
-    font-weight: 700; font-size: 1rem; color: #fff;
-  }
-
-  .header h1 {
-    font-size: 1.35rem;
-    font-weight: 700;
-    color: var(--fg);
-    letter-spacing: -0.02em;
-  }
-
-  .header-right {
-    display: flex;
-    align-items: center;
-    gap: 1rem;
-  }
-
-  .status-badge {
-    display: flex; align-items: center; gap: 0.4rem;
-    font-size: 0.8rem; color: var(--fg-muted);
-  }
-
-  .status-dot {
-    width: 8px; height: 8px; border-radius: 50%;
-    background: var(--fg-muted);
-    transition: background 0.3s;
-  }
-
-  .status-dot.online {
-    background: var(--green);
-    box-shadow: 0 0 6px rgba(74,222,128,0.5);
-  }
-
-  .status-dot.offline {
-    background: var(--red);
-  }
-
-  .auto-refresh-toggle {
-    display: flex; align-items: center; gap: 0.5rem;
-    font-size: 0.8rem; color: var(--fg-muted); cursor: pointer;
-    user-select: none;
-  }
-
-  .toggle-track {
-    width: 36px; height: 20px;
-    background: rgba(255,255,255,0.1);
-    border-radius: 10px;
-    position: relative;
-    transition: background 0.2s;
-  }
-
-  .toggle-track.active {
-    background: var(--accent);
-  }
-
-  .toggle-knob {
-    width: 16px; height: 16px;
-    background: #fff;
-    border-radius: 50%;
-    position: absolute;
-    top: 2px; left: 2px;
-    transition: transform 0.2s;
-  }
-
-  .toggle-track.active .toggle-knob {
-    transform: translateX(16px);
-  }
-
-  /* -- Cards -- */
-  .card {
-    background: var(--bg-card);
-    backdrop-filter: blur(12px);
-    -webkit-backdrop-filter: blur(12px);
-    border: 1px solid var(--border);
-    border-radius: 12px;
-    padding: 1.25rem 1.5rem;
-    margin-bottom: 1rem;
-    transition: background 0.2s, border-color 0.2s, transform 0.2s;
-  }
-
-  .card:hover {
-    background: var(--bg-card-hover);
-    border-color: var(--border-hover);
-    transform: translateY(-1px);
-  }
-
-  .card-label {
-    font-size: 0.7rem;
-    font-weight: 600;
-    text-transform: uppercase;
-    letter-spacing: 0.08em;
-    color: var(--fg-muted);
-    margin-bottom: 0.75rem;
-  }
-
-  /* -- Stats Bar -- */
-  .stats-bar {
-    display: grid;
-    grid-template-columns: repeat(auto-fit, minmax(140px, 1fr));
-    gap: 0.75rem;
-    margin-bottom: 1rem;
-  }
-
-  .stat-chip {
-    background: var(--bg-card);
-    backdrop-filter: blur(12px);
-    -webkit-backdrop-filter: blur(12px);
-    border: 1px solid var(--border);
-    border-radius: 10px;
-    padding: 0.75rem 1rem;
-    text-align: center;
-    transition: background 0.2s, border-color 0.2s;
-  }
-
-  .stat-chip:hover {
-    background: var(--bg-card-hover);
-    border-color: var(--border-hover);
-  }
-
-  .stat-value {
-    font-size: 1.3rem;
-    font-weight: 700;
-    font-variant-numeric: tabular-nums;
-    color: var(--fg);
-    line-height: 1.2;
-  }
-
-  .stat-label {
-    font-size: 0.65rem;
-    font-weight: 600;
-    text-transform: uppercase;
-    letter-spacing: 0.06em;
-    color: var(--fg-muted);
-    margin-top: 0.2rem;
-  }
-
-  /* -- Plan Overview -- */
-  .plan-row {
-    display: flex;
-    align-items: center;
-    gap: 1rem;
-    flex-wrap: wrap;
-  }
-
-  .plan-badge {
-    display: inline-flex; align-items: center;
-    padding: 0.3rem 0.75rem;
-    border-radius: 6px;
-    background: linear-gradient(135deg, var(--accent), var(--purple));
-    color: #fff;
-    font-weight: 600;
-    font-size: 0.85rem;
-    text-transform: capitalize;
-  }
-
-  .plan-meta {
-    display: flex;
-    align-items: center;
-    gap: 1.5rem;
-    flex-wrap: wrap;
-  }
-
-  .meta-item {
-    display: flex;
-    flex-direction: column;
-  }
-
-  .meta-label {
-    font-size: 0.7rem;
-    color: var(--fg-muted);
-    text-transform: uppercase;
-    letter-spacing: 0.05em;
-  }
-
-  .meta-value {
-    font-size: 0.9rem;
-    color: var(--fg-dim);
-    font-weight: 500;
-  }
-
-  .countdown {
-    font-variant-numeric: tabular-nums;
-    color: var(--accent);
-    font-weight: 600;
-  }
-
-  /* -- Quota Grid -- */
-  .quota-grid {
-    display: grid;
-    grid-template-columns: repeat(auto-fill, minmax(200px, 1fr));
-    gap: 1rem;
-    margin-bottom: 1rem;
-  }
-
-  .quota-card {
-    background: var(--bg-card);
-    backdrop-filter: blur(12px);
-    -webkit-backdrop-filter: blur(12px);
-    border: 1px solid var(--border);
-    border-radius: 12px;
-    padding: 1.25rem;
-    display: flex;
-    flex-direction: column;
-    align-items: center;
-    text-align: center;
-    transition: background 0.2s, border-color 0.2s, transform 0.2s;
-  }
-
-  .quota-card:hover {
-    background: var(--bg-card-hover);
-    border-color: var(--border-hover);
-    transform: translateY(-2px);
-  }
-
-  .quota-name {
-    font-size: 0.75rem;
-    font-weight: 600;
-    text-transform: uppercase;
-    letter-spacing: 0.06em;
-    color: var(--fg-muted);
-    margin-bottom: 0.75rem;
-    word-break: break-word;
-  }
-
-  /* -- Ring Progress -- */
-  .ring-container {
-    position: relative;
-    width: var(--ring-size);
-    height: var(--ring-size);
-    margin-bottom: 0.75rem;
-  }
-
-  .ring-svg {
-    width: 100%; height: 100%;
-    transform: rotate(-90deg);
-  }
-
-  .ring-bg {
-    fill: none;
-    stroke: rgba(255,255,255,0.06);
-    stroke-width: var(--ring-stroke);
-  }
-
-  .ring-fill {
-    fill: none;
-    stroke-width: var(--ring-stroke);
-    stroke-linecap: round;
-    transition: stroke-dashoffset 1s ease, stroke 0.5s;
-  }
-
-  .ring-text {
-    position: absolute;
-    inset: 0;
-    display: flex;
-    flex-direction: column;
-    align-items: center;
-    justify-content: center;
-  }
-
-  .ring-pct {
-    font-size: 1.25rem;
-    font-weight: 700;
-    line-height: 1;
-    font-variant-numeric: tabular-nums;
-  }
-
-  .ring-label {
-    font-size: 0.65rem;
-    color: var(--fg-muted);
-    margin-top: 2px;
-  }
-
-  .quota-remaining {
-    font-size: 0.85rem;
-    color: var(--fg-dim);
-  }
-
-  .unlimited-badge {
-    display: inline-flex;
-    align-items: center;
-    gap: 0.3rem;
-    padding: 0.25rem 0.6rem;
-    border-radius: 6px;
-    background: rgba(56,189,248,0.15);
-    color: var(--accent);
-    font-size: 0.8rem;
-    font-weight: 600;
-  }
-
-  .unlimited-icon {
-    font-size: 1rem;
-  }
-
-  /* -- Collapsible Sections -- */
-  .collapsible-header {
-    display: flex;
-    align-items: center;
-    justify-content: space-between;
-    cursor: pointer;
-    user-select: none;
-  }
-
-  .collapsible-header:hover .card-label {
-    color: var(--fg-dim);
-  }
-
-  .chevron {
-    width: 20px; height: 20px;
-    color: var(--fg-muted);
-    transition: transform 0.3s;
-  }
-
-  .chevron.open {
-    transform: rotate(180deg);
-  }
-
-  .collapsible-body {
-    overflow: hidden;
-    max-height: 0;
-    transition: max-height 0.4s ease;
-  }
-
-  .collapsible-body.open {
-    max-height: 4000px;
-  }
-
-  /* -- Models Table -- */
-  .models-table {
-    width: 100%;
-    border-collapse: collapse;
-    margin-top: 0.75rem;
-    font-size: 0.85rem;
-  }
-
-  .models-table th {
-    text-align: left;
-    padding: 0.5rem 0.75rem;
-    font-size: 0.7rem;
-    font-weight: 600;
-    text-transform: uppercase;
-    letter-spacing: 0.06em;
-    color: var(--fg-muted);
-    border-bottom: 1px solid var(--border);
-  }
-
-  .models-table td {
-    padding: 0.5rem 0.75rem;
-    border-bottom: 1px solid rgba(255,255,255,0.03);
-    color: var(--fg-dim);
-  }
-
-  .models-table tr:hover td {
-    background: rgba(255,255,255,0.02);
-  }
-
-  .model-id {
-    font-family: ui-monospace, SFMono-Regular, 'SF Mono', Menlo, Consolas, monospace;
-    font-size: 0.8rem;
-    color: var(--accent);
-  }
-
-  .owner-badge {
-    display: inline-block;
-    padding: 0.15rem 0.45rem;
-    border-radius: 4px;
-    background: rgba(255,255,255,0.06);
-    font-size: 0.75rem;
-    color: var(--fg-dim);
-  }
-
-  .model-group-header td {
-    font-weight: 600;
-    color: var(--fg-muted);
-    font-size: 0.75rem;
-    text-transform: uppercase;
-    letter-spacing: 0.05em;
-    padding-top: 0.75rem;
-    border-bottom: 1px solid var(--border);
-  }
-
-  /* -- Badge -- */
-  .badge {
-    display: inline-block;
-    padding: 0.15rem 0.5rem;
-    border-radius: 4px;
-    font-size: 0.72rem;
-    font-weight: 600;
-    letter-spacing: 0.02em;
-  }
-
-  .badge-messages { background: rgba(56,189,248,0.15); color: var(--accent); }
-  .badge-responses { background: rgba(167,139,250,0.15); color: var(--purple); }
-  .badge-chat_completions { background: rgba(74,222,128,0.15); color: var(--green); }
-  .badge-compact { background: rgba(251,191,36,0.15); color: var(--yellow); }
-  .badge-warmup { background: rgba(248,113,113,0.15); color: var(--red); }
-  .badge-normal { background: rgba(255,255,255,0.06); color: var(--fg-dim); }
-  .badge-enabled { background: rgba(74,222,128,0.15); color: var(--green); }
-  .badge-disabled { background: rgba(255,255,255,0.06); color: var(--fg-muted); }
-  .badge-feature { background: rgba(167,139,250,0.1); color: var(--purple); font-size: 0.7rem; margin: 0.15rem; }
-
-  /* -- Session Intelligence -- */
-  .session-grid {
-    display: grid;
-    grid-template-columns: 1fr 1fr;
-    gap: 1rem;
-    margin-top: 0.75rem;
-  }
-
-  .session-section {
-    background: rgba(0,0,0,0.2);
-    border-radius: 8px;
-    padding: 0.75rem 1rem;
-  }
-
-  .session-section-label {
-    font-size: 0.65rem;
-    font-weight: 600;
-    text-transform: uppercase;
-    letter-spacing: 0.06em;
-    color: var(--fg-muted);
-    margin-bottom: 0.5rem;
-  }
-
-  .tool-list {
-    display: flex;
-    flex-wrap: wrap;
-    gap: 0.3rem;
-  }
-
-  .tool-tag {
-    display: inline-block;
-    padding: 0.15rem 0.45rem;
-    border-radius: 4px;
-    background: rgba(255,255,255,0.06);
-    font-family: ui-monospace, SFMono-Regular, 'SF Mono', Menlo, Consolas, monospace;
-    font-size: 0.72rem;
-    color: var(--fg-dim);
-  }
-
-  .tool-tag.mcp {
-    background: rgba(167,139,250,0.12);
-    color: var(--purple);
-  }
-
-  .claude-md-content {
-    background: rgba(0,0,0,0.3);
-    border-radius: 8px;
-    padding: 0.75rem 1rem;
-    font-family: ui-monospace, SFMono-Regular, 'SF Mono', Menlo, Consolas, monospace;
-    font-size: 0.75rem;
-    line-height: 1.5;
-    overflow-x: auto;
-    white-space: pre-wrap;
-    word-break: break-word;
-    max-height: 300px;
-    overflow-y: auto;
-    color: var(--fg-dim);
-    margin-top: 0.5rem;
-  }
-
-  .claude-md-path {
-    font-family: ui-monospace, SFMono-Regular, 'SF Mono', Menlo, Consolas, monospace;
-    font-size: 0.75rem;
-    color: var(--accent);
-    margin-bottom: 0.25rem;
-  }
-
-  /* -- Activity Feed -- */
-  .activity-table {
-    width: 100%;
-    border-collapse: collapse;
-    margin-top: 0.75rem;
-    font-size: 0.8rem;
-  }
-
-  .activity-table th {
-    text-align: left;
-    padding: 0.4rem 0.5rem;
-    font-size: 0.65rem;
-    font-weight: 600;
-    text-transform: uppercase;
-    letter-spacing: 0.06em;
-    color: var(--fg-muted);
-    border-bottom: 1px solid var(--border);
-    white-space: nowrap;
-  }
-
-  .activity-table td {
-    padding: 0.4rem 0.5rem;
-    border-bottom: 1px solid rgba(255,255,255,0.03);
-    color: var(--fg-dim);
-    white-space: nowrap;
-  }
-
-  .activity-table tr:hover td {
-    background: rgba(255,255,255,0.02);
-  }
-
-  .activity-scroll {
-    max-height: 400px;
-    overflow-y: auto;
-    margin-top: 0.75rem;
-  }
-
-  /* -- Distribution Charts -- */
-  .charts-row {
-    display: grid;
-    grid-template-columns: 1fr 1fr;
-    gap: 1rem;
-    margin-bottom: 1rem;
-  }
-
-  .bar-chart {
-    margin-top: 0.5rem;
-  }
-
-  .bar-row {
-    display: flex;
-    align-items: center;
-    gap: 0.5rem;
-    margin-bottom: 0.4rem;
-  }
-
-  .bar-label {
-    font-size: 0.75rem;
-    color: var(--fg-dim);
-    min-width: 100px;
-    text-align: right;
-    font-family: ui-monospace, SFMono-Regular, 'SF Mono', Menlo, Consolas, monospace;
-    overflow: hidden;
-    text-overflow: ellipsis;
-    white-space: nowrap;
-  }
-
-  .bar-track {
-    flex: 1;
-    height: 18px;
-    background: rgba(255,255,255,0.04);
-    border-radius: 4px;
-    overflow: hidden;
-  }
-
-  .bar-fill {
-    height: 100%;
-    border-radius: 4px;
-    transition: width 0.6s ease;
-    min-width: 2px;
-  }
-
-  .bar-count {
-    font-size: 0.72rem;
-    color: var(--fg-muted);
-    min-width: 30px;
-    font-variant-numeric: tabular-nums;
-  }
-
-  /* -- Config Section -- */
-  .config-grid {
-    display: grid;
-    grid-template-columns: repeat(auto-fill, minmax(200px, 1fr));
-    gap: 0.75rem;
-    margin-top: 0.75rem;
-  }
-
-  .config-item {
-    display: flex;
-    flex-direction: column;
-    gap: 0.15rem;
-  }
-
-  .config-key {
-    font-size: 0.65rem;
-    font-weight: 600;
-    text-transform: uppercase;
-    letter-spacing: 0.06em;
-    color: var(--fg-muted);
-  }
-
-  .config-val {
-    font-size: 0.85rem;
-    color: var(--fg-dim);
-    font-family: ui-monospace, SFMono-Regular, 'SF Mono', Menlo, Consolas, monospace;
-  }
-
-  /* -- JSON Viewer -- */
-  .json-view {
-    background: rgba(0,0,0,0.3);
-    border-radius: 8px;
-    padding: 1rem;
-    font-family: ui-monospace, SFMono-Regular, 'SF Mono', Menlo, Consolas, monospace;
-    font-size: 0.78rem;
-    line-height: 1.6;
-    overflow-x: auto;
-    white-space: pre-wrap;
-    word-break: break-word;
-    max-height: 500px;
-    overflow-y: auto;
-    margin-top: 0.75rem;
-  }
-
-  .json-key { color: var(--accent); }
-  .json-string { color: var(--green); }
-  .json-number { color: var(--yellow); }
-  .json-bool { color: var(--purple); }
-  .json-null { color: var(--fg-muted); }
-  .json-bracket { color: var(--fg-dim); }
-
-  /* -- Loading / Error -- */
-  .loading-container {
-    display: flex;
-    flex-direction: column;
-    align-items: center;
-    justify-content: center;
-    padding: 4rem 1rem;
-    color: var(--fg-muted);
-  }
-
-  .spinner {
-    width: 32px; height: 32px;
-    border: 3px solid rgba(255,255,255,0.08);
-    border-top-color: var(--accent);
-    border-radius: 50%;
-    animation: spin 0.8s linear infinite;
-    margin-bottom: 1rem;
-  }
-
-  @keyframes spin { to { transform: rotate(360deg); } }
-
-  @keyframes ring-in {
-    from { stroke-dashoffset: var(--circumference); }
-  }
-
-  .error-card {
-    background: rgba(248,113,113,0.08);
-    border: 1px solid rgba(248,113,113,0.25);
-    border-radius: 12px;
-    padding: 1.25rem 1.5rem;
-    color: var(--red);
-    margin-bottom: 1rem;
-  }
-
-  .last-updated {
-    text-align: center;
-    font-size: 0.75rem;
-    color: var(--fg-muted);
-    margin-top: 1.5rem;
-    padding-bottom: 1rem;
-  }
-
-  /* -- Responsive -- */
-  @media (max-width: 600px) {
-    .container { padding: 1rem; }
-    .header h1 { font-size: 1.1rem; }
-    .quota-grid { grid-template-columns: repeat(auto-fill, minmax(150px, 1fr)); }
-    .session-grid { grid-template-columns: 1fr; }
-    .charts-row { grid-template-columns: 1fr; }
-    :root { --ring-size: 80px; }
-  }
-</style>
-</head>
-<body>
-<div class="backdrop"></div>
-<div class="container">
-  <!-- Header -->
-  <div class="header">
-    <div class="header-left">
-      <div class="logo">CP</div>
-      <h1>Copilot Proxy</h1>
-    </div>
-    <div class="header-right">
-      <div class="status-badge">
-        <span class="status-dot" id="statusDot"></span>
-        <span id="statusText">Checking...</span>
-      </div>
-      <label class="auto-refresh-toggle" id="autoRefreshToggle">
-        <div class="toggle-track" id="toggleTrack">
-          <div class="toggle-knob"></div>
-        </div>
-        <span>Auto-refresh</span>
-      </label>
-    </div>
-  </div>
-
-  <!-- Content -->
-  <div id="content">
-    <div class="loading-container">
-      <div class="spinner"></div>
-      <span>Loading dashboard...</span>
-    </div>
-  </div>
-
-  <div class="last-updated" id="lastUpdated"></div>
-</div>
-
-<script>
 const BASE = window.location.origin;
 let autoRefresh = true;
 let refreshTimer = null;
@@ -770,11 +5,19 @@ let countdownTimer = null;
 let usageData = null;
 let modelsData = null;
 let statsData = null;
+let historyLoaded = false;
 
 // -- Init --
 document.addEventListener('DOMContentLoaded', () => {
   updateToggleUI();
   document.getElementById('autoRefreshToggle').addEventListener('click', toggleAutoRefresh);
+  document.querySelectorAll('.tab').forEach(tab => {
+    tab.addEventListener('click', () => showView(tab.dataset.view));
+  });
+  document.getElementById('historySearch').addEventListener('submit', e => {
+    e.preventDefault();
+    searchHistory();
+  });
   checkHealth();
   fetchAll();
   startAutoRefresh();
@@ -849,6 +92,7 @@ async function fetchAll() {
     }
 
     render();
+    updateTabs();
     document.getElementById('lastUpdated').textContent =
       'Last updated: ' + new Date().toLocaleTimeString();
   } catch (e) {
@@ -857,6 +101,71 @@ async function fetchAll() {
   }
 }
 
+// -- Tabs --
+function updateTabs() {
+  const enabled = !!(statsData && statsData.config && statsData.config.history_enabled);
+  document.getElementById('tabs').hidden = !enabled;
+  if (!enabled && !document.getElementById('historyView').hidden) {
+    showView('content');
+  }
+}
+
+function showView(id) {
+  for (const view of ['content', 'historyView']) {
+    document.getElementById(view).hidden = view !== id;
+  }
+  document.querySelectorAll('.tab').forEach(tab => {
+    tab.classList.toggle('active', tab.dataset.view === id);
+  });
+  if (id === 'historyView' && !historyLoaded) {
+    searchHistory();
+  }
+}
+
+// -- Transcript History --
+async function searchHistory() {
+  const q = document.getElementById('historyQuery').value;
+  const el = document.getElementById('historyResults');
+  try {
+    const resp = await fetch(BASE + '/api/history?limit=100&q=' + encodeURIComponent(q));
+    const data = await resp.json();
+    if (!resp.ok) {
+      el.innerHTML = '<div class="history-empty">' + escapeHtml((data.error && data.error.message) || resp.statusText) + '</div>';
+      return;
+    }
+    historyLoaded = true;
+    el.innerHTML = renderHistory(data.entries || []);
+  } catch (e) {
+    el.innerHTML = '<div class="history-empty">Failed to search history: ' + escapeHtml(e.message) + '</div>';
+  }
+}
+
+function renderHistory(entries) {
+  if (entries.length === 0) return '<div class="history-empty">No matching entries.</div>';
+
+  let html = '';
+  for (const h of entries) {
+    const model = h.routed_model ? h.model + ' -> ' + h.routed_model : h.model;
+    html += '<div class="history-entry">';
+    html += '<div class="history-meta">';
+    html += '<span title="' + escapeHtml(h.time) + '">' + escapeHtml(timeAgo(new Date(h.time))) + '</span>';
+    html += '<span class="model-id">' + escapeHtml(model || '') + '</span>';
+    html += '<span>' + escapeHtml(h.endpoint) + '</span>';
+    html += '<span>' + formatNumber(h.input_tokens || 0) + ' / ' + formatNumber(h.output_tokens || 0) + ' tokens</span>';
+    if (h.status >= 400) html += '<span style="color:var(--red)">HTTP ' + h.status + '</span>';
+    if (h.key_label) html += '<span>' + escapeHtml(h.key_label) + '</span>';
+    html += '</div>';
+    html += '<details><summary>' + escapeHtml(h.prompt || '(no text)') + '</summary>';
+    html += '<div class="session-section-label" style="margin-top:0.5rem">Prompt</div>';
+    html += '<div class="claude-md-content">' + escapeHtml(h.prompt || '') + '</div>';
+    html += '<div class="session-section-label" style="margin-top:0.5rem">Response</div>';
+    html += '<div class="claude-md-content">' + escapeHtml(h.response || '') + '</div>';
+    html += '</details>';
+    html += '</div>';
+  }
+  return html;
+}
+
 // -- Render --
 function render() {
   const el = document.getElementById('content');
@@ -877,6 +186,9 @@ function render() {
   // Activity Feed
   html += renderActivityFeed();
 
+  // Token Chart
+  html += renderTokenChart();
+
   // Distribution Charts
   html += renderDistributionCharts();
 
@@ -931,11 +243,46 @@ function renderStatsBar() {
   html += renderStatChip(inputTok, 'Input Tokens');
   html += renderStatChip(outputTok, 'Output Tokens');
   html += renderStatChip(cacheRate + '%', 'Cache Hit Rate');
+  if (statsData.trimmed_tool_requests) {
+    html += renderStatChip(formatNumber(statsData.trimmed_tool_requests), 'Trimmed Tool Reqs');
+  }
+  const up = statsData.upstream;
+  if (up && up.reused + up.new > 0) {
+    html += renderStatChip(Math.round((up.reused / (up.reused + up.new)) * 100) + '%', 'Conn Reuse');
+    html += renderStatChip(formatNumber(up.avg_ttfb_ms) + 'ms', 'Avg TTFB');
+  }
+  const failover = statsData.failover;
+  if (failover && failover.circuit.open && failover.upstreams.length) {
+    html += renderStatChip('ON', 'Failover');
+  }
+  const fallbackReqs = failover ? failover.upstreams.reduce((a, u) => a + u.requests, 0) : 0;
+  if (fallbackReqs) {
+    html += renderStatChip(formatNumber(fallbackReqs), 'Fallback Reqs');
+  }
+  const deduped = sumCounts(statsData.dedup_hits) + sumCounts(statsData.cache_hits);
+  if (deduped) {
+    html += renderStatChip(formatNumber(deduped), 'Deduped Reqs');
+  }
+  const premium = statsData.premium;
+  if (premium && premium.today) {
+    html += renderStatChip(formatNumber(premium.today), 'Premium Today');
+  }
+  if (premium && premium.quota && premium.quota.diverged) {
+    const q = premium.quota;
+    html += renderStatChip(formatNumber(q.used) + ' / ' + formatNumber(q.local_used), 'Premium Diverged');
+  }
   html += renderStatChip(uptime, 'Uptime');
+  if (statsData.build) {
+    html += renderStatChip(escapeHtml(statsData.build.version), 'Version');
+  }
   html += '</div>';
   return html;
 }
 
+function sumCounts(counts) {
+  return Object.values(counts || {}).reduce((a, b) => a + b, 0);
+}
+
 function renderStatChip(value, label) {
   return '<div class="stat-chip"><div class="stat-value">' + value + '</div><div class="stat-label">' + label + '</div></div>';
 }
@@ -1063,9 +410,10 @@ function renderSessionCard() {
 
   // CLAUDE.md files
   if (s.claude_md_files && s.claude_md_files.length > 0) {
+    html += '<div class="session-section-label" style="margin-top:0.75rem">Memory Files (' + s.claude_md_files.length + ', ~' + formatNumber(s.memory_tokens || 0) + ' tokens)</div>';
     for (const f of s.claude_md_files) {
       html += '<div style="margin-top:0.75rem">';
-      html += '<div class="claude-md-path">' + escapeHtml(f.path) + '</div>';
+      html += '<div class="claude-md-path">' + escapeHtml(f.path) + ' <span style="color:var(--fg-muted)">' + formatNumber(f.bytes || 0) + ' bytes, ~' + formatNumber(f.tokens || 0) + ' tokens</span></div>';
       html += '<div class="claude-md-content">' + escapeHtml(f.content) + '</div>';
       html += '</div>';
     }
@@ -1184,7 +532,7 @@ function renderActivityFeed() {
     const latency = r.latency_ms ? r.latency_ms + 'ms' : '';
 
     html += '<tr>';
-    html += '<td>' + escapeHtml(ts) + '</td>';
+    html += '<td title="' + escapeHtml(r.request_id || '') + '">' + escapeHtml(ts) + '</td>';
     html += '<td><span class="model-id">' + escapeHtml(shortModel) + '</span></td>';
     html += '<td><span class="badge badge-' + escapeHtml(backend) + '">' + escapeHtml(backend) + '</span></td>';
     html += '<td><span class="badge badge-' + escapeHtml(reqType) + '">' + escapeHtml(reqType) + '</span></td>';
@@ -1199,6 +547,40 @@ function renderActivityFeed() {
   return html;
 }
 
+// -- Token Chart --
+function renderTokenChart() {
+  if (!statsData || !statsData.recent || statsData.recent.length === 0) return '';
+
+  // Oldest first so the chart reads left to right
+  const records = statsData.recent.slice().reverse();
+  let max = 1;
+  for (const r of records) {
+    max = Math.max(max, (r.input_tokens || 0) + (r.output_tokens || 0));
+  }
+
+  let html = '<div class="card">';
+  html += '<div class="card-label">Tokens per Request</div>';
+  html += '<div class="token-chart">';
+  for (const r of records) {
+    const input = r.input_tokens || 0;
+    const output = r.output_tokens || 0;
+    const inPct = (input / max) * 100;
+    const outPct = (output / max) * 100;
+    const title = (r.routed_model || r.model || '') + ' — ' + formatNumber(input) + ' in / ' + formatNumber(output) + ' out';
+    html += '<div class="token-col" title="' + escapeHtml(title) + '">';
+    html += '<div class="token-out" style="height:' + outPct + '%"></div>';
+    html += '<div class="token-in" style="height:' + inPct + '%"></div>';
+    html += '</div>';
+  }
+  html += '</div>';
+  html += '<div class="token-legend">';
+  html += '<span><span class="legend-dot" style="background:var(--accent)"></span>Input</span>';
+  html += '<span><span class="legend-dot" style="background:var(--purple)"></span>Output</span>';
+  html += '</div>';
+  html += '</div>';
+  return html;
+}
+
 // -- Distribution Charts --
 function renderDistributionCharts() {
   if (!statsData) return '';
@@ -1213,6 +595,12 @@ function renderDistributionCharts() {
   html += '<div class="card-label">Model Distribution</div>';
   if (hasModels) {
     html += renderBarChart(statsData.model_counts, ['var(--accent)', 'var(--purple)', 'var(--green)', 'var(--yellow)', 'var(--orange)', 'var(--red)']);
+    const filtered = Object.entries(statsData.filtered || {}).sort((a, b) => b[1] - a[1]);
+    if (filtered.length > 0) {
+      html += '<div style="font-size:0.75rem;color:var(--fg-muted);margin-top:8px">Content filtered: ';
+      html += filtered.map(([model, n]) => escapeHtml(model) + ' ' + formatNumber(n)).join(', ');
+      html += '</div>';
+    }
   } else {
     html += '<div style="font-size:0.8rem;color:var(--fg-muted)">No data yet</div>';
   }
@@ -1287,10 +675,16 @@ function renderProxyConfig() {
   html += '<div class="config-grid">';
 
   html += configItem('Account Type', c.account_type || 'individual');
+  if (c.copilot_plan) html += configItem('Copilot Plan', c.copilot_plan);
   html += configItem('VS Code Version', c.vs_code_version || 'unknown');
-  html += configItem('Small Model', c.small_model || 'gpt-5-mini');
+  let smallModel = c.small_model || 'gpt-5-mini';
+  if (c.effective_small_model && c.effective_small_model !== smallModel) {
+    smallModel = c.effective_small_model + ' (' + smallModel + ' unavailable)';
+  }
+  html += configItem('Small Model', smallModel);
   html += configItem('Compact -> Small', c.compact_use_small_model ? 'Yes' : 'No');
   html += configItem('Auth', c.auth_enabled ? 'Enabled (' + c.api_key_count + ' keys)' : 'Disabled');
+  if (c.history_enabled) html += configItem('Transcript History', 'ON: prompts and responses stored on disk');
 
   html += '</div>';
 
@@ -1435,6 +829,3 @@ function timeAgo(date) {
   if (diff < 86400) return Math.floor(diff / 3600) + 'h ago';
   return Math.floor(diff / 86400) + 'd ago';
 }
-</script>
-</body>
-</html>
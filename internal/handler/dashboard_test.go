@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDashboardAssetsRevalidate(t *testing.T) {
+	r := newRequest("GET", "/dashboard/assets/dashboard.js", "")
+	w := httptest.NewRecorder()
+	DashboardAssets(w, r)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("first load: %d, ETag %q, Cache-Control %q; want 200 with an ETag and no-cache",
+			w.Code, etag, w.Header().Get("Cache-Control"))
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		ifNoneMatch string
+		want        int
+	}{
+		{"unchanged", "/dashboard/assets/dashboard.js", etag, http.StatusNotModified},
+		{"after an upgrade", "/dashboard/assets/dashboard.js", `"0000000000000000"`, http.StatusOK},
+		{"other asset", "/dashboard/assets/dashboard.css", etag, http.StatusOK},
+		{"missing", "/dashboard/assets/missing.js", etag, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := newRequest("GET", tt.path, "")
+		r.Header.Set("If-None-Match", tt.ifNoneMatch)
+		w := httptest.NewRecorder()
+		DashboardAssets(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
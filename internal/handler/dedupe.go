@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+const (
+	// countTokensCacheTTL is how long count_tokens results are reused.
+	// Claude Code re-counts the same prompt repeatedly while the user types.
+	countTokensCacheTTL = 5 * time.Second
+	// maxCachedResponses bounds each group's result cache.
+	maxCachedResponses = 256
+)
+
+// requestGroup deduplicates identical in-flight requests. The first caller
+// for a key runs the handler into a buffer; callers that arrive while it is
+// running wait and get a copy of the same response. With a TTL, successful
+// responses are also reused for that long.
+type requestGroup struct {
+	name string
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*flightCall
+	cache map[string]cachedResponse
+}
+
+type flightCall struct {
+	done chan struct{}
+	res  *bufferedResponse // nil if the handler panicked
+}
+
+type cachedResponse struct {
+	res     *bufferedResponse
+	expires time.Time
+}
+
+func newRequestGroup(name string, ttl time.Duration) *requestGroup {
+	return &requestGroup{
+		name:  name,
+		ttl:   ttl,
+		calls: make(map[string]*flightCall),
+		cache: make(map[string]cachedResponse),
+	}
+}
+
+// serve writes the response for key to w, running fn only if no identical
+// request is in flight or cached.
+func (g *requestGroup) serve(ctx context.Context, w http.ResponseWriter, key string, fn func(w http.ResponseWriter)) {
+	g.mu.Lock()
+	if c, ok := g.cache[key]; ok && time.Now().Before(c.expires) {
+		g.mu.Unlock()
+		state.MetricsFromContext(ctx).RecordDedupHit(g.name, true)
+		c.res.replay(w)
+		return
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		if call.res == nil {
+			api.ForwardError(w, errors.New("shared "+g.name+" request failed"))
+			return
+		}
+		state.MetricsFromContext(ctx).RecordDedupHit(g.name, false)
+		call.res.replay(w)
+		return
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		if call.res != nil && g.ttl > 0 && call.res.status < 300 {
+			g.storeLocked(key, call.res)
+		}
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	res := newBufferedResponse(config.FromContext(ctx).StreamBufferLimit())
+	fn(res)
+	res = res.checkOverflow(g.name)
+	call.res = res
+	res.replay(w)
+}
+
+// storeLocked caches res under key, dropping expired entries first. g.mu
+// must be held.
+func (g *requestGroup) storeLocked(key string, res *bufferedResponse) {
+	now := time.Now()
+	for k, c := range g.cache {
+		if !now.Before(c.expires) {
+			delete(g.cache, k)
+		}
+	}
+	if len(g.cache) >= maxCachedResponses {
+		return
+	}
+	g.cache[key] = cachedResponse{res: res, expires: now.Add(g.ttl)}
+}
+
+// reset drops the cached responses; requests in flight finish.
+func (g *requestGroup) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cache = make(map[string]cachedResponse)
+}
+
+// bufferedResponse captures a response so it can be replayed to several
+// clients. It is read-only once the handler returns. Writes past limit
+// fail and set overflow.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	limit       int
+	overflow    bool
+}
+
+func newBufferedResponse(limit int) *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK, limit: limit}
+}
+
+// checkOverflow returns b, or a 502 error response in its place if b's
+// handler wrote more than its limit.
+func (b *bufferedResponse) checkOverflow(name string) *bufferedResponse {
+	if !b.overflow {
+		return b
+	}
+	slog.Warn("dropping response over buffer limit", "group", name, "limit", b.limit)
+	res := newBufferedResponse(b.limit)
+	api.ForwardError(res, &api.HTTPError{Message: errStreamBufferFull.Error(), StatusCode: http.StatusBadGateway})
+	return res
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	if b.body.Len()+len(p) > b.limit {
+		b.overflow = true
+		return 0, errStreamBufferFull
+	}
+	return b.body.Write(p)
+}
+
+// replay writes the captured response to w.
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// requestKey hashes the parts identifying a request.
+func requestKey(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeJSON re-encodes a JSON body so that key order and whitespace
+// don't affect its key. Invalid JSON is returned as is.
+func normalizeJSON(body []byte) []byte {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return normalized
+}
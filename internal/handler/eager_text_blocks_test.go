@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Responses stream events for the eager text block tests, by shorthand.
+func eagerEvent(t *testing.T, shorthand string) (string, string) {
+	t.Helper()
+	kind, arg, _ := strings.Cut(shorthand, " ")
+	var idx int
+	fmt.Sscan(arg, &idx)
+	switch kind {
+	case "created":
+		return "response.created", `{"type":"response.created","response":{"id":"resp_1","model":"gpt-5","usage":null}}`
+	case "message":
+		return "response.output_item.added", fmt.Sprintf(`{"type":"response.output_item.added","output_index":%d,"item":{"type":"message","id":"msg_%d","role":"assistant","content":[]}}`, idx, idx)
+	case "part":
+		return "response.content_part.added", fmt.Sprintf(`{"type":"response.content_part.added","output_index":%d,"content_index":0,"part":{"type":"output_text","text":""}}`, idx)
+	case "delta":
+		return "response.output_text.delta", fmt.Sprintf(`{"type":"response.output_text.delta","output_index":%d,"content_index":0,"delta":"text"}`, idx)
+	case "message-done":
+		return "response.output_item.done", fmt.Sprintf(`{"type":"response.output_item.done","output_index":%d,"item":{"type":"message","id":"msg_%d","role":"assistant","content":[]}}`, idx, idx)
+	case "call":
+		return "response.output_item.added", fmt.Sprintf(`{"type":"response.output_item.added","output_index":%d,"item":{"type":"function_call","id":"fc_%d","call_id":"call_%d","name":"Read","arguments":""}}`, idx, idx, idx)
+	case "call-done":
+		return "response.output_item.done", fmt.Sprintf(`{"type":"response.output_item.done","output_index":%d,"item":{"type":"function_call","id":"fc_%d","call_id":"call_%d","name":"Read","arguments":"{}"}}`, idx, idx, idx)
+	case "completed":
+		return "response.completed", `{"type":"response.completed","response":{"id":"resp_1","model":"gpt-5","status":"completed","output":[],"usage":{"input_tokens":10,"output_tokens":2,"total_tokens":12}}}`
+	}
+	t.Fatalf("unknown event %q", shorthand)
+	return "", ""
+}
+
+// blockEvents summarizes the content block events of a translated stream
+// as "start 0 text", "delta 0", "stop 0".
+func blockEvents(t *testing.T, events []SSEEvent) []string {
+	t.Helper()
+	var out []string
+	for _, e := range events {
+		data, err := json.Marshal(e.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var evt struct {
+			Index        int `json:"index"`
+			ContentBlock struct {
+				Type string `json:"type"`
+			} `json:"content_block"`
+		}
+		json.Unmarshal(data, &evt)
+		switch e.Event {
+		case "content_block_start":
+			out = append(out, fmt.Sprintf("start %d %s", evt.Index, evt.ContentBlock.Type))
+		case "content_block_delta":
+			out = append(out, fmt.Sprintf("delta %d", evt.Index))
+		case "content_block_stop":
+			out = append(out, fmt.Sprintf("stop %d", evt.Index))
+		}
+	}
+	return out
+}
+
+func TestEagerTextBlocks(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+		eager []string // block events with eagerTextBlocks
+		lazy  []string // and without
+	}{
+		{
+			name:  "deltas reuse the eager block",
+			input: []string{"created", "message 0", "part 0", "delta 0", "delta 0", "message-done 0", "completed"},
+			eager: []string{"start 0 text", "delta 0", "delta 0", "stop 0"},
+			lazy:  []string{"start 0 text", "delta 0", "delta 0", "stop 0"},
+		},
+		{
+			name:  "item ends with zero deltas",
+			input: []string{"created", "message 0", "message-done 0", "completed"},
+			eager: []string{"start 0 text", "stop 0"},
+		},
+		{
+			name:  "empty item before a tool call",
+			input: []string{"created", "message 0", "message-done 0", "call 1", "call-done 1", "completed"},
+			eager: []string{"start 0 text", "stop 0", "start 1 tool_use", "stop 1"},
+			lazy:  []string{"start 0 tool_use", "stop 0"},
+		},
+		{
+			name:  "item cut off by response.completed",
+			input: []string{"created", "message 0", "completed"},
+			eager: []string{"start 0 text", "stop 0"},
+		},
+		{
+			name:  "block closed before the first delta",
+			input: []string{"created", "message 0", "call 1", "call-done 1", "part 0", "delta 0", "message-done 0", "completed"},
+			eager: []string{"start 0 text", "stop 0", "start 1 tool_use", "stop 1", "start 2 text", "delta 2", "stop 2"},
+			lazy:  []string{"start 0 tool_use", "stop 0", "start 1 text", "delta 1", "stop 1"},
+		},
+		{
+			name:  "two messages",
+			input: []string{"created", "message 0", "delta 0", "message-done 0", "message 1", "message-done 1", "message 2", "delta 2", "message-done 2", "completed"},
+			eager: []string{"start 0 text", "delta 0", "stop 0", "start 1 text", "stop 1", "start 2 text", "delta 2", "stop 2"},
+			lazy:  []string{"start 0 text", "delta 0", "stop 0", "start 1 text", "delta 1", "stop 1"},
+		},
+	}
+	for _, tt := range tests {
+		for _, eager := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/eager=%v", tt.name, eager), func(t *testing.T) {
+				s := NewResponsesStreamState("gpt-5")
+				s.eagerTextBlocks = eager
+				var events []SSEEvent
+				for _, shorthand := range tt.input {
+					eventType, data := eagerEvent(t, shorthand)
+					evts, err := s.TranslateEvent(eventType, data)
+					if err != nil {
+						t.Fatalf("%s: %v", shorthand, err)
+					}
+					events = append(events, evts...)
+				}
+				want := tt.lazy
+				if eager {
+					want = tt.eager
+				}
+				got := blockEvents(t, events)
+				if !slices.Equal(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				if n := len(events); n == 0 || events[n-1].Event != "message_stop" {
+					t.Error("stream doesn't end with message_stop")
+				}
+			})
+		}
+	}
+}
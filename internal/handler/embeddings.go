@@ -6,7 +6,7 @@ import (
 	"net/http"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
-	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
 )
 
 // Embeddings handles POST /embeddings and /v1/embeddings.
@@ -20,7 +20,10 @@ func Embeddings(w http.ResponseWriter, r *http.Request) {
 
 	slog.Info("embeddings request")
 
-	resp, err := service.ProxyEmbeddings(body)
+	call := startUpstreamCall(w, r, config.TimeoutEmbeddings, "")
+	defer call.stop()
+	resp, err := upstream(r.Context()).ProxyEmbeddings(call.ctx, body)
+	resp, err = call.guard(resp, err, nil)
 	if err != nil {
 		api.ForwardError(w, err)
 		return
@@ -0,0 +1,495 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Stream fixtures are upstream SSE transcripts with the output the stream
+// translators produce for them, kept as golden files. A fixture is a
+// directory holding fixture.json (translator and model), input.sse and
+// expected.sse. The proxy records them with start --record-fixture, and
+// TestFixtures replays them against the current translators.
+
+// Fixture translators: the stream paths a transcript can be replayed through.
+const (
+	FixtureChat                 = "chat"                  // Chat Completions → Anthropic (AnthropicStreamState)
+	FixtureResponses            = "responses"             // Responses → Anthropic (ResponsesStreamState)
+	FixtureResponsesPassthrough = "responses_passthrough" // Responses → Responses (StreamIDSync)
+	FixtureMessages             = "messages"              // native Messages → Anthropic (nativeStreamValidator)
+)
+
+// Fixture describes a recorded stream.
+type Fixture struct {
+	Translator string `json:"translator"`
+	Model      string `json:"model"`
+	// EagerTextBlocks replays a responses fixture as with the
+	// eagerTextBlocks config.
+	EagerTextBlocks bool `json:"eagerTextBlocks,omitempty"`
+}
+
+// FixtureResult is the outcome of checking one fixture.
+type FixtureResult struct {
+	Name string
+	// Diff describes the first difference from expected.sse; empty when
+	// the output matches.
+	Diff string
+	Err  error
+}
+
+// CheckFixtures replays every fixture under root and compares the output
+// with its expected.sse. With update, expected.sse is rewritten instead.
+func CheckFixtures(root string, update bool) ([]FixtureResult, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var results []FixtureResult
+	for _, e := range entries {
+		dir := filepath.Join(root, e.Name())
+		if _, err := os.Stat(filepath.Join(dir, "fixture.json")); !e.IsDir() || err != nil {
+			continue
+		}
+		res := FixtureResult{Name: e.Name()}
+		got, err := ReplayFixture(dir)
+		if err == nil {
+			err = checkFixtureOutput(dir, got)
+		}
+		switch {
+		case err != nil:
+			res.Err = err
+		case update:
+			res.Err = os.WriteFile(filepath.Join(dir, "expected.sse"), got, 0o644)
+		default:
+			want, err := os.ReadFile(filepath.Join(dir, "expected.sse"))
+			if err != nil {
+				res.Err = err
+			} else {
+				res.Diff = diffFixture(want, got)
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// ReplayFixture feeds a fixture's input.sse through its translator and
+// returns the SSE output.
+func ReplayFixture(dir string) ([]byte, error) {
+	fx, err := loadFixture(dir)
+	if err != nil {
+		return nil, err
+	}
+	input, err := os.Open(filepath.Join(dir, "input.sse"))
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	return replayStream(fx, input)
+}
+
+func loadFixture(dir string) (Fixture, error) {
+	var fx Fixture
+	path := filepath.Join(dir, "fixture.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fx, err
+	}
+	if err := json.Unmarshal(data, &fx); err != nil {
+		return fx, fmt.Errorf("%s: %w", path, err)
+	}
+	return fx, nil
+}
+
+// replayStream translates an upstream stream as the handlers do, without
+// delta coalescing or the output cap, which depend on timing and request.
+// Errors the handlers would send as an error event are written as one.
+func replayStream(fx Fixture, input io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	writeEvent := func(evt SSEEvent) error {
+		data, err := json.Marshal(evt.Data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&out, "event: %s\ndata: %s\n\n", evt.Event, data)
+		return nil
+	}
+
+	var err error
+	switch fx.Translator {
+	case FixtureChat:
+		streamState := NewAnthropicStreamState(fx.Model)
+		err = readSSE(fixtureContext(), input, func(eventType, data string) error {
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				return err
+			}
+			for _, evt := range streamState.TranslateChunk(&chunk) {
+				if err := writeEvent(evt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			for _, evt := range streamState.Finish() {
+				if err = writeEvent(evt); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			err = writeEvent(TranslateErrorEvent(err.Error()))
+		}
+	case FixtureResponses:
+		streamState := NewResponsesStreamState(fx.Model)
+		streamState.eagerTextBlocks = fx.EagerTextBlocks
+		err = readSSE(fixtureContext(), input, func(eventType, data string) error {
+			events, err := streamState.TranslateEvent(eventType, data)
+			if err != nil {
+				return err
+			}
+			for _, evt := range events {
+				if err := writeEvent(evt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			err = writeEvent(TranslateErrorEvent(err.Error()))
+		}
+		if err == nil && !streamState.IsComplete() {
+			err = writeEvent(TranslateErrorEvent("Stream ended unexpectedly without completion event"))
+		}
+	case FixtureResponsesPassthrough:
+		sync := NewStreamIDSync()
+		tracker := &responsesStreamTracker{}
+		var rec state.RequestRecord
+		err = readSSE(fixtureContext(), input, func(eventType, data string) error {
+			data = sync.Process(eventType, data)
+			tracker.observe(eventType, data, &rec)
+			if eventType != "" {
+				out.WriteString("event: " + eventType + "\n")
+			}
+			out.WriteString("data: " + data + "\n\n")
+			return nil
+		})
+		if !tracker.terminal {
+			msg := "upstream stream ended without a terminal event"
+			if err != nil {
+				msg = "upstream stream error: " + err.Error()
+			}
+			err = writeEvent(SSEEvent{Event: "response.failed", Data: tracker.failedEvent(msg)})
+		} else {
+			err = nil
+		}
+	case FixtureMessages:
+		validator := newNativeStreamValidator()
+		err = readSSE(fixtureContext(), input, func(eventType, data string) error {
+			before, skip := validator.process(eventType, data)
+			for _, evt := range before {
+				if err := writeEvent(evt); err != nil {
+					return err
+				}
+			}
+			if skip {
+				return nil
+			}
+			if eventType != "" {
+				out.WriteString("event: " + eventType + "\n")
+			}
+			out.WriteString("data: " + data + "\n\n")
+			return nil
+		})
+	default:
+		return nil, fmt.Errorf("unknown fixture translator %q", fx.Translator)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return syntheticIDRe.ReplaceAll(out.Bytes(), []byte("${1}fixture")), nil
+}
+
+// checkFixtureOutput checks that output translated to Anthropic events is
+// well-formed, whatever expected.sse says.
+func checkFixtureOutput(dir string, out []byte) error {
+	fx, err := loadFixture(dir)
+	if err != nil || fx.Translator == FixtureResponsesPassthrough {
+		return err
+	}
+	if err := checkAnthropicStream(out); err != nil {
+		return fmt.Errorf("malformed output: %w", err)
+	}
+	return nil
+}
+
+// fixtureContext returns the context fixtures are replayed under: the
+// default limits, whichever instance recorded them.
+func fixtureContext() context.Context {
+	return config.WithStore(context.Background(), config.NewStore(""))
+}
+
+// checkAnthropicStream checks content block structure in an Anthropic SSE
+// stream: blocks start at consecutive indexes, one at a time, and get
+// deltas and a stop only while open; tool_use blocks have an ID and name.
+// Message and tool_use IDs must have the msg_ and toolu_ prefixes
+// Anthropic SDKs expect.
+func checkAnthropicStream(stream []byte) error {
+	open, next, n := -1, 0, 0
+	return readSSE(fixtureContext(), bytes.NewReader(stream), func(eventType, data string) error {
+		n++
+		var evt struct {
+			Index   int `json:"index"`
+			Message struct {
+				ID string `json:"id"`
+			} `json:"message"`
+			ContentBlock struct {
+				Type string `json:"type"`
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"content_block"`
+		}
+		json.Unmarshal([]byte(data), &evt)
+		switch eventType {
+		case "message_start":
+			if !strings.HasPrefix(evt.Message.ID, "msg_") {
+				return fmt.Errorf("event %d: message ID %q without the msg_ prefix", n, evt.Message.ID)
+			}
+		case "content_block_start":
+			if open >= 0 {
+				return fmt.Errorf("event %d: block %d starts while block %d is open", n, evt.Index, open)
+			}
+			if evt.Index != next {
+				return fmt.Errorf("event %d: block %d starts, want %d", n, evt.Index, next)
+			}
+			if b := evt.ContentBlock; b.Type == "tool_use" && (b.ID == "" || b.Name == "") {
+				return fmt.Errorf("event %d: tool_use block %d without an id or name", n, evt.Index)
+			}
+			if b := evt.ContentBlock; b.Type == "tool_use" && !strings.HasPrefix(b.ID, "toolu_") {
+				return fmt.Errorf("event %d: tool_use ID %q without the toolu_ prefix", n, b.ID)
+			}
+			open, next = evt.Index, next+1
+		case "content_block_delta", "content_block_stop":
+			if evt.Index != open {
+				return fmt.Errorf("event %d: %s for block %d, which is not open", n, eventType, evt.Index)
+			}
+			if eventType == "content_block_stop" {
+				open = -1
+			}
+		case "message_delta", "message_stop":
+			if open >= 0 {
+				return fmt.Errorf("event %d: %s while block %d is open", n, eventType, open)
+			}
+		}
+		return nil
+	})
+}
+
+// syntheticIDRe matches the random part of IDs StreamIDSync generates.
+var syntheticIDRe = regexp.MustCompile(`\b(oi_\d+_)[0-9a-z]{16}\b`)
+
+// diffFixture describes the first line where got differs from want.
+func diffFixture(want, got []byte) string {
+	if bytes.Equal(want, got) {
+		return ""
+	}
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(string(got), "\n")
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("line %d:\n  want: %s\n  got:  %s", i+1, w, g)
+		}
+	}
+	return "output differs"
+}
+
+// Sanitizing
+
+// sanitizedFields are replaced in recorded transcripts: opaque reasoning
+// state, and padding that differs on every run.
+var sanitizedFields = map[string]bool{
+	"encrypted_content": true,
+	"reasoning_opaque":  true,
+	"signature":         true,
+	"obfuscation":       true,
+}
+
+// idFields hold upstream IDs, replaced with stable ones.
+var idFields = map[string]bool{
+	"id":          true,
+	"call_id":     true,
+	"item_id":     true,
+	"response_id": true,
+}
+
+// fixtureSanitizer rewrites a transcript so it can be committed: opaque
+// and random values are replaced, and IDs are numbered in order of first
+// appearance, keeping their prefix so the translators treat them alike.
+// Message text is kept; it's what the fixture exercises.
+type fixtureSanitizer struct {
+	ids map[string]string
+}
+
+// sanitize rewrites the JSON data lines of an SSE transcript. Other lines
+// pass through.
+func (s *fixtureSanitizer) sanitize(transcript []byte) []byte {
+	if s.ids == nil {
+		s.ids = make(map[string]string)
+	}
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(transcript), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			dec := json.NewDecoder(strings.NewReader(data))
+			dec.UseNumber()
+			var v any
+			if dec.Decode(&v) == nil {
+				if b, err := json.Marshal(s.walk(v)); err == nil {
+					// Keep the line ending, CRLF included
+					line = "data: " + string(b) + line[len(strings.TrimRight(line, "\r\n")):]
+				}
+			}
+		}
+		out.WriteString(line)
+	}
+	return out.Bytes()
+}
+
+func (s *fixtureSanitizer) walk(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			str, isString := val.(string)
+			switch {
+			case isString && str != "" && sanitizedFields[k]:
+				v[k] = "sanitized"
+			case isString && str != "" && idFields[k]:
+				v[k] = s.id(str)
+			default:
+				v[k] = s.walk(val)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = s.walk(v[i])
+		}
+	}
+	return v
+}
+
+func (s *fixtureSanitizer) id(orig string) string {
+	if id, ok := s.ids[orig]; ok {
+		return id
+	}
+	prefix := "id_"
+	if i := strings.IndexAny(orig, "_-"); i > 0 && i < len(orig)-1 {
+		prefix = orig[:i+1]
+	}
+	id := fmt.Sprintf("%s%d", prefix, len(s.ids)+1)
+	s.ids[orig] = id
+	return id
+}
+
+// Recording
+
+// fixtureRecorder copies an upstream stream as it's read and saves it as
+// a fixture when closed, if start --record-fixture is set. A stream larger
+// than maxStreamBufferBytes is not recorded.
+type fixtureRecorder struct {
+	io.ReadCloser
+	fx      Fixture
+	dir     string
+	buf     bytes.Buffer
+	limit   int
+	dropped bool
+	once    sync.Once
+}
+
+// recordFixture returns body, wrapped to be recorded when recording is on.
+func recordFixture(ctx context.Context, body io.ReadCloser, translator, model string) io.ReadCloser {
+	dir := state.FromContext(ctx).GetFixtureDir()
+	if dir == "" {
+		return body
+	}
+	cfg := config.FromContext(ctx)
+	fx := Fixture{Translator: translator, Model: model}
+	fx.EagerTextBlocks = translator == FixtureResponses && cfg.EagerTextBlocks
+	return &fixtureRecorder{ReadCloser: body, fx: fx, dir: dir, limit: cfg.StreamBufferLimit()}
+}
+
+func (r *fixtureRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.dropped {
+		return n, err
+	}
+	if r.buf.Len()+n > r.limit {
+		slog.Warn("stream too large to record as a fixture", "model", r.fx.Model, "limit", r.limit)
+		r.dropped = true
+		r.buf = bytes.Buffer{}
+		return n, err
+	}
+	r.buf.Write(p[:n])
+	return n, err
+}
+
+func (r *fixtureRecorder) Close() error {
+	r.once.Do(func() {
+		if r.dropped {
+			return
+		}
+		path, err := saveFixture(r.dir, r.fx, r.buf.Bytes())
+		if err != nil {
+			slog.Warn("failed to record fixture", "error", err)
+			return
+		}
+		slog.Info("recorded stream fixture", "path", path)
+	})
+	return r.ReadCloser.Close()
+}
+
+// saveFixture writes a sanitized transcript and its current output as a
+// new fixture directory under root.
+func saveFixture(root string, fx Fixture, transcript []byte) (string, error) {
+	input := (&fixtureSanitizer{}).sanitize(transcript)
+	expected, err := replayStream(fx, bytes.NewReader(input))
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s-%s", time.Now().Format("20060102-150405.000"), fx.Translator, fx.Model)
+	dir := filepath.Join(root, strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(name))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	meta, _ := json.MarshalIndent(fx, "", "  ")
+	files := map[string][]byte{
+		"fixture.json": append(meta, '\n'),
+		"input.sse":    input,
+		"expected.sse": expected,
+	}
+	for file, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0o644); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+var update = flag.Bool("update", false, "rewrite expected.sse of the stream fixtures and the golden files in testdata")
+
+// TestFixtures replays the stream fixtures in testdata/fixtures. After an
+// intended change in output, run it with -update and review the diff.
+func TestFixtures(t *testing.T) {
+	results, err := CheckFixtures("testdata/fixtures", *update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("no fixtures found")
+	}
+	for _, res := range results {
+		t.Run(res.Name, func(t *testing.T) {
+			switch {
+			case res.Err != nil:
+				t.Error(res.Err)
+			case res.Diff != "":
+				t.Errorf("output differs from expected.sse, %s", res.Diff)
+			}
+		})
+	}
+}
+
+// TestResponsesPassthroughFixtures streams the passthrough fixtures through
+// the /responses handler path, which must send what replayStream expects
+// and record the usage and error of the stream.
+func TestResponsesPassthroughFixtures(t *testing.T) {
+	tests := []struct {
+		fixture               string
+		input, cached, output int64
+		err                   string
+	}{
+		{fixture: "responses-passthrough-completed", input: 200, cached: 1000, output: 5},
+		{fixture: "responses-passthrough-incomplete", input: 40, output: 16},
+		{fixture: "responses-passthrough-truncated", err: "upstream stream ended without a terminal event"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			dir := filepath.Join("testdata/fixtures", tt.fixture)
+			input, err := os.ReadFile(filepath.Join(dir, "input.sse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(filepath.Join(dir, "expected.sse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(input))}
+			rec := state.RequestRecord{Model: "gpt-5"}
+			streamResponsesPassthrough(testContext(context.Background()), w, resp, nil, &rec)
+
+			got := syntheticIDRe.ReplaceAll(w.Body.Bytes(), []byte("${1}fixture"))
+			if diff := diffFixture(want, got); diff != "" {
+				t.Errorf("handler output differs from expected.sse, %s", diff)
+			}
+			if rec.InputTokens != tt.input || rec.CachedTokens != tt.cached || rec.OutputTokens != tt.output {
+				t.Errorf("tokens in/cached/out = %d/%d/%d, want %d/%d/%d",
+					rec.InputTokens, rec.CachedTokens, rec.OutputTokens, tt.input, tt.cached, tt.output)
+			}
+			if rec.Error != tt.err {
+				t.Errorf("error %q, want %q", rec.Error, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// Folded reasoning is wrapped in these, ahead of the answer.
+const (
+	thinkingOpenTag  = "<thinking>\n"
+	thinkingCloseTag = "\n</thinking>\n\n"
+)
+
+// resolveFoldThinking reports whether the reasoning of a /chat/completions
+// response is folded into its content: the X-Fold-Thinking header (true
+// or false), else foldThinkingIntoContent. Any other header value is a 400.
+// /v1/messages never folds; its clients render thinking blocks.
+func resolveFoldThinking(r *http.Request) (bool, error) {
+	switch h := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Fold-Thinking"))); h {
+	case "":
+		return config.FromContext(r.Context()).FoldThinkingIntoContent, nil
+	case "true", "1":
+		return true, nil
+	case "false", "0":
+		return false, nil
+	default:
+		return false, &api.HTTPError{
+			Message:    fmt.Sprintf("invalid X-Fold-Thinking header %q (expected true or false)", h),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+}
+
+// foldThinkingResponse moves the reasoning_text of every choice of a
+// non-streaming chat completion into its content, inside <thinking>
+// tags, and drops the reasoning fields. Tool calls are left alone. A body
+// that isn't a chat completion is returned as is.
+func foldThinkingResponse(data []byte) []byte {
+	var resp map[string]json.RawMessage
+	if json.Unmarshal(data, &resp) != nil {
+		return data
+	}
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(resp["choices"], &choices) != nil {
+		return data
+	}
+	changed := false
+	for _, choice := range choices {
+		var msg map[string]json.RawMessage
+		if json.Unmarshal(choice["message"], &msg) != nil || !hasReasoning(msg) {
+			continue
+		}
+		if reasoning := rawString(msg["reasoning_text"]); reasoning != "" {
+			msg["content"], _ = json.Marshal(thinkingOpenTag + reasoning + thinkingCloseTag + rawString(msg["content"]))
+		}
+		delete(msg, "reasoning_text")
+		delete(msg, "reasoning_opaque")
+		choice["message"], _ = json.Marshal(msg)
+		changed = true
+	}
+	if !changed {
+		return data
+	}
+	resp["choices"], _ = json.Marshal(choices)
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// thinkingFolder folds the reasoning of a streamed chat completion into
+// its content: reasoning_text deltas become content deltas, opened with
+// <thinking> and closed before the first answer text, tool call or
+// finish_reason of their choice.
+type thinkingFolder struct {
+	open map[int]bool // choices whose <thinking> isn't closed yet
+}
+
+func newThinkingFolder() *thinkingFolder {
+	return &thinkingFolder{open: make(map[int]bool)}
+}
+
+// line rewrites one SSE line; lines other than chunks with reasoning, or
+// of a choice with open thinking, are returned unchanged.
+func (f *thinkingFolder) line(line string) string {
+	data, ok := strings.CutPrefix(line, "data: ")
+	if !ok || (len(f.open) == 0 && !strings.Contains(data, `"reasoning_`)) {
+		return line
+	}
+	var chunk map[string]json.RawMessage
+	if json.Unmarshal([]byte(data), &chunk) != nil {
+		return line
+	}
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(chunk["choices"], &choices) != nil {
+		return line
+	}
+	changed := false
+	for _, choice := range choices {
+		if f.foldChoice(choice) {
+			changed = true
+		}
+	}
+	if !changed {
+		return line
+	}
+	chunk["choices"], _ = json.Marshal(choices)
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return "data: " + string(out)
+}
+
+// foldChoice rewrites the delta of one streamed choice, reporting whether
+// it changed.
+func (f *thinkingFolder) foldChoice(choice map[string]json.RawMessage) bool {
+	var index int
+	json.Unmarshal(choice["index"], &index)
+	var delta map[string]json.RawMessage
+	if json.Unmarshal(choice["delta"], &delta) != nil {
+		delta = make(map[string]json.RawMessage)
+	}
+	finished := len(choice["finish_reason"]) > 0 && string(choice["finish_reason"]) != "null"
+	if !hasReasoning(delta) && !(f.open[index] && (answerDelta(delta) || finished)) {
+		return false
+	}
+
+	reasoning := rawString(delta["reasoning_text"])
+	content := rawString(delta["content"])
+	var text string
+	if reasoning != "" {
+		if !f.open[index] {
+			text = thinkingOpenTag
+			f.open[index] = true
+		}
+		text += reasoning
+	}
+	if f.open[index] && (answerDelta(delta) || finished) {
+		text += thinkingCloseTag
+		delete(f.open, index)
+	}
+	delete(delta, "reasoning_text")
+	delete(delta, "reasoning_opaque")
+	if text != "" {
+		delta["content"], _ = json.Marshal(text + content)
+	}
+	choice["delta"], _ = json.Marshal(delta)
+	return true
+}
+
+func hasReasoning(m map[string]json.RawMessage) bool {
+	_, text := m["reasoning_text"]
+	_, opaque := m["reasoning_opaque"]
+	return text || opaque
+}
+
+// answerDelta reports whether a delta carries answer text or tool calls,
+// which end the folded thinking.
+func answerDelta(delta map[string]json.RawMessage) bool {
+	_, tools := delta["tool_calls"]
+	return rawString(delta["content"]) != "" || tools && string(delta["tool_calls"]) != "null"
+}
+
+// rawString decodes a JSON string, returning "" for null, a missing value
+// or anything else.
+func rawString(raw json.RawMessage) string {
+	var s string
+	json.Unmarshal(raw, &s)
+	return s
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Helpers shared by the handler tests. The tests' requests are served by
+// one instance on the process-wide state, metrics and config, so tests
+// that change them don't run in parallel and restore them on cleanup.
+
+// The test instance's caches and registries.
+var (
+	testAccount  = service.NewAccount()
+	testCaches   = NewCaches(state.Global)
+	testRegistry = middleware.NewRegistry(state.Metrics)
+	testNotified = notify.NewHistory()
+)
+
+// testBackend is the upstream of the requests newRequest returns.
+var testBackend service.Backend
+
+// useBackend sends the upstream calls of requests from newRequest to b for
+// the rest of the test.
+func useBackend(t *testing.T, b service.Backend) {
+	t.Helper()
+	testBackend = b
+	t.Cleanup(func() { testBackend = nil })
+}
+
+// useModels sets the Copilot models for the rest of the test.
+func useModels(t *testing.T, models ...state.Model) {
+	t.Helper()
+	prev := state.Global.GetModels()
+	state.Global.SetModels(models)
+	t.Cleanup(func() { state.Global.SetModels(prev) })
+}
+
+// useConfig applies fn to the config for the rest of the test.
+func useConfig(t *testing.T, fn func(c *config.Config)) {
+	t.Helper()
+	prev := config.Get()
+	config.Update(fn)
+	t.Cleanup(func() { config.Update(func(c *config.Config) { *c = *prev }) })
+}
+
+var requestIDs atomic.Int64
+
+// newRequest returns a request with a unique proxy request ID, the one
+// its metrics record carries, served by the backend set with useBackend.
+func newRequest(method, path, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	id := fmt.Sprintf("test-%d", requestIDs.Add(1))
+	return r.WithContext(testContext(context.WithValue(r.Context(), chimw.RequestIDKey, id)))
+}
+
+// testContext returns ctx served by the test instance, with the backend
+// set with useBackend.
+func testContext(ctx context.Context) context.Context {
+	backend := testBackend
+	if backend == nil {
+		backend = service.Copilot{}
+	}
+	ctx = state.WithState(ctx, state.Global)
+	ctx = state.WithMetrics(ctx, state.Metrics)
+	ctx = config.WithStore(ctx, config.Global)
+	ctx = service.WithAccount(ctx, testAccount)
+	ctx = WithBackend(ctx, backend)
+	ctx = WithCaches(ctx, testCaches)
+	ctx = middleware.WithRegistry(ctx, testRegistry)
+	return notify.WithHistory(ctx, testNotified)
+}
+
+// recordOf returns the metrics record of r.
+func recordOf(t *testing.T, r *http.Request) state.RequestRecord {
+	t.Helper()
+	id := chimw.GetReqID(r.Context())
+	for _, rec := range state.Metrics.Snapshot().Recent {
+		if rec.RequestID == id {
+			return rec
+		}
+	}
+	t.Fatalf("no metrics record for request %s", id)
+	return state.RequestRecord{}
+}
@@ -1,6 +1,20 @@
 package handler
 
-import "net/http"
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/buildinfo"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// tokenExpiringSoon is how close to expiry the Copilot token may get before
+// /healthz reports it as degraded. The refresher renews 60s before expiry,
+// so anything inside this window means a refresh is overdue.
+const tokenExpiringSoon = 2 * time.Minute
 
 // Health returns a simple health check response.
 func Health(w http.ResponseWriter, r *http.Request) {
@@ -8,3 +22,120 @@ func Health(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Server running"))
 }
+
+// healthzResponse is the JSON response for GET /healthz.
+type healthzResponse struct {
+	Status            string                  `json:"status"` // ok, degraded, unavailable
+	Build             buildinfo.Info          `json:"build"`
+	StartedAt         time.Time               `json:"started_at"`
+	Checks            map[string]healthzCheck `json:"checks"`
+	AnthropicVersions []string                `json:"anthropic_versions"` // accepted by /v1/messages
+}
+
+type healthzCheck struct {
+	Status    string     `json:"status"` // ok, warn, fail
+	Detail    string     `json:"detail,omitempty"`
+	Count     *int       `json:"count,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// Healthz handles GET /healthz — reports readiness of each component.
+// Responds 503 when any check fails, 200 otherwise.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	s := state.FromContext(r.Context())
+	checks := map[string]healthzCheck{
+		"github_token":  checkGithubToken(s),
+		"copilot_token": checkCopilotToken(s),
+		"models":        checkModels(s),
+		"upstream":      checkUpstream(s),
+		"config":        checkConfig(config.StoreFromContext(r.Context())),
+	}
+
+	status := "ok"
+	for _, c := range checks {
+		switch c.Status {
+		case "fail":
+			status = "unavailable"
+		case "warn":
+			if status == "ok" {
+				status = "degraded"
+			}
+		}
+	}
+
+	code := http.StatusOK
+	if status == "unavailable" {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(healthzResponse{
+		Status:            status,
+		Build:             buildinfo.Get(),
+		StartedAt:         state.ProcessStart(),
+		Checks:            checks,
+		AnthropicVersions: supportedAnthropicVersions,
+	})
+}
+
+func checkGithubToken(s *state.State) healthzCheck {
+	if s.GetGithubToken() == "" {
+		return healthzCheck{Status: "fail", Detail: "missing"}
+	}
+	return healthzCheck{Status: "ok", Detail: "present"}
+}
+
+func checkCopilotToken(s *state.State) healthzCheck {
+	if s.GetCopilotToken() == "" {
+		return healthzCheck{Status: "fail", Detail: "missing"}
+	}
+	expiresAt := s.GetCopilotTokenExpiresAt()
+	if expiresAt.IsZero() {
+		return healthzCheck{Status: "ok", Detail: "present"}
+	}
+	remaining := time.Until(expiresAt)
+	switch {
+	case remaining <= 0:
+		return healthzCheck{Status: "fail", Detail: "expired", Timestamp: &expiresAt}
+	case remaining < tokenExpiringSoon:
+		return healthzCheck{Status: "warn", Detail: "expiring soon", Timestamp: &expiresAt}
+	default:
+		return healthzCheck{Status: "ok", Detail: "present", Timestamp: &expiresAt}
+	}
+}
+
+func checkModels(s *state.State) healthzCheck {
+	count := len(s.GetModels())
+	if count == 0 {
+		return healthzCheck{Status: "fail", Detail: "no models loaded", Count: &count}
+	}
+	return healthzCheck{Status: "ok", Count: &count}
+}
+
+func checkUpstream(s *state.State) healthzCheck {
+	last := s.GetLastUpstreamSuccess()
+	if last.IsZero() {
+		return healthzCheck{Status: "warn", Detail: "no successful upstream call yet"}
+	}
+	return healthzCheck{Status: "ok", Timestamp: &last}
+}
+
+// checkConfig reports whether the config loaded. The load error names
+// the config path and parse details, so it is only logged when
+// auth.publicHealthz lets anyone read /healthz.
+func checkConfig(cfg *config.Store) healthzCheck {
+	loaded, err := cfg.LoadStatus()
+	switch {
+	case !loaded:
+		return healthzCheck{Status: "warn", Detail: "not loaded, using defaults"}
+	case err != nil && cfg.Get().Auth.PublicHealthz:
+		slog.Warn("healthz: config failed to load", "error", err)
+		return healthzCheck{Status: "warn", Detail: "failed to load, using defaults"}
+	case err != nil:
+		return healthzCheck{Status: "warn", Detail: err.Error()}
+	default:
+		return healthzCheck{Status: "ok"}
+	}
+}
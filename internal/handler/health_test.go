@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+func TestHealthzConfigCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"smallModel": "gpt-5-mini",`), 0o600)
+
+	tests := []struct {
+		name       string
+		load       bool
+		public     bool
+		wantDetail string
+	}{
+		{"not loaded", false, false, "not loaded, using defaults"},
+		{"load error", true, false, "parsing " + path},
+		{"load error, public", true, true, "failed to load, using defaults"},
+	}
+	for _, tt := range tests {
+		store := config.NewStore(path)
+		if tt.load && store.Load() == nil {
+			t.Fatal("broken config loaded")
+		}
+		store.Update(func(c *config.Config) { c.Auth.PublicHealthz = tt.public })
+
+		r := newRequest("GET", "/healthz", "")
+		r = r.WithContext(config.WithStore(r.Context(), store))
+		w := httptest.NewRecorder()
+		Healthz(w, r)
+
+		var resp healthzResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		check := resp.Checks["config"]
+		if check.Status != "warn" || !strings.HasPrefix(check.Detail, tt.wantDetail) {
+			t.Errorf("%s: config check %+v, want warn %q", tt.name, check, tt.wantDetail)
+		}
+		if tt.public && strings.Contains(w.Body.String(), path) {
+			t.Errorf("%s: public body names the config path: %s", tt.name, w.Body)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/history"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// defaultHistoryLimit is the number of entries returned when no ?limit=
+// is given.
+const defaultHistoryLimit = 50
+
+// historyResponse is the JSON response for GET /api/history.
+type historyResponse struct {
+	Query   string          `json:"query"`
+	Entries []history.Entry `json:"entries"`
+}
+
+// History handles GET /api/history — searches the transcript history.
+// ?q= matches prompt, response and model text (case-insensitive); ?limit=
+// caps the entries returned, newest first.
+func History(w http.ResponseWriter, r *http.Request) {
+	if !config.FromContext(r.Context()).History.Enabled {
+		api.ForwardError(w, &api.HTTPError{
+			Message:    "transcript history is disabled (set history.enabled)",
+			StatusCode: http.StatusNotFound,
+		})
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	limit := defaultHistoryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			api.ForwardError(w, &api.HTTPError{
+				Message:    "invalid limit: expected a positive integer",
+				StatusCode: http.StatusBadRequest,
+			})
+			return
+		}
+		limit = n
+	}
+
+	entries, err := history.Search(state.FromContext(r.Context()).HistoryPath(), q, limit)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(historyResponse{Query: q, Entries: entries})
+}
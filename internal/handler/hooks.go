@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/hooks"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// runPreRequestHooks passes the upstream payload of a /v1/messages request
+// for backend through the hooks.preRequest commands, in order. A hook
+// that exits non-zero rejects the request with a 400 carrying its stderr;
+// one that can't run or prints no JSON object fails it with a 500. Error
+// bodies name a hook by its file name; the full path is only logged.
+func runPreRequestHooks(ctx context.Context, backend string, body []byte) ([]byte, error) {
+	cfg := config.FromContext(ctx)
+	paths := cfg.Hooks.PreRequest
+	if len(paths) == 0 {
+		return body, nil
+	}
+	timeout := cfg.HookTimeout()
+	for _, path := range paths {
+		start := time.Now()
+		out, err := hooks.Run(ctx, path, backend, body, timeout)
+		elapsed := time.Since(start)
+		state.MetricsFromContext(ctx).RecordHook(path, elapsed, err != nil)
+		if err != nil {
+			var rejected *hooks.RejectedError
+			if errors.As(err, &rejected) {
+				slog.Warn("pre-request hook rejected request", "hook", path, "backend", backend, "error", rejected.Message)
+				return nil, &api.HTTPError{Message: err.Error(), StatusCode: http.StatusBadRequest}
+			}
+			slog.Error("pre-request hook failed", "hook", path, "backend", backend, "error", err)
+			return nil, &api.HTTPError{Message: err.Error(), StatusCode: http.StatusInternalServerError}
+		}
+		slog.Debug("pre-request hook ran", "hook", path, "backend", backend, "ms", elapsed.Milliseconds())
+		body = out
+	}
+	return body, nil
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+func TestPreRequestHookErrorsHideThePath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub hooks are shell scripts")
+	}
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rewrite := write("rewrite.sh", `echo '{"model":"rewritten"}'`)
+	reject := write("reject.sh", "echo 'blocked by policy' >&2; exit 1")
+	garbage := write("garbage.sh", "echo not json")
+
+	tests := []struct {
+		hooks  []string
+		status int
+		want   string
+	}{
+		{[]string{rewrite}, 0, `{"model":"rewritten"}`},
+		{[]string{rewrite, reject}, http.StatusBadRequest, "hook reject.sh rejected the request: blocked by policy"},
+		{[]string{garbage}, http.StatusInternalServerError, "hook garbage.sh did not print a JSON object"},
+		{[]string{filepath.Join(dir, "missing.sh")}, http.StatusInternalServerError, "hook missing.sh could not be started"},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *config.Config) { c.Hooks.PreRequest = tt.hooks })
+		out, err := runPreRequestHooks(testContext(context.Background()), "messages", []byte(`{"model":"x"}`))
+		if tt.status == 0 {
+			if err != nil || string(out) != tt.want {
+				t.Errorf("hooks %v: got %s, %v; want %s", tt.hooks, out, err, tt.want)
+			}
+			continue
+		}
+		var httpErr *api.HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Fatalf("hooks %v: got %v, want an HTTPError", tt.hooks, err)
+		}
+		if httpErr.StatusCode != tt.status || !strings.HasPrefix(httpErr.Message, tt.want) {
+			t.Errorf("hooks %v: got %d %q, want %d %q", tt.hooks, httpErr.StatusCode, httpErr.Message, tt.status, tt.want)
+		}
+		if strings.Contains(httpErr.Message, dir) {
+			t.Errorf("error body %q includes the hook's directory", httpErr.Message)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// maxIdempotencyKeyLen caps the Idempotency-Key header.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyCache keeps the responses of non-streaming requests sent with
+// an Idempotency-Key, keyed by API key and idempotency key, so a client's
+// retry of the same request is answered without another upstream call.
+// Entries are evicted least recently used first beyond
+// idempotency.maxEntries and expire after idempotency.ttl.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // *idempotencyEntry, most recently used first
+}
+
+type idempotencyEntry struct {
+	key      string
+	bodyHash string
+	done     chan struct{}     // closed once res is set
+	res      *bufferedResponse // nil while in flight
+	expires  time.Time
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// Idempotent wraps a completion handler so that a non-streaming request
+// with an Idempotency-Key header runs once per key. A retry with the same
+// key and body gets the first response with X-Idempotent-Replay: true,
+// waiting for it if the first request is still running; the same key with
+// another body is a 409. Streaming requests with the header are rejected,
+// since a stream can't be replayed. Responses that are worth retrying
+// (429, 5xx) aren't kept.
+func Idempotent(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idemKey := r.Header.Get("Idempotency-Key")
+		if idemKey == "" {
+			next(w, r)
+			return
+		}
+		if len(idemKey) > maxIdempotencyKeyLen {
+			api.ForwardError(w, &api.HTTPError{
+				Message:    fmt.Sprintf("Idempotency-Key is longer than %d characters", maxIdempotencyKeyLen),
+				StatusCode: http.StatusBadRequest,
+			})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			api.ForwardError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		json.Unmarshal(body, &req)
+		if req.Stream {
+			api.ForwardError(w, &api.HTTPError{
+				Message:    "Idempotency-Key is only supported on non-streaming requests; remove the header or set stream to false",
+				StatusCode: http.StatusBadRequest,
+			})
+			return
+		}
+
+		cfg := config.FromContext(r.Context())
+		idempotent := cachesOf(r.Context()).idempotent
+		key := requestKey([]byte(middleware.APIKeyFromContext(r.Context())), []byte(idemKey))
+		bodyHash := requestKey([]byte(name), normalizeJSON(body))
+		e, owner := idempotent.acquire(cfg, key, bodyHash)
+		if e == nil {
+			api.ForwardError(w, &api.HTTPError{
+				Message:    "Idempotency-Key was already used with a different request",
+				StatusCode: http.StatusConflict,
+			})
+			return
+		}
+		if !owner {
+			// A retry of a completed request counts as a cache hit, one
+			// that waited for the first as a shared call
+			completed := true
+			select {
+			case <-e.done:
+			default:
+				completed = false
+				select {
+				case <-e.done:
+				case <-r.Context().Done():
+					// The first request still finishes the entry for
+					// later retries
+					slog.Info("client gone while waiting for idempotent request", "endpoint", name)
+					return
+				}
+			}
+			slog.Info("replaying idempotent request", "endpoint", name, "waited", !completed)
+			state.MetricsFromContext(r.Context()).RecordDedupHit("idempotency", completed)
+			w.Header().Set("X-Idempotent-Replay", "true")
+			e.res.replay(w)
+			return
+		}
+
+		res := newBufferedResponse(cfg.StreamBufferLimit())
+		completed := false
+		defer func() {
+			// Also on a panic, so waiting retries aren't stuck; the key is
+			// released for another try
+			if !completed {
+				res = newBufferedResponse(cfg.StreamBufferLimit())
+				api.ForwardError(res, errors.New("idempotent "+name+" request failed"))
+			}
+			idempotent.finish(cfg, e, res)
+		}()
+		next(res, r)
+		res = res.checkOverflow("idempotency")
+		completed = true
+		res.replay(w)
+	}
+}
+
+// acquire returns the entry for key and whether the caller owns it: a new
+// entry that the caller must finish. It returns nil when key was used
+// with a different body. The limits are those of cfg.
+func (c *idempotencyCache) acquire(cfg *config.Config, key, bodyHash string) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*idempotencyEntry)
+		if e.res == nil || time.Now().Before(e.expires) {
+			if e.bodyHash != bodyHash {
+				return nil, false
+			}
+			c.order.MoveToFront(el)
+			return e, false
+		}
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	e := &idempotencyEntry{key: key, bodyHash: bodyHash, done: make(chan struct{})}
+	c.entries[key] = c.order.PushFront(e)
+	_, maxEntries := cfg.IdempotencyLimits()
+	c.evictLocked(maxEntries)
+	return e, true
+}
+
+// finish completes e with res for the requests waiting on it, and keeps it
+// for later retries unless res is worth retrying.
+func (c *idempotencyCache) finish(cfg *config.Config, e *idempotencyEntry, res *bufferedResponse) {
+	ttl, _ := cfg.IdempotencyLimits()
+	c.mu.Lock()
+	e.res = res
+	e.expires = time.Now().Add(ttl)
+	if res.status == http.StatusTooManyRequests || res.status >= 500 {
+		if el, ok := c.entries[e.key]; ok && el.Value == e {
+			c.order.Remove(el)
+			delete(c.entries, e.key)
+		}
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// evictLocked drops the least recently used completed entries beyond
+// maxEntries (idempotency.maxEntries); in-flight entries stay. c.mu must
+// be held.
+func (c *idempotencyCache) evictLocked(maxEntries int) {
+	for el := c.order.Back(); el != nil && c.order.Len() > maxEntries; {
+		prev := el.Prev()
+		if e := el.Value.(*idempotencyEntry); e.res != nil {
+			c.order.Remove(el)
+			delete(c.entries, e.key)
+		}
+		el = prev
+	}
+}
+
+// reset drops every entry; requests in flight finish with the entries
+// they hold.
+func (c *idempotencyCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idemKeys keeps keys unique across -count runs, since the test
+// instance's cache outlives each test.
+var idemKeys atomic.Int64
+
+func idempotentRequest(ctx context.Context, key, body string) *http.Request {
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/v1/messages", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	return r
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	var calls atomic.Int32
+	h := Idempotent("messages", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"id":"msg_1"}`))
+	})
+	key := fmt.Sprintf("replay-%d", idemKeys.Add(1))
+
+	first := httptest.NewRecorder()
+	h(first, idempotentRequest(testContext(context.Background()), key, `{"model":"m","a":1}`))
+	retry := httptest.NewRecorder()
+	h(retry, idempotentRequest(testContext(context.Background()), key, `{"a":1,"model":"m"}`))
+	if calls.Load() != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls.Load())
+	}
+	if retry.Body.String() != first.Body.String() || retry.Header().Get("X-Idempotent-Replay") != "true" {
+		t.Errorf("retry = %d %q %v", retry.Code, retry.Body, retry.Header())
+	}
+
+	conflict := httptest.NewRecorder()
+	h(conflict, idempotentRequest(testContext(context.Background()), key, `{"model":"other"}`))
+	if conflict.Code != http.StatusConflict {
+		t.Errorf("same key, other body: status %d, want 409", conflict.Code)
+	}
+}
+
+func TestIdempotentWaiterHonorsClientDisconnect(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := Idempotent("messages", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte(`{"id":"msg_slow"}`))
+	})
+	key := fmt.Sprintf("slow-%d", idemKeys.Add(1))
+
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		h(httptest.NewRecorder(), idempotentRequest(testContext(context.Background()), key, `{}`))
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(testContext(context.Background()))
+	waiterDone := make(chan struct{})
+	waiter := httptest.NewRecorder()
+	go func() {
+		defer close(waiterDone)
+		h(waiter, idempotentRequest(ctx, key, `{}`))
+	}()
+	cancel()
+	select {
+	case <-waiterDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting request didn't return after its client disconnected")
+	}
+	if waiter.Body.Len() != 0 {
+		t.Errorf("disconnected waiter got a body: %q", waiter.Body)
+	}
+
+	// The first request still completes the entry for later retries
+	close(release)
+	<-firstDone
+	retry := httptest.NewRecorder()
+	h(retry, idempotentRequest(testContext(context.Background()), key, `{}`))
+	if retry.Body.String() != `{"id":"msg_slow"}` {
+		t.Errorf("retry after completion = %q", retry.Body)
+	}
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/imaging"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// processedImagesMax bounds the processed-image cache. A conversation
+// resends the same images every turn, so each is processed once.
+const processedImagesMax = 64
+
+var processedImages = struct {
+	sync.Mutex
+	m map[[sha256.Size]byte]imaging.Result
+}{m: make(map[[sha256.Size]byte]imaging.Result)}
+
+// preprocessImages runs imageProcessing over the base64 images of req,
+// including those inside tool_result content, rewriting them in place. An
+// image that isn't valid is a 400 naming its block.
+func preprocessImages(ctx context.Context, req *AnthropicRequest) error {
+	cfg := config.FromContext(ctx)
+	if !cfg.ImageProcessing.Enabled {
+		return nil
+	}
+	maxBytes, maxDim := cfg.ImageLimits()
+	limits := imaging.Limits{MaxBytes: maxBytes, MaxDimension: maxDim}
+
+	for i := range req.Messages {
+		blocks := ParseMessageContent(req.Messages[i].Content)
+		changed := false
+		for j := range blocks {
+			b := &blocks[j]
+			switch b.Type {
+			case "image":
+				c, err := processImageBlock(ctx, b, limits)
+				if err != nil {
+					return &api.HTTPError{Message: fmt.Sprintf("messages.%d.content.%d: %v", i, j, err), StatusCode: http.StatusBadRequest}
+				}
+				changed = changed || c
+			case "tool_result":
+				var nested []ContentBlock
+				if json.Unmarshal(b.Content, &nested) != nil {
+					continue
+				}
+				nestedChanged := false
+				for k := range nested {
+					if nested[k].Type != "image" {
+						continue
+					}
+					c, err := processImageBlock(ctx, &nested[k], limits)
+					if err != nil {
+						return &api.HTTPError{Message: fmt.Sprintf("messages.%d.content.%d.content.%d: %v", i, j, k, err), StatusCode: http.StatusBadRequest}
+					}
+					nestedChanged = nestedChanged || c
+				}
+				if nestedChanged {
+					b.Content, _ = json.Marshal(nested)
+					changed = true
+				}
+			}
+		}
+		if changed {
+			req.Messages[i].Content, _ = json.Marshal(blocks)
+		}
+	}
+	return nil
+}
+
+// processImageBlock processes one image block and reports whether it
+// changed. Non-base64 sources are left alone.
+func processImageBlock(ctx context.Context, b *ContentBlock, limits imaging.Limits) (bool, error) {
+	if b.Source == nil || b.Source.Type != "base64" {
+		return false, nil
+	}
+	key := sha256.Sum256([]byte(b.Source.MediaType + "\x00" + b.Source.Data))
+	processedImages.Lock()
+	res, ok := processedImages.m[key]
+	processedImages.Unlock()
+
+	if !ok {
+		var err error
+		res, err = imaging.Process(b.Source.Data, b.Source.MediaType, limits)
+		if err != nil {
+			return false, err
+		}
+		if res.Sniffed {
+			slog.Info("image media type corrected", "declared", b.Source.MediaType, "actual", res.MediaType)
+		}
+		if res.Resized {
+			slog.Info("image resized",
+				"from", fmt.Sprintf("%dx%d %dB", res.OriginalWidth, res.OriginalHeight, res.OriginalBytes),
+				"to", fmt.Sprintf("%dx%d %dB %s", res.Width, res.Height, res.FinalBytes, res.MediaType))
+			state.MetricsFromContext(ctx).RecordImageResize()
+		}
+		processedImages.Lock()
+		if len(processedImages.m) >= processedImagesMax {
+			clear(processedImages.m)
+		}
+		processedImages.m[key] = res
+		processedImages.Unlock()
+	}
+
+	if res.Data == b.Source.Data && res.MediaType == b.Source.MediaType {
+		return false, nil
+	}
+	b.Source = &ImageSource{Type: "base64", MediaType: res.MediaType, Data: res.Data}
+	return true, nil
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// logprobsProbe remembers, per model, whether a response to a logprobs
+// request actually carried logprobs. Copilot's model list doesn't report
+// this capability, so it is learned from responses.
+type logprobsProbe struct {
+	sync.RWMutex
+	supported map[string]bool
+}
+
+func newLogprobsProbe() *logprobsProbe {
+	return &logprobsProbe{supported: make(map[string]bool)}
+}
+
+// reset forgets what was learned.
+func (p *logprobsProbe) reset() {
+	p.Lock()
+	defer p.Unlock()
+	p.supported = make(map[string]bool)
+}
+
+// checkLogprobsRequest rejects a logprobs request up front for a model that
+// has already answered one without logprobs, unless it is allowlisted in
+// logprobsModels.
+func checkLogprobsRequest(ctx context.Context, model string) error {
+	if config.FromContext(ctx).IsLogprobsModel(model) {
+		return nil
+	}
+	probe := cachesOf(ctx).logprobs
+	probe.RLock()
+	supported, known := probe.supported[model]
+	probe.RUnlock()
+	if known && !supported {
+		return logprobsUnsupportedError(model)
+	}
+	return nil
+}
+
+// checkLogprobsResponse verifies that a non-streaming chat completion
+// response carries logprobs, recording the outcome for model with ctx's instance.
+func checkLogprobsResponse(ctx context.Context, model string, body []byte) error {
+	var resp struct {
+		Choices []struct {
+			Logprobs json.RawMessage `json:"logprobs"`
+		} `json:"choices"`
+	}
+	json.Unmarshal(body, &resp)
+
+	ok := len(resp.Choices) > 0
+	for _, c := range resp.Choices {
+		if len(c.Logprobs) == 0 || string(c.Logprobs) == "null" {
+			ok = false
+		}
+	}
+
+	probe := cachesOf(ctx).logprobs
+	probe.Lock()
+	probe.supported[model] = ok
+	probe.Unlock()
+
+	if !ok {
+		return logprobsUnsupportedError(model)
+	}
+	return nil
+}
+
+func logprobsUnsupportedError(model string) error {
+	return &api.HTTPError{
+		Message:    "model " + model + " did not return logprobs; it may not support them (add it to logprobsModels to always forward)",
+		StatusCode: http.StatusBadRequest,
+	}
+}
+
+// requestsLogprobs reports whether an OpenAI chat completion body asks for
+// logprobs.
+func requestsLogprobs(body []byte) bool {
+	var req struct {
+		Logprobs bool `json:"logprobs"`
+	}
+	json.Unmarshal(body, &req)
+	return req.Logprobs
+}
+
+// rejectLogprobs returns a 400 when an Anthropic Messages request carries
+// OpenAI logprobs fields, which Anthropic has no equivalent for and which
+// would otherwise be dropped silently during translation.
+func rejectLogprobs(body []byte) error {
+	var req struct {
+		Logprobs    any `json:"logprobs"`
+		TopLogprobs any `json:"top_logprobs"`
+	}
+	json.Unmarshal(body, &req)
+	if (req.Logprobs == nil || req.Logprobs == false) && req.TopLogprobs == nil {
+		return nil
+	}
+	return &api.HTTPError{
+		Message:    "logprobs and top_logprobs are not supported on /v1/messages; use /v1/chat/completions",
+		StatusCode: http.StatusBadRequest,
+	}
+}
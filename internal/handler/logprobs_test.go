@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+const (
+	withLogprobs    = `{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"logprobs":{"content":[{"token":"hi","logprob":-0.1}]},"finish_reason":"stop"}]}`
+	withoutLogprobs = `{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}]}`
+)
+
+func TestChatCompletionLogprobs(t *testing.T) {
+	// The probe is process-wide, so each case uses its own model
+	tests := []struct {
+		name      string
+		model     string
+		allowlist bool
+		replies   []servicetest.Reply
+		want      []int // status of each request in turn
+		upstream  int   // requests that reached the fake
+	}{
+		{"returned", "lp-returned", false, []servicetest.Reply{servicetest.JSON(withLogprobs)}, []int{200, 200}, 2},
+		{"missing, then rejected up front", "lp-missing", false, []servicetest.Reply{servicetest.JSON(withoutLogprobs)}, []int{400, 400}, 1},
+		{"missing on an allowlisted model", "lp-allowlisted", true, []servicetest.Reply{servicetest.JSON(withoutLogprobs)}, []int{400, 400}, 2},
+		{"recovers once returned", "lp-allowlisted-recovers", true, []servicetest.Reply{servicetest.JSON(withoutLogprobs), servicetest.JSON(withLogprobs)}, []int{400, 200}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &servicetest.Fake{}
+			fake.Script(servicetest.ChatCompletions, tt.replies...)
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: tt.model, SupportedEndpoints: []string{"/chat/completions"}})
+			useConfig(t, func(c *config.Config) {
+				if tt.allowlist {
+					c.LogprobsModels = []string{tt.model}
+				}
+			})
+
+			for i, want := range tt.want {
+				w := httptest.NewRecorder()
+				ChatCompletions(w, newRequest("POST", "/chat/completions", `{"model":"`+tt.model+`","logprobs":true,"top_logprobs":2,"messages":[{"role":"user","content":"hi"}]}`))
+				if w.Code != want {
+					t.Errorf("request %d: status %d, want %d: %s", i+1, w.Code, want, w.Body)
+				}
+				if want == http.StatusBadRequest && !strings.Contains(w.Body.String(), "did not return logprobs") {
+					t.Errorf("request %d: error doesn't explain the missing logprobs: %s", i+1, w.Body)
+				}
+			}
+			if n := len(fake.Calls()); n != tt.upstream {
+				t.Errorf("%d upstream requests, want %d", n, tt.upstream)
+			}
+		})
+	}
+}
+
+func TestMessagesRejectsLogprobs(t *testing.T) {
+	fake := &servicetest.Fake{}
+	useBackend(t, fake)
+	tests := []struct {
+		field  string
+		status int
+	}{
+		{`"logprobs":true`, http.StatusBadRequest},
+		{`"top_logprobs":3`, http.StatusBadRequest},
+		{`"logprobs":false`, 0},
+	}
+	for _, tt := range tests {
+		before := len(fake.Calls())
+		w := httptest.NewRecorder()
+		Messages(w, newRequest("POST", "/v1/messages", `{"model":"claude-sonnet-4",`+tt.field+`,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+		rejected := w.Code == http.StatusBadRequest && strings.Contains(w.Body.String(), "not supported on /v1/messages")
+		if rejected != (tt.status == http.StatusBadRequest) {
+			t.Errorf("%s: status %d %s", tt.field, w.Code, w.Body)
+		}
+		if forwarded := len(fake.Calls()) > before; forwarded == rejected {
+			t.Errorf("%s: forwarded = %v, want %v", tt.field, forwarded, !rejected)
+		}
+	}
+}
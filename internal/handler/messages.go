@@ -1,16 +1,20 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 
+	chimw "github.com/go-chi/chi/v5/middleware"
+
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
 	"github.com/tonghaoch/copilot-proxy-go/internal/config"
-	"github.com/tonghaoch/copilot-proxy-go/internal/logger"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
 	"github.com/tonghaoch/copilot-proxy-go/internal/service"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
@@ -20,101 +24,230 @@ import (
 func Messages(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	body, err := io.ReadAll(r.Body)
+	// Wrap the writer so the recorded metrics reflect the real status code
+	ww := chimw.NewWrapResponseWriter(w, r.ProtoMajor)
+	w = ww
+
+	if !negotiateAnthropicVersion(w, r) {
+		return
+	}
+
+	m, err := prepareMessages(w, r, false)
 	if err != nil {
 		api.ForwardError(w, err)
 		return
 	}
+	req := &m.req
+
+	// Subagent marker → force agent initiator
+	forceAgent := false
+	if m.subagent != nil {
+		slog.Debug("subagent detected", "agent_id", m.subagent.AgentID, "agent_type", m.subagent.AgentType)
+		forceAgent = true
+	}
+
+	// X-Initiator header / per-key default override the heuristic
+	isAgent, initiatorOverride, err := resolveInitiator(r, forceAgent || isInitiatorAgent(req.Messages))
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+
+	// X-Backend / ?backend= (debug.allowBackendOverride)
+	forcedBackend, backendOverride, err := resolveBackendOverride(r, m.model)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+
+	// Build base record for metrics
+	rec := &state.RequestRecord{
+		RequestID:               chimw.GetReqID(r.Context()),
+		Timestamp:               start,
+		Endpoint:                "messages",
+		Model:                   m.originalModel,
+		RoutedModel:             req.Model,
+		RequestType:             m.reqType,
+		Initiator:               initiatorStr(isAgent),
+		InitiatorOverride:       initiatorOverride,
+		BackendOverride:         backendOverride,
+		ExtraPromptOverride:     req.overrides.preset,
+		ReasoningEffortOverride: req.overrides.effort,
+		HasVision:               hasVision(req.Messages),
+		Streaming:               req.Stream,
+		ToolCount:               len(req.Tools),
+		TrimmedTools:            m.trimmedTools,
+		Chaos:                   middleware.ChaosFromContext(r.Context()),
+	}
+	middleware.DescribeActiveRequest(r.Context(), rec.Model, rec.Initiator)
+
+	if req.Thinking != nil {
+		rec.ThinkingBudget = req.Thinking.BudgetTokens
+	}
+
+	// Determine backend routing, the same way Translate does
+	selected := selectBackend(m.model)
+	rec.Backend = messagesBackend(m.model, forcedBackend, service.FailoverActive(r.Context()))
+	if forcedBackend != "" {
+		slog.Info("backend overridden", "model", req.Model, "backend", forcedBackend, "selected", selected, "source", backendOverride)
+	} else if rec.Backend != selected {
+		// Thinking signatures and encrypted reasoning are lost for these turns
+		slog.Warn("Copilot failed over, translating through Chat Completions", "model", req.Model, "backend", selected)
+	}
+
+	// Translated up front: the cache keys are of what goes upstream, with
+	// the current extra prompts and reasoning efforts applied
+	span := startSpan(r, spanTranslate)
+	up, err := buildUpstreamPayload(r.Context(), req, m.body, m.betaHeader, rec.Backend, m.trimmedTools)
+	span.SetError(err)
+	span.End()
+
+	route := func(w http.ResponseWriter) {
+		switch rec.Backend {
+		case "messages":
+			slog.Info("routing to Messages API", "model", req.Model)
+			handleWithMessagesAPI(w, r, req, isAgent, m.body, up, rec)
+		case "responses":
+			slog.Info("routing to Responses API", "model", req.Model)
+			handleWithResponsesAPI(w, r, req, isAgent, up, rec)
+		default:
+			slog.Info("routing to Chat Completions API", "model", req.Model)
+			handleWithChatCompletions(w, r, req, isAgent, up, rec)
+		}
+	}
+
+	switch {
+	case err != nil:
+		api.ForwardError(w, err)
+	case responseCacheable(config.FromContext(r.Context()), req.Stream, req.Temperature, m.originalModel, req.Model):
+		rec.Cached = cachesOf(r.Context()).responses.serve(r.Context(), w, up.key(r.Context()), route)
+	case m.reqType == "warmup" && !req.Stream:
+		// Claude Code sometimes fires duplicate warmups back-to-back;
+		// identical ones share one upstream call
+		key := requestKey([]byte(up.key(r.Context())), []byte(initiatorStr(isAgent)))
+		cachesOf(r.Context()).warmup.serve(r.Context(), w, key, route)
+	default:
+		route(w)
+	}
 
-	var req AnthropicRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		api.ForwardError(w, &api.HTTPError{
+	// Record request metrics
+	rec.LatencyMs = time.Since(start).Milliseconds()
+	rec.StatusCode = ww.Status()
+	if rec.StatusCode == 0 {
+		rec.StatusCode = http.StatusOK
+	}
+	state.MetricsFromContext(r.Context()).RecordRequest(*rec)
+}
+
+// messagesRequest is a /v1/messages request prepared for its backend.
+type messagesRequest struct {
+	req           AnthropicRequest
+	body          []byte // after redactions and repairs, to forward natively
+	betaHeader    string
+	originalModel string // before session pins and small model routing
+	reqType       string // normal, compact or warmup
+	subagent      *SubagentInfo
+	trimmedTools  []string
+	model         *state.Model // the routed model, nil when not listed
+}
+
+// prepareMessages reads the /v1/messages request of r and prepares it the
+// way Messages sends it upstream; Translate shows the result. Headers
+// reporting changes are set on w. A dry run leaves the session pins,
+// request log and session snapshot alone.
+func prepareMessages(w http.ResponseWriter, r *http.Request, dryRun bool) (*messagesRequest, error) {
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configured redactions, before anything is parsed or forwarded
+	if rd := newRedactor(r); rd != nil {
+		body = rd.body(body, rd.anthropic)
+		rd.report(w, "messages")
+	}
+
+	m := &messagesRequest{betaHeader: r.Header.Get("Anthropic-Beta")}
+	req := &m.req
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, &api.HTTPError{
 			Message:    "invalid request body",
 			StatusCode: http.StatusBadRequest,
-		})
-		return
+		}
+	}
+
+	// OpenAI-only fields with no Anthropic equivalent
+	if err := rejectLogprobs(body); err != nil {
+		return nil, err
+	}
+	req.unknown = unknownRequestFields(body)
+
+	// tool_use/tool_result pairing: precise 400 instead of an upstream one,
+	// or repaired with repairToolPairs
+	if repaired, err := checkToolPairs(ctx, req); err != nil {
+		return nil, err
+	} else if repaired {
+		body = replaceMessages(body, req.Messages)
 	}
 
-	betaHeader := r.Header.Get("Anthropic-Beta")
+	// X-Extra-Prompt / X-Reasoning-Effort, then model suffixes
+	if req.overrides, err = parseRequestOverrides(r); err != nil {
+		return nil, err
+	}
+	req.applyModelSuffix(ctx)
 
 	// Capture original model before routing
-	originalModel := req.Model
+	m.originalModel = req.Model
 
-	logger.For("messages").Log("model=%s stream=%v initiator=%s", req.Model, req.Stream, initiatorStr(isInitiatorAgent(req.Messages)))
+	if !dryRun {
+		logRequest(r, "messages", req.Model, "model=%s stream=%v initiator=%s", req.Model, req.Stream, initiatorStr(isInitiatorAgent(req.Messages)))
+	}
 
 	// Determine request type
-	reqType := "normal"
-	if isCompactRequest(&req) {
-		reqType = "compact"
-	} else if isWarmupRequest(&req, betaHeader) {
-		reqType = "warmup"
+	m.reqType = "normal"
+	if isCompactRequest(req) {
+		m.reqType = "compact"
+	} else if isWarmupRequest(req, m.betaHeader) {
+		m.reqType = "warmup"
+	}
+
+	// sessionPinning: a model change mid-session reroutes to the pinned
+	// model or strips the old model's thinking
+	if m.reqType == "normal" && !dryRun {
+		body = applySessionPin(w, r, req, body)
 	}
 
 	// Quota optimizations: compact/warmup → small model
-	if changed := applySmallModelIfNeeded(&req, betaHeader); changed {
-		slog.Info("routed to small model", "model", req.Model, "reason", "compact/warmup")
+	if changed := applySmallModelIfNeeded(ctx, req, m.betaHeader); changed {
+		slog.Info("routed to small model", "model", req.Model, "reason", "compact/warmup/@small")
 	}
 
 	// Subagent marker detection → force agent initiator
-	subagent := detectSubagentMarker(req.Messages)
+	m.subagent = detectSubagentMarker(req.Messages)
 
 	// Build session snapshot
-	buildSessionSnapshot(&req, betaHeader, subagent)
-
-	// Tool result + text block merging
-	mergeToolResultBlocks(&req)
-
-	// Look up the model
-	model := state.Global.FindModel(req.Model)
-
-	// Subagent marker → force agent initiator
-	forceAgent := false
-	if subagent != nil {
-		slog.Debug("subagent detected", "agent_id", subagent.AgentID, "agent_type", subagent.AgentType)
-		forceAgent = true
+	if !dryRun {
+		buildSessionSnapshot(ctx, req, m.betaHeader, m.subagent)
 	}
 
-	// Build base record for metrics
-	isAgent := forceAgent || isInitiatorAgent(req.Messages)
-	rec := &state.RequestRecord{
-		Timestamp:   start,
-		Endpoint:    "messages",
-		Model:       originalModel,
-		RoutedModel: req.Model,
-		RequestType: reqType,
-		Initiator:   initiatorStr(isAgent),
-		HasVision:   hasVision(req.Messages),
-		Streaming:   req.Stream,
-		ToolCount:   len(req.Tools),
-	}
-	if req.Thinking != nil {
-		rec.ThinkingBudget = req.Thinking.BudgetTokens
-	}
+	// Tool result + text block merging
+	mergeToolResultBlocks(req)
 
-	// Determine backend routing
-	if model != nil && isMessagesSupported(model) {
-		slog.Info("routing to Messages API", "model", req.Model)
-		rec.Backend = "messages"
-		handleWithMessagesAPI(w, r, &req, forceAgent, body, rec)
-	} else if model != nil && isResponsesSupported(model) {
-		slog.Info("routing to Responses API", "model", req.Model)
-		rec.Backend = "responses"
-		handleWithResponsesAPI(w, r, &req, forceAgent, rec)
-	} else {
-		slog.Info("routing to Chat Completions API", "model", req.Model)
-		rec.Backend = "chat_completions"
-		handleWithChatCompletions(w, r, &req, forceAgent, rec)
+	// maxTools / maxToolSchemaTokens guardrails
+	if m.trimmedTools, err = enforceToolLimits(ctx, req); err != nil {
+		slog.Warn("tool limits exceeded", "tools", len(req.Tools), "error", err)
+		return nil, err
 	}
 
-	// Record request metrics
-	rec.LatencyMs = time.Since(start).Milliseconds()
-	rec.StatusCode = 200
-	state.Metrics.RecordRequest(*rec)
+	m.body = body
+	m.model = state.FromContext(ctx).FindModel(req.Model)
+	return m, nil
 }
 
 // buildSessionSnapshot extracts session intelligence from the request and
 // updates the global metrics session.
-func buildSessionSnapshot(req *AnthropicRequest, betaHeader string, subagent *SubagentInfo) {
+func buildSessionSnapshot(ctx context.Context, req *AnthropicRequest, betaHeader string, subagent *SubagentInfo) {
 	systemText := ParseSystemPrompt(req.System)
 
 	snap := state.SessionSnapshot{
@@ -122,6 +255,9 @@ func buildSessionSnapshot(req *AnthropicRequest, betaHeader string, subagent *Su
 		BetaFeatures:  betaHeader,
 		LastSeen:      time.Now(),
 	}
+	for _, f := range snap.ClaudeMDFiles {
+		snap.MemoryTokens += f.Tokens
+	}
 
 	// Extract tool names
 	for _, t := range req.Tools {
@@ -153,72 +289,132 @@ func buildSessionSnapshot(req *AnthropicRequest, betaHeader string, subagent *Su
 		snap.UserID = req.Metadata.UserID
 	}
 
-	state.Metrics.UpdateSession(snap)
+	state.MetricsFromContext(ctx).UpdateSession(snap)
 }
 
-// handleWithChatCompletions translates Anthropic → OpenAI Chat Completions,
-// proxies the request, and translates the response back.
-func handleWithChatCompletions(w http.ResponseWriter, r *http.Request, req *AnthropicRequest, forceAgent bool, rec *state.RequestRecord) {
-	extraPrompt := config.GetExtraPrompt(normalizeModelName(req.Model))
+// upstreamPayload is a /v1/messages request translated for its backend,
+// before the pre-request hooks run on it.
+type upstreamPayload struct {
+	backend   string
+	body      []byte
+	beta      string // anthropic-beta header of native Messages requests
+	model     string
+	toolNames *toolNameMap
+}
 
-	ccReq, err := translateToOpenAI(req, extraPrompt)
+// buildUpstreamPayload translates req, whose body is rawBody, for backend
+// with the config of ctx applied.
+func buildUpstreamPayload(ctx context.Context, req *AnthropicRequest, rawBody []byte, betaHeader, backend string, trimmedTools []string) (*upstreamPayload, error) {
+	up := &upstreamPayload{backend: backend, model: req.Model}
+	var err error
+	switch backend {
+	case "messages":
+		up.body, up.beta, err = nativeMessagesPayload(ctx, req, rawBody, betaHeader, trimmedTools)
+	case "responses":
+		var payload *ResponsesPayload
+		if payload, up.toolNames, up.body, err = responsesPayload(ctx, req); err == nil {
+			up.model = payload.Model
+		}
+	default:
+		var ccReq *ChatCompletionRequest
+		if ccReq, up.toolNames, up.body, err = chatCompletionsPayload(ctx, req); err == nil {
+			up.model = ccReq.Model
+		}
+	}
 	if err != nil {
-		api.ForwardError(w, err)
-		return
+		return nil, err
 	}
+	return up, nil
+}
 
-	body, err := json.Marshal(ccReq)
+// key identifies the upstream request of up for the response cache. The
+// hooks are part of it since they may rewrite the payload.
+func (up *upstreamPayload) key(ctx context.Context) string {
+	hooks := strings.Join(config.FromContext(ctx).Hooks.PreRequest, "\x00")
+	return requestKey([]byte("messages"), []byte(up.backend), up.body, []byte(up.beta), []byte(hooks))
+}
+
+// handleWithChatCompletions translates Anthropic → OpenAI Chat Completions,
+// proxies the request, and translates the response back.
+func handleWithChatCompletions(w http.ResponseWriter, r *http.Request, req *AnthropicRequest, isAgent bool, up *upstreamPayload, rec *state.RequestRecord) {
+	body, err := runPreRequestHooks(r.Context(), "chat_completions", up.body)
 	if err != nil {
 		api.ForwardError(w, err)
 		return
 	}
 
-	isAgent := forceAgent || isInitiatorAgent(req.Messages)
 	vision := hasVision(req.Messages)
 
-	slog.Info("chat completions backend", "model", ccReq.Model, "stream", ccReq.Stream,
+	slog.Info("chat completions backend", "model", up.model, "stream", req.Stream,
 		"initiator", initiatorStr(isAgent), "vision", vision)
 
-	resp, err := service.ProxyChatCompletionEx(body, isAgent, vision)
+	call := startUpstreamCall(w, r, config.TimeoutMessages, req.reasoningEffort(r.Context()))
+	defer call.stop()
+	resp, err := upstream(r.Context()).ProxyChatCompletionEx(call.ctx, body, isAgent, vision)
+	resp, err = call.guard(resp, err, rec)
 	if err != nil {
+		rec.Error = err.Error()
 		api.ForwardError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if req.Stream {
-		streamChatToAnthropic(w, resp, ccReq.Model, rec)
+		span := startSpan(r, spanStream)
+		cw := call.clientStream(w)
+		streamChatToAnthropic(r.Context(), cw, resp, up.model, req.MaxTokens, up.toolNames, rec)
+		cw.end(rec)
+		span.End()
 	} else {
-		nonStreamChatToAnthropic(w, resp, rec)
+		nonStreamChatToAnthropic(w, resp, up.toolNames, rec)
+	}
+}
+
+// chatCompletionsPayload translates req for the Chat Completions backend
+// and returns the upstream request body.
+func chatCompletionsPayload(ctx context.Context, req *AnthropicRequest) (*ChatCompletionRequest, *toolNameMap, []byte, error) {
+	if err := preprocessImages(ctx, req); err != nil {
+		return nil, nil, nil, err
+	}
+	ccReq, err := translateToOpenAI(ctx, req, req.extraPrompt(ctx))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	toolNames := buildToolNameMap(req)
+	toolNames.applyToChat(ccReq)
+
+	body, err := json.Marshal(ccReq)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	return ccReq, toolNames, forwardUnknownFields(ctx, body, req, "chat_completions"), nil
 }
 
 // nonStreamChatToAnthropic translates a non-streaming Chat Completion response
 // to Anthropic format.
-func nonStreamChatToAnthropic(w http.ResponseWriter, resp *http.Response, rec *state.RequestRecord) {
+func nonStreamChatToAnthropic(w http.ResponseWriter, resp *http.Response, toolNames *toolNameMap, rec *state.RequestRecord) {
 	var ccResp ChatCompletionResponse
 	if err := json.NewDecoder(resp.Body).Decode(&ccResp); err != nil {
 		api.ForwardError(w, err)
 		return
 	}
 
-	// Capture token counts
-	if ccResp.Usage != nil {
-		rec.InputTokens = int64(ccResp.Usage.PromptTokens)
-		rec.OutputTokens = int64(ccResp.Usage.CompletionTokens)
-		if ccResp.Usage.PromptTokensDetails != nil {
-			rec.CachedTokens = int64(ccResp.Usage.PromptTokensDetails.CachedTokens)
-		}
-	}
-
 	result := translateToAnthropic(&ccResp)
+	toolNames.restore(result.Content)
+	rec.StopReason = result.StopReason
+
+	// Capture token counts (input excludes cached, as in the body)
+	rec.InputTokens = int64(result.Usage.InputTokens)
+	rec.OutputTokens = int64(result.Usage.OutputTokens)
+	rec.CachedTokens = int64(result.Usage.CacheReadInputTokens)
+	setUsageHeaders(w, rec)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
 // streamChatToAnthropic translates streaming Chat Completion chunks to
 // Anthropic SSE events.
-func streamChatToAnthropic(w http.ResponseWriter, resp *http.Response, model string, rec *state.RequestRecord) {
+func streamChatToAnthropic(ctx context.Context, w http.ResponseWriter, resp *http.Response, model string, maxTokens int, toolNames *toolNameMap, rec *state.RequestRecord) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
@@ -230,30 +426,72 @@ func streamChatToAnthropic(w http.ResponseWriter, resp *http.Response, model str
 	w.Header().Set("Connection", "keep-alive")
 	w.WriteHeader(http.StatusOK)
 
+	resp.Body = recordFixture(ctx, resp.Body, FixtureChat, model)
+	defer resp.Body.Close() // saves the recording; the caller's close is of the original body
 	streamState := NewAnthropicStreamState(model)
+	streamState.toolNames = toolNames
+	out := newDeltaCoalescer(w, flusher, config.FromContext(ctx).StreamCoalesceWindow())
+	outCap := newOutputCap(ctx, maxTokens)
+	salvage := newStreamSalvage(ctx)
 
-	err := readSSE(resp.Body, func(eventType, data string) error {
+	err := readSSE(ctx, resp.Body, func(eventType, data string) error {
 		var chunk ChatCompletionChunk
 		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
 			return err
 		}
 
 		events := streamState.TranslateChunk(&chunk)
+		salvage.count(events)
 		for _, evt := range events {
-			if err := writeSSE(w, flusher, evt.Event, evt.Data); err != nil {
+			if err := out.write(evt); err != nil {
 				return err
 			}
 		}
+		if outCap.exceeded(events, streamState.openBlockType) {
+			for _, evt := range outCap.abortEvents(streamState.closeCurrentBlock()) {
+				if err := out.write(evt); err != nil {
+					return err
+				}
+			}
+			return errOutputCapReached
+		}
 		return nil
 	})
+	out.flush()
+	aborted := errors.Is(err, errOutputCapReached)
+	if aborted {
+		// Closing the body early cancels the upstream request
+		resp.Body.Close()
+		rec.AbortedOutputCap = true
+		rec.StopReason = "max_tokens"
+		err = nil
+	} else if err == nil {
+		for _, evt := range streamState.Finish() {
+			if err = out.write(evt); err != nil {
+				break
+			}
+		}
+		rec.StopReason = streamState.StopReason()
+	}
 
 	if err != nil {
-		slog.Error("streaming error", "error", err)
-		writeSSEError(w, flusher, err.Error())
+		if !errors.Is(err, errClientDisconnected) {
+			slog.Error("streaming error", "error", err)
+		}
+		rec.Error = err.Error()
+		if !salvage.end(out, err, streamState.openBlockType, streamState.closeCurrentBlock, rec) {
+			writeSSEError(w, flusher, err.Error())
+		}
 	}
 
 	// Capture token counts from stream state
 	input, output, cached := streamState.TokenCounts()
+	if aborted {
+		// Upstream never reported usage for the cut-off stream
+		output = max(output, outCap.outputTokens())
+	} else if rec.Salvaged {
+		output = max(output, salvage.outputTokens())
+	}
 	rec.InputTokens = int64(input)
 	rec.OutputTokens = int64(output)
 	rec.CachedTokens = int64(cached)
@@ -261,67 +499,93 @@ func streamChatToAnthropic(w http.ResponseWriter, resp *http.Response, model str
 
 // handleWithResponsesAPI translates Anthropic → Responses API, proxies the
 // request, and translates the response back.
-func handleWithResponsesAPI(w http.ResponseWriter, r *http.Request, req *AnthropicRequest, forceAgent bool, rec *state.RequestRecord) {
-	extraPrompt := config.GetExtraPrompt(normalizeModelName(req.Model))
-
-	payload, err := translateToResponses(req, extraPrompt)
-	if err != nil {
-		api.ForwardError(w, err)
-		return
-	}
-
-	body, err := json.Marshal(payload)
+func handleWithResponsesAPI(w http.ResponseWriter, r *http.Request, req *AnthropicRequest, isAgent bool, up *upstreamPayload, rec *state.RequestRecord) {
+	body, err := runPreRequestHooks(r.Context(), "responses", up.body)
 	if err != nil {
 		api.ForwardError(w, err)
 		return
 	}
 
-	isAgent := forceAgent || isInitiatorAgent(req.Messages)
 	vision := hasVision(req.Messages)
 
-	slog.Info("responses API backend", "model", payload.Model, "stream", payload.Stream,
+	slog.Info("responses API backend", "model", up.model, "stream", req.Stream,
 		"initiator", initiatorStr(isAgent), "vision", vision)
 
-	resp, err := service.ProxyResponses(body, isAgent, vision)
+	call := startUpstreamCall(w, r, config.TimeoutMessages, req.reasoningEffort(r.Context()))
+	defer call.stop()
+	resp, err := upstream(r.Context()).ProxyResponses(call.ctx, body, isAgent, vision)
+	if isEncryptedContentError(err) && stripThinkingForRetry(err, req, rec) {
+		if up, err = buildUpstreamPayload(r.Context(), req, nil, "", "responses", nil); err == nil {
+			body, err = runPreRequestHooks(r.Context(), "responses", up.body)
+		}
+		if err == nil {
+			resp, err = upstream(r.Context()).ProxyResponses(call.ctx, body, isAgent, vision)
+		}
+	}
+	resp, err = call.guard(resp, err, rec)
 	if err != nil {
+		rec.Error = err.Error()
 		api.ForwardError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if req.Stream {
-		streamResponsesToAnthropic(w, resp, payload.Model, rec)
+		span := startSpan(r, spanStream)
+		cw := call.clientStream(w)
+		streamResponsesToAnthropic(r.Context(), cw, resp, up.model, req.MaxTokens, up.toolNames, rec)
+		cw.end(rec)
+		span.End()
 	} else {
-		nonStreamResponsesToAnthropic(w, resp, rec)
+		nonStreamResponsesToAnthropic(w, resp, up.toolNames, rec)
+	}
+}
+
+// responsesPayload translates req for the Responses backend and returns the
+// upstream request body.
+func responsesPayload(ctx context.Context, req *AnthropicRequest) (*ResponsesPayload, *toolNameMap, []byte, error) {
+	if err := preprocessImages(ctx, req); err != nil {
+		return nil, nil, nil, err
+	}
+	payload, err := translateToResponses(ctx, req, req.extraPrompt(ctx))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	toolNames := buildToolNameMap(req)
+	toolNames.applyToResponses(payload)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	return payload, toolNames, forwardUnknownFields(ctx, body, req, "responses"), nil
 }
 
 // nonStreamResponsesToAnthropic translates a non-streaming Responses result
 // to Anthropic format.
-func nonStreamResponsesToAnthropic(w http.ResponseWriter, resp *http.Response, rec *state.RequestRecord) {
+func nonStreamResponsesToAnthropic(w http.ResponseWriter, resp *http.Response, toolNames *toolNameMap, rec *state.RequestRecord) {
 	var result ResponsesResult
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		api.ForwardError(w, err)
 		return
 	}
 
-	// Capture token counts
-	if result.Usage != nil {
-		rec.InputTokens = int64(result.Usage.InputTokens)
-		rec.OutputTokens = int64(result.Usage.OutputTokens)
-		if result.Usage.InputTokensDetails != nil {
-			rec.CachedTokens = int64(result.Usage.InputTokensDetails.CachedTokens)
-		}
-	}
-
 	translated := translateResponsesResultToAnthropic(&result)
+	toolNames.restore(translated.Content)
+
+	// Capture token counts (input excludes cached, as in the body)
+	rec.InputTokens = int64(translated.Usage.InputTokens)
+	rec.OutputTokens = int64(translated.Usage.OutputTokens)
+	rec.CachedTokens = int64(translated.Usage.CacheReadInputTokens)
+	setUsageHeaders(w, rec)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(translated)
 }
 
 // streamResponsesToAnthropic translates streaming Responses events to
 // Anthropic SSE events.
-func streamResponsesToAnthropic(w http.ResponseWriter, resp *http.Response, model string, rec *state.RequestRecord) {
+func streamResponsesToAnthropic(ctx context.Context, w http.ResponseWriter, resp *http.Response, model string, maxTokens int, toolNames *toolNameMap, rec *state.RequestRecord) {
+	cfg := config.FromContext(ctx)
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
@@ -333,33 +597,75 @@ func streamResponsesToAnthropic(w http.ResponseWriter, resp *http.Response, mode
 	w.Header().Set("Connection", "keep-alive")
 	w.WriteHeader(http.StatusOK)
 
+	resp.Body = recordFixture(ctx, resp.Body, FixtureResponses, model)
+	defer resp.Body.Close() // saves the recording; the caller's close is of the original body
 	streamState := NewResponsesStreamState(model)
+	streamState.toolNames = toolNames
+	streamState.eagerTextBlocks = cfg.EagerTextBlocks
+	out := newDeltaCoalescer(w, flusher, cfg.StreamCoalesceWindow())
+	outCap := newOutputCap(ctx, maxTokens)
+	salvage := newStreamSalvage(ctx)
 
-	err := readSSE(resp.Body, func(eventType, data string) error {
+	err := readSSE(ctx, resp.Body, func(eventType, data string) error {
 		events, err := streamState.TranslateEvent(eventType, data)
 		if err != nil {
 			return err
 		}
+		salvage.count(events)
 		for _, evt := range events {
-			if err := writeSSE(w, flusher, evt.Event, evt.Data); err != nil {
+			if err := out.write(evt); err != nil {
 				return err
 			}
 		}
+		if outCap.exceeded(events, streamState.openBlockType) {
+			for _, evt := range outCap.abortEvents(streamState.closeCurrentBlock()) {
+				if err := out.write(evt); err != nil {
+					return err
+				}
+			}
+			return errOutputCapReached
+		}
 		return nil
 	})
+	out.flush()
+	aborted := errors.Is(err, errOutputCapReached)
+	if aborted {
+		// Closing the body early cancels the upstream request
+		resp.Body.Close()
+		rec.AbortedOutputCap = true
+		rec.StopReason = "max_tokens"
+		err = nil
+	}
 
 	if err != nil {
-		slog.Error("responses streaming error", "error", err)
-		writeSSEError(w, flusher, err.Error())
+		if !errors.Is(err, errClientDisconnected) {
+			slog.Error("responses streaming error", "error", err)
+		}
+		rec.Error = err.Error()
 	}
 
-	// If stream ended without completion, send error
-	if !streamState.IsComplete() {
-		writeSSEError(w, flusher, "Stream ended unexpectedly without completion event")
+	// A failed or cut-off stream keeps its partial answer if it can be
+	// salvaged, else gets an error
+	if !aborted && !streamState.IsComplete() {
+		if err == nil {
+			err = errors.New("Stream ended unexpectedly without completion event")
+			rec.Error = err.Error()
+		}
+		if !salvage.end(out, err, streamState.openBlockType, streamState.closeCurrentBlock, rec) {
+			writeSSEError(w, flusher, err.Error())
+		}
+	} else if err != nil {
+		writeSSEError(w, flusher, err.Error())
 	}
 
 	// Capture token counts from stream state
 	input, output, cached := streamState.TokenCounts()
+	if aborted {
+		// Upstream never reported usage for the cut-off stream
+		output = max(output, outCap.outputTokens())
+	} else if rec.Salvaged {
+		output = max(output, salvage.outputTokens())
+	}
 	rec.InputTokens = int64(input)
 	rec.OutputTokens = int64(output)
 	rec.CachedTokens = int64(cached)
@@ -1,8 +1,9 @@
 package handler
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
@@ -10,53 +11,39 @@ import (
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
 	"github.com/tonghaoch/copilot-proxy-go/internal/config"
-	"github.com/tonghaoch/copilot-proxy-go/internal/service"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
 // handleWithMessagesAPI forwards an Anthropic request to Copilot's native
 // Messages API, applying necessary filtering and header adjustments.
-// rawBody is the original request bytes to preserve unknown fields.
-func handleWithMessagesAPI(w http.ResponseWriter, r *http.Request, req *AnthropicRequest, forceAgent bool, rawBody []byte, rec *state.RequestRecord) {
-	// Parse into map to preserve unknown fields
-	var payload map[string]any
-	if err := json.Unmarshal(rawBody, &payload); err != nil {
-		api.ForwardError(w, err)
-		return
-	}
-
-	// Filter thinking blocks in assistant messages
-	filterThinkingBlocksInMap(payload, req)
-
-	// Set up adaptive thinking if supported
-	applyAdaptiveThinkingInMap(payload, req)
-
-	// Marshal the modified payload
-	body, err := json.Marshal(payload)
+// up is the translated payload; rawBody, the original request bytes with
+// their unknown fields, rebuilds it for a retry.
+func handleWithMessagesAPI(w http.ResponseWriter, r *http.Request, req *AnthropicRequest, isAgent bool, rawBody []byte, up *upstreamPayload, rec *state.RequestRecord) {
+	body, err := runPreRequestHooks(r.Context(), "messages", up.body)
 	if err != nil {
 		api.ForwardError(w, err)
 		return
 	}
 
-	// Build headers
-	betaHeader := r.Header.Get("Anthropic-Beta")
-	betaHeader = filterBetaHeader(betaHeader)
-
-	// Auto-inject thinking beta if needed
-	if betaHeader == "" && req.Thinking != nil && req.Thinking.BudgetTokens > 0 {
-		betaHeader = "interleaved-thinking-2025-05-14"
-	}
-
 	// Vision detection
 	vision := hasVision(req.Messages)
 
-	// Initiator detection
-	isAgent := forceAgent || isInitiatorAgent(req.Messages)
-
 	slog.Info("messages API (native)", "model", req.Model, "stream", req.Stream, "vision", vision)
 
-	resp, err := service.ProxyMessages(body, betaHeader, vision, isAgent)
+	call := startUpstreamCall(w, r, config.TimeoutMessages, req.reasoningEffort(r.Context()))
+	defer call.stop()
+	resp, err := upstream(r.Context()).ProxyMessages(call.ctx, body, up.beta, vision, isAgent)
+	if isThinkingSignatureError(err) && stripThinkingForRetry(err, req, rec) {
+		if up, err = buildUpstreamPayload(r.Context(), req, rawBody, r.Header.Get("Anthropic-Beta"), "messages", rec.TrimmedTools); err == nil {
+			body, err = runPreRequestHooks(r.Context(), "messages", up.body)
+		}
+		if err == nil {
+			resp, err = upstream(r.Context()).ProxyMessages(call.ctx, body, up.beta, vision, isAgent)
+		}
+	}
+	resp, err = call.guard(resp, err, rec)
 	if err != nil {
+		rec.Error = err.Error()
 		api.ForwardError(w, err)
 		return
 	}
@@ -64,6 +51,11 @@ func handleWithMessagesAPI(w http.ResponseWriter, r *http.Request, req *Anthropi
 
 	if req.Stream {
 		// Stream passthrough — forward SSE events, sniff usage data
+		span := startSpan(r, spanStream)
+		defer span.End()
+		cw := call.clientStream(w)
+		defer cw.end(rec)
+		w := http.ResponseWriter(cw) // the rest of the stream goes through cw
 		flusher, ok := w.(http.Flusher)
 		if !ok {
 			http.Error(w, "streaming not supported", http.StatusInternalServerError)
@@ -74,34 +66,100 @@ func handleWithMessagesAPI(w http.ResponseWriter, r *http.Request, req *Anthropi
 		w.Header().Set("Connection", "keep-alive")
 		w.WriteHeader(http.StatusOK)
 
-		readSSE(resp.Body, func(eventType, data string) error {
+		resp.Body = recordFixture(r.Context(), resp.Body, FixtureMessages, req.Model)
+		defer resp.Body.Close() // saves the recording; the deferred close above is of the original body
+		validator := newNativeStreamValidator()
+		err := readSSE(r.Context(), resp.Body, func(eventType, data string) error {
 			// Sniff token counts from native Anthropic events
 			captureNativeTokens(eventType, data, rec)
 
+			// Repair block ordering; well-formed events pass through as-is
+			before, skip := validator.process(eventType, data)
+			for _, evt := range before {
+				if err := writeSSE(w, flusher, evt.Event, evt.Data); err != nil {
+					return err
+				}
+			}
+			if skip {
+				return nil
+			}
+
 			if eventType != "" {
 				io.WriteString(w, "event: "+eventType+"\n")
 			}
-			io.WriteString(w, "data: "+data+"\n\n")
+			if _, err := io.WriteString(w, "data: "+data+"\n\n"); err != nil {
+				return err
+			}
 			flusher.Flush()
 			return nil
 		})
+		var tooLarge *sseEventTooLargeError
+		if err != nil && (rec.Timeout || rec.Canceled || errors.As(err, &tooLarge)) {
+			slog.Error("native messages stream error", "error", err)
+			rec.Error = err.Error()
+			writeSSEError(w, flusher, err.Error())
+		}
 	} else {
-		// Non-streaming passthrough — tee body to capture usage
-		var buf bytes.Buffer
-		tee := io.TeeReader(resp.Body, &buf)
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, tee)
-
-		// Parse usage from the buffered copy
+		// Non-streaming passthrough — buffer the body to capture usage
+		// for the record and the usage headers
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			api.ForwardError(w, err)
+			return
+		}
 		var anthResp AnthropicResponse
-		if json.Unmarshal(buf.Bytes(), &anthResp) == nil {
+		if json.Unmarshal(data, &anthResp) == nil {
 			rec.InputTokens = int64(anthResp.Usage.InputTokens)
 			rec.OutputTokens = int64(anthResp.Usage.OutputTokens)
 			rec.CachedTokens = int64(anthResp.Usage.CacheReadInputTokens)
 		}
+
+		setUsageHeaders(w, rec)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(data)
+	}
+}
+
+// nativeMessagesPayload returns the upstream request body and
+// Anthropic-Beta header for the native Messages backend.
+func nativeMessagesPayload(ctx context.Context, req *AnthropicRequest, rawBody []byte, betaHeader string, trimmedTools []string) ([]byte, string, error) {
+	// Parse into map to preserve unknown fields
+	var payload map[string]any
+	if err := json.Unmarshal(rawBody, &payload); err != nil {
+		return nil, "", err
+	}
+
+	// The routed model (small model, session pin)
+	payload["model"] = req.Model
+
+	// Filter thinking blocks in assistant messages
+	filterThinkingBlocksInMap(payload, req)
+
+	// Set up adaptive thinking if supported, unless #nothink turned it off
+	if req.overrides.noThinking {
+		delete(payload, "thinking")
+	} else {
+		applyAdaptiveThinkingInMap(ctx, payload, req)
+	}
+
+	// Tool definitions summarized by enforceToolLimits
+	applyTrimmedToolsInMap(payload, req, trimmedTools)
+
+	// Marshal the modified payload
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Build headers
+	betaHeader = filterBetaHeader(betaHeader)
+
+	// Auto-inject thinking beta if needed
+	if betaHeader == "" && req.Thinking != nil && req.Thinking.BudgetTokens > 0 {
+		betaHeader = "interleaved-thinking-2025-05-14"
 	}
+	return body, betaHeader, nil
 }
 
 // captureNativeTokens extracts token counts from native Anthropic SSE events
@@ -171,8 +229,8 @@ func filterThinkingBlocksInMap(payload map[string]any, req *AnthropicRequest) {
 
 // applyAdaptiveThinkingInMap modifies the thinking config and output_config
 // in the map representation. Only applies when the model supports adaptive thinking.
-func applyAdaptiveThinkingInMap(payload map[string]any, req *AnthropicRequest) {
-	model := state.Global.FindModel(req.Model)
+func applyAdaptiveThinkingInMap(ctx context.Context, payload map[string]any, req *AnthropicRequest) {
+	model := state.FromContext(ctx).FindModel(req.Model)
 	if model == nil || !model.Capabilities.Supports.AdaptiveThinking {
 		return
 	}
@@ -181,7 +239,7 @@ func applyAdaptiveThinkingInMap(payload map[string]any, req *AnthropicRequest) {
 	payload["thinking"] = map[string]string{"type": "adaptive"}
 
 	// Set output_config effort
-	effort := config.GetReasoningEffort(normalizeModelName(req.Model))
+	effort := req.reasoningEffort(ctx)
 	mapped := mapEffort(effort)
 	if mapped != "" {
 		payload["output_config"] = map[string]string{"effort": mapped}
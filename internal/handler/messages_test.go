@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Non-streaming upstream replies of each backend, for model MODEL.
+const (
+	chatOK      = `{"id":"c1","model":"MODEL","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":1}}`
+	responsesOK = `{"id":"resp_1","object":"response","status":"completed","model":"MODEL","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"ok"}]}],"usage":{"input_tokens":5,"output_tokens":1}}`
+	messagesOK  = `{"id":"msg_1","type":"message","role":"assistant","model":"MODEL","content":[{"type":"text","text":"ok"}],"stop_reason":"end_turn","usage":{"input_tokens":5,"output_tokens":1}}`
+)
+
+// scriptAll answers every endpoint with its backend's successful reply.
+func scriptAll(fake *servicetest.Fake, model string) {
+	fake.Script(servicetest.ChatCompletions, servicetest.JSON(replaceModel(chatOK, model)))
+	fake.Script(servicetest.Responses, servicetest.JSON(replaceModel(responsesOK, model)))
+	fake.Script(servicetest.Messages, servicetest.JSON(replaceModel(messagesOK, model)))
+}
+
+func TestMessagesRouting(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoints []string // nil: the model isn't listed
+		header    string   // X-Backend
+		override  bool     // debug.allowBackendOverride
+		upstream  string
+		backend   string
+		status    int
+	}{
+		{"messages only", []string{"/v1/messages"}, "", false, servicetest.Messages, "messages", 200},
+		{"messages preferred", []string{"/chat/completions", "/responses", "/v1/messages"}, "", false, servicetest.Messages, "messages", 200},
+		{"responses preferred over chat", []string{"/chat/completions", "/responses"}, "", false, servicetest.Responses, "responses", 200},
+		{"responses only", []string{"/responses"}, "", false, servicetest.Responses, "responses", 200},
+		{"chat completions", []string{"/chat/completions"}, "", false, servicetest.ChatCompletions, "chat_completions", 200},
+		{"no endpoints listed", []string{}, "", false, servicetest.ChatCompletions, "chat_completions", 200},
+		{"unknown model", nil, "", false, servicetest.ChatCompletions, "chat_completions", 200},
+		{"override", []string{"/v1/messages", "/chat/completions"}, "chat_completions", true, servicetest.ChatCompletions, "chat_completions", 200},
+		{"override to responses", []string{"/v1/messages", "/responses"}, "Responses", true, servicetest.Responses, "responses", 200},
+		{"override disabled", []string{"/v1/messages", "/chat/completions"}, "chat_completions", false, "", "", 403},
+		{"override unsupported", []string{"/v1/messages"}, "responses", true, "", "", 400},
+		{"override invalid", []string{"/v1/messages"}, "grpc", true, "", "", 400},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := fmt.Sprintf("claude-route-%d", i)
+			fake := &servicetest.Fake{}
+			scriptAll(fake, model)
+			useBackend(t, fake)
+			if tt.endpoints != nil {
+				useModels(t, state.Model{ID: model, SupportedEndpoints: tt.endpoints})
+			} else {
+				useModels(t, state.Model{ID: "claude-other", SupportedEndpoints: []string{"/v1/messages"}})
+			}
+			useConfig(t, func(c *config.Config) { c.Debug.AllowBackendOverride = tt.override })
+
+			w := httptest.NewRecorder()
+			r := newRequest("POST", "/v1/messages", `{"model":"`+model+`","max_tokens":64,"messages":[{"role":"user","content":"route"}]}`)
+			if tt.header != "" {
+				r.Header.Set("X-Backend", tt.header)
+			}
+			Messages(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var want []string
+			if tt.upstream != "" {
+				want = []string{tt.upstream}
+			}
+			if got := fake.Endpoints(); !slices.Equal(got, want) {
+				t.Errorf("upstream calls %v, want %v", got, want)
+			}
+			if tt.status != 200 {
+				return
+			}
+			rec := recordOf(t, r)
+			if rec.Backend != tt.backend || rec.Model != model || rec.StatusCode != 200 {
+				t.Errorf("record backend/model/status %s/%s/%d, want %s/%s/200", rec.Backend, rec.Model, rec.StatusCode, tt.backend, model)
+			}
+			if (tt.header != "") != (rec.BackendOverride != "") {
+				t.Errorf("record backend override %q with X-Backend %q", rec.BackendOverride, tt.header)
+			}
+			var msg AnthropicResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || msg.Type != "message" || len(msg.Content) != 1 {
+				t.Errorf("response isn't an Anthropic message: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestMessagesForwardsErrors(t *testing.T) {
+	backends := []struct {
+		endpoint, upstream string
+	}{
+		{"/chat/completions", servicetest.ChatCompletions},
+		{"/responses", servicetest.Responses},
+		{"/v1/messages", servicetest.Messages},
+	}
+	tests := []struct {
+		name    string
+		reply   servicetest.Reply
+		status  int
+		message string
+		errType string
+	}{
+		{"openai error", servicetest.Error(400, `{"error":{"message":"max_tokens is too large","type":"invalid_request_error"}}`),
+			400, "max_tokens is too large", "invalid_request_error"},
+		{"anthropic error", servicetest.Error(400, `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long"}}`),
+			400, "prompt is too long", "invalid_request_error"},
+		{"rate limited", servicetest.Error(429, `{"error":{"message":"rate limit exceeded","type":"rate_limit_error"}}`),
+			429, "rate limit exceeded", "rate_limit_error"},
+		{"plain message", servicetest.Error(403, `{"message":"model access denied"}`),
+			403, "model access denied", "internal_error"},
+		{"not json", servicetest.Error(502, `<html>Bad Gateway</html>`),
+			502, "HTTP 502", "internal_error"},
+		{"server error", servicetest.Error(500, `{"error":{"message":"upstream exploded","type":"server_error"}}`),
+			500, "upstream exploded", "server_error"},
+		{"transport error", servicetest.Reply{Err: errors.New("dial tcp: connection refused")},
+			500, "connection refused", "internal_error"},
+	}
+	for _, b := range backends {
+		for i, tt := range tests {
+			for _, stream := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/%s/stream=%v", b.upstream, tt.name, stream), func(t *testing.T) {
+					model := fmt.Sprintf("claude-err-%s-%d-%v", strings.Trim(b.endpoint, "/"), i, stream)
+					fake := &servicetest.Fake{}
+					fake.Script(b.upstream, tt.reply)
+					useBackend(t, fake)
+					useModels(t, state.Model{ID: model, SupportedEndpoints: []string{b.endpoint}})
+
+					w := httptest.NewRecorder()
+					r := newRequest("POST", "/v1/messages", fmt.Sprintf(`{"model":%q,"max_tokens":64,"stream":%v,"messages":[{"role":"user","content":"errors"}]}`, model, stream))
+					Messages(w, r)
+
+					if w.Code != tt.status {
+						t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+					}
+					if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+						t.Errorf("Content-Type %q, want application/json", ct)
+					}
+					var body struct {
+						Error struct{ Message, Type string }
+					}
+					if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+						t.Fatalf("error body isn't JSON: %s", w.Body)
+					}
+					if !strings.Contains(body.Error.Message, tt.message) || body.Error.Type != tt.errType {
+						t.Errorf("error %q (%s), want %q (%s)", body.Error.Message, body.Error.Type, tt.message, tt.errType)
+					}
+					rec := recordOf(t, r)
+					if rec.StatusCode != tt.status || rec.Error == "" {
+						t.Errorf("record status %d, error %q; want %d and the error", rec.StatusCode, rec.Error, tt.status)
+					}
+					if got := fake.Endpoints(); len(got) == 0 || got[0] != b.upstream {
+						t.Errorf("upstream calls %v, want %s", got, b.upstream)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestMessagesRejectsBeforeUpstream checks requests refused without
+// calling the upstream.
+func TestMessagesRejectsBeforeUpstream(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		header http.Header
+		status int
+	}{
+		{"invalid JSON", `{"model":`, nil, 400},
+		{"logprobs", `{"model":"claude-sonnet-4","max_tokens":64,"logprobs":true,"messages":[{"role":"user","content":"hi"}]}`, nil, 400},
+		{"orphan tool_result", `{"model":"claude-sonnet-4","max_tokens":64,"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"x"}]}]}`, nil, 400},
+		{"invalid reasoning effort", `{"model":"claude-sonnet-4","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`, http.Header{"X-Reasoning-Effort": {"extreme"}}, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &servicetest.Fake{}
+			scriptAll(fake, "claude-sonnet-4")
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: "claude-sonnet-4", SupportedEndpoints: []string{"/v1/messages"}})
+
+			w := httptest.NewRecorder()
+			r := newRequest("POST", "/v1/messages", tt.body)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			Messages(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if calls := fake.Endpoints(); len(calls) != 0 {
+				t.Errorf("upstream called: %v", calls)
+			}
+		})
+	}
+}
@@ -2,13 +2,18 @@ package handler
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
 	"strings"
 
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
@@ -25,6 +30,44 @@ func initiatorStr(isAgent bool) string {
 	return "user"
 }
 
+// resolveInitiator applies initiator overrides on top of the heuristic
+// result. When API keys are configured, an X-Initiator: agent|user header
+// wins, then the authenticating key's defaultInitiator. Returns the
+// effective value and the override source ("header", "key_default", or "").
+func resolveInitiator(r *http.Request, heuristic bool) (isAgent bool, override string, err error) {
+	cfg := config.FromContext(r.Context())
+	if len(cfg.GetAPIKeys()) == 0 {
+		return heuristic, "", nil
+	}
+
+	if h := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Initiator"))); h != "" {
+		if h != "agent" && h != "user" {
+			return heuristic, "", &api.HTTPError{
+				Message:    fmt.Sprintf("invalid X-Initiator header %q (expected agent or user)", h),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		return h == "agent", "header", nil
+	}
+
+	switch cfg.GetKeyOptions(middleware.APIKeyFromContext(r.Context())).DefaultInitiator {
+	case "agent":
+		return true, "key_default", nil
+	case "user":
+		return false, "key_default", nil
+	}
+	return heuristic, "", nil
+}
+
+// errorStatus returns the HTTP status code that api.ForwardError will use
+// for err, for recording in request metrics.
+func errorStatus(err error) int {
+	if httpErr, ok := err.(*api.HTTPError); ok {
+		return httpErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
 // isClaude returns true if the model name indicates a Claude model.
 func isClaude(model string) bool {
 	return strings.Contains(strings.ToLower(model), "claude")
@@ -69,9 +112,22 @@ func isAllDigits(s string) bool {
 // hasVision checks if any message content contains image blocks.
 func hasVision(messages []AnthropicMsg) bool {
 	for _, msg := range messages {
-		blocks := ParseMessageContent(msg.Content)
-		for _, b := range blocks {
-			if b.Type == "image" {
+		if blocksHaveImage(ParseMessageContent(msg.Content)) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocksHaveImage reports whether blocks contain an image, including inside
+// tool_result content (e.g. a screenshot tool's output).
+func blocksHaveImage(blocks []ContentBlock) bool {
+	for _, b := range blocks {
+		switch b.Type {
+		case "image":
+			return true
+		case "tool_result":
+			if blocksHaveImage(ParseMessageContent(b.Content)) {
 				return true
 			}
 		}
@@ -89,12 +145,21 @@ func mapStopReason(reason string) string {
 	case "tool_calls":
 		return "tool_use"
 	case "content_filter":
-		return "end_turn"
+		return "refusal"
 	default:
 		return "end_turn"
 	}
 }
 
+// stopReasonRank orders stop reasons when a response has several choices:
+// the highest ranked one is reported.
+var stopReasonRank = map[string]int{"end_turn": 0, "max_tokens": 1, "refusal": 2, "tool_use": 3}
+
+// filteredText is the text of a non-streaming response whose content was
+// withheld by Copilot's content filter, so the client doesn't show an empty
+// answer.
+const filteredText = "[The response was blocked by Copilot's content filter.]"
+
 // SSE helpers
 
 // writeSSE writes an Anthropic SSE event to the response writer.
@@ -122,31 +187,118 @@ func writeSSEError(w http.ResponseWriter, flusher http.Flusher, message string)
 	})
 }
 
+// errStreamBufferFull is returned by response writers that would hold more
+// than maxStreamBufferBytes buffered but not yet sent.
+var errStreamBufferFull = errors.New("response buffer limit reached (maxStreamBufferBytes)")
+
+// sseEventTooLargeError is returned when an upstream SSE event is larger
+// than maxSSEEventBytes.
+type sseEventTooLargeError struct {
+	Size  int // bytes read when the limit was passed
+	Limit int
+}
+
+func (e *sseEventTooLargeError) Error() string {
+	return fmt.Sprintf("upstream SSE event too large: over %d bytes read, limit is %d (maxSSEEventBytes)", e.Size, e.Limit)
+}
+
+// sseLineReader reads the lines of an SSE stream, failing with
+// *sseEventTooLargeError once the current event passes limit bytes.
+type sseLineReader struct {
+	rd    *bufio.Reader
+	limit int
+	size  int // bytes of the current event so far
+}
+
+func newSSELineReader(ctx context.Context, body io.Reader) *sseLineReader {
+	return &sseLineReader{rd: bufio.NewReaderSize(body, 64*1024), limit: config.FromContext(ctx).SSEEventLimit()}
+}
+
+// readLine returns the next line without its line ending. Like
+// bufio.Reader.ReadString, it returns io.EOF with the stream's last line,
+// which is "" when the stream ended with a line ending.
+func (s *sseLineReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := s.rd.ReadSlice('\n')
+		s.size += len(chunk)
+		if s.size > s.limit {
+			return "", &sseEventTooLargeError{Size: s.size, Limit: s.limit}
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		text := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+		if text == "" {
+			s.size = 0 // a blank line ends the event
+		}
+		return text, err
+	}
+}
+
 // readSSE reads Server-Sent Events from a reader and calls the handler
 // for each event. Works for both OpenAI format (data-only) and Responses
-// format (event + data).
-func readSSE(body io.Reader, handler func(eventType, data string) error) error {
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 0, 256*1024), 1024*1024)
+// format (event + data). An event's data lines are joined with "\n" and
+// it is dispatched at the blank line ending it, or at the end of the
+// stream. Comment lines, the id and retry fields, and CRLF line endings
+// are tolerated. A "[DONE]" event ends the stream. An event larger than
+// maxSSEEventBytes fails with *sseEventTooLargeError.
+func readSSE(ctx context.Context, body io.Reader, handler func(eventType, data string) error) error {
+	rd := newSSELineReader(ctx, body)
 
 	var eventType string
-	for scanner.Scan() {
-		line := scanner.Text()
-		switch {
-		case strings.HasPrefix(line, "event: "):
-			eventType = strings.TrimPrefix(line, "event: ")
-		case strings.HasPrefix(line, "data: "):
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "[DONE]" {
-				return nil
+	var data strings.Builder
+	hasData := false
+	dispatch := func() (done bool, err error) {
+		if !hasData {
+			eventType = "" // an event without data is dropped
+			return false, nil
+		}
+		payload := data.String()
+		t := eventType
+		eventType, hasData = "", false
+		data.Reset()
+		if payload == "[DONE]" {
+			return true, nil
+		}
+		return false, handler(t, payload)
+	}
+
+	for {
+		line, readErr := rd.readLine()
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if line == "" {
+			if readErr == nil {
+				if done, err := dispatch(); done || err != nil {
+					return err
+				}
 			}
-			if err := handler(eventType, data); err != nil {
-				return err
+		} else if !strings.HasPrefix(line, ":") { // ":" starts a comment
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				eventType = value
+			case "data":
+				if hasData {
+					data.WriteByte('\n')
+				}
+				data.WriteString(value)
+				hasData = true
 			}
-			eventType = "" // reset after handling
+			// id and retry only matter for reconnecting
+		}
+		if readErr == io.EOF {
+			_, err := dispatch()
+			return err
 		}
 	}
-	return scanner.Err()
 }
 
 // getToolResultText extracts text content from a tool_result's Content field,
@@ -174,31 +326,53 @@ func getToolResultText(raw json.RawMessage) string {
 	return string(raw)
 }
 
-// claudeMDRe matches "Contents of /path/to/CLAUDE.md (..." followed by content.
-var claudeMDRe = regexp.MustCompile(`Contents of (/[^\s]+/CLAUDE\.md)(?: \([^)]*\))?:\s*\n([\s\S]*?)(?:\n\n(?:Contents of /|$))`)
+// claudeMDRe matches the legacy format's header, "Contents of
+// /path/to/CLAUDE.md (...):"; the content runs to the next header.
+var claudeMDRe = regexp.MustCompile(`Contents of (/[^\s]+/CLAUDE\.md)(?: \([^)]*\))?:\s*\n`)
 
-// extractClaudeMDFiles parses the system prompt for CLAUDE.md file references.
+// projectMemoryRe matches the newer format: content wrapped in
+// <project_memory path="..."> ... </project_memory>.
+var projectMemoryRe = regexp.MustCompile(`<project_memory\s+path=("[^"]*"|'[^']*'|[^\s>]+)[^>]*>([\s\S]*?)</project_memory>`)
+
+// extractClaudeMDFiles parses the system prompt for CLAUDE.md (memory) files
+// in either format, with their sizes.
 func extractClaudeMDFiles(systemPrompt string) []state.ClaudeMDFile {
 	if systemPrompt == "" {
 		return nil
 	}
 
 	var files []state.ClaudeMDFile
+	seen := make(map[string]bool)
+	add := func(path, content string) {
+		content = strings.TrimSpace(content)
+		if content == "" || seen[path] {
+			return
+		}
+		seen[path] = true
+		files = append(files, state.ClaudeMDFile{
+			Path:    path,
+			Content: content,
+			Bytes:   len(content),
+			Tokens:  countStringTokens(content),
+		})
+	}
 
-	// Try the regex approach first for standard format
-	matches := claudeMDRe.FindAllStringSubmatch(systemPrompt, -1)
-	for _, m := range matches {
-		content := strings.TrimSpace(m[2])
-		if content != "" {
-			files = append(files, state.ClaudeMDFile{
-				Path:    m[1],
-				Content: content,
-			})
+	for _, m := range projectMemoryRe.FindAllStringSubmatch(systemPrompt, -1) {
+		add(strings.Trim(m[1], `"'`), m[2])
+	}
+
+	// Try the regex approach first for the legacy format
+	matches := claudeMDRe.FindAllStringSubmatchIndex(systemPrompt, -1)
+	for i, m := range matches {
+		end := len(systemPrompt)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
 		}
+		add(systemPrompt[m[2]:m[3]], systemPrompt[m[1]:end])
 	}
 
 	// Fallback: scan line by line for "Contents of" pattern
-	if len(files) == 0 {
+	if len(matches) == 0 {
 		lines := strings.Split(systemPrompt, "\n")
 		for i, line := range lines {
 			if !strings.HasPrefix(line, "Contents of /") || !strings.Contains(line, "CLAUDE.md") {
@@ -235,13 +409,7 @@ func extractClaudeMDFiles(systemPrompt string) []state.ClaudeMDFile {
 				contentLines = append(contentLines, lines[j])
 			}
 
-			content := strings.TrimSpace(strings.Join(contentLines, "\n"))
-			if content != "" {
-				files = append(files, state.ClaudeMDFile{
-					Path:    path,
-					Content: content,
-				})
-			}
+			add(path, strings.Join(contentLines, "\n"))
 		}
 	}
 
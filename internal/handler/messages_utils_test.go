@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestExtractClaudeMDFiles checks the memory files found in each system
+// prompt under testdata/fixtures/claudemd against its expected.json.
+func TestExtractClaudeMDFiles(t *testing.T) {
+	dirs, err := filepath.Glob("testdata/fixtures/claudemd/*")
+	if err != nil || len(dirs) == 0 {
+		t.Fatalf("no CLAUDE.md fixtures: %v", err)
+	}
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			system, err := os.ReadFile(filepath.Join(dir, "system.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(extractClaudeMDFiles(string(system)), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			path := filepath.Join(dir, "expected.json")
+			if *update {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := diffFixture(want, got); diff != "" {
+				t.Errorf("files differ from expected.json, %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// modelSuffix holds the per-request options selected by suffixes of the
+// model name, for clients that can only set the model:
+//
+//	model@<effort>  reasoning effort (none, minimal, low, medium, high, xhigh)
+//	model@small     route to the small model
+//	model#nothink   thinking disabled
+//
+// Suffixes combine, e.g. claude-sonnet-4@low#nothink.
+type modelSuffix struct {
+	effort     string
+	small      bool
+	noThinking bool
+}
+
+func (s modelSuffix) set() bool {
+	return s.effort != "" || s.small || s.noThinking
+}
+
+// parseModelSuffix splits model into the model to use and its suffix
+// options. Suffixes are taken off the end while they are recognized and
+// the rest isn't a known model, so a model whose real ID contains @ or #
+// is never split.
+func parseModelSuffix(ctx context.Context, model string) (string, modelSuffix) {
+	var s modelSuffix
+	base := model
+parse:
+	for state.FromContext(ctx).FindModel(base) == nil {
+		i := strings.LastIndexAny(base, "@#")
+		if i <= 0 {
+			break
+		}
+		opt := base[i:]
+		switch {
+		case opt == config.ModelSuffixNoThink && !s.noThinking:
+			s.noThinking = true
+		case opt == config.ModelSuffixSmall && !s.small:
+			s.small = true
+		case opt[0] == '@' && config.IsValidReasoningEffort(opt[1:]) && s.effort == "":
+			s.effort = opt[1:]
+		default:
+			break parse
+		}
+		base = base[:i]
+	}
+	return base, s
+}
+
+func (s modelSuffix) log(model, base string) {
+	slog.Info("model suffix", "model", model, "base", base,
+		"reasoning_effort", s.effort, "small", s.small, "no_thinking", s.noThinking)
+}
+
+// applyModelSuffix takes the suffix off req.Model into req.overrides. An
+// X-Reasoning-Effort header wins over an effort suffix; #nothink drops the
+// request's thinking config.
+func (req *AnthropicRequest) applyModelSuffix(ctx context.Context) {
+	base, s := parseModelSuffix(ctx, req.Model)
+	if !s.set() {
+		return
+	}
+	s.log(req.Model, base)
+	req.Model = base
+	if req.overrides.effort == "" {
+		req.overrides.effort = s.effort
+	}
+	req.overrides.small = s.small
+	if s.noThinking {
+		req.overrides.noThinking = true
+		req.Thinking = nil
+	}
+}
+
+// suffixModel returns the model a request with suffix s is sent to: the
+// small model for @small, else base.
+func (s modelSuffix) suffixModel(ctx context.Context, base string) string {
+	if s.small {
+		return config.FromContext(ctx).EffectiveSmallModel(state.FromContext(ctx))
+	}
+	return base
+}
+
+// applyModelSuffix applies the options of a model suffix to an OpenAI
+// /chat/completions or /responses payload: the model without the suffix,
+// the reasoning effort, and no thinking settings for #nothink. Returns the
+// model the client asked for, without the suffix.
+func applyModelSuffix(ctx context.Context, payload map[string]any, responsesAPI bool) string {
+	model, _ := payload["model"].(string)
+	base, s := parseModelSuffix(ctx, model)
+	if !s.set() {
+		return model
+	}
+	s.log(model, base)
+	payload["model"] = s.suffixModel(ctx, base)
+	if s.noThinking {
+		delete(payload, "thinking")
+		delete(payload, "thinking_budget")
+		if responsesAPI && s.effort == "" {
+			delete(payload, "reasoning")
+		}
+	}
+	if s.effort != "" {
+		if responsesAPI {
+			reasoning, _ := payload["reasoning"].(map[string]any)
+			if reasoning == nil {
+				reasoning = map[string]any{}
+			}
+			reasoning["effort"] = s.effort
+			payload["reasoning"] = reasoning
+		} else {
+			payload["reasoning_effort"] = s.effort
+		}
+	}
+	return base
+}
+
+// applyModelSuffixToBody is applyModelSuffix on a JSON request body. The
+// body is returned unchanged when its model has no suffix.
+func applyModelSuffixToBody(ctx context.Context, body []byte, responsesAPI bool) []byte {
+	var payload map[string]any
+	if json.Unmarshal(body, &payload) != nil {
+		return body
+	}
+	model, _ := payload["model"].(string)
+	if applyModelSuffix(ctx, payload, responsesAPI) == model {
+		return body
+	}
+	patched, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	return patched
+}
+
+// modelSuffixVariants returns the advertiseModelSuffixes variants of m for
+// the models list: #nothink only for models with thinking, @small for
+// models other than the small model, and efforts for every chat model.
+func modelSuffixVariants(ctx context.Context, m state.Model) []string {
+	cfg := config.FromContext(ctx)
+	if m.Capabilities.Type == "embeddings" {
+		return nil
+	}
+	thinking := m.Capabilities.Supports.MaxThinkingBudget > 0 || m.Capabilities.Supports.AdaptiveThinking
+	var ids []string
+	for _, suffix := range cfg.AdvertiseModelSuffixes {
+		if suffix == config.ModelSuffixNoThink && !thinking || suffix == config.ModelSuffixSmall && m.ID == cfg.EffectiveSmallModel(state.FromContext(ctx)) {
+			continue
+		}
+		ids = append(ids, m.ID+suffix)
+	}
+	return ids
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// TestReasoningAcrossModelSwitch runs a session whose first turn is
+// answered by a Responses model and whose second goes to a Chat
+// Completions Claude model, which can't take the first turn's encrypted
+// reasoning, and checks what becomes of it.
+func TestReasoningAcrossModelSwitch(t *testing.T) {
+	const summary = "The failing assertion compares against a stale golden file."
+
+	fake := &servicetest.Fake{}
+	fake.Script(servicetest.Responses, servicetest.JSON(`{"id":"resp_1","object":"response","status":"completed","model":"gpt-5","output":[`+
+		`{"type":"reasoning","id":"rs_1","summary":[{"type":"summary_text","text":"`+summary+`"}],"encrypted_content":"gAAAAB-opaque"},`+
+		`{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Regenerate the golden file."}]}],`+
+		`"usage":{"input_tokens":10,"output_tokens":5}}`))
+	fake.Script(servicetest.ChatCompletions, servicetest.JSON(`{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"Done."},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":1}}`))
+	useBackend(t, fake)
+	useModels(t,
+		state.Model{ID: "gpt-5", SupportedEndpoints: []string{"/responses"}},
+		state.Model{ID: "claude-sonnet-4", SupportedEndpoints: []string{"/chat/completions"}},
+	)
+
+	first := `{"role":"user","content":"why does the test fail?"}`
+	w := httptest.NewRecorder()
+	Messages(w, newRequest("POST", "/v1/messages", `{"model":"gpt-5","max_tokens":1024,"thinking":{"type":"enabled","budget_tokens":1024},"messages":[`+first+`]}`))
+	if w.Code != 200 {
+		t.Fatalf("first turn: status %d: %s", w.Code, w.Body)
+	}
+	var turn struct {
+		Content json.RawMessage `json:"content"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &turn)
+	if !strings.Contains(string(turn.Content), `"type":"thinking"`) {
+		t.Fatalf("first turn has no thinking block: %s", turn.Content)
+	}
+
+	tests := []struct {
+		fallback bool
+		want     string // assistant content sent for the first turn
+	}{
+		{false, "Regenerate the golden file."},
+		{true, priorReasoningPrefix + summary + "\n\nRegenerate the golden file."},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *config.Config) { c.ReasoningSummaryFallback = tt.fallback })
+		before := len(fake.Calls())
+		second := `{"model":"claude-sonnet-4","max_tokens":1024,"messages":[` + first + `,{"role":"assistant","content":` + string(turn.Content) + `},{"role":"user","content":"do it (fallback ` + map[bool]string{true: "on", false: "off"}[tt.fallback] + `)"}]}`
+		w := httptest.NewRecorder()
+		Messages(w, newRequest("POST", "/v1/messages", second))
+		if w.Code != 200 {
+			t.Fatalf("second turn: status %d: %s", w.Code, w.Body)
+		}
+
+		calls := fake.Calls()[before:]
+		if len(calls) != 1 || calls[0].Endpoint != servicetest.ChatCompletions {
+			t.Fatalf("second turn went to %v", fake.Endpoints()[before:])
+		}
+		var sent ChatCompletionRequest
+		json.Unmarshal(calls[0].Body, &sent)
+		var assistant *OpenAIMsg
+		for i := range sent.Messages {
+			if sent.Messages[i].Role == "assistant" {
+				assistant = &sent.Messages[i]
+			}
+		}
+		if assistant == nil {
+			t.Fatalf("fallback %v: no assistant message sent: %s", tt.fallback, calls[0].Body)
+		}
+		if got, _ := assistant.Content.(string); got != tt.want {
+			t.Errorf("fallback %v: assistant content %q, want %q", tt.fallback, got, tt.want)
+		}
+		if strings.Contains(string(calls[0].Body), "gAAAAB-opaque") {
+			t.Errorf("fallback %v: encrypted reasoning sent to a Claude model", tt.fallback)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"log/slog"
 	"net/http"
+	"strings"
 
-	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
@@ -24,34 +26,42 @@ type ModelEntry struct {
 	Created     int    `json:"created"`
 	OwnedBy    string `json:"owned_by"`
 	DisplayName string `json:"display_name,omitempty"`
+	// Proxy is the proxy's steering config for the model, an extension
+	// clients that don't know it ignore.
+	Proxy *ModelProxyInfo `json:"x_copilot_proxy,omitempty"`
 }
 
-// Models handles GET /models and /v1/models.
+// ModelProxyInfo is the x_copilot_proxy extension of a ModelEntry.
+type ModelProxyInfo struct {
+	ReasoningEffort string `json:"reasoning_effort"` // modelReasoningEfforts, or the default
+	ExtraPrompt     bool   `json:"extra_prompt"`     // an extraPrompts entry is set (unused on the messages backend)
+	SmallModel      bool   `json:"small_model"`      // the effective smallModel
+	Backend         string `json:"backend"`          // where /v1/messages routes it: messages, responses, chat_completions
+}
+
+// Models handles GET /models and /v1/models. Concurrent requests share one
+// response.
 func Models(w http.ResponseWriter, r *http.Request) {
-	models := state.Global.GetModels()
+	cachesOf(r.Context()).models.serve(r.Context(), w, "", func(w http.ResponseWriter) {
+		listModels(r.Context(), w)
+	})
+}
 
-	// Fallback: fetch models if not cached yet
-	if len(models) == 0 {
-		slog.Info("models not cached, fetching...")
-		fetched, err := service.FetchModels()
-		if err != nil {
-			slog.Error("failed to fetch models", "error", err)
-			http.Error(w, `{"error": "failed to fetch models"}`, http.StatusInternalServerError)
-			return
-		}
-		state.Global.SetModels(fetched)
-		models = fetched
+// listModels writes the models list, fetching it if not cached yet.
+func listModels(ctx context.Context, w http.ResponseWriter) {
+	models, err := cachedModels(ctx)
+	if err != nil {
+		http.Error(w, `{"error": "failed to fetch models"}`, http.StatusInternalServerError)
+		return
 	}
 
-	entries := make([]ModelEntry, len(models))
-	for i, m := range models {
-		entries[i] = ModelEntry{
-			ID:          m.ID,
-			Object:      "model",
-			Type:        "model",
-			Created:     0,
-			OwnedBy:    m.OwnedBy,
-			DisplayName: m.Name,
+	entries := make([]ModelEntry, 0, len(models))
+	for _, m := range models {
+		entries = append(entries, modelEntry(ctx, m, m.ID, modelSuffix{}))
+		// advertiseModelSuffixes variants follow their model
+		for _, id := range modelSuffixVariants(ctx, m) {
+			_, suffix := parseModelSuffix(ctx, id)
+			entries = append(entries, modelEntry(ctx, m, id, suffix))
 		}
 	}
 
@@ -62,3 +72,50 @@ func Models(w http.ResponseWriter, r *http.Request) {
 		HasMore: false,
 	})
 }
+
+// modelEntry returns the list entry of model m, or of its variant id
+// with the options of suffix.
+func modelEntry(ctx context.Context, m state.Model, id string, suffix modelSuffix) ModelEntry {
+	cfg := config.FromContext(ctx)
+	routed := suffix.suffixModel(ctx, m.ID)
+	info := &ModelProxyInfo{
+		ReasoningEffort: cfg.GetReasoningEffort(routed),
+		ExtraPrompt:     cfg.GetExtraPrompt(routed) != "",
+		SmallModel:      routed == cfg.EffectiveSmallModel(state.FromContext(ctx)),
+		Backend:         selectBackend(state.FromContext(ctx).FindModel(routed)),
+	}
+	if suffix.effort != "" {
+		info.ReasoningEffort = suffix.effort
+	}
+	name := m.Name
+	if id != m.ID {
+		name += " (" + strings.TrimPrefix(id, m.ID) + ")"
+	}
+	return ModelEntry{
+		ID:          id,
+		Object:      "model",
+		Type:        "model",
+		Created:     0,
+		OwnedBy:    m.OwnedBy,
+		DisplayName: name,
+		Proxy:       info,
+	}
+}
+
+// cachedModels returns the cached Copilot models, fetching them if not
+// cached yet.
+func cachedModels(ctx context.Context) ([]state.Model, error) {
+	s := state.FromContext(ctx)
+	if models := s.GetModels(); len(models) > 0 {
+		return models, nil
+	}
+	slog.Info("models not cached, fetching...")
+	fetched, err := upstream(ctx).FetchModels(ctx)
+	if err != nil {
+		slog.Error("failed to fetch models", "error", err)
+		return nil, err
+	}
+	s.SetModels(fetched)
+	config.FromContext(ctx).EffectiveSmallModel(s) // warns if smallModel was removed
+	return s.GetModels(), nil
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// modelInfo describes one model for routers. Field names follow LiteLLM's
+// model_info, so the proxy can be added as a provider without restating
+// its limits. Every field is always present; costs are null for models
+// without a modelPricing entry.
+type modelInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Vendor string `json:"vendor"`
+	Family string `json:"family"`
+	// Mode is "chat" or "embedding".
+	Mode string `json:"mode"`
+	// Backend is the API /v1/messages uses for the model: messages,
+	// responses or chat_completions. Empty for embedding models.
+	Backend string `json:"backend"`
+	Preview bool   `json:"preview"`
+
+	ContextWindow   int `json:"context_window"`
+	MaxInputTokens  int `json:"max_input_tokens"`
+	MaxOutputTokens int `json:"max_output_tokens"`
+	// MaxTokens is LiteLLM's older name for MaxOutputTokens.
+	MaxTokens int `json:"max_tokens"`
+
+	SupportsVision                  bool `json:"supports_vision"`
+	SupportsFunctionCalling         bool `json:"supports_function_calling"`
+	SupportsParallelFunctionCalling bool `json:"supports_parallel_function_calling"`
+	SupportsResponseSchema          bool `json:"supports_response_schema"`
+	SupportsReasoning               bool `json:"supports_reasoning"`
+	SupportsStreaming               bool `json:"supports_streaming"`
+	MinThinkingBudget               int  `json:"min_thinking_budget"`
+	MaxThinkingBudget               int  `json:"max_thinking_budget"`
+
+	// Costs in USD per token, from modelPricing.
+	InputCostPerToken       *float64 `json:"input_cost_per_token"`
+	OutputCostPerToken      *float64 `json:"output_cost_per_token"`
+	CacheReadInputTokenCost *float64 `json:"cache_read_input_token_cost"`
+
+	SupportedEndpoints []string `json:"supported_endpoints"`
+	// OverriddenFields lists the fields of Copilot's listing that
+	// modelOverrides replaced, as dotted paths such as
+	// "capabilities.limits.max_output_tokens".
+	OverriddenFields []string `json:"overridden_fields"`
+}
+
+// modelInfoList is the response of GET /api/models/info.
+type modelInfoList struct {
+	Object string      `json:"object"`
+	Data   []modelInfo `json:"data"`
+}
+
+// ModelsInfo handles GET /api/models/info — capabilities, limits and
+// configured pricing of every model, for routing frontends.
+func ModelsInfo(w http.ResponseWriter, r *http.Request) {
+	models, err := cachedModels(r.Context())
+	if err != nil {
+		http.Error(w, `{"error": "failed to fetch models"}`, http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]modelInfo, 0, len(models))
+	for i := range models {
+		infos = append(infos, newModelInfo(r.Context(), &models[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(modelInfoList{Object: "list", Data: infos})
+}
+
+func newModelInfo(ctx context.Context, m *state.Model) modelInfo {
+	limits, supports := m.Capabilities.Limits, m.Capabilities.Supports
+	info := modelInfo{
+		ID:                              m.ID,
+		Name:                            m.Name,
+		Vendor:                          m.OwnedBy,
+		Family:                          m.Capabilities.Family,
+		Mode:                            "chat",
+		Preview:                         m.Preview,
+		ContextWindow:                   limits.MaxContextWindowTokens,
+		MaxInputTokens:                  limits.MaxPromptTokens,
+		MaxOutputTokens:                 limits.MaxOutputTokens,
+		MaxTokens:                       limits.MaxOutputTokens,
+		SupportsVision:                  supports.Vision,
+		SupportsFunctionCalling:         supports.ToolCalls,
+		SupportsParallelFunctionCalling: supports.ParallelToolCalls,
+		SupportsResponseSchema:          supports.StructuredOutputs,
+		SupportsReasoning:               supports.MaxThinkingBudget > 0 || supports.AdaptiveThinking,
+		SupportsStreaming:               supports.Streaming,
+		MinThinkingBudget:               supports.MinThinkingBudget,
+		MaxThinkingBudget:               supports.MaxThinkingBudget,
+		SupportedEndpoints:              m.SupportedEndpoints,
+		OverriddenFields:                m.Overridden,
+	}
+	if info.SupportedEndpoints == nil {
+		info.SupportedEndpoints = []string{}
+	}
+	if info.OverriddenFields == nil {
+		info.OverriddenFields = []string{}
+	}
+	if info.MaxInputTokens == 0 {
+		info.MaxInputTokens = limits.MaxContextWindowTokens
+	}
+	if m.Capabilities.Type == "embeddings" {
+		info.Mode = "embedding"
+	} else {
+		info.Backend = selectBackend(m)
+	}
+
+	if price, ok := config.FromContext(ctx).GetModelPrice(m.ID); ok {
+		input := price.InputPerMTok / 1e6
+		output := price.OutputPerMTok / 1e6
+		info.InputCostPerToken, info.OutputCostPerToken = &input, &output
+		if price.CachedInputPerMTok > 0 {
+			cached := price.CachedInputPerMTok / 1e6
+			info.CacheReadInputTokenCost = &cached
+		}
+	}
+	return info
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// TestModelsGolden compares GET /v1/models, including the x_copilot_proxy
+// extension, with testdata/models. Run with -update to rewrite them.
+func TestModelsGolden(t *testing.T) {
+	thinking := state.ModelCapabilities{Supports: state.ModelSupports{MaxThinkingBudget: 32000}}
+	useModels(t,
+		state.Model{ID: "claude-sonnet-4.5", Name: "Claude Sonnet 4.5", OwnedBy: "Anthropic", Capabilities: thinking, SupportedEndpoints: []string{"/v1/messages", "/chat/completions"}},
+		state.Model{ID: "gpt-5", Name: "GPT-5", OwnedBy: "OpenAI", SupportedEndpoints: []string{"/responses"}},
+		state.Model{ID: "gpt-5-mini", Name: "GPT-5 mini", OwnedBy: "OpenAI", SupportedEndpoints: []string{"/chat/completions", "/responses"}},
+		state.Model{ID: "gpt-4.1", Name: "GPT-4.1", OwnedBy: "OpenAI", SupportedEndpoints: []string{"/chat/completions"}},
+		state.Model{ID: "text-embedding-3-small", Name: "Embedding V3 small", OwnedBy: "OpenAI", Capabilities: state.ModelCapabilities{Type: "embeddings"}},
+	)
+
+	tests := []struct {
+		name   string
+		config func(c *config.Config)
+	}{
+		{"defaults", func(c *config.Config) {}},
+		{"steering", func(c *config.Config) {
+			c.ModelReasoningEfforts = map[string]string{"gpt-5": "medium", "gpt-5-mini": "minimal"}
+			c.ExtraPrompts = map[string]string{"gpt-4.1": "Be brief.", "claude-sonnet-4.5": "Unused on messages."}
+			c.SmallModel = "gpt-4.1"
+		}},
+		{"suffixes", func(c *config.Config) {
+			c.AdvertiseModelSuffixes = []string{"@low", config.ModelSuffixSmall, config.ModelSuffixNoThink}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.ModelReasoningEfforts = map[string]string{"gpt-5-mini": "low"}
+				c.ExtraPrompts = map[string]string{}
+				c.SmallModel = "gpt-5-mini"
+				c.AdvertiseModelSuffixes = nil
+				tt.config(c)
+			})
+
+			rec := httptest.NewRecorder()
+			Models(rec, newRequest("GET", "/v1/models", ""))
+			if rec.Code != 200 {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var got bytes.Buffer
+			if err := json.Indent(&got, rec.Body.Bytes(), "", "  "); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata/models", tt.name+".json")
+			if *update {
+				if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := diffFixture(want, got.Bytes()); diff != "" {
+				t.Errorf("output differs from %s, %s", path, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+)
+
+// nativeStreamValidator checks content block ordering on a native Messages
+// stream. Copilot occasionally sends a content_block_delta for an index that
+// never had a content_block_start (seen with adaptive thinking), which
+// crashes Claude Code. Well-formed events are forwarded untouched; the
+// validator only reports events to insert before, or instead of, them.
+type nativeStreamValidator struct {
+	open    map[int]string // block index -> block type
+	repairs int
+}
+
+func newNativeStreamValidator() *nativeStreamValidator {
+	return &nativeStreamValidator{open: make(map[int]string)}
+}
+
+// process inspects one upstream event. It returns events to emit before
+// it, and skip when the event itself must be dropped.
+func (v *nativeStreamValidator) process(eventType, data string) (before []SSEEvent, skip bool) {
+	switch eventType {
+	case "content_block_start", "content_block_delta", "content_block_stop":
+	case "message_delta", "message_stop":
+		return v.closeOpen(eventType), false
+	default:
+		return nil, false
+	}
+
+	var evt struct {
+		Index        int `json:"index"`
+		ContentBlock struct {
+			Type string `json:"type"`
+		} `json:"content_block"`
+		Delta struct {
+			Type string `json:"type"`
+		} `json:"delta"`
+	}
+	if json.Unmarshal([]byte(data), &evt) != nil {
+		return nil, false
+	}
+
+	switch eventType {
+	case "content_block_start":
+		v.open[evt.Index] = evt.ContentBlock.Type
+	case "content_block_delta":
+		if _, ok := v.open[evt.Index]; !ok {
+			block := blockForDelta(evt.Delta.Type)
+			slog.Warn("native stream: delta without content_block_start, synthesizing one",
+				"index", evt.Index, "delta", evt.Delta.Type, "block", block.Type)
+			v.repairs++
+			v.open[evt.Index] = block.Type
+			before = append(before, SSEEvent{
+				Event: "content_block_start",
+				Data:  ContentBlockStartEvent{Type: "content_block_start", Index: evt.Index, ContentBlock: block},
+			})
+		}
+	case "content_block_stop":
+		if _, ok := v.open[evt.Index]; !ok {
+			slog.Warn("native stream: dropping content_block_stop for a block that is not open", "index", evt.Index)
+			v.repairs++
+			return nil, true
+		}
+		delete(v.open, evt.Index)
+	}
+	return before, false
+}
+
+// closeOpen returns content_block_stop events for blocks still open when
+// the message ends.
+func (v *nativeStreamValidator) closeOpen(eventType string) []SSEEvent {
+	if len(v.open) == 0 {
+		return nil
+	}
+	indices := make([]int, 0, len(v.open))
+	for i := range v.open {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+
+	slog.Warn("native stream: closing content blocks left open", "event", eventType, "indices", indices)
+	events := make([]SSEEvent, 0, len(indices))
+	for _, i := range indices {
+		events = append(events, SSEEvent{
+			Event: "content_block_stop",
+			Data:  ContentBlockStopEvent{Type: "content_block_stop", Index: i},
+		})
+		delete(v.open, i)
+		v.repairs++
+	}
+	return events
+}
+
+// blockForDelta infers the content block a delta type belongs to.
+func blockForDelta(deltaType string) ContentBlock {
+	switch deltaType {
+	case "thinking_delta", "signature_delta":
+		return ContentBlock{Type: "thinking"}
+	case "input_json_delta":
+		return ContentBlock{Type: "tool_use", ID: "toolu_" + randomBase36(24), Input: json.RawMessage("{}")}
+	default:
+		return ContentBlock{Type: "text"}
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Stubs of OpenAI account endpoints. Some OpenAI SDK wrappers and
+// dashboards probe them as health checks and mark the backend dead on a
+// 404 or 401. Those checks look at the status and the response shape, so
+// the responses are well formed but minimal.
+
+// organizationID names the single organization the proxy reports.
+const organizationID = "org-copilot-proxy"
+
+type openAIOrganization struct {
+	Object      string `json:"object"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Created     int64  `json:"created"`
+	Personal    bool   `json:"personal"`
+	IsDefault   bool   `json:"is_default"`
+	Role        string `json:"role"`
+}
+
+// openAIUsageEntry is one entry of the legacy GET /v1/usage response.
+type openAIUsageEntry struct {
+	AggregationTimestamp      int64  `json:"aggregation_timestamp"`
+	NRequests                 int64  `json:"n_requests"`
+	Operation                 string `json:"operation"`
+	SnapshotID                string `json:"snapshot_id"`
+	NContextTokensTotal       int64  `json:"n_context_tokens_total"`
+	NGeneratedTokensTotal     int64  `json:"n_generated_tokens_total"`
+	NCachedContextTokensTotal int64  `json:"n_cached_context_tokens_total"`
+}
+
+// openAIUsageResponse is the legacy GET /v1/usage response. Only data is
+// filled; the other lists exist because clients index them.
+type openAIUsageResponse struct {
+	Object                       string             `json:"object"`
+	Data                         []openAIUsageEntry `json:"data"`
+	FTData                       []any              `json:"ft_data"`
+	DalleAPIData                 []any              `json:"dalle_api_data"`
+	WhisperAPIData               []any              `json:"whisper_api_data"`
+	TTSAPIData                   []any              `json:"tts_api_data"`
+	AssistantCodeInterpreterData []any              `json:"assistant_code_interpreter_data"`
+	RetrievalStorageData         []any              `json:"retrieval_storage_data"`
+	CurrentUsageUSD              float64            `json:"current_usage_usd"`
+}
+
+func proxyOrganization(ctx context.Context) openAIOrganization {
+	return openAIOrganization{
+		Object:      "organization",
+		ID:          organizationID,
+		Name:        "copilot-proxy",
+		Title:       "copilot-proxy",
+		Description: "GitHub Copilot via copilot-proxy",
+		Created:     state.MetricsFromContext(ctx).Snapshot().Aggregates.StartTime.Unix(),
+		Personal:    true,
+		IsDefault:   true,
+		Role:        "owner",
+	}
+}
+
+// Organizations handles GET /v1/organizations — a list holding the one
+// organization the proxy reports.
+func Organizations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": []openAIOrganization{proxyOrganization(r.Context())}})
+}
+
+// Organization handles GET /v1/organization — the organization the proxy
+// reports.
+func Organization(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxyOrganization(r.Context()))
+}
+
+// OpenAIUsage handles GET /v1/usage?date=YYYY-MM-DD in the shape of
+// OpenAI's daily usage. The proxy only keeps totals since it started, so
+// any date from the start day to today gets one entry with those totals,
+// and other dates get none. Costs are always 0.
+func OpenAIUsage(w http.ResponseWriter, r *http.Request) {
+	agg := state.MetricsFromContext(r.Context()).Snapshot().Aggregates
+	day := time.Now()
+	if d := r.URL.Query().Get("date"); d != "" {
+		var err error
+		if day, err = time.ParseInLocation(time.DateOnly, d, time.Local); err != nil {
+			api.ForwardError(w, &api.HTTPError{
+				Message:    "invalid date " + d + ": want YYYY-MM-DD",
+				StatusCode: http.StatusBadRequest,
+			})
+			return
+		}
+	}
+
+	resp := openAIUsageResponse{
+		Object:                       "list",
+		Data:                         []openAIUsageEntry{},
+		FTData:                       []any{},
+		DalleAPIData:                 []any{},
+		WhisperAPIData:               []any{},
+		TTSAPIData:                   []any{},
+		AssistantCodeInterpreterData: []any{},
+		RetrievalStorageData:         []any{},
+	}
+	startDay := agg.StartTime.Format(time.DateOnly)
+	if date := day.Format(time.DateOnly); date >= startDay && date <= time.Now().Format(time.DateOnly) && agg.TotalRequests > 0 {
+		resp.Data = append(resp.Data, openAIUsageEntry{
+			AggregationTimestamp:      agg.StartTime.Unix(),
+			NRequests:                 agg.TotalRequests,
+			Operation:                 "completion",
+			SnapshotID:                "copilot",
+			NContextTokensTotal:       agg.TotalInputTokens,
+			NGeneratedTokensTotal:     agg.TotalOutputTokens,
+			NCachedContextTokensTotal: agg.TotalCachedTokens,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// TestOpenAIAccountStubs documents the fields OpenAI health probes and
+// usage dashboards read from the stubs, and checks they are filled.
+func TestOpenAIAccountStubs(t *testing.T) {
+	state.Metrics.RecordRequest(state.RequestRecord{
+		Timestamp: time.Now(), Endpoint: "chat_completions", Model: "gpt-4.1",
+		StatusCode: 200, InputTokens: 30, OutputTokens: 4, CachedTokens: 10,
+	})
+	agg := state.Metrics.Snapshot().Aggregates
+	today := time.Now().Format(time.DateOnly)
+
+	tests := []struct {
+		path   string
+		status int
+		fields map[string]any // JSON path → value; nil checks presence only
+	}{
+		{"/v1/organization", 200, map[string]any{
+			"object": "organization", "id": organizationID, "is_default": true, "personal": true, "role": "owner", "name": nil, "created": nil,
+		}},
+		{"/v1/organizations", 200, map[string]any{
+			"object": "list", "data.0.object": "organization", "data.0.id": organizationID,
+		}},
+		{"/v1/usage", 200, map[string]any{
+			"object": "list", "data.0.operation": "completion",
+			"data.0.n_requests":                    float64(agg.TotalRequests),
+			"data.0.n_context_tokens_total":        float64(agg.TotalInputTokens),
+			"data.0.n_generated_tokens_total":      float64(agg.TotalOutputTokens),
+			"data.0.n_cached_context_tokens_total": float64(agg.TotalCachedTokens),
+			"data.0.aggregation_timestamp":         float64(agg.StartTime.Unix()),
+			"current_usage_usd":                    float64(0),
+			"ft_data":                              []any{}, "dalle_api_data": []any{}, "whisper_api_data": []any{},
+		}},
+		{"/v1/usage?date=" + today, 200, map[string]any{"data.0.n_requests": float64(agg.TotalRequests)}},
+		{"/v1/usage?date=2001-01-01", 200, map[string]any{"object": "list", "data": []any{}}},
+		{"/v1/usage?date=" + time.Now().AddDate(0, 0, 2).Format(time.DateOnly), 200, map[string]any{"data": []any{}}},
+		{"/v1/usage?date=yesterday", http.StatusBadRequest, map[string]any{"error.message": "HTTP 400: invalid date yesterday: want YYYY-MM-DD"}},
+	}
+	handlers := map[string]http.HandlerFunc{"/v1/organization": Organization, "/v1/organizations": Organizations, "/v1/usage": OpenAIUsage}
+	for _, tt := range tests {
+		r := newRequest("GET", tt.path, "")
+		w := httptest.NewRecorder()
+		handlers[r.URL.Path](w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.path, w.Code, tt.status, w.Body)
+			continue
+		}
+		var body any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: not JSON: %s", tt.path, w.Body)
+			continue
+		}
+		for path, want := range tt.fields {
+			got, ok := jsonPath(body, path)
+			if !ok {
+				t.Errorf("%s: no %s in %s", tt.path, path, w.Body)
+				continue
+			}
+			if want != nil {
+				if g, _ := json.Marshal(got); string(g) != mustJSON(want) {
+					t.Errorf("%s: %s = %s, want %s", tt.path, path, g, mustJSON(want))
+				}
+			}
+		}
+	}
+}
+
+// jsonPath looks up a dotted path of object keys and array indexes.
+func jsonPath(v any, path string) (any, bool) {
+	for path != "" {
+		key, rest, _ := strings.Cut(path, ".")
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+		path = rest
+	}
+	return v, true
+}
+
+func mustJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
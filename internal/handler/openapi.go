@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+)
+
+// The OpenAPI description of the management API (GET /api/openapi.json):
+// stats, active requests and cancellation, request logs, translation,
+// model info, session pins, history, usage, health and token. The LLM
+// endpoints follow the OpenAI and Anthropic specifications and are left out. Schemas are generated from the types
+// the handlers encode, so they can't drift from the responses.
+
+// openAPIOperation describes one management endpoint. Responses maps a
+// status code to a value of the type returned, or nil for free-form JSON.
+type openAPIOperation struct {
+	Method, Path string
+	Summary      string
+	Params       []openAPIParam
+	RequestBody  any
+	Responses    map[int]any
+}
+
+type openAPIParam struct {
+	Name, In, Description string
+	Type                  string // string or integer
+}
+
+var errorResponse = api.ErrorResponse{}
+
+var openAPIOperations = []openAPIOperation{
+	{
+		Method: http.MethodGet, Path: "/api/stats",
+		Summary: "Usage statistics, recent requests and configuration summary",
+		Params: []openAPIParam{
+			{Name: "model", In: "query", Type: "string", Description: "Only recent requests for this model"},
+			{Name: "backend", In: "query", Type: "string", Description: "Only recent requests routed to this backend"},
+			{Name: "type", In: "query", Type: "string", Description: "Only recent requests of this type (normal, compact, warmup)"},
+			{Name: "status", In: "query", Type: "string", Description: `"error" for failed requests only`},
+			{Name: "since", In: "query", Type: "string", Description: "Only recent requests at or after this RFC 3339 time"},
+			{Name: "limit", In: "query", Type: "integer", Description: "Number of recent requests (default 50)"},
+		},
+		Responses: map[int]any{200: statsResponse{}, 400: errorResponse},
+	},
+	{
+		Method: http.MethodGet, Path: "/api/requests/{id}/logs",
+		Summary:   "Handler log lines of one request",
+		Params:    []openAPIParam{{Name: "id", In: "path", Type: "string", Description: `Request ID, with "/" escaped as %2F`}},
+		Responses: map[int]any{200: requestLogsResponse{}, 400: errorResponse, 404: errorResponse, 500: errorResponse},
+	},
+	{
+		Method: http.MethodGet, Path: "/api/requests/active",
+		Summary:   "In-flight completion requests",
+		Responses: map[int]any{200: activeRequestsResponse{}},
+	},
+	{
+		Method: http.MethodPost, Path: "/api/requests/{id}/cancel",
+		Summary:   "Cancel an in-flight completion request",
+		Params:    []openAPIParam{{Name: "id", In: "path", Type: "string", Description: `Request ID, with "/" escaped as %2F`}},
+		Responses: map[int]any{200: middleware.ActiveRequest{}, 400: errorResponse, 404: errorResponse},
+	},
+	{
+		Method: http.MethodPost, Path: "/api/translate",
+		Summary:     "Dry run of POST /v1/messages: the upstream payload, without sending it",
+		Params:      []openAPIParam{{Name: "backend", In: "query", Type: "string", Description: "chat, responses or messages (default: the routed backend)"}},
+		RequestBody: AnthropicRequest{},
+		Responses:   map[int]any{200: translateResponse{}, 400: errorResponse},
+	},
+	{
+		Method: http.MethodGet, Path: "/api/models/info",
+		Summary:   "Per-model limits, capabilities and configured pricing",
+		Responses: map[int]any{200: modelInfoList{}},
+	},
+	{
+		Method: http.MethodDelete, Path: "/api/sessions/{id}/pin",
+		Summary:   "Release a session's model pin",
+		Params:    []openAPIParam{{Name: "id", In: "path", Type: "string", Description: "Session pin ID from /api/stats"}},
+		Responses: map[int]any{200: sessionPinRelease{}, 404: errorResponse},
+	},
+	{
+		Method: http.MethodGet, Path: "/api/history",
+		Summary: "Search the transcript history (history.enabled)",
+		Params: []openAPIParam{
+			{Name: "q", In: "query", Type: "string", Description: "Text to find in prompts, responses and models (case-insensitive); empty lists all"},
+			{Name: "limit", In: "query", Type: "integer", Description: "Number of entries, newest first (default 50)"},
+		},
+		Responses: map[int]any{200: historyResponse{}, 400: errorResponse, 404: errorResponse, 500: errorResponse},
+	},
+	{
+		Method: http.MethodGet, Path: "/usage",
+		Summary:   "Copilot quota and usage, as reported by GitHub",
+		Responses: map[int]any{200: nil},
+	},
+	{
+		Method: http.MethodGet, Path: "/healthz",
+		Summary:   "Readiness checks",
+		Responses: map[int]any{200: healthzResponse{}, 503: healthzResponse{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/token",
+		Summary:   "The current Copilot token (with auth.exposeToken and an API key)",
+		Responses: map[int]any{200: TokenResponse{}, 403: errorResponse, 404: errorResponse},
+	},
+	{
+		Method: http.MethodGet, Path: "/token/github",
+		Summary:   "The GitHub token (with auth.exposeToken and an API key)",
+		Responses: map[int]any{200: TokenResponse{}, 403: errorResponse, 404: errorResponse},
+	},
+	{
+		Method: http.MethodGet, Path: "/api/openapi.json",
+		Summary:   "This document",
+		Responses: map[int]any{200: nil},
+	},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+)
+
+// OpenAPI returns the handler of GET /api/openapi.json, describing the
+// management API of the given proxy version.
+func OpenAPI(version string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		openAPIOnce.Do(func() {
+			openAPIDoc, _ = json.Marshal(buildOpenAPI(version))
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDoc)
+	}
+}
+
+func buildOpenAPI(version string) map[string]any {
+	g := &schemaGen{schemas: make(map[string]any), names: make(map[reflect.Type]string)}
+	paths := make(map[string]map[string]any)
+	for _, op := range openAPIOperations {
+		operation := map[string]any{"summary": op.Summary}
+		if len(op.Params) > 0 {
+			var params []map[string]any
+			for _, p := range op.Params {
+				params = append(params, map[string]any{
+					"name":        p.Name,
+					"in":          p.In,
+					"required":    p.In == "path",
+					"description": p.Description,
+					"schema":      map[string]any{"type": p.Type},
+				})
+			}
+			operation["parameters"] = params
+		}
+		if op.RequestBody != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(g.schema(reflect.TypeOf(op.RequestBody))),
+			}
+		}
+		responses := make(map[string]any)
+		for code, v := range op.Responses {
+			schema := map[string]any{}
+			if v != nil {
+				schema = g.schema(reflect.TypeOf(v))
+			}
+			responses[strconv.Itoa(code)] = map[string]any{
+				"description": http.StatusText(code),
+				"content":     jsonContent(schema),
+			}
+		}
+		operation["responses"] = responses
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]any)
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "copilot-proxy-go management API",
+			"version":     version,
+			"description": "Management endpoints of copilot-proxy-go. The LLM endpoints follow the OpenAI and Anthropic APIs.",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.schemas},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// schemaGen derives JSON Schemas (OpenAPI 3.1) from Go types as
+// encoding/json encodes them. Named structs become components referenced
+// with $ref. Slices, maps and pointers also accept null, which is how nil
+// ones encode.
+type schemaGen struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(g.schema(t.Elem()))
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return nullable(map[string]any{"type": "array", "items": g.schema(t.Elem())})
+	case reflect.Map:
+		return nullable(map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())})
+	case reflect.Struct:
+		return g.ref(t)
+	}
+	return map[string]any{} // interfaces: any JSON value
+}
+
+// ref returns a $ref to the component schema of struct type t, adding it
+// on first use.
+func (g *schemaGen) ref(t reflect.Type) map[string]any {
+	name, ok := g.names[t]
+	if !ok {
+		name = g.componentName(t)
+		g.names[t] = name
+		g.schemas[name] = map[string]any{} // placeholder for recursive types
+		g.schemas[name] = g.object(t)
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// componentName is the exported form of t's name, qualified by its
+// package if another type already took it.
+func (g *schemaGen) componentName(t reflect.Type) string {
+	name := t.Name()
+	if name == "" {
+		name = "Object"
+	}
+	name = strings.ToUpper(name[:1]) + name[1:]
+	if _, taken := g.schemas[name]; taken {
+		pkg := t.PkgPath()
+		pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	return name
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	required := []string{}
+	g.fields(t, props, &required)
+	return map[string]any{"type": "object", "properties": props, "required": required}
+}
+
+// fields adds the JSON fields of struct t, including those of embedded
+// structs, to props. Fields without omitempty/omitzero are required.
+func (g *schemaGen) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func nullable(s map[string]any) map[string]any {
+	if typ, ok := s["type"].(string); ok {
+		s["type"] = []string{typ, "null"}
+		return s
+	}
+	return map[string]any{"anyOf": []any{s, map[string]any{"type": "null"}}}
+}
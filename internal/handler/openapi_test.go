@@ -0,0 +1,343 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// openAPIDocument returns the published document as clients decode it.
+func openAPIDocument(t *testing.T) map[string]any {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	OpenAPI("test")(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	var doc map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decoding the document: %v", err)
+	}
+	return doc
+}
+
+// docAt returns the value at keys in the decoded document, or nil.
+func docAt(v any, keys ...string) any {
+	for _, k := range keys {
+		m, _ := v.(map[string]any)
+		v = m[k]
+	}
+	return v
+}
+
+// responseSchema returns the schema of the status response of an
+// operation in doc, or nil if the operation doesn't declare one.
+func responseSchema(doc map[string]any, method, path string, status int) any {
+	op, _ := docAt(doc, "paths", path, strings.ToLower(method)).(map[string]any)
+	return docAt(op, "responses", strconv.Itoa(status), "content", "application/json", "schema")
+}
+
+// validateSchema checks the decoded JSON value v against schema, the
+// subset of JSON Schema buildOpenAPI emits, resolving $refs in doc.
+// Object properties the schema doesn't declare are errors too, so a field
+// added to a response without its type changing the spec fails here.
+func validateSchema(doc map[string]any, schema any, v any, at string) []string {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return []string{at + ": no schema"}
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		target := docAt(doc, "components", "schemas", name)
+		if target == nil {
+			return []string{fmt.Sprintf("%s: unresolved $ref %s", at, ref)}
+		}
+		return validateSchema(doc, target, v, at)
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		for _, alt := range anyOf {
+			if len(validateSchema(doc, alt, v, at)) == 0 {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s: %s matches no anyOf alternative", at, jsonKind(v))}
+	}
+
+	var types []string
+	switch typ := s["type"].(type) {
+	case string:
+		types = []string{typ}
+	case []any:
+		for _, t := range typ {
+			types = append(types, t.(string))
+		}
+	}
+	if len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return kindMatches(t, v) }) {
+		return []string{fmt.Sprintf("%s: %s, want %v", at, jsonKind(v), types)}
+	}
+
+	var errs []string
+	switch v := v.(type) {
+	case map[string]any:
+		props, _ := s["properties"].(map[string]any)
+		required, _ := s["required"].([]any)
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required %q", at, name))
+			}
+		}
+		for name, field := range v {
+			switch {
+			case props[name] != nil:
+				errs = append(errs, validateSchema(doc, props[name], field, at+"."+name)...)
+			case s["additionalProperties"] != nil:
+				errs = append(errs, validateSchema(doc, s["additionalProperties"], field, at+"."+name)...)
+			case props != nil:
+				errs = append(errs, fmt.Sprintf("%s: undeclared property %q", at, name))
+			}
+		}
+	case []any:
+		if items := s["items"]; items != nil {
+			for i, item := range v {
+				errs = append(errs, validateSchema(doc, items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	}
+	return errs
+}
+
+func kindMatches(typ string, v any) bool {
+	switch typ {
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return typ == jsonKind(v)
+}
+
+func jsonKind(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+// populated returns a value of type t with every exported field set, so
+// that omitempty fields are encoded too.
+func populated(t reflect.Type, depth int) reflect.Value {
+	v := reflect.New(t).Elem()
+	if depth > 4 {
+		return v
+	}
+	switch t {
+	case timeType:
+		return reflect.ValueOf(time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+	case rawMessageType:
+		return reflect.ValueOf(json.RawMessage(`{"any":"json"}`))
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		v.Set(reflect.New(t.Elem()))
+		v.Elem().Set(populated(t.Elem(), depth+1))
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Slice:
+		v.Set(reflect.Append(reflect.MakeSlice(t, 0, 1), populated(t.Elem(), depth+1)))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+		v.SetMapIndex(populated(t.Key(), depth+1), populated(t.Elem(), depth+1))
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if f := v.Field(i); f.CanSet() {
+				f.Set(populated(t.Field(i).Type, depth+1))
+			}
+		}
+	}
+	return v
+}
+
+// TestOpenAPIRoundTripsTypes keeps the spec in sync with the types the
+// handlers encode and decode: the zero value and a fully populated value
+// of every request and response type, encoded and decoded as JSON, must
+// validate against the schema published for it.
+func TestOpenAPIRoundTripsTypes(t *testing.T) {
+	doc := openAPIDocument(t)
+	if doc["openapi"] != "3.1.0" {
+		t.Errorf("openapi = %v, want 3.1.0", doc["openapi"])
+	}
+
+	check := func(name string, typ reflect.Type, schema any) {
+		for _, v := range []reflect.Value{reflect.New(typ).Elem(), populated(typ, 0)} {
+			data, err := json.Marshal(v.Interface())
+			if err != nil {
+				t.Errorf("%s: encoding %s: %v", name, typ, err)
+				continue
+			}
+			var decoded any
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Errorf("%s: decoding %s: %v", name, typ, err)
+				continue
+			}
+			for _, e := range validateSchema(doc, schema, decoded, typ.String()) {
+				t.Errorf("%s: %s", name, e)
+			}
+		}
+	}
+
+	for _, op := range openAPIOperations {
+		name := op.Method + " " + op.Path
+		if docAt(doc, "paths", op.Path, strings.ToLower(op.Method)) == nil {
+			t.Errorf("%s: not in the document", name)
+			continue
+		}
+		if op.RequestBody != nil {
+			schema := docAt(doc, "paths", op.Path, strings.ToLower(op.Method), "requestBody", "content", "application/json", "schema")
+			check(name+" request", reflect.TypeOf(op.RequestBody), schema)
+		}
+		for status, v := range op.Responses {
+			schema := responseSchema(doc, op.Method, op.Path, status)
+			if schema == nil {
+				t.Errorf("%s: no schema for %d", name, status)
+				continue
+			}
+			if v != nil {
+				check(fmt.Sprintf("%s %d", name, status), reflect.TypeOf(v), schema)
+			}
+		}
+	}
+
+	// Undeclared fields are caught, not waved through
+	schema := responseSchema(doc, "DELETE", "/api/sessions/{id}/pin", 200)
+	if errs := validateSchema(doc, schema, map[string]any{"id": "p", "released": true, "extra": 1}, "pin"); len(errs) != 1 {
+		t.Errorf("undeclared property: got %v, want one error", errs)
+	}
+	if errs := validateSchema(doc, schema, map[string]any{"id": "p"}, "pin"); len(errs) != 1 {
+		t.Errorf("missing required property: got %v, want one error", errs)
+	}
+}
+
+// TestOpenAPIValidatesHandlerResponses checks example responses of the
+// real handlers, successes and errors, against the published schema.
+func TestOpenAPIValidatesHandlerResponses(t *testing.T) {
+	doc := openAPIDocument(t)
+	useModels(t, state.Model{ID: "gpt-4.1", Name: "GPT-4.1", SupportedEndpoints: []string{"/chat/completions"}})
+	useConfig(t, func(c *config.Config) {
+		c.Auth.ExposeToken = false
+		c.History.Enabled = false
+	})
+
+	state.Metrics.RecordRequest(state.RequestRecord{
+		RequestID: "openapi-example", Timestamp: time.Now(), Model: "gpt-4.1", Backend: "chat_completions",
+		RequestType: "messages", Endpoint: "messages", StatusCode: 200, InputTokens: 12, OutputTokens: 3,
+	})
+	now := time.Now()
+	sessionPins := testCaches.pins
+	sessionPins.mu.Lock()
+	sessionPins.pins["openapi-pin"] = &sessionPin{ID: "openapi-pin", UserID: "u", Model: "gpt-4.1", Backend: "chat_completions", Created: now, LastUsed: now}
+	sessionPins.mu.Unlock()
+	t.Cleanup(func() { sessionPins.release("openapi-pin") })
+
+	translateBody := `{"model":"gpt-4.1","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		method, path, pattern string
+		params                map[string]string
+		body                  string
+		handler               http.HandlerFunc
+		status                int
+	}{
+		{"GET", "/api/stats", "", nil, "", Stats, 200},
+		{"GET", "/api/stats?limit=ten", "/api/stats", nil, "", Stats, 400},
+		{"GET", "/api/requests/active", "", nil, "", ActiveRequests, 200},
+		{"GET", "/api/requests/%2F/logs", "/api/requests/{id}/logs", map[string]string{"id": "%"}, "", RequestLogs, 400},
+		{"POST", "/api/translate", "", nil, translateBody, Translate, 200},
+		{"POST", "/api/translate?backend=responses", "/api/translate", nil, translateBody, Translate, 200},
+		{"POST", "/api/translate?backend=grpc", "/api/translate", nil, translateBody, Translate, 400},
+		{"GET", "/api/models/info", "", nil, "", ModelsInfo, 200},
+		{"DELETE", "/api/sessions/openapi-pin/pin", "/api/sessions/{id}/pin", map[string]string{"id": "openapi-pin"}, "", ReleaseSessionPin, 200},
+		{"DELETE", "/api/sessions/openapi-pin/pin", "/api/sessions/{id}/pin", map[string]string{"id": "openapi-pin"}, "", ReleaseSessionPin, 404},
+		{"GET", "/api/history", "", nil, "", History, 404},
+		{"GET", "/token", "", nil, "", Token, 404},
+		{"GET", "/token/github", "", nil, "", GitHubToken, 404},
+	}
+	for _, tt := range tests {
+		pattern := tt.pattern
+		if pattern == "" {
+			pattern = tt.path
+		}
+		name := fmt.Sprintf("%s %s", tt.method, tt.path)
+		r := newRequest(tt.method, tt.path, tt.body)
+		if tt.params != nil {
+			rctx := chi.NewRouteContext()
+			for k, v := range tt.params {
+				rctx.URLParams.Add(k, v)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		}
+		rec := httptest.NewRecorder()
+		tt.handler(rec, r)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", name, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		schema := responseSchema(doc, tt.method, pattern, tt.status)
+		if schema == nil {
+			t.Errorf("%s: status %d is not in the document", name, tt.status)
+			continue
+		}
+		var body any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: decoding the response: %v", name, err)
+			continue
+		}
+		for _, e := range validateSchema(doc, schema, body, "response") {
+			t.Errorf("%s: %s", name, e)
+		}
+	}
+
+	// Healthz answers 200 or 503 depending on this process's tokens;
+	// both are documented with the same schema
+	rec := httptest.NewRecorder()
+	Healthz(rec, newRequest("GET", "/healthz", ""))
+	var body any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("GET /healthz: decoding the response: %v", err)
+	}
+	schema := responseSchema(doc, "GET", "/healthz", rec.Code)
+	if schema == nil {
+		t.Fatalf("GET /healthz: status %d is not in the document", rec.Code)
+	}
+	for _, e := range validateSchema(doc, schema, body, "response") {
+		t.Errorf("GET /healthz: %s", e)
+	}
+}
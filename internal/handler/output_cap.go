@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// errOutputCapReached stops reading an upstream stream whose output went
+// over the cap.
+var errOutputCapReached = errors.New("stream output token cap reached")
+
+// outputCap aborts runaway translated streams. It estimates output tokens
+// from the text and thinking deltas sent to the client and trips once they
+// exceed maxStreamOutputTokens or the client's max_tokens (with slack for
+// the estimate, in case the backend ignores it).
+type outputCap struct {
+	limit   int
+	chars   int
+	tripped bool
+}
+
+// newOutputCap returns nil when no limit applies.
+func newOutputCap(ctx context.Context, clientMaxTokens int) *outputCap {
+	limit := config.FromContext(ctx).MaxStreamOutputTokens
+	if clientMaxTokens > 0 {
+		// The estimate is rough; only catch backends that clearly ignore it
+		if client := clientMaxTokens + clientMaxTokens/4; limit == 0 || client < limit {
+			limit = client
+		}
+	}
+	if limit <= 0 {
+		return nil
+	}
+	return &outputCap{limit: limit}
+}
+
+// exceeded counts the events about to be sent and reports whether the
+// stream should be aborted now. A tool_use block is always allowed to
+// finish so its argument JSON is never cut off.
+func (c *outputCap) exceeded(events []SSEEvent, openBlockType string) bool {
+	if c == nil {
+		return false
+	}
+	for _, evt := range events {
+		switch data := evt.Data.(type) {
+		case ContentBlockDeltaEvent:
+			c.chars += len(data.Delta.Text) + len(data.Delta.Thinking)
+		case MessageStopEvent:
+			// Finished on its own
+			return false
+		}
+	}
+	if !c.tripped && c.outputTokens() > c.limit {
+		c.tripped = true
+		slog.Warn("stream output exceeded token cap", "limit", c.limit, "est_tokens", c.outputTokens())
+	}
+	return c.tripped && openBlockType != "tool_use"
+}
+
+// abortEvents ends the message after closing the open block: message_delta
+// with stop_reason max_tokens, then message_stop.
+func (c *outputCap) abortEvents(closeBlock []SSEEvent) []SSEEvent {
+	return append(closeBlock,
+		SSEEvent{
+			Event: "message_delta",
+			Data: MessageDeltaEvent{
+				Type:  "message_delta",
+				Delta: MessageDelta{StopReason: "max_tokens"},
+				Usage: DeltaUsage{OutputTokens: c.outputTokens()},
+			},
+		},
+		SSEEvent{
+			Event: "message_stop",
+			Data:  MessageStopEvent{Type: "message_stop"},
+		},
+	)
+}
+
+// outputTokens is the estimated output sent so far.
+func (c *outputCap) outputTokens() int {
+	return tokensForChars(c.chars)
+}
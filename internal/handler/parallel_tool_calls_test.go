@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// parallelToolCalls returns the parallel_tool_calls field of payload as
+// "true", "false" or "" when it is absent.
+func parallelToolCalls(t *testing.T, payload any) string {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	return string(fields["parallel_tool_calls"])
+}
+
+func TestParallelToolCallsPrecedence(t *testing.T) {
+	const tools = `"tools":[{"name":"Read","input_schema":{"type":"object","properties":{}}}]`
+	tests := []struct {
+		name      string
+		policy    map[string]bool
+		request   string
+		chat      string
+		responses string
+	}{
+		{"no preference", nil, `{` + tools + `}`, "", "true"},
+		{"client disables", nil, `{` + tools + `,"tool_choice":{"type":"auto","disable_parallel_tool_use":true}}`, "false", "false"},
+		{"client allows", nil, `{` + tools + `,"tool_choice":{"type":"auto","disable_parallel_tool_use":false}}`, "", "true"},
+		{"model allows", map[string]bool{"gpt-5-mini": true}, `{` + tools + `}`, "true", "true"},
+		{"client disables over model allowing", map[string]bool{"gpt-5-mini": true}, `{` + tools + `,"tool_choice":{"type":"any","disable_parallel_tool_use":true}}`, "false", "false"},
+		{"model disables", map[string]bool{"gpt-5-mini": false}, `{` + tools + `}`, "false", "false"},
+		{"model disables over client", map[string]bool{"gpt-5-mini": false}, `{` + tools + `,"tool_choice":{"type":"auto"}}`, "false", "false"},
+		{"other model's entry", map[string]bool{"gpt-4.1": false}, `{` + tools + `}`, "", "true"},
+		{"no tools", map[string]bool{"gpt-5-mini": false}, `{}`, "", "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.ModelToolParallelism = tt.policy })
+			var req AnthropicRequest
+			if err := json.Unmarshal([]byte(tt.request), &req); err != nil {
+				t.Fatal(err)
+			}
+			req.Model = "gpt-5-mini"
+			req.MaxTokens = 1024
+			req.Messages = []AnthropicMsg{{Role: "user", Content: json.RawMessage(`"hi"`)}}
+
+			chat, err := translateToOpenAI(testContext(context.Background()), &req, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parallelToolCalls(t, chat); got != tt.chat {
+				t.Errorf("chat completions: parallel_tool_calls = %q, want %q", got, tt.chat)
+			}
+			responses, err := translateToResponses(testContext(context.Background()), &req, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parallelToolCalls(t, responses); got != tt.responses {
+				t.Errorf("responses: parallel_tool_calls = %q, want %q", got, tt.responses)
+			}
+		})
+	}
+}
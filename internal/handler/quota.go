@@ -1,11 +1,13 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"regexp"
 	"strings"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
 const compactPrefix = "You are a helpful AI assistant tasked with summarizing conversations"
@@ -25,18 +27,23 @@ func isWarmupRequest(req *AnthropicRequest, betaHeader string) bool {
 }
 
 // applySmallModelIfNeeded checks for compact/warmup requests and routes them
-// to the configured small model to save premium quota.
-// Returns true if the model was changed.
-func applySmallModelIfNeeded(req *AnthropicRequest, betaHeader string) bool {
-	cfg := config.Get()
+// to the small model (Config.EffectiveSmallModel) to save premium quota, as
+// it does requests for a model@small. Returns true if the model was changed.
+func applySmallModelIfNeeded(ctx context.Context, req *AnthropicRequest, betaHeader string) bool {
+	cfg := config.FromContext(ctx)
+
+	if req.overrides.small {
+		req.Model = cfg.EffectiveSmallModel(state.FromContext(ctx))
+		return true
+	}
 
 	if cfg.CompactUseSmallModel && isCompactRequest(req) {
-		req.Model = cfg.SmallModel
+		req.Model = cfg.EffectiveSmallModel(state.FromContext(ctx))
 		return true
 	}
 
 	if isWarmupRequest(req, betaHeader) && !isCompactRequest(req) {
-		req.Model = cfg.SmallModel
+		req.Model = cfg.EffectiveSmallModel(state.FromContext(ctx))
 		return true
 	}
 
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+)
+
+// compiledRedactions caches compiled redaction patterns by source.
+var compiledRedactions = struct {
+	sync.Mutex
+	re map[string]*regexp.Regexp
+}{re: make(map[string]*regexp.Regexp)}
+
+// redactor applies the configured redactions to the text of one request.
+// It only rewrites text fields of user, system and tool-result content, so
+// images and other encoded data pass through untouched.
+type redactor struct {
+	rules []compiledRule
+	count int
+}
+
+type compiledRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// newRedactor returns a redactor for r, or nil when no redactions are
+// configured or the request's API key skips them.
+func newRedactor(r *http.Request) *redactor {
+	cfg := config.FromContext(r.Context())
+	rules := cfg.Redactions
+	if len(rules) == 0 || cfg.GetKeyOptions(middleware.APIKeyFromContext(r.Context())).SkipRedaction {
+		return nil
+	}
+
+	compiledRedactions.Lock()
+	defer compiledRedactions.Unlock()
+	rd := &redactor{}
+	for _, rule := range rules {
+		re, ok := compiledRedactions.re[rule.Pattern]
+		if !ok {
+			var err error
+			if re, err = regexp.Compile(rule.Pattern); err != nil {
+				slog.Warn("skipping invalid redaction pattern", "pattern", rule.Pattern, "error", err)
+				continue
+			}
+			compiledRedactions.re[rule.Pattern] = re
+		}
+		rd.rules = append(rd.rules, compiledRule{re: re, replacement: rule.Replacement})
+	}
+	return rd
+}
+
+// text redacts one string.
+func (rd *redactor) text(s string) string {
+	for _, rule := range rd.rules {
+		if n := len(rule.re.FindAllStringIndex(s, -1)); n > 0 {
+			rd.count += n
+			s = rule.re.ReplaceAllString(s, rule.replacement)
+		}
+	}
+	return s
+}
+
+// content redacts a string or a list of content blocks: text parts
+// (text, input_text) and nested tool_result content. Other blocks, such as
+// images and documents, are left alone.
+func (rd *redactor) content(c any) any {
+	switch v := c.(type) {
+	case string:
+		return rd.text(v)
+	case []any:
+		for _, b := range v {
+			block, ok := b.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "text", "input_text":
+				if s, ok := block["text"].(string); ok {
+					block["text"] = rd.text(s)
+				}
+			case "tool_result":
+				if inner, ok := block["content"]; ok {
+					block["content"] = rd.content(inner)
+				}
+			}
+		}
+	}
+	return c
+}
+
+// field redacts m[key] as content, if present.
+func (rd *redactor) field(m map[string]any, key string) {
+	if v, ok := m[key]; ok {
+		m[key] = rd.content(v)
+	}
+}
+
+// messages redacts the content of messages with one of roles.
+func (rd *redactor) messages(list any, roles ...string) {
+	items, _ := list.([]any)
+	for _, item := range items {
+		msg, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		role, _ := msg["role"].(string)
+		for _, want := range roles {
+			if role == want {
+				rd.field(msg, "content")
+				break
+			}
+		}
+	}
+}
+
+// anthropic redacts an Anthropic Messages payload: the system prompt and
+// user turns, which carry tool results.
+func (rd *redactor) anthropic(payload map[string]any) {
+	rd.field(payload, "system")
+	rd.messages(payload["messages"], "user")
+}
+
+// chat redacts a Chat Completions payload.
+func (rd *redactor) chat(payload map[string]any) {
+	rd.messages(payload["messages"], "system", "developer", "user", "tool")
+}
+
+// responses redacts a Responses payload: instructions, system/user input
+// messages and function call outputs.
+func (rd *redactor) responses(payload map[string]any) {
+	if s, ok := payload["instructions"].(string); ok {
+		payload["instructions"] = rd.text(s)
+	}
+	switch input := payload["input"].(type) {
+	case string:
+		payload["input"] = rd.text(input)
+	case []any:
+		rd.messages(input, "system", "developer", "user")
+		for _, item := range input {
+			if m, ok := item.(map[string]any); ok {
+				switch m["type"] {
+				case "function_call_output", "custom_tool_call_output":
+					rd.field(m, "output")
+				}
+			}
+		}
+	}
+}
+
+// body decodes a JSON request body, redacts it with walk, and re-encodes it
+// if anything changed. Numbers are kept verbatim.
+func (rd *redactor) body(body []byte, walk func(map[string]any)) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var payload map[string]any
+	if dec.Decode(&payload) != nil {
+		return body
+	}
+	before := rd.count
+	walk(payload)
+	if rd.count == before {
+		return body
+	}
+	redacted, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// report logs the redaction count and sets the X-Redactions header.
+func (rd *redactor) report(w http.ResponseWriter, endpoint string) {
+	if rd == nil {
+		return
+	}
+	w.Header().Set("X-Redactions", strconv.Itoa(rd.count))
+	if rd.count > 0 {
+		slog.Info("redacted request content", "endpoint", endpoint, "redactions", rd.count)
+	}
+}
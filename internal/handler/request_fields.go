@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// knownRequestFields are the JSON names of the AnthropicRequest fields.
+var knownRequestFields = sync.OnceValue(func() map[string]bool {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(AnthropicRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	return known
+})
+
+// unknownRequestFields returns the top-level fields of a Messages body that
+// AnthropicRequest doesn't model. The native backend forwards the body as
+// is; the translated ones rebuild it from the struct and lose these.
+func unknownRequestFields(body []byte) map[string]json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil
+	}
+	known := knownRequestFields()
+	for name := range fields {
+		if known[name] {
+			delete(fields, name)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// droppedFields remembers which unknown fields have been warned about, so
+// each is logged at warn level once and at debug level afterwards.
+var droppedFields sync.Map
+
+// forwardUnknownFields adds the unknown fields of req that are listed in
+// forwardUnknownFields to a translated upstream body, renamed as
+// configured, and reports the rest as dropped. backend names the
+// translation in logs.
+func forwardUnknownFields(ctx context.Context, body []byte, req *AnthropicRequest, backend string) []byte {
+	if len(req.unknown) == 0 {
+		return body
+	}
+	names := make([]string, 0, len(req.unknown))
+	for name := range req.unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	forwards := config.FromContext(ctx).ForwardUnknownFields
+	add := make(map[string]json.RawMessage)
+	for _, name := range names {
+		target, ok := forwards[name]
+		if !ok {
+			if _, seen := droppedFields.LoadOrStore(name, true); !seen {
+				slog.Warn("dropped unknown Anthropic request field; list it in forwardUnknownFields to forward it", "field", name, "backend", backend)
+			} else {
+				slog.Debug("dropped unknown Anthropic request field", "field", name, "backend", backend)
+			}
+			continue
+		}
+		if target == "" {
+			target = name
+		}
+		add[target] = req.unknown[name]
+	}
+	if len(add) == 0 {
+		return body
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var payload map[string]any
+	if dec.Decode(&payload) != nil {
+		return body
+	}
+	for name, value := range add {
+		payload[name] = value
+	}
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	slog.Debug("forwarded unknown Anthropic request fields", "fields", len(add), "backend", backend)
+	return out
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/logger"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// logHandlers are the handler logs that carry request IDs, named as the
+// endpoints in RequestRecord (the logger normalizes "_" to "-").
+var logHandlers = []string{"messages", "chat_completions", "responses"}
+
+// logRequest writes a handler log line tagged with the request's ID. With
+// logRouting "model", the line goes to a file per handler and model; only
+// listed models get one, so clients can't open files at will.
+func logRequest(r *http.Request, handler, model, format string, args ...any) {
+	name := handler
+	if config.FromContext(r.Context()).LogRouting == config.LogRoutingModel && model != "" && state.FromContext(r.Context()).FindModel(model) != nil {
+		name += "-" + model
+	}
+	logger.For(name).LogRequest(chimw.GetReqID(r.Context()), format, args...)
+}
+
+type requestLogsResponse struct {
+	RequestID string        `json:"request_id"`
+	Lines     []logger.Line `json:"lines"`
+}
+
+// RequestLogs handles GET /api/requests/{id}/logs — the handler log lines
+// of one request. Request IDs contain "/", escaped as %2F in the path.
+// A request still in the recent list is looked up in its endpoint's logs
+// of its day; any other in all handler logs kept.
+func RequestLogs(w http.ResponseWriter, r *http.Request) {
+	id, err := url.PathUnescape(chi.URLParam(r, "id"))
+	if err != nil || id == "" {
+		api.ForwardError(w, &api.HTTPError{Message: "invalid request ID", StatusCode: http.StatusBadRequest})
+		return
+	}
+
+	handlers := logHandlers
+	to := time.Now()
+	from := to.AddDate(0, 0, -7)
+	for _, rec := range state.MetricsFromContext(r.Context()).Snapshot().Recent {
+		if rec.RequestID == id {
+			// Lines are filed when flushed, possibly after midnight
+			handlers = []string{rec.Endpoint}
+			from, to = rec.Timestamp, rec.Timestamp.AddDate(0, 0, 1)
+			break
+		}
+	}
+
+	lines, err := logger.Find(id, handlers, from, to)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	if len(lines) == 0 {
+		api.ForwardError(w, &api.HTTPError{Message: fmt.Sprintf("no log lines for request %q", id), StatusCode: http.StatusNotFound})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requestLogsResponse{RequestID: id, Lines: lines})
+}
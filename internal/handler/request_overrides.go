@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// requestOverrides replace per-model config lookups for one /v1/messages
+// request, from the X-Extra-Prompt and X-Reasoning-Effort headers and the
+// model suffix (see modelSuffix).
+type requestOverrides struct {
+	// preset is the X-Extra-Prompt value: "none" or a promptPresets name
+	preset      string
+	extraPrompt string
+	effort      string
+	// small and noThinking come from the @small and #nothink suffixes
+	small      bool
+	noThinking bool
+}
+
+// parseRequestOverrides reads the override headers. An unknown preset or
+// effort is a 400.
+func parseRequestOverrides(r *http.Request) (requestOverrides, error) {
+	var o requestOverrides
+	if h := strings.TrimSpace(r.Header.Get("X-Extra-Prompt")); h != "" {
+		if h != "none" {
+			prompt, ok := config.FromContext(r.Context()).PromptPresets[h]
+			if !ok {
+				return o, &api.HTTPError{
+					Message:    fmt.Sprintf("unknown X-Extra-Prompt preset %q (available: %s)", h, availablePresets(r.Context())),
+					StatusCode: http.StatusBadRequest,
+				}
+			}
+			o.extraPrompt = prompt
+		}
+		o.preset = h
+	}
+	if h := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Reasoning-Effort"))); h != "" {
+		if !config.IsValidReasoningEffort(h) {
+			return o, &api.HTTPError{
+				Message:    fmt.Sprintf("invalid X-Reasoning-Effort header %q (expected none, minimal, low, medium, high, or xhigh)", h),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		o.effort = h
+	}
+	if o.preset != "" || o.effort != "" {
+		slog.Info("request overrides", "extra_prompt", o.preset, "reasoning_effort", o.effort)
+	}
+	return o, nil
+}
+
+// availablePresets lists the promptPresets names plus "none".
+func availablePresets(ctx context.Context) string {
+	names := []string{"none"}
+	for name := range config.FromContext(ctx).PromptPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return strings.Join(names, ", ")
+}
+
+// key identifies the overrides in cache and dedup keys, since they change
+// the upstream request.
+func (o requestOverrides) key() []byte {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%t\x00%t", o.preset, o.effort, o.small, o.noThinking))
+}
+
+// extraPrompt returns the extra prompt for req: the X-Extra-Prompt preset
+// when given, else the model's extraPrompts entry.
+func (req *AnthropicRequest) extraPrompt(ctx context.Context) string {
+	if req.overrides.preset != "" {
+		return req.overrides.extraPrompt
+	}
+	return config.FromContext(ctx).GetExtraPrompt(normalizeModelName(req.Model))
+}
+
+// reasoningEffort returns the reasoning effort for req: X-Reasoning-Effort
+// when given, else the model's configured effort.
+func (req *AnthropicRequest) reasoningEffort(ctx context.Context) string {
+	if req.overrides.effort != "" {
+		return req.overrides.effort
+	}
+	return config.FromContext(ctx).GetReasoningEffort(normalizeModelName(req.Model))
+}
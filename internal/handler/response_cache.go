@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// responseCache is the opt-in cache for deterministic non-streaming
+// responses (see config.ResponseCacheConfig). Entries are keyed by a hash
+// of the request as sent upstream and evicted least recently used first.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // *cachedEntry, most recently used first
+}
+
+type cachedEntry struct {
+	key     string
+	res     *bufferedResponse
+	expires time.Time
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the cached response for key, if fresh.
+func (c *responseCache) get(key string) (*bufferedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cachedEntry)
+	if !time.Now().Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.res, true
+}
+
+// put caches res under key, evicting the least recently used entries
+// beyond the entry cap of cfg.
+func (c *responseCache) put(cfg *config.Config, key string, res *bufferedResponse) {
+	ttl, maxEntries, _ := cfg.ResponseCacheLimits()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&cachedEntry{key: key, res: res, expires: time.Now().Add(ttl)})
+	for c.order.Len() > maxEntries {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*cachedEntry).key)
+	}
+}
+
+// reset drops every entry.
+func (c *responseCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// serve writes the cached response for key, or runs fn and caches its response if it succeeded and fits maxBodyBytes.
+// It reports whether the response came from the cache; responses carry
+// X-Cache: hit or miss.
+func (c *responseCache) serve(ctx context.Context, w http.ResponseWriter, key string, fn func(w http.ResponseWriter)) bool {
+	if res, ok := c.get(key); ok {
+		w.Header().Set("X-Cache", "hit")
+		res.replay(w)
+		return true
+	}
+
+	cfg := config.FromContext(ctx)
+	res := newBufferedResponse(cfg.StreamBufferLimit())
+	fn(res)
+	res = res.checkOverflow("response_cache")
+	// Answers of an alternate upstream aren't kept past the failover
+	if _, _, maxBodyBytes := cfg.ResponseCacheLimits(); res.status == http.StatusOK && res.body.Len() <= maxBodyBytes && res.header.Get(servedByHeader) == "" {
+		c.put(cfg, key, res)
+	}
+	w.Header().Set("X-Cache", "miss")
+	res.replay(w)
+	return false
+}
+
+// responseCacheable reports whether a non-streaming request may be cached:
+// the cache is enabled in cfg and the request is deterministic
+// (temperature 0) or its model is listed in responseCache.models.
+func responseCacheable(cfg *config.Config, stream bool, temperature *float64, models ...string) bool {
+	if stream || !cfg.ResponseCache.Enabled {
+		return false
+	}
+	if temperature != nil && *temperature == 0 {
+		return true
+	}
+	for _, m := range models {
+		if cfg.IsResponseCacheModel(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatCompletionCacheKey returns the cache key for a patched chat
+// completion body, with or without folded reasoning, and false when the
+// request isn't cacheable under cfg.
+func chatCompletionCacheKey(cfg *config.Config, body []byte, stream, fold bool) (string, bool) {
+	var req struct {
+		Model       string   `json:"model"`
+		Temperature *float64 `json:"temperature"`
+	}
+	if json.Unmarshal(body, &req) != nil || !responseCacheable(cfg, stream, req.Temperature, req.Model) {
+		return "", false
+	}
+	return requestKey([]byte("chat_completions"), []byte(strconv.FormatBool(fold)), normalizeJSON(body)), true
+}
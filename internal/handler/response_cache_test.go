@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+func TestChatCompletionCacheKey(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.ResponseCache = config.ResponseCacheConfig{Enabled: true, Models: []string{"gpt-4.1"}}
+	})
+	const base = `{"model":"gpt-5-mini","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	key, ok := chatCompletionCacheKey(config.Get(), []byte(base), false, false)
+	if !ok {
+		t.Fatal("temperature 0 request isn't cacheable")
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		stream    bool
+		fold      bool
+		cacheable bool
+		same      bool
+	}{
+		{"field order", `{"messages":[{"content":"hi","role":"user"}],"temperature":0,"model":"gpt-5-mini"}`, false, false, true, true},
+		{"whitespace", "{\n  \"model\": \"gpt-5-mini\",\n  \"temperature\": 0.0,\n  \"messages\": [ {\"role\": \"user\", \"content\": \"hi\"} ]\n}", false, false, true, true},
+		{"other prompt", `{"model":"gpt-5-mini","temperature":0,"messages":[{"role":"user","content":"hello"}]}`, false, false, true, false},
+		{"folded reasoning", base, false, true, true, false},
+		{"streaming", base, true, false, false, false},
+		{"sampled", `{"model":"gpt-5-mini","temperature":0.7,"messages":[{"role":"user","content":"hi"}]}`, false, false, false, false},
+		{"no temperature", `{"model":"gpt-5-mini","messages":[{"role":"user","content":"hi"}]}`, false, false, false, false},
+		{"listed model", `{"model":"gpt-4.1","temperature":1,"messages":[{"role":"user","content":"hi"}]}`, false, false, true, false},
+	}
+	for _, tt := range tests {
+		got, ok := chatCompletionCacheKey(config.Get(), []byte(tt.body), tt.stream, tt.fold)
+		if ok != tt.cacheable {
+			t.Errorf("%s: cacheable = %v, want %v", tt.name, ok, tt.cacheable)
+		}
+		if ok && (got == key) != tt.same {
+			t.Errorf("%s: same key = %v, want %v", tt.name, got == key, tt.same)
+		}
+	}
+
+	useConfig(t, func(c *config.Config) { c.ResponseCache.Enabled = false })
+	if _, ok := chatCompletionCacheKey(config.Get(), []byte(base), false, false); ok {
+		t.Error("cacheable with the cache disabled")
+	}
+}
+
+func TestResponseCacheServe(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.ResponseCache = config.ResponseCacheConfig{Enabled: true, MaxEntries: 2, MaxBodyBytes: 16}
+	})
+	c := newResponseCache()
+	calls := 0
+	serve := func(key string, status int, body string) (hit bool, res *httptest.ResponseRecorder) {
+		res = httptest.NewRecorder()
+		hit = c.serve(testContext(context.Background()), res, key, func(w http.ResponseWriter) {
+			calls++
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		})
+		return hit, res
+	}
+
+	tests := []struct {
+		key    string
+		status int
+		body   string
+		hit    bool
+	}{
+		{"a", 200, "A", false},
+		{"a", 200, "other", true}, // answered from the cache
+		{"err", 500, "boom", false},
+		{"err", 500, "boom", false}, // errors aren't cached
+		{"big", 200, strings.Repeat("x", 17), false},
+		{"big", 200, strings.Repeat("x", 17), false}, // over maxBodyBytes, not cached
+		{"b", 200, "B", false},
+		{"a", 200, "A", true}, // a is now the most recent; b next to go
+		{"c", 200, "C", false},
+		{"b", 200, "B", false},  // evicted by c
+		{"a", 200, "A2", false}, // evicted by b
+	}
+	for i, tt := range tests {
+		before := calls
+		hit, res := serve(tt.key, tt.status, tt.body)
+		if hit != tt.hit || (calls == before) != tt.hit {
+			t.Fatalf("step %d (%s): hit = %v, upstream called = %v; want hit %v", i, tt.key, hit, calls > before, tt.hit)
+		}
+		want := map[bool]string{true: "hit", false: "miss"}[tt.hit]
+		if got := res.Header().Get("X-Cache"); got != want {
+			t.Errorf("step %d (%s): X-Cache = %q, want %q", i, tt.key, got, want)
+		}
+		if tt.key == "a" && i == 1 && res.Body.String() != "A" {
+			t.Errorf("cached body %q, want %q", res.Body, "A")
+		}
+	}
+}
+
+func TestResponseCacheExpires(t *testing.T) {
+	useConfig(t, func(c *config.Config) {
+		c.ResponseCache = config.ResponseCacheConfig{Enabled: true, TTL: "1ns"}
+	})
+	c := newResponseCache()
+	res := newBufferedResponse(config.Get().StreamBufferLimit())
+	res.Write([]byte("A"))
+	c.put(config.Get(), "a", res)
+	if _, ok := c.get("a"); ok {
+		t.Error("expired entry served")
+	}
+	if len(c.entries) != 0 || c.order.Len() != 0 {
+		t.Error("expired entry kept")
+	}
+}
+
+func TestChatCompletionCacheHit(t *testing.T) {
+	fake := &servicetest.Fake{}
+	fake.Script(servicetest.ChatCompletions, servicetest.JSON(`{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"cached"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":1}}`))
+	useBackend(t, fake)
+	useModels(t, state.Model{ID: "gpt-4.1", SupportedEndpoints: []string{"/chat/completions"}})
+	useConfig(t, func(c *config.Config) { c.ResponseCache = config.ResponseCacheConfig{Enabled: true} })
+
+	for i, want := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		r := newRequest("POST", "/chat/completions", `{"model":"gpt-4.1","temperature":0,"messages":[{"role":"user","content":"cache me once"}]}`)
+		ChatCompletions(w, r)
+		if got := w.Header().Get("X-Cache"); got != want || w.Code != 200 || !strings.Contains(w.Body.String(), "cached") {
+			t.Errorf("request %d: %d X-Cache %q, want 200 %q: %s", i+1, w.Code, got, want, w.Body)
+		}
+		if rec := recordOf(t, r); rec.Cached != (want == "hit") {
+			t.Errorf("request %d: record cached = %v", i+1, rec.Cached)
+		}
+	}
+	if n := len(fake.Calls()); n != 1 {
+		t.Errorf("%d upstream requests, want 1", n)
+	}
+}
+
+func TestMessagesCacheFollowsConfig(t *testing.T) {
+	fake := &servicetest.Fake{}
+	scriptAll(fake, "gpt-5-mini")
+	useBackend(t, fake)
+	useModels(t, state.Model{ID: "gpt-5-mini", SupportedEndpoints: []string{"/responses"}})
+	useConfig(t, func(c *config.Config) {
+		c.ResponseCache = config.ResponseCacheConfig{Enabled: true}
+		c.ExtraPrompts = map[string]string{}
+		c.ModelReasoningEfforts = map[string]string{"gpt-5-mini": "low"}
+	})
+
+	tests := []struct {
+		name   string
+		update func(c *config.Config)
+		want   string
+	}{
+		{"first", nil, "miss"},
+		{"same", nil, "hit"},
+		{"extra prompt changed", func(c *config.Config) { c.ExtraPrompts = map[string]string{"gpt-5-mini": "Be terse."} }, "miss"},
+		{"same again", nil, "hit"},
+		{"reasoning effort changed", func(c *config.Config) { c.ModelReasoningEfforts = map[string]string{"gpt-5-mini": "high"} }, "miss"},
+		{"unrelated config", func(c *config.Config) { c.ExtraPrompts["gpt-4.1"] = "Be verbose." }, "hit"},
+	}
+	for _, tt := range tests {
+		if tt.update != nil {
+			config.Update(tt.update)
+		}
+		w := httptest.NewRecorder()
+		Messages(w, newRequest("POST", "/v1/messages", `{"model":"gpt-5-mini","max_tokens":10,"temperature":0,"messages":[{"role":"user","content":"cache me"}]}`))
+		if got := w.Header().Get("X-Cache"); got != tt.want || w.Code != 200 {
+			t.Errorf("%s: %d X-Cache %q, want 200 %q: %s", tt.name, w.Code, got, tt.want, w.Body)
+		}
+	}
+	if n := len(fake.Calls()); n != 3 {
+		t.Errorf("%d upstream requests, want 3", n)
+	}
+}
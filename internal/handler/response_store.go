@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// responseStore emulates Responses API server-side state, which Copilot
+// doesn't keep. It maps response IDs issued by the proxy to the full
+// conversation (input plus output items) so a later request can continue it
+// with previous_response_id. Entries expire after a TTL and the oldest are
+// evicted beyond the entry cap or byte budget.
+type responseStore struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // *storedResponse, oldest first
+	bytes   int
+}
+
+type storedResponse struct {
+	id      string
+	items   []any
+	size    int
+	expires time.Time
+}
+
+func newResponseStore() *responseStore {
+	return &responseStore{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// reset drops every stored conversation.
+func (s *responseStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[string]*list.Element)
+	s.order.Init()
+	s.bytes = 0
+}
+
+// get returns the conversation stored for id, under the limits of cfg.
+func (s *responseStore) get(cfg *config.Config, id string) ([]any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictLocked(cfg, time.Now())
+
+	el, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+	items := el.Value.(*storedResponse).items
+	return append([]any(nil), items...), true
+}
+
+// put stores a conversation under id, evicting as needed under the limits
+// of cfg.
+func (s *responseStore) put(cfg *config.Config, id string, items []any) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return
+	}
+	_, ttl, maxBytes := cfg.ResponseStoreLimits()
+	if len(data) > maxBytes {
+		slog.Warn("response too large to store for previous_response_id", "id", id, "bytes", len(data))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.entries[id] = s.order.PushBack(&storedResponse{id: id, items: items, size: len(data), expires: now.Add(ttl)})
+	s.bytes += len(data)
+	s.evictLocked(cfg, now)
+}
+
+// evictLocked drops expired entries, then the oldest entries until the
+// store is within the limits of cfg. s.mu must be held.
+func (s *responseStore) evictLocked(cfg *config.Config, now time.Time) {
+	maxEntries, _, maxBytes := cfg.ResponseStoreLimits()
+	// Entries share one TTL and are in insertion order, so expired ones
+	// are always at the front
+	for el := s.order.Front(); el != nil; el = s.order.Front() {
+		r := el.Value.(*storedResponse)
+		if !now.After(r.expires) && s.order.Len() <= maxEntries && s.bytes <= maxBytes {
+			break
+		}
+		s.order.Remove(el)
+		delete(s.entries, r.id)
+		s.bytes -= r.size
+	}
+}
+
+// pendingResponse is a Responses request whose result will be stored.
+type pendingResponse struct {
+	id    string
+	input []any
+	store *responseStore // of the request's proxy instance
+	cfg   *config.Config
+}
+
+// expandPreviousResponse emulates server-side conversation state on a
+// Responses payload: it prepends the conversation stored for
+// previous_response_id to input, and forces store to false upstream. If the
+// client asked to store the response with store: true, it returns a
+// pendingResponse with the ID the client will see; otherwise nil. Unlike
+// OpenAI, a missing store means false: the proxy keeps nothing it wasn't
+// asked to.
+func expandPreviousResponse(ctx context.Context, payload map[string]any) (*pendingResponse, error) {
+	prevID, _ := payload["previous_response_id"].(string)
+	store := payload["store"] == true
+	if prevID == "" && !store {
+		return nil, nil
+	}
+	delete(payload, "previous_response_id")
+	payload["store"] = false
+
+	input := responsesInputItems(payload["input"])
+	if prevID != "" {
+		history, ok := cachesOf(ctx).stored.get(config.FromContext(ctx), prevID)
+		if !ok {
+			return nil, &api.HTTPError{
+				Message:    "previous response " + prevID + " not found (the proxy keeps responses in memory; it may have expired or the proxy restarted)",
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		input = append(history, input...)
+		payload["input"] = input
+		slog.Debug("expanded previous_response_id", "id", prevID, "items", len(history))
+	}
+
+	if !store {
+		return nil, nil
+	}
+	return &pendingResponse{id: "resp_" + randomBase36(24), input: input, store: cachesOf(ctx).stored, cfg: config.FromContext(ctx)}, nil
+}
+
+// responsesInputItems normalizes a Responses input (string or item list)
+// to a list of items.
+func responsesInputItems(input any) []any {
+	switch v := input.(type) {
+	case []any:
+		return v
+	case string:
+		return []any{map[string]any{"type": "message", "role": "user", "content": v}}
+	}
+	return nil
+}
+
+// patchID replaces the upstream response ID with the proxy's own.
+func (p *pendingResponse) patchID(response map[string]any) {
+	if p != nil && response != nil {
+		response["id"] = p.id
+	}
+}
+
+// save stores the conversation so far: the request input followed by the
+// response's output items. Upstream item IDs are dropped except on
+// reasoning items, which need theirs to pair with encrypted content.
+func (p *pendingResponse) save(output []any) {
+	if p == nil {
+		return
+	}
+	items := append([]any(nil), p.input...)
+	for _, o := range output {
+		item, ok := o.(map[string]any)
+		if !ok {
+			continue
+		}
+		if item["type"] != "reasoning" {
+			copied := make(map[string]any, len(item))
+			for k, v := range item {
+				if k != "id" {
+					copied[k] = v
+				}
+			}
+			item = copied
+		}
+		items = append(items, item)
+	}
+	p.store.put(p.cfg, p.id, items)
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+func TestExpandPreviousResponseStoresOnlyWhenAsked(t *testing.T) {
+	tests := []struct {
+		payload string
+		pending bool
+	}{
+		{`{"input":"hi"}`, false},
+		{`{"input":"hi","store":false}`, false},
+		{`{"input":"hi","store":"true"}`, false},
+		{`{"input":"hi","store":true}`, true},
+	}
+	for _, tt := range tests {
+		var payload map[string]any
+		json.Unmarshal([]byte(tt.payload), &payload)
+		pending, err := expandPreviousResponse(testContext(context.Background()), payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.payload, err)
+		}
+		if (pending != nil) != tt.pending {
+			t.Errorf("%s: pending = %v, want %v", tt.payload, pending != nil, tt.pending)
+		}
+		if tt.pending && payload["store"] != false {
+			t.Errorf("%s: store upstream = %v, want false", tt.payload, payload["store"])
+		}
+	}
+}
+
+// postResponses sends body to the Responses handler and returns the
+// response ID the client sees.
+func postResponses(t *testing.T, body string) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Responses(w, newRequest("POST", "/responses", body))
+	var result struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result.ID
+}
+
+func TestResponsesStoresOnlySuccessfulResponses(t *testing.T) {
+	useModels(t, state.Model{ID: "gpt-5", SupportedEndpoints: []string{"/responses"}})
+	completed := `{"id":"resp_up","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`
+	tests := []struct {
+		name   string
+		body   string
+		reply  servicetest.Reply
+		stored bool
+	}{
+		{"completed", `{"model":"gpt-5","input":"hi","store":true}`, servicetest.JSON(completed), true},
+		{"store omitted", `{"model":"gpt-5","input":"hi"}`, servicetest.JSON(completed), false},
+		{"failed", `{"model":"gpt-5","input":"hi","store":true}`,
+			servicetest.JSON(`{"id":"resp_up","status":"failed","error":{"message":"boom"},"output":[]}`), false},
+		{"incomplete", `{"model":"gpt-5","input":"hi","store":true}`,
+			servicetest.JSON(`{"id":"resp_up","status":"incomplete","output":[]}`), false},
+		{"upstream error", `{"model":"gpt-5","input":"hi","store":true}`,
+			servicetest.Error(http.StatusInternalServerError, `{"error":{"message":"down"}}`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &servicetest.Fake{}
+			fake.Script(servicetest.Responses, tt.reply, servicetest.JSON(completed))
+			useBackend(t, fake)
+
+			code, id := postResponses(t, tt.body)
+			if tt.reply.Status == 0 && code != http.StatusOK {
+				t.Fatalf("status %d", code)
+			}
+			if id == "" {
+				id = "resp_up"
+			}
+			_, found := testCaches.stored.get(config.Get(), id)
+			if found != tt.stored {
+				t.Fatalf("response %s stored = %v, want %v", id, found, tt.stored)
+			}
+
+			// A follow-up can continue only a stored response
+			code, _ = postResponses(t, `{"model":"gpt-5","input":"more","previous_response_id":"`+id+`"}`)
+			if want := map[bool]int{true: http.StatusOK, false: http.StatusBadRequest}[tt.stored]; code != want {
+				t.Errorf("follow-up status %d, want %d", code, want)
+			}
+		})
+	}
+}
+
+func TestStoreStreamEventSavesOnCompletedOnly(t *testing.T) {
+	for _, event := range []string{"response.failed", "response.incomplete", "response.completed"} {
+		pending := &pendingResponse{id: "resp_" + strings.ReplaceAll(event, ".", "_"), store: testCaches.stored, cfg: config.Get()}
+		var items []any
+		storeStreamEvent(pending, event, `{"type":"`+event+`","response":{"id":"resp_up","output":[]}}`, &items)
+		_, found := testCaches.stored.get(config.Get(), pending.id)
+		if want := event == "response.completed"; found != want {
+			t.Errorf("%s: stored = %v, want %v", event, found, want)
+		}
+	}
+}
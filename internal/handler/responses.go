@@ -1,21 +1,25 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
 	"time"
 
+	chimw "github.com/go-chi/chi/v5/middleware"
+
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
 	"github.com/tonghaoch/copilot-proxy-go/internal/config"
-	"github.com/tonghaoch/copilot-proxy-go/internal/logger"
-	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
 // Responses handles POST /responses and /v1/responses — OpenAI Responses API passthrough.
 func Responses(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromContext(r.Context())
 	start := time.Now()
 
 	body, err := io.ReadAll(r.Body)
@@ -33,9 +37,16 @@ func Responses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get model and validate support
+	// Configured redactions, before anything is forwarded or stored
+	if rd := newRedactor(r); rd != nil {
+		rd.responses(payload)
+		rd.report(w, "responses")
+	}
+
+	// Model suffixes, then get model and validate support
+	applyModelSuffix(r.Context(), payload, true)
 	modelID, _ := payload["model"].(string)
-	model := state.Global.FindModel(modelID)
+	model := state.FromContext(r.Context()).FindModel(modelID)
 	if model == nil || !isResponsesSupported(model) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -50,7 +61,7 @@ func Responses(w http.ResponseWriter, r *http.Request) {
 
 	// apply_patch tool conversion: custom → function (if enabled in config)
 	if tools, ok := payload["tools"].([]any); ok {
-		if config.Get().UseFunctionApplyPatch {
+		if cfg.UseFunctionApplyPatch {
 			payload["tools"] = convertApplyPatchTools(tools)
 		}
 		// Remove web_search tools
@@ -60,12 +71,32 @@ func Responses(w http.ResponseWriter, r *http.Request) {
 	// Nullify service_tier
 	payload["service_tier"] = nil
 
+	// Per-model parallel tool call policy on top of the client's choice
+	var requestedParallel *bool
+	if v, ok := payload["parallel_tool_calls"].(bool); ok {
+		requestedParallel = &v
+	}
+	if parallel := cfg.ResolveParallelToolCalls(modelID, requestedParallel); parallel != nil {
+		payload["parallel_tool_calls"] = *parallel
+	}
+
+	// previous_response_id / store emulation (Copilot keeps no state)
+	pending, err := expandPreviousResponse(r.Context(), payload)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+
 	// Detect vision and initiator
 	isStream, _ := payload["stream"].(bool)
 	vision := detectVisionInResponses(payload)
-	isAgent := detectAgentInResponses(payload)
+	isAgent, initiatorOverride, err := resolveInitiator(r, detectAgentInResponses(payload))
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
 
-	logger.For("responses").Log("model=%s stream=%v initiator=%s vision=%v", modelID, isStream, initiatorStr(isAgent), vision)
+	logRequest(r, "responses", modelID, "model=%s stream=%v initiator=%s vision=%v", modelID, isStream, initiatorStr(isAgent), vision)
 	slog.Info("responses passthrough", "model", modelID, "stream", isStream,
 		"initiator", initiatorStr(isAgent), "vision", vision)
 
@@ -76,40 +107,89 @@ func Responses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := service.ProxyResponses(body, isAgent, vision)
+	rec := state.RequestRecord{
+		RequestID:         chimw.GetReqID(r.Context()),
+		Timestamp:         start,
+		Endpoint:          "responses",
+		Model:             modelID,
+		RoutedModel:       modelID,
+		Backend:           "responses",
+		RequestType:       "normal",
+		Initiator:         initiatorStr(isAgent),
+		InitiatorOverride: initiatorOverride,
+		HasVision:         vision,
+		Streaming:         isStream,
+		Chaos:             middleware.ChaosFromContext(r.Context()),
+	}
+	middleware.DescribeActiveRequest(r.Context(), rec.Model, rec.Initiator)
+
+	effort := ""
+	if reasoning, ok := payload["reasoning"].(map[string]any); ok {
+		effort, _ = reasoning["effort"].(string)
+	}
+	call := startUpstreamCall(w, r, config.TimeoutResponses, effort)
+	defer call.stop()
+	resp, err := upstream(r.Context()).ProxyResponses(call.ctx, body, isAgent, vision)
+	resp, err = call.guard(resp, err, &rec)
 	if err != nil {
+		rec.LatencyMs = time.Since(start).Milliseconds()
+		rec.StatusCode = errorStatus(err)
+		rec.Error = err.Error()
+		state.MetricsFromContext(r.Context()).RecordRequest(rec)
 		api.ForwardError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if isStream {
-		streamResponsesPassthrough(w, resp)
+		span := startSpan(r, spanStream)
+		cw := call.clientStream(w)
+		streamResponsesPassthrough(r.Context(), cw, resp, pending, &rec)
+		cw.end(&rec)
+		span.End()
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		writeResponsesResult(w, resp, pending, &rec)
 	}
 
 	// Record metrics
-	state.Metrics.RecordRequest(state.RequestRecord{
-		Timestamp:   start,
-		Endpoint:    "responses",
-		Model:       modelID,
-		RoutedModel: modelID,
-		Backend:     "responses",
-		RequestType: "normal",
-		Initiator:   initiatorStr(isAgent),
-		HasVision:   vision,
-		Streaming:   isStream,
-		LatencyMs:   time.Since(start).Milliseconds(),
-		StatusCode:  resp.StatusCode,
-	})
+	rec.LatencyMs = time.Since(start).Milliseconds()
+	rec.StatusCode = resp.StatusCode
+	state.MetricsFromContext(r.Context()).RecordRequest(rec)
+}
+
+// writeResponsesResult forwards a non-streaming response with usage headers.
+// With pending set, the response is forwarded under the proxy's response ID
+// and, if it completed, its conversation stored for previous_response_id.
+func writeResponsesResult(w http.ResponseWriter, resp *http.Response, pending *pendingResponse, rec *state.RequestRecord) {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+	recordResponsesUsage(data, rec)
+	var result map[string]any
+	if pending != nil && json.Unmarshal(data, &result) == nil {
+		pending.patchID(result)
+		// Like a stream, which is saved on response.completed only
+		if status, _ := result["status"].(string); resp.StatusCode == http.StatusOK && (status == "" || status == "completed") {
+			output, _ := result["output"].([]any)
+			pending.save(output)
+		}
+		data, _ = json.Marshal(result)
+	}
+	setUsageHeaders(w, rec)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(data)
 }
 
 // streamResponsesPassthrough forwards Responses SSE events, applying stream
-// ID synchronization to fix @ai-sdk/openai crashes.
-func streamResponsesPassthrough(w http.ResponseWriter, resp *http.Response) {
+// ID synchronization to fix @ai-sdk/openai crashes. Usage from the terminal
+// event is captured into rec. If the upstream stream ends without a
+// terminal event, a response.failed event is synthesized so clients don't
+// hang. With a pending response, response IDs are replaced with the proxy's
+// own and the conversation is stored once the stream completes.
+func streamResponsesPassthrough(ctx context.Context, w http.ResponseWriter, resp *http.Response, pending *pendingResponse, rec *state.RequestRecord) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
@@ -121,19 +201,154 @@ func streamResponsesPassthrough(w http.ResponseWriter, resp *http.Response) {
 	w.Header().Set("Connection", "keep-alive")
 	w.WriteHeader(http.StatusOK)
 
+	resp.Body = recordFixture(ctx, resp.Body, FixtureResponsesPassthrough, rec.Model)
+	defer resp.Body.Close() // saves the recording; the caller's close is of the original body
 	sync := NewStreamIDSync()
+	var outputItems []any // output_item.done items, in case completed has none
+	tracker := &responsesStreamTracker{}
 
-	readSSE(resp.Body, func(eventType, data string) error {
+	err := readSSE(ctx, resp.Body, func(eventType, data string) error {
 		// Apply stream ID synchronization
 		data = sync.Process(eventType, data)
+		if pending != nil {
+			data = storeStreamEvent(pending, eventType, data, &outputItems)
+		}
+		tracker.observe(eventType, data, rec)
 
 		if eventType != "" {
 			io.WriteString(w, "event: "+eventType+"\n")
 		}
-		io.WriteString(w, "data: "+data+"\n\n")
+		if _, err := io.WriteString(w, "data: "+data+"\n\n"); err != nil {
+			return err
+		}
 		flusher.Flush()
 		return nil
 	})
+
+	if tracker.terminal {
+		return
+	}
+	if errors.Is(err, errClientDisconnected) {
+		rec.Error = err.Error()
+		return
+	}
+	msg := "upstream stream ended without a terminal event"
+	if err != nil {
+		msg = "upstream stream error: " + err.Error()
+	}
+	slog.Error("responses passthrough stream incomplete", "error", msg)
+	rec.Error = msg
+	writeSSE(w, flusher, "response.failed", tracker.failedEvent(msg))
+}
+
+// responsesStreamTracker follows a passthrough Responses stream: the latest
+// response object, sequence number, and whether a terminal event arrived.
+type responsesStreamTracker struct {
+	response map[string]any
+	sequence float64
+	terminal bool
+}
+
+// observe updates the tracker from one event and captures usage and errors
+// from terminal events into rec.
+func (t *responsesStreamTracker) observe(eventType, data string, rec *state.RequestRecord) {
+	var evt struct {
+		SequenceNumber *float64       `json:"sequence_number"`
+		Response       map[string]any `json:"response"`
+	}
+	if json.Unmarshal([]byte(data), &evt) != nil {
+		return
+	}
+	if evt.SequenceNumber != nil {
+		t.sequence = *evt.SequenceNumber
+	}
+	if evt.Response != nil {
+		t.response = evt.Response
+	}
+
+	switch eventType {
+	case "response.completed", "response.incomplete", "response.failed":
+		t.terminal = true
+	default:
+		return
+	}
+
+	var terminal struct {
+		Response struct {
+			Usage *ResponsesUsage `json:"usage"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"response"`
+	}
+	if json.Unmarshal([]byte(data), &terminal) != nil {
+		return
+	}
+	if u := terminal.Response.Usage; u != nil {
+		cached := 0
+		if u.InputTokensDetails != nil {
+			cached = u.InputTokensDetails.CachedTokens
+		}
+		rec.InputTokens = int64(u.InputTokens - cached)
+		rec.CachedTokens = int64(cached)
+		rec.OutputTokens = int64(u.OutputTokens)
+	}
+	if e := terminal.Response.Error; e != nil && e.Message != "" {
+		rec.Error = e.Message
+	}
+}
+
+// failedEvent builds a response.failed event from the last response object
+// seen on the stream.
+func (t *responsesStreamTracker) failedEvent(message string) map[string]any {
+	response := make(map[string]any, len(t.response)+2)
+	for k, v := range t.response {
+		response[k] = v
+	}
+	if _, ok := response["object"]; !ok {
+		response["object"] = "response"
+	}
+	response["status"] = "failed"
+	response["error"] = map[string]any{"code": "server_error", "message": message}
+	return map[string]any{
+		"type":            "response.failed",
+		"sequence_number": t.sequence + 1,
+		"response":        response,
+	}
+}
+
+// storeStreamEvent rewrites the response ID in events that carry the
+// response object and stores the conversation on response.completed.
+func storeStreamEvent(pending *pendingResponse, eventType, data string, outputItems *[]any) string {
+	var evt map[string]any
+	if json.Unmarshal([]byte(data), &evt) != nil {
+		return data
+	}
+	switch eventType {
+	case "response.output_item.done":
+		if item, ok := evt["item"]; ok {
+			*outputItems = append(*outputItems, item)
+		}
+		return data
+	}
+
+	response, ok := evt["response"].(map[string]any)
+	if !ok {
+		return data
+	}
+	pending.patchID(response)
+	if eventType == "response.completed" {
+		output, _ := response["output"].([]any)
+		if len(output) == 0 {
+			output = *outputItems
+		}
+		pending.save(output)
+	}
+	patched, err := json.Marshal(evt)
+	if err != nil {
+		return data
+	}
+	return string(patched)
 }
 
 // convertApplyPatchTools converts apply_patch custom tools to function tools.
@@ -207,9 +422,10 @@ func containsImageRecursive(items []any) bool {
 		if t, _ := m["type"].(string); t == "input_image" {
 			return true
 		}
-		// Check nested content
-		if content, ok := m["content"].([]any); ok {
-			if containsImageRecursive(content) {
+		// Check nested content, and function_call_output items whose
+		// output is an array (e.g. a screenshot tool's result)
+		for _, key := range []string{"content", "output"} {
+			if nested, ok := m[key].([]any); ok && containsImageRecursive(nested) {
 				return true
 			}
 		}
@@ -217,16 +433,27 @@ func containsImageRecursive(items []any) bool {
 	return false
 }
 
-// detectAgentInResponses checks the last input item's role.
+// detectAgentInResponses decides the initiator from the last message of the
+// input, like isInitiatorAgent. Tool calls, their outputs and reasoning
+// items (function_call, function_call_output, reasoning and the like) are
+// skipped; the message before them decides by its role. Input without a
+// message is the user's.
 func detectAgentInResponses(payload map[string]any) bool {
 	input, ok := payload["input"].([]any)
-	if !ok || len(input) == 0 {
-		return false
-	}
-	last, ok := input[len(input)-1].(map[string]any)
 	if !ok {
 		return false
 	}
-	role, _ := last["role"].(string)
-	return role == "assistant" || role == ""
+	for i := len(input) - 1; i >= 0; i-- {
+		item, ok := input[i].(map[string]any)
+		if !ok {
+			continue
+		}
+		if itemType, _ := item["type"].(string); itemType != "message" && itemType != "" {
+			continue
+		}
+		if role, ok := item["role"].(string); ok {
+			return role == "assistant"
+		}
+	}
+	return false
 }
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// buildResponsesInstructions turns a /v1/messages system prompt and the
+// model's extra prompt into Responses API instructions, ordered per
+// responsesInstructions.order.
+func buildResponsesInstructions(ctx context.Context, raw json.RawMessage, extraPrompt string) string {
+	cfg := config.FromContext(ctx)
+	texts := systemBlockTexts(raw)
+	var instructions string
+	var pieces []string // in the order they appear in instructions
+	if cfg.ResponsesInstructionsOrder() == config.InstructionsOrderCache {
+		instructions = cacheOrderedInstructions(texts, extraPrompt)
+		pieces = append(texts, extraPrompt)
+	} else {
+		instructions = parseSystemPromptForResponses(raw, extraPrompt)
+		pieces = append([]string{extraPrompt}, texts...)
+		if len(texts) > 0 {
+			pieces[0], pieces[1] = texts[0], extraPrompt
+		}
+	}
+	if cfg.ResponsesInstructions.LogHashes {
+		logInstructionBoundaries(ctx, instructions, pieces)
+	}
+	return instructions
+}
+
+// cacheOrderedInstructions joins the system blocks in request order and
+// appends the extra prompt last, so the instructions start with the
+// client's system text exactly as sent. Upstream prompt caching matches on
+// the longest identical prefix.
+func cacheOrderedInstructions(texts []string, extraPrompt string) string {
+	var parts []string
+	for _, t := range texts {
+		if t != "" {
+			parts = append(parts, t)
+		}
+	}
+	instructions := strings.Join(parts, " ")
+	if extraPrompt != "" {
+		if instructions != "" {
+			instructions += "\n\n"
+		}
+		instructions += extraPrompt
+	}
+	return instructions
+}
+
+// systemBlockTexts returns the text of each system block; a string system
+// prompt is one block.
+func systemBlockTexts(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return []string{s}
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &blocks) != nil {
+		return nil
+	}
+	var texts []string
+	for _, b := range blocks {
+		if b.Type == "text" {
+			texts = append(texts, b.Text)
+		}
+	}
+	return texts
+}
+
+// logInstructionBoundaries logs where each piece ends in instructions with
+// a hash of the instructions up to that point. A boundary whose hash stays
+// the same across requests marks a prefix upstream caching can reuse;
+// compare with cached_tokens in /api/stats.
+func logInstructionBoundaries(ctx context.Context, instructions string, pieces []string) {
+	var boundaries []string
+	offset := 0
+	for _, piece := range pieces {
+		if piece == "" {
+			continue
+		}
+		i := strings.Index(instructions[offset:], piece)
+		if i < 0 {
+			continue
+		}
+		offset += i + len(piece)
+		sum := sha256.Sum256([]byte(instructions[:offset]))
+		boundaries = append(boundaries, fmt.Sprintf("%d:%s", offset, hex.EncodeToString(sum[:6])))
+	}
+	slog.Info("responses instructions", "order", config.FromContext(ctx).ResponsesInstructionsOrder(), "length", len(instructions), "boundaries", strings.Join(boundaries, " "))
+}
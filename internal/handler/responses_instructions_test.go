@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+func TestBuildResponsesInstructions(t *testing.T) {
+	const (
+		boilerplate = "You are Claude Code."
+		claudeMD    = "Contents of CLAUDE.md: use tabs."
+		extra       = "\n\nAlways answer briefly."
+	)
+	blocks := `[{"type":"text","text":"` + boilerplate + `"},{"type":"text","text":"` + claudeMD + `"}]`
+	tests := []struct {
+		name          string
+		system        string
+		extra         string
+		legacy, cache string
+	}{
+		{"blocks", blocks, extra, boilerplate + extra + " " + claudeMD, boilerplate + " " + claudeMD + "\n\n" + extra},
+		{"blocks, no extra prompt", blocks, "", boilerplate + " " + claudeMD, boilerplate + " " + claudeMD},
+		{"string", `"` + boilerplate + `"`, extra, boilerplate + extra, boilerplate + "\n\n" + extra},
+		{"no system", ``, extra, extra, extra},
+		{"non-text block skipped", `[{"type":"text","text":"` + boilerplate + `"},{"type":"image"},{"type":"text","text":"` + claudeMD + `"}]`, "", boilerplate + " " + claudeMD, boilerplate + " " + claudeMD},
+	}
+	for _, tt := range tests {
+		for order, want := range map[string]string{config.InstructionsOrderLegacy: tt.legacy, config.InstructionsOrderCache: tt.cache} {
+			useConfig(t, func(c *config.Config) { c.ResponsesInstructions.Order = order })
+			var raw json.RawMessage
+			if tt.system != "" {
+				raw = json.RawMessage(tt.system)
+			}
+			if got := buildResponsesInstructions(testContext(context.Background()), raw, tt.extra); got != want {
+				t.Errorf("%s, %s order:\n got %q\nwant %q", tt.name, order, got, want)
+			}
+		}
+	}
+}
+
+// TestCacheOrderKeepsPrefix checks what the cache ordering is for: requests
+// differing only in their later system blocks share the first block as an
+// instruction prefix, even with an extra prompt configured.
+func TestCacheOrderKeepsPrefix(t *testing.T) {
+	useConfig(t, func(c *config.Config) { c.ResponsesInstructions.Order = config.InstructionsOrderCache })
+	a := buildResponsesInstructions(testContext(context.Background()), json.RawMessage(`[{"type":"text","text":"stable"},{"type":"text","text":"session one"}]`), "extra")
+	b := buildResponsesInstructions(testContext(context.Background()), json.RawMessage(`[{"type":"text","text":"stable"},{"type":"text","text":"session two"}]`), "extra")
+	if !strings.HasPrefix(a, "stable session ") || !strings.HasPrefix(b, "stable session ") {
+		t.Errorf("instructions %q and %q don't share the stable prefix", a, b)
+	}
+}
+
+func TestInstructionBoundariesLogged(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	tests := []struct {
+		order   string
+		offsets []string
+	}{
+		// "stable" ends at 6, " dynamic" at 14, "\n\nextra" at 21
+		{config.InstructionsOrderCache, []string{"6", "14", "21"}},
+		// "stable" + "extra" at 11, " dynamic" at 19
+		{config.InstructionsOrderLegacy, []string{"6", "11", "19"}},
+	}
+	boundaryRe := regexp.MustCompile(`(\d+):[0-9a-f]{12}`)
+	for _, tt := range tests {
+		useConfig(t, func(c *config.Config) {
+			c.ResponsesInstructions = config.ResponsesInstructionsConfig{Order: tt.order, LogHashes: true}
+		})
+		logs.Reset()
+		buildResponsesInstructions(testContext(context.Background()), json.RawMessage(`[{"type":"text","text":"stable"},{"type":"text","text":"dynamic"}]`), "extra")
+		var offsets []string
+		for _, m := range boundaryRe.FindAllStringSubmatch(logs.String(), -1) {
+			offsets = append(offsets, m[1])
+		}
+		if strings.Join(offsets, " ") != strings.Join(tt.offsets, " ") {
+			t.Errorf("%s: logged boundaries at %v, want %v: %s", tt.order, offsets, tt.offsets, logs.String())
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Input items as Codex CLI sends them.
+const (
+	codexDeveloper = `{"type":"message","role":"developer","content":[{"type":"input_text","text":"<permissions instructions>"}]}`
+	codexUser      = `{"type":"message","role":"user","content":[{"type":"input_text","text":"fix the failing test"}]}`
+	codexReasoning = `{"type":"reasoning","id":"rs_1","summary":[{"type":"summary_text","text":"Run the tests first."}],"encrypted_content":"gAAAA"}`
+	codexShell     = `{"type":"function_call","name":"shell","arguments":"{\"command\":[\"go\",\"test\",\"./...\"]}","call_id":"call_1"}`
+	codexShellOut  = `{"type":"function_call_output","call_id":"call_1","output":"{\"output\":\"ok\",\"metadata\":{\"exit_code\":0}}"}`
+	codexPatch     = `{"type":"custom_tool_call","name":"apply_patch","input":"*** Begin Patch\n*** End Patch","call_id":"call_2"}`
+	codexPatchOut  = `{"type":"custom_tool_call_output","call_id":"call_2","output":"Success."}`
+	codexAnswer    = `{"type":"message","role":"assistant","content":[{"type":"output_text","text":"The test passes now."}]}`
+)
+
+func TestDetectAgentInResponses(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		agent bool
+	}{
+		{"string input", `"hello"`, false},
+		{"first turn", `[` + codexDeveloper + `,` + codexUser + `]`, false},
+		{"shell result", `[` + codexDeveloper + `,` + codexUser + `,` + codexReasoning + `,` + codexShell + `,` + codexShellOut + `]`, false},
+		{"patch result", `[` + codexUser + `,` + codexReasoning + `,` + codexPatch + `,` + codexPatchOut + `]`, false},
+		{"parallel results", `[` + codexUser + `,` + codexShell + `,` + codexPatch + `,` + codexShellOut + `,` + codexPatchOut + `]`, false},
+		{"follow-up after an answer", `[` + codexUser + `,` + codexShell + `,` + codexShellOut + `,` + codexAnswer + `,` + codexUser + `]`, false},
+		{"ends on the assistant's answer", `[` + codexUser + `,` + codexAnswer + `]`, true},
+		{"message without a type", `[` + codexAnswer + `,{"role":"user","content":"and now?"}]`, false},
+		{"tool calls after the answer", `[` + codexUser + `,` + codexAnswer + `,` + codexReasoning + `,` + codexShell + `,` + codexShellOut + `]`, true},
+		{"only tool outputs", `[` + codexShellOut + `]`, false},
+		{"empty", `[]`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload map[string]any
+			if err := json.Unmarshal([]byte(`{"input":`+tt.input+`}`), &payload); err != nil {
+				t.Fatal(err)
+			}
+			if got := detectAgentInResponses(payload); got != tt.agent {
+				t.Errorf("detectAgentInResponses = %v, want %v", got, tt.agent)
+			}
+
+			fake := &servicetest.Fake{}
+			fake.Script(servicetest.Responses, servicetest.JSON(`{"id":"resp_1","object":"response","status":"completed","output":[]}`))
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: "gpt-5-codex", SupportedEndpoints: []string{"/responses"}})
+			w := httptest.NewRecorder()
+			Responses(w, newRequest("POST", "/responses", `{"model":"gpt-5-codex","input":`+tt.input+`}`))
+			if calls := fake.Calls(); len(calls) != 1 || calls[0].IsAgent != tt.agent {
+				t.Errorf("upstream calls %+v, want one with agent initiator %v: %s", calls, tt.agent, w.Body)
+			}
+		})
+	}
+}
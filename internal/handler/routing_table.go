@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// ModelRoute is one row of the routing table: how /v1/messages would
+// serve a model and the config that applies to it.
+type ModelRoute struct {
+	ID                 string   `json:"id"`
+	ContextWindow      int      `json:"context_window"`
+	MaxOutputTokens    int      `json:"max_output_tokens"`
+	SupportedEndpoints []string `json:"supported_endpoints"`
+	// Backend is messages, responses or chat_completions, as chosen with
+	// no X-Backend override and no failover; empty for embedding models.
+	Backend         string `json:"backend"`
+	ReasoningEffort string `json:"reasoning_effort"` // modelReasoningEfforts, or the default
+	ExtraPrompt     bool   `json:"extra_prompt"`     // an extraPrompts entry is set (unused on the messages backend)
+	SmallModel      bool   `json:"small_model"`      // the effective smallModel
+}
+
+// RoutingTable returns the route of each of models under the current
+// config, in order. It makes no requests, so it can run on any list.
+func RoutingTable(ctx context.Context, models []state.Model) []ModelRoute {
+	cfg := config.FromContext(ctx)
+	small := cfg.EffectiveSmallModel(state.FromContext(ctx))
+	routes := make([]ModelRoute, 0, len(models))
+	for i := range models {
+		m := &models[i]
+		route := ModelRoute{
+			ID:                 m.ID,
+			ContextWindow:      m.Capabilities.Limits.MaxContextWindowTokens,
+			MaxOutputTokens:    m.Capabilities.Limits.MaxOutputTokens,
+			SupportedEndpoints: m.SupportedEndpoints,
+			ReasoningEffort:    cfg.GetReasoningEffort(m.ID),
+			ExtraPrompt:        cfg.GetExtraPrompt(m.ID) != "",
+			SmallModel:         m.ID == small,
+		}
+		if route.SupportedEndpoints == nil {
+			route.SupportedEndpoints = []string{}
+		}
+		if m.Capabilities.Type != "embeddings" {
+			route.Backend = MessagesBackend(m)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
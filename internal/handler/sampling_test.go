@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// TestTranslatorsApplySamplingPolicy checks that both translators send
+// temperature and top_p as the model's sampling policy says.
+func TestTranslatorsApplySamplingPolicy(t *testing.T) {
+	useModels(t,
+		state.Model{ID: "o3", Capabilities: state.ModelCapabilities{Supports: state.ModelSupports{ReasoningEffort: []string{"high"}}}},
+		state.Model{ID: "gpt-4.1"},
+	)
+	tests := []struct {
+		name     string
+		model    string
+		policy   string // modelSamplingParams entry; empty for none
+		request  string
+		chat     string // temperature/top_p sent, "" for omitted
+		response string
+	}{
+		{"forward", "gpt-4.1", config.SamplingForward, `{"temperature":2.5,"top_p":1.2}`, "2.5/1.2", "2.5/1.2"},
+		{"clamp", "gpt-4.1", config.SamplingClamp, `{"temperature":2.5,"top_p":1.2}`, "2/1", "2/1"},
+		{"omit", "gpt-4.1", config.SamplingOmit, `{"temperature":0.5,"top_p":0.9}`, "/", "/"},
+		{"derived clamp", "gpt-4.1", "", `{"temperature":2.5}`, "2/", "2/"},
+		{"derived omit", "o3", "", `{"temperature":0.5,"top_p":0.9}`, "/", "/"},
+		{"unlisted", "my-finetune", "", `{"temperature":0.5,"top_p":0.9}`, "0.5/0.9", "/"},
+		// No longer forced to 1 on the Responses API
+		{"not sent", "gpt-4.1", "", `{}`, "/", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.ModelSamplingParams = nil
+				if tt.policy != "" {
+					c.ModelSamplingParams = map[string]string{tt.model: tt.policy}
+				}
+			})
+			var req AnthropicRequest
+			if err := json.Unmarshal([]byte(tt.request), &req); err != nil {
+				t.Fatal(err)
+			}
+			req.Model = tt.model
+			req.MaxTokens = 1024
+			req.Messages = []AnthropicMsg{{Role: "user", Content: json.RawMessage(`"hi"`)}}
+
+			chat, err := translateToOpenAI(testContext(context.Background()), &req, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := samplingParams(chat.Temperature, chat.TopP); got != tt.chat {
+				t.Errorf("chat completions: temperature/top_p = %q, want %q", got, tt.chat)
+			}
+			responses, err := translateToResponses(testContext(context.Background()), &req, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := samplingParams(responses.Temperature, responses.TopP); got != tt.response {
+				t.Errorf("responses: temperature/top_p = %q, want %q", got, tt.response)
+			}
+		})
+	}
+}
+
+func samplingParams(temperature, topP *float64) string {
+	s := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		data, _ := json.Marshal(*v)
+		return string(data)
+	}
+	return s(temperature) + "/" + s(topP)
+}
@@ -0,0 +1,356 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// supportedFormats are the string formats Copilot's schema validation accepts.
+var supportedFormats = map[string]bool{
+	"date-time": true, "date": true, "time": true, "duration": true,
+	"email": true, "hostname": true, "ipv4": true, "ipv6": true, "uuid": true,
+}
+
+// metaKeywords never affect validation and are always removed.
+var metaKeywords = []string{"$schema", "$id", "$comment", "$anchor", "examples"}
+
+// strictAllowed is the keyword whitelist used in strict mode; anything else
+// (if/then/else, not, patternProperties, ...) is removed.
+var strictAllowed = map[string]bool{
+	"type": true, "properties": true, "required": true, "items": true,
+	"enum": true, "const": true, "description": true, "title": true,
+	"default": true, "format": true, "anyOf": true, "additionalProperties": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"minLength": true, "maxLength": true, "pattern": true, "minItems": true, "maxItems": true,
+	"nullable": true,
+}
+
+// schemaSanitizer rewrites one tool's input schema, recording what changed.
+type schemaSanitizer struct {
+	strict   bool
+	defs     map[string]any
+	inlining map[string]bool // refs being inlined, to break cycles
+	changes  []string
+}
+
+// prepareToolParameters decodes a tool's input schema and sanitizes it for
+// Copilot according to the toolSchemaSanitization config. keep is false
+// when the tool should be dropped from the request (dropInvalidTools).
+func prepareToolParameters(ctx context.Context, t AnthropicTool) (params any, keep bool) {
+	cfg := config.FromContext(ctx)
+	if t.InputSchema == nil {
+		return nil, true
+	}
+	json.Unmarshal(t.InputSchema, &params)
+
+	mode := cfg.GetToolSchemaSanitization()
+	if mode == config.SchemaSanitizeOff {
+		return params, true
+	}
+
+	schema, ok := params.(map[string]any)
+	if !ok {
+		return params, true
+	}
+
+	sanitized, changes, err := sanitizeToolSchema(schema, mode == config.SchemaSanitizeStrict)
+	if err != nil {
+		if cfg.DropInvalidTools {
+			slog.Warn("dropping tool with unsupported input schema", "tool", t.Name, "error", err)
+			return nil, false
+		}
+		slog.Warn("tool input schema may be rejected upstream", "tool", t.Name, "error", err)
+	}
+	if len(changes) > 0 {
+		slog.Info("sanitized tool input schema", "tool", t.Name, "changes", strings.Join(changes, "; "))
+	}
+	return sanitized, true
+}
+
+// sanitizeToolSchema returns a copy of schema with constructs Copilot
+// rejects stripped or rewritten: $ref/$defs are inlined, unsupported string
+// formats and meta keywords removed, and a top-level oneOf/anyOf/allOf is
+// merged into a single object. An error means the result is still not a
+// usable object schema.
+func sanitizeToolSchema(schema map[string]any, strict bool) (map[string]any, []string, error) {
+	s := &schemaSanitizer{strict: strict, defs: make(map[string]any), inlining: make(map[string]bool)}
+	for _, key := range []string{"$defs", "definitions"} {
+		if defs, ok := schema[key].(map[string]any); ok {
+			for name, def := range defs {
+				s.defs["#/"+key+"/"+name] = def
+			}
+		}
+	}
+
+	out, _ := s.walk(schema, "").(map[string]any)
+	if out == nil {
+		return nil, s.changes, fmt.Errorf("schema is not an object")
+	}
+	for _, key := range []string{"$defs", "definitions"} {
+		if _, ok := out[key]; ok {
+			delete(out, key)
+			s.note("removed %s after inlining references", key)
+		}
+	}
+
+	out = s.flattenTopLevel(out)
+
+	if t, ok := out["type"]; ok && t != "object" {
+		return out, s.changes, fmt.Errorf("top-level type is %v, expected object", t)
+	}
+	if _, ok := out["type"]; !ok {
+		out["type"] = "object"
+		s.note("set top-level type to object")
+	}
+	if _, ok := out["properties"]; !ok {
+		out["properties"] = map[string]any{}
+	}
+	return out, s.changes, nil
+}
+
+func (s *schemaSanitizer) note(format string, args ...any) {
+	s.changes = append(s.changes, fmt.Sprintf(format, args...))
+}
+
+// walk returns a sanitized deep copy of node. path is used in change notes.
+func (s *schemaSanitizer) walk(node any, path string) any {
+	switch v := node.(type) {
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = s.walk(item, fmt.Sprintf("%s[%d]", path, i))
+		}
+		return out
+	case map[string]any:
+		return s.walkObject(v, path)
+	default:
+		return node
+	}
+}
+
+func (s *schemaSanitizer) walkObject(obj map[string]any, path string) any {
+	if ref, ok := obj["$ref"].(string); ok {
+		return s.inlineRef(obj, ref, path)
+	}
+
+	out := make(map[string]any, len(obj))
+	for _, k := range sortedMapKeys(obj) {
+		v := obj[k]
+		loc := joinPath(path, k)
+
+		switch {
+		case path == "" && (k == "$defs" || k == "definitions"):
+			// Inlined at each $ref and removed afterwards
+			out[k] = v
+			continue
+		case isMetaKeyword(k):
+			s.note("removed %s", loc)
+			continue
+		case k == "format":
+			if f, ok := v.(string); ok && !supportedFormats[f] {
+				s.note("removed unsupported format %q at %s", f, loc)
+				continue
+			}
+		case path == "" && isCombinator(k):
+			// Top-level combinators are merged by flattenTopLevel
+		case k == "oneOf":
+			// oneOf below the top level is accepted as anyOf
+			k = "anyOf"
+			s.note("rewrote %s to anyOf", loc)
+		case s.strict && !strictAllowed[k] && !isSchemaMap(k):
+			s.note("removed %s (strict)", loc)
+			continue
+		}
+
+		switch k {
+		case "properties", "$defs", "definitions", "patternProperties":
+			// Keys of these maps are names, not keywords
+			if m, ok := v.(map[string]any); ok {
+				props := make(map[string]any, len(m))
+				for _, name := range sortedMapKeys(m) {
+					props[name] = s.walk(m[name], joinPath(loc, name))
+				}
+				out[k] = props
+				continue
+			}
+		}
+		out[k] = s.walk(v, loc)
+	}
+	return out
+}
+
+// inlineRef replaces a local $ref with a copy of its definition. Sibling
+// keywords (e.g. description) are kept on top of the inlined schema. A ref
+// back into a definition that is already being inlined becomes an
+// unconstrained schema.
+func (s *schemaSanitizer) inlineRef(obj map[string]any, ref, path string) any {
+	def, ok := s.defs[ref]
+	if !ok || s.inlining[ref] {
+		reason := "unresolvable"
+		if ok {
+			reason = "recursive"
+		}
+		s.note("replaced %s $ref %q at %s with an unconstrained schema", reason, ref, pathOrRoot(path))
+		out := map[string]any{}
+		if d, ok := obj["description"]; ok {
+			out["description"] = d
+		}
+		return out
+	}
+
+	s.note("inlined $ref %q at %s", ref, pathOrRoot(path))
+	s.inlining[ref] = true
+	inlined, _ := s.walk(def, path).(map[string]any)
+	delete(s.inlining, ref)
+	if inlined == nil {
+		inlined = map[string]any{}
+	}
+	for _, k := range sortedMapKeys(obj) {
+		if k != "$ref" {
+			inlined[k] = s.walk(obj[k], joinPath(path, k))
+		}
+	}
+	return inlined
+}
+
+// flattenTopLevel merges a top-level oneOf/anyOf/allOf of object schemas
+// into one object. Only properties required by every variant (or by any
+// allOf member) stay required.
+func (s *schemaSanitizer) flattenTopLevel(schema map[string]any) map[string]any {
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		variants, ok := schema[key].([]any)
+		if !ok {
+			continue
+		}
+		delete(schema, key)
+
+		props, _ := schema["properties"].(map[string]any)
+		if props == nil {
+			props = make(map[string]any)
+		}
+		counts := make(map[string]int)
+		for _, variant := range variants {
+			vm, ok := variant.(map[string]any)
+			if !ok {
+				continue
+			}
+			if vp, ok := vm["properties"].(map[string]any); ok {
+				for name, sub := range vp {
+					props[name] = mergeVariantProperty(props[name], sub)
+				}
+			}
+			if r, ok := vm["required"].([]any); ok {
+				for _, n := range r {
+					if name, ok := n.(string); ok {
+						counts[name]++
+					}
+				}
+			}
+		}
+
+		// Keep the schema's own required list, plus variant-required names
+		// that hold for every possible input
+		var merged []any
+		seen := make(map[string]bool)
+		if r, ok := schema["required"].([]any); ok {
+			for _, n := range r {
+				if name, ok := n.(string); ok && !seen[name] {
+					merged = append(merged, name)
+					seen[name] = true
+				}
+			}
+		}
+		for _, name := range sortedIntKeys(counts) {
+			if !seen[name] && (key == "allOf" || counts[name] == len(variants)) {
+				merged = append(merged, name)
+				seen[name] = true
+			}
+		}
+
+		schema["type"] = "object"
+		schema["properties"] = props
+		if len(merged) > 0 {
+			schema["required"] = merged
+		} else {
+			delete(schema, "required")
+		}
+		s.note("merged top-level %s (%d variants) into one object", key, len(variants))
+	}
+	return schema
+}
+
+func isMetaKeyword(k string) bool {
+	for _, m := range metaKeywords {
+		if k == m {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeVariantProperty combines a property's definitions from several
+// variants. Differing definitions are kept as alternatives under anyOf.
+func mergeVariantProperty(existing, sub any) any {
+	if existing == nil || reflect.DeepEqual(existing, sub) {
+		return sub
+	}
+	if m, ok := existing.(map[string]any); ok && len(m) == 1 {
+		if alts, ok := m["anyOf"].([]any); ok {
+			for _, alt := range alts {
+				if reflect.DeepEqual(alt, sub) {
+					return existing
+				}
+			}
+			return map[string]any{"anyOf": append(alts, sub)}
+		}
+	}
+	return map[string]any{"anyOf": []any{existing, sub}}
+}
+
+func isCombinator(k string) bool {
+	return k == "allOf" || k == "anyOf" || k == "oneOf"
+}
+
+// isSchemaMap reports keywords whose values are maps of named subschemas.
+func isSchemaMap(k string) bool {
+	return k == "properties" || k == "$defs" || k == "definitions"
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "(root)"
+	}
+	return path
+}
+
+func sortedMapKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedIntKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
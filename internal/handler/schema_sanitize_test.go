@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// Tool schemas in testdata/schemas are MCP tool input schemas of the kinds
+// Copilot rejects. Each directory holds input.json and, per strictness
+// level, the sanitized schema with its change notes as expected-<level>.json.
+
+type sanitizedFixture struct {
+	Schema  map[string]any `json:"schema,omitempty"`
+	Changes []string       `json:"changes"`
+	Error   string         `json:"error,omitempty"`
+}
+
+func loadSchemaFixture(t *testing.T, dir string) map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "input.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestSanitizeToolSchema(t *testing.T) {
+	dirs, err := filepath.Glob("testdata/schemas/*")
+	if err != nil || len(dirs) == 0 {
+		t.Fatalf("no schema fixtures: %v", err)
+	}
+	for _, dir := range dirs {
+		for _, level := range []string{config.SchemaSanitizeStandard, config.SchemaSanitizeStrict} {
+			t.Run(filepath.Base(dir)+"/"+level, func(t *testing.T) {
+				out, changes, err := sanitizeToolSchema(loadSchemaFixture(t, dir), level == config.SchemaSanitizeStrict)
+				res := sanitizedFixture{Changes: changes}
+				if err != nil {
+					res.Error = err.Error()
+				} else {
+					res.Schema = out
+					for _, problem := range schemaProblems(out, level == config.SchemaSanitizeStrict) {
+						t.Errorf("sanitized schema still has %s", problem)
+					}
+				}
+
+				got, _ := json.MarshalIndent(res, "", "  ")
+				got = append(got, '\n')
+				path := filepath.Join(dir, "expected-"+level+".json")
+				if *update {
+					if err := os.WriteFile(path, got, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := diffFixture(want, got); diff != "" {
+					t.Errorf("differs from %s, %s", filepath.Base(path), diff)
+				}
+			})
+		}
+	}
+}
+
+// schemaProblems lists the constructs Copilot rejects that remain in a
+// sanitized schema.
+func schemaProblems(schema map[string]any, strict bool) []string {
+	var problems []string
+	for _, k := range []string{"allOf", "anyOf", "oneOf"} {
+		if _, ok := schema[k]; ok {
+			problems = append(problems, "top-level "+k)
+		}
+	}
+	if schema["type"] != "object" {
+		problems = append(problems, "a top-level type other than object")
+	}
+	var walk func(node any, path string, names bool)
+	walk = func(node any, path string, names bool) {
+		switch v := node.(type) {
+		case []any:
+			for _, item := range v {
+				walk(item, path, false)
+			}
+		case map[string]any:
+			for k, sub := range v {
+				loc := joinPath(path, k)
+				if names {
+					walk(sub, loc, false)
+					continue
+				}
+				switch {
+				case k == "$ref" || k == "$defs" || k == "definitions" || k == "oneOf" || isMetaKeyword(k):
+					problems = append(problems, loc)
+				case k == "format" && !supportedFormats[sub.(string)]:
+					problems = append(problems, loc+" "+sub.(string))
+				case strict && !strictAllowed[k] && !isSchemaMap(k):
+					problems = append(problems, loc+" (strict)")
+				}
+				walk(sub, loc, k == "properties" || k == "patternProperties")
+			}
+		}
+	}
+	walk(schema, "", false)
+	return problems
+}
+
+func TestPrepareToolParameters(t *testing.T) {
+	github := loadSchemaFixture(t, "testdata/schemas/github-create-issue")
+	jira := loadSchemaFixture(t, "testdata/schemas/jira-bulk-import")
+	tests := []struct {
+		level     string
+		drop      bool
+		schema    map[string]any
+		keep      bool
+		unchanged bool
+	}{
+		{level: config.SchemaSanitizeOff, schema: github, keep: true, unchanged: true},
+		{level: config.SchemaSanitizeOff, drop: true, schema: jira, keep: true, unchanged: true},
+		{level: config.SchemaSanitizeStandard, schema: github, keep: true},
+		{level: config.SchemaSanitizeStrict, schema: github, keep: true},
+		// A schema that can't be fixed is sent as it is, or dropped
+		{level: config.SchemaSanitizeStandard, schema: jira, keep: true, unchanged: true},
+		{level: config.SchemaSanitizeStandard, drop: true, schema: jira, keep: false},
+		{level: config.SchemaSanitizeStrict, drop: true, schema: jira, keep: false},
+		{level: config.SchemaSanitizeStrict, drop: true, schema: github, keep: true},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *config.Config) {
+			c.ToolSchemaSanitization = tt.level
+			c.DropInvalidTools = tt.drop
+		})
+		raw, _ := json.Marshal(tt.schema)
+		params, keep := prepareToolParameters(testContext(context.Background()), AnthropicTool{Name: "tool", InputSchema: raw})
+		name := tt.level + map[bool]string{true: "+drop"}[tt.drop]
+		if keep != tt.keep {
+			t.Errorf("%s, %v: keep = %v, want %v", name, tt.schema["type"], keep, tt.keep)
+		}
+		if !keep {
+			continue
+		}
+		if unchanged := reflect.DeepEqual(params, tt.schema); unchanged != tt.unchanged {
+			t.Errorf("%s, %v: params unchanged = %v, want %v", name, tt.schema["type"], unchanged, tt.unchanged)
+		}
+		if strings.Contains(string(raw), "$defs") && !tt.unchanged {
+			out, _ := json.Marshal(params)
+			if strings.Contains(string(out), "$ref") {
+				t.Errorf("%s: $ref left in %s", name, out)
+			}
+		}
+	}
+}
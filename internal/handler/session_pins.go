@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Session pins outlive idle sessions by sessionPinIdleTTL; at most
+// maxSessionPins are kept, dropping the least recently used.
+const (
+	sessionPinIdleTTL = 24 * time.Hour
+	maxSessionPins    = 1000
+)
+
+// sessionPin is the model a Claude Code session (API key and
+// metadata.user_id) is on, as listed in /api/stats.
+type sessionPin struct {
+	ID       string    `json:"id"`
+	UserID   string    `json:"user_id"`
+	Model    string    `json:"model"`
+	Backend  string    `json:"backend"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	// Switches counts requests for another model that were handled
+	// (stripped or rerouted).
+	Switches int `json:"switches"`
+}
+
+// sessionPinStore holds the session pins of one proxy instance, whose
+// models state has.
+type sessionPinStore struct {
+	state *state.State
+	mu    sync.Mutex
+	pins  map[string]*sessionPin
+}
+
+func newSessionPinStore(st *state.State) *sessionPinStore {
+	return &sessionPinStore{state: st, pins: make(map[string]*sessionPin)}
+}
+
+// sessionPinID identifies a session without exposing its API key.
+func sessionPinID(apiKey, userID string) string {
+	sum := sha256.Sum256([]byte(apiKey + "\x00" + userID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// list returns the live pins, most recently used first.
+func (s *sessionPinStore) list() []sessionPin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked(time.Now())
+	out := make([]sessionPin, 0, len(s.pins))
+	for _, p := range s.pins {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastUsed.After(out[j].LastUsed) })
+	return out
+}
+
+// reset drops every pin.
+func (s *sessionPinStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pins = make(map[string]*sessionPin)
+}
+
+func (s *sessionPinStore) release(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pins[id]
+	delete(s.pins, id)
+	return ok
+}
+
+func (s *sessionPinStore) expireLocked(now time.Time) {
+	for id, p := range s.pins {
+		if now.Sub(p.LastUsed) > sessionPinIdleTTL {
+			delete(s.pins, id)
+		}
+	}
+}
+
+// resolve returns the model a request for model should use and whether
+// its thinking blocks must be stripped. The first request of a session
+// pins its model. A later request for another model is a switch only if
+// it carries signed thinking from earlier turns (Claude Code's background
+// requests use the small model with no such history, and pass through):
+// in "pin" mode it is routed to the pinned model, in "strip" mode the
+// session moves to the new model.
+func (s *sessionPinStore) resolve(mode, id, userID, model string, signed bool) (routed string, strip bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	p, ok := s.pins[id]
+	if !ok {
+		s.expireLocked(now)
+		if len(s.pins) >= maxSessionPins {
+			s.evictOldestLocked()
+		}
+		s.pins[id] = &sessionPin{
+			ID:       id,
+			UserID:   userID,
+			Model:    model,
+			Backend:  selectBackend(s.state.FindModel(model)),
+			Created:  now,
+			LastUsed: now,
+		}
+		return model, false
+	}
+	p.LastUsed = now
+	if model == p.Model || !signed {
+		return model, false
+	}
+
+	p.Switches++
+	if mode == config.SessionPinningPin {
+		return p.Model, false
+	}
+	p.Model = model
+	p.Backend = selectBackend(s.state.FindModel(model))
+	return model, true
+}
+
+func (s *sessionPinStore) evictOldestLocked() {
+	var oldest *sessionPin
+	for _, p := range s.pins {
+		if oldest == nil || p.LastUsed.Before(oldest.LastUsed) {
+			oldest = p
+		}
+	}
+	if oldest != nil {
+		delete(s.pins, oldest.ID)
+	}
+}
+
+// applySessionPin handles a model change within a session according to
+// sessionPinning: thinking signatures are bound to the model that produced
+// them, so carrying them to another model fails with a 400. It reroutes
+// req to the pinned model (X-Model-Pinned) or strips the thinking blocks
+// (X-Thinking-Stripped), returning the body to forward.
+func applySessionPin(w http.ResponseWriter, r *http.Request, req *AnthropicRequest, body []byte) []byte {
+	mode := config.FromContext(r.Context()).GetSessionPinning()
+	if mode == config.SessionPinningOff || req.Metadata == nil || req.Metadata.UserID == "" {
+		return body
+	}
+	userID := req.Metadata.UserID
+	id := sessionPinID(middleware.APIKeyFromContext(r.Context()), userID)
+	routed, strip := cachesOf(r.Context()).pins.resolve(mode, id, userID, req.Model, hasSignedThinking(req.Messages))
+
+	if routed != req.Model {
+		slog.Warn("session pinned, rerouting model change", "session", id, "requested", req.Model, "pinned", routed)
+		w.Header().Set("X-Model-Pinned", routed)
+		req.Model = routed
+	}
+	if strip {
+		n := stripThinkingBlocks(req.Messages)
+		slog.Warn("session changed model, stripped thinking blocks", "session", id, "model", req.Model, "blocks", n)
+		w.Header().Set("X-Thinking-Stripped", strconv.Itoa(n))
+		body = replaceMessages(body, req.Messages)
+	}
+	return body
+}
+
+// hasSignedThinking reports whether an assistant turn holds a signed
+// thinking or redacted_thinking block.
+func hasSignedThinking(msgs []AnthropicMsg) bool {
+	for _, m := range msgs {
+		if m.Role != "assistant" {
+			continue
+		}
+		for _, b := range ParseMessageContent(m.Content) {
+			if b.Type == "redacted_thinking" || b.Type == "thinking" && b.Signature != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripThinkingBlocks drops thinking and redacted_thinking blocks from
+// assistant turns, returning how many were dropped. A turn left empty
+// keeps an empty text block, as filterThinkingBlocksInMap does.
+func stripThinkingBlocks(msgs []AnthropicMsg) int {
+	n := 0
+	for i := range msgs {
+		if msgs[i].Role != "assistant" {
+			continue
+		}
+		blocks := ParseMessageContent(msgs[i].Content)
+		kept := make([]ContentBlock, 0, len(blocks))
+		for _, b := range blocks {
+			if b.Type == "thinking" || b.Type == "redacted_thinking" {
+				n++
+				continue
+			}
+			kept = append(kept, b)
+		}
+		if len(kept) == len(blocks) {
+			continue
+		}
+		if len(kept) == 0 {
+			kept = []ContentBlock{{Type: "text", Text: ""}}
+		}
+		if data, err := json.Marshal(kept); err == nil {
+			msgs[i].Content = data
+		}
+	}
+	return n
+}
+
+// sessionPinRelease is the response of DELETE /api/sessions/{id}/pin.
+type sessionPinRelease struct {
+	ID       string `json:"id"`
+	Released bool   `json:"released"`
+}
+
+// ReleaseSessionPin handles DELETE /api/sessions/{id}/pin — forgets a
+// session's pin, so its next request pins the model it asks for.
+func ReleaseSessionPin(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !cachesOf(r.Context()).pins.release(id) {
+		api.ForwardError(w, &api.HTTPError{
+			Message:    "no pin for session " + id,
+			StatusCode: http.StatusNotFound,
+		})
+		return
+	}
+	slog.Info("session pin released", "session", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionPinRelease{ID: id, Released: true})
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Upstream rejections of reasoning from another model. Thinking signatures
+// and encrypted reasoning are bound to the model (family) that produced
+// them; a conversation that switched models, or was replayed against
+// another backend, fails with a 400 such as
+//
+//	{"type":"error","error":{"type":"invalid_request_error","message":"messages.1.content.0: Invalid `signature` in `thinking` block"}}
+//	{"error":{"message":"The encrypted content for item rs_... could not be verified.","code":"invalid_encrypted_content"}}
+//
+// Both are recovered by retrying once without the reasoning.
+
+// isThinkingSignatureError reports whether err is the native Messages
+// backend rejecting a thinking block's signature.
+func isThinkingSignatureError(err error) bool {
+	body, ok := badRequestBody(err)
+	return ok && strings.Contains(body, "signature") && strings.Contains(body, "invalid")
+}
+
+// isEncryptedContentError reports whether err is the Responses backend
+// rejecting a reasoning item's encrypted_content.
+func isEncryptedContentError(err error) bool {
+	body, ok := badRequestBody(err)
+	return ok && (strings.Contains(body, "encrypted_content") || strings.Contains(body, "encrypted content"))
+}
+
+// badRequestBody returns the lowercased body of an upstream 400.
+func badRequestBody(err error) (string, bool) {
+	var httpErr *api.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+		return "", false
+	}
+	return strings.ToLower(httpErr.Body), true
+}
+
+// stripThinkingForRetry drops the thinking blocks of req after the
+// upstream rejected them with err, reporting whether there were any to
+// drop, i.e. whether a retry can succeed. Upstream errors arrive before
+// any byte is written, so streaming requests are retried as well.
+func stripThinkingForRetry(err error, req *AnthropicRequest, rec *state.RequestRecord) bool {
+	n := stripThinkingBlocks(req.Messages)
+	if n == 0 {
+		return false
+	}
+	slog.Warn("upstream rejected thinking from another model, retrying without it",
+		"backend", rec.Backend, "model", req.Model, "stripped", n, "error", err)
+	return true
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Upstream error bodies as captured.
+const (
+	nativeSignatureError  = `{"type":"error","error":{"type":"invalid_request_error","message":"messages.1.content.0: Invalid ` + "`signature`" + ` in ` + "`thinking`" + ` block"},"request_id":"req_011CTz"}`
+	responsesContentError = `{"error":{"message":"The encrypted content for item rs_68f2a1c0d4e88190 could not be verified.","type":"invalid_request_error","param":null,"code":"invalid_encrypted_content"}}`
+	nativeOtherError      = `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: 64000 > 32000, which is the maximum allowed number of output tokens for claude-sonnet-4"}}`
+)
+
+func TestSignatureErrorDetection(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		signature bool
+		encrypted bool
+	}{
+		{"native signature", 400, nativeSignatureError, true, false},
+		{"responses encrypted content", 400, responsesContentError, false, true},
+		{"other bad request", 400, nativeOtherError, false, false},
+		{"signature text on a 500", 500, nativeSignatureError, false, false},
+	}
+	for _, tt := range tests {
+		err := &api.HTTPError{Message: "upstream error", StatusCode: tt.status, Body: tt.body}
+		if got := isThinkingSignatureError(err); got != tt.signature {
+			t.Errorf("%s: isThinkingSignatureError = %v, want %v", tt.name, got, tt.signature)
+		}
+		if got := isEncryptedContentError(err); got != tt.encrypted {
+			t.Errorf("%s: isEncryptedContentError = %v, want %v", tt.name, got, tt.encrypted)
+		}
+	}
+}
+
+func TestRetryWithoutThinking(t *testing.T) {
+	const (
+		nativeOK    = `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4.5","content":[{"type":"text","text":"ok"}],"stop_reason":"end_turn","usage":{"input_tokens":5,"output_tokens":1}}`
+		responsesOK = `{"id":"resp_1","object":"response","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"ok"}]}]}`
+		nativeTurn  = `{"role":"assistant","content":[{"type":"thinking","thinking":"hm","signature":"EqoBCkgIBxABGAIiQL-other-model"},{"type":"text","text":"first"}]}`
+		reasonTurn  = `{"role":"assistant","content":[{"type":"thinking","thinking":"hm","signature":"gAAAAB-stale@rs_68f2a1c0d4e88190"},{"type":"text","text":"first"}]}`
+		plainTurn   = `{"role":"assistant","content":"first"}`
+	)
+	tests := []struct {
+		name     string
+		model    string
+		endpoint string
+		upstream string
+		turn     string
+		stream   bool
+		replies  []servicetest.Reply
+		status   int
+		calls    int
+	}{
+		{"native", "claude-sonnet-4.5", "/v1/messages", servicetest.Messages, nativeTurn, false,
+			[]servicetest.Reply{servicetest.Error(400, nativeSignatureError), servicetest.JSON(nativeOK)}, 200, 2},
+		{"native streaming", "claude-sonnet-4.5", "/v1/messages", servicetest.Messages, nativeTurn, true,
+			[]servicetest.Reply{servicetest.Error(400, nativeSignatureError), {Events: []servicetest.Event{
+				{Name: "message_start", Data: `{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4.5","content":[],"usage":{"input_tokens":5,"output_tokens":0}}}`},
+				{Name: "message_delta", Data: `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":1}}`},
+				{Name: "message_stop", Data: `{"type":"message_stop"}`},
+			}}}, 200, 2},
+		{"native, rejected again", "claude-sonnet-4.5", "/v1/messages", servicetest.Messages, nativeTurn, false,
+			[]servicetest.Reply{servicetest.Error(400, nativeSignatureError)}, 400, 2},
+		{"native, nothing to strip", "claude-sonnet-4.5", "/v1/messages", servicetest.Messages, plainTurn, false,
+			[]servicetest.Reply{servicetest.Error(400, nativeSignatureError)}, 400, 1},
+		{"native, other error", "claude-sonnet-4.5", "/v1/messages", servicetest.Messages, nativeTurn, false,
+			[]servicetest.Reply{servicetest.Error(400, nativeOtherError), servicetest.JSON(nativeOK)}, 400, 1},
+		{"responses", "gpt-5", "/responses", servicetest.Responses, reasonTurn, false,
+			[]servicetest.Reply{servicetest.Error(400, responsesContentError), servicetest.JSON(responsesOK)}, 200, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &servicetest.Fake{}
+			fake.Script(tt.upstream, tt.replies...)
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: tt.model, SupportedEndpoints: []string{tt.endpoint}})
+
+			stream := "false"
+			if tt.stream {
+				stream = "true"
+			}
+			w := httptest.NewRecorder()
+			Messages(w, newRequest("POST", "/v1/messages", `{"model":"`+tt.model+`","max_tokens":1024,"stream":`+stream+`,"thinking":{"type":"enabled","budget_tokens":512},"messages":[`+
+				`{"role":"user","content":"hi"},`+tt.turn+`,{"role":"user","content":"retry `+tt.name+`"}]}`))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			calls := fake.Calls()
+			if len(calls) != tt.calls {
+				t.Fatalf("%d upstream requests, want %d", len(calls), tt.calls)
+			}
+			if !strings.Contains(string(calls[0].Body), `"first"`) {
+				t.Errorf("first request lost the assistant text: %s", calls[0].Body)
+			}
+			if first := string(calls[0].Body); tt.turn != plainTurn && !strings.Contains(first, "other-model") && !strings.Contains(first, "gAAAAB-stale") {
+				t.Errorf("first request didn't carry the thinking: %s", first)
+			}
+			if tt.calls == 2 {
+				retry := string(calls[1].Body)
+				if strings.Contains(retry, "other-model") || strings.Contains(retry, "gAAAAB-stale") || strings.Contains(retry, `"type":"reasoning"`) {
+					t.Errorf("retry still carries the rejected thinking: %s", retry)
+				}
+				if !strings.Contains(retry, `"first"`) {
+					t.Errorf("retry lost the assistant text: %s", retry)
+				}
+			}
+		})
+	}
+}
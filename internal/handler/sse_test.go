@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// sseEvents returns the events readSSE dispatches for stream, as
+// "type|data" strings.
+func sseEvents(stream string) ([]string, error) {
+	var events []string
+	err := readSSE(testContext(context.Background()), strings.NewReader(stream), func(eventType, data string) error {
+		events = append(events, eventType+"|"+data)
+		return nil
+	})
+	return events, err
+}
+
+func TestReadSSE(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{"data only", "data: {\"a\":1}\n\ndata: {\"a\":2}\n\n", []string{`|{"a":1}`, `|{"a":2}`}},
+		{"named events", "event: response.created\ndata: {}\n\nevent: response.completed\ndata: {}\n\n", []string{"response.created|{}", "response.completed|{}"}},
+		{"multi-line data", "data: {\"a\":\ndata: 1}\n\n", []string{"|{\"a\":\n1}"}},
+		{"empty data line in the middle", "data: a\ndata:\ndata: b\n\n", []string{"|a\n\nb"}},
+		{"no space after the colon", "event:ping\ndata:{}\n\n", []string{"ping|{}"}},
+		{"only the first space is dropped", "data:  two spaces\n\n", []string{"| two spaces"}},
+		{"CRLF", "event: e\r\ndata: {}\r\n\r\ndata: x\r\n\r\n", []string{"e|{}", "|x"}},
+		{"comments", ": keep-alive\n\n: ping\ndata: {}\n: between\n\n", []string{"|{}"}},
+		{"id and retry ignored", "id: 7\nretry: 1000\ndata: {}\n\n", []string{"|{}"}},
+		{"unknown fields ignored", "foo: bar\ndata: {}\n\n", []string{"|{}"}},
+		{"event without data dropped", "event: ping\n\ndata: {}\n\n", []string{"|{}"}},
+		{"type doesn't leak into the next event", "event: a\ndata: 1\n\ndata: 2\n\n", []string{"a|1", "|2"}},
+		{"last event without a blank line", "data: 1\n\ndata: 2", []string{"|1", "|2"}},
+		{"last event ending in a newline only", "data: 1\n", []string{"|1"}},
+		{"DONE ends the stream", "data: 1\n\ndata: [DONE]\n\ndata: 2\n\n", []string{"|1"}},
+		{"several blank lines", "\n\n\ndata: 1\n\n\n\n", []string{"|1"}},
+		{"empty stream", "", nil},
+	}
+	for _, tt := range tests {
+		got, err := sseEvents(tt.stream)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadSSELargeEvents(t *testing.T) {
+	big := strings.Repeat("x", 3<<20) // well past bufio's buffer and the old 1 MB cap
+	tests := []struct {
+		name    string
+		limit   int
+		stream  string
+		want    int // length of the event's data
+		tooLong bool
+	}{
+		{"3 MB single line", 0, "data: " + big + "\n\ndata: next\n\n", len(big), false},
+		{"3 MB over many lines", 0, strings.Repeat("data: "+strings.Repeat("y", 1023)+"\n", 3<<10) + "\n", 3<<20 - 1, false},
+		{"over the configured limit", 1 << 20, "data: " + big + "\n\n", 0, true},
+		{"limit is per event", 1 << 20, strings.Repeat("data: "+strings.Repeat("z", 512<<10)+"\n\n", 4), 512 << 10, false},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *config.Config) { c.MaxSSEEventBytes = tt.limit })
+		var sizes []int
+		err := readSSE(testContext(context.Background()), strings.NewReader(tt.stream), func(_, data string) error {
+			sizes = append(sizes, len(data))
+			return nil
+		})
+		var tooLarge *sseEventTooLargeError
+		if errors.As(err, &tooLarge) != tt.tooLong {
+			t.Errorf("%s: error %v, want too large = %v", tt.name, err, tt.tooLong)
+			continue
+		}
+		if tt.tooLong {
+			if tooLarge.Limit != tt.limit {
+				t.Errorf("%s: error limit %d, want %d", tt.name, tooLarge.Limit, tt.limit)
+			}
+			continue
+		}
+		if err != nil || len(sizes) == 0 || sizes[0] != tt.want {
+			t.Errorf("%s: event sizes %v, err %v; want first %d", tt.name, sizes, err, tt.want)
+		}
+	}
+}
+
+func TestReadSSEHandlerError(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := readSSE(testContext(context.Background()), strings.NewReader("data: 1\n\ndata: 2\n\n"), func(_, _ string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("got %v after %d calls, want the handler's error after 1", err, calls)
+	}
+}
@@ -1,23 +1,46 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/buildinfo"
 	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
 // statsResponse is the JSON response for GET /api/stats.
 type statsResponse struct {
+	Build         buildinfo.Info     `json:"build"`
+	StartedAt     time.Time          `json:"started_at"`    // this process
+	MetricsSince  time.Time          `json:"metrics_since"` // the counters' epoch; earlier with shared metrics
 	UptimeSeconds int64              `json:"uptime_seconds"`
 	TotalRequests int64              `json:"total_requests"`
 	Tokens        statsTokens        `json:"tokens"`
 	ModelCounts   map[string]int64   `json:"model_counts"`
 	BackendCounts map[string]int64   `json:"backend_counts"`
 	TypeCounts    map[string]int64   `json:"type_counts"`
+	TrimmedToolRequests int64        `json:"trimmed_tool_requests"`
+	DedupHits     map[string]int64   `json:"dedup_hits"`
+	CacheHits     map[string]int64   `json:"cache_hits"`
+	Hedging       statsHedging       `json:"hedging"`
+	ResizedImages int64              `json:"resized_images"`
+	Filtered      map[string]int64   `json:"filtered"`
+	ChaosRequests map[string]int64   `json:"chaos_requests"`
+	Hooks         []statsHook        `json:"hooks"`
+	Upstream      statsUpstream      `json:"upstream"`
+	Failover      statsFailover      `json:"failover"`
+	Premium       statsPremium       `json:"premium"`
+	UpstreamRateLimits []service.ModelRateLimit `json:"upstream_rate_limits"`
 	Session       *statsSession      `json:"session"`
+	SessionPins   []sessionPin       `json:"session_pins"`
+	ModelQueues   []service.ModelQueue `json:"model_queues"`
 	Recent        []state.RequestRecord `json:"recent"`
 	Config        statsConfig        `json:"config"`
 }
@@ -30,6 +53,7 @@ type statsTokens struct {
 
 type statsSession struct {
 	ClaudeMDFiles   []state.ClaudeMDFile         `json:"claude_md_files"`
+	MemoryTokens    int                           `json:"memory_tokens"`
 	Tools           []string                      `json:"tools"`
 	MCPTools        []string                      `json:"mcp_tools"`
 	Thinking        statsThinking                 `json:"thinking"`
@@ -39,6 +63,51 @@ type statsSession struct {
 	LastSeen        *time.Time                    `json:"last_seen,omitempty"`
 }
 
+type statsHedging struct {
+	Hedged int64 `json:"hedged"`
+	Wins   int64 `json:"wins"`
+	Wasted int64 `json:"wasted"`
+}
+
+// statsUpstream summarizes upstream connection reuse. Averages are over
+// new connections (TLS) and all traced requests (TTFB).
+type statsUpstream struct {
+	Reused            int64 `json:"reused"`
+	New               int64 `json:"new"`
+	AvgTLSHandshakeMs int64 `json:"avg_tls_handshake_ms"`
+	AvgTTFBMs         int64 `json:"avg_ttfb_ms"`
+}
+
+// statsFailover reports the Copilot circuit breaker and the requests
+// each alternate upstream served while it was open.
+type statsFailover struct {
+	Circuit   service.CircuitStatus `json:"circuit"`
+	Upstreams []statsAlternate      `json:"upstreams"`
+}
+
+type statsAlternate struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+// statsPremium reports the premium requests computed from the request
+// records (premiumMultipliers) next to Copilot's premium quota.
+type statsPremium struct {
+	Today float64            `json:"today"`  // consumed today, local time
+	ByDay map[string]float64 `json:"by_day"` // YYYY-MM-DD
+	// Quota is nil until copilot_internal/user has been read.
+	Quota *service.PremiumQuotaReport `json:"quota"`
+}
+
+// statsHook summarizes the runs of one pre-request hook.
+type statsHook struct {
+	Hook     string `json:"hook"`
+	Runs     int64  `json:"runs"`
+	Failures int64  `json:"failures"`
+	AvgMs    int64  `json:"avg_ms"`
+}
+
 type statsThinking struct {
 	Enabled bool   `json:"enabled"`
 	Budget  int    `json:"budget"`
@@ -47,31 +116,139 @@ type statsThinking struct {
 
 type statsConfig struct {
 	AccountType          string            `json:"account_type"`
+	CopilotPlan          string            `json:"copilot_plan,omitempty"`
 	VSCodeVersion        string            `json:"vs_code_version"`
 	SmallModel           string            `json:"small_model"`
+	EffectiveSmallModel  string            `json:"effective_small_model"` // differs when small_model isn't available
 	CompactUseSmallModel bool              `json:"compact_use_small_model"`
 	ReasoningEfforts     map[string]string `json:"reasoning_efforts"`
 	AuthEnabled          bool              `json:"auth_enabled"`
 	APIKeyCount          int               `json:"api_key_count"`
+	// HistoryEnabled marks that prompt and response text is being stored
+	// (history.enabled).
+	HistoryEnabled       bool              `json:"history_enabled"`
+}
+
+// defaultRecentLimit is the number of recent records returned when no
+// ?limit= is given.
+const defaultRecentLimit = 50
+
+// recentFilter selects records from the metrics ring buffer.
+type recentFilter struct {
+	Model     string
+	Backend   string
+	Type      string
+	ErrorOnly bool
+	Since     time.Time
+	Limit     int
+}
+
+// parseRecentFilter reads ?model=, ?backend=, ?type=, ?status=error,
+// ?since=RFC3339 and ?limit= from the query string.
+func parseRecentFilter(r *http.Request) (recentFilter, error) {
+	q := r.URL.Query()
+	f := recentFilter{
+		Model:   q.Get("model"),
+		Backend: q.Get("backend"),
+		Type:    q.Get("type"),
+		Limit:   defaultRecentLimit,
+	}
+
+	switch status := q.Get("status"); status {
+	case "":
+	case "error":
+		f.ErrorOnly = true
+	default:
+		return f, &api.HTTPError{
+			Message:    "invalid status filter: " + status + " (expected \"error\")",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return f, &api.HTTPError{
+				Message:    "invalid since filter: expected RFC3339 timestamp",
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		f.Since = t
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return f, &api.HTTPError{
+				Message:    "invalid limit filter: expected a positive integer",
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		f.Limit = n
+	}
+
+	return f, nil
+}
+
+// matches reports whether a record passes every configured filter.
+// The model filter matches either the requested or the routed model.
+func (f recentFilter) matches(rec state.RequestRecord) bool {
+	if f.Model != "" && rec.Model != f.Model && rec.RoutedModel != f.Model {
+		return false
+	}
+	if f.Backend != "" && rec.Backend != f.Backend {
+		return false
+	}
+	if f.Type != "" && rec.RequestType != f.Type {
+		return false
+	}
+	if f.ErrorOnly && rec.Error == "" && rec.StatusCode >= 200 && rec.StatusCode < 300 {
+		return false
+	}
+	if !f.Since.IsZero() && rec.Timestamp.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// apply filters records (newest first) and truncates to the limit.
+func (f recentFilter) apply(records []state.RequestRecord) []state.RequestRecord {
+	result := make([]state.RequestRecord, 0, min(len(records), f.Limit))
+	for _, rec := range records {
+		if !f.matches(rec) {
+			continue
+		}
+		result = append(result, rec)
+		if len(result) >= f.Limit {
+			break
+		}
+	}
+	return result
 }
 
 // Stats handles GET /api/stats — returns all dashboard metrics as JSON.
+// The recent request list can be filtered with query parameters; see
+// parseRecentFilter.
 func Stats(w http.ResponseWriter, r *http.Request) {
-	snap := state.Metrics.Snapshot()
-	cfg := config.Get()
-	apiKeys := config.GetAPIKeys()
-
-	// Limit recent to last 50 for the API response
-	recent := snap.Recent
-	if len(recent) > 50 {
-		recent = recent[:50]
+	filter, err := parseRecentFilter(r)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
 	}
 
+	st := state.FromContext(r.Context())
+	snap := state.MetricsFromContext(r.Context()).Snapshot()
+	cfg := config.FromContext(r.Context())
+	apiKeys := cfg.GetAPIKeys()
+
+	recent := filter.apply(snap.Recent)
+
 	var session *statsSession
 	if !snap.Session.LastSeen.IsZero() {
 		lastSeen := snap.Session.LastSeen
 		session = &statsSession{
 			ClaudeMDFiles: snap.Session.ClaudeMDFiles,
+			MemoryTokens:  snap.Session.MemoryTokens,
 			Tools:         snap.Session.Tools,
 			MCPTools:      snap.Session.MCPTools,
 			Thinking: statsThinking{
@@ -87,7 +264,10 @@ func Stats(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := statsResponse{
-		UptimeSeconds: int64(time.Since(snap.Aggregates.StartTime).Seconds()),
+		Build:         buildinfo.Get(),
+		StartedAt:     state.ProcessStart(),
+		MetricsSince:  snap.Aggregates.StartTime,
+		UptimeSeconds: int64(time.Since(state.ProcessStart()).Seconds()),
 		TotalRequests: snap.Aggregates.TotalRequests,
 		Tokens: statsTokens{
 			Input:  snap.Aggregates.TotalInputTokens,
@@ -97,19 +277,98 @@ func Stats(w http.ResponseWriter, r *http.Request) {
 		ModelCounts:   snap.Aggregates.ModelCounts,
 		BackendCounts: snap.Aggregates.BackendCounts,
 		TypeCounts:    snap.Aggregates.TypeCounts,
+		TrimmedToolRequests: snap.Aggregates.TrimmedToolRequests,
+		DedupHits:     snap.Aggregates.DedupHits,
+		CacheHits:     snap.Aggregates.CacheHits,
+		Hedging: statsHedging{
+			Hedged: snap.Aggregates.HedgedRequests,
+			Wins:   snap.Aggregates.HedgeWins,
+			Wasted: snap.Aggregates.WastedHedgeRequests,
+		},
+		ResizedImages: snap.Aggregates.ResizedImages,
+		Filtered:      snap.Aggregates.Filtered,
+		ChaosRequests: snap.Aggregates.ChaosRequests,
+		Hooks:         hookStats(snap.Aggregates),
+		Upstream:      upstreamStats(snap.Aggregates),
+		Failover:      failoverStats(r.Context(), cfg, snap.Aggregates),
+		Premium:       premiumStats(r.Context(), snap.Aggregates),
+		UpstreamRateLimits: service.RateLimits(r.Context()),
 		Session:       session,
+		SessionPins:   cachesOf(r.Context()).pins.list(),
+		ModelQueues:   service.ModelQueues(r.Context()),
 		Recent:        recent,
 		Config: statsConfig{
-			AccountType:          state.Global.GetAccountType(),
-			VSCodeVersion:        state.Global.GetVSCodeVersion(),
+			AccountType:          st.GetAccountType(),
+			CopilotPlan:          st.GetCopilotPlan(),
+			VSCodeVersion:        st.GetVSCodeVersion(),
 			SmallModel:           cfg.SmallModel,
+			EffectiveSmallModel:  cfg.EffectiveSmallModel(st),
 			CompactUseSmallModel: cfg.CompactUseSmallModel,
 			ReasoningEfforts:     cfg.ModelReasoningEfforts,
 			AuthEnabled:          len(apiKeys) > 0,
 			APIKeyCount:          len(apiKeys),
+			HistoryEnabled:       cfg.History.Enabled,
 		},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+func hookStats(agg state.Aggregates) []statsHook {
+	hooks := []statsHook{}
+	for hook, runs := range agg.HookRuns {
+		h := statsHook{Hook: hook, Runs: runs, Failures: agg.HookFailures[hook]}
+		if runs > 0 {
+			h.AvgMs = agg.HookMs[hook] / runs
+		}
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Hook < hooks[j].Hook })
+	return hooks
+}
+
+// failoverStats lists the configured alternate upstreams, then any others
+// that served requests before a config change.
+func failoverStats(ctx context.Context, cfg *config.Config, agg state.Aggregates) statsFailover {
+	f := statsFailover{Circuit: service.Circuit(ctx), Upstreams: []statsAlternate{}}
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			f.Upstreams = append(f.Upstreams, statsAlternate{Name: name, Requests: agg.FallbackRequests[name], Errors: agg.FallbackErrors[name]})
+		}
+	}
+	for _, u := range cfg.AlternateUpstreams {
+		add(u.UpstreamName())
+	}
+	rest := make([]string, 0, len(agg.FallbackRequests))
+	for name := range agg.FallbackRequests {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		add(name)
+	}
+	return f
+}
+
+func premiumStats(ctx context.Context, agg state.Aggregates) statsPremium {
+	p := statsPremium{ByDay: make(map[string]float64, len(agg.PremiumByDay)), Quota: service.PremiumQuota(ctx)}
+	for day, milli := range agg.PremiumByDay {
+		p.ByDay[day] = float64(milli) / 1000
+	}
+	p.Today = p.ByDay[time.Now().Format(time.DateOnly)]
+	return p
+}
+
+func upstreamStats(agg state.Aggregates) statsUpstream {
+	u := statsUpstream{Reused: agg.ConnReused, New: agg.ConnNew}
+	if agg.ConnNew > 0 {
+		u.AvgTLSHandshakeMs = agg.TLSHandshakeMs / agg.ConnNew
+	}
+	if n := agg.ConnReused + agg.ConnNew; n > 0 {
+		u.AvgTTFBMs = agg.TTFBMs / n
+	}
+	return u
+}
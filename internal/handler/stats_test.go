@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+func TestParseRecentFilter(t *testing.T) {
+	since := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query   string
+		want    recentFilter
+		wantErr bool
+	}{
+		{"", recentFilter{Limit: defaultRecentLimit}, false},
+		{"model=gpt-4.1&backend=responses&type=messages", recentFilter{Model: "gpt-4.1", Backend: "responses", Type: "messages", Limit: defaultRecentLimit}, false},
+		{"status=error&limit=5", recentFilter{ErrorOnly: true, Limit: 5}, false},
+		{"since=2026-10-01T12:00:00Z", recentFilter{Since: since, Limit: defaultRecentLimit}, false},
+		{"status=ok", recentFilter{}, true},
+		{"since=yesterday", recentFilter{}, true},
+		{"limit=0", recentFilter{}, true},
+		{"limit=ten", recentFilter{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRecentFilter(httptest.NewRequest("GET", "/api/stats?"+tt.query, nil))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got no error", tt.query)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %+v, %v; want %+v", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestRecentFilterApply(t *testing.T) {
+	now := time.Now()
+	// Newest first, as in the metrics snapshot
+	records := []state.RequestRecord{
+		{RequestID: "a", Timestamp: now, Model: "claude-sonnet-4", RoutedModel: "claude-sonnet-4.5", Backend: "messages", RequestType: "messages", StatusCode: 200},
+		{RequestID: "b", Timestamp: now.Add(-time.Minute), Model: "gpt-4.1", Backend: "chat_completions", RequestType: "chat_completions", StatusCode: 429},
+		{RequestID: "c", Timestamp: now.Add(-2 * time.Minute), Model: "gpt-5", Backend: "responses", RequestType: "messages", StatusCode: 200, Error: "stream ended early"},
+		{RequestID: "d", Timestamp: now.Add(-time.Hour), Model: "gpt-5", Backend: "responses", RequestType: "responses", StatusCode: 200},
+	}
+	tests := []struct {
+		name   string
+		filter recentFilter
+		want   []string
+	}{
+		{"no filter", recentFilter{Limit: 50}, []string{"a", "b", "c", "d"}},
+		{"limit", recentFilter{Limit: 2}, []string{"a", "b"}},
+		{"requested model", recentFilter{Model: "gpt-5", Limit: 50}, []string{"c", "d"}},
+		{"routed model", recentFilter{Model: "claude-sonnet-4.5", Limit: 50}, []string{"a"}},
+		{"backend", recentFilter{Backend: "responses", Limit: 50}, []string{"c", "d"}},
+		{"type", recentFilter{Type: "messages", Limit: 50}, []string{"a", "c"}},
+		{"errors: status or message", recentFilter{ErrorOnly: true, Limit: 50}, []string{"b", "c"}},
+		{"since", recentFilter{Since: now.Add(-90 * time.Second), Limit: 50}, []string{"a", "b"}},
+		{"combined, limit after filtering", recentFilter{Model: "gpt-5", Type: "messages", Limit: 1}, []string{"c"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, rec := range tt.filter.apply(records) {
+			got = append(got, rec.RequestID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStatsRejectsBadFilter(t *testing.T) {
+	w := httptest.NewRecorder()
+	Stats(w, newRequest("GET", "/api/stats?limit=-1", ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+}
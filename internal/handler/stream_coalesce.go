@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// coalesceMaxBytes caps the text buffered in one combined delta.
+const coalesceMaxBytes = 1024
+
+// deltaCoalescer writes translated Anthropic SSE events, merging consecutive
+// text_delta/thinking_delta events for the same block into one event. A
+// buffered delta is flushed after the coalescing window, once it reaches
+// coalesceMaxBytes, or before any other event (block transitions, tool
+// calls, message_delta/message_stop). With a zero window every event is
+// written immediately.
+type deltaCoalescer struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	window  time.Duration
+
+	pending *ContentBlockDeltaEvent
+	size    int
+	timer   *time.Timer
+	err     error // first write error from a timer flush
+}
+
+func newDeltaCoalescer(w http.ResponseWriter, flusher http.Flusher, window time.Duration) *deltaCoalescer {
+	return &deltaCoalescer{w: w, flusher: flusher, window: window}
+}
+
+// write emits evt, or buffers it when it can be merged.
+func (c *deltaCoalescer) write(evt SSEEvent) error {
+	if c.window <= 0 {
+		return writeSSE(c.w, c.flusher, evt.Event, evt.Data)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+
+	delta, ok := evt.Data.(ContentBlockDeltaEvent)
+	if !ok || (delta.Delta.Type != "text_delta" && delta.Delta.Type != "thinking_delta") {
+		if err := c.flushLocked(); err != nil {
+			return err
+		}
+		return writeSSE(c.w, c.flusher, evt.Event, evt.Data)
+	}
+
+	if c.pending != nil && (c.pending.Index != delta.Index || c.pending.Delta.Type != delta.Delta.Type) {
+		if err := c.flushLocked(); err != nil {
+			return err
+		}
+	}
+	if c.pending == nil {
+		c.pending = &delta
+		c.size = len(delta.Delta.Text) + len(delta.Delta.Thinking)
+		c.timer = time.AfterFunc(c.window, c.timerFlush)
+	} else {
+		c.pending.Delta.Text += delta.Delta.Text
+		c.pending.Delta.Thinking += delta.Delta.Thinking
+		c.size += len(delta.Delta.Text) + len(delta.Delta.Thinking)
+	}
+	if c.size >= coalesceMaxBytes {
+		return c.flushLocked()
+	}
+	return nil
+}
+
+// flush writes any buffered delta. Call before writing to the stream
+// directly and when the stream ends.
+func (c *deltaCoalescer) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *deltaCoalescer) timerFlush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flushLocked(); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *deltaCoalescer) flushLocked() error {
+	if c.pending == nil {
+		return nil
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	evt := *c.pending
+	c.pending = nil
+	c.size = 0
+	return writeSSE(c.w, c.flusher, evt.Type, evt)
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// streamShape splits an Anthropic SSE stream into the text of each block,
+// the sequence of events other than text/thinking deltas, and the number
+// of those deltas.
+func streamShape(t *testing.T, stream []byte) (text map[int]string, events []string, deltas int) {
+	t.Helper()
+	text = make(map[int]string)
+	err := readSSE(testContext(context.Background()), bytes.NewReader(stream), func(eventType, data string) error {
+		var evt ContentBlockDeltaEvent
+		json.Unmarshal([]byte(data), &evt)
+		if evt.Type == "content_block_delta" && (evt.Delta.Type == "text_delta" || evt.Delta.Type == "thinking_delta") {
+			text[evt.Index] += evt.Delta.Text + evt.Delta.Thinking
+			deltas++
+			return nil
+		}
+		events = append(events, syntheticIDRe.ReplaceAllString(data, "${1}fixture"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text, events, deltas
+}
+
+// TestStreamCoalescing translates the chat and responses fixtures with and
+// without coalescing: the text of every block must come out byte-identical
+// and every other event unchanged and in order.
+func TestStreamCoalescing(t *testing.T) {
+	translate := map[string]func(context.Context, http.ResponseWriter, *http.Response, string, int, *toolNameMap, *state.RequestRecord){
+		FixtureChat:      streamChatToAnthropic,
+		FixtureResponses: streamResponsesToAnthropic,
+	}
+	dirs, err := filepath.Glob("testdata/fixtures/*/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tested := 0
+	for _, path := range dirs {
+		dir := filepath.Dir(path)
+		var fx Fixture
+		data, _ := os.ReadFile(path)
+		if err := json.Unmarshal(data, &fx); err != nil {
+			t.Fatal(err)
+		}
+		stream, ok := translate[fx.Translator]
+		if !ok {
+			continue
+		}
+		tested++
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			input, err := os.ReadFile(filepath.Join(dir, "input.sse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			run := func(ms int) []byte {
+				useConfig(t, func(c *config.Config) { c.StreamCoalesceMs = ms })
+				w := httptest.NewRecorder()
+				resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(input))}
+				stream(testContext(context.Background()), w, resp, fx.Model, 0, nil, &state.RequestRecord{})
+				return w.Body.Bytes()
+			}
+			plainText, plainEvents, plainDeltas := streamShape(t, run(0))
+			text, events, deltas := streamShape(t, run(60_000))
+
+			for i, want := range plainText {
+				if text[i] != want {
+					t.Errorf("block %d text %q, want %q", i, text[i], want)
+				}
+			}
+			if len(text) != len(plainText) {
+				t.Errorf("%d blocks with text, want %d", len(text), len(plainText))
+			}
+			if got, want := strings.Join(events, "\n"), strings.Join(plainEvents, "\n"); got != want {
+				t.Errorf("other events differ:\n got %s\nwant %s", got, want)
+			}
+			if deltas > len(plainText) || deltas > plainDeltas {
+				t.Errorf("%d deltas, want at most one per block (%d blocks)", deltas, len(plainText))
+			}
+		})
+	}
+	if tested == 0 {
+		t.Fatal("no chat or responses fixtures found")
+	}
+}
+
+func TestDeltaCoalescerFlushes(t *testing.T) {
+	textDelta := func(index int, text string) SSEEvent {
+		return SSEEvent{Event: "content_block_delta", Data: ContentBlockDeltaEvent{
+			Type: "content_block_delta", Index: index, Delta: Delta{Type: "text_delta", Text: text},
+		}}
+	}
+	big := strings.Repeat("x", coalesceMaxBytes/2)
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		events []SSEEvent
+		wait   time.Duration // before counting what was written
+		want   []string      // text of each delta written, in order
+	}{
+		{"off", 0, []SSEEvent{textDelta(0, "a"), textDelta(0, "b")}, 0, []string{"a", "b"}},
+		{"buffered", time.Minute, []SSEEvent{textDelta(0, "a"), textDelta(0, "b")}, 0, nil},
+		{"size cap", time.Minute, []SSEEvent{textDelta(0, big), textDelta(0, big), textDelta(0, "c")}, 0, []string{big + big}},
+		{"block change", time.Minute, []SSEEvent{textDelta(0, "a"), textDelta(1, "b")}, 0, []string{"a"}},
+		{"other event", time.Minute, []SSEEvent{textDelta(0, "a"), {Event: "content_block_stop", Data: ContentBlockStopEvent{Type: "content_block_stop"}}}, 0, []string{"a"}},
+		{"window elapses", 10 * time.Millisecond, []SSEEvent{textDelta(0, "a"), textDelta(0, "b")}, 200 * time.Millisecond, []string{"ab"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c := newDeltaCoalescer(w, w, tt.window)
+			for _, evt := range tt.events {
+				if err := c.write(evt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(tt.wait)
+			c.mu.Lock()
+			out := append([]byte(nil), w.Body.Bytes()...)
+			c.mu.Unlock()
+
+			var got []string
+			readSSE(testContext(context.Background()), bytes.NewReader(out), func(_, data string) error {
+				var evt ContentBlockDeltaEvent
+				json.Unmarshal([]byte(data), &evt)
+				if evt.Type == "content_block_delta" {
+					got = append(got, evt.Delta.Text)
+				}
+				return nil
+			})
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("deltas written %q, want %q", got, tt.want)
+			}
+			c.flush()
+		})
+	}
+}
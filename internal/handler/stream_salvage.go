@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// streamSalvage keeps the partial answer of a translated stream whose
+// upstream failed midway (salvagePartialStreams). Clients discard a
+// message that ends in an error event, so once text has been sent the
+// stream is ended as a normal turn instead.
+type streamSalvage struct {
+	textChars int
+	chars     int // text and thinking, for the output estimate
+}
+
+// newStreamSalvage returns nil when salvaging is off.
+func newStreamSalvage(ctx context.Context) *streamSalvage {
+	if !config.FromContext(ctx).SalvagePartialStreams {
+		return nil
+	}
+	return &streamSalvage{}
+}
+
+// count records the deltas of events about to be sent.
+func (s *streamSalvage) count(events []SSEEvent) {
+	if s == nil {
+		return
+	}
+	for _, evt := range events {
+		if data, ok := evt.Data.(ContentBlockDeltaEvent); ok {
+			s.textChars += len(data.Delta.Text)
+			s.chars += len(data.Delta.Text) + len(data.Delta.Thinking)
+		}
+	}
+}
+
+// end finishes a stream that failed with err after closing the open block:
+// message_delta with stop_reason end_turn and the estimated output, then
+// message_stop. It reports false, leaving the error to the caller, if no
+// text was sent, a tool_use block is open, whose argument JSON would be
+// cut off, or the request was canceled, which must not look finished, or
+// the client is gone.
+func (s *streamSalvage) end(out *deltaCoalescer, err error, openBlockType string, closeBlock func() []SSEEvent, rec *state.RequestRecord) bool {
+	if s == nil || s.textChars == 0 || openBlockType == "tool_use" || rec.Canceled || errors.Is(err, errClientDisconnected) {
+		return false
+	}
+	events := append(closeBlock(),
+		SSEEvent{
+			Event: "message_delta",
+			Data: MessageDeltaEvent{
+				Type:  "message_delta",
+				Delta: MessageDelta{StopReason: "end_turn"},
+				Usage: DeltaUsage{OutputTokens: s.outputTokens()},
+			},
+		},
+		SSEEvent{
+			Event: "message_stop",
+			Data:  MessageStopEvent{Type: "message_stop"},
+		},
+	)
+	for _, evt := range events {
+		if out.write(evt) != nil {
+			break
+		}
+	}
+	out.flush()
+
+	slog.Warn("upstream stream failed, salvaged partial answer", "error", err, "est_output_tokens", s.outputTokens())
+	rec.Salvaged = true
+	rec.StopReason = "end_turn"
+	return true
+}
+
+// outputTokens is the estimated output sent so far.
+func (s *streamSalvage) outputTokens() int {
+	return tokensForChars(s.chars)
+}
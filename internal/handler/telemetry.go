@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/telemetry"
+)
+
+// Span names of the handler's phases; the server span comes from
+// middleware.Tracing and the upstream call's from the service layer.
+const (
+	spanTranslate = "translate"
+	spanStream    = "stream"
+)
+
+// startSpan starts a telemetry span for a phase of r under its server
+// span. It is nil, and free, while telemetry is disabled.
+func startSpan(r *http.Request, name string) *telemetry.Span {
+	_, span := telemetry.Start(r.Context(), name, telemetry.KindInternal)
+	return span
+}
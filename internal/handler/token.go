@@ -2,20 +2,58 @@ package handler
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
 
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
-// TokenResponse is the JSON response for the token endpoint.
+// TokenResponse is the JSON response for the token endpoints.
 type TokenResponse struct {
 	Token string `json:"token"`
 }
 
 // Token handles GET /token — returns the current Copilot bearer token.
 func Token(w http.ResponseWriter, r *http.Request) {
+	serveToken(w, r, "copilot", state.FromContext(r.Context()).GetCopilotToken())
+}
+
+// GitHubToken handles GET /token/github — returns the GitHub token the
+// Copilot token is refreshed with.
+func GitHubToken(w http.ResponseWriter, r *http.Request) {
+	serveToken(w, r, "github", state.FromContext(r.Context()).GetGithubToken())
+}
+
+// serveToken hands out token, only with auth.exposeToken set (404
+// otherwise) and to a request that authenticated with an API key (403
+// otherwise, also when no API keys are configured). Every attempt is
+// logged with the caller's IP; the audit log records them too.
+func serveToken(w http.ResponseWriter, r *http.Request, kind, token string) {
+	cfg := config.FromContext(r.Context())
+	ip := middleware.ClientIP(r)
+	if !cfg.Auth.ExposeToken {
+		slog.Warn("token request refused: endpoint disabled", "token", kind, "client_ip", ip)
+		api.ForwardError(w, &api.HTTPError{
+			Message:    "the token endpoints are disabled; start with --expose-token or set auth.exposeToken",
+			StatusCode: http.StatusNotFound,
+		})
+		return
+	}
+	key := middleware.APIKeyFromContext(r.Context())
+	if key == "" {
+		slog.Warn("token request refused: no API key", "token", kind, "client_ip", ip)
+		api.ForwardError(w, &api.HTTPError{
+			Message:    "the token endpoints require an API key; configure auth.apiKeys",
+			StatusCode: http.StatusForbidden,
+		})
+		return
+	}
+
+	slog.Warn("token handed out", "token", kind, "client_ip", ip, "key", cfg.KeyLabel(key))
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(TokenResponse{
-		Token: state.Global.GetCopilotToken(),
-	})
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TokenResponse{Token: token})
 }
@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// maxSummaryDescLen caps a trimmed tool's description.
+const maxSummaryDescLen = 200
+
+// enforceToolLimits checks the request's tool definitions against maxTools
+// and maxToolSchemaTokens. Over a limit, it returns a 400 unless trimTools
+// is set; then it summarizes definitions (names are never changed) until
+// the request fits, and returns the names of the trimmed tools.
+//
+// With trimming, maxTools is the number of tools kept in full: MCP tools
+// are summarized before built-in ones, later tools before earlier ones.
+// Then the largest remaining definitions are summarized until the total is
+// within maxToolSchemaTokens.
+func enforceToolLimits(ctx context.Context, req *AnthropicRequest) ([]string, error) {
+	cfg := config.FromContext(ctx)
+	if len(req.Tools) == 0 || (cfg.MaxTools == 0 && cfg.MaxToolSchemaTokens == 0) {
+		return nil, nil
+	}
+
+	costs := make([]int, len(req.Tools))
+	total := 0
+	for i, t := range req.Tools {
+		costs[i] = toolDefinitionTokens(t)
+		total += costs[i]
+	}
+
+	overCount := cfg.MaxTools > 0 && len(req.Tools) > cfg.MaxTools
+	overTokens := cfg.MaxToolSchemaTokens > 0 && total > cfg.MaxToolSchemaTokens
+	if !overCount && !overTokens {
+		return nil, nil
+	}
+	if !cfg.TrimTools {
+		return nil, toolLimitError(len(req.Tools), total, cfg)
+	}
+
+	// Trim order: MCP tools first, then later tools first
+	order := make([]int, len(req.Tools))
+	for i := range order {
+		order[i] = len(req.Tools) - 1 - i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return isMCPTool(req.Tools[order[a]]) && !isMCPTool(req.Tools[order[b]])
+	})
+
+	trimmed := make(map[int]bool)
+	trim := func(i int) {
+		req.Tools[i] = summarizeTool(req.Tools[i])
+		after := toolDefinitionTokens(req.Tools[i])
+		total += after - costs[i]
+		costs[i] = after
+		trimmed[i] = true
+	}
+
+	if overCount {
+		for _, i := range order[:len(req.Tools)-cfg.MaxTools] {
+			trim(i)
+		}
+	}
+	if cfg.MaxToolSchemaTokens > 0 && total > cfg.MaxToolSchemaTokens {
+		// Largest first, keeping the MCP-before-built-in preference
+		sort.SliceStable(order, func(a, b int) bool {
+			ma, mb := isMCPTool(req.Tools[order[a]]), isMCPTool(req.Tools[order[b]])
+			if ma != mb {
+				return ma
+			}
+			return costs[order[a]] > costs[order[b]]
+		})
+		for _, i := range order {
+			if total <= cfg.MaxToolSchemaTokens {
+				break
+			}
+			if !trimmed[i] {
+				trim(i)
+			}
+		}
+	}
+
+	var names []string
+	for i, t := range req.Tools {
+		if trimmed[i] {
+			names = append(names, t.Name)
+		}
+	}
+	if cfg.MaxToolSchemaTokens > 0 && total > cfg.MaxToolSchemaTokens {
+		return names, toolLimitError(len(req.Tools), total, cfg)
+	}
+	slog.Warn("trimmed tool definitions to fit limits", "trimmed", len(names), "tools", len(req.Tools),
+		"schema_tokens", total, "names", strings.Join(names, ","))
+	return names, nil
+}
+
+// toolLimitError describes which limit a request exceeds.
+func toolLimitError(count, tokens int, cfg *config.Config) error {
+	var parts []string
+	if cfg.MaxTools > 0 && count > cfg.MaxTools && !cfg.TrimTools {
+		parts = append(parts, fmt.Sprintf("%d tools (maxTools is %d)", count, cfg.MaxTools))
+	}
+	if cfg.MaxToolSchemaTokens > 0 && tokens > cfg.MaxToolSchemaTokens {
+		parts = append(parts, fmt.Sprintf("~%d tokens of tool definitions (maxToolSchemaTokens is %d)", tokens, cfg.MaxToolSchemaTokens))
+	}
+	msg := "request has " + strings.Join(parts, " and ")
+	if cfg.TrimTools {
+		msg += " even after trimming tool definitions"
+	} else {
+		msg += "; disable some MCP servers or set trimTools to summarize tool definitions"
+	}
+	return &api.HTTPError{Message: msg, StatusCode: http.StatusBadRequest}
+}
+
+// toolDefinitionTokens estimates a tool definition's size the same way
+// estimateTokens does.
+func toolDefinitionTokens(t AnthropicTool) int {
+	n := countStringTokens(t.Name) + countStringTokens(t.Description) + 5
+	if t.InputSchema != nil {
+		n += countStringTokens(string(t.InputSchema))
+	}
+	return n
+}
+
+// summarizeTool reduces a tool to its name, the first sentence of its
+// description, and a schema listing only each property's type.
+func summarizeTool(t AnthropicTool) AnthropicTool {
+	t.Description = summarizeDescription(t.Description)
+
+	var schema map[string]any
+	if json.Unmarshal(t.InputSchema, &schema) != nil {
+		return t
+	}
+	summary := map[string]any{"type": "object"}
+	props := make(map[string]any)
+	if p, ok := schema["properties"].(map[string]any); ok {
+		for name, sub := range p {
+			prop := map[string]any{}
+			if sm, ok := sub.(map[string]any); ok {
+				if typ, ok := sm["type"]; ok {
+					prop["type"] = typ
+				}
+			}
+			props[name] = prop
+		}
+	}
+	summary["properties"] = props
+	if r, ok := schema["required"]; ok {
+		summary["required"] = r
+	}
+	if data, err := json.Marshal(summary); err == nil {
+		t.InputSchema = data
+	}
+	return t
+}
+
+func summarizeDescription(desc string) string {
+	desc = strings.TrimSpace(desc)
+	if i := strings.Index(desc, "\n"); i >= 0 {
+		desc = desc[:i]
+	}
+	if i := strings.Index(desc, ". "); i >= 0 {
+		desc = desc[:i+1]
+	}
+	if r := []rune(desc); len(r) > maxSummaryDescLen {
+		desc = strings.TrimSpace(string(r[:maxSummaryDescLen])) + "..."
+	}
+	return desc
+}
+
+// applyTrimmedToolsInMap copies trimmed definitions from req into the raw
+// native Messages payload, leaving other tool fields (cache_control, ...)
+// untouched.
+func applyTrimmedToolsInMap(payload map[string]any, req *AnthropicRequest, trimmed []string) {
+	if len(trimmed) == 0 {
+		return
+	}
+	byName := make(map[string]AnthropicTool, len(req.Tools))
+	for _, t := range req.Tools {
+		byName[t.Name] = t
+	}
+	tools, _ := payload["tools"].([]any)
+	for _, name := range trimmed {
+		for _, raw := range tools {
+			tool, ok := raw.(map[string]any)
+			if !ok || tool["name"] != name {
+				continue
+			}
+			t := byName[name]
+			tool["description"] = t.Description
+			var schema any
+			if json.Unmarshal(t.InputSchema, &schema) == nil {
+				tool["input_schema"] = schema
+			}
+		}
+	}
+}
+
+func isMCPTool(t AnthropicTool) bool {
+	return strings.HasPrefix(t.Name, "mcp__")
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+)
+
+// maxToolNameLen is Copilot's limit on function names.
+const maxToolNameLen = 64
+
+var (
+	validToolNameRe   = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+	invalidToolCharRe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// toolNameMap maps client tool names to names Copilot accepts and back, for
+// the lifetime of one request. A nil map leaves every name unchanged.
+type toolNameMap struct {
+	toUpstream map[string]string
+	toOriginal map[string]string
+}
+
+// buildToolNameMap collects every tool name the request refers to (tool
+// definitions, tool_use blocks in the history, and tool_choice) and assigns
+// a valid upstream name to each one that needs it. Returns nil when no name
+// needs rewriting.
+func buildToolNameMap(req *AnthropicRequest) *toolNameMap {
+	var names []string
+	for _, t := range req.Tools {
+		names = append(names, t.Name)
+	}
+	for _, msg := range req.Messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		for _, b := range ParseMessageContent(msg.Content) {
+			if b.Type == "tool_use" {
+				names = append(names, b.Name)
+			}
+		}
+	}
+	if req.ToolChoice != nil {
+		var tc struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(req.ToolChoice, &tc) == nil && tc.Name != "" {
+			names = append(names, tc.Name)
+		}
+	}
+
+	// Valid names are reserved first so they are never displaced by a
+	// rewritten one.
+	used := make(map[string]bool)
+	for _, n := range names {
+		if validToolNameRe.MatchString(n) {
+			used[n] = true
+		}
+	}
+
+	var m *toolNameMap
+	for _, n := range names {
+		if validToolNameRe.MatchString(n) {
+			continue
+		}
+		if m == nil {
+			m = &toolNameMap{toUpstream: make(map[string]string), toOriginal: make(map[string]string)}
+		}
+		if _, done := m.toUpstream[n]; done {
+			continue
+		}
+		upstream := shortenToolName(n, used)
+		used[upstream] = true
+		m.toUpstream[n] = upstream
+		m.toOriginal[upstream] = n
+		slog.Debug("rewrote tool name for upstream", "original", n, "upstream", upstream)
+	}
+	return m
+}
+
+// shortenToolName replaces unsupported characters and, when the result is
+// too long or collides with a name in use, truncates it and appends a hash
+// of the original name.
+func shortenToolName(name string, used map[string]bool) string {
+	clean := invalidToolCharRe.ReplaceAllString(name, "_")
+	if clean == "" {
+		clean = "tool"
+	}
+	if len(clean) <= maxToolNameLen && !used[clean] {
+		return clean
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])
+	for i := 0; ; i++ {
+		suffix := "_" + hash[:8]
+		if i > 0 {
+			suffix = fmt.Sprintf("_%s%d", hash[:8], i)
+		}
+		prefix := clean
+		if len(prefix)+len(suffix) > maxToolNameLen {
+			prefix = prefix[:maxToolNameLen-len(suffix)]
+		}
+		if candidate := prefix + suffix; !used[candidate] {
+			return candidate
+		}
+	}
+}
+
+// upstream returns the name to send to Copilot for a client tool name.
+func (m *toolNameMap) upstream(name string) string {
+	if m == nil {
+		return name
+	}
+	if u, ok := m.toUpstream[name]; ok {
+		return u
+	}
+	return name
+}
+
+// original returns the client's tool name for a name returned by Copilot.
+func (m *toolNameMap) original(name string) string {
+	if m == nil {
+		return name
+	}
+	if o, ok := m.toOriginal[name]; ok {
+		return o
+	}
+	return name
+}
+
+// applyToChat rewrites tool names in a Chat Completions payload.
+func (m *toolNameMap) applyToChat(req *ChatCompletionRequest) {
+	if m == nil {
+		return
+	}
+	for i := range req.Tools {
+		req.Tools[i].Function.Name = m.upstream(req.Tools[i].Function.Name)
+	}
+	for i := range req.Messages {
+		for j := range req.Messages[i].ToolCalls {
+			tc := &req.Messages[i].ToolCalls[j]
+			tc.Function.Name = m.upstream(tc.Function.Name)
+		}
+	}
+	req.ToolChoice = m.applyToToolChoice(req.ToolChoice)
+}
+
+// applyToResponses rewrites tool names in a Responses API payload.
+func (m *toolNameMap) applyToResponses(payload *ResponsesPayload) {
+	if m == nil {
+		return
+	}
+	for _, t := range payload.Tools {
+		if tool, ok := t.(map[string]any); ok {
+			if name, ok := tool["name"].(string); ok {
+				tool["name"] = m.upstream(name)
+			}
+		}
+	}
+	for i := range payload.Input {
+		if payload.Input[i].Type == "function_call" {
+			payload.Input[i].Name = m.upstream(payload.Input[i].Name)
+		}
+	}
+	payload.ToolChoice = m.applyToToolChoice(payload.ToolChoice)
+}
+
+// applyToToolChoice rewrites the function name in a translated tool_choice.
+func (m *toolNameMap) applyToToolChoice(choice any) any {
+	tc, ok := choice.(map[string]any)
+	if !ok {
+		return choice
+	}
+	if fn, ok := tc["function"].(map[string]string); ok {
+		tc["function"] = map[string]string{"name": m.upstream(fn["name"])}
+	}
+	if name, ok := tc["name"].(string); ok {
+		tc["name"] = m.upstream(name)
+	}
+	return tc
+}
+
+// restore maps tool_use block names in a translated response back to the
+// client's names.
+func (m *toolNameMap) restore(content []ContentBlock) {
+	if m == nil {
+		return
+	}
+	for i := range content {
+		if content[i].Type == "tool_use" {
+			content[i].Name = m.original(content[i].Name)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+const longMCPName = "mcp__github_enterprise_server__repository_management__create_or_update_file_contents"
+
+// toolRequest returns a request defining tools with the given names.
+func toolRequest(names ...string) *AnthropicRequest {
+	req := &AnthropicRequest{
+		Model:     "gpt-4.1",
+		MaxTokens: 1024,
+		Messages:  []AnthropicMsg{{Role: "user", Content: json.RawMessage(`"hi"`)}},
+	}
+	for _, n := range names {
+		req.Tools = append(req.Tools, AnthropicTool{Name: n, InputSchema: json.RawMessage(`{"type":"object","properties":{}}`)})
+	}
+	return req
+}
+
+func TestBuildToolNameMap(t *testing.T) {
+	tests := []struct {
+		name  string
+		tools []string
+		want  map[string]string // original -> upstream; "" = any valid name
+	}{
+		{"all valid", []string{"Read", "mcp__fs__read_file", "tool-1"}, nil},
+		{"invalid characters", []string{"mcp.read", "a b/c"}, map[string]string{"mcp.read": "mcp_read", "a b/c": "a_b_c"}},
+		{"too long", []string{longMCPName}, map[string]string{longMCPName: ""}},
+		{"collides with a valid name", []string{"mcp_read", "mcp.read"}, map[string]string{"mcp.read": ""}},
+		{"two invalid names clean to the same", []string{"mcp.read", "mcp:read"}, map[string]string{"mcp.read": "mcp_read", "mcp:read": ""}},
+		{"long names sharing a prefix", []string{longMCPName + "_a", longMCPName + "_b"}, map[string]string{longMCPName + "_a": "", longMCPName + "_b": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := buildToolNameMap(toolRequest(tt.tools...))
+			if tt.want == nil {
+				if m != nil {
+					t.Fatalf("got a map %v, want nil", m.toUpstream)
+				}
+				return
+			}
+			if m == nil {
+				t.Fatal("got a nil map")
+			}
+			seen := make(map[string]bool)
+			for _, n := range tt.tools {
+				up := m.upstream(n)
+				if !validToolNameRe.MatchString(up) {
+					t.Errorf("%q -> %q, not a valid upstream name", n, up)
+				}
+				if seen[up] {
+					t.Errorf("%q -> %q, already used by another tool", n, up)
+				}
+				seen[up] = true
+				if got := m.original(up); got != n {
+					t.Errorf("original(%q) = %q, want %q", up, got, n)
+				}
+				if want, ok := tt.want[n]; ok && want != "" && up != want {
+					t.Errorf("%q -> %q, want %q", n, up, want)
+				}
+			}
+			if again := buildToolNameMap(toolRequest(tt.tools...)); again.upstream(tt.tools[len(tt.tools)-1]) != m.upstream(tt.tools[len(tt.tools)-1]) {
+				t.Error("upstream names differ between identical requests")
+			}
+		})
+	}
+}
+
+func TestToolNameMapRewritesPayloads(t *testing.T) {
+	req := toolRequest(longMCPName)
+	req.Messages = []AnthropicMsg{
+		{Role: "user", Content: json.RawMessage(`"hi"`)},
+		{Role: "assistant", Content: json.RawMessage(`[{"type":"tool_use","id":"call_1","name":"` + longMCPName + `","input":{}}]`)},
+		{Role: "user", Content: json.RawMessage(`[{"type":"tool_result","tool_use_id":"call_1","content":"ok"}]`)},
+	}
+	req.ToolChoice = json.RawMessage(`{"type":"tool","name":"` + longMCPName + `"}`)
+
+	_, names, chat, err := chatCompletionsPayload(testContext(context.Background()), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, responses, err := responsesPayload(testContext(context.Background()), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := names.upstream(longMCPName)
+	for api, body := range map[string][]byte{"chat completions": chat, "responses": responses} {
+		if strings.Contains(string(body), longMCPName) {
+			t.Errorf("%s payload still carries the client's name: %s", api, body)
+		}
+		// tool definition, history tool call and tool_choice
+		if n := strings.Count(string(body), `"`+up+`"`); n != 3 {
+			t.Errorf("%s payload names %q %d times, want 3: %s", api, up, n, body)
+		}
+	}
+}
+
+func TestMessagesRestoresToolNames(t *testing.T) {
+	up := buildToolNameMap(toolRequest(longMCPName)).upstream(longMCPName)
+	toolCall := `{"id":"call_1","type":"function","function":{"name":"` + up + `","arguments":"{}"}}`
+	tests := []struct {
+		name  string
+		reply servicetest.Reply
+	}{
+		{"non-streaming", servicetest.JSON(`{"id":"c1","model":"gpt-4.1","choices":[{"index":0,"message":{"role":"assistant","tool_calls":[` + toolCall + `]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":5,"completion_tokens":2}}`)},
+		{"streaming", servicetest.SSE(
+			`{"id":"c1","model":"gpt-4.1","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,`+toolCall[1:]+`]}}]}`,
+			`{"id":"c1","model":"gpt-4.1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":5,"completion_tokens":2}}`,
+			`[DONE]`,
+		)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &servicetest.Fake{}
+			fake.Script(servicetest.ChatCompletions, tt.reply)
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: "gpt-4.1", SupportedEndpoints: []string{"/chat/completions"}})
+
+			stream := tt.name == "streaming"
+			body, _ := json.Marshal(map[string]any{
+				"model":      "gpt-4.1",
+				"max_tokens": 1024,
+				"stream":     stream,
+				"messages":   []map[string]any{{"role": "user", "content": "restore " + tt.name}},
+				"tools":      []map[string]any{{"name": longMCPName, "input_schema": map[string]any{"type": "object", "properties": map[string]any{}}}},
+			})
+			w := httptest.NewRecorder()
+			Messages(w, newRequest("POST", "/v1/messages", string(body)))
+
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			calls := fake.Calls()
+			if len(calls) != 1 || strings.Contains(string(calls[0].Body), longMCPName) {
+				t.Fatalf("upstream request carries the client's tool name: %s", calls[0].Body)
+			}
+			if !strings.Contains(w.Body.String(), `"name":"`+longMCPName+`"`) {
+				t.Errorf("response doesn't name the client's tool: %s", w.Body)
+			}
+			if strings.Contains(w.Body.String(), `"`+up+`"`) {
+				t.Errorf("response leaks the upstream name %q: %s", up, w.Body)
+			}
+		})
+	}
+}
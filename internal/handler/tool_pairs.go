@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// toolPairProblem is a tool_use without a tool_result in the following user
+// turn (dangling), or a tool_result without a matching tool_use in the
+// preceding assistant turn (orphan).
+type toolPairProblem struct {
+	orphan bool
+	msg    int // message index
+	block  int // content block index within the message
+	id     string
+	// answer is the first message of the user turn that should have held
+	// the tool_result of a dangling tool_use
+	answer int
+}
+
+func (p toolPairProblem) Error() string {
+	if p.orphan {
+		return fmt.Sprintf("messages.%d.content.%d: tool_result references tool_use_id %q, which has no tool_use in the preceding assistant message", p.msg, p.block, p.id)
+	}
+	return fmt.Sprintf("messages.%d.content.%d: tool_use %q has no tool_result in the following user message", p.msg, p.block, p.id)
+}
+
+// pairBlock is the part of a content block the pairing check reads. Blocks
+// are otherwise kept as raw JSON so a repair re-encodes them verbatim.
+type pairBlock struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	ToolUseID string `json:"tool_use_id"`
+}
+
+// rawContentBlocks returns the blocks of array content, or nil for string
+// content (which cannot hold tool blocks).
+func rawContentBlocks(content json.RawMessage) []json.RawMessage {
+	var blocks []json.RawMessage
+	if json.Unmarshal(content, &blocks) != nil {
+		return nil
+	}
+	return blocks
+}
+
+// findToolPairProblems walks the conversation turn by turn. Consecutive
+// messages with the same role form one turn, as they do upstream. The
+// tool_uses of an assistant turn must each be answered exactly once by a
+// tool_result in the next user turn; a conversation ending on an assistant
+// turn is not checked for answers.
+func findToolPairProblems(msgs []AnthropicMsg) []toolPairProblem {
+	type openUse struct {
+		msg, block int
+		answered   bool
+	}
+	var problems []toolPairProblem
+	var open map[string]*openUse
+	var order []string // open tool_use IDs in request order
+	answer := -1       // first message of the current user turn
+
+	closeTurn := func() {
+		for _, id := range order {
+			if u := open[id]; !u.answered && answer >= 0 {
+				problems = append(problems, toolPairProblem{msg: u.msg, block: u.block, id: id, answer: answer})
+			}
+		}
+		open, order, answer = nil, nil, -1
+	}
+
+	prevRole := ""
+	for i, m := range msgs {
+		switch m.Role {
+		case "assistant":
+			if prevRole != "assistant" {
+				closeTurn()
+				open = make(map[string]*openUse)
+			}
+			for j, raw := range rawContentBlocks(m.Content) {
+				var b pairBlock
+				if json.Unmarshal(raw, &b) != nil || b.Type != "tool_use" {
+					continue
+				}
+				if _, dup := open[b.ID]; !dup {
+					order = append(order, b.ID)
+				}
+				open[b.ID] = &openUse{msg: i, block: j}
+			}
+		case "user":
+			if prevRole != "user" {
+				answer = i
+			}
+			for j, raw := range rawContentBlocks(m.Content) {
+				var b pairBlock
+				if json.Unmarshal(raw, &b) != nil || b.Type != "tool_result" {
+					continue
+				}
+				if u, ok := open[b.ToolUseID]; ok && !u.answered {
+					u.answered = true
+					continue
+				}
+				problems = append(problems, toolPairProblem{orphan: true, msg: i, block: j, id: b.ToolUseID})
+			}
+		}
+		prevRole = m.Role
+	}
+	if prevRole == "user" {
+		closeTurn()
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].msg != problems[j].msg {
+			return problems[i].msg < problems[j].msg
+		}
+		return problems[i].block < problems[j].block
+	})
+	return problems
+}
+
+// repairToolPairs drops orphaned tool_results and inserts an empty
+// tool_result for each dangling tool_use at the start of the user turn that
+// should have answered it. A user message left empty gets a placeholder text
+// block, so the turn structure (and a leading user turn) is kept.
+func repairToolPairs(msgs []AnthropicMsg, problems []toolPairProblem) []AnthropicMsg {
+	drop := make(map[int]map[int]bool) // message → block indices
+	synth := make(map[int][]json.RawMessage)
+	for _, p := range problems {
+		if p.orphan {
+			if drop[p.msg] == nil {
+				drop[p.msg] = make(map[int]bool)
+			}
+			drop[p.msg][p.block] = true
+			continue
+		}
+		result, _ := json.Marshal(map[string]string{"type": "tool_result", "tool_use_id": p.id, "content": ""})
+		synth[p.answer] = append(synth[p.answer], result)
+	}
+
+	out := make([]AnthropicMsg, 0, len(msgs))
+	for i, m := range msgs {
+		added := synth[i]
+		if len(added) == 0 && drop[i] == nil {
+			out = append(out, m)
+			continue
+		}
+
+		blocks := append([]json.RawMessage(nil), added...)
+		if existing := rawContentBlocks(m.Content); existing != nil {
+			for j, raw := range existing {
+				if !drop[i][j] {
+					blocks = append(blocks, raw)
+				}
+			}
+		} else if text := ParseMessageContent(m.Content); len(text) > 0 && text[0].Text != "" {
+			raw, _ := json.Marshal(text[0])
+			blocks = append(blocks, raw)
+		}
+		if len(blocks) == 0 {
+			raw, _ := json.Marshal(ContentBlock{Type: "text", Text: "[orphaned tool_result removed]"})
+			blocks = append(blocks, raw)
+		}
+		m.Content, _ = json.Marshal(blocks)
+		out = append(out, m)
+	}
+	return out
+}
+
+// checkToolPairs validates tool_use/tool_result pairing in req. Problems are
+// rejected with a 400 naming the first offending block, or repaired in place
+// when repairToolPairs is set. It reports whether req.Messages changed.
+func checkToolPairs(ctx context.Context, req *AnthropicRequest) (bool, error) {
+	problems := findToolPairProblems(req.Messages)
+	if len(problems) == 0 {
+		return false, nil
+	}
+	if !config.FromContext(ctx).RepairToolPairs {
+		msg := problems[0].Error()
+		if len(problems) > 1 {
+			msg += fmt.Sprintf(" (and %d more pairing problems)", len(problems)-1)
+		}
+		return false, &api.HTTPError{Message: msg, StatusCode: http.StatusBadRequest}
+	}
+
+	var orphans int
+	for _, p := range problems {
+		if p.orphan {
+			orphans++
+		}
+	}
+	req.Messages = repairToolPairs(req.Messages, problems)
+	slog.Info("repaired tool_use/tool_result pairing", "dropped_results", orphans, "synthesized_results", len(problems)-orphans)
+	return true, nil
+}
+
+// replaceMessages re-encodes body with messages substituted. Numbers and
+// other fields are kept verbatim.
+func replaceMessages(body []byte, msgs []AnthropicMsg) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var payload map[string]any
+	if dec.Decode(&payload) != nil {
+		return body
+	}
+	payload["messages"] = msgs
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	return out
+}
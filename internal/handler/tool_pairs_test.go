@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+func TestCheckToolPairs(t *testing.T) {
+	const (
+		use1    = `{"type":"tool_use","id":"t1","name":"Read","input":{}}`
+		use2    = `{"type":"tool_use","id":"t2","name":"Grep","input":{}}`
+		result1 = `{"type":"tool_result","tool_use_id":"t1","content":"a"}`
+		result2 = `{"type":"tool_result","tool_use_id":"t2","content":"b"}`
+		empty1  = `{"content":"","tool_use_id":"t1","type":"tool_result"}`
+		empty2  = `{"content":"","tool_use_id":"t2","type":"tool_result"}`
+		task    = `{"type":"tool_use","id":"task1","name":"Task","input":{"subagent_type":"Explore","prompt":"find it"}}`
+		taskRes = `{"type":"tool_result","tool_use_id":"task1","content":[{"type":"text","text":"found in main.go"}]}`
+	)
+	tests := []struct {
+		name     string
+		messages string
+		err      string // rejection without repairToolPairs; "" when valid
+		repaired string // messages after repair, when err is set
+	}{
+		{
+			name:     "paired",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `]},{"role":"user","content":[` + result1 + `]}]`,
+		},
+		{
+			name:     "parallel calls answered out of order",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"text","text":"two"},` + use1 + `,` + use2 + `]},{"role":"user","content":[` + result2 + `,{"type":"text","text":"note"},` + result1 + `]}]`,
+		},
+		{
+			name:     "parallel calls split across messages of one turn",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `]},{"role":"assistant","content":[` + use2 + `]},{"role":"user","content":[` + result1 + `]},{"role":"user","content":[` + result2 + `]}]`,
+		},
+		{
+			name:     "subagent transcript",
+			messages: `[{"role":"user","content":"explore"},{"role":"assistant","content":[` + task + `]},{"role":"user","content":[` + taskRes + `]},{"role":"assistant","content":[` + use1 + `]},{"role":"user","content":[` + result1 + `]},{"role":"assistant","content":"done"}]`,
+		},
+		{
+			name:     "conversation ends on a tool_use",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `]}]`,
+		},
+		{
+			name:     "orphan tool_result",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":"ok"},{"role":"user","content":[` + result1 + `,{"type":"text","text":"go on"}]}]`,
+			err:      `messages.2.content.0: tool_result references tool_use_id "t1", which has no tool_use in the preceding assistant message`,
+			repaired: `[{"role":"user","content":"hi"},{"role":"assistant","content":"ok"},{"role":"user","content":[{"type":"text","text":"go on"}]}]`,
+		},
+		{
+			name:     "orphan tool_result alone in its message",
+			messages: `[{"role":"user","content":[` + result1 + `]},{"role":"assistant","content":"ok"}]`,
+			err:      `messages.0.content.0: tool_result references tool_use_id "t1"`,
+			repaired: `[{"role":"user","content":[{"type":"text","text":"[orphaned tool_result removed]"}]},{"role":"assistant","content":"ok"}]`,
+		},
+		{
+			name:     "answered twice",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `]},{"role":"user","content":[` + result1 + `,` + result1 + `]}]`,
+			err:      `messages.2.content.1: tool_result references tool_use_id "t1"`,
+			repaired: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `]},{"role":"user","content":[` + result1 + `]}]`,
+		},
+		{
+			name:     "dangling tool_use among parallel calls",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `,` + use2 + `]},{"role":"user","content":[` + result1 + `]}]`,
+			err:      `messages.1.content.1: tool_use "t2" has no tool_result in the following user message`,
+			repaired: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `,` + use2 + `]},{"role":"user","content":[` + empty2 + `,` + result1 + `]}]`,
+		},
+		{
+			name:     "dangling tool_use answered by text",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `,` + use2 + `]},{"role":"user","content":"never mind"}]`,
+			err:      `messages.1.content.0: tool_use "t1" has no tool_result in the following user message (and 1 more pairing problems)`,
+			repaired: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `,` + use2 + `]},{"role":"user","content":[` + empty1 + `,` + empty2 + `,{"type":"text","text":"never mind"}]}]`,
+		},
+		{
+			name:     "result in the wrong turn",
+			messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `]},{"role":"user","content":"wait"},{"role":"assistant","content":"ok"},{"role":"user","content":[` + result1 + `]}]`,
+			err:      `messages.1.content.0: tool_use "t1" has no tool_result`,
+			repaired: `[{"role":"user","content":"hi"},{"role":"assistant","content":[` + use1 + `]},{"role":"user","content":[` + empty1 + `,{"type":"text","text":"wait"}]},{"role":"assistant","content":"ok"},{"role":"user","content":[{"type":"text","text":"[orphaned tool_result removed]"}]}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse := func() *AnthropicRequest {
+				var req AnthropicRequest
+				if err := json.Unmarshal([]byte(`{"messages":`+tt.messages+`}`), &req); err != nil {
+					t.Fatal(err)
+				}
+				return &req
+			}
+
+			useConfig(t, func(c *config.Config) { c.RepairToolPairs = false })
+			repaired, err := checkToolPairs(testContext(context.Background()), parse())
+			if tt.err == "" {
+				if err != nil || repaired {
+					t.Fatalf("valid history: repaired = %v, err = %v", repaired, err)
+				}
+				return
+			}
+			var httpErr *api.HTTPError
+			if !errors.As(err, &httpErr) || httpErr.StatusCode != 400 || !strings.HasPrefix(httpErr.Message, tt.err) {
+				t.Errorf("error %v, want a 400 starting %q", err, tt.err)
+			}
+
+			useConfig(t, func(c *config.Config) { c.RepairToolPairs = true })
+			req := parse()
+			if repaired, err := checkToolPairs(testContext(context.Background()), req); err != nil || !repaired {
+				t.Fatalf("repair: repaired = %v, err = %v", repaired, err)
+			}
+			got, _ := json.Marshal(req.Messages)
+			if string(got) != tt.repaired {
+				t.Errorf("repaired messages\n got %s\nwant %s", got, tt.repaired)
+			}
+			if problems := findToolPairProblems(req.Messages); len(problems) > 0 {
+				t.Errorf("repaired history still has problems: %v", problems[0])
+			}
+		})
+	}
+}
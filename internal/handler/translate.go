@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+)
+
+type translateResponse struct {
+	Backend string `json:"backend"`
+	Model   string `json:"model"`
+	// AnthropicBeta is the header sent with native Messages requests.
+	AnthropicBeta string          `json:"anthropic_beta,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// Translate handles POST /api/translate — a dry run of POST /v1/messages.
+// It returns the payload the request would be sent upstream as, for the
+// backend given by ?backend= or else the one Messages would route to now,
+// failover included, without calling Copilot or recording metrics. The
+// request goes through Messages' own preparation, except that session
+// pins are neither applied nor updated. Nothing is masked in the
+// response; configured redactions apply as they would upstream.
+func Translate(w http.ResponseWriter, r *http.Request) {
+	backend := r.URL.Query().Get("backend")
+	switch backend {
+	case "", "chat", "responses", "messages":
+	default:
+		api.ForwardError(w, &api.HTTPError{
+			Message:    fmt.Sprintf("invalid backend %q: want chat, responses or messages", backend),
+			StatusCode: http.StatusBadRequest,
+		})
+		return
+	}
+
+	m, err := prepareMessages(w, r, true)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+
+	if backend == "chat" {
+		backend = "chat_completions"
+	}
+	backend = messagesBackend(m.model, backend, service.FailoverActive(r.Context()))
+	up, err := buildUpstreamPayload(r.Context(), &m.req, m.body, m.betaHeader, backend, m.trimmedTools)
+	if err != nil {
+		api.ForwardError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(translateResponse{
+		Backend:       backend,
+		Model:         m.req.Model,
+		AnthropicBeta: up.beta,
+		Payload:       up.body,
+	})
+}
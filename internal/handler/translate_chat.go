@@ -1,10 +1,15 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
@@ -25,8 +30,13 @@ RULES:
 
 const interleavedThinkingReminder = `<system-reminder>you MUST follow interleaved_thinking_protocol</system-reminder>`
 
+// priorReasoningPrefix introduces a Responses reasoning summary carried
+// into assistant text by reasoningSummaryFallback.
+const priorReasoningPrefix = "Prior reasoning summary: "
+
 // translateToOpenAI converts an Anthropic request to an OpenAI Chat Completions payload.
-func translateToOpenAI(req *AnthropicRequest, extraPrompt string) (*ChatCompletionRequest, error) {
+func translateToOpenAI(ctx context.Context, req *AnthropicRequest, extraPrompt string) (*ChatCompletionRequest, error) {
+	cfg := config.FromContext(ctx)
 	model := normalizeModelName(req.Model)
 	isClaudeModel := isClaude(model)
 
@@ -67,19 +77,18 @@ func translateToOpenAI(req *AnthropicRequest, extraPrompt string) (*ChatCompleti
 			messages = append(messages, translated...)
 			firstUserSeen = true
 		} else if msg.Role == "assistant" {
-			translated := translateAssistantMessage(blocks, isClaudeModel)
+			translated := translateAssistantMessage(blocks, isClaudeModel, cfg.ReasoningSummaryFallback)
 			messages = append(messages, translated...)
 		}
 	}
 
 	// Build request
 	ccReq := &ChatCompletionRequest{
-		Model:       model,
-		Messages:    messages,
-		Stream:      req.Stream,
-		Temperature: req.Temperature,
-		TopP:        req.TopP,
+		Model:    model,
+		Messages: messages,
+		Stream:   req.Stream,
 	}
+	ccReq.Temperature, ccReq.TopP = service.ApplySamplingPolicy(ctx, model, service.BackendChatCompletions, req.Temperature, req.TopP)
 
 	// Max tokens
 	maxTokens := req.MaxTokens
@@ -87,7 +96,7 @@ func translateToOpenAI(req *AnthropicRequest, extraPrompt string) (*ChatCompleti
 
 	// Thinking budget
 	if req.Thinking != nil && req.Thinking.BudgetTokens > 0 {
-		budget := clampThinkingBudget(req.Model, req.Thinking.BudgetTokens, req.MaxTokens)
+		budget := clampThinkingBudget(ctx, req.Model, req.Thinking.BudgetTokens, req.MaxTokens)
 		ccReq.MaxTokens = &budget
 	}
 
@@ -96,9 +105,10 @@ func translateToOpenAI(req *AnthropicRequest, extraPrompt string) (*ChatCompleti
 		ccReq.Stop = req.StopSequences
 	}
 
-	// Tools
+	// Tools (parallel_tool_calls is only valid alongside tools)
 	if len(req.Tools) > 0 {
-		ccReq.Tools = translateTools(req.Tools)
+		ccReq.Tools = translateTools(ctx, req.Tools)
+		ccReq.ParallelToolCalls = cfg.ResolveParallelToolCalls(model, requestedParallelToolCalls(req.ToolChoice))
 	}
 
 	// Tool choice
@@ -124,14 +134,35 @@ func translateUserMessage(blocks []ContentBlock, addThinkingReminder bool) []Ope
 		}
 	}
 
-	// Tool results become separate "tool" role messages
+	// Tool results become separate "tool" role messages. Tool messages
+	// can't carry images, so those follow in one user message after the
+	// last tool message (a user message between tool messages would break
+	// the tool_calls sequence), each labeled with its tool result ID.
+	var toolImages []OpenAIContentPart
 	for _, tr := range toolResults {
+		text := getToolResultText(tr.Content)
+		images := toolResultImages(tr.Content)
+		if len(images) > 0 {
+			marker := fmt.Sprintf("[image from tool result %s]", tr.ToolUseID)
+			if text == "" {
+				text = marker
+			}
+			for _, img := range images {
+				toolImages = append(toolImages, OpenAIContentPart{Type: "text", Text: marker}, img)
+			}
+		}
 		msgs = append(msgs, OpenAIMsg{
 			Role:       "tool",
-			Content:    getToolResultText(tr.Content),
+			Content:    text,
 			ToolCallID: tr.ToolUseID,
 		})
 	}
+	if len(toolImages) > 0 {
+		msgs = append(msgs, OpenAIMsg{
+			Role:    "user",
+			Content: toolImages,
+		})
+	}
 
 	// Other content becomes a user message
 	if len(otherBlocks) > 0 {
@@ -151,6 +182,26 @@ func translateUserMessage(blocks []ContentBlock, addThinkingReminder bool) []Ope
 	return msgs
 }
 
+// toolResultImages returns the images in a tool_result's content as OpenAI
+// image parts.
+func toolResultImages(raw json.RawMessage) []OpenAIContentPart {
+	var blocks []ContentBlock
+	if json.Unmarshal(raw, &blocks) != nil {
+		return nil
+	}
+	var parts []OpenAIContentPart
+	for _, b := range blocks {
+		if b.Type == "image" && b.Source != nil {
+			url := fmt.Sprintf("data:%s;base64,%s", b.Source.MediaType, b.Source.Data)
+			parts = append(parts, OpenAIContentPart{
+				Type:     "image_url",
+				ImageURL: &OpenAIImgURL{URL: url},
+			})
+		}
+	}
+	return parts
+}
+
 // buildUserContent builds OpenAI content from non-tool-result blocks.
 func buildUserContent(blocks []ContentBlock, addReminder bool) any {
 	// Check if there are any images
@@ -199,7 +250,7 @@ func buildUserContent(blocks []ContentBlock, addReminder bool) any {
 }
 
 // translateAssistantMessage translates Anthropic assistant blocks to OpenAI messages.
-func translateAssistantMessage(blocks []ContentBlock, isClaudeModel bool) []OpenAIMsg {
+func translateAssistantMessage(blocks []ContentBlock, isClaudeModel, reasoningSummaries bool) []OpenAIMsg {
 	msg := OpenAIMsg{Role: "assistant"}
 
 	var textParts []string
@@ -225,6 +276,15 @@ func translateAssistantMessage(blocks []ContentBlock, isClaudeModel bool) []Open
 			})
 
 		case "thinking":
+			// Responses API reasoning (from a model switch mid-session):
+			// its encrypted content means nothing here, but its summary
+			// can carry over as text
+			if reasoningSummaries && strings.Contains(b.Signature, "@") {
+				if b.Thinking != "" && b.Thinking != "Thinking..." {
+					textParts = append(textParts, priorReasoningPrefix+b.Thinking+"\n\n")
+				}
+				continue
+			}
 			if isClaudeModel {
 				// Filter out empty or placeholder thinking for Claude models
 				if b.Thinking == "" || b.Thinking == "Thinking..." {
@@ -256,21 +316,23 @@ func translateAssistantMessage(blocks []ContentBlock, isClaudeModel bool) []Open
 }
 
 // translateTools converts Anthropic tools to OpenAI function tools.
-func translateTools(tools []AnthropicTool) []OpenAITool {
-	result := make([]OpenAITool, len(tools))
-	for i, t := range tools {
-		var params any
-		if t.InputSchema != nil {
-			json.Unmarshal(t.InputSchema, &params)
+// Input schemas are sanitized for Copilot; tools whose schema cannot be
+// fixed may be dropped (see prepareToolParameters).
+func translateTools(ctx context.Context, tools []AnthropicTool) []OpenAITool {
+	result := make([]OpenAITool, 0, len(tools))
+	for _, t := range tools {
+		params, keep := prepareToolParameters(ctx, t)
+		if !keep {
+			continue
 		}
-		result[i] = OpenAITool{
+		result = append(result, OpenAITool{
 			Type: "function",
 			Function: OpenAIFunction{
 				Name:        t.Name,
 				Description: t.Description,
 				Parameters:  params,
 			},
-		}
+		})
 	}
 	return result
 }
@@ -303,9 +365,26 @@ func translateToolChoice(raw json.RawMessage) any {
 	return nil
 }
 
+// requestedParallelToolCalls returns false when the Anthropic tool_choice
+// sets disable_parallel_tool_use, or nil when the client expressed no
+// preference.
+func requestedParallelToolCalls(raw json.RawMessage) *bool {
+	if raw == nil {
+		return nil
+	}
+	var tc struct {
+		DisableParallelToolUse bool `json:"disable_parallel_tool_use"`
+	}
+	if err := json.Unmarshal(raw, &tc); err != nil || !tc.DisableParallelToolUse {
+		return nil
+	}
+	parallel := false
+	return &parallel
+}
+
 // clampThinkingBudget clamps the thinking budget to model-supported bounds.
-func clampThinkingBudget(modelID string, budget, maxTokens int) int {
-	model := state.Global.FindModel(modelID)
+func clampThinkingBudget(ctx context.Context, modelID string, budget, maxTokens int) int {
+	model := state.FromContext(ctx).FindModel(modelID)
 	minBudget := 1024
 	maxBudget := maxTokens - 1
 
@@ -330,13 +409,52 @@ func clampThinkingBudget(modelID string, budget, maxTokens int) int {
 	return budget
 }
 
+// chatChoiceHasText reports whether the choice carries text or reasoning.
+func chatChoiceHasText(m ChatCompletionM) bool {
+	return m.Content != nil && *m.Content != "" ||
+		m.ReasoningText != nil && *m.ReasoningText != "" ||
+		m.ReasoningOpaque != nil && *m.ReasoningOpaque != ""
+}
+
+// selectChatChoices returns the choices to merge into one Anthropic message,
+// in index order. Copilot sometimes splits one reply across choices (text in
+// one, tool calls in another, or content under a non-zero index next to an
+// empty index 0), so non-empty choices are merged. When more than one
+// carries text they are alternatives, and only the first non-empty choice is
+// kept. With no non-empty choice all are returned for their finish reasons.
+func selectChatChoices(resp *ChatCompletionResponse) []ChatCompletionChoice {
+	choices := append([]ChatCompletionChoice(nil), resp.Choices...)
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].Index < choices[j].Index })
+
+	var nonEmpty []ChatCompletionChoice
+	withText := 0
+	for _, c := range choices {
+		hasText := chatChoiceHasText(c.Message)
+		if hasText {
+			withText++
+		}
+		if hasText || len(c.Message.ToolCalls) > 0 {
+			nonEmpty = append(nonEmpty, c)
+		}
+	}
+	switch {
+	case len(nonEmpty) == 0:
+		return choices
+	case withText > 1:
+		slog.Warn("upstream returned alternative choices; keeping the first", "model", resp.Model, "kept", nonEmpty[0].Index, "dropped", len(nonEmpty)-1)
+		return nonEmpty[:1]
+	default:
+		return nonEmpty
+	}
+}
+
 // translateToAnthropic converts an OpenAI Chat Completion response to an
-// Anthropic response. Processes all choices, not just the first.
+// Anthropic response. The choices chosen by selectChatChoices are merged.
 func translateToAnthropic(resp *ChatCompletionResponse) *AnthropicResponse {
 	var content []ContentBlock
 	bestStopReason := "end_turn"
 
-	for _, choice := range resp.Choices {
+	for _, choice := range selectChatChoices(resp) {
 		msg := choice.Message
 
 		// Thinking/reasoning
@@ -366,28 +484,25 @@ func translateToAnthropic(resp *ChatCompletionResponse) *AnthropicResponse {
 			inputRaw := json.RawMessage(tc.Function.Arguments)
 			content = append(content, ContentBlock{
 				Type:  "tool_use",
-				ID:    tc.ID,
+				ID:    anthropicToolUseID(tc.ID),
 				Name:  tc.Function.Name,
 				Input: inputRaw,
 			})
 		}
 
-		// Pick the best stop reason: tool_calls > stop > others
-		reason := mapStopReason(choice.FinishReason)
-		if reason == "tool_use" {
-			bestStopReason = "tool_use"
-		} else if reason == "end_turn" && bestStopReason != "tool_use" {
-			bestStopReason = "end_turn"
-		} else if bestStopReason == "end_turn" {
-			// Keep end_turn as default unless we see something more specific
-		} else {
+		// Pick the best stop reason: tool_use > refusal > max_tokens > end_turn
+		if reason := mapStopReason(choice.FinishReason); stopReasonRank[reason] > stopReasonRank[bestStopReason] {
 			bestStopReason = reason
 		}
 	}
 
 	// Ensure at least one content block
 	if len(content) == 0 {
-		content = append(content, ContentBlock{Type: "text", Text: ""})
+		text := ""
+		if bestStopReason == "refusal" {
+			text = filteredText
+		}
+		content = append(content, ContentBlock{Type: "text", Text: text})
 	}
 
 	// Usage
@@ -403,7 +518,8 @@ func translateToAnthropic(resp *ChatCompletionResponse) *AnthropicResponse {
 	}
 
 	return &AnthropicResponse{
-		ID:         resp.ID,
+		ID:         anthropicMessageID(resp.ID),
+		UpstreamID: resp.ID,
 		Type:       "message",
 		Role:       "assistant",
 		Content:    content,
@@ -1,6 +1,11 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
@@ -17,20 +22,36 @@ type SSEEvent struct {
 type AnthropicStreamState struct {
 	blockIndex    int
 	openBlockType string // "text", "tool_use", "thinking", ""
-	toolCallMap   map[int]int // OpenAI tool call index -> Anthropic block index
+	toolCallMap   map[toolCallKey]int // OpenAI choice/tool call index -> Anthropic block index
+	// pendingTool is a tool call whose block start waits for its ID or
+	// name, which some chunks only carry on a later delta
+	pendingTool *pendingToolCall
+	// syntheticToolIDs are the IDs made up for tool calls that had none
+	// when their block started
+	syntheticToolIDs map[toolCallKey]string
+	messageID        string
+	// primaryChoice is the choice index whose text and thinking are
+	// streamed (-1 until a choice carries any); the text of other choices
+	// is dropped, their tool calls kept
+	primaryChoice  int
+	droppedChoices map[int]bool // choice indices whose text was dropped, logged once
 	hasStarted    bool
+	finished      bool
 	model         string
 	inputTokens   int
 	outputTokens  int
 	cachedTokens  int
+	stopReason    string
 	isClaudeModel bool
+	toolNames     *toolNameMap // restores client tool names; nil = unchanged
 }
 
 // NewAnthropicStreamState creates a new stream state.
 func NewAnthropicStreamState(model string) *AnthropicStreamState {
 	return &AnthropicStreamState{
 		blockIndex:    -1,
-		toolCallMap:   make(map[int]int),
+		toolCallMap:   make(map[toolCallKey]int),
+		primaryChoice: -1,
 		model:         model,
 		isClaudeModel: isClaude(model),
 	}
@@ -41,14 +62,57 @@ func (s *AnthropicStreamState) TokenCounts() (input, output, cached int) {
 	return s.inputTokens, s.outputTokens, s.cachedTokens
 }
 
+// toolCallKey identifies a streamed tool call. Tool call indices restart at
+// 0 in each choice.
+type toolCallKey struct {
+	choice, index int
+}
+
+// pendingToolCall collects the first deltas of a tool call until it has
+// both an ID and a name.
+type pendingToolCall struct {
+	key  toolCallKey
+	id   string
+	name string
+	args strings.Builder
+}
+
+func (p *pendingToolCall) merge(tc ToolCallDelta) {
+	if p.id == "" {
+		p.id = tc.ID
+	}
+	if tc.Function != nil {
+		if p.name == "" {
+			p.name = tc.Function.Name
+		}
+		p.args.WriteString(tc.Function.Arguments)
+	}
+}
+
+func (p *pendingToolCall) ready() bool {
+	return p.id != "" && p.name != ""
+}
+
+// StopReason returns the Anthropic stop reason, or "" before a finish
+// chunk.
+func (s *AnthropicStreamState) StopReason() string {
+	return s.stopReason
+}
+
 // TranslateChunk translates a single OpenAI Chat Completion chunk into
-// zero or more Anthropic SSE events.
+// zero or more Anthropic SSE events. Choices are handled in index order, so
+// a chunk whose only choice isn't index 0 still streams. The message ends
+// with Finish, once the upstream stream has ended.
 func (s *AnthropicStreamState) TranslateChunk(chunk *ChatCompletionChunk) []SSEEvent {
 	var events []SSEEvent
+	if s.finished {
+		return nil
+	}
 
 	// Emit message_start on first chunk
 	if !s.hasStarted {
 		s.hasStarted = true
+		s.messageID = chunk.ID
 		usage := AnthropicUsage{}
 		if chunk.Usage != nil {
 			usage.InputTokens = chunk.Usage.PromptTokens
@@ -64,27 +128,69 @@ func (s *AnthropicStreamState) TranslateChunk(chunk *ChatCompletionChunk) []SSEE
 			Data: MessageStartEvent{
 				Type: "message_start",
 				Message: AnthropicResponse{
-					ID:    chunk.ID,
-					Type:  "message",
-					Role:  "assistant",
-					Model: chunk.Model,
-					Usage: usage,
+					ID:         anthropicMessageID(chunk.ID),
+					UpstreamID: chunk.ID,
+					Type:       "message",
+					Role:       "assistant",
+					Model:      chunk.Model,
+					Usage:      usage,
 				},
 			},
 		})
 	}
 
-	if len(chunk.Choices) == 0 {
-		// Usage-only chunk at the end
-		if chunk.Usage != nil {
-			s.outputTokens = chunk.Usage.CompletionTokens
-		}
-		return events
+	// Usage arrives with the finish chunk or in a usage-only chunk after it
+	if chunk.Usage != nil {
+		s.outputTokens = chunk.Usage.CompletionTokens
 	}
+	choices := chunk.Choices
+	if len(choices) > 1 {
+		choices = append([]ChatCompletionChunkChoice(nil), choices...)
+		sort.SliceStable(choices, func(i, j int) bool { return choices[i].Index < choices[j].Index })
+	}
+	for _, choice := range choices {
+		events = append(events, s.translateChoice(choice)...)
+	}
+	return events
+}
 
-	choice := chunk.Choices[0]
+// translateChoice translates one choice of a chunk.
+func (s *AnthropicStreamState) translateChoice(choice ChatCompletionChunkChoice) []SSEEvent {
+	var events []SSEEvent
 	delta := choice.Delta
 
+	hasText := delta.Content != nil && *delta.Content != "" ||
+		delta.ReasoningText != nil && *delta.ReasoningText != "" ||
+		delta.ReasoningOpaque != nil && *delta.ReasoningOpaque != ""
+	if hasText && s.primaryChoice < 0 {
+		s.primaryChoice = choice.Index
+	}
+	if hasText && choice.Index != s.primaryChoice {
+		if !s.droppedChoices[choice.Index] {
+			if s.droppedChoices == nil {
+				s.droppedChoices = make(map[int]bool)
+			}
+			s.droppedChoices[choice.Index] = true
+			slog.Warn("dropping text of extra stream choice", "model", s.model, "choice", choice.Index, "kept", s.primaryChoice)
+		}
+		delta.Content, delta.ReasoningText, delta.ReasoningOpaque = nil, nil, nil
+	}
+
+	// A choice whose text was dropped only ends the message with its tool
+	// calls, which are kept
+	if choice.FinishReason != nil {
+		reason := mapStopReason(*choice.FinishReason)
+		if !s.droppedChoices[choice.Index] || reason == "tool_use" {
+			if s.stopReason == "" || stopReasonRank[reason] > stopReasonRank[s.stopReason] {
+				s.stopReason = reason
+			}
+		}
+	}
+	if hasText && choice.Index == s.primaryChoice {
+		// Text after a tool call that is still waiting for its ID or name
+		events = append(events, s.flushPendingToolCall()...)
+	}
+
 	// Handle reasoning_text (thinking)
 	if delta.ReasoningText != nil && *delta.ReasoningText != "" {
 		if s.openBlockType == "text" && s.isClaudeModel {
@@ -196,31 +302,32 @@ func (s *AnthropicStreamState) TranslateChunk(chunk *ChatCompletionChunk) []SSEE
 
 	// Handle tool calls
 	for _, tc := range delta.ToolCalls {
-		blockIdx, exists := s.toolCallMap[tc.Index]
+		key := toolCallKey{choice.Index, tc.Index}
+		if p := s.pendingTool; p != nil && p.key == key {
+			p.merge(tc)
+			if p.ready() {
+				s.pendingTool = nil
+				events = append(events, s.startToolCall(p)...)
+			}
+			continue
+		}
+		blockIdx, exists := s.toolCallMap[key]
 		if !exists {
-			// New tool call: close current block, open tool_use
-			events = append(events, s.closeCurrentBlock()...)
-			s.blockIndex++
-			blockIdx = s.blockIndex
-			s.toolCallMap[tc.Index] = blockIdx
-			s.openBlockType = "tool_use"
-
-			name := ""
-			if tc.Function != nil {
-				name = tc.Function.Name
+			// New tool call: its block starts once the ID and name are known
+			events = append(events, s.flushPendingToolCall()...)
+			p := &pendingToolCall{key: key}
+			p.merge(tc)
+			if !p.ready() {
+				s.pendingTool = p
+				continue
 			}
-			events = append(events, SSEEvent{
-				Event: "content_block_start",
-				Data: ContentBlockStartEvent{
-					Type:  "content_block_start",
-					Index: blockIdx,
-					ContentBlock: ContentBlock{
-						Type: "tool_use",
-						ID:   tc.ID,
-						Name: name,
-					},
-				},
-			})
+			events = append(events, s.startToolCall(p)...)
+			continue
+		}
+		if id, ok := s.syntheticToolIDs[key]; ok && tc.ID != "" && tc.ID != id {
+			// Too late to send; the client keeps the synthesized ID
+			slog.Debug("tool call ID arrived after its block started", "model", s.model, "id", tc.ID, "sent", id)
+			delete(s.syntheticToolIDs, key)
 		}
 
 		if tc.Function != nil && tc.Function.Arguments != "" {
@@ -235,38 +342,102 @@ func (s *AnthropicStreamState) TranslateChunk(chunk *ChatCompletionChunk) []SSEE
 		}
 	}
 
-	// Handle finish_reason
-	if choice.FinishReason != nil {
-		events = append(events, s.closeCurrentBlock()...)
-
-		stopReason := mapStopReason(*choice.FinishReason)
+	return events
+}
 
-		// Update usage from final chunk
-		if chunk.Usage != nil {
-			s.outputTokens = chunk.Usage.CompletionTokens
-		}
+// Finish closes the message after the upstream stream has ended: the open
+// block, then message_delta with the highest ranked stop reason of all
+// choices and message_stop. It returns nothing if no choice finished (the
+// stream was cut off) or the message was already finished.
+func (s *AnthropicStreamState) Finish() []SSEEvent {
+	if s.finished || !s.hasStarted || s.stopReason == "" {
+		return nil
+	}
+	s.finished = true
+	events := s.flushPendingToolCall()
+	events = append(events, s.closeCurrentBlock()...)
+	events = append(events, SSEEvent{
+		Event: "message_delta",
+		Data: MessageDeltaEvent{
+			Type: "message_delta",
+			Delta: MessageDelta{
+				StopReason: s.stopReason,
+			},
+			Usage: DeltaUsage{
+				OutputTokens: s.outputTokens,
+			},
+		},
+	})
+	events = append(events, SSEEvent{
+		Event: "message_stop",
+		Data:  MessageStopEvent{Type: "message_stop"},
+	})
+	return events
+}
 
-		events = append(events, SSEEvent{
-			Event: "message_delta",
-			Data: MessageDeltaEvent{
-				Type: "message_delta",
-				Delta: MessageDelta{
-					StopReason: stopReason,
-				},
-				Usage: DeltaUsage{
-					OutputTokens: s.outputTokens,
-				},
+// startToolCall closes the current block and opens a tool_use block for
+// p, with the arguments received so far.
+func (s *AnthropicStreamState) startToolCall(p *pendingToolCall) []SSEEvent {
+	events := s.closeCurrentBlock()
+	s.blockIndex++
+	s.toolCallMap[p.key] = s.blockIndex
+	s.openBlockType = "tool_use"
+	events = append(events, SSEEvent{
+		Event: "content_block_start",
+		Data: ContentBlockStartEvent{
+			Type:  "content_block_start",
+			Index: s.blockIndex,
+			ContentBlock: ContentBlock{
+				Type: "tool_use",
+				ID:   anthropicToolUseID(p.id),
+				Name: s.toolNames.original(p.name),
 			},
-		})
+		},
+	})
+	if p.args.Len() > 0 {
 		events = append(events, SSEEvent{
-			Event: "message_stop",
-			Data:  MessageStopEvent{Type: "message_stop"},
+			Event: "content_block_delta",
+			Data: ContentBlockDeltaEvent{
+				Type:  "content_block_delta",
+				Index: s.blockIndex,
+				Delta: Delta{Type: "input_json_delta", PartialJSON: p.args.String()},
+			},
 		})
 	}
-
 	return events
 }
 
+// flushPendingToolCall starts the block of a tool call still waiting for
+// its ID or name, because something else comes next. A missing ID is
+// synthesized, stable for the message and tool call, so the client's
+// tool_result can refer to it.
+func (s *AnthropicStreamState) flushPendingToolCall() []SSEEvent {
+	p := s.pendingTool
+	if p == nil {
+		return nil
+	}
+	s.pendingTool = nil
+	if p.id == "" {
+		p.id = syntheticToolUseID(s.messageID, p.key)
+		if s.syntheticToolIDs == nil {
+			s.syntheticToolIDs = make(map[toolCallKey]string)
+		}
+		s.syntheticToolIDs[p.key] = p.id
+		slog.Warn("tool call without an ID, synthesized one", "model", s.model, "tool", p.name, "id", p.id)
+	}
+	if p.name == "" {
+		slog.Warn("tool call without a name", "model", s.model, "id", p.id)
+	}
+	return s.startToolCall(p)
+}
+
+// syntheticToolUseID derives a tool_use ID from the message ID and the
+// tool call's position.
+func syntheticToolUseID(messageID string, key toolCallKey) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d", messageID, key.choice, key.index)))
+	return "toolu_" + hex.EncodeToString(sum[:12])
+}
+
 func (s *AnthropicStreamState) closeCurrentBlock() []SSEEvent {
 	if s.openBlockType == "" {
 		return nil
@@ -363,6 +534,35 @@ func detectVisionInBlocks(blocks []ContentBlock) bool {
 	return false
 }
 
+// selectBackend returns the backend serving /v1/messages requests for
+// model: "messages", "responses" or "chat_completions".
+func selectBackend(model *state.Model) string {
+	if model != nil && isMessagesSupported(model) {
+		return "messages"
+	} else if model != nil && isResponsesSupported(model) {
+		return "responses"
+	}
+	return "chat_completions"
+}
+
+// messagesBackend returns the backend Messages sends a request for model
+// to: forced (X-Backend, already checked) when set, else selectBackend's
+// choice, except that while failover is active everything goes through
+// Chat Completions, the only API the alternate upstreams speak.
+func messagesBackend(model *state.Model, forced string, failover bool) string {
+	switch {
+	case forced != "":
+		return forced
+	case failover:
+		return "chat_completions"
+	}
+	return selectBackend(model)
+}
+
+// MessagesBackend is the backend a /v1/messages request for model goes
+// to with no override and no failover, for callers outside the handlers.
+func MessagesBackend(model *state.Model) string { return messagesBackend(model, "", false) }
+
 // isResponsesSupported checks if a model supports the Responses API.
 func isResponsesSupported(model *state.Model) bool {
 	if model == nil {
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestTranslateToAnthropicChoices(t *testing.T) {
+	tests := []struct {
+		name   string
+		resp   string
+		text   []string // text blocks, in order
+		tools  []string // tool_use names, in order
+		reason string
+	}{
+		{
+			name:   "single choice",
+			resp:   `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi."},"finish_reason":"stop"}]}`,
+			text:   []string{"Hi."},
+			reason: "end_turn",
+		},
+		{
+			name: "content under index 1 next to an empty index 0",
+			resp: `{"choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":"stop"},` +
+				`{"index":1,"message":{"role":"assistant","content":"The tests pass."},"finish_reason":"stop"}]}`,
+			text:   []string{"The tests pass."},
+			reason: "end_turn",
+		},
+		{
+			name: "alternatives out of order keep index 0",
+			resp: `{"choices":[{"index":1,"message":{"role":"assistant","content":"Second"},"finish_reason":"length"},` +
+				`{"index":0,"message":{"role":"assistant","content":"First"},"finish_reason":"stop"}]}`,
+			text:   []string{"First"},
+			reason: "end_turn",
+		},
+		{
+			name: "text and tool calls split across choices are merged",
+			resp: `{"choices":[{"index":0,"message":{"role":"assistant","content":"Reading the file."},"finish_reason":"stop"},` +
+				`{"index":1,"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"Read","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+			text:   []string{"Reading the file."},
+			tools:  []string{"Read"},
+			reason: "tool_use",
+		},
+		{
+			name:   "no content keeps the finish reason",
+			resp:   `{"choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":"length"}]}`,
+			text:   []string{""},
+			reason: "max_tokens",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ChatCompletionResponse
+			if err := json.Unmarshal([]byte(tt.resp), &resp); err != nil {
+				t.Fatal(err)
+			}
+			got := translateToAnthropic(&resp)
+			var text, tools []string
+			for _, b := range got.Content {
+				switch b.Type {
+				case "text":
+					text = append(text, b.Text)
+				case "tool_use":
+					tools = append(tools, b.Name)
+				}
+			}
+			if !slices.Equal(text, tt.text) || !slices.Equal(tools, tt.tools) {
+				t.Errorf("got text %q, tools %q; want %q, %q", text, tools, tt.text, tt.tools)
+			}
+			if got.StopReason != tt.reason {
+				t.Errorf("stop reason %q, want %q", got.StopReason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestTranslateToOpenAIToolResultImages(t *testing.T) {
+	const (
+		png        = `{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0K"}}`
+		imagePart  = `{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0K"}}`
+		toolUses   = `{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"Screenshot","input":{}},{"type":"tool_use","id":"t2","name":"Read","input":{}}]}`
+		marker1    = `{"type":"text","text":"[image from tool result t1]"}`
+		marker2    = `{"type":"text","text":"[image from tool result t2]"}`
+		textResult = `{"type":"tool_result","tool_use_id":"t2","content":"file contents"}`
+	)
+	tests := []struct {
+		name    string
+		results string // content of the user message answering toolUses
+		want    string // messages translated from it
+	}{
+		{
+			name:    "text and image",
+			results: `[{"type":"tool_result","tool_use_id":"t1","content":[{"type":"text","text":"Took a screenshot"},` + png + `]},` + textResult + `]`,
+			want: `[{"role":"tool","content":"Took a screenshot","tool_call_id":"t1"},{"role":"tool","content":"file contents","tool_call_id":"t2"},` +
+				`{"role":"user","content":[` + marker1 + `,` + imagePart + `]}]`,
+		},
+		{
+			name:    "image only",
+			results: `[{"type":"tool_result","tool_use_id":"t1","content":[` + png + `]},` + textResult + `]`,
+			want: `[{"role":"tool","content":"[image from tool result t1]","tool_call_id":"t1"},{"role":"tool","content":"file contents","tool_call_id":"t2"},` +
+				`{"role":"user","content":[` + marker1 + `,` + imagePart + `]}]`,
+		},
+		{
+			name:    "images from both results, then user text",
+			results: `[{"type":"tool_result","tool_use_id":"t1","content":[` + png + `,` + png + `]},{"type":"tool_result","tool_use_id":"t2","content":[{"type":"text","text":"diagram"},` + png + `]},{"type":"text","text":"what changed?"}]`,
+			want: `[{"role":"tool","content":"[image from tool result t1]","tool_call_id":"t1"},{"role":"tool","content":"diagram","tool_call_id":"t2"},` +
+				`{"role":"user","content":[` + marker1 + `,` + imagePart + `,` + marker1 + `,` + imagePart + `,` + marker2 + `,` + imagePart + `]},` +
+				`{"role":"user","content":"what changed?"}]`,
+		},
+		{
+			name:    "no images",
+			results: `[{"type":"tool_result","tool_use_id":"t1","content":"done"},` + textResult + `]`,
+			want:    `[{"role":"tool","content":"done","tool_call_id":"t1"},{"role":"tool","content":"file contents","tool_call_id":"t2"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req AnthropicRequest
+			body := `{"model":"gpt-4.1","max_tokens":1024,"messages":[{"role":"user","content":"look"},` + toolUses + `,{"role":"user","content":` + tt.results + `}]}`
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				t.Fatal(err)
+			}
+			if !hasVision(req.Messages) != (tt.name == "no images") {
+				t.Errorf("hasVision = %v", hasVision(req.Messages))
+			}
+			out, err := translateToOpenAI(testContext(context.Background()), &req, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// after the user prompt and the assistant's tool calls
+			got, _ := json.Marshal(out.Messages[2:])
+			var gotV, wantV any
+			json.Unmarshal(got, &gotV)
+			if err := json.Unmarshal([]byte(tt.want), &wantV); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotV, wantV) {
+				t.Errorf("messages\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
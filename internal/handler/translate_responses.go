@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"regexp"
 	"strings"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
 )
 
 var (
@@ -15,20 +18,20 @@ var (
 )
 
 // translateToResponses converts an Anthropic request to a Responses API payload.
-func translateToResponses(req *AnthropicRequest, extraPrompt string) (*ResponsesPayload, error) {
+func translateToResponses(ctx context.Context, req *AnthropicRequest, extraPrompt string) (*ResponsesPayload, error) {
 	model := normalizeModelName(req.Model)
 
 	// Build input items from messages
 	var input []ResponsesInput
 	for _, msg := range req.Messages {
 		blocks := ParseMessageContent(msg.Content)
-		items := translateMsgToResponsesInput(msg.Role, blocks, model)
+		items := translateMsgToResponsesInput(ctx, msg.Role, blocks, model)
 		input = append(input, items...)
 	}
+	input = dedupeResponsesInput(input)
 
-	// Instructions from system prompt (Responses API joins blocks with space,
-	// and appends extraPrompt to the first block before joining — matching TS)
-	instructions := parseSystemPromptForResponses(req.System, extraPrompt)
+	// Instructions from system prompt (ordering per responsesInstructions)
+	instructions := buildResponsesInstructions(ctx, req.System, extraPrompt)
 
 	// Max output tokens (minimum 12800)
 	maxOutput := req.MaxTokens
@@ -36,28 +39,35 @@ func translateToResponses(req *AnthropicRequest, extraPrompt string) (*Responses
 		maxOutput = 12800
 	}
 
-	// Temperature forced to 1 for reasoning models
-	temp := float64(1)
+	// Temperature and top_p per the model's sampling policy
+	temperature, topP := service.ApplySamplingPolicy(ctx, model, service.BackendResponses, req.Temperature, req.TopP)
 
 	// Reasoning config from config system
 	reasoning := &ResponsesReasoning{
-		Effort:  config.GetReasoningEffort(model),
+		Effort:  req.reasoningEffort(ctx),
 		Summary: "detailed",
 	}
 
 	storeFalse := false
-	parallelTrue := true
+
+	// Parallel tool calls default to on for the Responses API
+	parallel := config.FromContext(ctx).ResolveParallelToolCalls(model, requestedParallelToolCalls(req.ToolChoice))
+	if parallel == nil {
+		parallelTrue := true
+		parallel = &parallelTrue
+	}
 
 	payload := &ResponsesPayload{
 		Model:             model,
 		Input:             input,
 		Instructions:      instructions,
 		MaxOutputTokens:   maxOutput,
-		Temperature:       &temp,
+		Temperature:       temperature,
+		TopP:              topP,
 		Reasoning:         reasoning,
 		Include:           []string{"reasoning.encrypted_content"},
 		Store:             &storeFalse,
-		ParallelToolCalls: &parallelTrue,
+		ParallelToolCalls: parallel,
 		Stream:            req.Stream,
 		ServiceTier:       nil,
 	}
@@ -66,9 +76,9 @@ func translateToResponses(req *AnthropicRequest, extraPrompt string) (*Responses
 	if len(req.Tools) > 0 {
 		var tools []any
 		for _, t := range req.Tools {
-			var params any
-			if t.InputSchema != nil {
-				json.Unmarshal(t.InputSchema, &params)
+			params, keep := prepareToolParameters(ctx, t)
+			if !keep {
+				continue
 			}
 			tools = append(tools, map[string]any{
 				"type": "function",
@@ -94,9 +104,9 @@ func translateToResponses(req *AnthropicRequest, extraPrompt string) (*Responses
 }
 
 // translateMsgToResponsesInput converts Anthropic message blocks to Responses input items.
-func translateMsgToResponsesInput(role string, blocks []ContentBlock, model string) []ResponsesInput {
+func translateMsgToResponsesInput(ctx context.Context, role string, blocks []ContentBlock, model string) []ResponsesInput {
 	var items []ResponsesInput
-	isCodex := strings.Contains(model, "codex")
+	codexPhases := config.FromContext(ctx).UsesCodexPhases(model)
 
 	if role == "user" {
 		// Separate tool results from other content
@@ -174,8 +184,10 @@ func translateMsgToResponsesInput(role string, blocks []ContentBlock, model stri
 			}
 		}
 
-		// Add text as a message (use output_text content type for assistant)
-		if len(textParts) > 0 {
+		// Add text as a message (use output_text content type for assistant).
+		// Codex models expect every turn on a channel, so a turn of only
+		// tool calls gets an empty commentary message.
+		if len(textParts) > 0 || (codexPhases && hasToolUse) {
 			text := strings.Join(textParts, "")
 			var content any
 			content = []map[string]string{{"type": "output_text", "text": text}}
@@ -185,7 +197,7 @@ func translateMsgToResponsesInput(role string, blocks []ContentBlock, model stri
 				Content: content,
 			}
 			// Codex phase assignment
-			if isCodex && strings.Contains(model, "gpt-5.3-codex") {
+			if codexPhases {
 				if hasToolUse {
 					msgItem.Phase = "commentary"
 				} else {
@@ -199,6 +211,38 @@ func translateMsgToResponsesInput(role string, blocks []ContentBlock, model stri
 	return items
 }
 
+// dedupeResponsesInput drops reasoning items whose ID and function calls
+// whose call_id already appeared earlier in the input. Claude Code can
+// replay an assistant turn it already sent, and Copilot rejects the
+// request with "duplicate item id". The first occurrence is kept.
+func dedupeResponsesInput(input []ResponsesInput) []ResponsesInput {
+	seenReasoning := make(map[string]bool)
+	seenCalls := make(map[string]bool)
+	var droppedReasoning, droppedCalls []string
+	out := input[:0]
+	for _, item := range input {
+		switch {
+		case item.Type == "reasoning" && item.ID != "":
+			if seenReasoning[item.ID] {
+				droppedReasoning = append(droppedReasoning, item.ID)
+				continue
+			}
+			seenReasoning[item.ID] = true
+		case item.Type == "function_call" && item.CallID != "":
+			if seenCalls[item.CallID] {
+				droppedCalls = append(droppedCalls, item.CallID)
+				continue
+			}
+			seenCalls[item.CallID] = true
+		}
+		out = append(out, item)
+	}
+	if len(droppedReasoning) > 0 || len(droppedCalls) > 0 {
+		slog.Warn("dropped duplicate Responses input items", "reasoning", droppedReasoning, "function_calls", droppedCalls)
+	}
+	return out
+}
+
 // buildResponsesContent builds content for a Responses input message.
 func buildResponsesContent(blocks []ContentBlock) any {
 	hasImages := false
@@ -359,7 +403,7 @@ func translateResponsesResultToAnthropic(result *ResponsesResult) *AnthropicResp
 			input := parseToolInput(item.Arguments)
 			content = append(content, ContentBlock{
 				Type:  "tool_use",
-				ID:    item.CallID,
+				ID:    anthropicToolUseID(item.CallID),
 				Name:  item.Name,
 				Input: input,
 			})
@@ -413,7 +457,8 @@ func translateResponsesResultToAnthropic(result *ResponsesResult) *AnthropicResp
 	}
 
 	return &AnthropicResponse{
-		ID:         result.ID,
+		ID:         anthropicMessageID(result.ID),
+		UpstreamID: result.ID,
 		Type:       "message",
 		Role:       "assistant",
 		Content:    content,
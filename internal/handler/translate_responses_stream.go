@@ -3,6 +3,8 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
 )
 
@@ -15,6 +17,7 @@ type ResponsesStreamState struct {
 	hasStarted       bool
 	messageCompleted bool
 	model            string
+	toolNames        *toolNameMap // restores client tool names; nil = unchanged
 
 	// For infinite whitespace detection
 	wsRunLength map[int]int // output_index -> consecutive whitespace count
@@ -28,6 +31,16 @@ type ResponsesStreamState struct {
 	// Track text block indices by composite key "outputIndex:contentIndex"
 	textBlockByKey map[string]int
 
+	// Output indexes seen in response.output_item.added
+	addedOutputs map[int]bool
+
+	// eagerTextBlocks opens a text block when a message item is added,
+	// before its first delta (eagerTextBlocks config)
+	eagerTextBlocks bool
+	// Text blocks opened that way that no content part has claimed yet:
+	// output_index -> block index
+	eagerTextBlock map[int]int
+
 	// Token counts for metrics
 	inputTokens  int
 	outputTokens int
@@ -44,6 +57,8 @@ func NewResponsesStreamState(model string) *ResponsesStreamState {
 		reasoningSummaryBlock: make(map[int]int),
 		blockHasDelta:         make(map[int]bool),
 		textBlockByKey:        make(map[string]int),
+		addedOutputs:          make(map[int]bool),
+		eagerTextBlock:        make(map[int]int),
 	}
 }
 
@@ -88,11 +103,12 @@ func (s *ResponsesStreamState) TranslateEvent(eventType, data string) ([]SSEEven
 			Data: MessageStartEvent{
 				Type: "message_start",
 				Message: AnthropicResponse{
-					ID:    evt.Response.ID,
-					Type:  "message",
-					Role:  "assistant",
-					Model: evt.Response.Model,
-					Usage: usage,
+					ID:         anthropicMessageID(evt.Response.ID),
+					UpstreamID: evt.Response.ID,
+					Type:       "message",
+					Role:       "assistant",
+					Model:      evt.Response.Model,
+					Usage:      usage,
 				},
 			},
 		})
@@ -113,6 +129,23 @@ func (s *ResponsesStreamState) TranslateEvent(eventType, data string) ([]SSEEven
 		}
 		json.Unmarshal(evt.Item, &item)
 
+		// Some models add an output item again after an internal retry;
+		// the restarted item gets fresh blocks
+		if s.addedOutputs[evt.OutputIndex] {
+			slog.Warn("responses stream: output item added again, restarting its blocks",
+				"output_index", evt.OutputIndex, "type", item.Type)
+			events = append(events, s.resetOutputIndex(evt.OutputIndex)...)
+		}
+		s.addedOutputs[evt.OutputIndex] = true
+
+		if item.Type == "message" && s.eagerTextBlocks {
+			// Show the client a block right away; the first content part
+			// of the item takes it over
+			events = append(events, s.closeCurrentBlock()...)
+			events = append(events, s.openTextBlock()...)
+			s.eagerTextBlock[evt.OutputIndex] = s.blockIndex
+		}
+
 		if item.Type == "function_call" {
 			// Close any open block
 			events = append(events, s.closeCurrentBlock()...)
@@ -128,8 +161,8 @@ func (s *ResponsesStreamState) TranslateEvent(eventType, data string) ([]SSEEven
 					Index: s.blockIndex,
 					ContentBlock: ContentBlock{
 						Type: "tool_use",
-						ID:   item.CallID,
-						Name: item.Name,
+						ID:   anthropicToolUseID(item.CallID),
+						Name: s.toolNames.original(item.Name),
 					},
 				},
 			})
@@ -201,6 +234,14 @@ func (s *ResponsesStreamState) TranslateEvent(eventType, data string) ([]SSEEven
 			events = append(events, s.closeCurrentBlock()...)
 		}
 
+		// Close an eagerly opened text block that got no text
+		if blockIdx, ok := s.eagerTextBlock[evt.OutputIndex]; ok {
+			delete(s.eagerTextBlock, evt.OutputIndex)
+			if s.openBlockType == "text" && s.blockIndex == blockIdx {
+				events = append(events, s.closeCurrentBlock()...)
+			}
+		}
+
 		// Close tool_use block when function_call is done
 		if item.Type == "function_call" {
 			if blockIdx, ok := s.toolCallBlocks[evt.OutputIndex]; ok {
@@ -488,31 +529,74 @@ func (s *ResponsesStreamState) TranslateEvent(eventType, data string) ([]SSEEven
 	return events, nil
 }
 
-// openOrGetTextBlock opens or retrieves a text block for the given output/content index.
+// resetOutputIndex forgets the blocks of an output item, so its later
+// events open new ones, and closes its block if it is the open one.
+func (s *ResponsesStreamState) resetOutputIndex(outputIndex int) []SSEEvent {
+	var blocks []int
+	if blockIdx, ok := s.toolCallBlocks[outputIndex]; ok {
+		blocks = append(blocks, blockIdx)
+		delete(s.toolCallBlocks, outputIndex)
+	}
+	if blockIdx, ok := s.reasoningSummaryBlock[outputIndex]; ok {
+		blocks = append(blocks, blockIdx)
+		delete(s.reasoningSummaryBlock, outputIndex)
+	}
+	prefix := fmt.Sprintf("%d:", outputIndex)
+	for key, blockIdx := range s.textBlockByKey {
+		if strings.HasPrefix(key, prefix) {
+			blocks = append(blocks, blockIdx)
+			delete(s.textBlockByKey, key)
+		}
+	}
+	if blockIdx, ok := s.eagerTextBlock[outputIndex]; ok {
+		blocks = append(blocks, blockIdx)
+		delete(s.eagerTextBlock, outputIndex)
+	}
+	delete(s.wsRunLength, outputIndex)
+
+	if s.openBlockType != "" && slices.Contains(blocks, s.blockIndex) {
+		return s.closeCurrentBlock()
+	}
+	return nil
+}
+
+// openOrGetTextBlock opens or retrieves a text block for the given
+// output/content index. The first content part of an output item takes
+// over the block eagerTextBlocks opened for it, if that is still open.
 func (s *ResponsesStreamState) openOrGetTextBlock(outputIndex, contentIndex int, events *[]SSEEvent) int {
 	key := fmt.Sprintf("%d:%d", outputIndex, contentIndex)
 	if blockIdx, ok := s.textBlockByKey[key]; ok {
 		return blockIdx
 	}
+	if blockIdx, ok := s.eagerTextBlock[outputIndex]; ok {
+		delete(s.eagerTextBlock, outputIndex)
+		if s.openBlockType == "text" && s.blockIndex == blockIdx {
+			s.textBlockByKey[key] = blockIdx
+			return blockIdx
+		}
+	}
 
-	// Open a new text block
 	*events = append(*events, s.closeCurrentBlock()...)
+	*events = append(*events, s.openTextBlock()...)
+	s.textBlockByKey[key] = s.blockIndex
+	return s.blockIndex
+}
+
+// openTextBlock opens a new text block; the current one must be closed.
+func (s *ResponsesStreamState) openTextBlock() []SSEEvent {
 	s.blockIndex++
-	blockIdx := s.blockIndex
-	s.textBlockByKey[key] = blockIdx
 	s.openBlockType = "text"
-	*events = append(*events, SSEEvent{
+	return []SSEEvent{{
 		Event: "content_block_start",
 		Data: ContentBlockStartEvent{
 			Type:  "content_block_start",
-			Index: blockIdx,
+			Index: s.blockIndex,
 			ContentBlock: ContentBlock{
 				Type: "text",
 				Text: "",
 			},
 		},
-	})
-	return blockIdx
+	}}
 }
 
 func (s *ResponsesStreamState) closeCurrentBlock() []SSEEvent {
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+func TestDedupeResponsesInput(t *testing.T) {
+	reasoning := func(id, summary string) ResponsesInput {
+		return ResponsesInput{Type: "reasoning", ID: id, Summary: []SummaryItem{{Type: "summary_text", Text: summary}}}
+	}
+	call := func(id string) ResponsesInput { return ResponsesInput{Type: "function_call", CallID: id, Name: "Bash"} }
+	output := func(id string) ResponsesInput { return ResponsesInput{Type: "function_call_output", CallID: id} }
+
+	tests := []struct {
+		name  string
+		input []ResponsesInput
+		want  []string // type:id of each item kept, with the summary of reasoning
+	}{
+		{"no duplicates", []ResponsesInput{reasoning("rs_1", "a"), call("c1"), output("c1")}, []string{"reasoning:rs_1:a", "function_call:c1", "function_call_output:c1"}},
+		{"replayed reasoning keeps the first", []ResponsesInput{reasoning("rs_1", "first"), call("c1"), output("c1"), reasoning("rs_1", "replay"), reasoning("rs_2", "b")}, []string{"reasoning:rs_1:first", "function_call:c1", "function_call_output:c1", "reasoning:rs_2:b"}},
+		{"replayed call", []ResponsesInput{call("c1"), call("c1"), output("c1")}, []string{"function_call:c1", "function_call_output:c1"}},
+		{"items without IDs kept", []ResponsesInput{{Type: "reasoning"}, {Type: "reasoning"}, {Type: "message"}, {Type: "message"}}, []string{"reasoning:", "reasoning:", "message:", "message:"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, item := range dedupeResponsesInput(tt.input) {
+			s := item.Type + ":" + item.ID + item.CallID
+			if len(item.Summary) > 0 {
+				s += ":" + item.Summary[0].Text
+			}
+			got = append(got, s)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestReplayedAssistantTurn sends a Claude Code transcript that replays an
+// assistant turn, which Copilot rejected with "duplicate item id", through
+// the Responses backend.
+func TestReplayedAssistantTurn(t *testing.T) {
+	body, err := os.ReadFile("testdata/transcripts/replayed-assistant-turn.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &servicetest.Fake{}
+	fake.Script(servicetest.Responses, servicetest.JSON(`{"id":"resp_1","object":"response","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Committed."}]}]}`))
+	useBackend(t, fake)
+	useModels(t, state.Model{ID: "gpt-5", SupportedEndpoints: []string{"/responses"}})
+
+	w := httptest.NewRecorder()
+	Messages(w, newRequest("POST", "/v1/messages", string(body)))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("upstream calls %v", fake.Endpoints())
+	}
+	var sent struct {
+		Input []ResponsesInput `json:"input"`
+	}
+	if err := json.Unmarshal(calls[0].Body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	ids := make(map[string]bool)
+	for _, item := range sent.Input {
+		id := item.ID + item.CallID
+		if item.Type == "message" {
+			id = item.Role
+		}
+		got = append(got, item.Type+":"+id)
+		if item.Type == "reasoning" || item.Type == "function_call" {
+			if ids[id] {
+				t.Errorf("%s %s sent twice", item.Type, id)
+			}
+			ids[id] = true
+		}
+	}
+	want := []string{
+		"message:user",
+		"reasoning:rs_68f2a1c0d4e88190",
+		"function_call:call_Kq3vX9aTbEw1",
+		"function_call_output:call_Kq3vX9aTbEw1",
+		"reasoning:rs_68f2a1c9b7f48190",
+		"message:assistant",
+		"message:user",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("input items\n got %v\nwant %v", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// translate runs Translate on r and returns its decoded response.
+func translate(t *testing.T, r *http.Request) translateResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Translate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("translate: %d %s", w.Code, w.Body)
+	}
+	var resp translateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// TestTranslateMatchesMessages checks that the dry run shows what
+// Messages sends upstream for the same request.
+func TestTranslateMatchesMessages(t *testing.T) {
+	useModels(t,
+		state.Model{ID: "claude-sonnet-4", SupportedEndpoints: []string{"/v1/messages", "/chat/completions", "/responses"}},
+		state.Model{ID: "gpt-5-mini", SupportedEndpoints: []string{"/chat/completions", "/responses"}},
+	)
+	useConfig(t, func(c *config.Config) {
+		c.Debug.AllowBackendOverride = true
+		c.ExtraPrompts = map[string]string{"claude-sonnet-4": "Be terse."}
+		c.ModelReasoningEfforts = map[string]string{"gpt-5-mini": "high"}
+	})
+
+	tests := []struct {
+		name     string
+		model    string
+		query    string // ?backend= of the dry run
+		header   string // X-Backend of the real request
+		backend  string
+		upstream string
+	}{
+		{"native", "claude-sonnet-4", "", "", "messages", servicetest.Messages},
+		{"responses", "gpt-5-mini", "", "", "responses", servicetest.Responses},
+		{"forced chat", "claude-sonnet-4", "?backend=chat", "chat_completions", "chat_completions", servicetest.ChatCompletions},
+		{"forced responses", "claude-sonnet-4", "?backend=responses", "responses", "responses", servicetest.Responses},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &servicetest.Fake{}
+			scriptAll(fake, tt.model)
+			useBackend(t, fake)
+			body := `{"model":"` + tt.model + `","max_tokens":64,"temperature":0.5,"thinking":{"type":"enabled","budget_tokens":1024},` +
+				`"messages":[{"role":"user","content":"hi"}],"tools":[{"name":"Read","input_schema":{"type":"object"}}]}`
+
+			dry := newRequest("POST", "/api/translate"+tt.query, body)
+			dry.Header.Set("Anthropic-Beta", "claude-code-20250219")
+			got := translate(t, dry)
+
+			r := newRequest("POST", "/v1/messages", body)
+			r.Header.Set("Anthropic-Beta", "claude-code-20250219")
+			if tt.header != "" {
+				r.Header.Set("X-Backend", tt.header)
+			}
+			w := httptest.NewRecorder()
+			Messages(w, r)
+			calls := fake.Calls()
+			if w.Code != http.StatusOK || len(calls) != 1 {
+				t.Fatalf("messages: %d after %d upstream calls: %s", w.Code, len(calls), w.Body)
+			}
+
+			if got.Backend != tt.backend || calls[0].Endpoint != tt.upstream {
+				t.Errorf("backend = %s, want %s; Messages went to %s", got.Backend, tt.backend, calls[0].Endpoint)
+			}
+			if string(got.Payload) != string(calls[0].Body) {
+				t.Errorf("payload differs from what Messages sent:\n%s\n%s", got.Payload, calls[0].Body)
+			}
+			if got.AnthropicBeta != calls[0].BetaHeader {
+				t.Errorf("anthropic_beta = %q, Messages sent %q", got.AnthropicBeta, calls[0].BetaHeader)
+			}
+			if got.Model != tt.model {
+				t.Errorf("model = %q, want %q", got.Model, tt.model)
+			}
+		})
+	}
+}
+
+// failingTransport answers every request with a 502.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Body:       http.NoBody,
+		Header:     http.Header{},
+		Request:    req,
+	}, nil
+}
+
+func TestTranslateFollowsFailover(t *testing.T) {
+	useModels(t, state.Model{ID: "claude-sonnet-4", SupportedEndpoints: []string{"/v1/messages", "/chat/completions"}})
+	useConfig(t, func(c *config.Config) {
+		c.Failover = config.FailoverConfig{Threshold: 1}
+		c.AlternateUpstreams = []config.AlternateUpstream{{Name: "alt", BaseURL: "http://alt.invalid/v1"}}
+	})
+	body := `{"model":"claude-sonnet-4","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`
+	account := service.NewAccount()
+	withAccount := func(r *http.Request) *http.Request {
+		return r.WithContext(service.WithAccount(r.Context(), account))
+	}
+
+	if got := translate(t, withAccount(newRequest("POST", "/api/translate", body))); got.Backend != "messages" {
+		t.Fatalf("backend = %s before failover, want messages", got.Backend)
+	}
+
+	// One failed Copilot request opens the account's circuit
+	prev := http.DefaultClient.Transport
+	http.DefaultClient.Transport = failingTransport{}
+	ctx := service.WithAccount(testContext(context.Background()), account)
+	if resp, err := service.ProxyChatCompletion(ctx, []byte(`{"model":"claude-sonnet-4","messages":[]}`), false); err == nil {
+		resp.Body.Close()
+	}
+	http.DefaultClient.Transport = prev
+	if !service.FailoverActive(ctx) {
+		t.Fatal("failover not active")
+	}
+
+	got := translate(t, withAccount(newRequest("POST", "/api/translate", body)))
+	if got.Backend != "chat_completions" || !strings.Contains(string(got.Payload), `"messages":[`) {
+		t.Errorf("during failover: backend %s, payload %s; want the Chat Completions translation", got.Backend, got.Payload)
+	}
+	if got := translate(t, withAccount(newRequest("POST", "/api/translate?backend=messages", body))); got.Backend != "messages" {
+		t.Errorf("forced backend = %s during failover, want messages", got.Backend)
+	}
+}
@@ -20,6 +20,12 @@ type AnthropicRequest struct {
 	ToolChoice    json.RawMessage  `json:"tool_choice,omitempty"`
 	Thinking      *ThinkingConfig  `json:"thinking,omitempty"`
 	OutputConfig  *OutputConfig    `json:"output_config,omitempty"`
+
+	// unknown holds top-level fields not modeled above, which the
+	// translated backends would otherwise lose (see request_fields.go)
+	unknown map[string]json.RawMessage
+	// overrides are per-request header overrides (see request_overrides.go)
+	overrides requestOverrides
 }
 
 type AnthropicMeta struct {
@@ -84,6 +90,10 @@ type AnthropicTool struct {
 // AnthropicResponse is the response we return from POST /v1/messages.
 type AnthropicResponse struct {
 	ID           string         `json:"id"`
+	// UpstreamID is the ID of the Chat Completions or Responses API
+	// response a message was translated from, for correlation; empty for
+	// native messages.
+	UpstreamID   string         `json:"upstream_id,omitempty"`
 	Type         string         `json:"type"`
 	Role         string         `json:"role"`
 	Content      []ContentBlock `json:"content"`
@@ -12,6 +12,7 @@ type ChatCompletionRequest struct {
 	Tools       []OpenAITool   `json:"tools,omitempty"`
 	ToolChoice  any            `json:"tool_choice,omitempty"`
 	Stop        any            `json:"stop,omitempty"`
+	ParallelToolCalls *bool    `json:"parallel_tool_calls,omitempty"`
 }
 
 type OpenAIMsg struct {
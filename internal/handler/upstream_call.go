@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+	"github.com/tonghaoch/copilot-proxy-go/internal/telemetry"
+)
+
+// upstreamCall carries the context of one upstream request: its timeout,
+// from sending the request to the end of reading its response, and the
+// tracing of its connection. The context is independent of the client's
+// request, since deduplicated and cached calls serve more than one client;
+// only waiting for a modelConcurrency slot ends with the client's request.
+// A stream that runs out of time is cut between events: the handler sees a
+// read error after the last complete one.
+//
+// Every attempt of the call is sent with the same X-Request-Id, carrying
+// the client's X-Request-Id as a suffix; the upstream response's request
+// ID is echoed to the client as X-Upstream-Request-Id.
+//
+// A chat completion served by an alternate upstream during failover is
+// marked with X-Served-By: fallback. Upstream spans nest under the
+// request's telemetry span. The rate-limit headers of Copilot's
+// response are copied into the request record.
+//
+// Canceling the client's request with POST /api/requests/{id}/cancel
+// (unlike the client going away) ends the call too, failing it with a 499.
+// A streaming client going away ends it through clientStream.
+type upstreamCall struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	client    context.Context
+	stopAfter func() bool
+	endpoint  string
+	timeout   time.Duration
+	conn      service.ConnStats
+	servedBy  service.ServedBy
+	rateLimit service.UpstreamRateLimit
+	ids       *service.RequestIDs
+	w         http.ResponseWriter
+	// disconnected is set by clientStream when the streaming client is gone
+	disconnected atomic.Bool
+	// requestID is the proxy's (chi) ID of r, clientID the X-Request-Id
+	// the client sent
+	requestID, clientID string
+}
+
+// startUpstreamCall starts the configured timeout for endpoint (a
+// config.Timeout* constant) at the given reasoning effort, for the
+// request r answered on w. Call stop once the response has been read.
+func startUpstreamCall(w http.ResponseWriter, r *http.Request, endpoint, effort string) *upstreamCall {
+	c := &upstreamCall{
+		endpoint:  endpoint,
+		timeout:   config.FromContext(r.Context()).UpstreamTimeout(endpoint, effort),
+		w:         w,
+		requestID: chimw.GetReqID(r.Context()),
+		clientID:  r.Header.Get("X-Request-Id"),
+		client:    r.Context(),
+	}
+	// The request's proxy instance, without its cancellation
+	base := context.WithoutCancel(r.Context())
+	if c.timeout > 0 {
+		c.ctx, c.cancel = context.WithTimeout(base, c.timeout)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(base)
+	}
+	c.ids = service.NewRequestIDs(c.clientID)
+	c.ctx = service.WithConnStats(c.ctx, &c.conn)
+	c.ctx = service.WithRequestIDs(c.ctx, c.ids)
+	c.ctx = service.WithServedBy(c.ctx, &c.servedBy)
+	c.ctx = service.WithUpstreamRateLimit(c.ctx, &c.rateLimit)
+	c.ctx = service.WithClientContext(c.ctx, r.Context())
+	c.ctx = telemetry.ContextWithSpan(c.ctx, telemetry.FromContext(r.Context()))
+	cancel := c.cancel
+	c.stopAfter = context.AfterFunc(c.client, func() {
+		if middleware.CanceledFromContext(c.client) {
+			cancel()
+		}
+	})
+	return c
+}
+
+func (c *upstreamCall) stop() {
+	c.stopAfter()
+	c.cancel()
+}
+
+// check returns a 504 for an error caused by the timeout expiring and a
+// 499 for one caused by canceling the request, marking rec, and
+// errClientDisconnected once a streaming client is gone; other errors are
+// returned unchanged.
+func (c *upstreamCall) check(err error, rec *state.RequestRecord) error {
+	if err != nil && middleware.CanceledFromContext(c.client) {
+		return c.canceled(err, rec)
+	}
+	if err != nil && c.disconnected.Load() {
+		if rec != nil {
+			rec.ClientDisconnected = true
+		}
+		if errors.Is(err, errClientDisconnected) {
+			return err
+		}
+		return errClientDisconnected
+	}
+	if err == nil || !errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	var httpErr *api.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusGatewayTimeout {
+		return err // already converted
+	}
+	if rec != nil && !rec.Timeout {
+		rec.Timeout = true
+		slog.Warn("upstream request timed out", "endpoint", c.endpoint, "timeout", c.timeout, "model", rec.RoutedModel)
+	}
+	return &api.HTTPError{
+		Message:    fmt.Sprintf("upstream request timed out after %s (timeouts.%s)", c.timeout, c.endpoint),
+		StatusCode: http.StatusGatewayTimeout,
+	}
+}
+
+func (c *upstreamCall) canceled(err error, rec *state.RequestRecord) error {
+	if isRequestCanceled(err) {
+		return err // already converted
+	}
+	if rec != nil && !rec.Canceled {
+		rec.Canceled = true
+		slog.Warn("upstream request canceled", "endpoint", c.endpoint, "request_id", c.requestID, "model", rec.RoutedModel)
+	}
+	return &api.HTTPError{
+		Message:    middleware.ErrRequestCanceled.Error(),
+		StatusCode: middleware.StatusRequestCanceled,
+	}
+}
+
+// isRequestCanceled reports whether err is the error check returns for a
+// canceled request.
+func isRequestCanceled(err error) bool {
+	var httpErr *api.HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == middleware.StatusRequestCanceled
+}
+
+// recordConn copies the traced connection into rec.
+func (c *upstreamCall) recordConn(rec *state.RequestRecord) {
+	info := c.conn.Info()
+	if rec == nil || !info.Traced {
+		return
+	}
+	rec.UpstreamConn = "new"
+	if info.Reused {
+		rec.UpstreamConn = "reused"
+	}
+	rec.TLSHandshakeMs = info.TLSHandshake.Milliseconds()
+	rec.TTFBMs = info.TTFB.Milliseconds()
+}
+
+// recordRequestIDs echoes the upstream response's request ID to the
+// client, copies it into rec and logs it with the other IDs of the
+// request.
+func (c *upstreamCall) recordRequestIDs(rec *state.RequestRecord) {
+	upstreamID := c.ids.Received()
+	if upstreamID != "" {
+		c.w.Header().Set("X-Upstream-Request-Id", upstreamID)
+	}
+	if rec != nil {
+		rec.UpstreamRequestID = upstreamID
+	}
+	slog.Info("upstream request", "endpoint", c.endpoint, "request_id", c.requestID,
+		"client_request_id", c.clientID, "sent_request_id", c.ids.Sent, "upstream_request_id", upstreamID)
+}
+
+// servedByHeader marks responses served by an alternate upstream.
+const servedByHeader = "X-Served-By"
+
+// recordServedBy marks the response and rec when an alternate upstream
+// served the call.
+func (c *upstreamCall) recordServedBy(rec *state.RequestRecord) {
+	name := c.servedBy.Alternate()
+	if name == "" {
+		return
+	}
+	c.w.Header().Set(servedByHeader, "fallback")
+	if rec != nil {
+		rec.ServedBy = name
+	}
+}
+
+// recordRateLimit copies the rate-limit headers of Copilot's response
+// into rec.
+func (c *upstreamCall) recordRateLimit(rec *state.RequestRecord) {
+	if rec != nil {
+		rec.UpstreamRateLimit = c.rateLimit.Headers()
+	}
+}
+
+// guard records the connection, applies check to the result of an upstream
+// call and makes reads of the response body report the timeout the same
+// way.
+func (c *upstreamCall) guard(resp *http.Response, err error, rec *state.RequestRecord) (*http.Response, error) {
+	c.recordConn(rec)
+	c.recordRequestIDs(rec)
+	c.recordServedBy(rec)
+	c.recordRateLimit(rec)
+	if err != nil {
+		return nil, c.check(err, rec)
+	}
+	resp.Body = timeoutBody{ReadCloser: resp.Body, c: c, rec: rec}
+	return resp, nil
+}
+
+type timeoutBody struct {
+	io.ReadCloser
+	c   *upstreamCall
+	rec *state.RequestRecord
+}
+
+func (b timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = b.c.check(err, b.rec)
+	}
+	return n, err
+}
@@ -10,17 +10,22 @@ import (
 )
 
 // Usage handles GET /usage — returns Copilot quota/usage information.
+// Concurrent requests share one upstream call.
 func Usage(w http.ResponseWriter, r *http.Request) {
+	cachesOf(r.Context()).usage.serve(r.Context(), w, "", func(w http.ResponseWriter) {
+		fetchUsage(w, state.FromContext(r.Context()))
+	})
+}
+
+// fetchUsage proxies the Copilot user endpoint for the account of s.
+func fetchUsage(w http.ResponseWriter, s *state.State) {
 	req, err := http.NewRequest(http.MethodGet, "https://api.github.com/copilot_internal/user", nil)
 	if err != nil {
 		api.ForwardError(w, err)
 		return
 	}
 
-	req.Header = api.BuildGitHubHeaders(
-		state.Global.GetGithubToken(),
-		state.Global.GetVSCodeVersion(),
-	)
+	req.Header = api.BuildGitHubHeaders(s, s.GetGithubToken())
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// setUsageHeaders sets X-Input-Tokens, X-Output-Tokens, X-Cached-Tokens and
+// X-Routed-Model from rec, so monitoring can read usage without parsing the
+// body. Input tokens exclude cached tokens, as in the request record. Only
+// non-streaming responses get them: a stream's headers are sent before its
+// usage is known.
+func setUsageHeaders(w http.ResponseWriter, rec *state.RequestRecord) {
+	h := w.Header()
+	h.Set("X-Input-Tokens", strconv.FormatInt(rec.InputTokens, 10))
+	h.Set("X-Output-Tokens", strconv.FormatInt(rec.OutputTokens, 10))
+	h.Set("X-Cached-Tokens", strconv.FormatInt(rec.CachedTokens, 10))
+	if rec.RoutedModel != "" {
+		h.Set("X-Routed-Model", rec.RoutedModel)
+	}
+}
+
+// recordChatUsage copies the usage of a Chat Completion response body into
+// rec.
+func recordChatUsage(data []byte, rec *state.RequestRecord) {
+	var resp struct {
+		Usage *ChatCompletionUsage `json:"usage"`
+	}
+	if json.Unmarshal(data, &resp) != nil || resp.Usage == nil {
+		return
+	}
+	cached := 0
+	if resp.Usage.PromptTokensDetails != nil {
+		cached = resp.Usage.PromptTokensDetails.CachedTokens
+	}
+	rec.InputTokens = int64(resp.Usage.PromptTokens - cached)
+	rec.OutputTokens = int64(resp.Usage.CompletionTokens)
+	rec.CachedTokens = int64(cached)
+}
+
+// recordResponsesUsage copies the usage of a Responses result body into
+// rec.
+func recordResponsesUsage(data []byte, rec *state.RequestRecord) {
+	var result struct {
+		Usage *ResponsesUsage `json:"usage"`
+	}
+	if json.Unmarshal(data, &result) != nil || result.Usage == nil {
+		return
+	}
+	cached := 0
+	if result.Usage.InputTokensDetails != nil {
+		cached = result.Usage.InputTokensDetails.CachedTokens
+	}
+	rec.InputTokens = int64(result.Usage.InputTokens - cached)
+	rec.OutputTokens = int64(result.Usage.OutputTokens)
+	rec.CachedTokens = int64(cached)
+}
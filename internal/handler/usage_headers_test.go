@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+func TestUsageHeaders(t *testing.T) {
+	const (
+		chatReply      = `{"id":"c1","model":"MODEL","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":120,"completion_tokens":7,"prompt_tokens_details":{"cached_tokens":100}}}`
+		responsesReply = `{"id":"resp_1","object":"response","status":"completed","model":"MODEL","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}],"usage":{"input_tokens":120,"output_tokens":7,"input_tokens_details":{"cached_tokens":100}}}`
+		messagesReply  = `{"id":"msg_1","type":"message","role":"assistant","model":"MODEL","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":20,"output_tokens":7,"cache_read_input_tokens":100}}`
+		anthropicBody  = `{"model":"MODEL","max_tokens":64,"messages":[{"role":"user","content":"usage headers"}]}`
+	)
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		path      string
+		endpoints []string
+		upstream  string
+		reply     string
+		body      string
+	}{
+		{"chat completions", ChatCompletions, "/chat/completions", []string{"/chat/completions"}, servicetest.ChatCompletions, chatReply,
+			`{"model":"MODEL","messages":[{"role":"user","content":"usage headers"}]}`},
+		{"responses", Responses, "/responses", []string{"/responses"}, servicetest.Responses, responsesReply,
+			`{"model":"MODEL","input":"usage headers"}`},
+		{"messages via chat completions", Messages, "/v1/messages", []string{"/chat/completions"}, servicetest.ChatCompletions, chatReply, anthropicBody},
+		{"messages via responses", Messages, "/v1/messages", []string{"/responses"}, servicetest.Responses, responsesReply, anthropicBody},
+		{"messages via messages", Messages, "/v1/messages", []string{"/v1/messages"}, servicetest.Messages, messagesReply, anthropicBody},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := "usage-model-" + strconv.Itoa(i)
+			fake := &servicetest.Fake{}
+			fake.Script(tt.upstream, servicetest.JSON(replaceModel(tt.reply, model)))
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: model, SupportedEndpoints: tt.endpoints})
+
+			w := httptest.NewRecorder()
+			r := newRequest("POST", tt.path, replaceModel(tt.body, model))
+			tt.handler(w, r)
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			want := map[string]string{"X-Input-Tokens": "20", "X-Output-Tokens": "7", "X-Cached-Tokens": "100", "X-Routed-Model": model}
+			for h, v := range want {
+				if got := w.Header().Get(h); got != v {
+					t.Errorf("%s = %q, want %q", h, got, v)
+				}
+			}
+			rec := recordOf(t, r)
+			if rec.InputTokens != 20 || rec.OutputTokens != 7 || rec.CachedTokens != 100 {
+				t.Errorf("record tokens in/out/cached = %d/%d/%d, want the headers' 20/7/100", rec.InputTokens, rec.OutputTokens, rec.CachedTokens)
+			}
+			if tt.path == "/v1/messages" {
+				var body struct{ Usage AnthropicUsage }
+				json.Unmarshal(w.Body.Bytes(), &body)
+				if body.Usage.InputTokens != 20 || body.Usage.OutputTokens != 7 || body.Usage.CacheReadInputTokens != 100 {
+					t.Errorf("body usage %+v doesn't match the headers", body.Usage)
+				}
+			}
+		})
+	}
+}
+
+func TestNoUsageHeadersWhenStreaming(t *testing.T) {
+	fake := &servicetest.Fake{}
+	fake.Script(servicetest.ChatCompletions, servicetest.SSE(
+		`{"id":"c1","choices":[{"index":0,"delta":{"content":"hi"}}]}`,
+		`{"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":1}}`,
+		`[DONE]`,
+	))
+	useBackend(t, fake)
+	useModels(t, state.Model{ID: "usage-stream", SupportedEndpoints: []string{"/chat/completions"}})
+
+	w := httptest.NewRecorder()
+	ChatCompletions(w, newRequest("POST", "/chat/completions", `{"model":"usage-stream","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Input-Tokens"); got != "" {
+		t.Errorf("streaming response has X-Input-Tokens %q", got)
+	}
+}
+
+func replaceModel(s, model string) string {
+	return strings.ReplaceAll(s, "MODEL", model)
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// The transcripts in testdata/vision are Claude Code and Codex requests
+// whose only image is a screenshot tool's result.
+
+func readTranscript(t *testing.T, name, model string) string {
+	t.Helper()
+	data, err := os.ReadFile("testdata/vision/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(string(data), "MODEL", model, 1)
+}
+
+func TestVisionDetection(t *testing.T) {
+	screenshot := readTranscript(t, "claude-code-screenshot.json", "claude-sonnet-4")
+	var req AnthropicRequest
+	if err := json.Unmarshal([]byte(screenshot), &req); err != nil {
+		t.Fatal(err)
+	}
+	if !hasVision(req.Messages) {
+		t.Error("hasVision misses the screenshot in a tool_result")
+	}
+	if hasVision(req.Messages[:len(req.Messages)-1]) {
+		t.Error("hasVision reports an image before the screenshot")
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"message image", `[{"type":"message","role":"user","content":[{"type":"input_image","image_url":"data:image/png;base64,AA"}]}]`, true},
+		{"function_call_output image", `[{"type":"function_call_output","call_id":"c1","output":[{"type":"input_image","image_url":"data:image/png;base64,AA"}]}]`, true},
+		{"function_call_output text", `[{"type":"function_call_output","call_id":"c1","output":"done"}]`, false},
+		{"text only", `[{"type":"message","role":"user","content":[{"type":"input_text","text":"hi"}]}]`, false},
+	}
+	for _, tt := range tests {
+		var payload map[string]any
+		json.Unmarshal([]byte(`{"input":`+tt.input+`}`), &payload)
+		if got := detectVisionInResponses(payload); got != tt.want {
+			t.Errorf("%s: detectVisionInResponses = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestScreenshotSetsVision sends the transcripts through the handlers and
+// checks that the upstream call asks for vision and the record says so.
+func TestScreenshotSetsVision(t *testing.T) {
+	tests := []struct {
+		name       string
+		endpoints  []string
+		transcript string
+		upstream   string
+		reply      string
+	}{
+		{"messages backend", []string{"/v1/messages"}, "claude-code-screenshot.json", servicetest.Messages,
+			`{"id":"msg_1","type":"message","role":"assistant","model":"m","content":[{"type":"text","text":"Misaligned."}],"stop_reason":"end_turn","usage":{"input_tokens":5,"output_tokens":2}}`},
+		{"responses backend", []string{"/responses"}, "claude-code-screenshot.json", servicetest.Responses,
+			`{"id":"resp_1","object":"response","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Misaligned."}]}],"usage":{"input_tokens":5,"output_tokens":2}}`},
+		{"chat completions backend", []string{"/chat/completions"}, "claude-code-screenshot.json", servicetest.ChatCompletions,
+			`{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"Misaligned."},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2}}`},
+		{"responses passthrough", []string{"/responses"}, "responses-screenshot.json", servicetest.Responses,
+			`{"id":"resp_2","object":"response","status":"completed","output":[],"usage":{"input_tokens":5,"output_tokens":2}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := "vision-" + strings.ReplaceAll(tt.name, " ", "-")
+			fake := &servicetest.Fake{}
+			fake.Script(tt.upstream, servicetest.JSON(tt.reply))
+			useBackend(t, fake)
+			useModels(t, state.Model{ID: model, SupportedEndpoints: tt.endpoints})
+
+			body := readTranscript(t, tt.transcript, model)
+			w := httptest.NewRecorder()
+			r := newRequest("POST", "/v1/messages", body)
+			if tt.transcript == "responses-screenshot.json" {
+				r = newRequest("POST", "/responses", body)
+				Responses(w, r)
+			} else {
+				Messages(w, r)
+			}
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			calls := fake.Calls()
+			if len(calls) != 1 || calls[0].Endpoint != tt.upstream {
+				t.Fatalf("upstream calls %v, want one to %s", fake.Endpoints(), tt.upstream)
+			}
+			if !calls[0].Vision {
+				t.Error("upstream request isn't marked as a vision request")
+			}
+			if !recordOf(t, r).HasVision {
+				t.Error("record isn't marked has_vision")
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/websocket"
+)
+
+const (
+	// wsPingInterval is how often the server pings an open socket.
+	wsPingInterval = 25 * time.Second
+	// wsIdleTimeout is how long the server waits for the request frame, and
+	// then for any frame (including pongs), before giving up on the client.
+	wsIdleTimeout = 2 * wsPingInterval
+	// wsCloseTimeout is how long the server waits for the client to
+	// acknowledge its close frame.
+	wsCloseTimeout = 2 * time.Second
+)
+
+// wsRequestHeaders are forwarded from the upgrade request to the streamed
+// request.
+var wsRequestHeaders = []string{"x-api-key", "Authorization", "X-Initiator", "X-Extra-Prompt", "X-Reasoning-Effort", "X-Fold-Thinking", "X-Backend", "anthropic-beta"}
+
+// WebSocket returns a handler that serves the streaming endpoint at path
+// over a WebSocket. The first message is the endpoint's JSON request, which
+// may carry the API key as "api_key"; no query parameter is read, since it
+// would end up in access logs and browser history. The request is streamed
+// through next, so it goes through the same middleware and handler as a POST
+// to path; each SSE event's data is sent as one text message. The socket is
+// closed with 1000 when the stream completes, 1011 when it fails or the
+// upstream returns 5xx, and 4000+status for other HTTP errors (e.g. 4401,
+// 4429), after a message with the error body.
+func WebSocket(next http.Handler, path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			slog.Debug("websocket upgrade failed", "path", r.URL.Path, "error", err)
+			return
+		}
+		defer conn.Close()
+		conn.IdleTimeout = wsIdleTimeout
+
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		body, key, err := wsRequestBody(msg)
+		if err != nil {
+			wsError(conn, err.Error())
+			conn.WriteClose(websocket.CloseInvalidPayload, "invalid request")
+			return
+		}
+
+		// A fresh context: r's carries chi's routing state for the upgrade,
+		// and next serves the request with its proxy instance again
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+		if err != nil {
+			conn.WriteClose(websocket.CloseInternalError, "")
+			return
+		}
+		for _, h := range wsRequestHeaders {
+			if v := r.Header.Get(h); v != "" {
+				req.Header.Set(h, v)
+			}
+		}
+		if key != "" {
+			req.Header.Set("x-api-key", key)
+			req.Header.Del("Authorization")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = r.RemoteAddr
+
+		// Keep reading for pongs and the client's close; either ending the
+		// read cancels the request.
+		readDone := make(chan struct{})
+		go func() {
+			defer close(readDone)
+			defer cancel()
+			for {
+				if _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			ticker := time.NewTicker(wsPingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if conn.Ping() != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		ew := &wsEventWriter{conn: conn, header: make(http.Header), limit: config.FromContext(r.Context()).StreamBufferLimit()}
+		next.ServeHTTP(ew, req)
+		code, reason := ew.finish()
+		conn.WriteClose(code, reason)
+
+		select {
+		case <-readDone:
+		case <-time.After(wsCloseTimeout):
+		}
+	}
+}
+
+// wsRequestBody turns the first WebSocket message into a streaming request
+// body, removing the api_key field.
+func wsRequestBody(msg []byte) (body []byte, key string, err error) {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var payload map[string]any
+	if dec.Decode(&payload) != nil || payload == nil {
+		return nil, "", errors.New("first message must be a JSON request object")
+	}
+	if v, ok := payload["api_key"]; ok {
+		key, _ = v.(string)
+		delete(payload, "api_key")
+	}
+	payload["stream"] = true
+	body, err = json.Marshal(payload)
+	return body, key, err
+}
+
+// wsError sends an error message in the Anthropic error shape.
+func wsError(conn *websocket.Conn, message string) {
+	data, _ := json.Marshal(map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": "invalid_request_error", "message": message},
+	})
+	conn.WriteText(data)
+}
+
+// wsEventWriter is the http.ResponseWriter a WebSocket request is served
+// into. It sends the data of each SSE event as a text message; a non-SSE
+// response, such as an error, is sent as one message when finished.
+type wsEventWriter struct {
+	conn        *websocket.Conn
+	header      http.Header
+	status      int
+	wroteHeader bool
+	sse         bool
+	buf         bytes.Buffer // unparsed SSE, or the whole non-SSE body
+	data        []string     // data lines of the current event
+	dataSize    int          // bytes in data
+	limit       int          // cap on buf and data together
+	failed      bool         // an error event was sent
+	err         error        // first write error
+}
+
+func (ew *wsEventWriter) Header() http.Header { return ew.header }
+
+func (ew *wsEventWriter) WriteHeader(status int) {
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	ew.status = status
+	ew.sse = strings.HasPrefix(ew.header.Get("Content-Type"), "text/event-stream")
+}
+
+func (ew *wsEventWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	ew.buf.Write(p)
+	if ew.sse {
+		ew.sendEvents()
+	}
+	if ew.err == nil && ew.buf.Len()+ew.dataSize > ew.limit {
+		slog.Warn("dropping websocket stream: unsent response over buffer limit",
+			"buffered", ew.buf.Len()+ew.dataSize, "limit", ew.limit)
+		ew.err = errStreamBufferFull
+		ew.conn.WriteClose(websocket.CloseMessageTooBig, "response buffer limit reached")
+		ew.conn.Close()
+	}
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	return len(p), nil
+}
+
+// Flush is a no-op: events are sent as soon as they are complete.
+func (ew *wsEventWriter) Flush() {}
+
+// sendEvents sends every complete event in the buffer.
+func (ew *wsEventWriter) sendEvents() {
+	for ew.err == nil {
+		i := bytes.IndexByte(ew.buf.Bytes(), '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimSuffix(string(ew.buf.Next(i + 1)[:i]), "\r")
+		switch {
+		case line == "":
+			ew.sendEvent()
+		case strings.HasPrefix(line, "data:"):
+			ew.data = append(ew.data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			ew.dataSize += len(ew.data[len(ew.data)-1])
+		case line == "event: error":
+			ew.failed = true
+		}
+	}
+}
+
+func (ew *wsEventWriter) sendEvent() {
+	data := strings.Join(ew.data, "\n")
+	ew.data, ew.dataSize = ew.data[:0], 0
+	if data == "" || data == "[DONE]" {
+		return
+	}
+	if strings.HasPrefix(data, `{"type":"error"`) {
+		ew.failed = true
+	}
+	ew.err = ew.conn.WriteText([]byte(data))
+}
+
+// finish sends what's left of the response and returns the close code.
+func (ew *wsEventWriter) finish() (int, string) {
+	if ew.sse {
+		if len(ew.data) > 0 {
+			ew.sendEvent()
+		}
+	} else if ew.buf.Len() > 0 {
+		ew.conn.WriteText(bytes.TrimSpace(ew.buf.Bytes()))
+	}
+
+	switch {
+	case ew.status >= 500:
+		return websocket.CloseInternalError, http.StatusText(ew.status)
+	case ew.status >= 400:
+		return 4000 + ew.status, http.StatusText(ew.status)
+	case ew.failed:
+		return websocket.CloseInternalError, "stream failed"
+	}
+	return websocket.CloseNormal, ""
+}
@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/websocket"
+)
+
+// wsClient is a minimal WebSocket client for driving WebSocket handlers.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWS upgrades a connection to srv with header added to the handshake.
+func dialWS(t *testing.T, srv *httptest.Server, header http.Header) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/messages/ws", nil)
+	req.Header = header.Clone()
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %v %v", resp, err)
+	}
+	return &wsClient{conn: conn, br: br}
+}
+
+// send sends a masked frame.
+func (c *wsClient) send(op byte, payload []byte) {
+	mask := [4]byte{1, 2, 3, 4}
+	out := []byte{0x80 | op, 0x80 | 126}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)))
+	out = append(out, mask[:]...)
+	for i, b := range payload {
+		out = append(out, b^mask[i%4])
+	}
+	c.conn.Write(out)
+}
+
+// readAll reads text messages until the server's close frame, answers the
+// close, and returns the messages and the close code.
+func (c *wsClient) readAll(t *testing.T) (msgs []string, code int) {
+	t.Helper()
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			t.Fatalf("read frame: %v (after %q)", err, msgs)
+		}
+		n := uint64(hdr[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(c.br, ext[:])
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(c.br, ext[:])
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		payload := make([]byte, n)
+		io.ReadFull(c.br, payload)
+		switch hdr[0] & 0x0F {
+		case 0x1:
+			msgs = append(msgs, string(payload))
+		case 0x8:
+			c.send(0x8, payload)
+			return msgs, int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   string
+		status    int
+		body      string
+		sse       bool
+		wantMsgs  []string
+		wantCode  int
+		wantKey   string // x-api-key from api_key; empty keeps the upgrade's Authorization
+		wantNoReq bool   // the request never reaches the handler
+	}{
+		{
+			name:    "stream",
+			request: `{"model":"claude-sonnet-4","api_key":"sk-test","messages":[]}`,
+			status:  http.StatusOK,
+			sse:     true,
+			body: "event: message_start\ndata: {\"type\":\"message_start\"}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\n" +
+				"data: \"text\":\"hi\"}\n\n" +
+				"data: [DONE]\n\n",
+			wantMsgs: []string{`{"type":"message_start"}`, "{\"type\":\"content_block_delta\",\n\"text\":\"hi\"}"},
+			wantCode: websocket.CloseNormal,
+			wantKey:  "sk-test",
+		},
+		{
+			name:     "error event",
+			request:  `{"model":"claude-sonnet-4"}`,
+			status:   http.StatusOK,
+			sse:      true,
+			body:     "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\"}}\n\n",
+			wantMsgs: []string{`{"type":"error","error":{"type":"overloaded_error"}}`},
+			wantCode: websocket.CloseInternalError,
+		},
+		{
+			name:     "client error status",
+			request:  `{"model":"claude-sonnet-4"}`,
+			status:   http.StatusTooManyRequests,
+			body:     `{"error":{"message":"slow down"}}` + "\n",
+			wantMsgs: []string{`{"error":{"message":"slow down"}}`},
+			wantCode: 4000 + http.StatusTooManyRequests,
+		},
+		{
+			name:     "upstream failure",
+			request:  `{"model":"claude-sonnet-4"}`,
+			status:   http.StatusBadGateway,
+			body:     `{"error":{"message":"bad gateway"}}`,
+			wantMsgs: []string{`{"error":{"message":"bad gateway"}}`},
+			wantCode: websocket.CloseInternalError,
+		},
+		{
+			name:      "invalid first message",
+			request:   `not json`,
+			wantMsgs:  []string{`{"error":{"message":"first message must be a JSON request object","type":"invalid_request_error"},"type":"error"}`},
+			wantCode:  websocket.CloseInvalidPayload,
+			wantNoReq: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type served struct {
+				r    *http.Request
+				body map[string]any
+			}
+			reqs := make(chan served, 1)
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body map[string]any
+				json.NewDecoder(r.Body).Decode(&body)
+				reqs <- served{r, body}
+				if tt.sse {
+					w.Header().Set("Content-Type", "text/event-stream")
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			ws := WebSocket(next, "/v1/messages")
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws(w, r.WithContext(testContext(r.Context())))
+			}))
+			t.Cleanup(srv.Close)
+
+			c := dialWS(t, srv, http.Header{"Authorization": {"Bearer sk-header"}, "X-Initiator": {"agent"}})
+			c.send(0x1, []byte(tt.request))
+			msgs, code := c.readAll(t)
+
+			if code != tt.wantCode {
+				t.Errorf("close code = %d, want %d", code, tt.wantCode)
+			}
+			if len(msgs) != len(tt.wantMsgs) {
+				t.Fatalf("messages = %q, want %q", msgs, tt.wantMsgs)
+			}
+			for i := range msgs {
+				if msgs[i] != tt.wantMsgs[i] {
+					t.Errorf("message %d = %q, want %q", i, msgs[i], tt.wantMsgs[i])
+				}
+			}
+			if tt.wantNoReq {
+				if len(reqs) != 0 {
+					t.Error("invalid request reached the handler")
+				}
+				return
+			}
+			s := <-reqs
+			got, gotBody := s.r, s.body
+
+			if got.Method != http.MethodPost || got.URL.Path != "/v1/messages" {
+				t.Errorf("request = %s %s, want POST /v1/messages", got.Method, got.URL.Path)
+			}
+			if gotBody["stream"] != true {
+				t.Errorf("stream = %v, want true", gotBody["stream"])
+			}
+			if _, ok := gotBody["api_key"]; ok {
+				t.Error("api_key forwarded in the body")
+			}
+			if got.Header.Get("X-Initiator") != "agent" {
+				t.Errorf("X-Initiator = %q, want it forwarded", got.Header.Get("X-Initiator"))
+			}
+			wantAuth := "Bearer sk-header"
+			if tt.wantKey != "" {
+				wantAuth = ""
+			}
+			if got.Header.Get("x-api-key") != tt.wantKey || got.Header.Get("Authorization") != wantAuth {
+				t.Errorf("x-api-key %q, Authorization %q; want %q, %q",
+					got.Header.Get("x-api-key"), got.Header.Get("Authorization"), tt.wantKey, wantAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// PromptText returns the text of the last user turn of a /v1/messages,
+// /chat/completions or /responses request body: the last user message, or
+// the tool results that follow the last assistant turn. Images and other
+// non-text blocks are left out.
+func PromptText(body []byte) string {
+	// Messages and Responses input items share what is needed here
+	type turn struct {
+		Type    string          `json:"type"`
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+		Output  json.RawMessage `json:"output"`
+	}
+	var req struct {
+		Messages []turn          `json:"messages"`
+		Input    json.RawMessage `json:"input"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+	turns := req.Messages
+	if turns == nil {
+		var input string
+		if json.Unmarshal(req.Input, &input) == nil {
+			return input
+		}
+		json.Unmarshal(req.Input, &turns)
+	}
+
+	var parts []string
+walk:
+	for i := len(turns) - 1; i >= 0; i-- {
+		t := turns[i]
+		switch {
+		case t.Role == "tool":
+			parts = append(parts, contentText(t.Content))
+		case t.Type == "function_call_output":
+			parts = append(parts, contentText(t.Output))
+		case t.Type == "function_call":
+			// precedes its output
+		case t.Role == "user" && len(parts) == 0:
+			return contentText(t.Content)
+		default:
+			break walk
+		}
+	}
+	slices.Reverse(parts)
+	return strings.Join(parts, "\n")
+}
+
+// contentText joins the text of a message content: a string, or blocks
+// of type text, input_text or tool_result (whose content nests).
+func contentText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var blocks []struct {
+		Type    string          `json:"type"`
+		Text    string          `json:"text"`
+		Content json.RawMessage `json:"content"`
+	}
+	if json.Unmarshal(raw, &blocks) != nil {
+		return ""
+	}
+	var parts []string
+	for _, b := range blocks {
+		switch b.Type {
+		case "text", "input_text", "output_text":
+			parts = append(parts, b.Text)
+		case "tool_result":
+			if t := contentText(b.Content); t != "" {
+				parts = append(parts, t)
+			}
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// ResponseText returns the answer text of a completion response in the
+// Anthropic, Chat Completions or Responses format, streamed (SSE) or not.
+// Thinking and tool calls are left out.
+func ResponseText(body []byte, streamed bool) string {
+	if !streamed {
+		var resp struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+			Output []struct {
+				Type    string `json:"type"`
+				Content []struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"output"`
+		}
+		if json.Unmarshal(body, &resp) != nil {
+			return ""
+		}
+		var b strings.Builder
+		for _, c := range resp.Content {
+			if c.Type == "text" {
+				b.WriteString(c.Text)
+			}
+		}
+		if len(resp.Choices) > 0 {
+			b.WriteString(resp.Choices[0].Message.Content)
+		}
+		for _, o := range resp.Output {
+			for _, c := range o.Content {
+				if o.Type == "message" && c.Type == "output_text" {
+					b.WriteString(c.Text)
+				}
+			}
+		}
+		return b.String()
+	}
+
+	var b strings.Builder
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for sc.Scan() {
+		data, ok := bytes.CutPrefix(sc.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		var evt struct {
+			Type    string          `json:"type"`
+			Delta   json.RawMessage `json:"delta"`
+			Choices []struct {
+				Index int `json:"index"`
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal(bytes.TrimSpace(data), &evt) != nil {
+			continue
+		}
+		switch evt.Type {
+		case "content_block_delta":
+			var d struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			}
+			if json.Unmarshal(evt.Delta, &d) == nil && d.Type == "text_delta" {
+				b.WriteString(d.Text)
+			}
+		case "response.output_text.delta":
+			var d string
+			if json.Unmarshal(evt.Delta, &d) == nil {
+				b.WriteString(d)
+			}
+		case "":
+			for _, c := range evt.Choices {
+				if c.Index == 0 {
+					b.WriteString(c.Delta.Content)
+				}
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,309 @@
+// Package history keeps a local, searchable transcript of completion
+// requests: the prompt and response text, model, tokens and time of each.
+// Entries are JSON lines in one file, bounded in size and age; searches
+// scan the file, which its size cap keeps cheap. Writers, in the proxy and
+// in `history purge`, take a lock file next to it, so neither loses the
+// other's changes.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTextBytes caps the prompt and the response text of an entry.
+const maxTextBytes = 64 << 10
+
+// pruneInterval is how often Append drops entries past the retention.
+const pruneInterval = time.Hour
+
+// Entry is one recorded request.
+type Entry struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	KeyLabel     string    `json:"key_label,omitempty"`
+	Endpoint     string    `json:"endpoint"`
+	Model        string    `json:"model"`
+	RoutedModel  string    `json:"routed_model,omitempty"`
+	Status       int       `json:"status"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+	Prompt       string    `json:"prompt"`
+	Response     string    `json:"response"`
+}
+
+// Limits bound the history file.
+type Limits struct {
+	MaxBytes  int64         // file size; the oldest entries go first
+	Retention time.Duration // entry age; 0 keeps entries until MaxBytes
+}
+
+// Store appends entries to a history file. The file is opened for each
+// write under the history lock, so `history purge` can rewrite it while
+// the proxy runs.
+type Store struct {
+	mu        sync.Mutex
+	path      string
+	limits    func() Limits
+	lastPrune time.Time
+}
+
+// NewStore returns the store of the history file at path. limits is read
+// on every append, so changes apply without reopening the store.
+func NewStore(path string, limits func() Limits) *Store {
+	return &Store{path: path, limits: limits}
+}
+
+// Append records e, truncating its texts to maxTextBytes.
+func (s *Store) Append(e Entry) error {
+	e.Prompt = truncate(e.Prompt)
+	e.Response = truncate(e.Response)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lock(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	info, statErr := f.Stat()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	limits := s.limits()
+	overSize := statErr == nil && limits.MaxBytes > 0 && info.Size() > limits.MaxBytes
+	if overSize || limits.Retention > 0 && now.Sub(s.lastPrune) > pruneInterval {
+		s.lastPrune = now
+		return compact(s.path, limits, now)
+	}
+	return nil
+}
+
+// Search returns up to limit entries of the history file at path whose
+// prompt, response or model contains q (case-insensitive), newest first.
+// An empty q matches all.
+func Search(path, q string, limit int) ([]Entry, error) {
+	q = strings.ToLower(q)
+	var matches []Entry
+	err := scan(path, func(e Entry, _ []byte) {
+		if q == "" ||
+			strings.Contains(strings.ToLower(e.Prompt), q) ||
+			strings.Contains(strings.ToLower(e.Response), q) ||
+			strings.Contains(strings.ToLower(e.Model), q) ||
+			strings.Contains(strings.ToLower(e.RoutedModel), q) {
+			matches = append(matches, e)
+		}
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	// The file is in time order; keep the newest limit matches
+	if limit > 0 && len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	out := make([]Entry, 0, len(matches))
+	for i := len(matches) - 1; i >= 0; i-- {
+		out = append(out, matches[i])
+	}
+	return out, err
+}
+
+// compact rewrites the history file at path without entries older than
+// the retention, then drops the oldest until it fits in three quarters of
+// MaxBytes, so it isn't rewritten on every append.
+func compact(path string, limits Limits, now time.Time) error {
+	var cutoff time.Time
+	if limits.Retention > 0 {
+		cutoff = now.Add(-limits.Retention)
+	}
+	var lines [][]byte
+	var size int64
+	err := scan(path, func(e Entry, line []byte) {
+		if e.Time.Before(cutoff) {
+			return
+		}
+		lines = append(lines, line)
+		size += int64(len(line))
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		target := limits.MaxBytes * 3 / 4
+		for len(lines) > 0 && size > target {
+			size -= int64(len(lines[0]))
+			lines = lines[1:]
+		}
+	}
+	return rewrite(path, lines)
+}
+
+// Export writes the entries of the history file at path recorded at or
+// after since to w, one JSON object per line, oldest first.
+func Export(path string, since time.Time, w io.Writer) (int, error) {
+	n := 0
+	var werr error
+	err := scan(path, func(e Entry, line []byte) {
+		if werr != nil || e.Time.Before(since) {
+			return
+		}
+		_, werr = w.Write(line)
+		n++
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// Purge removes the entries of the history file at path recorded before
+// before, or the whole file when before is zero, and returns how many
+// entries were removed. It holds the history lock, so entries a running
+// proxy appends meanwhile are kept.
+func Purge(path string, before time.Time) (int, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	unlock, err := lock(path)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if before.IsZero() {
+		n := 0
+		err = scan(path, func(Entry, []byte) { n++ })
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		if err := os.Remove(path); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	var kept [][]byte
+	removed := 0
+	err = scan(path, func(e Entry, line []byte) {
+		if e.Time.Before(before) {
+			removed++
+			return
+		}
+		kept = append(kept, line)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return removed, rewrite(path, kept)
+}
+
+// lock takes the lock of the history file at path, which every writer
+// holds: the proxy's appends and compactions, and `history purge` in
+// another process. It is a file of its own, path.lock, since rewrites
+// replace the history file. The returned func releases it.
+func lock(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %w", f.Name(), err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// scan calls fn with every valid entry of the history file and its line,
+// newline included. Unparseable lines, such as one cut short by a crash,
+// are skipped.
+func scan(path string, fn func(Entry, []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var e Entry
+			if json.Unmarshal(bytes.TrimSpace(line), &e) == nil {
+				fn(e, line)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rewrite atomically replaces the file at path with lines.
+func rewrite(path string, lines [][]byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		w.Write(line)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func truncate(s string) string {
+	if len(s) <= maxTextBytes {
+		return s
+	}
+	return strings.ToValidUTF8(s[:maxTextBytes], "") + " [truncated]"
+}
@@ -0,0 +1,249 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStore returns a store of a history file in a new directory.
+func newStore(t *testing.T, limits Limits) (*Store, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	return NewStore(path, func() Limits { return limits }), path
+}
+
+func appendAll(t *testing.T, s *Store, entries ...Entry) {
+	t.Helper()
+	for _, e := range entries {
+		if err := s.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func ids(entries []Entry) []string {
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.ID
+	}
+	return out
+}
+
+func TestSearch(t *testing.T) {
+	s, path := newStore(t, Limits{})
+	now := time.Now()
+	appendAll(t, s,
+		Entry{ID: "1", Time: now.Add(-3 * time.Minute), Model: "gpt-4.1", Prompt: "Refactor the parser", Response: "Done."},
+		Entry{ID: "2", Time: now.Add(-2 * time.Minute), Model: "claude-sonnet-4", Prompt: "hello", Response: "The PARSER is fine"},
+		Entry{ID: "3", Time: now.Add(-time.Minute), Model: "claude-sonnet-4", RoutedModel: "gpt-5-mini", Prompt: "warmup"},
+	)
+
+	tests := []struct {
+		q     string
+		limit int
+		want  []string
+	}{
+		{"", 0, []string{"3", "2", "1"}},
+		{"parser", 0, []string{"2", "1"}},
+		{"parser", 1, []string{"2"}},
+		{"CLAUDE", 0, []string{"3", "2"}},
+		{"gpt-5-mini", 0, []string{"3"}},
+		{"nothing like it", 0, []string{}},
+	}
+	for _, tt := range tests {
+		got, err := Search(path, tt.q, tt.limit)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", tt.q, err)
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(tt.want) {
+			t.Errorf("Search(%q, %d) = %v, want %v", tt.q, tt.limit, ids(got), tt.want)
+		}
+	}
+
+	if got, err := Search(filepath.Join(t.TempDir(), "missing.jsonl"), "", 0); err != nil || len(got) != 0 {
+		t.Errorf("Search of a missing file = %v, %v; want nothing", got, err)
+	}
+}
+
+func TestSearchSkipsBrokenLines(t *testing.T) {
+	s, path := newStore(t, Limits{})
+	appendAll(t, s, Entry{ID: "1", Time: time.Now()})
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n{\"id\":\"cut short")
+	f.Close()
+
+	got, err := Search(path, "", 0)
+	if err != nil || fmt.Sprint(ids(got)) != "[1]" {
+		t.Errorf("Search = %v, %v; want only the valid entry", ids(got), err)
+	}
+}
+
+func TestAppendTruncatesTexts(t *testing.T) {
+	s, path := newStore(t, Limits{})
+	appendAll(t, s, Entry{ID: "1", Time: time.Now(), Prompt: strings.Repeat("é", maxTextBytes), Response: "short"})
+
+	got, _ := Search(path, "", 0)
+	if len(got) != 1 {
+		t.Fatalf("%d entries, want 1", len(got))
+	}
+	if p := got[0].Prompt; len(p) > maxTextBytes+len(" [truncated]") || !strings.HasSuffix(p, " [truncated]") {
+		t.Errorf("prompt of %d bytes not truncated", len(p))
+	}
+	if got[0].Response != "short" {
+		t.Errorf("response = %q, want it kept", got[0].Response)
+	}
+}
+
+func TestAppendCompacts(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		s, path := newStore(t, Limits{MaxBytes: 2000})
+		for i := range 40 {
+			appendAll(t, s, Entry{ID: fmt.Sprint(i), Time: time.Now(), Prompt: strings.Repeat("x", 80)})
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 2000 {
+			t.Errorf("history is %d bytes, want at most 2000", info.Size())
+		}
+		got, _ := Search(path, "", 1)
+		if len(got) != 1 || got[0].ID != "39" {
+			t.Errorf("newest entry = %v, want the last appended kept", ids(got))
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		s, path := newStore(t, Limits{Retention: 24 * time.Hour})
+		old := NewStore(path, func() Limits { return Limits{} })
+		appendAll(t, old, Entry{ID: "old", Time: time.Now().Add(-48 * time.Hour)})
+		appendAll(t, s, Entry{ID: "new", Time: time.Now()})
+
+		got, _ := Search(path, "", 0)
+		if fmt.Sprint(ids(got)) != "[new]" {
+			t.Errorf("entries = %v, want the old one pruned", ids(got))
+		}
+	})
+}
+
+func TestExport(t *testing.T) {
+	s, path := newStore(t, Limits{})
+	now := time.Now()
+	appendAll(t, s,
+		Entry{ID: "1", Time: now.Add(-2 * time.Hour)},
+		Entry{ID: "2", Time: now.Add(-time.Minute)},
+		Entry{ID: "3", Time: now},
+	)
+	var buf bytes.Buffer
+	n, err := Export(path, now.Add(-time.Hour), &buf)
+	if err != nil || n != 2 {
+		t.Fatalf("Export = %d, %v; want 2 entries", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"id":"2"`) || !strings.Contains(lines[1], `"id":"3"`) {
+		t.Errorf("export = %q, want entries 2 and 3, oldest first", lines)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		before      time.Time
+		wantRemoved int
+		wantLeft    []string
+	}{
+		{"older than", now.Add(-time.Hour), 2, []string{"3"}},
+		{"nothing older", now.Add(-72 * time.Hour), 0, []string{"3", "2", "1"}},
+		{"all", time.Time{}, 3, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, path := newStore(t, Limits{})
+			appendAll(t, s,
+				Entry{ID: "1", Time: now.Add(-48 * time.Hour)},
+				Entry{ID: "2", Time: now.Add(-2 * time.Hour)},
+				Entry{ID: "3", Time: now},
+			)
+			removed, err := Purge(path, tt.before)
+			if err != nil || removed != tt.wantRemoved {
+				t.Fatalf("Purge = %d, %v; want %d removed", removed, err, tt.wantRemoved)
+			}
+			got, _ := Search(path, "", 0)
+			if fmt.Sprint(ids(got)) != fmt.Sprint(tt.wantLeft) {
+				t.Errorf("left = %v, want %v", ids(got), tt.wantLeft)
+			}
+		})
+	}
+
+	if n, err := Purge(filepath.Join(t.TempDir(), "missing.jsonl"), time.Time{}); n != 0 || err != nil {
+		t.Errorf("Purge of a missing file = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestPurgeKeepsConcurrentAppends(t *testing.T) {
+	s, path := newStore(t, Limits{})
+	appendAll(t, s, Entry{ID: "old", Time: time.Now().Add(-48 * time.Hour)})
+
+	const n = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range n {
+			if err := s.Append(Entry{ID: fmt.Sprint(i), Time: time.Now(), Prompt: strings.Repeat("p", 500)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for range 50 {
+		if _, err := Purge(path, time.Now().Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	got, _ := Search(path, "", 0)
+	if len(got) != n {
+		t.Errorf("%d entries after purging during appends, want all %d", len(got), n)
+	}
+}
+
+func TestLockExcludes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	unlock, err := lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan func())
+	go func() {
+		// A second open file, as another process would have
+		unlock2, err := lock(path)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- unlock2
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock2 := <-acquired:
+		unlock2()
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not released")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package history
+
+import "os"
+
+// lockFile does nothing where there is no flock or LockFileEx; Store's
+// mutex still orders the proxy's own writes.
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,38 @@
+//go:build windows
+
+package history
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// lockfileExclusiveLock is LOCKFILE_EXCLUSIVE_LOCK (minwinbase.h).
+const lockfileExclusiveLock = 0x2
+
+var (
+	kernel32     = syscall.NewLazyDLL("kernel32.dll")
+	lockFileEx   = kernel32.NewProc("LockFileEx")
+	unlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockFile takes an exclusive lock on the first byte of f, waiting for it.
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := lockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// unlockFile releases the lock lockFile took on f.
+func unlockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := unlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Package hooks runs external commands that rewrite upstream request
+// payloads. A hook reads the payload JSON on stdin and prints the payload
+// to send, unchanged or modified, on stdout.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxQuoted caps the hook output quoted in an error.
+const maxQuoted = 4096
+
+// EnvBackend names the environment variable telling a hook which payload
+// format it receives: messages, responses or chat_completions.
+const EnvBackend = "COPILOT_PROXY_HOOK_BACKEND"
+
+// RejectedError is returned when a hook exits non-zero: it refused the
+// request, and Message is what it printed on stderr. Hook is the file name
+// only, since the error may be shown to the client.
+type RejectedError struct {
+	Hook    string
+	Message string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("hook %s rejected the request: %s", e.Hook, e.Message)
+}
+
+// Run passes payload through the hook at path and returns its output. It
+// fails when the hook can't be started, runs past timeout, exits non-zero
+// (a *RejectedError) or doesn't print a JSON object. Errors name the hook
+// by its file name, not its full path.
+func Run(ctx context.Context, path, backend string, payload []byte, timeout time.Duration) ([]byte, error) {
+	name := filepath.Base(path)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), EnvBackend+"="+backend)
+	// Don't wait on grandchildren that kept the output pipes open
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if errors.Is(ctxErr, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("hook %s timed out after %s", name, timeout)
+		}
+		return nil, fmt.Errorf("hook %s: %w", name, ctxErr)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg := strings.TrimSpace(truncate(stderr.String()))
+		if msg == "" {
+			msg = exitErr.Error()
+		}
+		return nil, &RejectedError{Hook: name, Message: msg}
+	}
+	if err != nil {
+		// exec and os errors repeat the full path; keep only the cause
+		var execErr *exec.Error
+		var pathErr *os.PathError
+		switch {
+		case errors.As(err, &execErr):
+			err = execErr.Err
+		case errors.As(err, &pathErr):
+			err = pathErr.Err
+		}
+		return nil, fmt.Errorf("hook %s could not be started: %w", name, err)
+	}
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 || out[0] != '{' || !json.Valid(out) {
+		return nil, fmt.Errorf("hook %s did not print a JSON object: %q", name, truncate(string(out)))
+	}
+	return out, nil
+}
+
+func truncate(s string) string {
+	if len(s) > maxQuoted {
+		return s[:maxQuoted] + "..."
+	}
+	return s
+}
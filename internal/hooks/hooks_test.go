@@ -0,0 +1,97 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stub writes a shell script with body to a temporary directory and
+// returns its path.
+func stub(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub hooks are shell scripts")
+	}
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+	payload := []byte(`{"model":"gpt-4.1"}`)
+	tests := []struct {
+		name     string
+		script   string
+		timeout  time.Duration
+		want     string
+		rejected string
+		errHas   string
+	}{
+		{name: "pass through", script: "cat", want: `{"model":"gpt-4.1"}`},
+		{name: "rewrite", script: `echo '{"model":"claude-sonnet-4"}'`, want: `{"model":"claude-sonnet-4"}`},
+		{name: "sees backend", script: `printf '{"backend":"%s"}' "$` + EnvBackend + `"`, want: `{"backend":"responses"}`},
+		{name: "reject", script: "cat >/dev/null; echo 'no secrets please' >&2; exit 3", rejected: "no secrets please"},
+		{name: "reject without stderr", script: "exit 1", rejected: "exit status 1"},
+		{name: "timeout", script: "exec sleep 5", timeout: 100 * time.Millisecond, errHas: "timed out after 100ms"},
+		{name: "not JSON", script: "echo hello", errHas: `did not print a JSON object: "hello"`},
+		{name: "JSON array", script: "echo '[1]'", errHas: "did not print a JSON object"},
+		{name: "empty output", script: "true", errHas: "did not print a JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := stub(t, tt.script)
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			out, err := Run(context.Background(), path, "responses", payload, timeout)
+
+			var rejected *RejectedError
+			switch {
+			case tt.rejected != "":
+				if !errors.As(err, &rejected) {
+					t.Fatalf("got %v, want a RejectedError", err)
+				}
+				if rejected.Message != tt.rejected {
+					t.Errorf("message %q, want %q", rejected.Message, tt.rejected)
+				}
+			case tt.errHas != "":
+				if err == nil || !strings.Contains(err.Error(), tt.errHas) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.errHas)
+				}
+				if errors.As(err, &rejected) {
+					t.Errorf("got a RejectedError for a failed hook")
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(out) != tt.want {
+					t.Errorf("got %s, want %s", out, tt.want)
+				}
+			}
+			if err != nil && strings.Contains(err.Error(), filepath.Dir(path)) {
+				t.Errorf("error %q includes the hook's directory", err)
+			}
+		})
+	}
+}
+
+func TestRunMissingHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.sh")
+	_, err := Run(context.Background(), path, "messages", []byte(`{}`), time.Second)
+	if err == nil {
+		t.Fatal("got no error for a missing hook")
+	}
+	if !strings.Contains(err.Error(), "missing.sh could not be started") || strings.Contains(err.Error(), filepath.Dir(path)) {
+		t.Errorf("error %q should name only the file", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Package imaging validates and downscales base64 images before they are
+// forwarded upstream, using only the standard library codecs.
+package imaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // decoder registration
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+)
+
+// jpegQuality is used when an image is re-encoded as JPEG.
+const jpegQuality = 85
+
+// Limits bound the images forwarded as is.
+type Limits struct {
+	MaxBytes     int // decoded size
+	MaxDimension int // longest side in pixels
+}
+
+// Result describes a processed image.
+type Result struct {
+	Data      string // base64
+	MediaType string
+	// Sniffed is set when MediaType was corrected from the declared type.
+	Sniffed bool
+	// Resized is set when the image was downscaled or re-encoded.
+	Resized        bool
+	OriginalBytes  int
+	FinalBytes     int
+	Width, Height  int // final dimensions; 0 when not decoded
+	OriginalWidth  int
+	OriginalHeight int
+}
+
+// ErrInvalidBase64 is returned for image data that doesn't decode.
+var ErrInvalidBase64 = errors.New("image data is not valid base64")
+
+// Process validates base64 image data, corrects a media type that doesn't
+// match the content, and downscales or re-encodes images over limits.
+// Formats the standard library can't decode (WebP) are only validated.
+func Process(data, mediaType string, limits Limits) (Result, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return Result{}, ErrInvalidBase64
+	}
+	res := Result{Data: data, MediaType: mediaType, OriginalBytes: len(raw), FinalBytes: len(raw)}
+
+	sniffed := http.DetectContentType(raw)
+	if !strings.HasPrefix(sniffed, "image/") {
+		return Result{}, fmt.Errorf("image data is not an image (detected %s)", sniffed)
+	}
+	if sniffed != mediaType {
+		res.MediaType, res.Sniffed = sniffed, true
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		// Not decodable here (e.g. WebP): forward unchanged
+		return res, nil
+	}
+	res.Width, res.Height = cfg.Width, cfg.Height
+	res.OriginalWidth, res.OriginalHeight = cfg.Width, cfg.Height
+	if len(raw) <= limits.MaxBytes && max(cfg.Width, cfg.Height) <= limits.MaxDimension {
+		return res, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return Result{}, fmt.Errorf("decoding %s image: %w", format, err)
+	}
+
+	// Scale to fit MaxDimension, then shrink further until the encoded
+	// image fits MaxBytes. PNG sources stay PNG while they fit (sharper
+	// text in screenshots); otherwise JPEG.
+	w, h := fit(cfg.Width, cfg.Height, limits.MaxDimension)
+	for attempt := 0; ; attempt++ {
+		scaled := scale(img, w, h)
+		var out []byte
+		outType := "image/jpeg"
+		if format == "png" {
+			if out, err = encodePNG(scaled); err == nil && len(out) <= limits.MaxBytes {
+				outType = "image/png"
+			} else {
+				out = nil
+			}
+		}
+		if out == nil {
+			if out, err = encodeJPEG(scaled); err != nil {
+				return Result{}, err
+			}
+		}
+		if len(out) <= limits.MaxBytes || attempt == 5 {
+			res.Data = base64.StdEncoding.EncodeToString(out)
+			res.MediaType, res.Sniffed = outType, false
+			res.Resized = true
+			res.FinalBytes = len(out)
+			res.Width, res.Height = w, h
+			return res, nil
+		}
+		w, h = max(w*3/4, 1), max(h*3/4, 1)
+	}
+}
+
+// fit returns w×h scaled down so neither side exceeds maxDim.
+func fit(w, h, maxDim int) (int, int) {
+	if maxDim <= 0 || max(w, h) <= maxDim {
+		return w, h
+	}
+	if w >= h {
+		return maxDim, max(h*maxDim/w, 1)
+	}
+	return max(w*maxDim/h, 1), maxDim
+}
+
+// scale resizes img to w×h by averaging the source pixels covered by each
+// destination pixel (a box filter, suited to downscaling).
+func scale(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw == w && sh == h {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for dy := 0; dy < h; dy++ {
+		y0, y1 := dy*sh/h, max((dy+1)*sh/h, dy*sh/h+1)
+		for dx := 0; dx < w; dx++ {
+			x0, x1 := dx*sw/w, max((dx+1)*sw/w, dx*sw/w+1)
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride+x0*4 : y*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					bl += uint64(row[i+2])
+					a += uint64(row[i+3])
+					n++
+				}
+			}
+			o := dy*dst.Stride + dx*4
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(bl / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeJPEG flattens transparency onto white and encodes as JPEG.
+func encodeJPEG(img *image.RGBA) ([]byte, error) {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, image.Point{}, draw.Over)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"bufio"
 	"fmt"
 	"log/slog"
 	"os"
@@ -87,6 +88,12 @@ func (l *HandlerLogger) Log(format string, args ...any) {
 	l.mu.Unlock()
 }
 
+// LogRequest writes a log line tagged with a request ID, so Find can
+// collect the lines of one request.
+func (l *HandlerLogger) LogRequest(requestID, format string, args ...any) {
+	l.Log("req=%s %s", requestID, fmt.Sprintf(format, args...))
+}
+
 func (l *HandlerLogger) flushLoop() {
 	for {
 		select {
@@ -143,6 +150,72 @@ func (l *HandlerLogger) Close() {
 	l.mu.Unlock()
 }
 
+// FlushAll writes buffered lines of all loggers to their files.
+func FlushAll() {
+	loggersMu.Lock()
+	defer loggersMu.Unlock()
+	for _, l := range loggers {
+		l.mu.Lock()
+		l.flushLocked()
+		l.mu.Unlock()
+	}
+}
+
+// Line is a log line found by Find.
+type Line struct {
+	File string `json:"file"`
+	Text string `json:"text"`
+}
+
+// Find returns the lines tagged with requestID in the log files of the
+// named handlers (including their per-model files) dated from one day to
+// another, inclusive.
+func Find(requestID string, handlers []string, from, to time.Time) ([]Line, error) {
+	FlushAll()
+
+	logDir := state.LogDir()
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	tag := " req=" + requestID + " "
+
+	var lines []Line
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".log") || len(name) < len("2006-01-02.log") {
+			continue
+		}
+		date := strings.TrimSuffix(name[len(name)-len("2006-01-02.log"):], ".log")
+		if date < first || date > last || !matchesHandler(name, handlers) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(logDir, name))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			if strings.Contains(sc.Text(), tag) {
+				lines = append(lines, Line{File: name, Text: sc.Text()})
+			}
+		}
+		f.Close()
+	}
+	return lines, nil
+}
+
+func matchesHandler(file string, handlers []string) bool {
+	for _, h := range handlers {
+		if strings.HasPrefix(file, sanitizeName(h)+"-") {
+			return true
+		}
+	}
+	return false
+}
+
 // CloseAll flushes and closes all loggers. Call on process exit.
 func CloseAll() {
 	loggersMu.Lock()
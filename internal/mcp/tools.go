@@ -0,0 +1,226 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// tool is one MCP tool. Mutating tools are only listed and callable when
+// named in mcp.allowedTools.
+type tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+
+	run func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+var noArgs = map[string]any{"type": "object", "properties": map[string]any{}}
+
+var tools = []tool{
+	{
+		Name:        "get_usage",
+		Description: "Copilot plan, quota reset date and remaining premium request quota.",
+		InputSchema: noArgs,
+		run:         getUsage,
+	},
+	{
+		Name:        "get_stats",
+		Description: "Proxy request statistics since start: request and token totals, counts by model, backend and type.",
+		InputSchema: noArgs,
+		run:         getStats,
+	},
+	{
+		Name:        "list_models",
+		Description: "Models available from Copilot, with the current small model and reasoning effort overrides.",
+		InputSchema: noArgs,
+		run:         listModels,
+	},
+	{
+		Name:        "set_small_model",
+		Description: "Set the model used for compact and warmup requests, until the proxy restarts.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"model": map[string]any{"type": "string", "description": "Model ID from list_models"},
+			},
+			"required": []string{"model"},
+		},
+		run: setSmallModel,
+	},
+	{
+		Name:        "switch_reasoning_effort",
+		Description: "Set the reasoning effort sent for a model, until the proxy restarts. An empty effort removes the override.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"model":  map[string]any{"type": "string", "description": "Model ID from list_models"},
+				"effort": map[string]any{"type": "string", "enum": []string{"", "none", "minimal", "low", "medium", "high", "xhigh"}},
+			},
+			"required": []string{"model", "effort"},
+		},
+		run: switchReasoningEffort,
+	},
+}
+
+// allowed reports whether t may be listed and called on the proxy
+// instance of ctx.
+func (t tool) allowed(ctx context.Context) bool {
+	return !slices.Contains(config.MutatingMCPTools, t.Name) || config.FromContext(ctx).IsMCPToolAllowed(t.Name)
+}
+
+func availableTools(ctx context.Context) []tool {
+	var list []tool
+	for _, t := range tools {
+		if t.allowed(ctx) {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func findTool(ctx context.Context, name string) (tool, bool) {
+	for _, t := range tools {
+		if t.Name == name && t.allowed(ctx) {
+			return t, true
+		}
+	}
+	return tool{}, false
+}
+
+func toJSON(v any) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	return string(data), err
+}
+
+func getUsage(ctx context.Context, _ json.RawMessage) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.github.com/copilot_internal/user", nil)
+	if err != nil {
+		return "", err
+	}
+	s := state.FromContext(ctx)
+	req.Header = api.BuildGitHubHeaders(s, s.GetGithubToken())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching usage: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("usage request failed with status %d", resp.StatusCode)
+	}
+
+	var usage struct {
+		Plan           string         `json:"copilot_plan"`
+		QuotaResetDate string         `json:"quota_reset_date"`
+		QuotaSnapshots map[string]any `json:"quota_snapshots"`
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return "", fmt.Errorf("decoding usage: %w", err)
+	}
+	return toJSON(map[string]any{
+		"plan":             usage.Plan,
+		"quota_reset_date": usage.QuotaResetDate,
+		"quota_snapshots":  usage.QuotaSnapshots,
+	})
+}
+
+func getStats(ctx context.Context, _ json.RawMessage) (string, error) {
+	agg := state.MetricsFromContext(ctx).Snapshot().Aggregates
+	return toJSON(map[string]any{
+		"uptime":              time.Since(state.ProcessStart()).Round(time.Second).String(),
+		"total_requests":      agg.TotalRequests,
+		"total_input_tokens":  agg.TotalInputTokens,
+		"total_output_tokens": agg.TotalOutputTokens,
+		"total_cached_tokens": agg.TotalCachedTokens,
+		"model_counts":        agg.ModelCounts,
+		"backend_counts":      agg.BackendCounts,
+		"type_counts":         agg.TypeCounts,
+	})
+}
+
+func listModels(ctx context.Context, _ json.RawMessage) (string, error) {
+	type entry struct {
+		ID        string   `json:"id"`
+		Name      string   `json:"name"`
+		Preview   bool     `json:"preview,omitempty"`
+		Endpoints []string `json:"supported_endpoints,omitempty"`
+	}
+	var models []entry
+	for _, m := range state.FromContext(ctx).GetModels() {
+		models = append(models, entry{ID: m.ID, Name: m.Name, Preview: m.Preview, Endpoints: m.SupportedEndpoints})
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+
+	cfg := config.FromContext(ctx)
+	return toJSON(map[string]any{
+		"models":                  models,
+		"small_model":             cfg.SmallModel,
+		"model_reasoning_efforts": cfg.ModelReasoningEfforts,
+	})
+}
+
+func setSmallModel(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil || args.Model == "" {
+		return "", errors.New("model is required")
+	}
+	if state.FromContext(ctx).FindModel(args.Model) == nil {
+		return "", fmt.Errorf("unknown model %q; see list_models", args.Model)
+	}
+
+	var previous string
+	config.StoreFromContext(ctx).Update(func(c *config.Config) {
+		previous = c.SmallModel
+		c.SmallModel = args.Model
+	})
+	return fmt.Sprintf("small model changed from %s to %s (until restart)", previous, args.Model), nil
+}
+
+func switchReasoningEffort(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args struct {
+		Model  string `json:"model"`
+		Effort string `json:"effort"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil || args.Model == "" {
+		return "", errors.New("model is required")
+	}
+	if state.FromContext(ctx).FindModel(args.Model) == nil {
+		return "", fmt.Errorf("unknown model %q; see list_models", args.Model)
+	}
+	if args.Effort != "" && !config.IsValidReasoningEffort(args.Effort) {
+		return "", fmt.Errorf("invalid effort %q (expected none, minimal, low, medium, high, or xhigh)", args.Effort)
+	}
+
+	config.StoreFromContext(ctx).Update(func(c *config.Config) {
+		if args.Effort == "" {
+			delete(c.ModelReasoningEfforts, args.Model)
+			return
+		}
+		if c.ModelReasoningEfforts == nil {
+			c.ModelReasoningEfforts = make(map[string]string)
+		}
+		c.ModelReasoningEfforts[args.Model] = args.Effort
+	})
+	if args.Effort == "" {
+		return fmt.Sprintf("reasoning effort override for %s removed (until restart)", args.Model), nil
+	}
+	return fmt.Sprintf("reasoning effort for %s set to %s (until restart)", args.Model, args.Effort), nil
+}
@@ -0,0 +1,119 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sseKeepAlive is how often an idle SSE stream gets a comment line.
+const sseKeepAlive = 30 * time.Second
+
+// ServeStdio serves newline-delimited JSON-RPC messages from r, writing
+// responses to w, until r is closed.
+func (s *Server) ServeStdio(ctx context.Context, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		msg := bytes.TrimSpace(scanner.Bytes())
+		if len(msg) == 0 {
+			continue
+		}
+		if resp := s.Handle(ctx, msg); resp != nil {
+			if _, err := w.Write(append(resp, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// sseSessions maps session IDs to the channels of open SSE streams.
+var sseSessions = struct {
+	sync.Mutex
+	m map[string]chan []byte
+}{m: make(map[string]chan []byte)}
+
+// SSE handles GET on the SSE endpoint (HTTP+SSE transport): it opens an
+// event stream, announces the message endpoint for the session, then sends
+// the responses to messages posted there. messagePath is the path
+// Messages is mounted at.
+func (s *Server) SSE(messagePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		id := uuid.New().String()
+		ch := make(chan []byte, 16)
+		sseSessions.Lock()
+		sseSessions.m[id] = ch
+		sseSessions.Unlock()
+		defer func() {
+			sseSessions.Lock()
+			delete(sseSessions.m, id)
+			sseSessions.Unlock()
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "event: endpoint\ndata: %s?sessionId=%s\n\n", messagePath, id)
+		flusher.Flush()
+		slog.Info("mcp session opened", "session", id)
+
+		ticker := time.NewTicker(sseKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				slog.Info("mcp session closed", "session", id)
+				return
+			case msg := <-ch:
+				fmt.Fprintf(w, "event: message\ndata: %s\n\n", msg)
+				flusher.Flush()
+			case <-ticker.C:
+				io.WriteString(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// Messages handles POST on the message endpoint: the JSON-RPC message is
+// processed and its response sent on the session's event stream.
+func (s *Server) Messages(w http.ResponseWriter, r *http.Request) {
+	sseSessions.Lock()
+	ch, ok := sseSessions.m[r.URL.Query().Get("sessionId")]
+	sseSessions.Unlock()
+	if !ok {
+		http.Error(w, "unknown or closed session", http.StatusNotFound)
+		return
+	}
+
+	msg, err := io.ReadAll(io.LimitReader(r.Body, 16<<20))
+	if err != nil || len(strings.TrimSpace(string(msg))) == 0 {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	if resp := s.Handle(r.Context(), msg); resp != nil {
+		select {
+		case ch <- resp:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// StatusRequestCanceled is the status of a request canceled with
+// POST /api/requests/{id}/cancel, the "client closed request" status
+// nginx logs for requests that ended before they were answered.
+const StatusRequestCanceled = 499
+
+// ErrRequestCanceled is the cause of the context of a request canceled
+// with POST /api/requests/{id}/cancel.
+var ErrRequestCanceled = errors.New("request canceled via /api/requests/{id}/cancel")
+
+// ActiveRequest describes an in-flight completion request, as listed by
+// GET /api/requests/active.
+type ActiveRequest struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"request_id,omitempty"` // chi's request ID, as in logs and records
+	Endpoint  string    `json:"endpoint"`
+	Model     string    `json:"model,omitempty"`     // empty until the handler parsed the body
+	Initiator string    `json:"initiator,omitempty"` // user or agent; empty as Model
+	KeyLabel  string    `json:"key_label,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+	Canceled  bool      `json:"canceled,omitempty"` // canceled, still winding down
+}
+
+type activeEntry struct {
+	req    ActiveRequest
+	cancel context.CancelCauseFunc
+	reg    *activeRequests
+}
+
+// activeRequests holds one instance's in-flight completion requests by
+// ID.
+type activeRequests struct {
+	sync.Mutex
+	m map[string]*activeEntry
+}
+
+type activeKey struct{}
+
+// add registers e under a new ID, which it returns. An ID already taken
+// is never reused; a new one is drawn instead.
+func (a *activeRequests) add(e *activeEntry) string {
+	a.Lock()
+	defer a.Unlock()
+	for {
+		id := newActiveID()
+		if _, taken := a.m[id]; !taken {
+			e.req.ID = id
+			a.m[id] = e
+			return id
+		}
+	}
+}
+
+// newActiveID returns a random ID for an active request.
+func newActiveID() string {
+	return "req_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// ActiveRequests registers every request to the completion endpoints with
+// the registry of its instance while it is handled, for
+// GET /api/requests/active, and gives it a context that
+// CancelActiveRequest cancels. Entries are keyed by an ID the proxy
+// generates, never by chi's request ID: that one comes from the client's
+// X-Request-Id, so clients could pick it in advance or reuse it and
+// shadow another request's entry.
+func ActiveRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, ok := completionEndpoints[r.URL.Path]
+		if !ok || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		active := &registryOf(r.Context()).active
+		ctx, cancel := context.WithCancelCause(r.Context())
+		e := &activeEntry{
+			req: ActiveRequest{
+				RequestID: chimw.GetReqID(r.Context()),
+				Endpoint:  endpoint,
+				KeyLabel:  config.FromContext(r.Context()).KeyLabel(APIKeyFromContext(r.Context())),
+				StartedAt: time.Now(),
+			},
+			cancel: cancel,
+			reg:    active,
+		}
+		id := active.add(e)
+		// Deferred, so a panicking handler doesn't leave its entry behind
+		defer func() {
+			active.Lock()
+			delete(active.m, id)
+			active.Unlock()
+			cancel(nil)
+		}()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, activeKey{}, e)))
+	})
+}
+
+// DescribeActiveRequest sets the model and initiator of the active
+// request of ctx once the handler has parsed them.
+func DescribeActiveRequest(ctx context.Context, model, initiator string) {
+	e, _ := ctx.Value(activeKey{}).(*activeEntry)
+	if e == nil {
+		return
+	}
+	e.reg.Lock()
+	e.req.Model = model
+	e.req.Initiator = initiator
+	e.reg.Unlock()
+}
+
+// ListActiveRequests returns the in-flight completion requests of ctx's
+// instance, oldest first.
+func ListActiveRequests(ctx context.Context) []ActiveRequest {
+	active := &registryOf(ctx).active
+	now := time.Now()
+	active.Lock()
+	out := make([]ActiveRequest, 0, len(active.m))
+	for _, e := range active.m {
+		req := e.req
+		req.ElapsedMs = now.Sub(req.StartedAt).Milliseconds()
+		out = append(out, req)
+	}
+	active.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// CancelActiveRequest cancels the context of the in-flight request id of
+// ctx's instance with ErrRequestCanceled, reporting whether there was
+// one. The handler ends its upstream call and answers with an error.
+func CancelActiveRequest(ctx context.Context, id string) (ActiveRequest, bool) {
+	active := &registryOf(ctx).active
+	active.Lock()
+	e, ok := active.m[id]
+	var req ActiveRequest
+	if ok {
+		e.req.Canceled = true
+		req = e.req
+	}
+	active.Unlock()
+	if !ok {
+		return ActiveRequest{}, false
+	}
+	e.cancel(ErrRequestCanceled)
+	slog.Warn("request canceled via API", "request_id", id, "endpoint", req.Endpoint, "model", req.Model)
+	req.ElapsedMs = time.Since(req.StartedAt).Milliseconds()
+	return req, true
+}
+
+// CanceledFromContext reports whether the request of ctx was canceled
+// with CancelActiveRequest.
+func CanceledFromContext(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrRequestCanceled)
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// serveActive sends n concurrent POSTs to /v1/messages, each with the
+// client request ID clientID, through chi's RequestID and ActiveRequests,
+// and returns the context they run under once all are in flight. The
+// handlers block until release is closed, and report whether their
+// request was canceled on canceled.
+func serveActive(t *testing.T, ctx context.Context, n int, clientID string, release <-chan struct{}, canceled chan<- bool) *sync.WaitGroup {
+	t.Helper()
+	var started sync.WaitGroup
+	started.Add(n)
+	h := chimw.RequestID(ActiveRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		canceled <- CanceledFromContext(r.Context())
+	})))
+
+	var done sync.WaitGroup
+	for range n {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil).WithContext(ctx)
+			req.Header.Set(chimw.RequestIDHeader, clientID)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	started.Wait()
+	return &done
+}
+
+func TestActiveRequestsIDsAreServerGenerated(t *testing.T) {
+	ctx := config.WithStore(context.Background(), config.NewStore(""))
+	ctx = WithRegistry(ctx, NewRegistry(state.NewMetrics()))
+	release := make(chan struct{})
+	canceled := make(chan bool, 2)
+	done := serveActive(t, ctx, 2, "chosen-by-client", release, canceled)
+
+	active := ListActiveRequests(ctx)
+	if len(active) != 2 {
+		t.Fatalf("%d active requests, want both requests sharing a client ID: %+v", len(active), active)
+	}
+	if active[0].ID == active[1].ID {
+		t.Fatalf("both requests listed as %q", active[0].ID)
+	}
+	for _, req := range active {
+		if req.ID == "chosen-by-client" || req.ID == "" {
+			t.Errorf("ID = %q, want one generated by the proxy", req.ID)
+		}
+		if req.RequestID != "chosen-by-client" {
+			t.Errorf("RequestID = %q, want the client's", req.RequestID)
+		}
+	}
+	if _, ok := CancelActiveRequest(ctx, "chosen-by-client"); ok {
+		t.Error("canceled a request by the client's ID")
+	}
+
+	if _, ok := CancelActiveRequest(ctx, active[0].ID); !ok {
+		t.Fatalf("cancel %s: not found", active[0].ID)
+	}
+	if !<-canceled {
+		t.Error("first request to finish wasn't the canceled one")
+	}
+	close(release)
+	if <-canceled {
+		t.Error("the other request was canceled too")
+	}
+	done.Wait()
+	if active := ListActiveRequests(ctx); len(active) != 0 {
+		t.Errorf("finished requests still listed: %+v", active)
+	}
+}
+
+func TestActiveRequestsSkipsOtherRoutes(t *testing.T) {
+	ctx := config.WithStore(context.Background(), config.NewStore(""))
+	ctx = WithRegistry(ctx, NewRegistry(state.NewMetrics()))
+
+	tests := []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/v1/messages"},
+		{http.MethodPost, "/v1/embeddings"},
+		{http.MethodPost, "/api/requests/active"},
+	}
+	for _, tt := range tests {
+		var listed int
+		h := ActiveRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			listed = len(ListActiveRequests(r.Context()))
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil).WithContext(ctx))
+		if listed != 0 {
+			t.Errorf("%s %s: %d active requests, want it untracked", tt.method, tt.path, listed)
+		}
+	}
+}
@@ -2,48 +2,276 @@ package middleware
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// Rules under which a request is approved, as logged.
+const (
+	ruleOperator   = "operator"    // approved at the prompt
+	ruleEndpoint   = "endpoint"    // approval.endpoints
+	ruleFollowUp   = "follow_up"   // approval.followUpMinutes
+	ruleApproveAll = "approve_all" // "a" at the prompt
 )
 
+// approvalMemory holds the approvals that later requests can rely on.
+type approvalMemory struct {
+	mu       sync.Mutex
+	sessions map[string]time.Time // session key -> end of its follow-up window
+	allUntil time.Time            // end of the "approve all" window
+}
+
+// RequestSummary describes a completion request for the approval prompt.
+type RequestSummary struct {
+	Model       string
+	RoutedModel string // after small-model routing
+	RequestType string // normal, compact, warmup
+	Initiator   string // user, agent
+	InputTokens int    // estimated
+	// Premium reports whether the request consumes premium requests, and
+	// Multiplier how many (0 if Copilot doesn't say).
+	Premium    bool
+	Multiplier float64
+}
+
+// Summarizer classifies a request from its body, reporting false for
+// requests it doesn't describe.
+type Summarizer func(r *http.Request, body []byte) (RequestSummary, bool)
+
+// String formats s as the lines shown under the prompt.
+func (s RequestSummary) String() string {
+	var b strings.Builder
+	b.WriteString("  Model: " + s.Model)
+	if s.RoutedModel != "" && s.RoutedModel != s.Model {
+		b.WriteString(" -> " + s.RoutedModel)
+	}
+	if s.RequestType != "" && s.RequestType != "normal" {
+		b.WriteString(" (" + s.RequestType + ")")
+	}
+	fmt.Fprintf(&b, "\n  Initiator: %s, ~%d input tokens\n  Premium request: ", s.Initiator, s.InputTokens)
+	switch {
+	case s.Premium && s.Multiplier > 0:
+		fmt.Fprintf(&b, "yes (%gx)", s.Multiplier)
+	case s.Premium:
+		b.WriteString("yes")
+	case s.Initiator == "agent":
+		b.WriteString("no (agent-initiated)")
+	default:
+		b.WriteString("no")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
 // ManualApproval returns a middleware that prompts the operator via CLI
-// to approve or reject each incoming request.
-func ManualApproval(next http.Handler) http.Handler {
+// to approve or reject each incoming request, unless an approval rule
+// applies: an endpoint listed in approval.endpoints, an agent-initiated
+// follow-up within approval.followUpMinutes of an approved user-initiated
+// request of the same session, or an "approve all" window opened by
+// answering "a". Prompts are shown one at a time, with the request's
+// summary from summarize if it gives one.
+func ManualApproval(summarize Summarizer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return manualApproval(next, summarize)
+	}
+}
+
+func manualApproval(next http.Handler, summarize Summarizer) http.Handler {
 	reader := bufio.NewReader(os.Stdin)
+	memory := &approvalMemory{sessions: make(map[string]time.Time)}
+	var prompt sync.Mutex
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Always allow health check
-		if r.URL.Path == "/" {
+		// Always allow health checks
+		if r.URL.Path == "/" || r.URL.Path == "/healthz" {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		fmt.Printf("\n  Incoming request: %s %s\n", r.Method, r.URL.Path)
-		fmt.Print("  Accept? [y/N]: ")
+		var body []byte
+		if r.Method == http.MethodPost {
+			var err error
+			if body, err = io.ReadAll(r.Body); err != nil {
+				http.Error(w, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		session, isAgent := approvalSession(r, body)
+		summary, hasSummary := RequestSummary{}, false
+		if summarize != nil && len(body) > 0 {
+			if summary, hasSummary = summarize(r, body); hasSummary {
+				isAgent = summary.Initiator == "agent"
+			}
+		}
 
+		if rule := memory.autoApprove(config.FromContext(r.Context()), r.URL.Path, session, isAgent); rule != "" {
+			approve(w, r, next, rule)
+			return
+		}
+
+		prompt.Lock()
+		// An answer to an earlier prompt may have approved this one
+		if rule := memory.autoApprove(config.FromContext(r.Context()), r.URL.Path, session, isAgent); rule != "" {
+			prompt.Unlock()
+			approve(w, r, next, rule)
+			return
+		}
+		allWindow := config.FromContext(r.Context()).ApproveAllWindow()
+		fmt.Printf("\n  Incoming request: %s %s\n", r.Method, r.URL.Path)
+		if hasSummary {
+			fmt.Print(summary)
+		}
+		fmt.Printf("  Accept? [y/N, a = all for %s]: ", allWindow)
 		input, err := reader.ReadString('\n')
+		prompt.Unlock()
 		if err != nil {
 			slog.Error("failed to read approval input", "error", err)
+			setApproval(r, "rejected")
 			reject(w)
 			return
 		}
 
-		input = strings.TrimSpace(strings.ToLower(input))
-		if input != "y" && input != "yes" {
+		switch strings.TrimSpace(strings.ToLower(input)) {
+		case "y", "yes":
+			if !isAgent {
+				memory.approveSession(config.FromContext(r.Context()), session)
+			}
+			approve(w, r, next, ruleOperator)
+		case "a", "all":
+			memory.approveAll(allWindow)
+			slog.Info("approving all requests", "for", allWindow)
+			approve(w, r, next, ruleOperator)
+		default:
 			slog.Info("request rejected by operator", "path", r.URL.Path)
+			setApproval(r, "rejected")
 			reject(w)
-			return
 		}
-
-		slog.Info("request approved by operator", "path", r.URL.Path)
-		next.ServeHTTP(w, r)
 	})
 }
 
+func approve(w http.ResponseWriter, r *http.Request, next http.Handler, rule string) {
+	slog.Info("request approved", "path", r.URL.Path, "rule", rule)
+	setApproval(r, "approved")
+	next.ServeHTTP(w, r)
+}
+
+// autoApprove returns the rule approving a request without a prompt, or
+// "" if none applies.
+func (m *approvalMemory) autoApprove(c *config.Config, path, session string, isAgent bool) string {
+	cfg := c.Approval
+	for _, e := range cfg.Endpoints {
+		if e == path || slices.Contains(config.ApprovalEndpoints[e], path) {
+			return ruleEndpoint
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.Before(m.allUntil) {
+		return ruleApproveAll
+	}
+	if cfg.FollowUpMinutes > 0 && isAgent && session != "" {
+		if until, ok := m.sessions[session]; ok && now.Before(until) {
+			return ruleFollowUp
+		}
+	}
+	return ""
+}
+
+// approveSession opens the follow-up window of session, if follow-ups are
+// enabled.
+func (m *approvalMemory) approveSession(cfg *config.Config, session string) {
+	minutes := cfg.Approval.FollowUpMinutes
+	if session == "" || minutes <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, until := range m.sessions {
+		if !now.Before(until) {
+			delete(m.sessions, k)
+		}
+	}
+	m.sessions[session] = now.Add(time.Duration(minutes) * time.Minute)
+}
+
+func (m *approvalMemory) approveAll(d time.Duration) {
+	m.mu.Lock()
+	m.allUntil = time.Now().Add(d)
+	m.mu.Unlock()
+}
+
+// approvalSession returns the session a request belongs to, keyed by its
+// API key and metadata.user_id ("" without a user_id), and whether it is
+// agent-initiated: an X-Initiator header or the key's defaultInitiator if
+// API keys are configured, else the last message being from the assistant
+// or a tool, or a user message of only tool results. A summary's
+// initiator takes precedence.
+func approvalSession(r *http.Request, body []byte) (session string, isAgent bool) {
+	var req struct {
+		Metadata struct {
+			UserID string `json:"user_id"`
+		} `json:"metadata"`
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &req) != nil {
+		return "", false
+	}
+	if req.Metadata.UserID != "" {
+		session = APIKeyFromContext(r.Context()) + "\x00" + req.Metadata.UserID
+	}
+
+	if cfg := config.FromContext(r.Context()); len(cfg.GetAPIKeys()) > 0 {
+		initiator := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Initiator")))
+		if initiator == "" {
+			initiator = cfg.GetKeyOptions(APIKeyFromContext(r.Context())).DefaultInitiator
+		}
+		switch initiator {
+		case "agent":
+			return session, true
+		case "user":
+			return session, false
+		}
+	}
+
+	if len(req.Messages) == 0 {
+		return session, false
+	}
+	last := req.Messages[len(req.Messages)-1]
+	if last.Role != "user" {
+		return session, last.Role == "assistant" || last.Role == "tool"
+	}
+	var blocks []struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(last.Content, &blocks) != nil || len(blocks) == 0 {
+		return session, false // string content is user text
+	}
+	for _, b := range blocks {
+		if b.Type != "tool_result" {
+			return session, false
+		}
+	}
+	return session, true
+}
+
 func reject(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusForbidden)
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/audit"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// completionEndpoints maps the completion POST paths, which are audited
+// and recorded in the history, to their metrics endpoint name.
+var completionEndpoints = map[string]string{
+	"/v1/messages":         "messages",
+	"/chat/completions":    "chat_completions",
+	"/v1/chat/completions": "chat_completions",
+	"/responses":           "responses",
+	"/v1/responses":        "responses",
+}
+
+// tokenEndpoints maps the token GET paths, which are audited with the
+// caller's IP, to their audit endpoint name.
+var tokenEndpoints = map[string]string{
+	"/token":        "token",
+	"/token/github": "token_github",
+}
+
+// auditTrace collects the approval decision for the audit entry of one
+// request from further down the chain.
+type auditTrace struct {
+	mu       sync.Mutex
+	approval string
+}
+
+type auditTraceKey struct{}
+
+// Audit returns a middleware that appends an entry to w for every request
+// to the completion endpoints, and for every fetch of a token endpoint,
+// served or refused. It must run after Auth and before ManualApproval, and
+// relies on chi's RequestID middleware.
+func Audit(w *audit.Writer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if endpoint, ok := tokenEndpoints[r.URL.Path]; ok && r.Method == http.MethodGet {
+				auditTokenFetch(w, endpoint, next, rw, r)
+				return
+			}
+
+			endpoint, ok := completionEndpoints[r.URL.Path]
+			if !ok || r.Method != http.MethodPost {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			start := time.Now()
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(rw, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			watch, stop := watchRecord(r.Context(), chimw.GetReqID(r.Context()))
+			defer stop()
+			t := &auditTrace{}
+
+			respHash := sha256.New()
+			ww := chimw.NewWrapResponseWriter(rw, r.ProtoMajor)
+			ww.Tee(respHash)
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), auditTraceKey{}, t)))
+
+			entry := audit.Entry{
+				Time:         start,
+				KeyLabel:     config.FromContext(r.Context()).KeyLabel(APIKeyFromContext(r.Context())),
+				Endpoint:     endpoint,
+				Status:       ww.Status(),
+				PromptHash:   audit.Hash(body),
+				ResponseHash: "sha256:" + hex.EncodeToString(respHash.Sum(nil)),
+			}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			t.mu.Lock()
+			entry.Approval = t.approval
+			t.mu.Unlock()
+			if rec := watch.record(); rec != nil {
+				entry.Model = rec.Model
+				if rec.RoutedModel != rec.Model {
+					entry.RoutedModel = rec.RoutedModel
+				}
+				entry.InputTokens = rec.InputTokens
+				entry.OutputTokens = rec.OutputTokens
+				entry.CachedTokens = rec.CachedTokens
+			} else {
+				// Rejected before reaching the handler's metrics
+				var req struct {
+					Model string `json:"model"`
+				}
+				json.Unmarshal(body, &req)
+				entry.Model = req.Model
+			}
+
+			if err := w.Append(entry); err != nil {
+				slog.Error("failed to write audit log", "error", err)
+			}
+		})
+	}
+}
+
+// auditTokenFetch serves a token endpoint and appends its entry: the
+// caller's IP and the status, without hashes of the token.
+func auditTokenFetch(w *audit.Writer, endpoint string, next http.Handler, rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ww := chimw.NewWrapResponseWriter(rw, r.ProtoMajor)
+	next.ServeHTTP(ww, r)
+
+	entry := audit.Entry{
+		Time:     start,
+		KeyLabel: config.FromContext(r.Context()).KeyLabel(APIKeyFromContext(r.Context())),
+		Endpoint: endpoint,
+		ClientIP: ClientIP(r),
+		Status:   ww.Status(),
+	}
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	if err := w.Append(entry); err != nil {
+		slog.Error("failed to write audit log", "error", err)
+	}
+}
+
+// ClientIP returns the IP of the request's client, as set by chi's RealIP
+// middleware.
+func ClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// setApproval records a manual approval decision for the audit log.
+func setApproval(r *http.Request, decision string) {
+	if t, ok := r.Context().Value(auditTraceKey{}).(*auditTrace); ok {
+		t.mu.Lock()
+		t.approval = decision
+		t.mu.Unlock()
+	}
+}
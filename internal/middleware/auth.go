@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"strings"
@@ -10,7 +11,8 @@ import (
 
 // Auth returns a middleware that checks incoming requests for valid API keys.
 // If no API keys are configured, authentication is disabled.
-// GET / and OPTIONS requests always bypass authentication.
+// GET / and OPTIONS requests always bypass authentication; GET /healthz
+// bypasses it when auth.publicHealthz is set.
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Always allow health check and CORS preflight
@@ -19,7 +21,12 @@ func Auth(next http.Handler) http.Handler {
 			return
 		}
 
-		keys := config.GetAPIKeys()
+		if r.URL.Path == "/healthz" && config.FromContext(r.Context()).Auth.PublicHealthz {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		keys := config.FromContext(r.Context()).GetAPIKeys()
 		if len(keys) == 0 {
 			// Auth disabled
 			next.ServeHTTP(w, r)
@@ -47,10 +54,19 @@ func Auth(next http.Handler) http.Handler {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, apiKey)))
 	})
 }
 
+type apiKeyCtxKey struct{}
+
+// APIKeyFromContext returns the API key the request authenticated with, or
+// "" when authentication is disabled or bypassed.
+func APIKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(apiKeyCtxKey{}).(string)
+	return key
+}
+
 // extractAPIKey gets the API key from x-api-key header or Authorization Bearer.
 func extractAPIKey(r *http.Request) string {
 	// Try x-api-key first
@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+const (
+	// maxChaosDelay caps slow:<duration>.
+	maxChaosDelay = 5 * time.Minute
+	// defaultChaosEvents is how many SSE events pass before a reset or a
+	// malformed event without :N.
+	defaultChaosEvents = 3
+	// malformedSSEEvent is the broken event malformed-sse inserts: its
+	// JSON is cut off.
+	malformedSSEEvent = "event: chaos\ndata: {\"type\": \"chaos\", \"unterminated\n\n"
+)
+
+// errChaosReset is returned by writes after reset-mid-stream cut the
+// stream.
+var errChaosReset = errors.New("chaos: stream reset")
+
+// chaosDirective is a parsed X-Chaos header. Directives combine, comma
+// separated:
+//
+//	<status>             fail with this 4xx/5xx status, e.g. 429 or 503
+//	slow:<duration>      wait before handling, e.g. slow:5s
+//	reset-mid-stream[:N] drop the connection after N SSE events (default 3)
+//	malformed-sse[:N]    insert a broken event after N SSE events (default 3)
+type chaosDirective struct {
+	header    string
+	status    int
+	delay     time.Duration
+	resetAt   int // 0: no reset
+	malformAt int // 0: no malformed event
+}
+
+// parseChaos parses an X-Chaos header value.
+func parseChaos(v string) (*chaosDirective, error) {
+	d := &chaosDirective{header: v}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(strings.ToLower(part))
+		name, arg, hasArg := strings.Cut(part, ":")
+		switch name {
+		case "slow":
+			delay, err := time.ParseDuration(arg)
+			if err != nil || delay <= 0 || delay > maxChaosDelay {
+				return nil, fmt.Errorf("invalid X-Chaos directive %q (expected slow:<duration> up to %s)", part, maxChaosDelay)
+			}
+			d.delay = delay
+		case "reset-mid-stream", "malformed-sse":
+			n := defaultChaosEvents
+			if hasArg {
+				var err error
+				if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+					return nil, fmt.Errorf("invalid X-Chaos directive %q (expected %s or %s:<events>)", part, name, name)
+				}
+			}
+			if name == "reset-mid-stream" {
+				d.resetAt = n
+			} else {
+				d.malformAt = n
+			}
+		default:
+			status, err := strconv.Atoi(part)
+			if err != nil || status < 400 || status > 599 {
+				return nil, fmt.Errorf("invalid X-Chaos directive %q (expected a 4xx/5xx status, slow:<duration>, reset-mid-stream[:N] or malformed-sse[:N])", part)
+			}
+			d.status = status
+		}
+	}
+	return d, nil
+}
+
+type chaosCtxKey struct{}
+
+// ChaosFromContext returns the X-Chaos header that chaos mode applies to
+// the request, or "" when there is none.
+func ChaosFromContext(ctx context.Context) string {
+	d, _ := ctx.Value(chaosCtxKey{}).(*chaosDirective)
+	if d == nil {
+		return ""
+	}
+	return d.header
+}
+
+// Chaos returns a middleware that injects the failures an X-Chaos header
+// asks for into requests to the completion endpoints, to exercise client
+// retry logic. It is only installed by start --chaos; without it the
+// header is ignored. Requests it fails outright are recorded here; the
+// handler marks the rest with ChaosFromContext. It must run outside the
+// audit and history middleware, since a reset aborts the handler chain.
+func Chaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Chaos")
+		endpoint, ok := completionEndpoints[r.URL.Path]
+		if header == "" || !ok || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d, err := parseChaos(header)
+		if err != nil {
+			api.ForwardError(w, &api.HTTPError{Message: err.Error(), StatusCode: http.StatusBadRequest})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		json.Unmarshal(body, &req)
+		if (d.resetAt > 0 || d.malformAt > 0) && !req.Stream {
+			api.ForwardError(w, &api.HTTPError{
+				Message:    "X-Chaos reset-mid-stream and malformed-sse only apply to streaming requests",
+				StatusCode: http.StatusBadRequest,
+			})
+			return
+		}
+		slog.Warn("chaos: injecting failure", "endpoint", endpoint, "directive", header)
+
+		if d.delay > 0 {
+			select {
+			case <-time.After(d.delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if d.status != 0 {
+			start := time.Now()
+			msg := fmt.Sprintf("chaos: injected %d %s", d.status, http.StatusText(d.status))
+			if d.status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			api.ForwardError(w, &api.HTTPError{Message: msg, StatusCode: d.status})
+			state.MetricsFromContext(r.Context()).RecordRequest(state.RequestRecord{
+				RequestID:   chimw.GetReqID(r.Context()),
+				Timestamp:   start,
+				Endpoint:    endpoint,
+				Model:       req.Model,
+				RoutedModel: req.Model,
+				Streaming:   req.Stream,
+				Chaos:       header,
+				StatusCode:  d.status,
+				Error:       msg,
+			})
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), chaosCtxKey{}, d)
+		if d.resetAt == 0 && d.malformAt == 0 {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		cw := &chaosWriter{ResponseWriter: w, d: d}
+		next.ServeHTTP(cw, r.WithContext(ctx))
+		if cw.reset {
+			// Drop the connection without ending the response, as a
+			// network failure would
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// chaosWriter counts the SSE events written through it to insert a
+// malformed event or cut the stream after the configured number.
+type chaosWriter struct {
+	http.ResponseWriter
+	d         *chaosDirective
+	events    int
+	lastByte  byte
+	malformed bool
+	reset     bool
+}
+
+func (cw *chaosWriter) Write(p []byte) (int, error) {
+	if cw.reset {
+		return 0, errChaosReset
+	}
+	written := 0
+	for i, b := range p {
+		endOfEvent := b == '\n' && cw.lastByte == '\n'
+		cw.lastByte = b
+		if !endOfEvent {
+			continue
+		}
+		cw.events++
+		if cw.d.malformAt > 0 && cw.events == cw.d.malformAt && !cw.malformed {
+			n, err := cw.ResponseWriter.Write(p[written : i+1])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			cw.malformed = true
+			io.WriteString(cw.ResponseWriter, malformedSSEEvent)
+		}
+		if cw.d.resetAt > 0 && cw.events == cw.d.resetAt {
+			n, err := cw.ResponseWriter.Write(p[written : i+1])
+			written += n
+			if err == nil {
+				cw.Flush()
+			}
+			cw.reset = true
+			return written, errChaosReset
+		}
+	}
+	n, err := cw.ResponseWriter.Write(p[written:])
+	return written + n, err
+}
+
+func (cw *chaosWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *chaosWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
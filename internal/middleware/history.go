@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/history"
+)
+
+// maxHistoryCapture caps the response bytes kept to extract the answer
+// text of a history entry.
+const maxHistoryCapture = 8 << 20
+
+// History returns a middleware that records the prompt and response text
+// of every request to the completion endpoints in s while history.enabled
+// is set. It must run after ManualApproval, so rejected requests aren't
+// recorded, and relies on chi's RequestID middleware.
+func History(s *history.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			endpoint, ok := completionEndpoints[r.URL.Path]
+			if !ok || r.Method != http.MethodPost || !config.FromContext(r.Context()).History.Enabled {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			start := time.Now()
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(rw, "failed to read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			reqID := chimw.GetReqID(r.Context())
+			watch, stop := watchRecord(r.Context(), reqID)
+			defer stop()
+
+			resp := &cappedBuffer{max: maxHistoryCapture}
+			ww := chimw.NewWrapResponseWriter(rw, r.ProtoMajor)
+			ww.Tee(resp)
+			next.ServeHTTP(ww, r)
+
+			streamed := strings.HasPrefix(ww.Header().Get("Content-Type"), "text/event-stream")
+			entry := history.Entry{
+				ID:       reqID,
+				Time:     start,
+				KeyLabel: config.FromContext(r.Context()).KeyLabel(APIKeyFromContext(r.Context())),
+				Endpoint: endpoint,
+				Status:   ww.Status(),
+				Prompt:   history.PromptText(body),
+				Response: history.ResponseText(resp.Bytes(), streamed),
+			}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			if rec := watch.record(); rec != nil {
+				entry.Model = rec.Model
+				if rec.RoutedModel != rec.Model {
+					entry.RoutedModel = rec.RoutedModel
+				}
+				entry.InputTokens = rec.InputTokens
+				entry.OutputTokens = rec.OutputTokens
+			} else {
+				var req struct {
+					Model string `json:"model"`
+				}
+				json.Unmarshal(body, &req)
+				entry.Model = req.Model
+			}
+
+			if err := s.Append(entry); err != nil {
+				slog.Error("failed to write history", "error", err)
+			}
+		})
+	}
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the
+// rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
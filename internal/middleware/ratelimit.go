@@ -7,67 +7,92 @@ import (
 	"time"
 )
 
+// RateLimitStore holds the time of the last admitted request, so limiters
+// sharing a store share one limit.
+type RateLimitStore interface {
+	// Acquire admits a request when cooldown has passed since the last
+	// admitted one; otherwise it returns the time remaining.
+	Acquire(cooldown time.Duration) (time.Duration, error)
+}
+
+// localRateLimit is the per-process RateLimitStore.
+type localRateLimit struct {
+	mu          sync.Mutex
+	lastRequest time.Time
+}
+
+func (l *localRateLimit) Acquire(cooldown time.Duration) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// First request: always pass through
+	if !l.lastRequest.IsZero() {
+		if elapsed := time.Since(l.lastRequest); elapsed < cooldown {
+			return cooldown - elapsed, nil
+		}
+	}
+	l.lastRequest = time.Now()
+	return 0, nil
+}
+
 // RateLimiter enforces a minimum interval between requests.
 type RateLimiter struct {
-	mu           sync.Mutex
-	seconds      int
-	wait         bool
-	lastRequest  time.Time
+	seconds int
+	wait    bool
+	store   RateLimitStore
+	local   localRateLimit
 }
 
 // NewRateLimiter creates a rate limiter with the given interval in seconds.
 // If wait is true, requests will sleep instead of being rejected with 429.
-func NewRateLimiter(seconds int, wait bool) *RateLimiter {
+// A nil store limits this process only; when a shared store fails, the
+// limiter falls back to the local one.
+func NewRateLimiter(seconds int, wait bool, store RateLimitStore) *RateLimiter {
 	return &RateLimiter{
 		seconds: seconds,
 		wait:    wait,
+		store:   store,
+	}
+}
+
+func (rl *RateLimiter) acquire(cooldown time.Duration) time.Duration {
+	if rl.store != nil {
+		if remaining, err := rl.store.Acquire(cooldown); err == nil {
+			return remaining
+		}
 	}
+	remaining, _ := rl.local.Acquire(cooldown)
+	return remaining
 }
 
 // Middleware returns an HTTP middleware that enforces the rate limit.
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rl.mu.Lock()
-
-		if rl.lastRequest.IsZero() {
-			// First request: always pass through
-			rl.lastRequest = time.Now()
-			rl.mu.Unlock()
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		elapsed := time.Since(rl.lastRequest)
 		cooldown := time.Duration(rl.seconds) * time.Second
 
-		if elapsed < cooldown {
-			remaining := cooldown - elapsed
-
-			if rl.wait {
-				rl.mu.Unlock()
-				time.Sleep(remaining)
-				rl.mu.Lock()
-				rl.lastRequest = time.Now()
-				rl.mu.Unlock()
+		for {
+			remaining := rl.acquire(cooldown)
+			if remaining <= 0 {
 				next.ServeHTTP(w, r)
 				return
 			}
-
-			rl.mu.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", remaining.String())
-			w.WriteHeader(http.StatusTooManyRequests)
-			json.NewEncoder(w).Encode(map[string]any{
-				"error": map[string]string{
-					"message": "Rate limit exceeded",
-					"type":    "rate_limit_error",
-				},
-			})
-			return
+			if !rl.wait {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", remaining.String())
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]any{
+					"error": map[string]string{
+						"message": "Rate limit exceeded",
+						"type":    "rate_limit_error",
+					},
+				})
+				return
+			}
+			// Waiters retry in turn, so each is admitted in its own slot
+			select {
+			case <-time.After(remaining):
+			case <-r.Context().Done():
+				return
+			}
 		}
-
-		rl.lastRequest = time.Now()
-		rl.mu.Unlock()
-		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// recordWatch receives the request record the handler of one in-flight
+// request passes to its instance's metrics store, for middleware that
+// reports on the request once it is done (audit, history).
+type recordWatch struct {
+	mu  sync.Mutex
+	rec *state.RequestRecord
+}
+
+// record returns the handler's record, or nil if the request didn't get
+// that far (rejected by a middleware, or not a tracked endpoint).
+func (w *recordWatch) record() *state.RequestRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rec
+}
+
+// recordWatches holds the watches of one instance's in-flight requests by
+// request ID.
+type recordWatches struct {
+	sync.Mutex
+	m map[string][]*recordWatch
+}
+
+// deliver passes rec to the watches of its request; it is the metrics
+// store's OnRecord hook.
+func (ws *recordWatches) deliver(rec state.RequestRecord) {
+	ws.Lock()
+	watches := ws.m[rec.RequestID]
+	ws.Unlock()
+	for _, w := range watches {
+		w.mu.Lock()
+		w.rec = &rec
+		w.mu.Unlock()
+	}
+}
+
+// watchRecord starts watching for the record of request reqID (chi's
+// request ID) in the metrics of ctx's instance. stop must be called when
+// the request is done.
+func watchRecord(ctx context.Context, reqID string) (w *recordWatch, stop func()) {
+	ws := &registryOf(ctx).watches
+	w = &recordWatch{}
+	ws.Lock()
+	ws.m[reqID] = append(ws.m[reqID], w)
+	ws.Unlock()
+	return w, func() {
+		ws.Lock()
+		defer ws.Unlock()
+		watches := ws.m[reqID]
+		for i, other := range watches {
+			if other == w {
+				watches = append(watches[:i:i], watches[i+1:]...)
+				break
+			}
+		}
+		if len(watches) == 0 {
+			delete(ws.m, reqID)
+		} else {
+			ws.m[reqID] = watches
+		}
+	}
+}
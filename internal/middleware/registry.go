@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Registry is what the middleware tracks for one proxy instance: its
+// in-flight completion requests (see ActiveRequests) and the request
+// records the audit, history and tracing middleware wait for. Each
+// instance has its own, put on its requests' context with WithRegistry.
+type Registry struct {
+	active  activeRequests
+	watches recordWatches
+}
+
+// NewRegistry returns the registry of a new proxy instance, whose handlers
+// record their requests to metrics.
+func NewRegistry(metrics *state.MetricsStore) *Registry {
+	reg := &Registry{
+		active:  activeRequests{m: make(map[string]*activeEntry)},
+		watches: recordWatches{m: make(map[string][]*recordWatch)},
+	}
+	metrics.OnRecord(reg.watches.deliver)
+	return reg
+}
+
+type registryKey struct{}
+
+// WithRegistry returns a context whose requests are tracked in reg.
+func WithRegistry(ctx context.Context, reg *Registry) context.Context {
+	return context.WithValue(ctx, registryKey{}, reg)
+}
+
+// registryOf returns the registry of the proxy instance serving ctx's
+// request. A context without one is a wiring bug, so it panics rather
+// than track the request with another instance's.
+func registryOf(ctx context.Context) *Registry {
+	reg, ok := ctx.Value(registryKey{}).(*Registry)
+	if !ok {
+		panic("middleware: context carries no proxy instance registry")
+	}
+	return reg
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/telemetry"
+)
+
+// Tracing starts the server span of each request to the completion
+// endpoints while telemetry is enabled, as a child of
+// the client's traceparent if it sent one. The handler's spans nest under
+// it; the model, backend, initiator and tokens come from the handler's
+// request record. It relies on chi's RequestID middleware.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		endpoint, ok := completionEndpoints[r.URL.Path]
+		if !ok || r.Method != http.MethodPost || !telemetry.Enabled(r.Context()) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		ctx := telemetry.Extract(r.Context(), r.Header)
+		ctx, span := telemetry.Start(ctx, r.Method+" "+r.URL.Path, telemetry.KindServer)
+		defer span.End()
+		span.SetString("http.request.method", r.Method)
+		span.SetString("url.path", r.URL.Path)
+		span.SetString("copilot_proxy.endpoint", endpoint)
+
+		reqID := chimw.GetReqID(r.Context())
+		watch, stop := watchRecord(r.Context(), reqID)
+		defer stop()
+
+		ww := chimw.NewWrapResponseWriter(rw, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetInt("http.response.status_code", int64(status))
+		span.SetString("copilot_proxy.request_id", reqID)
+		rec := watch.record()
+		if rec == nil {
+			return
+		}
+		span.SetString("gen_ai.request.model", rec.Model)
+		span.SetString("copilot_proxy.routed_model", rec.RoutedModel)
+		span.SetString("copilot_proxy.backend", rec.Backend)
+		span.SetString("copilot_proxy.initiator", rec.Initiator)
+		span.SetString("copilot_proxy.request_type", rec.RequestType)
+		span.SetInt("gen_ai.usage.input_tokens", rec.InputTokens)
+		span.SetInt("gen_ai.usage.output_tokens", rec.OutputTokens)
+		span.SetInt("copilot_proxy.usage.cached_tokens", rec.CachedTokens)
+		if rec.Error != "" {
+			span.SetError(errors.New(rec.Error))
+		}
+	})
+}
@@ -0,0 +1,225 @@
+// Package notify sends alerts about the proxy to the destinations in the
+// notifications config section: a webhook (Slack, Discord or generic
+// JSON) and a local command. Each event is sent at most once per
+// notifications.intervalMinutes.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// Events notified.
+const (
+	EventQuota         = "quota"          // premium quota use reached notifications.quotaPercent
+	EventCircuitOpen   = "circuit_open"   // Copilot requests keep failing
+	EventCircuitClosed = "circuit_closed" // Copilot recovered
+	EventAuthFailure   = "auth_failure"   // the Copilot token couldn't be refreshed
+	EventTest          = "test"           // notify test
+)
+
+// Environment variables set for notifications.command.
+const (
+	EnvEvent   = "COPILOT_PROXY_NOTIFY_EVENT"
+	EnvTitle   = "COPILOT_PROXY_NOTIFY_TITLE"
+	EnvMessage = "COPILOT_PROXY_NOTIFY_MESSAGE"
+)
+
+// deliveryTimeout bounds each webhook post and command run.
+const deliveryTimeout = 10 * time.Second
+
+// Notification is one alert, posted as is to json webhooks and passed on
+// stdin to the command.
+type Notification struct {
+	Event   string    `json:"event"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	Host    string    `json:"host,omitempty"` // tells instances apart
+	Time    time.Time `json:"time"`
+}
+
+// History is when a proxy instance last notified each event, for the
+// notifications.intervalMinutes limit of Send. Each instance has its own,
+// put on its context with WithHistory.
+type History struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// NewHistory returns the notification history of a new proxy instance.
+func NewHistory() *History {
+	return &History{last: make(map[string]time.Time)}
+}
+
+type historyKey struct{}
+
+// WithHistory returns a context whose notifications are limited by h.
+func WithHistory(ctx context.Context, h *History) context.Context {
+	return context.WithValue(ctx, historyKey{}, h)
+}
+
+// historyOf returns the notification history of ctx's proxy instance,
+// panicking without one like config.StoreFromContext.
+func historyOf(ctx context.Context) *History {
+	h, ok := ctx.Value(historyKey{}).(*History)
+	if !ok {
+		panic("notify: context carries no proxy instance notification history")
+	}
+	return h
+}
+
+// Send notifies event in the background, unless no destination is
+// configured or event was notified less than notifications.intervalMinutes
+// ago. The destinations, interval and history are those of ctx's proxy
+// instance (see config.StoreFromContext and WithHistory). Delivery
+// failures are logged.
+func Send(ctx context.Context, event, title, message string) {
+	cfg := config.FromContext(ctx)
+	if !cfg.NotificationsEnabled() {
+		return
+	}
+	now := time.Now()
+	h := historyOf(ctx)
+	h.mu.Lock()
+	if last, ok := h.last[event]; ok && now.Sub(last) < cfg.NotifyInterval() {
+		h.mu.Unlock()
+		slog.Debug("notification suppressed", "event", event, "last_sent", last)
+		return
+	}
+	h.last[event] = now
+	h.mu.Unlock()
+
+	n := New(event, title, message)
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := Deliver(ctx, n); err != nil {
+			slog.Warn("notification failed", "event", event, "error", err)
+			return
+		}
+		slog.Info("notification sent", "event", event)
+	}()
+}
+
+// New returns a notification of event, stamped with the host and time.
+func New(event, title, message string) Notification {
+	host, _ := os.Hostname()
+	return Notification{Event: event, Title: title, Message: message, Host: host, Time: time.Now()}
+}
+
+// Deliver sends n to every configured destination now, without the rate
+// limit of Send, and returns the failures joined.
+func Deliver(ctx context.Context, n Notification) error {
+	full := config.FromContext(ctx)
+	cfg := full.Notifications
+	var errs []error
+	if cfg.WebhookURL != "" {
+		if err := postWebhook(ctx, WebhookFormat(full, cfg.WebhookURL), cfg.WebhookURL, n); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	if cfg.Command != "" {
+		if err := runCommand(ctx, cfg.Command, n); err != nil {
+			errs = append(errs, fmt.Errorf("command: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WebhookFormat returns the body format posted to rawURL: the configured
+// one, or for auto, slack or discord when the URL is one of theirs and
+// json otherwise.
+func WebhookFormat(cfg *config.Config, rawURL string) string {
+	if f := cfg.GetWebhookFormat(); f != config.WebhookFormatAuto {
+		return f
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return config.WebhookFormatJSON
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "hooks.slack.com":
+		return config.WebhookFormatSlack
+	case (host == "discord.com" || host == "discordapp.com" || strings.HasSuffix(host, ".discord.com")) &&
+		strings.HasPrefix(u.Path, "/api/webhooks/"):
+		return config.WebhookFormatDiscord
+	}
+	return config.WebhookFormatJSON
+}
+
+func webhookBody(format string, n Notification) ([]byte, error) {
+	switch format {
+	case config.WebhookFormatSlack:
+		return json.Marshal(map[string]string{"text": "*" + n.Title + "*\n" + n.Message})
+	case config.WebhookFormatDiscord:
+		return json.Marshal(map[string]string{"content": "**" + n.Title + "**\n" + n.Message})
+	}
+	return json.Marshal(n)
+}
+
+func postWebhook(ctx context.Context, format, rawURL string, n Notification) error {
+	body, err := webhookBody(format, n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The URL carries the webhook's secret; keep it out of logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func runCommand(ctx context.Context, path string, n Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), EnvEvent+"="+n.Event, EnvTitle+"="+n.Title, EnvMessage+"="+n.Message)
+	// Don't wait on grandchildren that kept stderr open
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", path, err, msg)
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
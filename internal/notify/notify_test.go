@@ -0,0 +1,212 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// instanceContext returns a context whose proxy instance has the
+// notifications config nc and the notification history h.
+func instanceContext(nc config.NotificationsConfig, h *History) context.Context {
+	store := config.NewStore("")
+	store.Update(func(c *config.Config) { c.Notifications = nc })
+	return WithHistory(config.WithStore(context.Background(), store), h)
+}
+
+// posted is a request a webhook received.
+type posted struct {
+	contentType string
+	body        []byte
+}
+
+// newWebhook returns a webhook answering with status and message, and the
+// channel its requests go to.
+func newWebhook(t *testing.T, status int, message string) (*httptest.Server, chan posted) {
+	t.Helper()
+	got := make(chan posted, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- posted{r.Header.Get("Content-Type"), body}
+		w.WriteHeader(status)
+		io.WriteString(w, message)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+// delivered returns the events posted within a short wait.
+func delivered(t *testing.T, got chan posted) []string {
+	t.Helper()
+	var events []string
+	for {
+		select {
+		case p := <-got:
+			var n Notification
+			if err := json.Unmarshal(p.body, &n); err != nil {
+				t.Fatalf("webhook body %s: %v", p.body, err)
+			}
+			events = append(events, n.Event)
+		case <-time.After(200 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+func TestSendOncePerInterval(t *testing.T) {
+	srv, got := newWebhook(t, http.StatusOK, "")
+	h := NewHistory()
+	ctx := instanceContext(config.NotificationsConfig{WebhookURL: srv.URL, IntervalMinutes: 30}, h)
+
+	Send(ctx, EventCircuitOpen, "Copilot is failing", "2 requests failed")
+	Send(ctx, EventCircuitOpen, "Copilot is failing", "3 requests failed")
+	Send(ctx, EventQuota, "Quota", "90% used")
+	if events := delivered(t, got); !slices.Equal(slices.Sorted(slices.Values(events)), []string{EventCircuitOpen, EventQuota}) {
+		t.Fatalf("delivered %v, want each event once", events)
+	}
+
+	// Another instance keeps its own history
+	Send(instanceContext(config.NotificationsConfig{WebhookURL: srv.URL}, NewHistory()), EventCircuitOpen, "Copilot is failing", "")
+	if events := delivered(t, got); len(events) != 1 {
+		t.Errorf("other instance delivered %v, want its first circuit_open", events)
+	}
+
+	// Once the interval has passed, the event is sent again
+	h.mu.Lock()
+	h.last[EventCircuitOpen] = time.Now().Add(-31 * time.Minute)
+	h.mu.Unlock()
+	Send(ctx, EventCircuitOpen, "Copilot is failing", "")
+	if events := delivered(t, got); len(events) != 1 {
+		t.Errorf("after the interval delivered %v, want circuit_open again", events)
+	}
+}
+
+func TestSendWithoutDestinations(t *testing.T) {
+	h := NewHistory()
+	Send(instanceContext(config.NotificationsConfig{}, h), EventQuota, "Quota", "")
+	if len(h.last) != 0 {
+		t.Errorf("history %v, want nothing recorded without destinations", h.last)
+	}
+}
+
+func TestWebhookFormat(t *testing.T) {
+	tests := []struct {
+		format, url, want string
+	}{
+		{"", "https://hooks.slack.com/services/T0/B0/x", config.WebhookFormatSlack},
+		{"", "https://discord.com/api/webhooks/1/x", config.WebhookFormatDiscord},
+		{"", "https://ptb.discord.com/api/webhooks/1/x", config.WebhookFormatDiscord},
+		{"", "https://discordapp.com/api/webhooks/1/x", config.WebhookFormatDiscord},
+		{"", "https://discord.com/channels/1", config.WebhookFormatJSON},
+		{"", "https://example.com/hook", config.WebhookFormatJSON},
+		{"", "://", config.WebhookFormatJSON},
+		{config.WebhookFormatSlack, "https://example.com/hook", config.WebhookFormatSlack},
+		{config.WebhookFormatJSON, "https://hooks.slack.com/services/x", config.WebhookFormatJSON},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{Notifications: config.NotificationsConfig{WebhookFormat: tt.format}}
+		if got := WebhookFormat(cfg, tt.url); got != tt.want {
+			t.Errorf("WebhookFormat(%q, %q) = %q, want %q", tt.format, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	n := Notification{Event: EventQuota, Title: "Quota low", Message: "90% used", Host: "box", Time: time.Unix(1700000000, 0).UTC()}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{config.WebhookFormatJSON, `{"event":"quota","title":"Quota low","message":"90% used","host":"box","time":"2023-11-14T22:13:20Z"}`},
+		{config.WebhookFormatSlack, `{"text":"*Quota low*\n90% used"}`},
+		{config.WebhookFormatDiscord, `{"content":"**Quota low**\n90% used"}`},
+	}
+	for _, tt := range tests {
+		srv, got := newWebhook(t, http.StatusNoContent, "")
+		ctx := instanceContext(config.NotificationsConfig{WebhookURL: srv.URL, WebhookFormat: tt.format}, NewHistory())
+		if err := Deliver(ctx, n); err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		p := <-got
+		if p.contentType != "application/json" || string(p.body) != tt.want {
+			t.Errorf("%s: posted %s %s, want %s", tt.format, p.contentType, p.body, tt.want)
+		}
+	}
+}
+
+func TestDeliverFailures(t *testing.T) {
+	srv, _ := newWebhook(t, http.StatusInternalServerError, "  boom\n")
+	ln := httptest.NewServer(http.NotFoundHandler())
+	unreachable := ln.URL + "/hooks/secret-token"
+	ln.Close()
+
+	tests := []struct {
+		name    string
+		nc      config.NotificationsConfig
+		want    []string
+		notWant string
+	}{
+		{"webhook status", config.NotificationsConfig{WebhookURL: srv.URL}, []string{"webhook: status 500: boom"}, ""},
+		{"webhook unreachable", config.NotificationsConfig{WebhookURL: unreachable}, []string{"webhook: "}, "secret-token"},
+		{"command missing", config.NotificationsConfig{Command: filepath.Join(t.TempDir(), "missing")}, []string{"command: "}, ""},
+		{"both", config.NotificationsConfig{WebhookURL: srv.URL, Command: filepath.Join(t.TempDir(), "missing")}, []string{"webhook: status 500", "command: "}, ""},
+	}
+	for _, tt := range tests {
+		err := Deliver(instanceContext(tt.nc, NewHistory()), New(EventTest, "Test", "hello"))
+		if err == nil {
+			t.Errorf("%s: delivered", tt.name)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q, want %q in it", tt.name, err, want)
+			}
+		}
+		if tt.notWant != "" && strings.Contains(err.Error(), tt.notWant) {
+			t.Errorf("%s: error %q leaks %q", tt.name, err, tt.notWant)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "notify.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\n"+
+		"echo \"$"+EnvEvent+"|$"+EnvTitle+"|$"+EnvMessage+"\" > "+out+"\n"+
+		"cat >> "+out+"\n"+
+		"[ \"$"+EnvEvent+"\" = test ] || { echo refused >&2; exit 3; }\n"), 0o755)
+	ctx := instanceContext(config.NotificationsConfig{Command: script}, NewHistory())
+
+	if err := Deliver(ctx, New(EventTest, "Test", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(out)
+	env, stdin, _ := strings.Cut(string(data), "\n")
+	if env != "test|Test|hello" {
+		t.Errorf("environment = %q", env)
+	}
+	var n Notification
+	if err := json.Unmarshal([]byte(stdin), &n); err != nil || n.Event != EventTest || n.Message != "hello" {
+		t.Errorf("stdin = %q (%v), want the notification JSON", stdin, err)
+	}
+
+	err := Deliver(ctx, New(EventQuota, "Quota", ""))
+	if err == nil || !strings.Contains(err.Error(), "exit status 3: refused") {
+		t.Errorf("failing command: %v, want its exit status and stderr", err)
+	}
+}
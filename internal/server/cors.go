@@ -0,0 +1,130 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/cors"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// corsPolicy applies the cors config of store to every request, rebuilding
+// the policy when a config reload changes it. Without allowedOrigins, any
+// origin is allowed on a loopback bind, where only local pages can reach
+// the proxy, and none otherwise (same-origin only).
+func corsPolicy(store *config.Store, loopback bool) func(http.Handler) http.Handler {
+	var (
+		mu     sync.Mutex
+		cached config.CORSConfig
+		policy *cors.Cors
+	)
+	current := func() *cors.Cors {
+		c := store.Get()
+		mu.Lock()
+		defer mu.Unlock()
+		if policy == nil || !sameCORSConfig(c.CORS, cached) {
+			cached = c.CORS
+			policy = cors.New(corsOptions(c, loopback))
+		}
+		return policy
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current().Handler(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+func corsOptions(c *config.Config, loopback bool) cors.Options {
+	opts := cors.Options{
+		AllowedOrigins:   c.CORS.AllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   c.CORS.AllowedHeaders,
+		AllowCredentials: c.CORS.AllowCredentials,
+		MaxAge:           c.CORSMaxAge(),
+	}
+	if len(opts.AllowedHeaders) == 0 {
+		opts.AllowedHeaders = []string{"*"}
+	}
+	if len(opts.AllowedOrigins) == 0 {
+		if loopback {
+			opts.AllowedOrigins = []string{"*"}
+		} else {
+			// An empty list would allow every origin
+			opts.AllowOriginFunc = func(*http.Request, string) bool { return false }
+		}
+	}
+	return opts
+}
+
+func sameCORSConfig(a, b config.CORSConfig) bool {
+	return slices.Equal(a.AllowedOrigins, b.AllowedOrigins) &&
+		slices.Equal(a.AllowedHeaders, b.AllowedHeaders) &&
+		a.AllowCredentials == b.AllowCredentials &&
+		a.MaxAge == b.MaxAge
+}
+
+// websocketOrigins rejects WebSocket upgrades from pages the cors config
+// doesn't allow. The upgrade is a plain GET that browsers send from any
+// page without a preflight, and its response isn't subject to CORS, so
+// without this any website could open a socket to the proxy. Allowed are
+// a matching cors.allowedOrigins entry, the proxy's own origin, and
+// without allowedOrigins on a loopback bind, pages served from loopback
+// hosts. Requests without an Origin don't come from a browser and pass.
+// The cors config is that of store.
+func websocketOrigins(store *config.Store, loopback bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && !websocketOriginAllowed(r, origin, store.Get().CORS.AllowedOrigins, loopback) {
+				slog.Warn("rejected websocket upgrade from disallowed origin", "origin", origin, "path", r.URL.Path)
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func websocketOriginAllowed(r *http.Request, origin string, allowed []string, loopback bool) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // includes "null", sent by sandboxed pages and files
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if len(allowed) == 0 {
+		return loopback && isLoopbackHost(u.Hostname())
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		// One wildcard, as go-chi/cors matches: https://*.example.com
+		if prefix, suffix, ok := strings.Cut(pattern, "*"); ok &&
+			len(origin) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopbackHost reports whether host (start --host) only accepts local
+// connections. An empty host listens on all interfaces.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// useCORS sets the cors config for the rest of the test.
+func useCORS(t *testing.T, cors config.CORSConfig) {
+	t.Helper()
+	prev := config.Get()
+	config.Update(func(c *config.Config) { c.CORS = cors })
+	t.Cleanup(func() { config.Update(func(c *config.Config) { *c = *prev }) })
+}
+
+// globalInstance returns an instance serving the process-wide state,
+// metrics and config, the ones the tests change.
+func globalInstance() *Instance {
+	return NewInstance(state.Global, state.Metrics, config.Global, nil)
+}
+
+func TestWebsocketOriginAllowed(t *testing.T) {
+	tests := []struct {
+		origin   string
+		allowed  []string
+		loopback bool
+		want     bool
+	}{
+		// Same origin always
+		{"http://proxy.lan:4141", nil, false, true},
+		{"http://PROXY.lan:4141", []string{"https://app.example.com"}, false, true},
+		// Nothing configured: loopback pages on a loopback bind only
+		{"http://localhost:3000", nil, true, true},
+		{"http://127.0.0.1:5173", nil, true, true},
+		{"http://[::1]:8080", nil, true, true},
+		{"https://evil.example", nil, true, false},
+		{"http://localhost:3000", nil, false, false},
+		{"null", nil, true, false},
+		// Configured origins, wildcards as go-chi/cors matches them
+		{"https://app.example.com", []string{"https://app.example.com"}, false, true},
+		{"https://App.Example.com", []string{"https://app.example.com"}, true, true},
+		{"https://evil.example", []string{"https://app.example.com"}, true, false},
+		{"http://localhost:3000", []string{"https://app.example.com"}, true, false},
+		{"https://a.example.com", []string{"https://*.example.com"}, false, true},
+		{"https://example.com.evil", []string{"https://*.example.com"}, false, false},
+		{"https://anything.test", []string{"*"}, false, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://proxy.lan:4141/v1/messages/ws", nil)
+		if got := websocketOriginAllowed(r, tt.origin, tt.allowed, tt.loopback); got != tt.want {
+			t.Errorf("origin %s, allowed %v, loopback %v: got %v, want %v", tt.origin, tt.allowed, tt.loopback, got, tt.want)
+		}
+	}
+}
+
+// upgradeStatus sends a WebSocket upgrade for path to srv with origin and
+// returns the response status.
+func upgradeStatus(t *testing.T, srv *httptest.Server, path, origin string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + srv.Listener.Addr().String() + "\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	if origin != "" {
+		req += "Origin: " + origin + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestWebsocketUpgradeChecksOrigin(t *testing.T) {
+	useCORS(t, config.CORSConfig{})
+	srv := httptest.NewServer(New(globalInstance(), Options{Host: "127.0.0.1"}).Handler)
+	defer srv.Close()
+
+	for _, path := range []string{"/v1/messages/ws", "/v1/chat/completions/ws"} {
+		for _, tt := range []struct {
+			origin string
+			want   int
+		}{
+			{"", http.StatusSwitchingProtocols},
+			{"http://localhost:3000", http.StatusSwitchingProtocols},
+			{srv.URL, http.StatusSwitchingProtocols},
+			{"https://evil.example", http.StatusForbidden},
+			{"null", http.StatusForbidden},
+		} {
+			if got := upgradeStatus(t, srv, path, tt.origin); got != tt.want {
+				t.Errorf("%s from %q: status %d, want %d", path, tt.origin, got, tt.want)
+			}
+		}
+	}
+
+	// A configured list replaces the loopback default
+	useCORS(t, config.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}})
+	for origin, want := range map[string]int{
+		"https://app.example.com": http.StatusSwitchingProtocols,
+		"http://localhost:3000":   http.StatusForbidden,
+	} {
+		if got := upgradeStatus(t, srv, "/v1/messages/ws", origin); got != want {
+			t.Errorf("configured, from %q: status %d, want %d", origin, got, want)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	app := config.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true, MaxAge: 600}
+	tests := []struct {
+		name    string
+		host    string
+		cors    config.CORSConfig
+		origin  string
+		headers string // Access-Control-Request-Headers
+		// Expected response headers; empty when the preflight is refused
+		allowOrigin, allowCredentials, maxAge string
+	}{
+		{name: "loopback default", host: "127.0.0.1", origin: "http://localhost:3000", headers: "content-type,x-api-key",
+			allowOrigin: "*", maxAge: "300"},
+		{name: "loopback default, any page", host: "localhost", origin: "https://evil.example", headers: "content-type",
+			allowOrigin: "*", maxAge: "300"},
+		{name: "all interfaces default is same-origin", host: "0.0.0.0", origin: "http://localhost:3000", headers: "content-type"},
+		{name: "all interfaces, no host", host: "", origin: "https://app.example.com", headers: "content-type"},
+		{name: "configured origin with credentials", host: "0.0.0.0", cors: app, origin: "https://app.example.com", headers: "content-type,anthropic-version",
+			allowOrigin: "https://app.example.com", allowCredentials: "true", maxAge: "600"},
+		{name: "configured origin on loopback", host: "127.0.0.1", cors: app, origin: "https://app.example.com", headers: "content-type",
+			allowOrigin: "https://app.example.com", allowCredentials: "true", maxAge: "600"},
+		{name: "configured list replaces loopback default", host: "127.0.0.1", cors: app, origin: "http://localhost:3000", headers: "content-type"},
+		{name: "other origin rejected", host: "0.0.0.0", cors: app, origin: "https://evil.example", headers: "content-type"},
+		{name: "configured headers allow", host: "0.0.0.0", cors: config.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedHeaders: []string{"Content-Type", "X-Api-Key"}},
+			origin: "https://app.example.com", headers: "x-api-key", allowOrigin: "https://app.example.com", maxAge: "300"},
+		{name: "configured headers refuse others", host: "0.0.0.0", cors: config.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedHeaders: []string{"Content-Type"}},
+			origin: "https://app.example.com", headers: "x-api-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCORS(t, tt.cors)
+			srv := httptest.NewServer(New(globalInstance(), Options{Host: tt.host}).Handler)
+			defer srv.Close()
+
+			req, _ := http.NewRequest("OPTIONS", srv.URL+"/v1/messages", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			// Preflights are answered by the policy, never by the handler
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d, want 200", resp.StatusCode)
+			}
+			for header, want := range map[string]string{
+				"Access-Control-Allow-Origin":      tt.allowOrigin,
+				"Access-Control-Allow-Credentials": tt.allowCredentials,
+				"Access-Control-Max-Age":           tt.maxAge,
+			} {
+				if got := resp.Header.Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+			if tt.allowOrigin != "" {
+				if got := resp.Header.Get("Access-Control-Allow-Methods"); got != "POST" {
+					t.Errorf("Access-Control-Allow-Methods = %q, want POST", got)
+				}
+				if got := resp.Header.Get("Access-Control-Allow-Headers"); got == "" {
+					t.Error("no Access-Control-Allow-Headers")
+				}
+			}
+		})
+	}
+}
+
+func TestCORSReloadsConfig(t *testing.T) {
+	useCORS(t, config.CORSConfig{})
+	srv := httptest.NewServer(New(globalInstance(), Options{Host: "0.0.0.0"}).Handler)
+	defer srv.Close()
+
+	preflight := func() string {
+		req, _ := http.NewRequest("OPTIONS", srv.URL+"/v1/messages", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Access-Control-Allow-Origin")
+	}
+	if got := preflight(); got != "" {
+		t.Errorf("before reload: Access-Control-Allow-Origin = %q, want none", got)
+	}
+	config.Update(func(c *config.Config) { c.CORS.AllowedOrigins = []string{"https://app.example.com"} })
+	if got := preflight(); got != "https://app.example.com" {
+		t.Errorf("after reload: Access-Control-Allow-Origin = %q, want the configured origin", got)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/handler"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Instance is one proxy instance: the Copilot account it serves, its
+// metrics and config, and the caches and registries its requests share.
+// New serves it; instances run side by side in one process, sharing none
+// of it. The CLI serves state.Global, state.Metrics and config.Global.
+type Instance struct {
+	State   *state.State
+	Metrics *state.MetricsStore
+	Config  *config.Store
+	// Backend is the upstream the handlers call; tests pass a
+	// servicetest.Fake.
+	Backend service.Backend
+
+	account  *service.Account
+	caches   *handler.Caches
+	registry *middleware.Registry
+	notified *notify.History
+}
+
+// NewInstance returns an instance serving the account of st with metrics
+// and the config of cfg; a nil backend is the Copilot API.
+func NewInstance(st *state.State, metrics *state.MetricsStore, cfg *config.Store, backend service.Backend) *Instance {
+	if backend == nil {
+		backend = service.Copilot{}
+	}
+	return &Instance{
+		State:    st,
+		Metrics:  metrics,
+		Config:   cfg,
+		Backend:  backend,
+		account:  service.NewAccount(),
+		caches:   handler.NewCaches(st),
+		registry: middleware.NewRegistry(metrics),
+		notified: notify.NewHistory(),
+	}
+}
+
+// Context returns a copy of ctx served by the instance: every request of
+// New gets one, and so must the instance's background work (token
+// refresh, model refresh, quota polling).
+func (i *Instance) Context(ctx context.Context) context.Context {
+	ctx = state.WithState(ctx, i.State)
+	ctx = state.WithMetrics(ctx, i.Metrics)
+	ctx = config.WithStore(ctx, i.Config)
+	ctx = service.WithAccount(ctx, i.account)
+	ctx = handler.WithBackend(ctx, i.Backend)
+	ctx = handler.WithCaches(ctx, i.caches)
+	ctx = middleware.WithRegistry(ctx, i.registry)
+	return notify.WithHistory(ctx, i.notified)
+}
+
+// Close drops the instance's cached responses, stored conversations and
+// session pins. Stop serving it and cancel its background work first.
+func (i *Instance) Close() {
+	i.caches.Close()
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestOpenAPIDescribesManagementRoutes keeps /api/openapi.json in sync
+// with the router: every management route is described, and every
+// described operation is routed.
+func TestOpenAPIDescribesManagementRoutes(t *testing.T) {
+	router := New(globalInstance(), Options{Host: "127.0.0.1", Version: "test"}).Handler.(chi.Routes)
+
+	var routed []string
+	chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		switch {
+		case strings.HasPrefix(route, "/api/"), route == "/usage", route == "/healthz", strings.HasPrefix(route, "/token"):
+			routed = append(routed, method+" "+route)
+		}
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	router.(http.Handler).ServeHTTP(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decoding the document: %v (status %d)", err, rec.Code)
+	}
+	var described []string
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			described = append(described, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	slices.Sort(routed)
+	slices.Sort(described)
+	if !slices.Equal(routed, described) {
+		t.Errorf("routed management API:\n  %s\ndescribed:\n  %s", strings.Join(routed, "\n  "), strings.Join(described, "\n  "))
+	}
+}
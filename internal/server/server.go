@@ -3,93 +3,202 @@ package server
 import (
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 
+	"github.com/tonghaoch/copilot-proxy-go/internal/audit"
+	"github.com/tonghaoch/copilot-proxy-go/internal/batch"
+	"github.com/tonghaoch/copilot-proxy-go/internal/buildinfo"
 	"github.com/tonghaoch/copilot-proxy-go/internal/handler"
+	"github.com/tonghaoch/copilot-proxy-go/internal/history"
+	"github.com/tonghaoch/copilot-proxy-go/internal/mcp"
 	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
 )
 
 // Options configures the server behavior.
 type Options struct {
 	Port             int
+	Host             string // interface to listen on; empty for all
 	ManualApprove    bool
 	RateLimitSeconds int
 	RateLimitWait    bool
+	// RateLimitStore, if set, shares the rate limit with other instances.
+	RateLimitStore middleware.RateLimitStore
+	// AuditLog, if set, receives an entry for every completion request.
+	AuditLog *audit.Writer
+	// MCP, if set, is served over HTTP+SSE at /mcp/sse.
+	MCP *mcp.Server
+	// Version is the proxy version reported by /api/openapi.json.
+	Version string
+	// Chaos enables X-Chaos failure injection (start --chaos).
+	Chaos bool
 }
 
-// New creates a new HTTP server with all routes and middleware configured.
-func New(opts Options) *http.Server {
+// New creates a new HTTP server serving inst, with all routes and
+// middleware configured.
+func New(inst *Instance, opts Options) *http.Server {
+	st, cfg := inst.State, inst.Config
+	var batches *batch.Store
 	r := chi.NewRouter()
 
+	// The instance every request is served by, handlers reading it from
+	// the request context
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := inst.Context(req.Context())
+			if batches != nil {
+				ctx = batch.WithStore(ctx, batches)
+			}
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	})
+
 	// Core middleware
 	r.Use(chimw.RealIP)
 	r.Use(chimw.RequestID)
+	r.Use(chimw.SetHeader("X-Copilot-Proxy-Version", buildinfo.Get().Short()))
 	r.Use(requestLogger)
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: false,
-		MaxAge:           300,
-	}))
+	r.Use(corsPolicy(cfg, isLoopbackHost(opts.Host)))
 	r.Use(chimw.Recoverer)
 
-	// API key authentication
-	r.Use(middleware.Auth)
-
-	// Rate limiting (if configured)
-	if opts.RateLimitSeconds > 0 {
-		rl := middleware.NewRateLimiter(opts.RateLimitSeconds, opts.RateLimitWait)
-		r.Use(rl.Middleware)
-		slog.Info(fmt.Sprintf("rate limiting enabled: %ds (wait=%v)", opts.RateLimitSeconds, opts.RateLimitWait))
+	// WebSocket transport for streaming endpoints. The upgrade itself skips
+	// the policy middleware below, apart from the Origin check; the request
+	// it carries is dispatched back through the router as a POST and gets
+	// all of it.
+	wsOrigins := websocketOrigins(cfg, isLoopbackHost(opts.Host))
+	r.With(wsOrigins).Get("/v1/messages/ws", handler.WebSocket(r, "/v1/messages"))
+	r.With(wsOrigins).Get("/v1/chat/completions/ws", handler.WebSocket(r, "/v1/chat/completions"))
+
+	// MCP server (HTTP+SSE); authenticated, but not rate limited or
+	// approved per message
+	if opts.MCP != nil {
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Auth)
+			r.Get("/mcp/sse", opts.MCP.SSE("/mcp/message"))
+			r.Post("/mcp/message", opts.MCP.Messages)
+		})
 	}
 
-	// Manual approval (if enabled)
-	if opts.ManualApprove {
-		r.Use(middleware.ManualApproval)
-		slog.Info("manual approval enabled")
-	}
-
-	// Routes
-	r.Get("/", handler.Health)
-	r.Get("/token", handler.Token)
-	r.Get("/usage", handler.Usage)
-	r.Get("/dashboard", handler.Dashboard)
-	r.Get("/api/stats", handler.Stats)
-
-	// Models
-	r.Get("/models", handler.Models)
-	r.Get("/v1/models", handler.Models)
-
-	// Chat Completions
-	r.Post("/chat/completions", handler.ChatCompletions)
-	r.Post("/v1/chat/completions", handler.ChatCompletions)
-
-	// Messages (Anthropic-compatible)
-	r.Post("/v1/messages", handler.Messages)
-	r.Post("/v1/messages/count_tokens", handler.CountTokens)
-
-	// Responses (OpenAI Responses API)
-	r.Post("/responses", handler.Responses)
-	r.Post("/v1/responses", handler.Responses)
+	r.Group(func(r chi.Router) {
+		// API key authentication
+		r.Use(middleware.Auth)
+
+		// Failure injection for client testing; outside audit and history,
+		// whose handlers a mid-stream reset aborts
+		if opts.Chaos {
+			r.Use(middleware.Chaos)
+			slog.Warn("chaos mode enabled: X-Chaos headers inject upstream failures")
+		}
+
+		// OpenTelemetry server spans (while telemetry.otlpEndpoint is set)
+		r.Use(middleware.Tracing)
+
+		// Audit log (if enabled); before approval so decisions are recorded
+		if opts.AuditLog != nil {
+			r.Use(middleware.Audit(opts.AuditLog))
+		}
+
+		// In-flight request registry, for GET /api/requests/active and
+		// POST /api/requests/{id}/cancel; a request waiting for its rate
+		// limit or approval can be canceled too
+		r.Use(middleware.ActiveRequests)
+
+		// Rate limiting (if configured)
+		if opts.RateLimitSeconds > 0 {
+			rl := middleware.NewRateLimiter(opts.RateLimitSeconds, opts.RateLimitWait, opts.RateLimitStore)
+			r.Use(rl.Middleware)
+			slog.Info(fmt.Sprintf("rate limiting enabled: %ds (wait=%v, shared=%v)", opts.RateLimitSeconds, opts.RateLimitWait, opts.RateLimitStore != nil))
+		}
+
+		// Manual approval (if enabled)
+		if opts.ManualApprove {
+			r.Use(middleware.ManualApproval(handler.ApprovalSummary))
+			slog.Info("manual approval enabled")
+		}
+
+		// Transcript history; records only while history.enabled is set
+		r.Use(middleware.History(history.NewStore(st.HistoryPath(), func() history.Limits {
+			c := cfg.Get()
+			return history.Limits{MaxBytes: c.HistoryMaxBytes(), Retention: c.HistoryRetention()}
+		})))
+
+		// Routes
+		r.Get("/", handler.Health)
+		r.Get("/healthz", handler.Healthz)
+		r.Get("/token", handler.Token)
+		r.Get("/token/github", handler.GitHubToken)
+		r.Get("/usage", handler.Usage)
+		r.Get("/dashboard", handler.Dashboard)
+		r.Get("/dashboard/assets/*", handler.DashboardAssets)
+		r.Get("/api/stats", handler.Stats)
+		r.Get("/api/requests/active", handler.ActiveRequests)
+		r.Get("/api/requests/{id}/logs", handler.RequestLogs)
+		r.Post("/api/requests/{id}/cancel", handler.CancelRequest)
+		r.Post("/api/translate", handler.Translate)
+		r.Get("/api/models/info", handler.ModelsInfo)
+		r.Delete("/api/sessions/{id}/pin", handler.ReleaseSessionPin)
+		r.Get("/api/openapi.json", handler.OpenAPI(opts.Version))
+		r.Get("/api/history", handler.History)
+
+		// Models
+		r.Get("/models", handler.Models)
+		r.Get("/v1/models", handler.Models)
+
+		// Chat Completions
+		r.Post("/chat/completions", handler.Idempotent("chat_completions", handler.ChatCompletions))
+		r.Post("/v1/chat/completions", handler.Idempotent("chat_completions", handler.ChatCompletions))
+
+		// Messages (Anthropic-compatible)
+		r.Post("/v1/messages", handler.Idempotent("messages", handler.Messages))
+		r.Post("/v1/messages/count_tokens", handler.CountTokens)
+
+		// Responses (OpenAI Responses API)
+		r.Post("/responses", handler.Idempotent("responses", handler.Responses))
+		r.Post("/v1/responses", handler.Idempotent("responses", handler.Responses))
+
+		// OpenAI account stubs, for clients that probe them as health checks
+		r.Get("/v1/organizations", handler.Organizations)
+		r.Get("/v1/organization", handler.Organization)
+		r.Get("/v1/usage", handler.OpenAIUsage)
+
+		// Embeddings
+		r.Post("/embeddings", handler.Embeddings)
+		r.Post("/v1/embeddings", handler.Embeddings)
+
+		// Files and batches (OpenAI Batch API emulation)
+		for _, prefix := range []string{"", "/v1"} {
+			r.Post(prefix+"/files", handler.CreateFile)
+			r.Get(prefix+"/files", handler.ListFiles)
+			r.Get(prefix+"/files/{id}", handler.GetFile)
+			r.Delete(prefix+"/files/{id}", handler.DeleteFile)
+			r.Get(prefix+"/files/{id}/content", handler.FileContent)
+			r.Post(prefix+"/batches", handler.CreateBatch)
+			r.Get(prefix+"/batches", handler.ListBatches)
+			r.Get(prefix+"/batches/{id}", handler.GetBatch)
+			r.Post(prefix+"/batches/{id}/cancel", handler.CancelBatch)
+		}
+	})
 
-	// Embeddings
-	r.Post("/embeddings", handler.Embeddings)
-	r.Post("/v1/embeddings", handler.Embeddings)
+	// Batch jobs run their requests through the router, like clients
+	var err error
+	if batches, err = batch.Open(st.BatchesDir(), r, cfg); err != nil {
+		slog.Error("batch API unavailable", "error", err)
+	}
 
-	addr := fmt.Sprintf(":%d", opts.Port)
+	addr := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
 
+	// No WriteTimeout: upstream requests are bounded per endpoint by the
+	// timeouts config, and a server-wide limit would cut long streams short
 	return &http.Server{
-		Addr:         addr,
-		Handler:      r,
-		ReadTimeout:  5 * time.Minute,
-		WriteTimeout: 10 * time.Minute,
-		IdleTimeout:  120 * time.Second,
+		Addr:        addr,
+		Handler:     r,
+		ReadTimeout: 5 * time.Minute,
+		IdleTimeout: 120 * time.Second,
 	}
 }
 
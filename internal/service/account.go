@@ -0,0 +1,43 @@
+package service
+
+import "context"
+
+// Account is what the service package tracks about the Copilot account of
+// one proxy instance: its failover circuit, the latest rate-limit headers
+// per model, the modelConcurrency slots and the premium quota. Each
+// instance has its own, put on its requests' context with WithAccount.
+type Account struct {
+	circuit     circuitBreaker
+	rateLimits  rateLimits
+	modelLimits modelLimiter
+	premium     premiumQuota
+}
+
+// NewAccount returns the account data of a new proxy instance.
+func NewAccount() *Account {
+	return &Account{
+		rateLimits: rateLimits{
+			models: make(map[string]ModelRateLimit),
+			low:    make(map[string]bool),
+		},
+		modelLimits: modelLimiter{models: make(map[string]*modelSlots)},
+	}
+}
+
+type accountKey struct{}
+
+// WithAccount returns a context whose requests are accounted to a.
+func WithAccount(ctx context.Context, a *Account) context.Context {
+	return context.WithValue(ctx, accountKey{}, a)
+}
+
+// accountOf returns the account of the proxy instance serving ctx's
+// request. A context without one is a wiring bug, so it panics rather
+// than account the request to another instance.
+func accountOf(ctx context.Context) *Account {
+	a, ok := ctx.Value(accountKey{}).(*Account)
+	if !ok {
+		panic("service: context carries no proxy instance account")
+	}
+	return a
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Backend is the upstream the handlers send requests to. Copilot is the
+// real one; servicetest.Fake stands in for it where no Copilot API is
+// reachable.
+type Backend interface {
+	FetchModels(ctx context.Context) ([]state.Model, error)
+	ProxyChatCompletion(ctx context.Context, body []byte, isAgent bool) (*http.Response, error)
+	ProxyChatCompletionEx(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error)
+	ProxyChatCompletionFanOut(ctx context.Context, body []byte, isAgent bool, n int) ([]byte, error)
+	ProxyMessages(ctx context.Context, body []byte, betaHeader string, vision, isAgent bool) (*http.Response, error)
+	ProxyResponses(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error)
+	ProxyEmbeddings(ctx context.Context, body []byte) (*http.Response, error)
+}
+
+// Copilot is the Backend that calls the Copilot API, through the package
+// functions of the same names.
+type Copilot struct{}
+
+var _ Backend = Copilot{}
+
+func (Copilot) FetchModels(ctx context.Context) ([]state.Model, error) { return FetchModels(ctx) }
+
+func (Copilot) ProxyChatCompletion(ctx context.Context, body []byte, isAgent bool) (*http.Response, error) {
+	return ProxyChatCompletion(ctx, body, isAgent)
+}
+
+func (Copilot) ProxyChatCompletionEx(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error) {
+	return ProxyChatCompletionEx(ctx, body, isAgent, vision)
+}
+
+func (Copilot) ProxyChatCompletionFanOut(ctx context.Context, body []byte, isAgent bool, n int) ([]byte, error) {
+	return ProxyChatCompletionFanOut(ctx, body, isAgent, n)
+}
+
+func (Copilot) ProxyMessages(ctx context.Context, body []byte, betaHeader string, vision, isAgent bool) (*http.Response, error) {
+	return ProxyMessages(ctx, body, betaHeader, vision, isAgent)
+}
+
+func (Copilot) ProxyResponses(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error) {
+	return ProxyResponses(ctx, body, isAgent, vision)
+}
+
+func (Copilot) ProxyEmbeddings(ctx context.Context, body []byte) (*http.Response, error) {
+	return ProxyEmbeddings(ctx, body)
+}
@@ -1,23 +1,27 @@
 package service
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
 )
 
-// FetchModels retrieves available models from the Copilot API.
-func FetchModels() ([]state.Model, error) {
-	req, err := http.NewRequest(http.MethodGet, api.CopilotURL("/models"), nil)
+// FetchModels retrieves the models available to the account of ctx's
+// proxy instance from the Copilot API.
+func FetchModels(ctx context.Context) ([]state.Model, error) {
+	s := state.FromContext(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.CopilotURL(s, "/models"), nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating models request: %w", err)
 	}
-	req.Header = api.BuildCopilotHeadersFromState()
+	req.Header = api.BuildCopilotHeaders(s)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -28,35 +32,51 @@ func FetchModels() ([]state.Model, error) {
 	if resp.StatusCode != http.StatusOK {
 		return nil, api.NewHTTPError(resp)
 	}
+	s.MarkUpstreamSuccess()
 
 	var result state.ModelsResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("decoding models response: %w", err)
 	}
+	writeModelsCache(s, result.Data)
 	return result.Data, nil
 }
 
 // ProxyChatCompletion forwards a chat completion request to the Copilot API.
 // Used by the /chat/completions passthrough endpoint.
-func ProxyChatCompletion(body []byte, isAgent bool) (*http.Response, error) {
-	return ProxyChatCompletionEx(body, isAgent, false)
+func ProxyChatCompletion(ctx context.Context, body []byte, isAgent bool) (*http.Response, error) {
+	return ProxyChatCompletionEx(ctx, body, isAgent, false)
 }
 
 // ProxyChatCompletionEx forwards a chat completion request with vision support.
 // Used by the Messages handler when routing through Chat Completions backend.
-func ProxyChatCompletionEx(body []byte, isAgent, vision bool) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPost, api.CopilotURL("/chat/completions"), bytes.NewReader(body))
+// While Copilot is failed over, and for the request whose failure opens
+// the circuit, the alternate upstreams serve it instead.
+func ProxyChatCompletionEx(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error) {
+	if FailoverActive(ctx) {
+		return proxyAlternate(ctx, body)
+	}
+	resp, err := proxyCopilotChatCompletion(ctx, body, isAgent, vision)
+	if outage(err) && FailoverActive(ctx) {
+		slog.Warn("chat completion failed, retrying on alternate upstreams", "error", err)
+		return proxyAlternate(ctx, body)
+	}
+	return resp, err
+}
+
+func proxyCopilotChatCompletion(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "/chat/completions", body)
 	if err != nil {
 		return nil, fmt.Errorf("creating chat completion request: %w", err)
 	}
 
-	req.Header = api.BuildCopilotHeadersFromState()
+	req.Header = api.BuildCopilotHeaders(state.FromContext(ctx))
 	api.SetInitiatorHeader(req.Header, isAgent)
 	if vision {
 		req.Header.Set("Copilot-Vision-Request", "true")
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doUpstream(req, body)
 	if err != nil {
 		return nil, fmt.Errorf("proxying chat completion: %w", err)
 	}
@@ -66,17 +86,22 @@ func ProxyChatCompletionEx(body []byte, isAgent, vision bool) (*http.Response, e
 		return nil, api.NewHTTPError(resp)
 	}
 
+	state.FromContext(ctx).MarkUpstreamSuccess()
 	return resp, nil
 }
 
 // ProxyMessages forwards a request to the Copilot native Messages API.
-func ProxyMessages(body []byte, betaHeader string, vision, isAgent bool) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPost, api.CopilotURL("/v1/messages"), bytes.NewReader(body))
+// It has no failover: while Copilot is failed over it is rejected.
+func ProxyMessages(ctx context.Context, body []byte, betaHeader string, vision, isAgent bool) (*http.Response, error) {
+	if FailoverActive(ctx) {
+		return nil, errFailoverUnsupported(ctx, "native Messages API", body)
+	}
+	req, err := newUpstreamRequest(ctx, "/v1/messages", body)
 	if err != nil {
 		return nil, fmt.Errorf("creating messages request: %w", err)
 	}
 
-	req.Header = api.BuildCopilotHeadersFromState()
+	req.Header = api.BuildCopilotHeaders(state.FromContext(ctx))
 	api.SetInitiatorHeader(req.Header, isAgent)
 	if betaHeader != "" {
 		req.Header.Set("Anthropic-Beta", betaHeader)
@@ -85,7 +110,7 @@ func ProxyMessages(body []byte, betaHeader string, vision, isAgent bool) (*http.
 		req.Header.Set("Copilot-Vision-Request", "true")
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doUpstream(req, body)
 	if err != nil {
 		return nil, fmt.Errorf("proxying messages: %w", err)
 	}
@@ -95,23 +120,28 @@ func ProxyMessages(body []byte, betaHeader string, vision, isAgent bool) (*http.
 		return nil, api.NewHTTPError(resp)
 	}
 
+	state.FromContext(ctx).MarkUpstreamSuccess()
 	return resp, nil
 }
 
-// ProxyResponses forwards a request to the Copilot Responses API.
-func ProxyResponses(body []byte, isAgent, vision bool) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPost, api.CopilotURL("/responses"), bytes.NewReader(body))
+// ProxyResponses forwards a request to the Copilot Responses API. It has
+// no failover: while Copilot is failed over it is rejected.
+func ProxyResponses(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error) {
+	if FailoverActive(ctx) {
+		return nil, errFailoverUnsupported(ctx, "Responses API", body)
+	}
+	req, err := newUpstreamRequest(ctx, "/responses", body)
 	if err != nil {
 		return nil, fmt.Errorf("creating responses request: %w", err)
 	}
 
-	req.Header = api.BuildCopilotHeadersFromState()
+	req.Header = api.BuildCopilotHeaders(state.FromContext(ctx))
 	api.SetInitiatorHeader(req.Header, isAgent)
 	if vision {
 		req.Header.Set("Copilot-Vision-Request", "true")
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doUpstream(req, body)
 	if err != nil {
 		return nil, fmt.Errorf("proxying responses: %w", err)
 	}
@@ -121,19 +151,20 @@ func ProxyResponses(body []byte, isAgent, vision bool) (*http.Response, error) {
 		return nil, api.NewHTTPError(resp)
 	}
 
+	state.FromContext(ctx).MarkUpstreamSuccess()
 	return resp, nil
 }
 
 // ProxyEmbeddings forwards a request to the Copilot Embeddings API.
-func ProxyEmbeddings(body []byte) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPost, api.CopilotURL("/embeddings"), bytes.NewReader(body))
+func ProxyEmbeddings(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "/embeddings", body)
 	if err != nil {
 		return nil, fmt.Errorf("creating embeddings request: %w", err)
 	}
 
-	req.Header = api.BuildCopilotHeadersFromState()
+	req.Header = api.BuildCopilotHeaders(state.FromContext(ctx))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doUpstream(req, nil) // no body to hedge on: never hedged
 	if err != nil {
 		return nil, fmt.Errorf("proxying embeddings: %w", err)
 	}
@@ -143,6 +174,7 @@ func ProxyEmbeddings(body []byte) (*http.Response, error) {
 		return nil, api.NewHTTPError(resp)
 	}
 
+	state.FromContext(ctx).MarkUpstreamSuccess()
 	return resp, nil
 }
 
@@ -153,22 +185,32 @@ type ChatCompletionPayload struct {
 	Model     string           `json:"model"`
 	Stream    bool             `json:"stream"`
 	MaxTokens *int             `json:"max_tokens,omitempty"`
+	N         *int             `json:"n,omitempty"`
 	Messages  []map[string]any `json:"messages"`
 }
 
+// MaxChoices caps n when fanning out a chat completion.
+const MaxChoices = 8
+
 // ParseAndPatchChatCompletion reads the request body, patches max_tokens if
-// missing, and determines the initiator. Returns the patched body bytes,
-// whether streaming is requested, and whether this is an agent-initiated request.
-func ParseAndPatchChatCompletion(body io.Reader) ([]byte, bool, bool, error) {
+// missing, merges mid-conversation system messages (see
+// mergeMidSystemMessages), and determines the initiator. Returns the patched
+// body bytes, whether streaming is requested, whether this is an
+// agent-initiated request, and the number of choices to fan out.
+//
+// n > 1 is only accepted for non-streaming requests with
+// chatCompletionFanOut enabled; it is then removed from the body so each
+// upstream request returns one choice.
+func ParseAndPatchChatCompletion(ctx context.Context, body io.Reader) ([]byte, bool, bool, int, error) {
 	raw, err := io.ReadAll(body)
 	if err != nil {
-		return nil, false, false, fmt.Errorf("reading request body: %w", err)
+		return nil, false, false, 0, fmt.Errorf("reading request body: %w", err)
 	}
 
 	// Parse into a generic map so we can patch without losing fields
 	var payload map[string]any
 	if err := json.Unmarshal(raw, &payload); err != nil {
-		return nil, false, false, fmt.Errorf("parsing request body: %w", err)
+		return nil, false, false, 0, fmt.Errorf("parsing request body: %w", err)
 	}
 
 	// Parse the fields we care about
@@ -177,9 +219,21 @@ func ParseAndPatchChatCompletion(body io.Reader) ([]byte, bool, bool, error) {
 
 	isStream := parsed.Stream
 
+	n := 1
+	if parsed.N != nil {
+		n = *parsed.N
+	}
+	cfg := config.FromContext(ctx)
+	if err := checkChoiceCount(cfg, n, isStream); err != nil {
+		return nil, false, false, 0, err
+	}
+	if n > 1 {
+		delete(payload, "n")
+	}
+
 	// Auto-fill max_tokens from model capabilities if missing
 	if parsed.MaxTokens == nil {
-		if model := state.Global.FindModel(parsed.Model); model != nil {
+		if model := state.FromContext(ctx).FindModel(parsed.Model); model != nil {
 			maxOut := model.Capabilities.Limits.MaxOutputTokens
 			if maxOut > 0 {
 				payload["max_tokens"] = maxOut
@@ -187,6 +241,31 @@ func ParseAndPatchChatCompletion(body io.Reader) ([]byte, bool, bool, error) {
 		}
 	}
 
+	// Per-model parallel tool call policy on top of the client's choice;
+	// the field is only valid when tools are present
+	if tools, ok := payload["tools"].([]any); ok && len(tools) > 0 {
+		var requested *bool
+		if v, ok := payload["parallel_tool_calls"].(bool); ok {
+			requested = &v
+		}
+		if parallel := cfg.ResolveParallelToolCalls(parsed.Model, requested); parallel != nil {
+			payload["parallel_tool_calls"] = *parallel
+		}
+	}
+
+	// Per-model temperature/top_p policy
+	patchSamplingParams(ctx, payload, parsed.Model)
+
+	// Fold non-leading system messages into user messages
+	if cfg.GetMidConversationSystem() == config.MidSystemMerge {
+		if messages, ok := payload["messages"].([]any); ok {
+			if merged, n := mergeMidSystemMessages(messages); n > 0 {
+				payload["messages"] = merged
+				slog.Debug("merged mid-conversation system messages", "count", n)
+			}
+		}
+	}
+
 	// Detect initiator: if last message is from assistant or tool, it's agent-initiated
 	isAgent := false
 	if len(parsed.Messages) > 0 {
@@ -199,8 +278,28 @@ func ParseAndPatchChatCompletion(body io.Reader) ([]byte, bool, bool, error) {
 	// Re-marshal the patched payload
 	patched, err := json.Marshal(payload)
 	if err != nil {
-		return nil, false, false, fmt.Errorf("marshaling patched payload: %w", err)
+		return nil, false, false, 0, fmt.Errorf("marshaling patched payload: %w", err)
 	}
 
-	return patched, isStream, isAgent, nil
+	return patched, isStream, isAgent, n, nil
+}
+
+// checkChoiceCount rejects n values that cannot be honored.
+func checkChoiceCount(cfg *config.Config, n int, stream bool) error {
+	var msg string
+	switch {
+	case n < 1:
+		msg = "n must be at least 1"
+	case n == 1:
+		return nil
+	case stream:
+		msg = "n > 1 is not supported for streaming requests"
+	case !cfg.ChatCompletionFanOut:
+		msg = "n > 1 is not supported (enable chatCompletionFanOut to send one upstream request per choice)"
+	case n > MaxChoices:
+		msg = fmt.Sprintf("n must be at most %d", MaxChoices)
+	default:
+		return nil
+	}
+	return &api.HTTPError{Message: msg, StatusCode: http.StatusBadRequest}
 }
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+func TestParseAndPatchChatCompletionParallelToolCalls(t *testing.T) {
+	const tools = `"tools":[{"type":"function","function":{"name":"read","parameters":{"type":"object"}}}]`
+	tests := []struct {
+		name    string
+		policy  map[string]bool
+		request string
+		want    string // parallel_tool_calls sent, "" when absent
+	}{
+		{"client value kept", nil, `{"model":"gpt-5-mini",` + tools + `,"parallel_tool_calls":true}`, "true"},
+		{"nothing set", nil, `{"model":"gpt-5-mini",` + tools + `}`, ""},
+		{"model disables over client", map[string]bool{"gpt-5-mini": false}, `{"model":"gpt-5-mini",` + tools + `,"parallel_tool_calls":true}`, "false"},
+		{"client disables over model", map[string]bool{"gpt-5-mini": true}, `{"model":"gpt-5-mini",` + tools + `,"parallel_tool_calls":false}`, "false"},
+		{"model default", map[string]bool{"gpt-5-mini": true}, `{"model":"gpt-5-mini",` + tools + `}`, "true"},
+		{"no tools", map[string]bool{"gpt-5-mini": false}, `{"model":"gpt-5-mini"}`, ""},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *config.Config) { c.ModelToolParallelism = tt.policy })
+		body := strings.Replace(tt.request, "{", `{"messages":[{"role":"user","content":"hi"}],`, 1)
+		out, _, _, _, err := ParseAndPatchChatCompletion(testContext(context.Background()), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var fields map[string]json.RawMessage
+		json.Unmarshal(out, &fields)
+		if got := string(fields["parallel_tool_calls"]); got != tt.want {
+			t.Errorf("%s: parallel_tool_calls = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAndPatchChatCompletionSystemMessages(t *testing.T) {
+	const reminder = "<system-reminder>\\n%s\\n</system-reminder>"
+	r := func(s string) string { return strings.ReplaceAll(reminder, "%s", s) }
+	tests := []struct {
+		name     string
+		mode     string
+		messages string
+		want     string
+	}{
+		{
+			"leading system kept",
+			"",
+			`[{"role":"system","content":"a"},{"role":"system","content":"b"},{"role":"user","content":"hi"}]`,
+			`[{"content":"a","role":"system"},{"content":"b","role":"system"},{"content":"hi","role":"user"}]`,
+		},
+		{
+			"merged into the next user message",
+			"",
+			`[{"role":"system","content":"s"},{"role":"user","content":"q1"},{"role":"assistant","content":"a1"},{"role":"system","content":"r1"},{"role":"user","content":"q2"}]`,
+			`[{"content":"s","role":"system"},{"content":"q1","role":"user"},{"content":"a1","role":"assistant"},{"content":"` + r("r1") + `\n\nq2","role":"user"}]`,
+		},
+		{
+			"several interleaved",
+			"merge",
+			`[{"role":"user","content":"q1"},{"role":"system","content":"r1"},{"role":"assistant","content":"a1"},{"role":"system","content":"r2"},{"role":"system","content":"r3"},{"role":"user","content":"q2"},{"role":"system","content":"r4"},{"role":"user","content":"q3"}]`,
+			`[{"content":"q1","role":"user"},{"content":"a1","role":"assistant"},{"content":"` + r("r1") + `\n\n` + r("r2") + `\n\n` + r("r3") + `\n\nq2","role":"user"},{"content":"` + r("r4") + `\n\nq3","role":"user"}]`,
+		},
+		{
+			"trailing system appended to the last user message",
+			"",
+			`[{"role":"user","content":"q1"},{"role":"assistant","content":"a1"},{"role":"tool","tool_call_id":"c1","content":"out"},{"role":"system","content":"r1"}]`,
+			`[{"content":"q1\n\n` + r("r1") + `","role":"user"},{"content":"a1","role":"assistant"},{"content":"out","role":"tool","tool_call_id":"c1"}]`,
+		},
+		{
+			"no user message",
+			"",
+			`[{"role":"assistant","content":"a1"},{"role":"system","content":"r1"}]`,
+			`[{"content":"a1","role":"assistant"},{"content":"` + r("r1") + `","role":"user"}]`,
+		},
+		{
+			"content parts keep their shape",
+			"",
+			`[{"role":"user","content":"q1"},{"role":"system","content":[{"type":"text","text":"r1"}]},{"role":"user","content":[{"type":"text","text":"q2"}]}]`,
+			`[{"content":"q1","role":"user"},{"content":[{"text":"` + r("r1") + `","type":"text"},{"text":"q2","type":"text"}],"role":"user"}]`,
+		},
+		{
+			"keep mode forwards as is",
+			"keep",
+			`[{"role":"user","content":"q1"},{"role":"system","content":"r1"},{"role":"user","content":"q2"}]`,
+			`[{"content":"q1","role":"user"},{"content":"r1","role":"system"},{"content":"q2","role":"user"}]`,
+		},
+	}
+	for _, tt := range tests {
+		useConfig(t, func(c *config.Config) { c.MidConversationSystem = tt.mode })
+		out, _, _, _, err := ParseAndPatchChatCompletion(testContext(context.Background()), strings.NewReader(`{"model":"gpt-4.1","messages":`+tt.messages+`}`))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got struct{ Messages any }
+		json.Unmarshal(out, &got)
+		var want any
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatalf("%s: bad want: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got.Messages, want) {
+			t.Errorf("%s:\n got %v\nwant %v", tt.name, got.Messages, want)
+		}
+	}
+}
+
+func TestParseAndPatchChatCompletionKeepsLogprobs(t *testing.T) {
+	useConfig(t, func(c *config.Config) {})
+	body := `{"model":"gpt-4.1","messages":[{"role":"user","content":"hi"}],"logprobs":true,"top_logprobs":5}`
+	out, _, _, _, err := ParseAndPatchChatCompletion(testContext(context.Background()), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(out, &fields)
+	if string(fields["logprobs"]) != "true" || string(fields["top_logprobs"]) != "5" {
+		t.Errorf("logprobs = %s, top_logprobs = %s; want true, 5", fields["logprobs"], fields["top_logprobs"])
+	}
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
+	"github.com/tonghaoch/copilot-proxy-go/internal/telemetry"
+)
+
+// circuitBreaker tracks consecutive failed Copilot requests: network
+// errors and 5xx responses. failover.threshold of them in a row open it
+// for failover.cooldownSeconds; after that Copilot is tried again, and a
+// success closes it while another failure reopens it. Each account has
+// one.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// CircuitStatus describes the Copilot circuit breaker, as reported in
+// /api/stats.
+type CircuitStatus struct {
+	Open                bool       `json:"open"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+// Circuit returns the state of the Copilot circuit breaker of ctx's
+// account.
+func Circuit(ctx context.Context) CircuitStatus {
+	c := &accountOf(ctx).circuit
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := CircuitStatus{ConsecutiveFailures: c.failures}
+	if time.Now().Before(c.openUntil) {
+		until := c.openUntil
+		status.Open = true
+		status.OpenUntil = &until
+	}
+	return status
+}
+
+// record counts the outcome of a Copilot request sent with ctx. A request
+// canceled by the proxy (a hedge that lost) counts as neither.
+func (c *circuitBreaker) record(ctx context.Context, resp *http.Response, err error) {
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	cfg := config.FromContext(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		if c.failures >= cfg.FailoverThreshold() {
+			slog.Info("Copilot recovered, closing the failover circuit")
+			notify.Send(ctx, notify.EventCircuitClosed, "Copilot recovered",
+				fmt.Sprintf("Copilot requests succeed again after %d consecutive failures.", c.failures))
+		}
+		c.failures = 0
+		c.openUntil = time.Time{}
+		return
+	}
+	c.failures++
+	now := time.Now()
+	if c.failures >= cfg.FailoverThreshold() && !now.Before(c.openUntil) {
+		c.openUntil = now.Add(cfg.FailoverCooldown())
+		msg := fmt.Sprintf("%d Copilot requests in a row failed.", c.failures)
+		if len(cfg.AlternateUpstreams) > 0 {
+			slog.Warn("Copilot is failing, serving chat completions from alternate upstreams",
+				"consecutive_failures", c.failures, "cooldown", cfg.FailoverCooldown())
+			msg += " Chat completions are served by the alternate upstreams."
+		}
+		notify.Send(ctx, notify.EventCircuitOpen, "Copilot is failing", msg)
+	}
+}
+
+func (c *circuitBreaker) open() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.openUntil)
+}
+
+// FailoverActive reports whether chat completions of ctx's proxy instance
+// currently go to the alternate upstreams: its circuit is open and
+// alternates are configured.
+func FailoverActive(ctx context.Context) bool {
+	return len(config.FromContext(ctx).AlternateUpstreams) > 0 && accountOf(ctx).circuit.open()
+}
+
+// errFailoverUnsupported rejects a request for a Copilot-only API while
+// Copilot is failed over. /chat/completions is suggested only when an
+// alternate upstream serves the request's model.
+func errFailoverUnsupported(ctx context.Context, apiName string, body []byte) error {
+	msg := fmt.Sprintf("Copilot is unavailable and the %s can't be served by the alternate upstreams; retry later", apiName)
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &req)
+	if alternateServes(ctx, req.Model) {
+		msg += " or use /chat/completions"
+	}
+	return &api.HTTPError{Message: msg, StatusCode: http.StatusServiceUnavailable}
+}
+
+// alternateServes reports whether any alternate upstream serves model.
+func alternateServes(ctx context.Context, model string) bool {
+	for _, u := range config.FromContext(ctx).AlternateUpstreams {
+		if _, ok := u.MapModel(model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// outage reports whether err, from a Copilot request, is the kind of
+// failure that failover covers: a network error or a 5xx.
+func outage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var httpErr *api.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500
+	}
+	return true
+}
+
+// ServedBy records which upstream answered the requests made with a
+// context from WithServedBy.
+type ServedBy struct {
+	mu   sync.Mutex
+	name string
+}
+
+// Alternate returns the name of the alternate upstream that answered, or
+// "" when Copilot did.
+func (s *ServedBy) Alternate() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+func (s *ServedBy) set(name string) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+type servedByKey struct{}
+
+// WithServedBy returns a context whose chat completions record in s
+// whether an alternate upstream served them.
+func WithServedBy(ctx context.Context, s *ServedBy) context.Context {
+	return context.WithValue(ctx, servedByKey{}, s)
+}
+
+// proxyAlternate sends a chat completion to the first alternate upstream
+// that serves its model and answers; each one that fails hands over to
+// the next. The body's model is mapped per upstream, and Copilot's
+// reasoning fields are dropped.
+func proxyAlternate(ctx context.Context, body []byte) (*http.Response, error) {
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("parsing chat completion for failover: %w", err)
+	}
+	model, _ := payload["model"].(string)
+	stripCopilotReasoning(payload)
+
+	var lastErr error
+	for _, u := range config.FromContext(ctx).AlternateUpstreams {
+		mapped, ok := u.MapModel(model)
+		if !ok {
+			continue
+		}
+		payload["model"] = mapped
+		patched, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := sendAlternate(ctx, u, patched)
+		if err == nil {
+			slog.Info("chat completion served by alternate upstream", "upstream", u.UpstreamName(), "model", model, "upstream_model", mapped)
+			if s, ok := ctx.Value(servedByKey{}).(*ServedBy); ok {
+				s.set(u.UpstreamName())
+			}
+			return resp, nil
+		}
+		slog.Warn("alternate upstream failed", "upstream", u.UpstreamName(), "error", err)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		return nil, &api.HTTPError{
+			Message:    fmt.Sprintf("Copilot is unavailable and no alternate upstream serves model %q", model),
+			StatusCode: http.StatusServiceUnavailable,
+		}
+	}
+	return nil, lastErr
+}
+
+// stripCopilotReasoning removes the reasoning Copilot attaches to
+// assistant messages: its text and its encrypted form only mean something
+// to Copilot.
+func stripCopilotReasoning(payload map[string]any) {
+	messages, _ := payload["messages"].([]any)
+	for _, m := range messages {
+		if msg, ok := m.(map[string]any); ok {
+			delete(msg, "reasoning_text")
+			delete(msg, "reasoning_opaque")
+		}
+	}
+}
+
+// sendAlternate posts a chat completion to u, traced as a client span.
+// Non-200 responses become an *api.HTTPError.
+func sendAlternate(ctx context.Context, u config.AlternateUpstream, body []byte) (*http.Response, error) {
+	url := strings.TrimSuffix(u.BaseURL, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if u.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+u.APIKey)
+	}
+	_, span := telemetry.Start(ctx, "alternate POST /chat/completions", telemetry.KindClient)
+	defer span.End()
+	span.SetString("copilot_proxy.upstream", u.UpstreamName())
+	span.Inject(req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetInt("http.response.status_code", int64(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		err := api.NewHTTPError(resp)
+		span.SetError(err)
+		return nil, err
+	}
+	return resp, nil
+}
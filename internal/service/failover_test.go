@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// resetCircuit closes the Copilot circuit now and after the test.
+func resetCircuit(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		accountOf(testContext(context.Background())).circuit.mu.Lock()
+		accountOf(testContext(context.Background())).circuit.failures = 0
+		accountOf(testContext(context.Background())).circuit.openUntil = time.Time{}
+		accountOf(testContext(context.Background())).circuit.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// endCooldown lets the next request through to Copilot, as if the
+// cooldown had passed.
+func endCooldown() {
+	accountOf(testContext(context.Background())).circuit.mu.Lock()
+	accountOf(testContext(context.Background())).circuit.openUntil = time.Now().Add(-time.Millisecond)
+	accountOf(testContext(context.Background())).circuit.mu.Unlock()
+}
+
+// upstream is a test chat completions server that counts its requests and
+// answers with the current status.
+type upstream struct {
+	*httptest.Server
+	calls  atomic.Int32
+	status atomic.Int32
+	models chan string
+}
+
+func newUpstream(t *testing.T, status int) *upstream {
+	t.Helper()
+	u := &upstream{models: make(chan string, 16)}
+	u.status.Store(int32(status))
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.calls.Add(1)
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		select {
+		case u.models <- req.Model:
+		default:
+		}
+		status := int(u.status.Load())
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprint(w, chatCompletion("ok", 1, 1, 0))
+		} else {
+			fmt.Fprint(w, `{"error":{"message":"upstream down"}}`)
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) lastModel() string {
+	var m string
+	for {
+		select {
+		case m = <-u.models:
+		default:
+			return m
+		}
+	}
+}
+
+// useFailover sends Copilot requests to copilot and configures alternate
+// as its failover, serving models (all models when nil).
+func useFailover(t *testing.T, copilot, alternate *upstream, models map[string]string) {
+	t.Helper()
+	resetCircuit(t)
+	fakeCopilot(t, copilot.Config.Handler.ServeHTTP)
+	useConfig(t, func(c *config.Config) {
+		c.Failover = config.FailoverConfig{Threshold: 2}
+		c.AlternateUpstreams = []config.AlternateUpstream{{Name: "alt", BaseURL: alternate.URL, Models: models}}
+	})
+}
+
+func chat(t *testing.T, model string) (int, error) {
+	t.Helper()
+	body := []byte(`{"model":"` + model + `","messages":[{"role":"user","content":"hi"}]}`)
+	resp, err := ProxyChatCompletion(testContext(context.Background()), body, false)
+	if err != nil {
+		var httpErr *api.HTTPError
+		if errors.As(err, &httpErr) {
+			return httpErr.StatusCode, err
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestFailoverOpensAtThreshold(t *testing.T) {
+	copilot := newUpstream(t, http.StatusBadGateway)
+	alternate := newUpstream(t, http.StatusOK)
+	useFailover(t, copilot, alternate, map[string]string{"gpt-4.1": "alt-model"})
+
+	// The first failure is returned: the circuit is still closed
+	if status, _ := chat(t, "gpt-4.1"); status != http.StatusBadGateway {
+		t.Fatalf("first failure: status %d, want 502", status)
+	}
+	if Circuit(testContext(context.Background())).Open || FailoverActive(testContext(context.Background())) {
+		t.Fatal("circuit opened below the threshold")
+	}
+	if alternate.calls.Load() != 0 {
+		t.Fatal("alternate called below the threshold")
+	}
+
+	// The failure that opens the circuit is retried on the alternate
+	if status, err := chat(t, "gpt-4.1"); status != http.StatusOK {
+		t.Fatalf("circuit-opening request: status %d (%v), want 200 from the alternate", status, err)
+	}
+	if !Circuit(testContext(context.Background())).Open || !FailoverActive(testContext(context.Background())) {
+		t.Fatal("circuit not open at the threshold")
+	}
+	if got := alternate.lastModel(); got != "alt-model" {
+		t.Errorf("alternate got model %q, want the mapped alt-model", got)
+	}
+
+	// While open, Copilot isn't tried
+	if status, _ := chat(t, "gpt-4.1"); status != http.StatusOK {
+		t.Fatalf("while open: status %d, want 200", status)
+	}
+	if n := copilot.calls.Load(); n != 2 {
+		t.Errorf("Copilot called %d times, want 2", n)
+	}
+	if n := alternate.calls.Load(); n != 2 {
+		t.Errorf("alternate called %d times, want 2", n)
+	}
+}
+
+func TestFailoverCooldown(t *testing.T) {
+	copilot := newUpstream(t, http.StatusServiceUnavailable)
+	alternate := newUpstream(t, http.StatusOK)
+	useFailover(t, copilot, alternate, nil)
+
+	chat(t, "gpt-4.1")
+	chat(t, "gpt-4.1")
+	if !Circuit(testContext(context.Background())).Open {
+		t.Fatal("circuit not open")
+	}
+
+	// After the cooldown Copilot gets one probe; its failure reopens the
+	// circuit and the request is still served by the alternate
+	endCooldown()
+	if Circuit(testContext(context.Background())).Open {
+		t.Fatal("circuit still open after the cooldown")
+	}
+	if status, _ := chat(t, "gpt-4.1"); status != http.StatusOK {
+		t.Fatalf("failed probe: status %d, want 200 from the alternate", status)
+	}
+	if n := copilot.calls.Load(); n != 3 {
+		t.Fatalf("Copilot called %d times, want 3 (one probe)", n)
+	}
+	status := Circuit(testContext(context.Background()))
+	if !status.Open || status.OpenUntil == nil || time.Until(*status.OpenUntil) < 20*time.Second {
+		t.Fatalf("failed probe didn't reopen the circuit for the cooldown: %+v", status)
+	}
+
+	// A successful probe closes it
+	endCooldown()
+	copilot.status.Store(http.StatusOK)
+	if status, _ := chat(t, "gpt-4.1"); status != http.StatusOK {
+		t.Fatalf("successful probe: status %d", status)
+	}
+	if status := Circuit(testContext(context.Background())); status.Open || status.ConsecutiveFailures != 0 {
+		t.Fatalf("successful probe didn't close the circuit: %+v", status)
+	}
+	if n := alternate.calls.Load(); n != 2 {
+		t.Errorf("alternate called %d times, want 2", n)
+	}
+}
+
+func TestFailoverIgnoresCanceledRequests(t *testing.T) {
+	resetCircuit(t)
+	useConfig(t, func(c *config.Config) { c.Failover = config.FailoverConfig{Threshold: 1} })
+
+	// A request the proxy canceled, such as a hedge that lost, isn't a
+	// Copilot failure
+	ctx, cancel := context.WithCancel(testContext(context.Background()))
+	cancel()
+	accountOf(ctx).circuit.record(ctx, nil, context.Canceled)
+	if status := Circuit(testContext(context.Background())); status.Open || status.ConsecutiveFailures != 0 {
+		t.Fatalf("canceled request counted: %+v", status)
+	}
+
+	// End to end: the first attempt hangs past the hedging delay, the
+	// duplicate wins and the loser is canceled
+	var calls atomic.Int32
+	fakeCopilot(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if calls.Add(1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, chatCompletion("ok", 1, 1, 0))
+	})
+	useConfig(t, func(c *config.Config) {
+		c.Hedging = config.HedgingConfig{Enabled: true, DelayMs: 50, Models: []string{"gpt-4.1-mini"}}
+	})
+	if status, err := chat(t, "gpt-4.1-mini"); status != http.StatusOK {
+		t.Fatalf("hedged request: status %d (%v)", status, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("Copilot called %d times, want 2 (hedged)", n)
+	}
+	if status := Circuit(testContext(context.Background())); status.Open || status.ConsecutiveFailures != 0 {
+		t.Fatalf("losing hedge counted: %+v", status)
+	}
+}
+
+func TestFailoverUnsupportedSuggestsChatCompletions(t *testing.T) {
+	copilot := newUpstream(t, http.StatusInternalServerError)
+	alternate := newUpstream(t, http.StatusOK)
+	useFailover(t, copilot, alternate, map[string]string{"gpt-4.1": "alt-model"})
+	chat(t, "gpt-4.1")
+	chat(t, "gpt-4.1")
+	ctx := testContext(context.Background())
+	if !FailoverActive(ctx) {
+		t.Fatal("failover not active")
+	}
+
+	tests := []struct {
+		model   string
+		suggest bool
+	}{
+		{"gpt-4.1", true},
+		{"claude-sonnet-4", false},
+	}
+	for _, tt := range tests {
+		body := []byte(`{"model":"` + tt.model + `","input":"hi"}`)
+		for name, call := range map[string]func() error{
+			"responses": func() error { _, err := ProxyResponses(ctx, body, false, false); return err },
+			"messages":  func() error { _, err := ProxyMessages(ctx, body, "", false, false); return err },
+		} {
+			var httpErr *api.HTTPError
+			if err := call(); !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("%s %s: got %v, want a 503", name, tt.model, err)
+			}
+			if got := strings.Contains(httpErr.Message, "/chat/completions"); got != tt.suggest {
+				t.Errorf("%s %s: %q suggests /chat/completions = %v, want %v", name, tt.model, httpErr.Message, got, tt.suggest)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ProxyChatCompletionFanOut sends n copies of a non-streaming chat
+// completion request concurrently and merges the responses into one with n
+// choices. Choice indices are renumbered in request order and usage is
+// summed. If any request fails, the first error is returned and the
+// requests still running are canceled; the responses that did arrive are
+// merged and returned with the error, so the tokens they used can be
+// recorded. Canceling ctx cancels them all.
+func ProxyChatCompletionFanOut(ctx context.Context, body []byte, isAgent bool, n int) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]map[string]any, n)
+	var (
+		failOnce sync.Once
+		firstErr error
+	)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if results[i], err = fetchChatCompletion(ctx, body, isAgent); err != nil {
+				failOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	results = slices.DeleteFunc(results, func(r map[string]any) bool { return r == nil })
+	if len(results) == 0 {
+		return nil, firstErr
+	}
+	merged, err := json.Marshal(mergeChatCompletions(results))
+	if err != nil {
+		return nil, err
+	}
+	return merged, firstErr
+}
+
+// fetchChatCompletion performs one non-streaming request and decodes it.
+func fetchChatCompletion(ctx context.Context, body []byte, isAgent bool) (map[string]any, error) {
+	resp, err := ProxyChatCompletion(ctx, body, isAgent)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading chat completion response: %w", err)
+	}
+	var result map[string]any
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("parsing chat completion response: %w", err)
+	}
+	return result, nil
+}
+
+// usageDetails are the nested usage counts mergeChatCompletions sums, by
+// the usage field holding them.
+var usageDetails = map[string]string{
+	"prompt_tokens_details":     "cached_tokens",
+	"completion_tokens_details": "reasoning_tokens",
+}
+
+// mergeChatCompletions combines responses into the first one.
+func mergeChatCompletions(results []map[string]any) map[string]any {
+	merged := results[0]
+
+	var choices []any
+	usage := make(map[string]float64)
+	hasUsage := false
+	for _, r := range results {
+		if cs, ok := r["choices"].([]any); ok {
+			for _, c := range cs {
+				if choice, ok := c.(map[string]any); ok {
+					choice["index"] = len(choices)
+				}
+				choices = append(choices, c)
+			}
+		}
+		if u, ok := r["usage"].(map[string]any); ok {
+			hasUsage = true
+			for _, key := range []string{"prompt_tokens", "completion_tokens", "total_tokens"} {
+				if v, ok := u[key].(float64); ok {
+					usage[key] += v
+				}
+			}
+			for key, detail := range usageDetails {
+				if d, ok := u[key].(map[string]any); ok {
+					if v, ok := d[detail].(float64); ok {
+						usage[key+"."+detail] += v
+					}
+				}
+			}
+		}
+	}
+
+	merged["choices"] = choices
+	if hasUsage {
+		u, _ := merged["usage"].(map[string]any)
+		if u == nil {
+			u = make(map[string]any)
+		}
+		for key, v := range usage {
+			if key, detail, ok := strings.Cut(key, "."); ok {
+				d, _ := u[key].(map[string]any)
+				if d == nil {
+					d = make(map[string]any)
+					u[key] = d
+				}
+				d[detail] = int64(v)
+				continue
+			}
+			u[key] = int64(v)
+		}
+		merged["usage"] = u
+	}
+	return merged
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func chatCompletion(content string, prompt, completion, cached int) string {
+	return fmt.Sprintf(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":%q}}],`+
+		`"usage":{"prompt_tokens":%d,"completion_tokens":%d,"total_tokens":%d,"prompt_tokens_details":{"cached_tokens":%d}}}`,
+		content, prompt, completion, prompt+completion, cached)
+}
+
+func TestFanOutMergesChoicesAndUsage(t *testing.T) {
+	var calls atomic.Int32
+	fakeCopilot(t, func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		fmt.Fprint(w, chatCompletion(fmt.Sprint("answer ", n), 10, int(n), 4))
+	})
+
+	data, err := ProxyChatCompletionFanOut(testContext(context.Background()), []byte(`{"model":"gpt-4.1"}`), false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged struct {
+		Choices []struct {
+			Index int `json:"index"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens        int `json:"prompt_tokens"`
+			CompletionTokens    int `json:"completion_tokens"`
+			TotalTokens         int `json:"total_tokens"`
+			PromptTokensDetails struct {
+				CachedTokens int `json:"cached_tokens"`
+			} `json:"prompt_tokens_details"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Choices) != 3 {
+		t.Fatalf("got %d choices, want 3", len(merged.Choices))
+	}
+	for i, c := range merged.Choices {
+		if c.Index != i {
+			t.Errorf("choice %d has index %d", i, c.Index)
+		}
+	}
+	u := merged.Usage
+	if u.PromptTokens != 30 || u.CompletionTokens != 6 || u.TotalTokens != 36 || u.PromptTokensDetails.CachedTokens != 12 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestFanOutFailureCancelsTheRest(t *testing.T) {
+	var calls atomic.Int32
+	fakeCopilot(t, func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			fmt.Fprint(w, chatCompletion("done", 10, 5, 0))
+		case 2:
+			// After the first has been read
+			time.Sleep(200 * time.Millisecond)
+			http.Error(w, `{"error":{"message":"bad request"}}`, http.StatusBadRequest)
+		default:
+			io.Copy(io.Discard, r.Body) // so the server notices the cancel
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+				fmt.Fprint(w, chatCompletion("late", 10, 5, 0))
+			}
+		}
+	})
+
+	start := time.Now()
+	data, err := ProxyChatCompletionFanOut(testContext(context.Background()), []byte(`{"model":"gpt-4.1"}`), false, 4)
+	if err == nil {
+		t.Fatal("want the 400 returned")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Error("the requests still running weren't canceled")
+	}
+	var partial struct {
+		Usage struct {
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(data, &partial); partial.Usage.CompletionTokens != 5 {
+		t.Errorf("partial response = %s, want the completed request's usage", data)
+	}
+}
+
+func TestFanOutStopsWhenCallerCancels(t *testing.T) {
+	started := make(chan struct{}, 3)
+	fakeCopilot(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			fmt.Fprint(w, chatCompletion("late", 1, 1, 0))
+		}
+	})
+
+	ctx, cancel := context.WithCancel(testContext(context.Background()))
+	go func() {
+		for range 3 {
+			<-started
+		}
+		cancel()
+	}()
+	start := time.Now()
+	_, err := ProxyChatCompletionFanOut(ctx, []byte(`{"model":"gpt-4.1"}`), false, 3)
+	if err == nil {
+		t.Fatal("want an error once the caller cancels")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Error("fan-out kept running after the caller canceled")
+	}
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+	"github.com/tonghaoch/copilot-proxy-go/internal/telemetry"
+)
+
+// doUpstream sends req, hedging it when hedging applies to body. It first
+// waits for a modelConcurrency slot of the body's model, held until the
+// response body is closed; a hedge needs a second slot. The RequestIDs of
+// its context, if any, set its X-Request-Id and record the response's.
+// The outcome counts toward the failover circuit, and the response's
+// rate-limit headers are captured. The call is traced as a client span
+// (until the response headers arrive) whose traceparent is sent upstream.
+func doUpstream(req *http.Request, body []byte) (*http.Response, error) {
+	ctx := req.Context()
+	acct := accountOf(ctx)
+	model := requestModel(ctx, body)
+	release, err := acct.modelLimits.acquire(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+	ids := requestIDsFrom(req.Context())
+	if ids != nil {
+		req.Header.Set("X-Request-Id", ids.Sent)
+	}
+	_, span := telemetry.Start(req.Context(), "upstream "+req.Method+" "+req.URL.Path, telemetry.KindClient)
+	defer span.End()
+	span.SetString("http.request.method", req.Method)
+	span.SetString("url.full", req.URL.String())
+	span.Inject(req.Header)
+	var resp *http.Response
+	if delay, ok := hedgeDelay(ctx, body); ok {
+		resp, err = doHedged(req, delay, func() (func(), bool) {
+			return acct.modelLimits.tryAcquire(ctx, model)
+		})
+	} else {
+		resp, err = http.DefaultClient.Do(req)
+	}
+	acct.circuit.record(ctx, resp, err)
+	if err != nil {
+		span.SetError(err)
+		release()
+		return nil, err
+	}
+	span.SetInt("http.response.status_code", int64(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetError(errors.New(resp.Status))
+	}
+	if ids != nil {
+		ids.record(resp.Header)
+	}
+	recordRateLimit(req.Context(), body, resp.Header)
+	resp.Body = releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// hedgeDelay reports whether a request body may be hedged, and after how
+// long. Only non-streaming requests without tools for a hedging model
+// qualify: a stream can't be switched once started, and a duplicate
+// tool-calling turn could act twice.
+func hedgeDelay(ctx context.Context, body []byte) (time.Duration, bool) {
+	cfg := config.FromContext(ctx)
+	if !cfg.Hedging.Enabled {
+		return 0, false
+	}
+	var req struct {
+		Model  string            `json:"model"`
+		Stream bool              `json:"stream"`
+		Tools  []json.RawMessage `json:"tools"`
+	}
+	if json.Unmarshal(body, &req) != nil || req.Stream || len(req.Tools) > 0 {
+		return 0, false
+	}
+	if !cfg.IsHedgeModel(state.FromContext(ctx), req.Model) {
+		return 0, false
+	}
+	return cfg.HedgeDelay(), true
+}
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// doHedged sends req and, if no response arrives within delay, a duplicate.
+// The first successful response wins and the other request is canceled. A
+// failure waits for the other request, if one is in flight; errors are
+// never hedged. Both requests inherit the context (and timeout) of req.
+// The duplicate takes a modelConcurrency slot from hedgeSlot, held until
+// the losing request is done, and isn't sent when none is free.
+func doHedged(req *http.Request, delay time.Duration, hedgeSlot func() (release func(), ok bool)) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+
+		r := req.Clone(ctx)
+		if req.GetBody != nil {
+			r.Body, _ = req.GetBody()
+		}
+		go func() {
+			resp, err := http.DefaultClient.Do(r)
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	var failed *hedgeResult
+	releaseHedge := func() {}
+	for {
+		select {
+		case <-timer.C:
+			release, ok := hedgeSlot()
+			if !ok {
+				slog.Debug("not hedging slow upstream request: no modelConcurrency slot free", "url", req.URL.Path)
+				continue
+			}
+			releaseHedge = release
+			slog.Info("hedging slow upstream request", "delay", delay, "url", req.URL.Path)
+			send()
+			pending++
+		case res := <-results:
+			pending--
+			if res.err == nil && res.resp.StatusCode == http.StatusOK {
+				hedged := len(cancels) > 1
+				for i, cancel := range cancels {
+					if i != res.attempt {
+						cancel()
+					}
+				}
+				if failed != nil {
+					failed.close()
+				}
+				discardHedgeResults(results, pending, releaseHedge)
+				if hedged {
+					slog.Info("hedged request finished", "winner", res.attempt, "url", req.URL.Path)
+					state.MetricsFromContext(req.Context()).RecordHedge(res.attempt == 1, pending > 0)
+				}
+				res.wrapCancel(cancels[res.attempt])
+				return res.resp, res.err
+			}
+			if failed == nil {
+				failed = &res
+			} else {
+				res.close()
+				cancels[res.attempt]()
+			}
+			if pending == 0 {
+				if len(cancels) > 1 {
+					state.MetricsFromContext(req.Context()).RecordHedge(false, false)
+				}
+				releaseHedge()
+				failed.wrapCancel(cancels[failed.attempt])
+				return failed.resp, failed.err
+			}
+		}
+	}
+}
+
+// discardHedgeResults closes the responses of canceled requests as they
+// finish, then calls release.
+func discardHedgeResults(results <-chan hedgeResult, pending int, release func()) {
+	if pending == 0 {
+		release()
+		return
+	}
+	go func() {
+		for range pending {
+			res := <-results
+			res.close()
+		}
+		release()
+	}()
+}
+
+func (r *hedgeResult) close() {
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+}
+
+// wrapCancel releases the request context once the response body is
+// closed; canceling earlier would abort reading it.
+func (r *hedgeResult) wrapCancel(cancel context.CancelFunc) {
+	if r.resp == nil {
+		cancel()
+		return
+	}
+	r.resp.Body = cancelOnClose{ReadCloser: r.resp.Body, cancel: cancel}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
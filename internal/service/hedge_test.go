@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+func TestHedgeNeedsConcurrencySlot(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int // modelConcurrency of the model; 0 for none
+		wantCalls int32
+	}{
+		{"no limit", 0, 2},
+		{"slot free", 2, 2},
+		{"no slot free", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			var mu sync.Mutex
+			inFlight, maxInFlight := 0, 0
+			fakeCopilot(t, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				mu.Lock()
+				inFlight++
+				maxInFlight = max(maxInFlight, inFlight)
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					inFlight--
+					mu.Unlock()
+				}()
+				if calls.Add(1) == 1 {
+					// Slow enough to be hedged
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(200 * time.Millisecond):
+					}
+				}
+				fmt.Fprint(w, chatCompletion("ok", 1, 1, 0))
+			})
+			useConfig(t, func(c *config.Config) {
+				c.Hedging = config.HedgingConfig{Enabled: true, DelayMs: 20, Models: []string{"gpt-4.1-mini"}}
+				c.ModelConcurrency = nil
+				if tt.limit > 0 {
+					c.ModelConcurrency = map[string]int{"gpt-4.1-mini": tt.limit}
+				}
+			})
+			ctx := WithAccount(testContext(context.Background()), NewAccount())
+
+			resp, err := ProxyChatCompletion(ctx, []byte(`{"model":"gpt-4.1-mini","messages":[{"role":"user","content":"hi"}]}`), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("Copilot called %d times, want %d", n, tt.wantCalls)
+			}
+			mu.Lock()
+			peak := maxInFlight
+			mu.Unlock()
+			if tt.limit > 0 && peak > tt.limit {
+				t.Errorf("%d requests in flight, over the limit of %d", peak, tt.limit)
+			}
+			// Every slot is released, the loser's once it's done
+			deadline := time.Now().Add(time.Second)
+			for {
+				active := 0
+				for _, q := range ModelQueues(ctx) {
+					active += q.Active
+				}
+				if active == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%d slots still held", active)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
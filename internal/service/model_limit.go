@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// ModelQueue describes the upstream requests of one model limited by
+// modelConcurrency, as reported in /api/stats.
+type ModelQueue struct {
+	Model  string `json:"model"`
+	Limit  int    `json:"limit"`
+	Active int    `json:"active"`
+	Queued int    `json:"queued"`
+}
+
+// modelSlots counts the requests of one model. wake is closed, and
+// replaced, whenever a slot is released.
+type modelSlots struct {
+	active int
+	queued int
+	wake   chan struct{}
+}
+
+// modelLimiter enforces modelConcurrency on every upstream completion
+// request of an account, whichever backend it goes to. Limits are read on
+// each acquire, so a config reload applies to waiting requests too.
+type modelLimiter struct {
+	mu     sync.Mutex
+	models map[string]*modelSlots
+}
+
+type clientContextKey struct{}
+
+// WithClientContext returns a context whose upstream requests stop
+// waiting for a modelConcurrency slot once client is done. Upstream
+// contexts are independent of the client's request, which would otherwise
+// keep queuing after the client left.
+func WithClientContext(ctx, client context.Context) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// acquire waits for a slot of model, until ctx or the client context it
+// carries is done. The returned release must be called once.
+func (l *modelLimiter) acquire(ctx context.Context, model string) (release func(), err error) {
+	cfg := config.StoreFromContext(ctx)
+	limit := cfg.Get().ModelConcurrencyLimit(model)
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	client, _ := ctx.Value(clientContextKey{}).(context.Context)
+	if client == nil {
+		client = context.Background()
+	}
+
+	l.mu.Lock()
+	s := l.slots(model)
+	for limit > 0 && s.active >= limit {
+		s.queued++
+		wake := s.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-client.Done():
+			err = client.Err()
+		}
+		l.mu.Lock()
+		s.queued--
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		limit = cfg.Get().ModelConcurrencyLimit(model)
+	}
+	s.active++
+	l.mu.Unlock()
+	return l.releaser(s), nil
+}
+
+// tryAcquire takes a slot of model if one is free now, without queuing.
+// The returned release must be called once.
+func (l *modelLimiter) tryAcquire(ctx context.Context, model string) (release func(), ok bool) {
+	limit := config.FromContext(ctx).ModelConcurrencyLimit(model)
+	if limit <= 0 {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.slots(model)
+	if s.active >= limit {
+		return nil, false
+	}
+	s.active++
+	return l.releaser(s), true
+}
+
+// slots returns the slots of model, with l.mu held.
+func (l *modelLimiter) slots(model string) *modelSlots {
+	s := l.models[model]
+	if s == nil {
+		s = &modelSlots{wake: make(chan struct{})}
+		l.models[model] = s
+	}
+	return s
+}
+
+// releaser returns the release func of a slot taken from s.
+func (l *modelLimiter) releaser(s *modelSlots) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			s.active--
+			close(s.wake)
+			s.wake = make(chan struct{})
+			l.mu.Unlock()
+		})
+	}
+}
+
+// ModelQueues returns the models of ctx's account with a modelConcurrency
+// limit or requests in flight under one, sorted by model.
+func ModelQueues(ctx context.Context) []ModelQueue {
+	l := &accountOf(ctx).modelLimits
+	cfg := config.FromContext(ctx)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]bool)
+	out := []ModelQueue{}
+	for model, s := range l.models {
+		seen[model] = true
+		out = append(out, ModelQueue{Model: model, Limit: cfg.ModelConcurrencyLimit(model), Active: s.active, Queued: s.queued})
+	}
+	for model, limit := range cfg.ModelConcurrency {
+		if !seen[model] {
+			out = append(out, ModelQueue{Model: model, Limit: limit})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	return out
+}
+
+// requestModel returns the model of an upstream request body, parsing it
+// only when modelConcurrency is configured.
+func requestModel(ctx context.Context, body []byte) string {
+	if len(config.FromContext(ctx).ModelConcurrency) == 0 {
+		return ""
+	}
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &req)
+	return req.Model
+}
+
+// releaseBody releases a modelConcurrency slot when the response body is
+// closed, so a stream holds its slot until it has been read.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// modelsRetryMax caps the wait between background models fetches after
+// starting from the cached list.
+const modelsRetryMax = 5 * time.Minute
+
+// modelsCache is the models cache file: the last list FetchModels got,
+// before modelOverrides.
+type modelsCache struct {
+	Models    []state.Model `json:"models"`
+	FetchedAt time.Time     `json:"fetched_at"`
+}
+
+func writeModelsCache(s *state.State, models []state.Model) {
+	data, _ := json.Marshal(modelsCache{Models: models, FetchedAt: time.Now()})
+	if err := os.WriteFile(s.ModelsCachePath(), data, 0o600); err != nil {
+		slog.Warn("failed to cache models", "path", s.ModelsCachePath(), "error", err)
+	}
+}
+
+// CachedModels returns the models list last fetched for the proxy instance
+// of ctx and when it was fetched, for starting while Copilot's models
+// endpoint is unreachable.
+func CachedModels(ctx context.Context) ([]state.Model, time.Time, error) {
+	data, err := os.ReadFile(state.FromContext(ctx).ModelsCachePath())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var c modelsCache
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(c.Models) == 0 {
+		return nil, time.Time{}, errors.New("models cache is empty")
+	}
+	return c.Models, c.FetchedAt, nil
+}
+
+// RefreshModelsUntilFetched fetches the models list of ctx's proxy
+// instance in the background until it succeeds, then swaps it in for the
+// cached list the server started with, or until ctx is done. Waits double
+// from 15s up to modelsRetryMax.
+func RefreshModelsUntilFetched(ctx context.Context) {
+	wait := 15 * time.Second
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		models, err := FetchModels(ctx)
+		if err == nil {
+			s := state.FromContext(ctx)
+			s.SetModels(models)
+			config.FromContext(ctx).EffectiveSmallModel(s) // warns if smallModel was removed
+			slog.Info("fetched models, replacing the cached list", "models", len(models))
+			return
+		}
+		wait = min(wait*2, modelsRetryMax)
+		slog.Debug("models still unavailable", "error", err, "retry_in", wait)
+	}
+}
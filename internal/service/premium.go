@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// PremiumCost returns how many premium requests rec consumed on the proxy
+// instance of ctx, for MetricsStore.SetPremiumCost. Copilot bills user-initiated requests
+// only, at the PremiumMultiplier of the model they were routed to, so
+// compact and warmup requests on the small model cost what it costs
+// (nothing for the included models). Agent-initiated and failed
+// requests, and requests served from the response cache or by an
+// alternate upstream, cost nothing.
+func PremiumCost(ctx context.Context, rec state.RequestRecord) float64 {
+	if rec.Initiator != "user" || rec.Cached || rec.ServedBy != "" || rec.StatusCode >= 400 {
+		return 0
+	}
+	model := rec.RoutedModel
+	if model == "" {
+		model = rec.Model
+	}
+	return PremiumMultiplier(ctx, model)
+}
+
+// PremiumMultiplier returns the premium requests a user-initiated request
+// to model costs: its premiumMultipliers entry, or else the multiplier in
+// Copilot's model list (0 for included models), or else the "default"
+// entry or 1.
+func PremiumMultiplier(ctx context.Context, model string) float64 {
+	cfg := config.FromContext(ctx)
+	if m, ok := cfg.PremiumMultiplier(model); ok {
+		return m
+	}
+	if m := state.FromContext(ctx).FindModel(model); m != nil && m.Billing != nil {
+		if m.Billing.Multiplier > 0 || !m.Billing.IsPremium {
+			return m.Billing.Multiplier
+		}
+	}
+	return cfg.DefaultPremiumMultiplier()
+}
+
+// LocalPremiumTotal returns the premium requests counted in agg since
+// the metrics epoch.
+func LocalPremiumTotal(agg state.Aggregates) float64 {
+	var milli int64
+	for _, n := range agg.PremiumByDay {
+		milli += n
+	}
+	return float64(milli) / 1000
+}
+
+// premiumQuotaTTL is how long a premium quota snapshot is used, or a
+// failed read waited out, before copilot_internal/user is read again.
+const premiumQuotaTTL = 5 * time.Minute
+
+// PremiumQuotaReport sets Copilot's premium request quota against the
+// premium requests computed locally. Both are counted from the baseline,
+// the first quota snapshot read (again after a quota reset), so Used and
+// LocalUsed cover the same period. Other clients on the same account
+// (editors, other proxies) also show up as divergence.
+type PremiumQuotaReport struct {
+	Entitlement float64   `json:"entitlement"`
+	Remaining   float64   `json:"remaining"`
+	Unlimited   bool      `json:"unlimited"`
+	ResetDate   string    `json:"reset_date,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+	Since       time.Time `json:"since"`      // the baseline snapshot
+	Used        float64   `json:"used"`       // by Copilot's quota since the baseline
+	LocalUsed   float64   `json:"local_used"` // computed locally since the baseline
+	Divergence  float64   `json:"divergence"` // Used - LocalUsed
+	Threshold   float64   `json:"threshold"`  // premiumDivergenceThreshold
+	// Diverged marks a divergence beyond the threshold: premiumMultipliers
+	// (or Copilot's model list) is likely stale.
+	Diverged bool `json:"diverged"`
+}
+
+// premiumQuotaSnapshot is the premium_interactions quota snapshot of
+// copilot_internal/user.
+type premiumQuotaSnapshot struct {
+	Entitlement      float64  `json:"entitlement"`
+	Remaining        float64  `json:"remaining"`
+	QuotaRemaining   *float64 `json:"quota_remaining"` // fractional; preferred when present
+	PercentRemaining *float64 `json:"percent_remaining"`
+	Unlimited        bool     `json:"unlimited"`
+}
+
+// premiumQuota is the premium quota report of an account.
+type premiumQuota struct {
+	sync.Mutex
+	report    *PremiumQuotaReport
+	attempted time.Time // last read of copilot_internal/user, failed or not
+	// official and local premium requests used at the baseline
+	baseUsed, baseLocal float64
+	// quotaNotified is set once use reached notifications.quotaPercent,
+	// until it drops below again (a quota reset)
+	quotaNotified bool
+}
+
+// PremiumQuota returns the latest quota report of ctx's account, or nil
+// before the first snapshot has been read. A stale or missing snapshot is
+// refreshed in the background, so the call never waits for GitHub.
+func PremiumQuota(ctx context.Context) *PremiumQuotaReport {
+	premiumQuota := &accountOf(ctx).premium
+	premiumQuota.Lock()
+	defer premiumQuota.Unlock()
+	if time.Since(premiumQuota.attempted) > premiumQuotaTTL {
+		premiumQuota.attempted = time.Now()
+		go refreshPremiumQuota(context.WithoutCancel(ctx))
+	}
+	if premiumQuota.report == nil {
+		return nil
+	}
+	r := *premiumQuota.report
+	return &r
+}
+
+func refreshPremiumQuota(ctx context.Context) {
+	fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	snap, resetDate, err := fetchPremiumQuota(fetchCtx)
+	if err != nil {
+		slog.Debug("premium quota not refreshed", "error", err)
+		return
+	}
+	recordPremiumQuota(ctx, snap, resetDate)
+}
+
+// recordPremiumQuota makes snap the latest quota report of ctx's account
+// and notifies once use crosses notifications.quotaPercent.
+func recordPremiumQuota(ctx context.Context, snap *premiumQuotaSnapshot, resetDate string) {
+	local := LocalPremiumTotal(state.MetricsFromContext(ctx).Snapshot().Aggregates)
+	cfg := config.FromContext(ctx)
+
+	premiumQuota := &accountOf(ctx).premium
+	premiumQuota.Lock()
+	defer premiumQuota.Unlock()
+
+	remaining := snap.Remaining
+	if snap.QuotaRemaining != nil {
+		remaining = *snap.QuotaRemaining
+	}
+	used := snap.Entitlement - remaining
+	prev := premiumQuota.report
+	now := time.Now()
+	if prev == nil || prev.ResetDate != resetDate || used < premiumQuota.baseUsed {
+		premiumQuota.baseUsed, premiumQuota.baseLocal = used, local
+		prev = &PremiumQuotaReport{Since: now}
+	}
+
+	r := &PremiumQuotaReport{
+		Entitlement: snap.Entitlement,
+		Remaining:   remaining,
+		Unlimited:   snap.Unlimited,
+		ResetDate:   resetDate,
+		FetchedAt:   now,
+		Since:       prev.Since,
+		Used:        roundPremium(used - premiumQuota.baseUsed),
+		LocalUsed:   roundPremium(local - premiumQuota.baseLocal),
+		Threshold:   cfg.GetPremiumDivergenceThreshold(),
+	}
+	r.Divergence = roundPremium(r.Used - r.LocalUsed)
+	r.Diverged = !r.Unlimited && math.Abs(r.Divergence) > r.Threshold
+	if r.Diverged && !prev.Diverged {
+		slog.Warn("premium requests diverge from Copilot's quota; premiumMultipliers may be stale",
+			"quota_used", r.Used, "local_used", r.LocalUsed, "since", r.Since.Format(time.RFC3339))
+	}
+	premiumQuota.report = r
+
+	if !snap.Unlimited && snap.Entitlement > 0 {
+		usedPercent := used / snap.Entitlement * 100
+		if snap.PercentRemaining != nil {
+			usedPercent = 100 - *snap.PercentRemaining
+		}
+		threshold := float64(cfg.NotifyQuotaPercent())
+		switch {
+		case usedPercent >= threshold && !premiumQuota.quotaNotified:
+			premiumQuota.quotaNotified = true
+			msg := fmt.Sprintf("%.0f%% of the premium requests are used (%.0f of %.0f left).",
+				usedPercent, remaining, snap.Entitlement)
+			if resetDate != "" {
+				msg += " The quota resets " + resetDate + "."
+			}
+			notify.Send(ctx, notify.EventQuota, "Copilot premium quota running out", msg)
+		case usedPercent < threshold:
+			premiumQuota.quotaNotified = false
+		}
+	}
+}
+
+// PollPremiumQuota reads the premium quota of ctx's account every
+// premiumQuotaTTL, so quota notifications don't wait for /api/stats to be
+// requested. It returns when ctx is done.
+func PollPremiumQuota(ctx context.Context) {
+	for {
+		PremiumQuota(ctx)
+		select {
+		case <-time.After(premiumQuotaTTL):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func roundPremium(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// fetchPremiumQuota reads the premium_interactions quota snapshot and the
+// quota reset date from copilot_internal/user.
+func fetchPremiumQuota(ctx context.Context) (*premiumQuotaSnapshot, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.github.com/copilot_internal/user", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	s := state.FromContext(ctx)
+	req.Header = api.BuildGitHubHeaders(s, s.GetGithubToken())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetching usage: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("usage request failed with status %d", resp.StatusCode)
+	}
+
+	var usage struct {
+		QuotaResetDate string `json:"quota_reset_date"`
+		QuotaSnapshots struct {
+			PremiumInteractions *premiumQuotaSnapshot `json:"premium_interactions"`
+		} `json:"quota_snapshots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, "", fmt.Errorf("decoding usage: %w", err)
+	}
+	if usage.QuotaSnapshots.PremiumInteractions == nil {
+		return nil, "", fmt.Errorf("usage has no premium_interactions quota")
+	}
+	return usage.QuotaSnapshots.PremiumInteractions, usage.QuotaResetDate, nil
+}
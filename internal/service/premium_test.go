@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
+)
+
+func TestQuotaNotifiedOnThresholdCrossing(t *testing.T) {
+	events := make(chan notify.Notification, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notify.Notification
+		json.NewDecoder(r.Body).Decode(&n)
+		events <- n
+	}))
+	defer hook.Close()
+	useConfig(t, func(c *config.Config) {
+		c.Notifications = config.NotificationsConfig{WebhookURL: hook.URL, QuotaPercent: 80}
+	})
+	ctx := WithAccount(testContext(context.Background()), NewAccount())
+
+	pct := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		snap     premiumQuotaSnapshot
+		history  bool // a new notification history, past the interval limit
+		notified bool
+	}{
+		{"below", premiumQuotaSnapshot{Entitlement: 300, Remaining: 90}, false, false},
+		{"crossed", premiumQuotaSnapshot{Entitlement: 300, Remaining: 45}, false, true},
+		{"still above", premiumQuotaSnapshot{Entitlement: 300, Remaining: 10}, true, false},
+		{"reset", premiumQuotaSnapshot{Entitlement: 300, Remaining: 300}, false, false},
+		{"crossed again", premiumQuotaSnapshot{Entitlement: 300, Remaining: 30}, true, true},
+		{"percent remaining preferred", premiumQuotaSnapshot{Entitlement: 300, Remaining: 0, PercentRemaining: pct(50)}, false, false},
+		{"unlimited", premiumQuotaSnapshot{Entitlement: 300, Remaining: 0, Unlimited: true}, true, false},
+	}
+	for _, tt := range tests {
+		if tt.history {
+			ctx = notify.WithHistory(ctx, notify.NewHistory())
+		}
+		recordPremiumQuota(ctx, &tt.snap, "2026-11-01")
+		select {
+		case n := <-events:
+			if !tt.notified {
+				t.Errorf("%s: notified %q", tt.name, n.Message)
+			} else if n.Event != notify.EventQuota || n.Message == "" {
+				t.Errorf("%s: notification %+v", tt.name, n)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if tt.notified {
+				t.Errorf("%s: not notified", tt.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// maxClientRequestIDLen caps the client's request ID carried upstream.
+const maxClientRequestIDLen = 64
+
+// RequestIDs links one logical upstream request to the IDs needed to trace
+// it: the X-Request-Id sent to Copilot, the same for every attempt (hedges
+// and retries), and the request ID of Copilot's response, which Copilot
+// support asks for.
+type RequestIDs struct {
+	Sent string
+
+	mu       sync.Mutex
+	received string
+}
+
+// NewRequestIDs generates the X-Request-Id of a logical request. A
+// request ID sent by the client is appended to it, so the upstream ID
+// can be found from the client's.
+func NewRequestIDs(clientID string) *RequestIDs {
+	id := uuid.New().String()
+	if clientID = sanitizeRequestID(clientID); clientID != "" {
+		id += "-" + clientID
+	}
+	return &RequestIDs{Sent: id}
+}
+
+// Received returns the request ID of the last upstream response, or "".
+func (ids *RequestIDs) Received() string {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	return ids.received
+}
+
+func (ids *RequestIDs) record(h http.Header) {
+	id := h.Get("X-Request-Id")
+	if id == "" {
+		id = h.Get("X-Github-Request-Id")
+	}
+	if id == "" {
+		return
+	}
+	ids.mu.Lock()
+	ids.received = id
+	ids.mu.Unlock()
+}
+
+type requestIDsKey struct{}
+
+// WithRequestIDs returns a context whose upstream requests are sent with
+// the X-Request-Id of ids and record the ID of their response in it.
+func WithRequestIDs(ctx context.Context, ids *RequestIDs) context.Context {
+	return context.WithValue(ctx, requestIDsKey{}, ids)
+}
+
+func requestIDsFrom(ctx context.Context) *RequestIDs {
+	ids, _ := ctx.Value(requestIDsKey{}).(*RequestIDs)
+	return ids
+}
+
+// sanitizeRequestID keeps the characters of id that are safe in a header
+// value and in logs, up to maxClientRequestIDLen.
+func sanitizeRequestID(id string) string {
+	var b strings.Builder
+	for _, c := range id {
+		if b.Len() >= maxClientRequestIDLen {
+			break
+		}
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("-_.:", c):
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Backends a sampling policy is resolved for, as in RequestRecord.Backend.
+const (
+	BackendChatCompletions = "chat_completions"
+	BackendResponses       = "responses"
+)
+
+// Upper bounds of the sampling parameters under the clamp policy; both
+// are clamped to 0 from below. Claude models accept temperatures up to 1,
+// OpenAI models up to 2.
+const (
+	maxTemperature       = 2.0
+	maxClaudeTemperature = 1.0
+	maxTopP              = 1.0
+)
+
+// SamplingPolicy returns how the temperature and top_p of a request for
+// model are handled on backend: the modelSamplingParams entry if there is
+// one, or else a policy derived from the model's capabilities. Reasoning
+// models (those listing reasoning efforts) reject sampling parameters, so
+// theirs are omitted; other known models get them clamped. Models missing
+// from the model list keep the old behavior: forwarded on Chat
+// Completions, omitted on the Responses API, which serves reasoning
+// models.
+func SamplingPolicy(ctx context.Context, model, backend string) string {
+	if p, ok := config.FromContext(ctx).ModelSamplingPolicy(model); ok {
+		return p
+	}
+	m := state.FromContext(ctx).FindModel(model)
+	switch {
+	case m != nil && len(m.Capabilities.Supports.ReasoningEffort) > 0:
+		return config.SamplingOmit
+	case m != nil:
+		return config.SamplingClamp
+	case backend == BackendResponses:
+		return config.SamplingOmit
+	}
+	return config.SamplingForward
+}
+
+// ApplySamplingPolicy returns the temperature and top_p to send upstream
+// for a request for model on backend, under its SamplingPolicy. Dropped
+// and clamped values are logged.
+func ApplySamplingPolicy(ctx context.Context, model, backend string, temperature, topP *float64) (*float64, *float64) {
+	if temperature == nil && topP == nil {
+		return nil, nil
+	}
+	policy := SamplingPolicy(ctx, model, backend)
+	return applySampling(policy, model, backend, "temperature", temperature, temperatureLimit(model)),
+		applySampling(policy, model, backend, "top_p", topP, maxTopP)
+}
+
+// patchSamplingParams applies the sampling policy of model to the
+// temperature and top_p of a chat completions payload in place.
+func patchSamplingParams(ctx context.Context, payload map[string]any, model string) {
+	var policy string
+	for _, p := range []struct {
+		name  string
+		limit float64
+	}{{"temperature", temperatureLimit(model)}, {"top_p", maxTopP}} {
+		v, ok := payload[p.name].(float64)
+		if !ok {
+			continue
+		}
+		if policy == "" {
+			policy = SamplingPolicy(ctx, model, BackendChatCompletions)
+		}
+		if out := applySampling(policy, model, BackendChatCompletions, p.name, &v, p.limit); out != nil {
+			payload[p.name] = *out
+		} else {
+			delete(payload, p.name)
+		}
+	}
+}
+
+func applySampling(policy, model, backend, name string, v *float64, limit float64) *float64 {
+	if v == nil {
+		return nil
+	}
+	switch policy {
+	case config.SamplingOmit:
+		slog.Info("dropping sampling parameter", "model", model, "backend", backend, "param", name, "value", *v)
+		return nil
+	case config.SamplingClamp:
+		clamped := min(max(*v, 0), limit)
+		if clamped != *v {
+			slog.Info("clamping sampling parameter", "model", model, "backend", backend, "param", name, "value", *v, "clamped", clamped)
+		}
+		return &clamped
+	}
+	out := *v
+	return &out
+}
+
+func temperatureLimit(model string) float64 {
+	if strings.Contains(strings.ToLower(model), "claude") {
+		return maxClaudeTemperature
+	}
+	return maxTemperature
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// useSamplingModels lists o3 (a reasoning model), gpt-4.1 and
+// claude-sonnet-4 for the rest of the test.
+func useSamplingModels(t *testing.T) {
+	t.Helper()
+	prev := state.Global.GetModels()
+	reasoning := state.ModelCapabilities{Supports: state.ModelSupports{ReasoningEffort: []string{"low", "medium", "high"}}}
+	state.Global.SetModels([]state.Model{
+		{ID: "o3", Capabilities: reasoning},
+		{ID: "gpt-4.1"},
+		{ID: "claude-sonnet-4"},
+	})
+	t.Cleanup(func() { state.Global.SetModels(prev) })
+}
+
+func TestSamplingPolicy(t *testing.T) {
+	useSamplingModels(t)
+	tests := []struct {
+		name     string
+		policies map[string]string
+		model    string
+		backend  string
+		want     string
+	}{
+		// Derived from the model list
+		{"reasoning model", nil, "o3", BackendChatCompletions, config.SamplingOmit},
+		{"listed model", nil, "gpt-4.1", BackendChatCompletions, config.SamplingClamp},
+		{"listed model on responses", nil, "gpt-4.1", BackendResponses, config.SamplingClamp},
+		{"unlisted on chat", nil, "my-finetune", BackendChatCompletions, config.SamplingForward},
+		{"unlisted on responses", nil, "my-finetune", BackendResponses, config.SamplingOmit},
+		// Configured
+		{"model entry", map[string]string{"o3": config.SamplingForward}, "o3", BackendResponses, config.SamplingForward},
+		{"default entry", map[string]string{config.ModelSamplingDefault: config.SamplingOmit}, "gpt-4.1", BackendChatCompletions, config.SamplingOmit},
+		{"model entry beats default", map[string]string{config.ModelSamplingDefault: config.SamplingOmit, "gpt-4.1": config.SamplingForward}, "gpt-4.1", BackendChatCompletions, config.SamplingForward},
+		{"other model's entry", map[string]string{"o3": config.SamplingForward}, "my-finetune", BackendResponses, config.SamplingOmit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) { c.ModelSamplingParams = tt.policies })
+			if got := SamplingPolicy(testContext(context.Background()), tt.model, tt.backend); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySamplingPolicy(t *testing.T) {
+	useSamplingModels(t)
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name        string
+		policy      string
+		model       string
+		temperature *float64
+		topP        *float64
+		wantTemp    *float64
+		wantTopP    *float64
+		logged      string
+	}{
+		{"forward", config.SamplingForward, "o3", f(1.7), f(0.9), f(1.7), f(0.9), ""},
+		{"forward out of range", config.SamplingForward, "gpt-4.1", f(3), f(1.5), f(3), f(1.5), ""},
+		{"clamp in range", config.SamplingClamp, "gpt-4.1", f(1.7), f(0.9), f(1.7), f(0.9), ""},
+		{"clamp above", config.SamplingClamp, "gpt-4.1", f(2.5), f(1.5), f(2), f(1), "clamping sampling parameter"},
+		{"clamp below", config.SamplingClamp, "gpt-4.1", f(-1), f(-0.5), f(0), f(0), "clamping sampling parameter"},
+		{"clamp claude", config.SamplingClamp, "claude-sonnet-4", f(1.7), nil, f(1), nil, "clamping sampling parameter"},
+		{"omit", config.SamplingOmit, "gpt-4.1", f(0.2), f(0.9), nil, nil, "dropping sampling parameter"},
+		{"omit temperature only", config.SamplingOmit, "gpt-4.1", f(0.2), nil, nil, nil, "dropping sampling parameter"},
+		{"nothing sent", config.SamplingOmit, "gpt-4.1", nil, nil, nil, nil, ""},
+	}
+	for _, tt := range tests {
+		for _, backend := range []string{BackendChatCompletions, BackendResponses} {
+			t.Run(tt.name+"/"+backend, func(t *testing.T) {
+				useConfig(t, func(c *config.Config) { c.ModelSamplingParams = map[string]string{tt.model: tt.policy} })
+				var logs bytes.Buffer
+				prev := slog.Default()
+				slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+				t.Cleanup(func() { slog.SetDefault(prev) })
+
+				temp, topP := ApplySamplingPolicy(testContext(context.Background()), tt.model, backend, tt.temperature, tt.topP)
+				if !sameFloat(temp, tt.wantTemp) || !sameFloat(topP, tt.wantTopP) {
+					t.Errorf("got temperature %v, top_p %v; want %v, %v", deref(temp), deref(topP), deref(tt.wantTemp), deref(tt.wantTopP))
+				}
+				if tt.logged == "" {
+					if logs.Len() > 0 {
+						t.Errorf("unexpected log: %s", logs.String())
+					}
+				} else if !strings.Contains(logs.String(), tt.logged) || !strings.Contains(logs.String(), "backend="+backend) {
+					t.Errorf("log %q, want %q with backend=%s", logs.String(), tt.logged, backend)
+				}
+				// The client's values are never modified
+				if temp != nil && temp == tt.temperature || topP != nil && topP == tt.topP {
+					t.Error("returned the client's pointer")
+				}
+			})
+		}
+	}
+}
+
+func TestPatchSamplingParams(t *testing.T) {
+	useSamplingModels(t)
+	tests := []struct {
+		name    string
+		model   string
+		policy  string // modelSamplingParams entry; empty for none
+		payload map[string]any
+		want    map[string]any
+	}{
+		{"derived omit", "o3", "", map[string]any{"temperature": 0.5, "top_p": 0.9}, map[string]any{}},
+		{"derived clamp", "gpt-4.1", "", map[string]any{"temperature": 2.5, "top_p": 0.9}, map[string]any{"temperature": 2.0, "top_p": 0.9}},
+		{"derived forward", "my-finetune", "", map[string]any{"temperature": 2.5}, map[string]any{"temperature": 2.5}},
+		{"configured forward", "o3", config.SamplingForward, map[string]any{"temperature": 0.5}, map[string]any{"temperature": 0.5}},
+		{"configured clamp", "claude-sonnet-4", config.SamplingClamp, map[string]any{"temperature": 1.5, "top_p": 1.2}, map[string]any{"temperature": 1.0, "top_p": 1.0}},
+		{"configured omit", "gpt-4.1", config.SamplingOmit, map[string]any{"top_p": 0.5}, map[string]any{}},
+		{"null left alone", "gpt-4.1", config.SamplingOmit, map[string]any{"temperature": nil}, map[string]any{"temperature": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, func(c *config.Config) {
+				c.ModelSamplingParams = nil
+				if tt.policy != "" {
+					c.ModelSamplingParams = map[string]string{tt.model: tt.policy}
+				}
+			})
+			patchSamplingParams(testContext(context.Background()), tt.payload, tt.model)
+			if len(tt.payload) != len(tt.want) {
+				t.Fatalf("got %v, want %v", tt.payload, tt.want)
+			}
+			for k, want := range tt.want {
+				if got, ok := tt.payload[k]; !ok || got != want {
+					t.Errorf("%s = %v, want %v", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func sameFloat(a, b *float64) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func deref(v *float64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// TestParseAndPatchChatCompletionSampling checks the policy on the chat
+// completions passthrough.
+func TestParseAndPatchChatCompletionSampling(t *testing.T) {
+	useSamplingModels(t)
+	useConfig(t, func(c *config.Config) { c.ModelSamplingParams = nil })
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"o3", `{}`},
+		{"gpt-4.1", `{"temperature":2,"top_p":1}`},
+		{"my-finetune", `{"temperature":2.5,"top_p":1.2}`},
+	}
+	for _, tt := range tests {
+		body := `{"model":"` + tt.model + `","temperature":2.5,"top_p":1.2,"messages":[{"role":"user","content":"hi"}]}`
+		out, _, _, _, err := ParseAndPatchChatCompletion(testContext(context.Background()), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.model, err)
+		}
+		var got, want map[string]any
+		json.Unmarshal(out, &got)
+		json.Unmarshal([]byte(tt.want), &want)
+		for _, k := range []string{"temperature", "top_p"} {
+			if got[k] != want[k] {
+				t.Errorf("%s: %s = %v, want %v", tt.model, k, got[k], want[k])
+			}
+		}
+	}
+}
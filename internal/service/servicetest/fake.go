@@ -0,0 +1,238 @@
+// Package servicetest provides a fake service.Backend, so handlers can be
+// exercised without a Copilot API: each endpoint answers with scripted
+// replies, streaming ones as SSE transcripts, and every call is recorded.
+package servicetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Upstream endpoints a Fake can be scripted for.
+const (
+	ChatCompletions = "/chat/completions"
+	Messages        = "/v1/messages"
+	Responses       = "/responses"
+	Embeddings      = "/embeddings"
+)
+
+// Reply is one scripted upstream response.
+type Reply struct {
+	Status int         // defaults to 200
+	Header http.Header // Content-Type defaults to application/json, or text/event-stream with Events
+	Body   string      // sent as is, unless Events is set
+	Events []Event     // an SSE transcript to stream instead of Body
+	Err    error       // returned instead of a response, as for a transport failure
+}
+
+// Event is one SSE event of a transcript. Name is omitted from the frame
+// when empty, as Chat Completions and Responses streams do.
+type Event struct {
+	Name string
+	Data string
+}
+
+// JSON returns a 200 reply with body.
+func JSON(body string) Reply { return Reply{Body: body} }
+
+// Error returns a non-2xx reply; the handler gets it the way the service
+// reports one, as an *api.HTTPError carrying body.
+func Error(status int, body string) Reply { return Reply{Status: status, Body: body} }
+
+// SSE returns a streaming reply of unnamed events with the given data.
+func SSE(data ...string) Reply {
+	events := make([]Event, len(data))
+	for i, d := range data {
+		events[i] = Event{Data: d}
+	}
+	return Reply{Events: events}
+}
+
+// Transcript returns a streaming reply that replays a recorded SSE
+// transcript, such as a fixture's input.sse.
+func Transcript(path string) (Reply, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Reply{}, err
+	}
+	return Reply{
+		Header: http.Header{"Content-Type": {"text/event-stream"}},
+		Body:   string(data),
+	}, nil
+}
+
+// Call is one request the Fake received.
+type Call struct {
+	Endpoint   string
+	Body       []byte
+	IsAgent    bool
+	Vision     bool
+	BetaHeader string // Messages only
+	N          int    // fan-out only
+}
+
+// Fake is a service.Backend answering from scripted replies. The zero
+// value is ready to use; an endpoint with no script fails its calls.
+type Fake struct {
+	mu        sync.Mutex
+	models    []state.Model
+	modelsErr error
+	scripts   map[string][]Reply
+	calls     []Call
+}
+
+var _ service.Backend = (*Fake)(nil)
+
+// Script queues replies for endpoint. They're used in order, and the last
+// one keeps answering once the rest are used up.
+func (f *Fake) Script(endpoint string, replies ...Reply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.scripts == nil {
+		f.scripts = make(map[string][]Reply)
+	}
+	f.scripts[endpoint] = append(f.scripts[endpoint], replies...)
+}
+
+// SetModels sets what FetchModels returns.
+func (f *Fake) SetModels(models []state.Model, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.models, f.modelsErr = models, err
+}
+
+// Calls returns the requests received so far, oldest first.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// Endpoints returns the endpoint of each request received so far.
+func (f *Fake) Endpoints() []string {
+	calls := f.Calls()
+	out := make([]string, len(calls))
+	for i, c := range calls {
+		out[i] = c.Endpoint
+	}
+	return out
+}
+
+func (f *Fake) FetchModels(ctx context.Context) ([]state.Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.models, f.modelsErr
+}
+
+func (f *Fake) ProxyChatCompletion(ctx context.Context, body []byte, isAgent bool) (*http.Response, error) {
+	return f.serve(ctx, Call{Endpoint: ChatCompletions, Body: body, IsAgent: isAgent})
+}
+
+func (f *Fake) ProxyChatCompletionEx(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error) {
+	return f.serve(ctx, Call{Endpoint: ChatCompletions, Body: body, IsAgent: isAgent, Vision: vision})
+}
+
+// ProxyChatCompletionFanOut answers with one Chat Completions reply, which
+// the script should make the merged response of all n choices.
+func (f *Fake) ProxyChatCompletionFanOut(ctx context.Context, body []byte, isAgent bool, n int) ([]byte, error) {
+	resp, err := f.serve(ctx, Call{Endpoint: ChatCompletions, Body: body, IsAgent: isAgent, N: n})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (f *Fake) ProxyMessages(ctx context.Context, body []byte, betaHeader string, vision, isAgent bool) (*http.Response, error) {
+	return f.serve(ctx, Call{Endpoint: Messages, Body: body, IsAgent: isAgent, Vision: vision, BetaHeader: betaHeader})
+}
+
+func (f *Fake) ProxyResponses(ctx context.Context, body []byte, isAgent, vision bool) (*http.Response, error) {
+	return f.serve(ctx, Call{Endpoint: Responses, Body: body, IsAgent: isAgent, Vision: vision})
+}
+
+func (f *Fake) ProxyEmbeddings(ctx context.Context, body []byte) (*http.Response, error) {
+	return f.serve(ctx, Call{Endpoint: Embeddings, Body: body})
+}
+
+// serve records call and answers it with the next reply scripted for its
+// endpoint, turning a non-2xx one into the error the service returns.
+func (f *Fake) serve(ctx context.Context, call Call) (*http.Response, error) {
+	call.Body = bytes.Clone(call.Body)
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	queue := f.scripts[call.Endpoint]
+	var reply Reply
+	ok := len(queue) > 0
+	if ok {
+		reply = queue[0]
+		if len(queue) > 1 {
+			f.scripts[call.Endpoint] = queue[1:]
+		}
+	}
+	f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("servicetest: no reply scripted for %s", call.Endpoint)
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	resp := reply.response()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, api.NewHTTPError(resp)
+	}
+	return resp, nil
+}
+
+func (r Reply) response() *http.Response {
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := r.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	body := r.Body
+	if r.Events != nil {
+		var b strings.Builder
+		for _, e := range r.Events {
+			if e.Name != "" {
+				fmt.Fprintf(&b, "event: %s\n", e.Name)
+			}
+			fmt.Fprintf(&b, "data: %s\n\n", e.Data)
+		}
+		body = b.String()
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "text/event-stream")
+		}
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
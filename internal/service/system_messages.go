@@ -0,0 +1,116 @@
+package service
+
+import "strings"
+
+// mergeMidSystemMessages folds system messages that appear after the start
+// of the conversation into the adjacent user message as <system-reminder>
+// blocks, for models that reject a system role mid-conversation. Leading
+// system messages are left alone. Each message is merged into the next user
+// message, or the previous one when no user message follows; with no user
+// message at all it becomes a user message. Returns the new message list
+// and the number of messages merged.
+func mergeMidSystemMessages(messages []any) ([]any, int) {
+	leading := 0
+	for leading < len(messages) && messageRole(messages[leading]) == "system" {
+		leading++
+	}
+
+	out := make([]any, 0, len(messages))
+	out = append(out, messages[:leading]...)
+
+	var pending []string // reminders waiting for the next user message
+	merged := 0
+	lastUser := -1 // index in out
+	for _, m := range messages[leading:] {
+		msg, ok := m.(map[string]any)
+		if !ok {
+			out = append(out, m)
+			continue
+		}
+		switch msg["role"] {
+		case "system":
+			pending = append(pending, systemReminder(msg["content"]))
+			merged++
+			continue
+		case "user":
+			if len(pending) > 0 {
+				msg["content"] = prependText(msg["content"], pending)
+				pending = nil
+			}
+			lastUser = len(out)
+		}
+		out = append(out, msg)
+	}
+
+	if len(pending) > 0 {
+		if lastUser >= 0 {
+			user := out[lastUser].(map[string]any)
+			user["content"] = appendText(user["content"], pending)
+		} else {
+			out = append(out, map[string]any{"role": "user", "content": strings.Join(pending, "\n\n")})
+		}
+	}
+	return out, merged
+}
+
+func messageRole(m any) string {
+	if msg, ok := m.(map[string]any); ok {
+		role, _ := msg["role"].(string)
+		return role
+	}
+	return ""
+}
+
+// systemReminder wraps a system message's text in a <system-reminder> block.
+func systemReminder(content any) string {
+	return "<system-reminder>\n" + contentText(content) + "\n</system-reminder>"
+}
+
+// contentText joins the text of a string or content-part array.
+func contentText(content any) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []any:
+		var parts []string
+		for _, p := range v {
+			if part, ok := p.(map[string]any); ok {
+				if text, ok := part["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// prependText adds text blocks before a user message's content, keeping
+// its shape (string or content-part array).
+func prependText(content any, texts []string) any {
+	if parts, ok := content.([]any); ok {
+		out := make([]any, 0, len(parts)+len(texts))
+		for _, t := range texts {
+			out = append(out, map[string]any{"type": "text", "text": t})
+		}
+		return append(out, parts...)
+	}
+	if s, _ := content.(string); s != "" {
+		texts = append(texts, s)
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// appendText adds text blocks after a user message's content.
+func appendText(content any, texts []string) any {
+	if parts, ok := content.([]any); ok {
+		for _, t := range texts {
+			parts = append(parts, map[string]any{"type": "text", "text": t})
+		}
+		return parts
+	}
+	if s, _ := content.(string); s != "" {
+		texts = append([]string{s}, texts...)
+	}
+	return strings.Join(texts, "\n\n")
+}
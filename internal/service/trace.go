@@ -0,0 +1,97 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// ConnInfo describes how an upstream request got its connection.
+type ConnInfo struct {
+	Traced       bool // a connection was obtained
+	Reused       bool // an idle or multiplexed (HTTP/2) connection was reused
+	TLSHandshake time.Duration
+	TTFB         time.Duration // from requesting a connection to the first response byte
+}
+
+// ConnStats collects ConnInfo for the upstream requests made with a
+// context from WithConnStats. When a request is hedged, the first
+// connection and first response byte are recorded.
+type ConnStats struct {
+	mu       sync.Mutex
+	info     ConnInfo
+	start    time.Time
+	tlsStart time.Time
+}
+
+type connStatsKey struct{}
+
+// WithConnStats returns a context whose upstream requests record their
+// connection in stats.
+func WithConnStats(ctx context.Context, stats *ConnStats) context.Context {
+	return context.WithValue(ctx, connStatsKey{}, stats)
+}
+
+// Info returns what was recorded so far.
+func (s *ConnStats) Info() ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+func (s *ConnStats) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			s.mu.Lock()
+			if s.start.IsZero() {
+				s.start = time.Now()
+			}
+			s.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			s.mu.Lock()
+			if s.tlsStart.IsZero() {
+				s.tlsStart = time.Now()
+			}
+			s.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			s.mu.Lock()
+			if s.info.TLSHandshake == 0 && !s.tlsStart.IsZero() {
+				s.info.TLSHandshake = time.Since(s.tlsStart)
+			}
+			s.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.mu.Lock()
+			if !s.info.Traced {
+				s.info.Traced = true
+				s.info.Reused = info.Reused
+			}
+			s.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			s.mu.Lock()
+			if s.info.TTFB == 0 && !s.start.IsZero() {
+				s.info.TTFB = time.Since(s.start)
+			}
+			s.mu.Unlock()
+		},
+	}
+}
+
+// newUpstreamRequest builds a POST of body to a Copilot API path, tracing
+// its connection into the ConnStats of ctx, if any.
+func newUpstreamRequest(ctx context.Context, path string, body []byte) (*http.Request, error) {
+	if stats, ok := ctx.Value(connStatsKey{}).(*ConnStats); ok {
+		ctx = httptrace.WithClientTrace(ctx, stats.trace())
+	}
+	return http.NewRequestWithContext(ctx, http.MethodPost, api.CopilotURL(state.FromContext(ctx), path), bytes.NewReader(body))
+}
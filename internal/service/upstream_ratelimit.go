@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// rateLimitHeaderPrefix starts the rate-limit headers of Copilot
+// responses, such as x-ratelimit-remaining or
+// x-ratelimit-remaining-requests.
+const rateLimitHeaderPrefix = "x-ratelimit-"
+
+// ModelRateLimit is the latest rate-limit state Copilot reported for a
+// model, as listed in /api/stats.
+type ModelRateLimit struct {
+	Model string `json:"model"`
+	// Headers are the x-ratelimit-* headers of the response, keyed by
+	// their name without the prefix (remaining, limit-tokens, ...)
+	Headers   map[string]string `json:"headers"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// rateLimits keeps the latest rate-limit headers per model, and which
+// resources are below rateLimitWarnPercent so the warning is logged once
+// per drop rather than on every response.
+type rateLimits struct {
+	mu     sync.Mutex
+	models map[string]ModelRateLimit
+	low    map[string]bool // model + "\x00" + resource
+}
+
+// RateLimits returns the latest rate-limit headers of every model that
+// reported them for ctx's account, sorted by model.
+func RateLimits(ctx context.Context) []ModelRateLimit {
+	r := &accountOf(ctx).rateLimits
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]ModelRateLimit, 0, len(r.models))
+	for _, m := range r.models {
+		m.Headers = maps.Clone(m.Headers)
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	return out
+}
+
+// rateLimitHeaders returns the x-ratelimit-* headers of h keyed by their
+// name without the prefix, or nil when there are none.
+func rateLimitHeaders(h http.Header) map[string]string {
+	var out map[string]string
+	for name, values := range h {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, rateLimitHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[strings.TrimPrefix(name, rateLimitHeaderPrefix)] = values[0]
+	}
+	return out
+}
+
+// record stores headers as the latest of model and warns about each
+// resource whose remaining count has just dropped below percent of its
+// limit.
+func (r *rateLimits) record(model string, headers map[string]string, percent int) {
+	if model == "" {
+		model = "unknown"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.models[model] = ModelRateLimit{Model: model, Headers: headers, UpdatedAt: time.Now()}
+	for name, value := range headers {
+		resource, ok := strings.CutPrefix(name, "remaining")
+		if !ok {
+			continue
+		}
+		remaining, err1 := strconv.ParseInt(value, 10, 64)
+		limit, err2 := strconv.ParseInt(headers["limit"+resource], 10, 64)
+		if err1 != nil || err2 != nil || limit <= 0 {
+			continue
+		}
+		key := model + "\x00" + resource
+		low := remaining*100 < limit*int64(percent)
+		if low && !r.low[key] {
+			slog.Warn("Copilot rate limit running low", "model", model,
+				"resource", strings.TrimPrefix(resource, "-"), "remaining", remaining, "limit", limit,
+				"reset", headers["reset"+resource])
+		}
+		r.low[key] = low
+	}
+}
+
+// UpstreamRateLimit records the rate-limit headers of the last Copilot
+// response to the requests made with a context from
+// WithUpstreamRateLimit.
+type UpstreamRateLimit struct {
+	mu      sync.Mutex
+	headers map[string]string
+}
+
+// Headers returns the x-ratelimit-* headers of the last response, keyed
+// by their name without the prefix, or nil when it had none.
+func (u *UpstreamRateLimit) Headers() map[string]string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.headers
+}
+
+func (u *UpstreamRateLimit) set(headers map[string]string) {
+	u.mu.Lock()
+	u.headers = headers
+	u.mu.Unlock()
+}
+
+type upstreamRateLimitKey struct{}
+
+// WithUpstreamRateLimit returns a context whose Copilot requests record
+// the rate-limit headers of their response in u.
+func WithUpstreamRateLimit(ctx context.Context, u *UpstreamRateLimit) context.Context {
+	return context.WithValue(ctx, upstreamRateLimitKey{}, u)
+}
+
+// recordRateLimit captures the rate-limit headers of a Copilot response to
+// a request with body, for /api/stats and the context's UpstreamRateLimit.
+func recordRateLimit(ctx context.Context, body []byte, h http.Header) {
+	headers := rateLimitHeaders(h)
+	if headers == nil {
+		return
+	}
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &req)
+	accountOf(ctx).rateLimits.record(req.Model, headers, config.FromContext(ctx).RateLimitWarnThreshold())
+	if u, ok := ctx.Value(upstreamRateLimitKey{}).(*UpstreamRateLimit); ok {
+		u.set(headers)
+	}
+}
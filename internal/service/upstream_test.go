@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// The tests' instance serves the process-wide state, metrics and config.
+var (
+	testAccount  = NewAccount()
+	testNotified = notify.NewHistory()
+)
+
+// testContext returns ctx served by the tests' instance.
+func testContext(ctx context.Context) context.Context {
+	ctx = state.WithState(ctx, state.Global)
+	ctx = state.WithMetrics(ctx, state.Metrics)
+	ctx = config.WithStore(ctx, config.Global)
+	ctx = WithAccount(ctx, testAccount)
+	return notify.WithHistory(ctx, testNotified)
+}
+
+// redirectTransport sends requests for the Copilot API to a test server.
+type redirectTransport struct {
+	copilot *url.URL
+	next    http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if base, _ := url.Parse(api.GetBaseURL(state.Global.GetAccountType())); req.URL.Host == base.Host {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host = t.copilot.Scheme, t.copilot.Host
+	}
+	return t.next.RoundTrip(req)
+}
+
+// fakeCopilot serves the Copilot API with h for the rest of the test.
+func fakeCopilot(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	prev := http.DefaultClient.Transport
+	next := prev
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = redirectTransport{copilot: u, next: next}
+	t.Cleanup(func() { http.DefaultClient.Transport = prev })
+	return srv
+}
+
+// useConfig applies fn to the config for the rest of the test.
+func useConfig(t *testing.T, fn func(c *config.Config)) {
+	t.Helper()
+	prev := config.Get()
+	config.Update(fn)
+	t.Cleanup(func() { config.Update(func(c *config.Config) { *c = *prev }) })
+}
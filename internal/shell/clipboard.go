@@ -1,35 +1,113 @@
 package shell
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"runtime"
 	"strings"
 )
 
-// CopyToClipboard attempts to copy text to the system clipboard.
-// Returns an error if clipboard is unavailable (falls back to printing).
-func CopyToClipboard(text string) error {
+// Clipboard modes, as taken by --clipboard.
+const (
+	ClipboardAuto   = "auto"   // native, or OSC 52 over SSH or when native fails
+	ClipboardOSC52  = "osc52"  // the terminal's clipboard, via an escape sequence
+	ClipboardNative = "native" // the system clipboard utility
+	ClipboardOff    = "off"
+)
+
+// ClipboardModes lists the values --clipboard accepts.
+var ClipboardModes = []string{ClipboardAuto, ClipboardOSC52, ClipboardNative, ClipboardOff}
+
+// MethodOSC52 is the method CopyToClipboard reports for an OSC 52 copy.
+const MethodOSC52 = "OSC 52"
+
+// maxOSC52Bytes caps the base64 payload of an OSC 52 sequence; terminals
+// drop (or truncate) longer ones, xterm at 100000 bytes by default.
+const maxOSC52Bytes = 100000
+
+// errClipboardOff is returned by CopyToClipboard in ClipboardOff mode.
+var errClipboardOff = errors.New("clipboard disabled (--clipboard=off)")
+
+// CopyToClipboard copies text to the clipboard as mode says, and returns
+// the method used: the utility's name, or MethodOSC52. An OSC 52 copy
+// can't be confirmed; the terminal may ignore it. Returns an error if no
+// method worked (falls back to printing).
+func CopyToClipboard(text, mode string) (string, error) {
+	switch mode {
+	case ClipboardOff:
+		return "", errClipboardOff
+	case ClipboardNative:
+		return copyNative(text)
+	case ClipboardOSC52:
+		return MethodOSC52, copyOSC52(text)
+	case ClipboardAuto, "":
+	default:
+		return "", fmt.Errorf("invalid clipboard mode %q (expected %s)", mode, strings.Join(ClipboardModes, ", "))
+	}
+
+	// Over SSH a native utility would fill the remote machine's clipboard
+	if os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" {
+		if err := copyOSC52(text); err == nil {
+			return MethodOSC52, nil
+		}
+	}
+	method, err := copyNative(text)
+	if err == nil {
+		return method, nil
+	}
+	if oscErr := copyOSC52(text); oscErr != nil {
+		return "", fmt.Errorf("%w; %v", err, oscErr)
+	}
+	return MethodOSC52, nil
+}
+
+// copyNative copies text with the platform's clipboard utility.
+func copyNative(text string) (string, error) {
 	var cmd *exec.Cmd
 
 	switch runtime.GOOS {
 	case "darwin":
 		cmd = exec.Command("pbcopy")
 	case "linux":
-		// Try xclip first, then xsel
-		if path, err := exec.LookPath("xclip"); err == nil {
+		// wl-copy on Wayland, then xclip, then xsel
+		if path, err := exec.LookPath("wl-copy"); err == nil && os.Getenv("WAYLAND_DISPLAY") != "" {
+			cmd = exec.Command(path)
+		} else if path, err := exec.LookPath("xclip"); err == nil {
 			cmd = exec.Command(path, "-selection", "clipboard")
 		} else if path, err := exec.LookPath("xsel"); err == nil {
 			cmd = exec.Command(path, "--clipboard", "--input")
 		} else {
-			return fmt.Errorf("no clipboard utility found (install xclip or xsel)")
+			return "", fmt.Errorf("no clipboard utility found (install wl-clipboard, xclip or xsel)")
 		}
 	case "windows":
 		cmd = exec.Command("clip")
 	default:
-		return fmt.Errorf("clipboard not supported on %s", runtime.GOOS)
+		return "", fmt.Errorf("clipboard not supported on %s", runtime.GOOS)
 	}
 
 	cmd.Stdin = strings.NewReader(text)
-	return cmd.Run()
+	method := processBaseName(cmd.Args[0])
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w", method, err)
+	}
+	return method, nil
+}
+
+// copyOSC52 asks the terminal on stdout to set its clipboard to text. It
+// works over SSH and in terminals without a clipboard utility; tmux needs
+// set-clipboard on to pass it through.
+func copyOSC52(text string) error {
+	info, err := os.Stdout.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("OSC 52: stdout is not a terminal")
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	if len(encoded) > maxOSC52Bytes {
+		return fmt.Errorf("OSC 52: %d bytes encoded, over the %d byte limit", len(encoded), maxOSC52Bytes)
+	}
+	_, err = fmt.Fprintf(os.Stdout, "\x1b]52;c;%s\x07", encoded)
+	return err
 }
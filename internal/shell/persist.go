@@ -0,0 +1,152 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Where Persist can save environment variables.
+const (
+	PersistProfile = "profile" // a block in the PowerShell profile
+	PersistSetx    = "setx"    // user environment variables, via setx (Windows)
+)
+
+// PersistModes lists the values --claude-code-persist accepts.
+var PersistModes = []string{PersistProfile, PersistSetx}
+
+// The process and command lookups Persist and Detect depend on; tests
+// replace them.
+var (
+	ancestors   = processAncestors
+	profilePath = powershellProfile
+	setx        = func(key, value string) ([]byte, error) {
+		return exec.Command("setx", key, value).CombinedOutput()
+	}
+)
+
+// Markers around the block Persist writes to the PowerShell profile, so
+// running it again replaces the block instead of adding another.
+const (
+	profileBlockStart = "# >>> copilot-proxy-go claude-code >>>"
+	profileBlockEnd   = "# <<< copilot-proxy-go claude-code <<<"
+)
+
+// Persist saves vars so shells started from now on have them, and returns
+// where they went.
+func Persist(mode string, vars []EnvVar) (string, error) {
+	switch mode {
+	case PersistProfile:
+		return persistProfile(vars)
+	case PersistSetx:
+		return persistSetx(vars)
+	}
+	return "", fmt.Errorf("invalid persist mode %q (expected %s)", mode, strings.Join(PersistModes, " or "))
+}
+
+// persistProfile writes vars to the current user's profile of the
+// PowerShell the proxy runs in: pwsh when that's an ancestor, else
+// Windows PowerShell (pwsh off Windows).
+func persistProfile(vars []EnvVar) (string, error) {
+	exe := "powershell"
+	if runtime.GOOS != "windows" {
+		exe = "pwsh"
+	}
+	names, _ := ancestors(maxAncestors)
+	for _, name := range names {
+		if processBaseName(name) == "pwsh" {
+			exe = "pwsh"
+			break
+		}
+	}
+	path, err := profilePath(exe)
+	if err != nil {
+		return "", err
+	}
+	if err := writeProfile(path, vars); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// powershellProfile asks exe (powershell or pwsh) for its current user's
+// profile path.
+func powershellProfile(exe string) (string, error) {
+	out, err := exec.Command(exe, "-NoProfile", "-NoLogo", "-Command", "$PROFILE.CurrentUserCurrentHost").Output()
+	if err != nil {
+		return "", fmt.Errorf("finding the %s profile: %w", exe, err)
+	}
+	path := strings.TrimSpace(string(out))
+	if path == "" {
+		return "", fmt.Errorf("%s reported no profile path", exe)
+	}
+	return path, nil
+}
+
+// writeProfile puts the block of vars into the profile at path, creating
+// it and its directory if needed.
+func writeProfile(path string, vars []EnvVar) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, replaceProfileBlock(existing, profileBlock(vars)), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// profileBlock renders vars as PowerShell assignments between the
+// markers. Values are single-quoted, so nothing in them is expanded.
+func profileBlock(vars []EnvVar) []byte {
+	var b bytes.Buffer
+	b.WriteString(profileBlockStart + "\n")
+	for _, v := range vars {
+		fmt.Fprintf(&b, "$env:%s = '%s'\n", v.Key, strings.ReplaceAll(v.Value, "'", "''"))
+	}
+	b.WriteString(profileBlockEnd + "\n")
+	return b.Bytes()
+}
+
+// replaceProfileBlock swaps block in for the one already in profile, or
+// appends it.
+func replaceProfileBlock(profile, block []byte) []byte {
+	start := bytes.Index(profile, []byte(profileBlockStart))
+	end := bytes.Index(profile, []byte(profileBlockEnd))
+	if start >= 0 && end > start {
+		end += len(profileBlockEnd)
+		if end < len(profile) && profile[end] == '\r' {
+			end++
+		}
+		if end < len(profile) && profile[end] == '\n' {
+			end++
+		}
+		return slices.Concat(profile[:start], block, profile[end:])
+	}
+	if len(profile) > 0 && !bytes.HasSuffix(profile, []byte("\n")) {
+		profile = append(profile, '\n')
+	}
+	return slices.Concat(profile, block)
+}
+
+// persistSetx sets vars as user environment variables. Only processes
+// started afterwards see them, not the shell the proxy runs in.
+func persistSetx(vars []EnvVar) (string, error) {
+	if runtime.GOOS != "windows" {
+		return "", fmt.Errorf("setx is only available on Windows")
+	}
+	for _, v := range vars {
+		if out, err := setx(v.Key, v.Value); err != nil {
+			return "", fmt.Errorf("setx %s: %w: %s", v.Key, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return `the user environment (HKCU\Environment)`, nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package shell
+
+import "testing"
+
+func TestPersistSetxNeedsWindows(t *testing.T) {
+	prev := setx
+	setx = func(key, value string) ([]byte, error) {
+		t.Errorf("setx %s run off Windows", key)
+		return nil, nil
+	}
+	t.Cleanup(func() { setx = prev })
+
+	if _, err := Persist(PersistSetx, persistVars); err == nil {
+		t.Error("setx persisted off Windows")
+	}
+}
+
+func TestProcessAncestorsOffWindows(t *testing.T) {
+	if names, err := processAncestors(maxAncestors); err == nil || names != nil {
+		t.Errorf("got %v, %v; want an error", names, err)
+	}
+}
@@ -0,0 +1,94 @@
+package shell
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var persistVars = []EnvVar{{"ANTHROPIC_BASE_URL", "http://localhost:4141"}, {"ANTHROPIC_AUTH_TOKEN", "it's dummy"}}
+
+func TestProfileBlock(t *testing.T) {
+	want := profileBlockStart + "\n" +
+		"$env:ANTHROPIC_BASE_URL = 'http://localhost:4141'\n" +
+		"$env:ANTHROPIC_AUTH_TOKEN = 'it''s dummy'\n" +
+		profileBlockEnd + "\n"
+	if got := string(profileBlock(persistVars)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReplaceProfileBlock(t *testing.T) {
+	block := profileBlockStart + "\nnew\n" + profileBlockEnd + "\n"
+	old := profileBlockStart + "\nold\n" + profileBlockEnd
+	tests := []struct {
+		name, profile, want string
+	}{
+		{"empty", "", block},
+		{"appended", "Set-Alias ll ls\n", "Set-Alias ll ls\n" + block},
+		{"appended after a line without newline", "Set-Alias ll ls", "Set-Alias ll ls\n" + block},
+		{"replaced", "before\n" + old + "\nafter\n", "before\n" + block + "after\n"},
+		{"replaced at the end", "before\n" + old + "\n", "before\n" + block},
+		{"replaced without newline", "before\n" + old, "before\n" + block},
+		{"replaced in CRLF file", "before\r\n" + old + "\r\nafter\r\n", "before\r\n" + block + "after\r\n"},
+		{"end marker only", "x\n" + profileBlockEnd + "\n", "x\n" + profileBlockEnd + "\n" + block},
+	}
+	for _, tt := range tests {
+		if got := string(replaceProfileBlock([]byte(tt.profile), []byte(block))); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestPersistProfile writes the profile twice, as two --claude-code-persist
+// runs would: the second replaces the first's block.
+func TestPersistProfile(t *testing.T) {
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "Documents", "PowerShell", "Microsoft.PowerShell_profile.ps1")
+	var asked []string
+	prev := profilePath
+	profilePath = func(exe string) (string, error) {
+		asked = append(asked, exe)
+		return profile, nil
+	}
+	t.Cleanup(func() { profilePath = prev })
+	useAncestors(t, []string{"go.exe", "pwsh.exe"}, nil)
+
+	where, err := Persist(PersistProfile, persistVars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where != profile || len(asked) != 1 || asked[0] != "pwsh" {
+		t.Errorf("wrote %s after asking %v; want %s from pwsh", where, asked, profile)
+	}
+	if _, err := Persist(PersistProfile, []EnvVar{{"ANTHROPIC_BASE_URL", "http://localhost:5000"}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	if strings.Count(got, profileBlockStart) != 1 || !strings.Contains(got, "localhost:5000") || strings.Contains(got, "localhost:4141") {
+		t.Errorf("profile after two runs:\n%s", got)
+	}
+}
+
+func TestPersistProfileLookupFails(t *testing.T) {
+	prev := profilePath
+	profilePath = func(exe string) (string, error) { return "", errors.New("finding the powershell profile: not found") }
+	t.Cleanup(func() { profilePath = prev })
+	useAncestors(t, nil, errors.New("no snapshot"))
+
+	if _, err := Persist(PersistProfile, persistVars); err == nil || !strings.Contains(err.Error(), "profile") {
+		t.Errorf("got %v, want the lookup error", err)
+	}
+}
+
+func TestPersistInvalidMode(t *testing.T) {
+	if _, err := Persist("registry", persistVars); err == nil || !strings.Contains(err.Error(), "profile or setx") {
+		t.Errorf("got %v, want an invalid mode error", err)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build windows
+
+package shell
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPersistSetx(t *testing.T) {
+	var set []string
+	prev := setx
+	setx = func(key, value string) ([]byte, error) {
+		set = append(set, key+"="+value)
+		return []byte("SUCCESS: Specified value was saved."), nil
+	}
+	t.Cleanup(func() { setx = prev })
+
+	where, err := Persist(PersistSetx, persistVars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ANTHROPIC_BASE_URL=http://localhost:4141", "ANTHROPIC_AUTH_TOKEN=it's dummy"}
+	if !slices.Equal(set, want) || !strings.Contains(where, "HKCU") {
+		t.Errorf("set %v in %s, want %v in the user environment", set, where, want)
+	}
+}
+
+func TestPersistSetxFails(t *testing.T) {
+	prev := setx
+	setx = func(key, value string) ([]byte, error) {
+		return []byte("ERROR: Access to the registry path is denied."), errors.New("exit status 1")
+	}
+	t.Cleanup(func() { setx = prev })
+
+	if _, err := Persist(PersistSetx, persistVars); err == nil || !strings.Contains(err.Error(), "registry path is denied") {
+		t.Errorf("got %v, want setx's output in the error", err)
+	}
+}
+
+// TestProcessAncestors reads the real process tree: the test binary's
+// parent is go test (or whatever ran it).
+func TestProcessAncestors(t *testing.T) {
+	names, err := processAncestors(maxAncestors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 || len(names) > maxAncestors {
+		t.Fatalf("got %d ancestors: %v", len(names), names)
+	}
+	for _, name := range names {
+		if name == "" {
+			t.Errorf("empty process name in %v", names)
+		}
+	}
+	if names, err := processAncestors(1); err != nil || len(names) != 1 {
+		t.Errorf("limit 1: got %v, %v", names, err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package shell
+
+import "errors"
+
+// processAncestors is only needed on Windows, where there's no SHELL.
+func processAncestors(limit int) ([]string, error) {
+	return nil, errors.New("process ancestry is only looked up on Windows")
+}
@@ -0,0 +1,54 @@
+//go:build windows
+
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// processAncestors returns the executable names of this process's parent,
+// its parent, and so on, at most limit of them. It reads a Toolhelp32
+// snapshot of the process list, which unlike wmic is in every Windows
+// version.
+func processAncestors(limit int) ([]string, error) {
+	snap, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("process snapshot: %w", err)
+	}
+	defer syscall.CloseHandle(snap)
+
+	type process struct {
+		parent uint32
+		name   string
+	}
+	procs := make(map[uint32]process)
+	var entry syscall.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	for err = syscall.Process32First(snap, &entry); err == nil; err = syscall.Process32Next(snap, &entry) {
+		procs[entry.ProcessID] = process{entry.ParentProcessID, syscall.UTF16ToString(entry.ExeFile[:])}
+	}
+	if !errors.Is(err, syscall.ERROR_NO_MORE_FILES) {
+		return nil, fmt.Errorf("listing processes: %w", err)
+	}
+
+	var names []string
+	for pid := uint32(os.Getppid()); len(names) < limit; {
+		p, ok := procs[pid]
+		if !ok {
+			break
+		}
+		names = append(names, p.name)
+		if p.parent == 0 || p.parent == pid {
+			break
+		}
+		pid = p.parent
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("parent process %d not in the process list", os.Getppid())
+	}
+	return names, nil
+}
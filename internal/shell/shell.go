@@ -2,8 +2,8 @@ package shell
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
 	"runtime"
 	"strings"
 )
@@ -46,23 +46,19 @@ func detectUnix() ShellType {
 	}
 }
 
+// maxAncestors bounds how far up the process tree detectWindows looks.
+const maxAncestors = 8
+
 func detectWindows() ShellType {
-	// Try to detect parent process via wmic
-	ppid := os.Getppid()
-	out, err := exec.Command("wmic", "process", "where",
-		fmt.Sprintf("ProcessId=%d", ppid),
-		"get", "Name", "/value").Output()
-	if err == nil {
-		name := strings.ToLower(string(out))
-		switch {
-		case strings.Contains(name, "powershell") || strings.Contains(name, "pwsh"):
-			return PowerShell
-		case strings.Contains(name, "cmd"):
-			return Cmd
-		case strings.Contains(name, "bash"):
-			return Bash
-		case strings.Contains(name, "zsh"):
-			return Zsh
+	// The nearest ancestor that's a shell; go run, winpty and the like
+	// can sit in between
+	names, err := ancestors(maxAncestors)
+	if err != nil {
+		slog.Debug("parent process lookup failed, guessing the shell", "error", err)
+	}
+	for _, name := range names {
+		if t, ok := shellFromProcess(name); ok {
+			return t
 		}
 	}
 
@@ -74,6 +70,30 @@ func detectWindows() ShellType {
 	return Cmd
 }
 
+// shellFromProcess maps an executable name like "pwsh.exe" to its shell.
+func shellFromProcess(name string) (ShellType, bool) {
+	switch processBaseName(name) {
+	case "powershell", "pwsh":
+		return PowerShell, true
+	case "cmd":
+		return Cmd, true
+	case "bash":
+		return Bash, true
+	case "zsh":
+		return Zsh, true
+	case "fish":
+		return Fish, true
+	}
+	return "", false
+}
+
+// processBaseName lowercases an executable name and drops its directory
+// (either separator) and .exe.
+func processBaseName(name string) string {
+	name = name[strings.LastIndexAny(name, `\/`)+1:]
+	return strings.TrimSuffix(strings.ToLower(name), ".exe")
+}
+
 // EnvVar represents a key-value environment variable.
 type EnvVar struct {
 	Key   string
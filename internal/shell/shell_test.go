@@ -0,0 +1,97 @@
+package shell
+
+import (
+	"errors"
+	"testing"
+)
+
+// useAncestors makes the process tree lookup return names and err for
+// the rest of the test.
+func useAncestors(t *testing.T, names []string, err error) {
+	t.Helper()
+	prev := ancestors
+	ancestors = func(limit int) ([]string, error) {
+		if len(names) > limit {
+			return names[:limit], err
+		}
+		return names, err
+	}
+	t.Cleanup(func() { ancestors = prev })
+}
+
+func TestShellFromProcess(t *testing.T) {
+	tests := []struct {
+		name string
+		want ShellType
+		ok   bool
+	}{
+		{"pwsh.exe", PowerShell, true},
+		{"PowerShell.EXE", PowerShell, true},
+		{`C:\Program Files\PowerShell\7\pwsh.exe`, PowerShell, true},
+		{"cmd.exe", Cmd, true},
+		{"bash.exe", Bash, true},
+		{"/usr/bin/zsh", Zsh, true},
+		{"fish", Fish, true},
+		{"go.exe", "", false},
+		{"winpty-agent.exe", "", false},
+		{"WindowsTerminal.exe", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := shellFromProcess(tt.name); got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestDetectWindows covers detection from the process tree, without
+// wmic, and the fallback when the lookup fails or finds no shell.
+func TestDetectWindows(t *testing.T) {
+	lookupFailed := errors.New("CreateToolhelp32Snapshot: access denied")
+	tests := []struct {
+		name         string
+		ancestors    []string
+		err          error
+		psModulePath string
+		want         ShellType
+	}{
+		{"parent is the shell", []string{"pwsh.exe", "WindowsTerminal.exe", "explorer.exe"}, nil, "", PowerShell},
+		{"shell behind go run", []string{"go.exe", "cmd.exe", "explorer.exe"}, nil, `C:\ps`, Cmd},
+		{"shell behind winpty", []string{"winpty-agent.exe", "winpty.exe", "bash.exe", "mintty.exe"}, nil, "", Bash},
+		{"nearest shell wins", []string{"bash.exe", "pwsh.exe"}, nil, "", Bash},
+		{"shell past the limit", []string{"a.exe", "b.exe", "c.exe", "d.exe", "e.exe", "f.exe", "g.exe", "h.exe", "pwsh.exe"}, nil, "", Cmd},
+		{"no shell, PowerShell env", []string{"go.exe", "explorer.exe"}, nil, `C:\ps`, PowerShell},
+		{"no shell", []string{"go.exe", "services.exe"}, nil, "", Cmd},
+		{"lookup failed, PowerShell env", nil, lookupFailed, `C:\ps`, PowerShell},
+		{"lookup failed", nil, lookupFailed, "", Cmd},
+		{"partial lookup", []string{"pwsh.exe"}, lookupFailed, "", PowerShell},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useAncestors(t, tt.ancestors, tt.err)
+			t.Setenv("PSModulePath", tt.psModulePath)
+			if got := detectWindows(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateExportScript(t *testing.T) {
+	vars := []EnvVar{{"ANTHROPIC_BASE_URL", "http://localhost:4141"}, {"ANTHROPIC_MODEL", "gpt-4.1"}}
+	tests := []struct {
+		shell ShellType
+		want  string
+	}{
+		{PowerShell, `$env:ANTHROPIC_BASE_URL = "http://localhost:4141"; $env:ANTHROPIC_MODEL = "gpt-4.1"; claude`},
+		{Cmd, `set ANTHROPIC_BASE_URL=http://localhost:4141 & set ANTHROPIC_MODEL=gpt-4.1 & claude`},
+		{Fish, `set -gx ANTHROPIC_BASE_URL http://localhost:4141; set -gx ANTHROPIC_MODEL gpt-4.1; claude`},
+		{Bash, `export ANTHROPIC_BASE_URL="http://localhost:4141" ANTHROPIC_MODEL="gpt-4.1" && claude`},
+		{Zsh, `export ANTHROPIC_BASE_URL="http://localhost:4141" ANTHROPIC_MODEL="gpt-4.1" && claude`},
+	}
+	for _, tt := range tests {
+		if got := GenerateExportScript(tt.shell, vars, "claude"); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.shell, got, tt.want)
+		}
+	}
+}
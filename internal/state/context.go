@@ -0,0 +1,39 @@
+package state
+
+import "context"
+
+type stateKey struct{}
+
+type metricsKey struct{}
+
+// WithState returns a context whose request is served by the proxy
+// instance with state s.
+func WithState(ctx context.Context, s *State) context.Context {
+	return context.WithValue(ctx, stateKey{}, s)
+}
+
+// FromContext returns the state of the proxy instance serving ctx's
+// request. A context without one is a wiring bug, so it panics rather
+// than serve the request with another instance's account.
+func FromContext(ctx context.Context) *State {
+	s, ok := ctx.Value(stateKey{}).(*State)
+	if !ok {
+		panic("state: context carries no proxy instance state")
+	}
+	return s
+}
+
+// WithMetrics returns a context whose request records to m.
+func WithMetrics(ctx context.Context, m *MetricsStore) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// MetricsFromContext returns the metrics store of the proxy instance
+// serving ctx's request. Like FromContext, it panics without one.
+func MetricsFromContext(ctx context.Context) *MetricsStore {
+	m, ok := ctx.Value(metricsKey{}).(*MetricsStore)
+	if !ok {
+		panic("state: context carries no proxy instance metrics")
+	}
+	return m
+}
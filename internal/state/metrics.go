@@ -1,12 +1,18 @@
 package state
 
 import (
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 // RequestRecord holds per-request metrics.
 type RequestRecord struct {
+	RequestID   string    `json:"request_id,omitempty"`
+	Instance    string    `json:"instance,omitempty"` // proxy instance that served it; set with shared metrics
 	Timestamp   time.Time `json:"timestamp"`
 	Endpoint    string    `json:"endpoint"`    // messages, chat_completions, responses
 	Model       string    `json:"model"`       // original model requested
@@ -14,14 +20,34 @@ type RequestRecord struct {
 	Backend     string    `json:"backend"`     // messages, responses, chat_completions
 	RequestType string    `json:"request_type"` // normal, compact, warmup
 	Initiator   string    `json:"initiator"`   // user, agent
+	InitiatorOverride string `json:"initiator_override,omitempty"` // header, key_default; empty when heuristic
+	BackendOverride   string `json:"backend_override,omitempty"`   // header, query: Backend forced with X-Backend/?backend= (debug.allowBackendOverride)
+	ExtraPromptOverride     string `json:"extra_prompt_override,omitempty"`     // X-Extra-Prompt preset or "none"
+	ReasoningEffortOverride string `json:"reasoning_effort_override,omitempty"` // X-Reasoning-Effort
 	HasVision   bool      `json:"has_vision"`
 	Streaming   bool      `json:"streaming"`
+	N           int       `json:"n,omitempty"` // choices served by fan-out; omitted for a single choice
 	ToolCount   int       `json:"tool_count"`
+	TrimmedTools []string `json:"trimmed_tools,omitempty"` // tools summarized by maxTools/maxToolSchemaTokens
 	ThinkingBudget int   `json:"thinking_budget"`
 	InputTokens  int64   `json:"input_tokens"`
 	OutputTokens int64   `json:"output_tokens"`
 	CachedTokens int64   `json:"cached_tokens"`
 	StopReason  string    `json:"stop_reason"`
+	AbortedOutputCap bool `json:"aborted_output_cap,omitempty"` // stream cut off by the output token cap
+	Salvaged    bool      `json:"salvaged,omitempty"` // failed stream ended as end_turn (salvagePartialStreams); Error says why
+	Timeout     bool      `json:"timeout,omitempty"` // upstream request ran out of its configured timeout
+	Canceled    bool      `json:"canceled,omitempty"` // canceled with POST /api/requests/{id}/cancel
+	ClientDisconnected bool `json:"client_disconnected,omitempty"` // streaming client went away; the upstream request was canceled
+	UpstreamConn   string `json:"upstream_conn,omitempty"`    // reused, new; empty without an upstream request
+	UpstreamRequestID string `json:"upstream_request_id,omitempty"` // request ID of Copilot's response
+	ServedBy    string    `json:"served_by,omitempty"` // alternate upstream that answered during failover; empty for Copilot
+	UpstreamRateLimit map[string]string `json:"upstream_rate_limit,omitempty"` // x-ratelimit-* headers of Copilot's response, without the prefix
+	TLSHandshakeMs int64  `json:"tls_handshake_ms,omitempty"` // new connections only
+	TTFBMs         int64  `json:"ttfb_ms,omitempty"`          // connection request to first response byte
+	Cached      bool      `json:"cached,omitempty"` // served from the response cache; no tokens used
+	PremiumCost float64   `json:"premium_cost,omitempty"` // premium requests consumed, as computed by the premium cost function
+	Chaos       string    `json:"chaos,omitempty"` // X-Chaos directive applied by start --chaos
 	LatencyMs   int64     `json:"latency_ms"`
 	StatusCode  int       `json:"status_code"`
 	Error       string    `json:"error,omitempty"`
@@ -31,11 +57,14 @@ type RequestRecord struct {
 type ClaudeMDFile struct {
 	Path    string `json:"path"`
 	Content string `json:"content"`
+	Bytes   int    `json:"bytes"`
+	Tokens  int    `json:"tokens"` // estimated
 }
 
 // SessionSnapshot holds session data updated on each Messages request.
 type SessionSnapshot struct {
 	ClaudeMDFiles   []ClaudeMDFile `json:"claude_md_files"`
+	MemoryTokens    int            `json:"memory_tokens"` // estimated total of ClaudeMDFiles
 	Tools           []string       `json:"tools"`
 	MCPTools        []string       `json:"mcp_tools"`
 	ThinkingEnabled bool           `json:"thinking_enabled"`
@@ -63,6 +92,27 @@ type Aggregates struct {
 	ModelCounts       map[string]int64 `json:"model_counts"`
 	BackendCounts     map[string]int64 `json:"backend_counts"`
 	TypeCounts        map[string]int64 `json:"type_counts"`
+	TrimmedToolRequests int64          `json:"trimmed_tool_requests"`
+	DedupHits         map[string]int64 `json:"dedup_hits"` // requests that shared an in-flight call, by endpoint
+	CacheHits         map[string]int64 `json:"cache_hits"` // requests served from a result cache, by endpoint
+	HedgedRequests    int64            `json:"hedged_requests"`       // duplicate upstream requests sent by hedging
+	HedgeWins         int64            `json:"hedge_wins"`            // hedges that answered first
+	WastedHedgeRequests int64          `json:"wasted_hedge_requests"` // requests canceled after the other one won
+	ResizedImages     int64            `json:"resized_images"`        // images downscaled or re-encoded by imageProcessing
+	HookRuns          map[string]int64 `json:"hook_runs"`             // pre-request hook runs, by hook path
+	HookFailures      map[string]int64 `json:"hook_failures"`         // runs that rejected or failed the request, by hook path
+	HookMs            map[string]int64 `json:"hook_ms"`               // total run time, by hook path
+	Filtered          map[string]int64 `json:"filtered"`              // responses stopped by the content filter, by model
+	FallbackRequests  map[string]int64 `json:"fallback_requests"`     // requests served by an alternate upstream, by upstream name
+	FallbackErrors    map[string]int64 `json:"fallback_errors"`       // of those, the ones that failed
+	ChaosRequests     map[string]int64 `json:"chaos_requests"`        // requests with failures injected by start --chaos, by endpoint
+	PremiumByDay      map[string]int64 `json:"premium_by_day"`        // premium requests consumed in thousandths, by local day (YYYY-MM-DD)
+	ConnReused        int64            `json:"conn_reused"`           // upstream requests on a reused connection
+	ConnNew           int64            `json:"conn_new"`              // upstream requests that opened a connection
+	TLSHandshakeMs    int64            `json:"tls_handshake_ms"`      // total over new connections
+	TTFBMs            int64            `json:"ttfb_ms"`               // total over ConnReused+ConnNew requests
+	// StartTime is the metrics epoch: when the counters started, which
+	// with shared metrics is before this process started.
 	StartTime         time.Time        `json:"start_time"`
 }
 
@@ -75,32 +125,107 @@ type MetricsSnapshot struct {
 
 const ringBufferSize = 200
 
-// metricsStore is the in-memory metrics store.
-type metricsStore struct {
+// MetricsStore is an in-memory metrics store.
+type MetricsStore struct {
 	mu        sync.RWMutex
 	agg       Aggregates
 	session   SessionSnapshot
 	ring      []RequestRecord
 	ringPos   int
 	ringCount int
+	hooks     []func(RequestRecord)
+	premiumCost func(RequestRecord) float64
+	shared    SharedMetrics
+	instance  string
 }
 
-// Metrics is the singleton metrics store instance.
-var Metrics = &metricsStore{
-	agg: Aggregates{
+// SharedMetrics aggregates metrics across proxy instances (see
+// internal/coord). Counters are named by Aggregates JSON field, with
+// "field:key" for map fields.
+type SharedMetrics interface {
+	// Add applies counter increments and, when rec is not nil, adds it to
+	// this instance's recent request feed.
+	Add(counts map[string]int64, rec *RequestRecord) error
+	// Load returns the shared counters and the recent requests of every
+	// instance. The counts include MetricsEpochCounter once Add has run.
+	Load() (counts map[string]int64, recent []RequestRecord, err error)
+}
+
+// MetricsEpochCounter is the shared counter holding the Unix time the
+// shared counters started; Add sets it only if it isn't set yet.
+const MetricsEpochCounter = "metrics_epoch"
+
+// processStart is when this process started.
+var processStart = time.Now()
+
+// ProcessStart returns when this process started, for uptime. The metrics
+// epoch, Aggregates.StartTime, differs with shared metrics.
+func ProcessStart() time.Time {
+	return processStart
+}
+
+// Metrics is the metrics store of the CLI's proxy instance.
+var Metrics = NewMetrics()
+
+// NewMetrics returns an empty metrics store, for a proxy instance of its
+// own (see the proxy package).
+func NewMetrics() *MetricsStore {
+	return &MetricsStore{
+		agg:  newAggregates(time.Now()),
+		ring: make([]RequestRecord, ringBufferSize),
+	}
+}
+
+func newAggregates(start time.Time) Aggregates {
+	return Aggregates{
 		ModelCounts:   make(map[string]int64),
 		BackendCounts: make(map[string]int64),
 		TypeCounts:    make(map[string]int64),
-		StartTime:     time.Now(),
-	},
-	ring: make([]RequestRecord, ringBufferSize),
+		DedupHits:     make(map[string]int64),
+		CacheHits:     make(map[string]int64),
+		Filtered:      make(map[string]int64),
+		HookRuns:      make(map[string]int64),
+		HookFailures:  make(map[string]int64),
+		HookMs:        make(map[string]int64),
+		FallbackRequests: make(map[string]int64),
+		FallbackErrors:   make(map[string]int64),
+		ChaosRequests:    make(map[string]int64),
+		PremiumByDay:     make(map[string]int64),
+		StartTime:     start,
+	}
+}
+
+// SetShared mirrors every count and record to shared, which then answers
+// Snapshot. Instance names this process in the shared recent feed. While
+// shared fails, Snapshot falls back to this process's own metrics.
+func (m *MetricsStore) SetShared(shared SharedMetrics, instance string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shared = shared
+	m.instance = instance
+}
+
+// SetPremiumCost sets the function computing how many premium requests a
+// recorded request consumed (see service.PremiumCost); the state package
+// can't read the config it depends on.
+func (m *MetricsStore) SetPremiumCost(fn func(RequestRecord) float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.premiumCost = fn
 }
 
 // RecordRequest appends a record to the ring buffer and updates aggregates.
-func (m *metricsStore) RecordRequest(rec RequestRecord) {
+func (m *MetricsStore) RecordRequest(rec RequestRecord) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.shared != nil {
+		rec.Instance = m.instance
+	}
+	if m.premiumCost != nil {
+		rec.PremiumCost = m.premiumCost(rec)
+	}
+
 	// Append to ring buffer
 	m.ring[m.ringPos] = rec
 	m.ringPos = (m.ringPos + 1) % ringBufferSize
@@ -109,34 +234,248 @@ func (m *metricsStore) RecordRequest(rec RequestRecord) {
 	}
 
 	// Update aggregates
-	m.agg.TotalRequests++
-	m.agg.TotalInputTokens += rec.InputTokens
-	m.agg.TotalOutputTokens += rec.OutputTokens
-	m.agg.TotalCachedTokens += rec.CachedTokens
+	counts := map[string]int64{
+		"total_requests":      1,
+		"total_input_tokens":  rec.InputTokens,
+		"total_output_tokens": rec.OutputTokens,
+		"total_cached_tokens": rec.CachedTokens,
+	}
 
 	model := rec.RoutedModel
 	if model == "" {
 		model = rec.Model
 	}
-	m.agg.ModelCounts[model]++
+	counts["model_counts:"+model] = 1
 
 	if rec.Backend != "" {
-		m.agg.BackendCounts[rec.Backend]++
+		counts["backend_counts:"+rec.Backend] = 1
 	}
 	if rec.RequestType != "" {
-		m.agg.TypeCounts[rec.RequestType]++
+		counts["type_counts:"+rec.RequestType] = 1
+	}
+	if len(rec.TrimmedTools) > 0 {
+		counts["trimmed_tool_requests"] = 1
+	}
+	if rec.Cached {
+		counts["cache_hits:"+rec.Endpoint] = 1
+	}
+	if rec.ServedBy != "" {
+		counts["fallback_requests:"+rec.ServedBy] = 1
+		if rec.StatusCode >= 400 {
+			counts["fallback_errors:"+rec.ServedBy] = 1
+		}
+	}
+	if rec.Chaos != "" {
+		counts["chaos_requests:"+rec.Endpoint] = 1
+	}
+	if rec.StopReason == "refusal" {
+		counts["filtered:"+model] = 1
+	}
+	if rec.PremiumCost > 0 {
+		counts["premium_by_day:"+rec.Timestamp.Local().Format(time.DateOnly)] = int64(math.Round(rec.PremiumCost * 1000))
+	}
+	switch rec.UpstreamConn {
+	case "reused":
+		counts["conn_reused"] = 1
+	case "new":
+		counts["conn_new"] = 1
+		counts["tls_handshake_ms"] = rec.TLSHandshakeMs
+	}
+	if rec.UpstreamConn != "" {
+		counts["ttfb_ms"] = rec.TTFBMs
+	}
+	m.count(counts, &rec)
+
+	for _, fn := range m.hooks {
+		fn(rec)
+	}
+}
+
+// count applies counts to the aggregates and mirrors them, with rec if
+// not nil, to the shared store. The caller holds m.mu.
+func (m *MetricsStore) count(counts map[string]int64, rec *RequestRecord) {
+	for name, n := range counts {
+		m.agg.add(name, n)
+	}
+	if m.shared != nil {
+		// Not under the lock: the shared store is remote
+		go func(shared SharedMetrics) {
+			if err := shared.Add(counts, rec); err != nil {
+				slog.Debug("shared metrics not updated", "error", err)
+			}
+		}(m.shared)
 	}
 }
 
+// add increments the counter name: an Aggregates JSON field, or
+// "field:key" for map fields. Unknown names are ignored.
+func (a *Aggregates) add(name string, n int64) {
+	field, key, isMap := strings.Cut(name, ":")
+	if isMap {
+		var counts map[string]int64
+		switch field {
+		case "model_counts":
+			counts = a.ModelCounts
+		case "backend_counts":
+			counts = a.BackendCounts
+		case "type_counts":
+			counts = a.TypeCounts
+		case "dedup_hits":
+			counts = a.DedupHits
+		case "cache_hits":
+			counts = a.CacheHits
+		case "filtered":
+			counts = a.Filtered
+		case "hook_runs":
+			counts = a.HookRuns
+		case "hook_failures":
+			counts = a.HookFailures
+		case "hook_ms":
+			counts = a.HookMs
+		case "fallback_requests":
+			counts = a.FallbackRequests
+		case "fallback_errors":
+			counts = a.FallbackErrors
+		case "chaos_requests":
+			counts = a.ChaosRequests
+		case "premium_by_day":
+			counts = a.PremiumByDay
+		}
+		if counts != nil {
+			counts[key] += n
+		}
+		return
+	}
+	var counter *int64
+	switch field {
+	case "total_requests":
+		counter = &a.TotalRequests
+	case "total_input_tokens":
+		counter = &a.TotalInputTokens
+	case "total_output_tokens":
+		counter = &a.TotalOutputTokens
+	case "total_cached_tokens":
+		counter = &a.TotalCachedTokens
+	case "trimmed_tool_requests":
+		counter = &a.TrimmedToolRequests
+	case "hedged_requests":
+		counter = &a.HedgedRequests
+	case "hedge_wins":
+		counter = &a.HedgeWins
+	case "wasted_hedge_requests":
+		counter = &a.WastedHedgeRequests
+	case "resized_images":
+		counter = &a.ResizedImages
+	case "conn_reused":
+		counter = &a.ConnReused
+	case "conn_new":
+		counter = &a.ConnNew
+	case "tls_handshake_ms":
+		counter = &a.TLSHandshakeMs
+	case "ttfb_ms":
+		counter = &a.TTFBMs
+	}
+	if counter != nil {
+		*counter += n
+	}
+}
+
+// OnRecord registers fn to be called with every recorded request. It runs
+// with the store locked and must not call back into Metrics.
+func (m *MetricsStore) OnRecord(fn func(RequestRecord)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, fn)
+}
+
+// RecordDedupHit counts a request answered without its own upstream call,
+// either by sharing an identical in-flight request or from the cache.
+func (m *MetricsStore) RecordDedupHit(endpoint string, cached bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cached {
+		m.count(map[string]int64{"cache_hits:" + endpoint: 1}, nil)
+	} else {
+		m.count(map[string]int64{"dedup_hits:" + endpoint: 1}, nil)
+	}
+}
+
+// RecordHedge counts a hedged upstream request: won when the duplicate
+// answered first, wasted when the losing request was canceled in flight.
+func (m *MetricsStore) RecordHedge(won, wasted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := map[string]int64{"hedged_requests": 1}
+	if won {
+		counts["hedge_wins"] = 1
+	}
+	if wasted {
+		counts["wasted_hedge_requests"] = 1
+	}
+	m.count(counts, nil)
+}
+
+// RecordImageResize counts an image downscaled or re-encoded before it was
+// sent upstream.
+func (m *MetricsStore) RecordImageResize() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.count(map[string]int64{"resized_images": 1}, nil)
+}
+
+// RecordHook counts a run of the pre-request hook at path and its
+// latency.
+func (m *MetricsStore) RecordHook(path string, d time.Duration, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := map[string]int64{"hook_runs:" + path: 1, "hook_ms:" + path: d.Milliseconds()}
+	if failed {
+		counts["hook_failures:"+path] = 1
+	}
+	m.count(counts, nil)
+}
+
 // UpdateSession updates the session snapshot.
-func (m *metricsStore) UpdateSession(snap SessionSnapshot) {
+func (m *MetricsStore) UpdateSession(snap SessionSnapshot) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.session = snap
 }
 
-// Snapshot returns a read-consistent copy of all metrics.
-func (m *metricsStore) Snapshot() MetricsSnapshot {
+// Snapshot returns a read-consistent copy of all metrics. With a shared
+// store, aggregates and recent requests cover every instance and the
+// start time is the shared metrics epoch; the session is this instance's.
+func (m *MetricsStore) Snapshot() MetricsSnapshot {
+	snap := m.localSnapshot()
+	m.mu.RLock()
+	shared := m.shared
+	m.mu.RUnlock()
+	if shared == nil {
+		return snap
+	}
+	counts, recent, err := shared.Load()
+	if err != nil {
+		slog.Debug("shared metrics unavailable, using local", "error", err)
+		return snap
+	}
+	agg := newAggregates(snap.Aggregates.StartTime)
+	if epoch, ok := counts[MetricsEpochCounter]; ok {
+		delete(counts, MetricsEpochCounter)
+		agg.StartTime = time.Unix(epoch, 0)
+	}
+	for name, n := range counts {
+		agg.add(name, n)
+	}
+	sort.SliceStable(recent, func(i, j int) bool { return recent[i].Timestamp.After(recent[j].Timestamp) })
+	if len(recent) > ringBufferSize {
+		recent = recent[:ringBufferSize]
+	}
+	snap.Aggregates = agg
+	snap.Recent = recent
+	return snap
+}
+
+func (m *MetricsStore) localSnapshot() MetricsSnapshot {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -145,6 +484,16 @@ func (m *metricsStore) Snapshot() MetricsSnapshot {
 	agg.ModelCounts = copyMap(m.agg.ModelCounts)
 	agg.BackendCounts = copyMap(m.agg.BackendCounts)
 	agg.TypeCounts = copyMap(m.agg.TypeCounts)
+	agg.DedupHits = copyMap(m.agg.DedupHits)
+	agg.CacheHits = copyMap(m.agg.CacheHits)
+	agg.Filtered = copyMap(m.agg.Filtered)
+	agg.HookRuns = copyMap(m.agg.HookRuns)
+	agg.HookFailures = copyMap(m.agg.HookFailures)
+	agg.HookMs = copyMap(m.agg.HookMs)
+	agg.FallbackRequests = copyMap(m.agg.FallbackRequests)
+	agg.FallbackErrors = copyMap(m.agg.FallbackErrors)
+	agg.ChaosRequests = copyMap(m.agg.ChaosRequests)
+	agg.PremiumByDay = copyMap(m.agg.PremiumByDay)
 
 	// Copy session
 	session := m.session
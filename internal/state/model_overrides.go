@@ -0,0 +1,97 @@
+package state
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// SetModelOverrides sets the modelOverrides config section: per model ID,
+// a JSON object SetModels deep-merges onto the model as Copilot lists it.
+// Call it before SetModels; models already set aren't patched.
+func (s *State) SetModelOverrides(overrides map[string]json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modelOverrides = overrides
+}
+
+// applyModelOverrides returns models with overrides merged on, setting
+// Overridden on each patched model, and logs what it changed. Objects
+// are merged key by key; arrays and other values replace the listed one.
+func applyModelOverrides(models []Model, overrides map[string]json.RawMessage) []Model {
+	if len(overrides) == 0 {
+		return models
+	}
+	out := make([]Model, len(models))
+	copy(out, models)
+	matched := make(map[string]bool, len(overrides))
+	for i := range out {
+		raw, ok := overrides[out[i].ID]
+		if !ok {
+			continue
+		}
+		matched[out[i].ID] = true
+		m, fields, err := overrideModel(out[i], raw)
+		if err != nil {
+			slog.Warn("ignoring modelOverrides entry", "model", out[i].ID, "error", err)
+			continue
+		}
+		out[i] = m
+		slog.Info("model metadata overridden", "model", m.ID, "fields", strings.Join(fields, ", "))
+	}
+	for id := range overrides {
+		if !matched[id] {
+			slog.Warn("modelOverrides entry matches no model", "model", id)
+		}
+	}
+	return out
+}
+
+// overrideModel merges the override object raw onto m, returning the
+// patched model and the dotted paths of the fields it set.
+func overrideModel(m Model, raw json.RawMessage) (Model, []string, error) {
+	var patch map[string]any
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return m, nil, err
+	}
+	delete(patch, "id") // the key the override was found by
+
+	listed, err := json.Marshal(m)
+	if err != nil {
+		return m, nil, err
+	}
+	var merged map[string]any
+	if err := json.Unmarshal(listed, &merged); err != nil {
+		return m, nil, err
+	}
+	var fields []string
+	mergeJSON(merged, patch, "", &fields)
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return m, nil, err
+	}
+	var out Model
+	if err := json.Unmarshal(b, &out); err != nil {
+		return m, nil, err
+	}
+	sort.Strings(fields)
+	out.Overridden = fields
+	return out, fields, nil
+}
+
+// mergeJSON merges patch into dst, appending the path of every value
+// it sets to fields.
+func mergeJSON(dst, patch map[string]any, prefix string, fields *[]string) {
+	for k, v := range patch {
+		path := prefix + k
+		if po, ok := v.(map[string]any); ok {
+			if do, ok := dst[k].(map[string]any); ok {
+				mergeJSON(do, po, path+".", fields)
+				continue
+			}
+		}
+		dst[k] = v
+		*fields = append(*fields, path)
+	}
+}
@@ -0,0 +1,292 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+const appName = "copilot-proxy-go"
+
+// DataDirEnv overrides the app directory, like the --data-dir flag.
+const DataDirEnv = "COPILOT_PROXY_DATA_DIR"
+
+// ConfigEnv overrides the config file, like the --config flag.
+const ConfigEnv = "COPILOT_PROXY_CONFIG"
+
+// PathCandidate is one step in the app directory resolution chain.
+type PathCandidate struct {
+	Source string `json:"source"` // e.g. "--data-dir", "XDG_DATA_HOME", "legacy"
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+	Chosen bool   `json:"chosen"`
+}
+
+var (
+	pathMu      sync.Mutex
+	dataDirFlag string
+	configFlag  string
+	resolved    []PathCandidate
+)
+
+// SetDataDir sets the app directory from the --data-dir flag. It takes
+// precedence over every other source. Must be called before any path lookup.
+func SetDataDir(dir string) {
+	pathMu.Lock()
+	defer pathMu.Unlock()
+	dataDirFlag = dir
+	resolved = nil
+}
+
+// SetConfigPath sets the config file from the --config flag, in place of
+// config.json in the app directory. It takes precedence over
+// $COPILOT_PROXY_CONFIG. Must be called before the config is loaded.
+func SetConfigPath(path string) {
+	pathMu.Lock()
+	defer pathMu.Unlock()
+	configFlag = path
+}
+
+// AppDir returns the directory holding the token, config, and logs.
+//
+// Resolution order: --data-dir, $COPILOT_PROXY_DATA_DIR, then the platform
+// default ($XDG_DATA_HOME or ~/.local/share on Linux, os.UserConfigDir() on
+// macOS and Windows). If the platform default does not exist yet but a
+// legacy directory from an older release does, the legacy one is reused.
+func AppDir() string {
+	for _, c := range ResolveAppDir() {
+		if c.Chosen {
+			return c.Path
+		}
+	}
+	return ""
+}
+
+// ResolveAppDir returns the full resolution chain with the chosen entry
+// marked, for diagnostics.
+func ResolveAppDir() []PathCandidate {
+	pathMu.Lock()
+	defer pathMu.Unlock()
+	if resolved == nil {
+		resolved = resolveAppDir()
+	}
+	return resolved
+}
+
+func resolveAppDir() []PathCandidate {
+	var chain []PathCandidate
+	add := func(source, path string) {
+		if path == "" {
+			return
+		}
+		_, err := os.Stat(path)
+		chain = append(chain, PathCandidate{Source: source, Path: path, Exists: err == nil})
+	}
+
+	add("--data-dir", dataDirFlag)
+	add(DataDirEnv, os.Getenv(DataDirEnv))
+	explicit := len(chain)
+
+	defaultSource, defaultPath := platformDir()
+	add(defaultSource, defaultPath)
+	for _, legacy := range legacyDirs(defaultPath) {
+		add("legacy", legacy)
+	}
+
+	// Prefer an explicit or platform default dir; fall back to an existing
+	// legacy dir only when the default has never been created.
+	chosen := 0
+	if explicit == 0 && !chain[0].Exists {
+		for i := 1; i < len(chain); i++ {
+			if chain[i].Exists {
+				chosen = i
+				break
+			}
+		}
+	}
+	chain[chosen].Chosen = true
+	return chain
+}
+
+// platformDir returns the default app directory and where it came from.
+func platformDir() (source, path string) {
+	home, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		if dir, err := os.UserConfigDir(); err == nil {
+			return "os.UserConfigDir", filepath.Join(dir, appName)
+		}
+		return "home", filepath.Join(home, appName)
+	default: // linux and others
+		if xdg := os.Getenv("XDG_DATA_HOME"); xdg != "" {
+			return "XDG_DATA_HOME", filepath.Join(xdg, appName)
+		}
+		return "~/.local/share", filepath.Join(home, ".local", "share", appName)
+	}
+}
+
+// legacyDirs lists directories used by earlier releases, excluding current.
+func legacyDirs(current string) []string {
+	home, _ := os.UserHomeDir()
+	var dirs []string
+	switch runtime.GOOS {
+	case "windows":
+		// Releases before os.UserConfigDir() used %LOCALAPPDATA%
+		if local := os.Getenv("LOCALAPPDATA"); local != "" {
+			dirs = append(dirs, filepath.Join(local, appName))
+		} else {
+			dirs = append(dirs, filepath.Join(home, "AppData", "Local", appName))
+		}
+	case "linux":
+		// Data created before XDG_DATA_HOME was set
+		dirs = append(dirs, filepath.Join(home, ".local", "share", appName))
+	}
+
+	var out []string
+	for _, d := range dirs {
+		if d != current {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// SetDataDir gives s an app directory of its own, in place of the one
+// AppDir resolves; its config is config.json in it.
+func (s *State) SetDataDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataDir = dir
+}
+
+// AppDir returns s's app directory: the one set by SetDataDir, or AppDir.
+func (s *State) AppDir() string {
+	s.mu.RLock()
+	dir := s.dataDir
+	s.mu.RUnlock()
+	if dir != "" {
+		return dir
+	}
+	return AppDir()
+}
+
+func TokenPath() string { return Global.TokenPath() }
+
+func (s *State) TokenPath() string {
+	return filepath.Join(s.AppDir(), "github_token")
+}
+
+// ConfigPath returns the config file config.Load reads and edits save to.
+func ConfigPath() string { return Global.ConfigPath() }
+
+// ConfigPath returns s's config file: config.json in the app directory set
+// by SetDataDir, or else the one ResolveConfigPath chooses.
+func (s *State) ConfigPath() string {
+	s.mu.RLock()
+	dir := s.dataDir
+	s.mu.RUnlock()
+	if dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	path, _ := ResolveConfigPath()
+	return path
+}
+
+// ResolveConfigPath returns the config file and what chose it: "--config",
+// ConfigEnv, or "app dir" for config.json in the app directory. An
+// overridden path is made absolute, so it doesn't depend on the working
+// directory later (or in a service).
+func ResolveConfigPath() (path, source string) {
+	pathMu.Lock()
+	flag := configFlag
+	pathMu.Unlock()
+	switch {
+	case flag != "":
+		path, source = flag, "--config"
+	case os.Getenv(ConfigEnv) != "":
+		path, source = os.Getenv(ConfigEnv), ConfigEnv
+	default:
+		return filepath.Join(AppDir(), "config.json"), "app dir"
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path, source
+}
+
+// BatchesDir returns the directory holding /v1/files uploads and
+// /v1/batches jobs.
+func BatchesDir() string { return Global.BatchesDir() }
+
+func (s *State) BatchesDir() string {
+	return filepath.Join(s.AppDir(), "batches")
+}
+
+// AuditLogPath is the default audit log location.
+func AuditLogPath() string { return Global.AuditLogPath() }
+
+func (s *State) AuditLogPath() string {
+	return filepath.Join(s.AppDir(), "audit.jsonl")
+}
+
+// AuditKeyPath holds the HMAC key chaining audit log entries.
+func AuditKeyPath() string { return Global.AuditKeyPath() }
+
+func (s *State) AuditKeyPath() string {
+	return filepath.Join(s.AppDir(), "audit_key")
+}
+
+// HistoryPath is the transcript history file (history.enabled).
+func HistoryPath() string { return Global.HistoryPath() }
+
+func (s *State) HistoryPath() string {
+	return filepath.Join(s.AppDir(), "history.jsonl")
+}
+
+// VSCodeVersionPath caches the VS Code version looked up at startup.
+func VSCodeVersionPath() string {
+	return filepath.Join(AppDir(), "vscode_version")
+}
+
+// CopilotChatVersionPath caches the copilot-chat version looked up on the
+// VS Code marketplace.
+func CopilotChatVersionPath() string {
+	return filepath.Join(AppDir(), "copilot_chat_version")
+}
+
+// ModelsCachePath caches the last Copilot models list fetched, used when
+// the models can't be fetched at startup.
+func ModelsCachePath() string { return Global.ModelsCachePath() }
+
+func (s *State) ModelsCachePath() string {
+	return filepath.Join(s.AppDir(), "models.json")
+}
+
+func LogDir() string { return Global.LogDir() }
+
+func (s *State) LogDir() string {
+	return filepath.Join(s.AppDir(), "logs")
+}
+
+// EnsurePaths creates the app directory and ensures token/config files exist.
+func EnsurePaths() error { return Global.EnsurePaths() }
+
+// EnsurePaths creates s's app directory and ensures its token file exists.
+func (s *State) EnsurePaths() error {
+	dir := s.AppDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.LogDir(), 0700); err != nil {
+		return err
+	}
+	// Touch token file if it doesn't exist
+	tokenPath := s.TokenPath()
+	if _, err := os.Stat(tokenPath); os.IsNotExist(err) {
+		if err := os.WriteFile(tokenPath, []byte(""), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
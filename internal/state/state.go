@@ -1,10 +1,9 @@
 package state
 
 import (
-	"os"
-	"path/filepath"
-	"runtime"
+	"encoding/json"
 	"sync"
+	"time"
 )
 
 // ModelLimits defines token limits for a model.
@@ -25,6 +24,9 @@ type ModelSupports struct {
 	StructuredOutputs bool `json:"structured_outputs"`
 	Vision            bool `json:"vision"`
 	AdaptiveThinking  bool `json:"adaptive_thinking"`
+	// ReasoningEffort lists the efforts a reasoning model accepts; such
+	// models reject sampling parameters.
+	ReasoningEffort []string `json:"reasoning_effort,omitempty"`
 }
 
 // ModelCapabilities describes a model's capabilities.
@@ -36,6 +38,12 @@ type ModelCapabilities struct {
 	Supports  ModelSupports `json:"supports"`
 }
 
+// ModelBilling describes how a model's requests are billed.
+type ModelBilling struct {
+	IsPremium  bool    `json:"is_premium"`
+	Multiplier float64 `json:"multiplier"` // premium requests per user-initiated request
+}
+
 // Model represents a Copilot model.
 type Model struct {
 	ID                 string            `json:"id"`
@@ -49,6 +57,9 @@ type Model struct {
 	Preview            bool              `json:"preview"`
 	Capabilities       ModelCapabilities `json:"capabilities"`
 	SupportedEndpoints []string          `json:"supported_endpoints"`
+	Billing            *ModelBilling     `json:"billing,omitempty"` // nil if Copilot doesn't say
+	// Overridden lists the fields modelOverrides set, as dotted JSON paths.
+	Overridden []string `json:"-"`
 }
 
 // ModelsResponse is the response from the Copilot models API.
@@ -62,17 +73,31 @@ type State struct {
 
 	githubToken  string
 	copilotToken string
+	copilotTokenExpiresAt time.Time
+	lastUpstreamSuccess   time.Time
 	accountType  string
+	copilotPlan  string
 	models       []Model
+	modelOverrides map[string]json.RawMessage
 	vsCodeVersion string
+	copilotChatVersion string
+	githubAPIVersion   string
 	verbose      bool
 	showToken    bool
+	fixtureDir   string
+	dataDir      string
 }
 
-// Global is the singleton state instance.
-var Global = &State{
-	accountType:   "individual",
-	vsCodeVersion: "1.109.3",
+// Global is the state of the CLI's proxy instance.
+var Global = New()
+
+// New returns the initial state of a proxy instance: an individual
+// account and no tokens or models yet.
+func New() *State {
+	return &State{
+		accountType:   "individual",
+		vsCodeVersion: "1.109.3",
+	}
 }
 
 func (s *State) GetGithubToken() string {
@@ -99,6 +124,32 @@ func (s *State) SetCopilotToken(t string) {
 	s.copilotToken = t
 }
 
+func (s *State) GetCopilotTokenExpiresAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.copilotTokenExpiresAt
+}
+
+func (s *State) SetCopilotTokenExpiresAt(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.copilotTokenExpiresAt = t
+}
+
+// GetLastUpstreamSuccess returns when a Copilot API call last returned 200.
+func (s *State) GetLastUpstreamSuccess() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastUpstreamSuccess
+}
+
+// MarkUpstreamSuccess records a successful Copilot API call.
+func (s *State) MarkUpstreamSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUpstreamSuccess = time.Now()
+}
+
 func (s *State) GetAccountType() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -111,16 +162,31 @@ func (s *State) SetAccountType(t string) {
 	s.accountType = t
 }
 
+// GetCopilotPlan returns the plan reported by copilot_internal/user, or ""
+// if it has not been detected.
+func (s *State) GetCopilotPlan() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.copilotPlan
+}
+
+func (s *State) SetCopilotPlan(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.copilotPlan = p
+}
+
 func (s *State) GetModels() []Model {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.models
 }
 
+// SetModels sets the Copilot models, with modelOverrides merged on.
 func (s *State) SetModels(m []Model) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.models = m
+	s.models = applyModelOverrides(m, s.modelOverrides)
 }
 
 func (s *State) GetVSCodeVersion() string {
@@ -135,6 +201,34 @@ func (s *State) SetVSCodeVersion(v string) {
 	s.vsCodeVersion = v
 }
 
+// GetCopilotChatVersion returns the copilot-chat version sent to Copilot,
+// or "" for the built-in one.
+func (s *State) GetCopilotChatVersion() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.copilotChatVersion
+}
+
+func (s *State) SetCopilotChatVersion(v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.copilotChatVersion = v
+}
+
+// GetGitHubAPIVersion returns the X-Github-Api-Version sent, or "" for the
+// built-in one.
+func (s *State) GetGitHubAPIVersion() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.githubAPIVersion
+}
+
+func (s *State) SetGitHubAPIVersion(v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.githubAPIVersion = v
+}
+
 func (s *State) GetVerbose() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -159,6 +253,20 @@ func (s *State) SetShowToken(v bool) {
 	s.showToken = v
 }
 
+// GetFixtureDir returns the directory streams are recorded to as
+// fixtures, or "" when not recording.
+func (s *State) GetFixtureDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fixtureDir
+}
+
+func (s *State) SetFixtureDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtureDir = dir
+}
+
 // FindModel looks up a model by ID.
 func (s *State) FindModel(id string) *Model {
 	s.mu.RLock()
@@ -170,56 +278,3 @@ func (s *State) FindModel(id string) *Model {
 	}
 	return nil
 }
-
-// --- Paths ---
-
-const appName = "copilot-proxy-go"
-
-func AppDir() string {
-	home, _ := os.UserHomeDir()
-	switch runtime.GOOS {
-	case "darwin":
-		return filepath.Join(home, "Library", "Application Support", appName)
-	case "windows":
-		if appData := os.Getenv("LOCALAPPDATA"); appData != "" {
-			return filepath.Join(appData, appName)
-		}
-		return filepath.Join(home, "AppData", "Local", appName)
-	default: // linux and others
-		if xdg := os.Getenv("XDG_DATA_HOME"); xdg != "" {
-			return filepath.Join(xdg, appName)
-		}
-		return filepath.Join(home, ".local", "share", appName)
-	}
-}
-
-func TokenPath() string {
-	return filepath.Join(AppDir(), "github_token")
-}
-
-func ConfigPath() string {
-	return filepath.Join(AppDir(), "config.json")
-}
-
-func LogDir() string {
-	return filepath.Join(AppDir(), "logs")
-}
-
-// EnsurePaths creates the app directory and ensures token/config files exist.
-func EnsurePaths() error {
-	dir := AppDir()
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
-	}
-	if err := os.MkdirAll(LogDir(), 0700); err != nil {
-		return err
-	}
-	// Touch token file if it doesn't exist
-	tokenPath := TokenPath()
-	if _, err := os.Stat(tokenPath); os.IsNotExist(err) {
-		if err := os.WriteFile(tokenPath, []byte(""), 0600); err != nil {
-			return err
-		}
-	}
-	return nil
-}
@@ -0,0 +1,270 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+const (
+	// exportInterval is how often queued spans are sent.
+	exportInterval = 5 * time.Second
+	// exportBatch sends the queue early once it holds this many spans.
+	exportBatch = 512
+	// maxQueued drops new spans while the collector can't keep up.
+	maxQueued = 8192
+	// exportTimeout bounds one export request.
+	exportTimeout = 10 * time.Second
+)
+
+// exporter queues ended spans and sends them to the collector in batches
+// from one goroutine, started with the first span.
+type exporter struct {
+	mu      sync.Mutex
+	queue   []*Span
+	started bool
+	dropped bool // a drop was logged since the queue last had room
+	wake    chan struct{}
+	// sending serializes exports, so Flush waits for one in progress
+	sending sync.Mutex
+}
+
+var spans = &exporter{wake: make(chan struct{}, 1)}
+
+var exportClient = &http.Client{Timeout: exportTimeout}
+
+func (e *exporter) add(s *Span) {
+	e.mu.Lock()
+	if len(e.queue) >= maxQueued {
+		if !e.dropped {
+			e.dropped = true
+			slog.Warn("telemetry queue full, dropping spans", "queued", len(e.queue))
+		}
+		e.mu.Unlock()
+		return
+	}
+	e.dropped = false
+	e.queue = append(e.queue, s)
+	full := len(e.queue) >= exportBatch
+	if !e.started {
+		e.started = true
+		go e.run()
+	}
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *exporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.wake:
+		}
+		e.flush(context.Background())
+	}
+}
+
+// flush sends every queued span, a batch at a time, each to its
+// destination. A failed batch is logged and dropped.
+func (e *exporter) flush(ctx context.Context) {
+	e.sending.Lock()
+	defer e.sending.Unlock()
+	for {
+		e.mu.Lock()
+		n := min(len(e.queue), exportBatch)
+		batch := e.queue[:n:n]
+		e.queue = e.queue[n:]
+		e.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		byDest := make(map[string][]*Span)
+		var order []*destination
+		for _, s := range batch {
+			if _, ok := byDest[s.dest.key]; !ok {
+				order = append(order, s.dest)
+			}
+			byDest[s.dest.key] = append(byDest[s.dest.key], s)
+		}
+		for _, dest := range order {
+			spans := byDest[dest.key]
+			if err := send(ctx, dest, spans); err != nil {
+				slog.Warn("failed to export spans", "spans", len(spans), "endpoint", dest.url, "error", err)
+			}
+		}
+	}
+}
+
+// Flush sends the spans queued so far, for shutdown.
+func Flush(ctx context.Context) {
+	spans.flush(ctx)
+}
+
+// tracesURL returns the OTLP/HTTP traces URL of endpoint: /v1/traces is
+// appended to a URL without a path.
+func tracesURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Path != "" && u.Path != "/" {
+		return endpoint
+	}
+	u.Path = "/v1/traces"
+	return u.String()
+}
+
+// destination is the collector a trace is exported to, from the config of
+// the proxy instance that started it.
+type destination struct {
+	url     string
+	headers map[string]string
+	service string
+	key     string // identifies url, headers and service, to batch by
+}
+
+func newDestination(cfg *config.Config) *destination {
+	d := &destination{
+		url:     tracesURL(cfg.Telemetry.OTLPEndpoint),
+		headers: cfg.Telemetry.Headers,
+		service: cfg.TelemetryServiceName(),
+	}
+	names := make([]string, 0, len(d.headers))
+	for k := range d.headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	key := []string{d.url, d.service}
+	for _, k := range names {
+		key = append(key, k, d.headers[k])
+	}
+	d.key = strings.Join(key, "\x00")
+	return d
+}
+
+// send posts batch to dest as an OTLP ExportTraceServiceRequest.
+func send(ctx context.Context, dest *destination, batch []*Span) error {
+	body, err := json.Marshal(encodeSpans(batch, dest.service))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dest.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range dest.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := exportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// OTLP/JSON messages. IDs are hex and 64-bit integers decimal strings, as
+// the OTLP JSON encoding requires.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              Kind           `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    string  `json:"intValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 2: error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func stringValue(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func encodeSpans(batch []*Span, serviceName string) otlpRequest {
+	out := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, a := range s.attrs {
+			if a.isInt {
+				span.Attributes = append(span.Attributes, otlpKeyValue{Key: a.key, Value: otlpValue{IntValue: strconv.FormatInt(a.num, 10)}})
+			} else {
+				span.Attributes = append(span.Attributes, stringValue(a.key, a.str))
+			}
+		}
+		if s.errMsg != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		out = append(out, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{stringValue("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/tonghaoch/copilot-proxy-go"}, Spans: out}},
+	}}}
+}
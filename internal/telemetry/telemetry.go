@@ -0,0 +1,212 @@
+// Package telemetry traces proxied requests and exports the spans to an
+// OpenTelemetry collector over OTLP/HTTP (JSON) at telemetry.otlpEndpoint.
+// It implements the part of the OTel data model the proxy needs: spans
+// with string and integer attributes, W3C traceparent propagation and a
+// batching exporter. Like the Redis and WebSocket code, it is built in
+// rather than taken from the OTel SDK, which would bring a dozen modules
+// (and gRPC's protobuf stack) for what is a few hundred lines here.
+//
+// Tracing follows the config of the request's proxy instance. Without an
+// endpoint nothing is traced: Start returns a nil *Span, whose methods do
+// nothing, and no call allocates.
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// SpanContext identifies a span within its trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// Valid reports whether both IDs are set; all-zero IDs are invalid in W3C
+// trace context.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Span is one timed operation of a trace. A nil *Span is a valid span
+// that records nothing.
+type Span struct {
+	sc     SpanContext
+	parent [8]byte
+	name   string
+	kind   Kind
+	start  time.Time
+	dest   *destination // where the trace is exported
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	ended  bool
+}
+
+type attribute struct {
+	key   string
+	str   string
+	num   int64
+	isInt bool
+}
+
+// Enabled reports whether spans are recorded for ctx's request: the
+// config of its proxy instance sets telemetry.otlpEndpoint.
+func Enabled(ctx context.Context) bool {
+	return config.FromContext(ctx).Telemetry.OTLPEndpoint != ""
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start starts a span named name as a child of the span in ctx, or of the
+// remote parent from Extract, or else as the root of a new trace. The
+// returned context carries the new span. A trace is exported where the
+// config said when its first span started. While telemetry is disabled it
+// returns ctx and a nil span.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if !Enabled(ctx) {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent := FromContext(ctx); parent != nil {
+		s.sc.TraceID = parent.sc.TraceID
+		s.parent = parent.sc.SpanID
+		s.dest = parent.dest
+	} else {
+		if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+			s.sc.TraceID = remote.TraceID
+			s.parent = remote.SpanID
+		} else {
+			rand.Read(s.sc.TraceID[:])
+		}
+		s.dest = newDestination(config.FromContext(ctx))
+	}
+	rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithSpan returns a context carrying s, for work on s's behalf
+// under another context (upstream calls aren't made under the client's
+// request context). A nil s returns ctx.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Extract returns ctx with the remote parent of an incoming traceparent
+// header in h, if it has a valid one and telemetry is enabled.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if !Enabled(ctx) {
+		return ctx
+	}
+	sc, ok := parseTraceparent(h.Get("Traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// parseTraceparent parses a W3C traceparent header:
+// version-traceid-parentid-flags.
+func parseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	return sc, sc.Valid()
+}
+
+// Inject sets the traceparent header of an outgoing request to s, so the
+// upstream's spans join the trace.
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	h.Set("Traceparent", "00-"+hex.EncodeToString(s.sc.TraceID[:])+"-"+hex.EncodeToString(s.sc.SpanID[:])+"-01")
+}
+
+// SetString sets a string attribute; empty values are skipped.
+func (s *Span) SetString(key, value string) {
+	if s == nil || value == "" {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key: key, str: value})
+	s.mu.Unlock()
+}
+
+// SetInt sets an integer attribute.
+func (s *Span) SetInt(key string, value int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key: key, num: value, isInt: true})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed with err's message. A nil err does
+// nothing.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Only the first call
+// counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	spans.add(s)
+}
@@ -0,0 +1,273 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+// instanceContext returns a context whose proxy instance has the
+// telemetry config tc.
+func instanceContext(tc config.TelemetryConfig) context.Context {
+	store := config.NewStore("")
+	store.Update(func(c *config.Config) { c.Telemetry = tc })
+	return config.WithStore(context.Background(), store)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"version 00", "00-" + testTraceID + "-" + testSpanID + "-01", true},
+		{"not sampled", "00-" + testTraceID + "-" + testSpanID + "-00", true},
+		{"surrounding space", " 00-" + testTraceID + "-" + testSpanID + "-01 ", true},
+		{"later version with more fields", "01-" + testTraceID + "-" + testSpanID + "-01-extra", true},
+		{"version 00 with more fields", "00-" + testTraceID + "-" + testSpanID + "-01-extra", false},
+		{"version ff", "ff-" + testTraceID + "-" + testSpanID + "-01", false},
+		{"zero trace ID", "00-" + strings.Repeat("0", 32) + "-" + testSpanID + "-01", false},
+		{"zero span ID", "00-" + testTraceID + "-" + strings.Repeat("0", 16) + "-01", false},
+		{"short trace ID", "00-" + testTraceID[1:] + "-" + testSpanID + "-01", false},
+		{"short span ID", "00-" + testTraceID + "-" + testSpanID[1:] + "-01", false},
+		{"not hex", "00-" + strings.Repeat("z", 32) + "-" + testSpanID + "-01", false},
+		{"missing flags", "00-" + testTraceID + "-" + testSpanID, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		sc, ok := parseTraceparent(tt.header)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && (hex.EncodeToString(sc.TraceID[:]) != testTraceID || hex.EncodeToString(sc.SpanID[:]) != testSpanID) {
+			t.Errorf("%s: parsed %x-%x", tt.name, sc.TraceID, sc.SpanID)
+		}
+	}
+}
+
+func TestStartJoinsTraceAndInjects(t *testing.T) {
+	ctx := instanceContext(config.TelemetryConfig{OTLPEndpoint: "http://collector.invalid"})
+	ctx = Extract(ctx, http.Header{"Traceparent": {"00-" + testTraceID + "-" + testSpanID + "-01"}})
+
+	ctx, server := Start(ctx, "POST /v1/messages", KindServer)
+	_, client := Start(ctx, "upstream", KindClient)
+	if got := hex.EncodeToString(server.sc.TraceID[:]); got != testTraceID {
+		t.Errorf("server span trace = %s, want the client's %s", got, testTraceID)
+	}
+	if got := hex.EncodeToString(server.parent[:]); got != testSpanID {
+		t.Errorf("server span parent = %s, want the client's span %s", got, testSpanID)
+	}
+	if client.sc.TraceID != server.sc.TraceID || client.parent != server.sc.SpanID {
+		t.Error("child span not under the server span")
+	}
+	if client.dest != server.dest {
+		t.Error("child span exported elsewhere than its trace")
+	}
+
+	h := http.Header{}
+	client.Inject(h)
+	want := "00-" + testTraceID + "-" + hex.EncodeToString(client.sc.SpanID[:]) + "-01"
+	if got := h.Get("Traceparent"); got != want {
+		t.Errorf("injected traceparent = %q, want %q", got, want)
+	}
+	if sc, ok := parseTraceparent(h.Get("Traceparent")); !ok || sc != client.sc {
+		t.Errorf("injected traceparent doesn't parse back to the span: %v", ok)
+	}
+}
+
+func TestDisabledIsFree(t *testing.T) {
+	ctx := instanceContext(config.TelemetryConfig{})
+	h := http.Header{"Traceparent": {"00-" + testTraceID + "-" + testSpanID + "-01"}}
+	out := http.Header{}
+	err := errors.New("failed")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c := Extract(ctx, h)
+		c, span := Start(c, "POST /v1/messages", KindServer)
+		span.SetString("gen_ai.request.model", "gpt-4.1")
+		span.SetInt("gen_ai.usage.input_tokens", 12)
+		span.SetError(err)
+		span.Inject(out)
+		span.End()
+		if span != nil || FromContext(c) != nil {
+			t.Fatal("span recorded while disabled")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per disabled request, want 0", allocs)
+	}
+	if len(out) != 0 {
+		t.Errorf("traceparent injected while disabled: %v", out)
+	}
+}
+
+func TestTracesURL(t *testing.T) {
+	tests := []struct{ endpoint, want string }{
+		{"http://localhost:4318", "http://localhost:4318/v1/traces"},
+		{"http://localhost:4318/", "http://localhost:4318/v1/traces"},
+		{"https://otel.example/custom/path", "https://otel.example/custom/path"},
+	}
+	for _, tt := range tests {
+		if got := tracesURL(tt.endpoint); got != tt.want {
+			t.Errorf("tracesURL(%q) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+// collector records the OTLP export requests it receives.
+type collector struct {
+	mu   sync.Mutex
+	reqs []collected
+}
+
+type collected struct {
+	path, contentType, token string
+	body                     otlpRequest
+}
+
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("export body: %v", err)
+		}
+		c.mu.Lock()
+		c.reqs = append(c.reqs, collected{r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("X-Api-Token"), body})
+		c.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+// received returns the export requests so far.
+func (c *collector) received() []collected {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]collected(nil), c.reqs...)
+}
+
+func attrs(kvs []otlpKeyValue) map[string]string {
+	out := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		if kv.Value.StringValue != nil {
+			out[kv.Key] = *kv.Value.StringValue
+		} else {
+			out[kv.Key] = "int:" + kv.Value.IntValue
+		}
+	}
+	return out
+}
+
+func TestExportedPayload(t *testing.T) {
+	c1, srv1 := newCollector(t)
+	c2, srv2 := newCollector(t)
+	ctx := instanceContext(config.TelemetryConfig{
+		OTLPEndpoint: srv1.URL,
+		Headers:      map[string]string{"X-Api-Token": "secret"},
+		ServiceName:  "proxy-a",
+	})
+	other := instanceContext(config.TelemetryConfig{OTLPEndpoint: srv2.URL + "/otlp/traces"})
+
+	ctx, server := Start(ctx, "POST /v1/messages", KindServer)
+	server.SetString("gen_ai.request.model", "claude-sonnet-4")
+	server.SetString("copilot_proxy.initiator", "")
+	server.SetInt("gen_ai.usage.output_tokens", 42)
+	_, upstream := Start(ctx, "upstream POST /v1/messages", KindClient)
+	upstream.SetError(errors.New("upstream returned 502"))
+	upstream.End()
+	server.End()
+	server.End()
+	_, elsewhere := Start(other, "POST /chat/completions", KindServer)
+	elsewhere.End()
+	Flush(context.Background())
+
+	got1, got2 := c1.received(), c2.received()
+	if len(got1) != 1 || len(got2) != 1 {
+		t.Fatalf("exports: %d and %d, want one to each instance's collector", len(got1), len(got2))
+	}
+	got := got1[0]
+	if got.path != "/v1/traces" || got.contentType != "application/json" || got.token != "secret" {
+		t.Errorf("export request: path %q, content type %q, token %q", got.path, got.contentType, got.token)
+	}
+	if got2[0].path != "/otlp/traces" {
+		t.Errorf("second collector path = %q, want the configured one", got2[0].path)
+	}
+
+	rs := got.body.ResourceSpans
+	if len(rs) != 1 || len(rs[0].ScopeSpans) != 1 {
+		t.Fatalf("resource spans: %+v", rs)
+	}
+	if name := attrs(rs[0].Resource.Attributes)["service.name"]; name != "proxy-a" {
+		t.Errorf("service.name = %q, want proxy-a", name)
+	}
+	spans := rs[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2 (End counts once)", len(spans))
+	}
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	srvSpan, upSpan := byName["POST /v1/messages"], byName["upstream POST /v1/messages"]
+
+	if srvSpan.TraceID != hex.EncodeToString(server.sc.TraceID[:]) || len(srvSpan.TraceID) != 32 {
+		t.Errorf("trace ID = %q", srvSpan.TraceID)
+	}
+	if srvSpan.ParentSpanID != "" {
+		t.Errorf("root span has parent %q", srvSpan.ParentSpanID)
+	}
+	if upSpan.TraceID != srvSpan.TraceID || upSpan.ParentSpanID != srvSpan.SpanID {
+		t.Errorf("upstream span not a child of the server span: %+v", upSpan)
+	}
+	if srvSpan.Kind != KindServer || upSpan.Kind != KindClient {
+		t.Errorf("kinds = %d, %d; want %d, %d", srvSpan.Kind, upSpan.Kind, KindServer, KindClient)
+	}
+	wantAttrs := map[string]string{"gen_ai.request.model": "claude-sonnet-4", "gen_ai.usage.output_tokens": "int:42"}
+	if a := attrs(srvSpan.Attributes); len(a) != len(wantAttrs) || a["gen_ai.request.model"] != "claude-sonnet-4" || a["gen_ai.usage.output_tokens"] != "int:42" {
+		t.Errorf("attributes = %v, want %v", a, wantAttrs)
+	}
+	if srvSpan.Status.Code != 0 || upSpan.Status != (otlpStatus{Code: 2, Message: "upstream returned 502"}) {
+		t.Errorf("statuses = %+v, %+v", srvSpan.Status, upSpan.Status)
+	}
+	if srvSpan.StartTimeUnixNano == "" || srvSpan.EndTimeUnixNano < srvSpan.StartTimeUnixNano {
+		t.Errorf("times = %s..%s", srvSpan.StartTimeUnixNano, srvSpan.EndTimeUnixNano)
+	}
+}
+
+func TestExportFailureDropsBatch(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	ctx := instanceContext(config.TelemetryConfig{OTLPEndpoint: srv.URL})
+
+	_, span := Start(ctx, "POST /v1/messages", KindServer)
+	err := send(context.Background(), span.dest, []*Span{span})
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "overloaded") {
+		t.Errorf("send error = %v, want the collector's status and message", err)
+	}
+	span.End()
+	Flush(context.Background())
+	Flush(context.Background())
+	if n := calls.Load(); n != 2 {
+		t.Errorf("collector called %d times, want 2 (no retry of a failed batch)", n)
+	}
+}
@@ -0,0 +1,296 @@
+// Package tui is a minimal terminal picker: a list filtered as you type
+// and navigated with the arrow keys, with a numbered prompt for input
+// that isn't a terminal.
+package tui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrCanceled is returned when the user aborts a pick (Ctrl-C, Esc, or
+// end of input).
+var ErrCanceled = errors.New("selection canceled")
+
+// visibleRows is how many items Select shows at once.
+const visibleRows = 10
+
+// Item is one choice: Label is what filtering matches, Detail is shown
+// next to it.
+type Item struct {
+	Label  string
+	Detail string
+}
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// selector is the state of Select, kept apart from the terminal.
+type selector struct {
+	items   []Item
+	query   string
+	matches []int // indices into items, best match first
+	cursor  int   // index into matches
+	offset  int   // first visible index into matches
+}
+
+func newSelector(items []Item) *selector {
+	s := &selector{items: items}
+	s.filter()
+	return s
+}
+
+// filter recomputes the matches for the query and resets the cursor.
+func (s *selector) filter() {
+	type match struct{ index, score int }
+	var found []match
+	for i, item := range s.items {
+		if score, ok := fuzzyScore(s.query, item.Label); ok {
+			found = append(found, match{i, score})
+		}
+	}
+	slices.SortStableFunc(found, func(a, b match) int { return a.score - b.score })
+	s.matches = s.matches[:0]
+	for _, m := range found {
+		s.matches = append(s.matches, m.index)
+	}
+	s.cursor, s.offset = 0, 0
+}
+
+// move shifts the cursor by delta, wrapping around, and scrolls to it.
+func (s *selector) move(delta int) {
+	if len(s.matches) == 0 {
+		return
+	}
+	s.cursor = ((s.cursor+delta)%len(s.matches) + len(s.matches)) % len(s.matches)
+	if s.cursor < s.offset {
+		s.offset = s.cursor
+	} else if s.cursor >= s.offset+visibleRows {
+		s.offset = s.cursor - visibleRows + 1
+	}
+}
+
+// selected returns the index into items under the cursor, or -1.
+func (s *selector) selected() int {
+	if len(s.matches) == 0 {
+		return -1
+	}
+	return s.matches[s.cursor]
+}
+
+// fuzzyScore matches query against label as a case-insensitive
+// subsequence. Lower scores are better: a match that starts early and has
+// few gaps between the matched characters.
+func fuzzyScore(query, label string) (int, bool) {
+	query, label = strings.ToLower(query), strings.ToLower(label)
+	if query == "" {
+		return 0, true
+	}
+	if i := strings.Index(label, query); i >= 0 {
+		return i, true // a contiguous match beats any with gaps
+	}
+	score, last, qi := len(label), -1, 0
+	for li := 0; li < len(label) && qi < len(query); li++ {
+		if label[li] != query[qi] {
+			continue
+		}
+		if last >= 0 && li > last+1 {
+			score += li - last - 1
+		} else if last < 0 {
+			score += li
+		}
+		last = li
+		qi++
+	}
+	return score, qi == len(query)
+}
+
+// Keys Select acts on.
+type key int
+
+const (
+	keyNone key = iota
+	keyRune
+	keyUp
+	keyDown
+	keyEnter
+	keyBackspace
+	keyClear
+	keyCancel
+)
+
+// readKey reads one key press from a terminal in raw mode.
+func readKey(in *bufio.Reader) (key, rune, error) {
+	r, _, err := in.ReadRune()
+	if err != nil {
+		return keyNone, 0, err
+	}
+	switch r {
+	case '\r', '\n':
+		return keyEnter, 0, nil
+	case 0x7f, 0x08:
+		return keyBackspace, 0, nil
+	case 0x15: // Ctrl-U
+		return keyClear, 0, nil
+	case 0x03, 0x04: // Ctrl-C, Ctrl-D
+		return keyCancel, 0, nil
+	case 0x10: // Ctrl-P
+		return keyUp, 0, nil
+	case 0x0e: // Ctrl-N
+		return keyDown, 0, nil
+	case 0x1b:
+		// An arrow key is ESC [ A or ESC O A, sent at once; a lone ESC
+		// has nothing buffered after it
+		if in.Buffered() == 0 {
+			return keyCancel, 0, nil
+		}
+		if b, _ := in.ReadByte(); b != '[' && b != 'O' {
+			return keyNone, 0, nil
+		}
+		switch b, _ := in.ReadByte(); b {
+		case 'A':
+			return keyUp, 0, nil
+		case 'B':
+			return keyDown, 0, nil
+		}
+		return keyNone, 0, nil
+	}
+	if r < 0x20 {
+		return keyNone, 0, nil
+	}
+	return keyRune, r, nil
+}
+
+// Select lets the user pick one of items on a terminal: typing filters
+// them fuzzily, the arrow keys (or Ctrl-P/Ctrl-N) move, Enter picks and
+// Ctrl-C or Esc cancels. in must be the terminal in raw mode (see
+// MakeRaw), out where it echoes. Returns the index into items.
+func Select(in *bufio.Reader, out io.Writer, title string, items []Item) (int, error) {
+	s := newSelector(items)
+	width := 0
+	for _, item := range items {
+		width = max(width, len(item.Label))
+	}
+
+	drawn := 0
+	for {
+		drawn = s.render(out, title, width, drawn)
+		k, r, err := readKey(in)
+		if err != nil {
+			clearLines(out, drawn)
+			return -1, ErrCanceled
+		}
+		switch k {
+		case keyRune:
+			s.query += string(r)
+			s.filter()
+		case keyBackspace:
+			if q := []rune(s.query); len(q) > 0 {
+				s.query = string(q[:len(q)-1])
+				s.filter()
+			}
+		case keyClear:
+			s.query = ""
+			s.filter()
+		case keyUp:
+			s.move(-1)
+		case keyDown:
+			s.move(1)
+		case keyCancel:
+			clearLines(out, drawn)
+			return -1, ErrCanceled
+		case keyEnter:
+			if i := s.selected(); i >= 0 {
+				clearLines(out, drawn)
+				fmt.Fprintf(out, "  %s %s\r\n", title, items[i].Label)
+				return i, nil
+			}
+		}
+	}
+}
+
+// render draws the selector over the drawn lines of the previous render
+// and returns how many lines it drew.
+func (s *selector) render(out io.Writer, title string, width, drawn int) int {
+	var b strings.Builder
+	if drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", drawn)
+	}
+	b.WriteString("\r\x1b[J")
+	lines := 0
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format+"\r\n", args...)
+		lines++
+	}
+
+	line("  %s \x1b[2m(type to filter, ↑/↓ to move, Enter to pick)\x1b[0m", title)
+	line("  > %s", s.query)
+	if len(s.matches) == 0 {
+		line("    \x1b[2mno matches\x1b[0m")
+	}
+	end := min(s.offset+visibleRows, len(s.matches))
+	for i := s.offset; i < end; i++ {
+		item := s.items[s.matches[i]]
+		row := fmt.Sprintf("%-*s  \x1b[2m%s\x1b[0m", width, item.Label, item.Detail)
+		if i == s.cursor {
+			line("  \x1b[7m› %s\x1b[0m", row)
+		} else {
+			line("    %s", row)
+		}
+	}
+	if len(s.matches) > visibleRows {
+		line("    \x1b[2m%d/%d\x1b[0m", s.cursor+1, len(s.matches))
+	}
+	io.WriteString(out, b.String())
+	return lines
+}
+
+// clearLines erases the n lines above the cursor.
+func clearLines(out io.Writer, n int) {
+	if n > 0 {
+		fmt.Fprintf(out, "\x1b[%dA", n)
+	}
+	io.WriteString(out, "\r\x1b[J")
+}
+
+// Prompt is the fallback for input that isn't a terminal: it lists items
+// numbered and reads a line with a number or a label. Surrounding spaces
+// are ignored; anything else invalid asks again. Returns the index into
+// items.
+func Prompt(in *bufio.Reader, out io.Writer, title string, items []Item) (int, error) {
+	fmt.Fprintf(out, "\n  %s\n", title)
+	width := 0
+	for _, item := range items {
+		width = max(width, len(item.Label))
+	}
+	for i, item := range items {
+		fmt.Fprintf(out, "    %2d. %-*s  %s\n", i+1, width, item.Label, item.Detail)
+	}
+	for {
+		fmt.Fprint(out, "\n  Enter number: ")
+		line, err := in.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if answer == "" && err != nil {
+			return -1, ErrCanceled
+		}
+		if n, convErr := strconv.Atoi(answer); convErr == nil && n >= 1 && n <= len(items) {
+			return n - 1, nil
+		}
+		if i := slices.IndexFunc(items, func(item Item) bool { return item.Label == answer }); i >= 0 {
+			return i, nil
+		}
+		if err != nil {
+			return -1, ErrCanceled
+		}
+		fmt.Fprintf(out, "  Invalid choice %q; enter 1-%d or a name from the list\n", answer, len(items))
+	}
+}
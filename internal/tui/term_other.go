@@ -0,0 +1,36 @@
+//go:build !windows
+
+package tui
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// MakeRaw puts the terminal f into raw mode for Select: keys arrive one at
+// a time, unechoed, with Ctrl-C as a key rather than a signal. Output
+// processing is kept, so "\r\n" ends a line. restore undoes it. It uses
+// stty, which every Unix has, rather than terminal ioctls that differ
+// between them.
+func MakeRaw(f *os.File) (restore func(), err error) {
+	saved, err := stty(f, "-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty(f, "-icanon", "-echo", "-isig", "min", "1", "time", "0"); err != nil {
+		return nil, err
+	}
+	return func() { stty(f, saved) }, nil
+}
+
+func stty(f *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = f
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("stty %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,59 @@
+//go:build windows
+
+package tui
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Console mode flags (wincon.h).
+const (
+	enableProcessedInput            = 0x0001
+	enableLineInput                 = 0x0002
+	enableEchoInput                 = 0x0004
+	enableVirtualTerminalInput      = 0x0200
+	enableVirtualTerminalProcessing = 0x0004
+)
+
+var setConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// MakeRaw puts the console f into raw mode for Select: keys arrive one at
+// a time, unechoed, with arrow keys as VT sequences and Ctrl-C as a key.
+// Stdout is switched to VT processing so Select's escape sequences are
+// interpreted. restore undoes both.
+func MakeRaw(f *os.File) (restore func(), err error) {
+	in := syscall.Handle(f.Fd())
+	var inMode uint32
+	if err := syscall.GetConsoleMode(in, &inMode); err != nil {
+		return nil, fmt.Errorf("console mode: %w", err)
+	}
+	raw := inMode&^(enableProcessedInput|enableLineInput|enableEchoInput) | enableVirtualTerminalInput
+	if err := setMode(in, raw); err != nil {
+		return nil, err
+	}
+
+	out := syscall.Handle(os.Stdout.Fd())
+	var outMode uint32
+	outOK := syscall.GetConsoleMode(out, &outMode) == nil
+	if outOK {
+		if err := setMode(out, outMode|enableVirtualTerminalProcessing); err != nil {
+			setMode(in, inMode)
+			return nil, err
+		}
+	}
+	return func() {
+		setMode(in, inMode)
+		if outOK {
+			setMode(out, outMode)
+		}
+	}, nil
+}
+
+func setMode(h syscall.Handle, mode uint32) error {
+	if r, _, err := setConsoleMode.Call(uintptr(h), uintptr(mode)); r == 0 {
+		return fmt.Errorf("setting console mode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package update
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	releasesURL = "https://api.github.com/repos/tonghaoch/copilot-proxy-go/releases/latest"
+	binaryName  = "copilot-proxy-go"
+)
+
+// Asset is a downloadable file attached to a GitHub release.
+type Asset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// Release is the subset of the GitHub releases API response we use.
+type Release struct {
+	TagName string  `json:"tag_name"`
+	HTMLURL string  `json:"html_url"`
+	Assets  []Asset `json:"assets"`
+}
+
+// Version returns the release tag without a leading "v".
+func (r *Release) Version() string {
+	return strings.TrimPrefix(r.TagName, "v")
+}
+
+// FetchLatest retrieves the latest published release from GitHub.
+func FetchLatest(ctx context.Context) (*Release, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releasesURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating releases request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching latest release: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("latest release request failed with status %d", resp.StatusCode)
+	}
+
+	var rel Release
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return nil, fmt.Errorf("decoding release response: %w", err)
+	}
+	return &rel, nil
+}
+
+// IsNewer reports whether latest is a higher semantic version than current.
+// A non-numeric current version (e.g. "dev") is always considered older.
+func IsNewer(current, latest string) bool {
+	cur, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	lat, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	for i := range cur {
+		if lat[i] != cur[i] {
+			return lat[i] > cur[i]
+		}
+	}
+	return false
+}
+
+// parseVersion parses "v1.2.3" or "1.2.3-rc1" into its numeric components.
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+// CheckAndLog logs a notice when a newer release is available. Intended to be
+// run in a goroutine at startup; failures are logged at debug level only.
+func CheckAndLog(current string) {
+	if _, ok := parseVersion(current); !ok {
+		return // development build
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rel, err := FetchLatest(ctx)
+	if err != nil {
+		slog.Debug("update check failed", "error", err)
+		return
+	}
+	if IsNewer(current, rel.Version()) {
+		slog.Info(fmt.Sprintf("a newer version is available: v%s (current v%s) — run 'copilot-proxy-go upgrade'",
+			rel.Version(), current))
+	}
+}
+
+// FindAsset picks the release asset for the running platform.
+func FindAsset(rel *Release) (*Asset, error) {
+	return findAsset(rel, runtime.GOOS, runtime.GOARCH)
+}
+
+// findAsset picks the asset whose name has goos and goarch as whole
+// tokens, so "arm" doesn't match an arm64 asset.
+func findAsset(rel *Release, goos, goarch string) (*Asset, error) {
+	for i := range rel.Assets {
+		name := strings.ToLower(rel.Assets[i].Name)
+		if strings.Contains(name, "checksum") {
+			continue
+		}
+		tokens := nameTokens(name)
+		if slices.Contains(tokens, goos) && slices.Contains(tokens, goarch) {
+			return &rel.Assets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no release asset found for %s/%s", goos, goarch)
+}
+
+// nameTokens splits an asset name like "copilot-proxy-go_linux_arm64.tar.gz"
+// at its separators.
+func nameTokens(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return r == '_' || r == '-' || r == '.' || r == ' '
+	})
+}
+
+// findChecksums returns the checksums file attached to the release, if any.
+func findChecksums(rel *Release) *Asset {
+	for i := range rel.Assets {
+		if strings.Contains(strings.ToLower(rel.Assets[i].Name), "checksums") {
+			return &rel.Assets[i]
+		}
+	}
+	return nil
+}
+
+// Download fetches the platform asset, verifies it against the release's
+// checksums file, and returns the extracted binary contents.
+func Download(ctx context.Context, rel *Release) ([]byte, error) {
+	asset, err := FindAsset(rel)
+	if err != nil {
+		return nil, err
+	}
+	sums := findChecksums(rel)
+	if sums == nil {
+		return nil, fmt.Errorf("release %s has no checksums file", rel.TagName)
+	}
+
+	sumData, err := fetch(ctx, sums.BrowserDownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("downloading checksums: %w", err)
+	}
+	want, err := lookupChecksum(sumData, asset.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fetch(ctx, asset.BrowserDownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", asset.Name, err)
+	}
+	got := sha256.Sum256(data)
+	if hex.EncodeToString(got[:]) != want {
+		return nil, fmt.Errorf("checksum mismatch for %s", asset.Name)
+	}
+
+	return extractBinary(asset.Name, data)
+}
+
+func fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// lookupChecksum finds the sha256 for name in a "<hash>  <file>" listing.
+func lookupChecksum(data []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum listed for %s", name)
+}
+
+// extractBinary returns the executable from an archive asset, or the data
+// itself when the asset is a bare binary.
+func extractBinary(assetName string, data []byte) ([]byte, error) {
+	want := binaryName
+	if runtime.GOOS == "windows" {
+		want += ".exe"
+	}
+
+	switch {
+	case strings.HasSuffix(assetName, ".tar.gz"), strings.HasSuffix(assetName, ".tgz"):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("opening archive: %w", err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading archive: %w", err)
+			}
+			if filepath.Base(hdr.Name) == want {
+				return io.ReadAll(tr)
+			}
+		}
+		return nil, fmt.Errorf("%s not found in %s", want, assetName)
+
+	case strings.HasSuffix(assetName, ".zip"):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("opening archive: %w", err)
+		}
+		for _, f := range zr.File {
+			if filepath.Base(f.Name) != want {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+		return nil, fmt.Errorf("%s not found in %s", want, assetName)
+
+	default:
+		return data, nil
+	}
+}
+
+// Apply replaces the running executable with binary.
+func Apply(binary []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locating executable: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	return replaceExecutable(exe, binary, runtime.GOOS)
+}
+
+// replaceExecutable writes binary next to exe and moves it into place. On
+// Unix that is a single rename over exe, so there is a binary at exe at
+// every moment. Windows can't replace a running executable but can rename
+// it, so there the old binary is moved aside to exe.old first, and moved
+// back if the new one can't be installed.
+func replaceExecutable(exe string, binary []byte, goos string) error {
+	dir := filepath.Dir(exe)
+	tmp, err := os.CreateTemp(dir, "."+binaryName+"-new-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing new binary: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		return err
+	}
+
+	if goos != "windows" {
+		if err := os.Rename(tmpPath, exe); err != nil {
+			return fmt.Errorf("installing new binary: %w", err)
+		}
+		return nil
+	}
+
+	// The running image stays locked; CleanupOld removes it next run.
+	oldPath := exe + ".old"
+	os.Remove(oldPath)
+	if err := os.Rename(exe, oldPath); err != nil {
+		return fmt.Errorf("moving old binary aside: %w", err)
+	}
+	if err := os.Rename(tmpPath, exe); err != nil {
+		// Roll back so the user still has a working binary
+		if rbErr := os.Rename(oldPath, exe); rbErr != nil {
+			return fmt.Errorf("installing new binary: %w (restoring the old one from %s also failed: %v)", err, oldPath, rbErr)
+		}
+		return fmt.Errorf("installing new binary: %w", err)
+	}
+	return nil
+}
+
+// CleanupOld removes a binary left aside by a previous Apply on Windows.
+func CleanupOld() {
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	os.Remove(exe + ".old")
+}
@@ -0,0 +1,100 @@
+package update
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindAsset(t *testing.T) {
+	rel := &Release{Assets: []Asset{
+		{Name: "checksums.txt"},
+		{Name: "copilot-proxy-go_linux_arm64.tar.gz"},
+		{Name: "copilot-proxy-go_linux_arm.tar.gz"},
+		{Name: "copilot-proxy-go_linux_amd64.tar.gz"},
+		{Name: "copilot-proxy-go_darwin_arm64.tar.gz"},
+		{Name: "copilot-proxy-go_windows_amd64.zip"},
+	}}
+	tests := []struct {
+		goos, goarch string
+		want         string
+	}{
+		{"linux", "arm", "copilot-proxy-go_linux_arm.tar.gz"},
+		{"linux", "arm64", "copilot-proxy-go_linux_arm64.tar.gz"},
+		{"linux", "amd64", "copilot-proxy-go_linux_amd64.tar.gz"},
+		{"darwin", "arm64", "copilot-proxy-go_darwin_arm64.tar.gz"},
+		{"windows", "amd64", "copilot-proxy-go_windows_amd64.zip"},
+		{"darwin", "amd64", ""},
+		{"freebsd", "386", ""},
+	}
+	for _, tt := range tests {
+		asset, err := findAsset(rel, tt.goos, tt.goarch)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s/%s: got %q, want no asset", tt.goos, tt.goarch, asset.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s/%s: %v", tt.goos, tt.goarch, err)
+		} else if asset.Name != tt.want {
+			t.Errorf("%s/%s: got %q, want %q", tt.goos, tt.goarch, asset.Name, tt.want)
+		}
+	}
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	tests := []struct {
+		goos    string
+		wantOld bool // the old binary is left at exe.old
+	}{
+		{"linux", false},
+		{"darwin", false},
+		{"windows", true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		exe := filepath.Join(dir, binaryName)
+		if err := os.WriteFile(exe, []byte("old"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := replaceExecutable(exe, []byte("new"), tt.goos); err != nil {
+			t.Fatalf("%s: %v", tt.goos, err)
+		}
+
+		if data, err := os.ReadFile(exe); err != nil || string(data) != "new" {
+			t.Errorf("%s: exe = %q, %v; want the new binary", tt.goos, data, err)
+		}
+		if info, err := os.Stat(exe); err == nil && info.Mode().Perm()&0111 == 0 {
+			t.Errorf("%s: new binary mode %v, want executable", tt.goos, info.Mode())
+		}
+		old, err := os.ReadFile(exe + ".old")
+		if tt.wantOld && string(old) != "old" {
+			t.Errorf("%s: exe.old = %q, %v; want the old binary", tt.goos, old, err)
+		}
+		if !tt.wantOld && err == nil {
+			t.Errorf("%s: old binary moved aside to exe.old", tt.goos)
+		}
+		entries, _ := os.ReadDir(dir)
+		if want := map[bool]int{false: 1, true: 2}[tt.wantOld]; len(entries) != want {
+			t.Errorf("%s: %d files left in the directory, want %d", tt.goos, len(entries), want)
+		}
+	}
+}
+
+func TestReplaceExecutableKeepsOldOnFailure(t *testing.T) {
+	// A non-empty directory can't be renamed over
+	exe := filepath.Join(t.TempDir(), binaryName)
+	if err := os.MkdirAll(filepath.Join(exe, "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceExecutable(exe, []byte("new"), "linux"); err == nil {
+		t.Fatal("replaced a non-empty directory")
+	}
+	if _, err := os.Stat(filepath.Join(exe, "keep")); err != nil {
+		t.Errorf("old content gone after a failed install: %v", err)
+	}
+	if _, err := os.Stat(exe + ".old"); err == nil {
+		t.Error("failed install left exe.old")
+	}
+}
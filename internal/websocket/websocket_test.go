@@ -0,0 +1,390 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey and testAccept are the handshake example of RFC 6455 section 1.3.
+const (
+	testKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	testAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// frame is one frame as the test client sends or receives it.
+type frame struct {
+	fin     bool
+	op      byte
+	payload []byte
+}
+
+// encode returns f as a client would send it: masked unless unmasked is
+// set, with the length in the shortest form.
+func (f frame) encode(unmasked bool) []byte {
+	b0 := f.op
+	if f.fin {
+		b0 |= 0x80
+	}
+	out := []byte{b0}
+	maskBit := byte(0x80)
+	if unmasked {
+		maskBit = 0
+	}
+	switch n := len(f.payload); {
+	case n <= 125:
+		out = append(out, maskBit|byte(n))
+	case n <= 0xFFFF:
+		out = append(out, maskBit|126)
+		out = binary.BigEndian.AppendUint16(out, uint16(n))
+	default:
+		out = append(out, maskBit|127)
+		out = binary.BigEndian.AppendUint64(out, uint64(n))
+	}
+	if unmasked {
+		return append(out, f.payload...)
+	}
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	out = append(out, mask[:]...)
+	for i, c := range f.payload {
+		out = append(out, c^mask[i%4])
+	}
+	return out
+}
+
+func text(s string) frame { return frame{fin: true, op: opText, payload: []byte(s)} }
+
+func closeFrame(code int, reason string) frame {
+	return frame{fin: true, op: opClose, payload: append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)}
+}
+
+// readServerFrame reads one frame from the server, which must be unmasked,
+// and returns it with the length form the header used (0 for 7-bit, 126
+// or 127).
+func readServerFrame(t *testing.T, br *bufio.Reader) (frame, byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+	n := uint64(hdr[1] & 0x7F)
+	form := byte(0)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		n, form = uint64(binary.BigEndian.Uint16(ext[:])), 126
+	case 127:
+		var ext [8]byte
+		io.ReadFull(br, ext[:])
+		n, form = binary.BigEndian.Uint64(ext[:]), 127
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+	return frame{fin: hdr[0]&0x80 != 0, op: hdr[0] & 0x0F, payload: payload}, form
+}
+
+// dial connects to srv and completes the opening handshake.
+func dial(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+testKey+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != testAccept {
+		t.Fatalf("Sec-WebSocket-Accept = %q, want %q", got, testAccept)
+	}
+	return conn, br
+}
+
+// echoServer upgrades each request, echoes its messages until ReadMessage
+// fails, and sends that error on errs.
+func echoServer(t *testing.T, limit int64) (*httptest.Server, <-chan error) {
+	errs := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if limit > 0 {
+			c.ReadLimit = limit
+		}
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			c.WriteText(msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, errs
+}
+
+func TestAcceptKey(t *testing.T) {
+	if got := acceptKey(testKey); got != testAccept {
+		t.Errorf("acceptKey = %q, want %q", got, testAccept)
+	}
+}
+
+func TestUpgradeRejectsNonWebSocketRequests(t *testing.T) {
+	upgrade := http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}}
+	tests := []struct {
+		name       string
+		method     string
+		header     http.Header
+		version    string
+		key        string
+		wantStatus int
+	}{
+		{"plain GET", http.MethodGet, http.Header{}, "13", testKey, http.StatusUpgradeRequired},
+		{"POST", http.MethodPost, upgrade, "13", testKey, http.StatusUpgradeRequired},
+		{"old version", http.MethodGet, upgrade, "8", testKey, http.StatusBadRequest},
+		{"no key", http.MethodGet, upgrade, "13", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.Header = tt.header.Clone()
+			r.Header.Set("Sec-WebSocket-Version", tt.version)
+			if tt.key != "" {
+				r.Header.Set("Sec-WebSocket-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			if _, err := Upgrade(w, r); err == nil {
+				t.Fatal("Upgrade succeeded")
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	long16 := strings.Repeat("a", 300)
+	long64 := strings.Repeat("b", 70000)
+	ping := frame{fin: true, op: opPing, payload: []byte("are you there")}
+
+	tests := []struct {
+		name     string
+		limit    int64
+		send     []frame
+		unmasked bool
+		want     []frame // frames the server sends back, in order
+		wantForm byte    // length form of the last frame in want
+		wantErr  error
+		wantCode int // close code sent by the server, for errors
+	}{
+		{
+			name: "short text",
+			send: []frame{text("hello")},
+			want: []frame{text("hello")},
+		},
+		{
+			name:     "16-bit length",
+			send:     []frame{text(long16)},
+			want:     []frame{text(long16)},
+			wantForm: 126,
+		},
+		{
+			name:     "64-bit length",
+			send:     []frame{text(long64)},
+			want:     []frame{text(long64)},
+			wantForm: 127,
+		},
+		{
+			name: "fragments with an interleaved ping",
+			send: []frame{
+				{op: opText, payload: []byte("hel")},
+				ping,
+				{op: opContinuation, payload: []byte("lo ")},
+				{fin: true, op: opContinuation, payload: []byte("world")},
+			},
+			want: []frame{{fin: true, op: opPong, payload: ping.payload}, text("hello world")},
+		},
+		{
+			name: "pong skipped",
+			send: []frame{{fin: true, op: opPong}, text("hi")},
+			want: []frame{text("hi")},
+		},
+		{
+			name:     "unmasked client frame",
+			send:     []frame{text("hello")},
+			unmasked: true,
+			wantErr:  ErrProtocol,
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "control frame over 125 bytes",
+			send:     []frame{{fin: true, op: opPing, payload: bytes.Repeat([]byte("p"), 126)}},
+			wantErr:  ErrProtocol,
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "fragmented control frame",
+			send:     []frame{{op: opPing, payload: []byte("p")}},
+			wantErr:  ErrProtocol,
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "continuation without a message",
+			send:     []frame{{fin: true, op: opContinuation, payload: []byte("x")}},
+			wantErr:  ErrProtocol,
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "new message inside a fragmented one",
+			send:     []frame{{op: opText, payload: []byte("a")}, text("b")},
+			wantErr:  ErrProtocol,
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "unknown opcode",
+			send:     []frame{{fin: true, op: 0x3}},
+			wantErr:  ErrProtocol,
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "frame over the read limit",
+			limit:    10,
+			send:     []frame{text("0123456789a")},
+			wantErr:  ErrMessageTooBig,
+			wantCode: CloseMessageTooBig,
+		},
+		{
+			name:     "fragments over the read limit",
+			limit:    10,
+			send:     []frame{{op: opText, payload: []byte("012345")}, {fin: true, op: opContinuation, payload: []byte("6789a")}},
+			wantErr:  ErrMessageTooBig,
+			wantCode: CloseMessageTooBig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, errs := echoServer(t, tt.limit)
+			conn, br := dial(t, srv)
+			for _, f := range tt.send {
+				conn.Write(f.encode(tt.unmasked))
+			}
+
+			for i, want := range tt.want {
+				got, form := readServerFrame(t, br)
+				if got.fin != want.fin || got.op != want.op || !bytes.Equal(got.payload, want.payload) {
+					t.Fatalf("frame %d = fin %v op %x %d bytes, want fin %v op %x %d bytes",
+						i, got.fin, got.op, len(got.payload), want.fin, want.op, len(want.payload))
+				}
+				if i == len(tt.want)-1 && form != tt.wantForm {
+					t.Errorf("length form = %d, want %d", form, tt.wantForm)
+				}
+			}
+			if tt.wantErr == nil {
+				return
+			}
+
+			got, _ := readServerFrame(t, br)
+			if got.op != opClose || len(got.payload) < 2 {
+				t.Fatalf("got op %x, want a close frame", got.op)
+			}
+			if code := int(binary.BigEndian.Uint16(got.payload)); code != tt.wantCode {
+				t.Errorf("close code = %d, want %d", code, tt.wantCode)
+			}
+			if err := <-errs; !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadMessage error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadMessageEchoesClose(t *testing.T) {
+	tests := []struct {
+		name       string
+		send       frame
+		wantCode   int
+		wantReason string
+	}{
+		{"with code", closeFrame(CloseGoingAway, "bye"), CloseGoingAway, "bye"},
+		{"without payload", frame{fin: true, op: opClose}, CloseNormal, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, errs := echoServer(t, 0)
+			conn, br := dial(t, srv)
+			conn.Write(tt.send.encode(false))
+
+			got, _ := readServerFrame(t, br)
+			if got.op != opClose || len(got.payload) < 2 {
+				t.Fatalf("got op %x, want a close frame", got.op)
+			}
+			if code := int(binary.BigEndian.Uint16(got.payload)); code != tt.wantCode {
+				t.Errorf("echoed close code = %d, want %d", code, tt.wantCode)
+			}
+			var closeErr *CloseError
+			if err := <-errs; !errors.As(err, &closeErr) {
+				t.Fatalf("ReadMessage error = %v, want a *CloseError", err)
+			}
+			if closeErr.Code != tt.wantCode || closeErr.Reason != tt.wantReason {
+				t.Errorf("CloseError = %d %q, want %d %q", closeErr.Code, closeErr.Reason, tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestWriteCloseOnce(t *testing.T) {
+	done := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.WriteClose(CloseNormal, strings.Repeat("r", 200))
+		c.WriteClose(CloseInternalError, "")
+		done <- c.WriteText([]byte("late"))
+	}))
+	t.Cleanup(srv.Close)
+	conn, br := dial(t, srv)
+
+	got, _ := readServerFrame(t, br)
+	if got.op != opClose || int(binary.BigEndian.Uint16(got.payload)) != CloseNormal {
+		t.Fatalf("first frame = op %x %q, want a 1000 close", got.op, got.payload)
+	}
+	if len(got.payload) != 125 {
+		t.Errorf("close payload = %d bytes, want the reason cut to fit 125", len(got.payload))
+	}
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close = %v, want net.ErrClosed", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("server sent more after its close frame")
+	}
+}
@@ -1,44 +1,82 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/tonghaoch/copilot-proxy-go/internal/api"
+	"github.com/tonghaoch/copilot-proxy-go/internal/audit"
 	"github.com/tonghaoch/copilot-proxy-go/internal/auth"
+	"github.com/tonghaoch/copilot-proxy-go/internal/buildinfo"
 	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/coord"
+	"github.com/tonghaoch/copilot-proxy-go/internal/daemon"
+	"github.com/tonghaoch/copilot-proxy-go/internal/handler"
+	"github.com/tonghaoch/copilot-proxy-go/internal/history"
 	"github.com/tonghaoch/copilot-proxy-go/internal/logger"
+	"github.com/tonghaoch/copilot-proxy-go/internal/mcp"
+	"github.com/tonghaoch/copilot-proxy-go/internal/notify"
+	"github.com/tonghaoch/copilot-proxy-go/internal/middleware"
 	"github.com/tonghaoch/copilot-proxy-go/internal/server"
 	"github.com/tonghaoch/copilot-proxy-go/internal/service"
 	"github.com/tonghaoch/copilot-proxy-go/internal/shell"
 	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+	"github.com/tonghaoch/copilot-proxy-go/internal/telemetry"
+	"github.com/tonghaoch/copilot-proxy-go/internal/tui"
+	"github.com/tonghaoch/copilot-proxy-go/internal/update"
 )
 
-var version = "dev"
-
 func main() {
+	var dataDir, configPath string
+
 	rootCmd := &cobra.Command{
 		Use:     "copilot-proxy-go",
 		Short:   "Turn GitHub Copilot into an OpenAI/Anthropic API compatible server",
-		Version: version,
+		Version: buildinfo.Get().Short(),
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if dataDir != "" {
+				state.SetDataDir(dataDir)
+			}
+			if configPath != "" {
+				state.SetConfigPath(configPath)
+			}
+		},
 	}
+	rootCmd.PersistentFlags().StringVar(&dataDir, "data-dir", "", "directory for token, config, and logs (env: "+state.DataDirEnv+")")
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config file to use instead of config.json in the data directory (env: "+state.ConfigEnv+")")
 
 	rootCmd.AddCommand(startCmd())
 	rootCmd.AddCommand(authCmd())
 	rootCmd.AddCommand(checkUsageCmd())
+	rootCmd.AddCommand(modelsCmd())
 	rootCmd.AddCommand(debugCmd())
+	rootCmd.AddCommand(upgradeCmd())
+	rootCmd.AddCommand(serviceCmd())
+	rootCmd.AddCommand(configCmd())
+	rootCmd.AddCommand(auditCmd())
+	rootCmd.AddCommand(historyCmd())
+	rootCmd.AddCommand(notifyCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -50,6 +88,7 @@ func main() {
 func startCmd() *cobra.Command {
 	var (
 		port             int
+		host             string
 		githubToken      string
 		accountType      string
 		showToken        bool
@@ -58,7 +97,16 @@ func startCmd() *cobra.Command {
 		rateLimitSeconds int
 		rateLimitWait    bool
 		claudeCode       bool
+		claudeCodePersist string
+		clipboard        string
 		proxyEnv         bool
+		configSets       []string
+		mcpMode          string
+		recordFixture    string
+		chaos            bool
+		vscodeVersion    string
+		requireFreshModels bool
+		exposeToken      bool
 	)
 
 	cmd := &cobra.Command{
@@ -66,21 +114,74 @@ func startCmd() *cobra.Command {
 		Short: "Start the Copilot API proxy server",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			setupLogging(verbose)
-			state.Global.SetAccountType(accountType)
+			switch mcpMode {
+			case "", "sse":
+			case "stdio":
+				if manualApprove || claudeCode {
+					return fmt.Errorf("--mcp=stdio can't be combined with --manual or --claude-code (both read stdin)")
+				}
+			default:
+				return fmt.Errorf("invalid --mcp %q (expected stdio or sse)", mcpMode)
+			}
+			// With MCP on stdio, stdout carries the protocol; everything
+			// else printed goes to stderr
+			mcpOut := os.Stdout
+			if mcpMode == "stdio" {
+				os.Stdout = os.Stderr
+			}
+			if claudeCodePersist != "" {
+				if !claudeCode {
+					return fmt.Errorf("--claude-code-persist needs --claude-code")
+				}
+				if !slices.Contains(shell.PersistModes, claudeCodePersist) {
+					return fmt.Errorf("invalid --claude-code-persist %q (expected %s)", claudeCodePersist, strings.Join(shell.PersistModes, " or "))
+				}
+			}
+			if !slices.Contains(shell.ClipboardModes, clipboard) {
+				return fmt.Errorf("invalid --clipboard %q (expected %s)", clipboard, strings.Join(shell.ClipboardModes, ", "))
+			}
+			if !slices.Contains(auth.ValidAccountTypes, accountType) {
+				return fmt.Errorf("invalid --account-type %q (expected %s)", accountType, strings.Join(auth.ValidAccountTypes, ", "))
+			}
+			if accountType != auth.AccountTypeAuto {
+				state.Global.SetAccountType(accountType)
+			}
 			state.Global.SetShowToken(showToken)
 			state.Global.SetVerbose(verbose)
+			if recordFixture != "" {
+				if err := os.MkdirAll(recordFixture, 0o755); err != nil {
+					return fmt.Errorf("failed to create fixture directory: %w", err)
+				}
+				state.Global.SetFixtureDir(recordFixture)
+				slog.Warn("recording stream fixtures; they keep message text, review before sharing", "dir", recordFixture)
+			}
 
-			slog.Info("copilot-proxy-go v" + version)
+			slog.Info("copilot-proxy-go v"+buildinfo.Version, "commit", buildinfo.Get().Commit)
 
 			if err := state.EnsurePaths(); err != nil {
 				return fmt.Errorf("failed to create app directories: %w", err)
 			}
 
+			if vscodeVersion != "" {
+				configSets = append(configSets, "editorIdentity.vscodeVersion="+vscodeVersion)
+			}
+			if exposeToken {
+				configSets = append(configSets, "auth.exposeToken=true")
+			}
+			if err := config.SetFlagOverrides(configSets); err != nil {
+				return err
+			}
 			if err := config.Load(); err != nil {
 				slog.Warn("failed to load config, using defaults: " + err.Error())
 			}
 			config.MergeDefaults()
 
+			// Non-blocking update check
+			update.CleanupOld()
+			if !config.Get().DisableUpdateCheck {
+				go update.CheckAndLog(buildinfo.Version)
+			}
+
 			// Proxy support
 			if proxyEnv {
 				setupProxy()
@@ -92,43 +193,69 @@ func startCmd() *cobra.Command {
 			go func() {
 				<-sigCh
 				slog.Info("shutting down...")
+				flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				telemetry.Flush(flushCtx)
+				cancel()
 				logger.CloseAll()
 				os.Exit(0)
 			}()
 
-			// VS Code version
-			vsVer := api.FetchVSCodeVersion()
-			state.Global.SetVSCodeVersion(vsVer)
-			slog.Info("VS Code version: " + vsVer)
+			// The CLI's proxy instance: the process-wide state, metrics and
+			// config
+			inst := cliInstance()
+			ctx := inst.Context(context.Background())
+
+			// Editor identity (VS Code and copilot-chat versions)
+			auth.SetupEditorIdentity(state.Global, config.Get(), true)
+			slog.Info("VS Code version: " + state.Global.GetVSCodeVersion())
 
 			// Auth
-			if err := auth.SetupAuth(githubToken); err != nil {
+			if err := auth.SetupAuth(ctx, state.Global, githubToken); err != nil {
 				return fmt.Errorf("authentication failed: %w", err)
 			}
+			auth.ResolveAccountType(state.Global, accountType)
 
 			// Models
+			state.Global.SetModelOverrides(config.Get().ModelOverrides)
 			slog.Info("fetching models...")
-			models, err := service.FetchModels()
+			models, err := service.FetchModels(ctx)
 			if err != nil {
-				return fmt.Errorf("failed to fetch models: %w", err)
+				if requireFreshModels {
+					return fmt.Errorf("failed to fetch models: %w", err)
+				}
+				cached, fetchedAt, cacheErr := service.CachedModels(ctx)
+				if cacheErr != nil {
+					return fmt.Errorf("failed to fetch models (and no cached list to start from): %w", err)
+				}
+				slog.Warn("failed to fetch models, starting with the cached list; retrying in the background",
+					"error", err, "cached_at", fetchedAt.Format(time.RFC3339))
+				models = cached
+				go service.RefreshModelsUntilFetched(ctx)
 			}
 			state.Global.SetModels(models)
+			config.Get().EffectiveSmallModel(state.Global) // warns if smallModel was removed
 
-			ids := make([]string, len(models))
-			for i, m := range models {
-				ids[i] = m.ID
-			}
-			sort.Strings(ids)
+			if verbose {
+				// Where each model routes, for predicting backends
+				fmt.Fprintf(os.Stderr, "\n  Routing table (%d models):\n\n", len(models))
+				printRoutingTable(os.Stderr, handler.RoutingTable(ctx, state.Global.GetModels()))
+			} else {
+				ids := make([]string, len(models))
+				for i, m := range models {
+					ids[i] = m.ID
+				}
+				sort.Strings(ids)
 
-			fmt.Fprintf(os.Stderr, "\n  Available models (%d):\n", len(models))
-			for _, id := range ids {
-				fmt.Fprintf(os.Stderr, "    • %s\n", id)
+				fmt.Fprintf(os.Stderr, "\n  Available models (%d):\n", len(models))
+				for _, id := range ids {
+					fmt.Fprintf(os.Stderr, "    • %s\n", id)
+				}
 			}
 			fmt.Fprintln(os.Stderr)
 
 			// Claude Code interactive setup
 			if claudeCode {
-				if err := runClaudeCodeSetup(port, models); err != nil {
+				if err := runClaudeCodeSetup(port, models, claudeCodePersist, clipboard); err != nil {
 					slog.Warn("claude-code setup failed", "error", err)
 				}
 			}
@@ -136,29 +263,116 @@ func startCmd() *cobra.Command {
 			// Start server
 			fmt.Println()
 			fmt.Printf("  Copilot API proxy is running on http://localhost:%d\n", port)
-			fmt.Printf("  Dashboard: http://localhost:%d/dashboard?endpoint=http://localhost:%d/usage\n", port, port)
+			fmt.Printf("  Dashboard: http://localhost:%d/dashboard\n", port)
 			fmt.Println()
 
-			srv := server.New(server.Options{
+			// Audit log
+			var auditLog *audit.Writer
+			if config.Get().Audit.Enabled {
+				key, err := audit.LoadKey(state.AuditKeyPath())
+				if err != nil {
+					return fmt.Errorf("failed to load audit key: %w", err)
+				}
+				path := config.Get().AuditLogPath(state.Global)
+				auditLog, err = audit.Open(path, key)
+				if err != nil {
+					return err
+				}
+				slog.Info("audit log enabled", "path", path)
+			}
+			if config.Get().History.Enabled {
+				slog.Warn("transcript history enabled: prompt and response text is stored on disk", "path", state.HistoryPath())
+			}
+
+			// Premium request accounting for /api/stats
+			state.Metrics.SetPremiumCost(func(rec state.RequestRecord) float64 {
+				return service.PremiumCost(ctx, rec)
+			})
+
+			// Notifications: the circuit breaker and token refresh send
+			// theirs as they happen; the premium quota has to be polled
+			if config.Get().NotificationsEnabled() {
+				go service.PollPremiumQuota(ctx)
+			}
+
+			// Coordination with other instances
+			var rateLimitStore middleware.RateLimitStore
+			if redisURL := config.Get().Coordination.RedisURL; redisURL != "" {
+				client, err := coord.NewClient(redisURL)
+				if err != nil {
+					return err
+				}
+				instance := config.Get().Coordination.InstanceID
+				if instance == "" {
+					host, _ := os.Hostname()
+					instance = fmt.Sprintf("%s:%d", host, port)
+				}
+				client.Do("PING") // an unreachable server is logged, not fatal
+				ns := config.Get().CoordinationNamespace()
+				rateLimitStore = coord.NewRateLimit(client, ns)
+				state.Metrics.SetShared(coord.NewMetrics(client, ns, instance), instance)
+				slog.Info("coordination enabled", "redis", client.Addr(), "namespace", ns, "instance", instance)
+			}
+
+			// MCP server
+			var mcpServer *mcp.Server
+			switch mcpMode {
+			case "stdio":
+				mcpServer = mcp.NewServer(buildinfo.Version)
+				go func() {
+					if err := mcpServer.ServeStdio(ctx, os.Stdin, mcpOut); err != nil {
+						slog.Error("mcp stdio failed", "error", err)
+					}
+					// The MCP client owns the process; stdin closing means it's gone
+					slog.Info("mcp client disconnected, shutting down...")
+					logger.CloseAll()
+					os.Exit(0)
+				}()
+				slog.Info("mcp server enabled on stdio")
+			case "sse":
+				mcpServer = mcp.NewServer(buildinfo.Version)
+				slog.Info(fmt.Sprintf("mcp server enabled on http://localhost:%d/mcp/sse", port))
+			}
+
+			opts := server.Options{
 				Port:             port,
+				Host:             host,
 				ManualApprove:    manualApprove,
 				RateLimitSeconds: rateLimitSeconds,
 				RateLimitWait:    rateLimitWait,
-			})
+				RateLimitStore:   rateLimitStore,
+				AuditLog:         auditLog,
+				Version:          buildinfo.Version,
+				Chaos:            chaos,
+			}
+			if mcpMode == "sse" {
+				opts.MCP = mcpServer
+			}
+			srv := server.New(inst, opts)
 			return srv.ListenAndServe()
 		},
 	}
 
 	cmd.Flags().IntVarP(&port, "port", "p", 4141, "port to listen on")
+	cmd.Flags().StringVar(&host, "host", "", "host or IP to listen on (default: all interfaces)")
 	cmd.Flags().StringVarP(&githubToken, "github-token", "g", "", "GitHub OAuth token (skips device code flow)")
-	cmd.Flags().StringVarP(&accountType, "account-type", "a", "individual", "Copilot account type: individual, business, enterprise")
+	cmd.Flags().StringVarP(&accountType, "account-type", "a", auth.AccountTypeAuto, "Copilot account type: auto, individual, business, enterprise")
 	cmd.Flags().BoolVar(&showToken, "show-token", false, "print tokens to console")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose logging")
 	cmd.Flags().BoolVar(&manualApprove, "manual", false, "require manual CLI approval for each request")
 	cmd.Flags().IntVarP(&rateLimitSeconds, "rate-limit", "r", 0, "minimum seconds between requests (0 = disabled)")
 	cmd.Flags().BoolVarP(&rateLimitWait, "wait", "w", false, "wait instead of rejecting on rate limit")
 	cmd.Flags().BoolVarP(&claudeCode, "claude-code", "c", false, "interactive model selection + env var generation for Claude Code")
+	cmd.Flags().StringVar(&clipboard, "clipboard", shell.ClipboardAuto, "how --claude-code copies its command: auto, osc52, native or off")
+	cmd.Flags().StringVar(&claudeCodePersist, "claude-code-persist", "", "save the --claude-code env vars instead of printing a command: profile (PowerShell profile) or setx (Windows user env)")
 	cmd.Flags().BoolVar(&proxyEnv, "proxy-env", false, "enable HTTP proxy from environment variables")
+	cmd.Flags().StringVar(&mcpMode, "mcp", "", "serve an MCP server exposing proxy controls: stdio or sse")
+	cmd.Flags().StringArrayVar(&configSets, "set", nil, "override a config field, e.g. --set smallModel=gpt-4.1 (repeatable)")
+	cmd.Flags().StringVar(&vscodeVersion, "vscode-version", "", "VS Code version to send instead of looking it up (sets editorIdentity.vscodeVersion)")
+	cmd.Flags().BoolVar(&chaos, "chaos", false, "let X-Chaos request headers inject upstream failures, for testing client retries")
+	cmd.Flags().BoolVar(&exposeToken, "expose-token", false, "serve GET /token and /token/github to API-key clients (sets auth.exposeToken)")
+	cmd.Flags().BoolVar(&requireFreshModels, "require-fresh-models", false, "exit if the models can't be fetched instead of starting with the cached list")
+	cmd.Flags().StringVar(&recordFixture, "record-fixture", "", "record streamed upstream responses as sanitized test fixtures in this directory")
 
 	return cmd
 }
@@ -190,7 +404,7 @@ func authCmd() *cobra.Command {
 			}
 
 			slog.Info("starting authentication...")
-			if err := auth.SetupAuth(""); err != nil {
+			if err := auth.SetupAuth(cliInstance().Context(context.Background()), state.Global, ""); err != nil {
 				return fmt.Errorf("authentication failed: %w", err)
 			}
 
@@ -221,7 +435,7 @@ func checkUsageCmd() *cobra.Command {
 			}
 
 			// Load token
-			token, err := auth.LoadToken()
+			token, err := auth.LoadToken(state.Global)
 			if err != nil || token == "" {
 				return fmt.Errorf("no GitHub token found. Run 'auth' first")
 			}
@@ -233,7 +447,7 @@ func checkUsageCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			req.Header = api.BuildGitHubHeadersFromState()
+			req.Header = api.BuildGitHubHeaders(state.Global, state.Global.GetGithubToken())
 
 			resp, err := http.DefaultClient.Do(req)
 			if err != nil {
@@ -304,6 +518,87 @@ func checkUsageCmd() *cobra.Command {
 	return cmd
 }
 
+// --- models command ---
+
+func modelsCmd() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "models",
+		Short: "Print the routing table: each model's limits, backend, and config",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setupLogging(false)
+
+			if err := state.EnsurePaths(); err != nil {
+				return err
+			}
+			if err := config.Load(); err != nil {
+				slog.Warn("failed to load config, using defaults: " + err.Error())
+			}
+
+			models, err := fetchModelsWithSavedToken()
+			if err != nil {
+				cached, fetchedAt, cacheErr := service.CachedModels(cliInstance().Context(context.Background()))
+				if cacheErr != nil {
+					return fmt.Errorf("%w (and no cached models list)", err)
+				}
+				fmt.Fprintf(os.Stderr, "  (%v — using the models list cached %s)\n", err, fetchedAt.Format(time.RFC3339))
+				models = cached
+			}
+			state.Global.SetModelOverrides(config.Get().ModelOverrides)
+			state.Global.SetModels(models)
+			routes := handler.RoutingTable(cliInstance().Context(context.Background()), state.Global.GetModels())
+
+			if jsonOutput {
+				data, _ := json.MarshalIndent(routes, "", "  ")
+				fmt.Println(string(data))
+				return nil
+			}
+			fmt.Println()
+			printRoutingTable(os.Stdout, routes)
+			fmt.Println()
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "output as JSON")
+
+	return cmd
+}
+
+// printRoutingTable writes routes as an aligned table. The small model is
+// marked with an asterisk.
+func printRoutingTable(w io.Writer, routes []handler.ModelRoute) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  MODEL\tCONTEXT\tMAX OUTPUT\tENDPOINTS\tBACKEND\tEFFORT\tEXTRA PROMPT")
+	dash := func(v string) string {
+		if v == "" {
+			return "-"
+		}
+		return v
+	}
+	tokens := func(n int) string {
+		if n <= 0 {
+			return "-"
+		}
+		return formatTokenCount(n)
+	}
+	for _, r := range routes {
+		id := r.ID
+		if r.SmallModel {
+			id += " *"
+		}
+		extra := ""
+		if r.ExtraPrompt {
+			extra = "yes"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, tokens(r.ContextWindow), tokens(r.MaxOutputTokens),
+			dash(strings.Join(r.SupportedEndpoints, ",")), dash(r.Backend), r.ReasoningEffort, dash(extra))
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\n  * small model. Backends are for /v1/messages without X-Backend or a failover.")
+}
+
 // --- debug command ---
 
 func debugCmd() *cobra.Command {
@@ -318,22 +613,55 @@ func debugCmd() *cobra.Command {
 				tokenExists = true
 			}
 
+			configPath, configSource := state.ResolveConfigPath()
 			configExists := false
-			if _, err := os.Stat(state.ConfigPath()); err == nil {
+			if _, err := os.Stat(configPath); err == nil {
 				configExists = true
 			}
 
+			// Detected plan, when a saved token lets us ask
+			plan, detectedAccountType := "", ""
+			if token, err := auth.LoadToken(state.Global); err == nil && token != "" {
+				state.Global.SetVSCodeVersion(api.FallbackVSCodeVersion)
+				if p, err := auth.FetchCopilotPlan(state.Global, token); err == nil {
+					plan, detectedAccountType = p.String(), p.AccountType()
+				} else {
+					plan = "unknown (" + err.Error() + ")"
+				}
+			}
+
+			// Identity headers as start would send them, without lookups
+			if err := config.Load(); err != nil {
+				slog.Warn("failed to load config, using defaults: " + err.Error())
+			}
+			auth.SetupEditorIdentity(state.Global, config.Get(), false)
+			identity := api.IdentityHeaders(state.Global)
+			identityHeaders := make(map[string]string, len(identity))
+			for name := range identity {
+				identityHeaders[name] = identity.Get(name)
+			}
+
+			build := buildinfo.Get()
 			info := map[string]any{
-				"version":       version,
+				"version":       buildinfo.Version,
 				"runtime":       "go",
 				"go_version":    runtime.Version(),
+				"commit":        build.Commit,
+				"build_date":    build.Date,
+				"modified":      build.Modified,
 				"platform":      runtime.GOOS,
 				"arch":          runtime.GOARCH,
 				"app_dir":       state.AppDir(),
+				"app_dir_chain": state.ResolveAppDir(),
 				"token_path":    state.TokenPath(),
-				"config_path":   state.ConfigPath(),
+				"config_path":   configPath,
+				"config_source": configSource,
+				"config_overridden": configSource != "app dir",
 				"token_exists":  tokenExists,
 				"config_exists": configExists,
+				"copilot_plan":  plan,
+				"account_type":  detectedAccountType,
+				"identity_headers": identityHeaders,
 			}
 
 			if jsonOutput {
@@ -343,12 +671,38 @@ func debugCmd() *cobra.Command {
 				fmt.Println()
 				fmt.Println("  copilot-proxy-go debug info")
 				fmt.Println("  ───────────────────────────")
-				fmt.Printf("  Version:       %s\n", version)
+				fmt.Printf("  Version:       %s\n", build.Short())
+				if build.Date != "" {
+					fmt.Printf("  Built:         %s\n", build.Date)
+				}
 				fmt.Printf("  Runtime:       Go %s\n", runtime.Version())
 				fmt.Printf("  Platform:      %s/%s\n", runtime.GOOS, runtime.GOARCH)
 				fmt.Printf("  App dir:       %s\n", state.AppDir())
+				for _, c := range state.ResolveAppDir() {
+					marker := " "
+					if c.Chosen {
+						marker = "*"
+					}
+					fmt.Printf("    %s %-18s %s (exists: %v)\n", marker, c.Source, c.Path, c.Exists)
+				}
 				fmt.Printf("  Token path:    %s (exists: %v)\n", state.TokenPath(), tokenExists)
-				fmt.Printf("  Config path:   %s (exists: %v)\n", state.ConfigPath(), configExists)
+				fmt.Printf("  Config path:   %s (exists: %v)\n", configPath, configExists)
+				if configSource != "app dir" {
+					fmt.Printf("    overridden by %s\n", configSource)
+				}
+				if plan != "" {
+					fmt.Printf("  Copilot plan:  %s\n", plan)
+				}
+				if detectedAccountType != "" {
+					fmt.Printf("  Account type:  %s (use with --account-type, or leave as auto)\n", detectedAccountType)
+				}
+				fmt.Println("  Identity headers:")
+				for _, name := range slices.Sorted(maps.Keys(identityHeaders)) {
+					fmt.Printf("    %s: %s\n", name, identityHeaders[name])
+				}
+				if config.Get().EditorIdentity.VSCodeVersion == "" {
+					fmt.Println("    (start looks up the VS Code version when the cached one is over a day old)")
+				}
 				fmt.Println()
 			}
 			return nil
@@ -360,6 +714,433 @@ func debugCmd() *cobra.Command {
 	return cmd
 }
 
+// --- upgrade command ---
+
+func upgradeCmd() *cobra.Command {
+	var checkOnly bool
+
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade to the latest release from GitHub",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setupLogging(false)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+
+			rel, err := update.FetchLatest(ctx)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("\n  Current version: %s\n", buildinfo.Version)
+			fmt.Printf("  Latest version:  %s\n", rel.Version())
+
+			if !update.IsNewer(buildinfo.Version, rel.Version()) {
+				fmt.Println("\n  Already up to date.")
+				return nil
+			}
+			if checkOnly {
+				fmt.Printf("\n  Update available: %s\n\n", rel.HTMLURL)
+				return nil
+			}
+
+			fmt.Println("\n  Downloading...")
+			binary, err := update.Download(ctx, rel)
+			if err != nil {
+				return fmt.Errorf("download failed: %w", err)
+			}
+			if err := update.Apply(binary); err != nil {
+				return fmt.Errorf("upgrade failed: %w", err)
+			}
+
+			fmt.Printf("  Upgraded to v%s\n\n", rel.Version())
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&checkOnly, "check-only", false, "only report whether a newer version exists")
+
+	return cmd
+}
+
+// --- service command ---
+
+func serviceCmd() *cobra.Command {
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "service",
+		Short: "Manage the proxy as a systemd (Linux) or launchd (macOS) service",
+	}
+
+	install := &cobra.Command{
+		Use:   "install [-- start flags...]",
+		Short: "Install and start the service; arguments after -- are passed to 'start'",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemon.Install(daemon.Options{Args: args, DryRun: dryRun})
+		},
+	}
+	install.Flags().BoolVar(&dryRun, "dry-run", false, "print the service definition and commands without applying them")
+
+	uninstall := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Stop and remove the service",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemon.Uninstall(daemon.Options{DryRun: dryRun})
+		},
+	}
+	uninstall.Flags().BoolVar(&dryRun, "dry-run", false, "print the commands without applying them")
+
+	status := &cobra.Command{
+		Use:   "status",
+		Short: "Show service status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemon.Status(daemon.Options{})
+		},
+	}
+
+	cmd.AddCommand(install, uninstall, status)
+	return cmd
+}
+
+// --- config command ---
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Validate, show, or edit the config file",
+	}
+
+	var offline bool
+	validate := &cobra.Command{
+		Use:   "validate",
+		Short: "Check config.json for syntax errors, unknown keys, and bad values",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setupLogging(false)
+			data, err := os.ReadFile(state.ConfigPath())
+			if err != nil {
+				return fmt.Errorf("reading config: %w", err)
+			}
+
+			var models []string
+			if !offline {
+				models = fetchModelIDsForValidation()
+			}
+
+			issues := config.Validate(data, models)
+			printConfigIssues(issues)
+			if config.HasErrors(issues) {
+				return fmt.Errorf("config has errors")
+			}
+			return nil
+		},
+	}
+	validate.Flags().BoolVar(&offline, "offline", false, "skip checking model names against the Copilot models list")
+
+	var showSets []string
+	show := &cobra.Command{
+		Use:   "show",
+		Short: "Print the effective config with secrets redacted and value sources",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setupLogging(false)
+			if err := config.SetFlagOverrides(showSets); err != nil {
+				return err
+			}
+			if err := config.Load(); err != nil {
+				slog.Warn("failed to load config, using defaults: " + err.Error())
+			}
+			data, err := json.MarshalIndent(config.Get().Redacted(), "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+
+			sources := config.Sources()
+			fmt.Println("\n  Sources (flag > env > file > default):")
+			for _, f := range config.Fields {
+				src := string(sources[f.Path])
+				if sources[f.Path] == config.SourceEnv {
+					src += " (" + f.Env + ")"
+				}
+				fmt.Printf("    %-24s %s\n", f.Path, src)
+			}
+			fmt.Println()
+			return nil
+		},
+	}
+	show.Flags().StringArrayVar(&showSets, "set", nil, "apply a config override as 'start --set' would")
+
+	edit := &cobra.Command{
+		Use:   "edit",
+		Short: "Open config.json in $EDITOR and validate on save",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setupLogging(false)
+			if err := state.EnsurePaths(); err != nil {
+				return err
+			}
+			if err := config.Load(); err != nil {
+				slog.Warn("failed to load config: " + err.Error())
+			}
+			return editConfig()
+		},
+	}
+
+	cmd.AddCommand(validate, show, edit)
+	return cmd
+}
+
+// --- audit command ---
+
+func auditCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log",
+	}
+
+	var keyFile string
+	verify := &cobra.Command{
+		Use:   "verify <file>",
+		Short: "Check the audit log's HMAC chain for edits, removed lines, and truncation",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if keyFile == "" {
+				keyFile = state.AuditKeyPath()
+			}
+			key, err := audit.ReadKey(keyFile)
+			if err != nil {
+				return fmt.Errorf("reading audit key: %w", err)
+			}
+
+			entries, headMissing, err := audit.Verify(args[0], key)
+			if err != nil {
+				return fmt.Errorf("audit log verification failed after %d valid entries: %w", entries, err)
+			}
+			fmt.Printf("  OK: %d entries, chain intact\n", entries)
+			if headMissing {
+				fmt.Printf("  Warning: %s not found; truncation of the end of the log can't be detected\n", audit.HeadPath(args[0]))
+			}
+			return nil
+		},
+	}
+	verify.Flags().StringVar(&keyFile, "key-file", "", "HMAC key file (default: audit_key in the data directory)")
+
+	cmd.AddCommand(verify)
+	return cmd
+}
+
+// --- notify command ---
+
+func notifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "notify",
+		Short: "Check the notifications config",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "test",
+		Short: "Send a test notification to the configured webhook and command",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := config.Load(); err != nil {
+				slog.Warn("failed to load config, using defaults: " + err.Error())
+			}
+			if !config.Get().NotificationsEnabled() {
+				return fmt.Errorf("notifications.webhookURL and notifications.command are both unset")
+			}
+			n := notify.New(notify.EventTest, "copilot-proxy-go test notification",
+				"Notifications from copilot-proxy-go reach this destination.")
+			ctx, cancel := context.WithTimeout(cliInstance().Context(context.Background()), 30*time.Second)
+			defer cancel()
+			if err := notify.Deliver(ctx, n); err != nil {
+				return fmt.Errorf("notification failed: %w", err)
+			}
+			cfg := config.Get().Notifications
+			if cfg.WebhookURL != "" {
+				fmt.Printf("  OK: posted to the webhook (%s format)\n", notify.WebhookFormat(config.Get(), cfg.WebhookURL))
+			}
+			if cfg.Command != "" {
+				fmt.Printf("  OK: ran %s\n", cfg.Command)
+			}
+			return nil
+		},
+	})
+	return cmd
+}
+
+// --- history command ---
+
+func historyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Export or purge the transcript history (history.enabled)",
+	}
+
+	var (
+		output string
+		days   int
+	)
+	export := &cobra.Command{
+		Use:   "export",
+		Short: "Write history entries as JSON lines, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var since time.Time
+			if days > 0 {
+				since = time.Now().AddDate(0, 0, -days)
+			}
+			w := os.Stdout
+			if output != "" {
+				f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			n, err := history.Export(state.HistoryPath(), since, w)
+			if err != nil {
+				return fmt.Errorf("exporting history: %w", err)
+			}
+			if output != "" {
+				fmt.Printf("  Exported %d entries to %s\n", n, output)
+			}
+			return nil
+		},
+	}
+	export.Flags().StringVarP(&output, "output", "o", "", "file to write (default: stdout)")
+	export.Flags().IntVar(&days, "days", 0, "only entries from the last N days (0 = all)")
+
+	var (
+		all       bool
+		olderThan int
+	)
+	purge := &cobra.Command{
+		Use:   "purge",
+		Short: "Delete history entries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all == (olderThan > 0) {
+				return fmt.Errorf("pass either --all or --older-than-days")
+			}
+			var before time.Time
+			if olderThan > 0 {
+				before = time.Now().AddDate(0, 0, -olderThan)
+			}
+			n, err := history.Purge(state.HistoryPath(), before)
+			if err != nil {
+				return fmt.Errorf("purging history: %w", err)
+			}
+			fmt.Printf("  Removed %d entries from %s\n", n, state.HistoryPath())
+			return nil
+		},
+	}
+	purge.Flags().BoolVar(&all, "all", false, "delete every entry")
+	purge.Flags().IntVar(&olderThan, "older-than-days", 0, "delete entries older than N days")
+
+	cmd.AddCommand(export, purge)
+	return cmd
+}
+
+// fetchModelIDsForValidation authenticates with the saved token and returns
+// the live model IDs, or nil if that isn't possible.
+func fetchModelIDsForValidation() []string {
+	models, err := fetchModelsWithSavedToken()
+	if err != nil {
+		fmt.Printf("  (%v — skipping model name checks)\n", err)
+		return nil
+	}
+	ids := make([]string, len(models))
+	for i, m := range models {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// cliInstance returns a proxy instance serving the process-wide state,
+// metrics and config, as the CLI's commands do.
+func cliInstance() *server.Instance {
+	return server.NewInstance(state.Global, state.Metrics, config.Global, nil)
+}
+
+// fetchModelsWithSavedToken authenticates with the saved token and returns
+// the live models list.
+func fetchModelsWithSavedToken() ([]state.Model, error) {
+	token, err := auth.LoadToken(state.Global)
+	if err != nil || token == "" {
+		return nil, fmt.Errorf("no GitHub token")
+	}
+	state.Global.SetGithubToken(token)
+	state.Global.SetVSCodeVersion(api.FallbackVSCodeVersion)
+
+	copilotToken, err := auth.FetchCopilotToken(state.Global, token)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch Copilot token: %w", err)
+	}
+	state.Global.SetCopilotToken(copilotToken.Token)
+
+	models, err := service.FetchModels(cliInstance().Context(context.Background()))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch models: %w", err)
+	}
+	return models, nil
+}
+
+func printConfigIssues(issues []config.Issue) {
+	fmt.Println()
+	if len(issues) == 0 {
+		fmt.Printf("  %s is valid\n\n", state.ConfigPath())
+		return
+	}
+	fmt.Printf("  %s:\n", state.ConfigPath())
+	for _, issue := range issues {
+		fmt.Printf("    %s\n", issue)
+	}
+	fmt.Println()
+}
+
+// editConfig opens the config in the user's editor, re-opening it until the
+// file validates or the user gives up.
+func editConfig() error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		parts := strings.Fields(editor)
+		c := exec.Command(parts[0], append(parts[1:], state.ConfigPath())...)
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("running editor: %w", err)
+		}
+
+		data, err := os.ReadFile(state.ConfigPath())
+		if err != nil {
+			return err
+		}
+		issues := config.Validate(data, nil)
+		printConfigIssues(issues)
+		if !config.HasErrors(issues) {
+			return nil
+		}
+
+		fmt.Print("  Config has errors. Edit again? [Y/n]: ")
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(strings.ToLower(input))
+		if input == "n" || input == "no" {
+			return fmt.Errorf("config has errors")
+		}
+	}
+}
+
 // --- helpers ---
 
 // toInt converts an any value (typically float64 from JSON) to int.
@@ -417,9 +1198,22 @@ func (h *cleanHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
 func (h *cleanHandler) WithGroup(name string) slog.Handler       { return h }
 
 func setupProxy() {
+	// A custom TLSClientConfig turns HTTP/2 off unless forced. Parallel
+	// subagents need more idle connections per host than the default 2, or
+	// most requests pay for a new TLS handshake.
 	transport := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
 	}
 	http.DefaultClient.Transport = transport
 
@@ -431,32 +1225,29 @@ func setupProxy() {
 	}
 }
 
-func runClaudeCodeSetup(port int, models []state.Model) error {
-	// Display model list for selection
-	fmt.Println()
-	fmt.Println("  Select primary model:")
-	for i, m := range models {
-		fmt.Printf("    %d. %s\n", i+1, m.ID)
+func runClaudeCodeSetup(port int, models []state.Model, persist, clipboard string) error {
+	// The selector on a terminal, numbered prompts otherwise
+	in := bufio.NewReader(os.Stdin)
+	pick := func(title string, items []tui.Item) (int, error) {
+		return tui.Prompt(in, os.Stdout, title, items)
 	}
-	fmt.Print("\n  Enter number: ")
-
-	var primaryIdx int
-	if _, err := fmt.Scan(&primaryIdx); err != nil || primaryIdx < 1 || primaryIdx > len(models) {
-		return fmt.Errorf("invalid selection")
-	}
-	primaryModel := models[primaryIdx-1].ID
-
-	fmt.Println("\n  Select small/fast model:")
-	for i, m := range models {
-		fmt.Printf("    %d. %s\n", i+1, m.ID)
+	restore := func() {}
+	if tui.IsTerminal(os.Stdin) && tui.IsTerminal(os.Stdout) {
+		if r, err := tui.MakeRaw(os.Stdin); err == nil {
+			restore = r
+			fmt.Println()
+			pick = func(title string, items []tui.Item) (int, error) {
+				return tui.Select(in, os.Stdout, title, items)
+			}
+		} else {
+			slog.Debug("no raw terminal, using the numbered model prompt", "error", err)
+		}
 	}
-	fmt.Print("\n  Enter number: ")
-
-	var smallIdx int
-	if _, err := fmt.Scan(&smallIdx); err != nil || smallIdx < 1 || smallIdx > len(models) {
-		return fmt.Errorf("invalid selection")
+	primaryModel, smallModel, err := chooseClaudeCodeModels(models, pick)
+	restore()
+	if err != nil {
+		return err
 	}
-	smallModel := models[smallIdx-1].ID
 
 	baseURL := fmt.Sprintf("http://localhost:%d", port)
 
@@ -471,6 +1262,18 @@ func runClaudeCodeSetup(port int, models []state.Model) error {
 		{Key: "CLAUDE_CODE_DISABLE_NONESSENTIAL_TRAFFIC", Value: "1"},
 	}
 
+	if persist != "" {
+		where, err := shell.Persist(persist, vars)
+		if err != nil {
+			return err
+		}
+		fmt.Println()
+		fmt.Printf("  Saved the Claude Code settings to %s.\n", where)
+		fmt.Println("  Open a new terminal and run: claude")
+		fmt.Println()
+		return nil
+	}
+
 	shellType := shell.Detect()
 	script := shell.GenerateExportScript(shellType, vars, "claude")
 
@@ -480,13 +1283,61 @@ func runClaudeCodeSetup(port int, models []state.Model) error {
 	fmt.Printf("  %s\n", script)
 	fmt.Println()
 
-	if err := shell.CopyToClipboard(script); err != nil {
-		fmt.Println("  (Could not copy to clipboard — paste the command above)")
-	} else {
-		fmt.Println("  Copied to clipboard!")
+	if clipboard != shell.ClipboardOff {
+		switch method, err := shell.CopyToClipboard(script, clipboard); {
+		case err != nil:
+			slog.Debug("clipboard copy failed", "error", err)
+			fmt.Println("  (Could not copy to clipboard — paste the command above)")
+		case method == shell.MethodOSC52:
+			fmt.Println("  Sent to the terminal clipboard (OSC 52) — if pasting doesn't work, copy the command above")
+		default:
+			fmt.Printf("  Copied to clipboard (%s)!\n", method)
+		}
+		fmt.Println()
 	}
-	fmt.Println()
 
 	return nil
 }
 
+// chooseClaudeCodeModels asks pick for the primary and then the small
+// model, offering every model with its context window and the backend
+// /v1/messages uses for it, and returns their IDs.
+func chooseClaudeCodeModels(models []state.Model, pick func(title string, items []tui.Item) (int, error)) (primary, small string, err error) {
+	if len(models) == 0 {
+		return "", "", fmt.Errorf("no models to choose from")
+	}
+	items := make([]tui.Item, len(models))
+	for i := range models {
+		m := &models[i]
+		window := "context ?"
+		if n := m.Capabilities.Limits.MaxContextWindowTokens; n > 0 {
+			window = "context " + formatTokenCount(n)
+		}
+		items[i] = tui.Item{Label: m.ID, Detail: window + " · " + handler.MessagesBackend(m)}
+	}
+	i, err := pick("Primary model:", items)
+	if err != nil {
+		return "", "", err
+	}
+	j, err := pick("Small/fast model:", items)
+	if err != nil {
+		return "", "", err
+	}
+	return models[i].ID, models[j].ID, nil
+}
+
+// formatTokenCount shortens a token count: 128000 → "128k", 1048576 → "1M",
+// 1500000 → "1.5M".
+func formatTokenCount(n int) string {
+	switch {
+	case n >= 1_000_000:
+		tenths := (n + 50_000) / 100_000
+		if tenths%10 == 0 {
+			return strconv.Itoa(tenths/10) + "M"
+		}
+		return fmt.Sprintf("%d.%dM", tenths/10, tenths%10)
+	case n >= 1000:
+		return strconv.Itoa((n+500)/1000) + "k"
+	}
+	return strconv.Itoa(n)
+}
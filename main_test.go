@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+	"github.com/tonghaoch/copilot-proxy-go/internal/tui"
+)
+
+func TestChooseClaudeCodeModels(t *testing.T) {
+	models := []state.Model{
+		{ID: "claude-sonnet-4.5", SupportedEndpoints: []string{"/v1/messages", "/chat/completions"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 200000}}},
+		{ID: "claude-haiku-4.5", SupportedEndpoints: []string{"/v1/messages"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 144000}}},
+		{ID: "gpt-5", SupportedEndpoints: []string{"/responses"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 400000}}},
+		{ID: "gpt-5-mini", SupportedEndpoints: []string{"/chat/completions", "/responses"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 264000}}},
+		{ID: "gpt-4.1", SupportedEndpoints: []string{"/chat/completions"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 1048576}}},
+		{ID: "gemini-2.5-pro"},
+	}
+	const (
+		up    = "\x1b[A"
+		down  = "\x1b[B"
+		bksp  = "\x7f"
+		enter = "\r"
+	)
+	tests := []struct {
+		name           string
+		picker         string // select (terminal) or prompt (numbered)
+		models         []state.Model
+		input          string
+		primary, small string
+		err            error
+	}{
+		// The selector: type to filter, arrows to move, Enter to pick
+		{"select first", "select", models, enter + enter, "claude-sonnet-4.5", "claude-sonnet-4.5", nil},
+		{"select by arrows", "select", models, down + down + enter + down + enter, "gpt-5", "claude-haiku-4.5", nil},
+		{"arrows wrap", "select", models, up + enter + "\x10" + "\x10" + enter, "gemini-2.5-pro", "gpt-4.1", nil},
+		{"filter", "select", models, "haiku" + enter + "gpt-5-m" + enter, "claude-haiku-4.5", "gpt-5-mini", nil},
+		{"fuzzy filter", "select", models, "cs45" + enter + "g41" + enter, "claude-sonnet-4.5", "gpt-4.1", nil},
+		// Contiguous matches first, earliest first: "mini" is at 2 in
+		// "gemini-2.5-pro", at 6 in "gpt-5-mini"
+		{"earlier match first", "select", models, "mini" + enter + "gpt-5" + down + enter, "gemini-2.5-pro", "gpt-5-mini", nil},
+		{"fewest gaps first", "select", models, "g5" + enter + "-4" + enter, "gpt-5", "gpt-4.1", nil},
+		{"filter then move", "select", models, "claude" + down + enter + "gpt" + down + down + enter, "claude-haiku-4.5", "gpt-4.1", nil},
+		{"backspace", "select", models, "gpx" + bksp + "-4" + enter + enter, "gpt-4.1", "claude-sonnet-4.5", nil},
+		{"clear", "select", models, "xyz" + "\x15" + down + enter + enter, "claude-haiku-4.5", "claude-sonnet-4.5", nil},
+		{"no match ignores enter", "select", models, "zzz" + enter + bksp + bksp + bksp + "gem" + enter + enter, "gemini-2.5-pro", "claude-sonnet-4.5", nil},
+		{"canceled", "select", models, "\x03", "", "", tui.ErrCanceled},
+		{"canceled on the second", "select", models, enter + "\x1b", "", "", tui.ErrCanceled},
+		{"input ends", "select", models, "gpt", "", "", tui.ErrCanceled},
+
+		// The numbered prompt: a number or an ID per line
+		{"numbers", "prompt", models, "3\n2\n", "gpt-5", "claude-haiku-4.5", nil},
+		{"padded", "prompt", models, "  5 \r\n\t4\n", "gpt-4.1", "gpt-5-mini", nil},
+		{"ids", "prompt", models, "gpt-5\nclaude-haiku-4.5\n", "gpt-5", "claude-haiku-4.5", nil},
+		{"invalid asks again", "prompt", models, "0\n7\n2x\nsonnet\n1\n6\n", "claude-sonnet-4.5", "gemini-2.5-pro", nil},
+		{"last line without newline", "prompt", models, "1\n2", "claude-sonnet-4.5", "claude-haiku-4.5", nil},
+		{"prompt input ends", "prompt", models, "1\n", "", "", tui.ErrCanceled},
+		{"prompt empty input", "prompt", models, "", "", "", tui.ErrCanceled},
+
+		{"no models", "prompt", nil, "1\n1\n", "", "", errors.New("no models to choose from")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := bufio.NewReader(strings.NewReader(tt.input))
+			pick := func(title string, items []tui.Item) (int, error) {
+				if tt.picker == "select" {
+					return tui.Select(in, io.Discard, title, items)
+				}
+				return tui.Prompt(in, io.Discard, title, items)
+			}
+			primary, small, err := chooseClaudeCodeModels(tt.models, pick)
+			switch {
+			case tt.err != nil:
+				if err == nil || err.Error() != tt.err.Error() {
+					t.Errorf("got %q, %q, %v; want error %v", primary, small, err, tt.err)
+				}
+			case err != nil:
+				t.Errorf("error %v, want %q and %q", err, primary, small)
+			case primary != tt.primary || small != tt.small:
+				t.Errorf("got %q and %q, want %q and %q", primary, small, tt.primary, tt.small)
+			}
+		})
+	}
+}
+
+// TestChooseClaudeCodeModelsItems checks what the picker is offered: every
+// model, with its context window and the backend /v1/messages uses.
+func TestChooseClaudeCodeModelsItems(t *testing.T) {
+	models := []state.Model{
+		{ID: "claude-sonnet-4.5", SupportedEndpoints: []string{"/v1/messages"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 200000}}},
+		{ID: "gpt-5", SupportedEndpoints: []string{"/responses"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 400000}}},
+		{ID: "gpt-4.1", SupportedEndpoints: []string{"/chat/completions"},
+			Capabilities: state.ModelCapabilities{Limits: state.ModelLimits{MaxContextWindowTokens: 1048576}}},
+		{ID: "gemini-2.5-pro"},
+	}
+	var titles []string
+	var offered [][]tui.Item
+	pick := func(title string, items []tui.Item) (int, error) {
+		titles = append(titles, title)
+		offered = append(offered, items)
+		return len(titles) - 1, nil
+	}
+	primary, small, err := chooseClaudeCodeModels(models, pick)
+	if err != nil || primary != "claude-sonnet-4.5" || small != "gpt-5" {
+		t.Fatalf("got %q, %q, %v", primary, small, err)
+	}
+	if want := []string{"Primary model:", "Small/fast model:"}; !slices.Equal(titles, want) {
+		t.Errorf("titles %q, want %q", titles, want)
+	}
+	want := []tui.Item{
+		{Label: "claude-sonnet-4.5", Detail: "context 200k · messages"},
+		{Label: "gpt-5", Detail: "context 400k · responses"},
+		{Label: "gpt-4.1", Detail: "context 1M · chat_completions"},
+		{Label: "gemini-2.5-pro", Detail: "context ? · chat_completions"},
+	}
+	for i, items := range offered {
+		if !slices.Equal(items, want) {
+			t.Errorf("pick %d offered %v, want %v", i+1, items, want)
+		}
+	}
+}
+
+func TestFormatTokenCount(t *testing.T) {
+	for n, want := range map[int]string{
+		0: "0", 999: "999", 1000: "1k", 1499: "1k", 1500: "2k", 128000: "128k", 200000: "200k",
+		1_000_000: "1M", 1_048_576: "1M", 1_500_000: "1.5M", 1_960_000: "2M", 2_000_000: "2M",
+	} {
+		if got := formatTokenCount(n); got != want {
+			t.Errorf("%d: got %q, want %q", n, got, want)
+		}
+	}
+}
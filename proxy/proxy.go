@@ -0,0 +1,197 @@
+// Package proxy embeds the Copilot API proxy in another Go program: New
+// authenticates and fetches the models the way `copilot-proxy-go start`
+// does, and App.Handler serves the proxy's routes on the caller's mux.
+//
+// Each App has its own state (tokens, models and account type), metrics,
+// config, caches and request registry, so one process can serve several
+// GitHub accounts side by side; give each its own DataDir to keep their
+// saved tokens, config files and logs apart. Close stops an App's
+// background work and drops its caches. The telemetry exporter, logging
+// and the cached editor versions stay process-wide.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/audit"
+	"github.com/tonghaoch/copilot-proxy-go/internal/auth"
+	"github.com/tonghaoch/copilot-proxy-go/internal/buildinfo"
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/server"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// Options configures an App. The zero value uses the saved GitHub token,
+// detects the account type and loads the config from the app directory.
+type Options struct {
+	// GitHubToken authenticates with Copilot. Empty uses the token saved
+	// by `copilot-proxy-go auth`; with neither, New fails rather than
+	// starting the interactive device flow.
+	GitHubToken string
+	// AccountType is auto (the default), individual, business or
+	// enterprise.
+	AccountType string
+	// DataDir overrides the app directory holding the saved token, config
+	// and logs, like --data-dir.
+	DataDir string
+	// ConfigSets overrides config fields, as the --set flag does
+	// ("smallModel=gpt-4.1").
+	ConfigSets []string
+	// RateLimitSeconds is the minimum time between requests (0 for none);
+	// RateLimitWait waits out the limit instead of rejecting.
+	RateLimitSeconds int
+	RateLimitWait    bool
+	// RequireFreshModels fails New when the models can't be fetched,
+	// instead of starting from the cached list.
+	RequireFreshModels bool
+
+	// backend replaces the Copilot API; tests pass a servicetest.Fake.
+	backend service.Backend
+}
+
+// App is an initialized proxy.
+type App struct {
+	instance *server.Instance
+	auditLog *audit.Writer
+	cancel   context.CancelFunc
+	handler  http.Handler
+}
+
+// Setup steps that reach GitHub, swapped out by tests.
+var (
+	setupEditorIdentity = auth.SetupEditorIdentity
+	setupAuth           = auth.SetupAuth
+	resolveAccountType  = auth.ResolveAccountType
+)
+
+// New authenticates, fetches the models and builds the proxy's routes.
+// Like `start` it applies the config file and COPILOT_PROXY_* variables,
+// and opens the audit log when audit.enabled is set. The --manual prompt,
+// MCP and coordination are left to the CLI.
+func New(opts Options) (*App, error) {
+	accountType := opts.AccountType
+	if accountType == "" {
+		accountType = auth.AccountTypeAuto
+	}
+	if !slices.Contains(auth.ValidAccountTypes, accountType) {
+		return nil, fmt.Errorf("invalid account type %q (expected %s)", accountType, strings.Join(auth.ValidAccountTypes, ", "))
+	}
+
+	st := state.New()
+	if opts.DataDir != "" {
+		st.SetDataDir(opts.DataDir)
+	}
+	if err := st.EnsurePaths(); err != nil {
+		return nil, fmt.Errorf("creating app directories: %w", err)
+	}
+	if opts.GitHubToken == "" {
+		if token, err := auth.LoadToken(st); err != nil || token == "" {
+			return nil, errors.New("no GitHub token: set Options.GitHubToken or run `copilot-proxy-go auth`")
+		}
+	}
+
+	cfg := config.NewStore(st.ConfigPath())
+	if err := cfg.SetFlagOverrides(opts.ConfigSets); err != nil {
+		return nil, err
+	}
+	if err := cfg.Load(); err != nil {
+		slog.Warn("failed to load config, using defaults: " + err.Error())
+	}
+	cfg.MergeDefaults()
+	if accountType != auth.AccountTypeAuto {
+		st.SetAccountType(accountType)
+	}
+	setupEditorIdentity(st, cfg.Get(), true)
+
+	// The token refresh, model refresh and quota polling run under ctx,
+	// until Close or a failed New cancels it
+	inst := server.NewInstance(st, state.NewMetrics(), cfg, opts.backend)
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = inst.Context(ctx)
+	app := &App{instance: inst, cancel: cancel}
+	if err := app.setup(ctx, opts, accountType); err != nil {
+		app.Close()
+		return nil, err
+	}
+	return app, nil
+}
+
+// setup authenticates, fetches the models and builds the routes of an App
+// whose instance ctx carries.
+func (a *App) setup(ctx context.Context, opts Options, accountType string) error {
+	st, cfg := a.instance.State, a.instance.Config
+	if err := setupAuth(ctx, st, opts.GitHubToken); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	resolveAccountType(st, accountType)
+
+	st.SetModelOverrides(cfg.Get().ModelOverrides)
+	models, err := a.instance.Backend.FetchModels(ctx)
+	if err != nil {
+		if opts.RequireFreshModels {
+			return fmt.Errorf("failed to fetch models: %w", err)
+		}
+		cached, fetchedAt, cacheErr := service.CachedModels(ctx)
+		if cacheErr != nil {
+			return fmt.Errorf("failed to fetch models (and no cached list to start from): %w", err)
+		}
+		slog.Warn("failed to fetch models, starting with the cached list; retrying in the background",
+			"error", err, "cached_at", fetchedAt.Format(time.RFC3339))
+		models = cached
+		go service.RefreshModelsUntilFetched(ctx)
+	}
+	st.SetModels(models)
+	cfg.Get().EffectiveSmallModel(st) // warns if smallModel was removed
+
+	if cfg.Get().Audit.Enabled {
+		key, err := audit.LoadKey(st.AuditKeyPath())
+		if err != nil {
+			return fmt.Errorf("failed to load audit key: %w", err)
+		}
+		if a.auditLog, err = audit.Open(cfg.Get().AuditLogPath(st), key); err != nil {
+			return err
+		}
+	}
+
+	a.instance.Metrics.SetPremiumCost(func(rec state.RequestRecord) float64 {
+		return service.PremiumCost(ctx, rec)
+	})
+	if cfg.Get().NotificationsEnabled() {
+		go service.PollPremiumQuota(ctx)
+	}
+
+	srv := server.New(a.instance, server.Options{
+		RateLimitSeconds: opts.RateLimitSeconds,
+		RateLimitWait:    opts.RateLimitWait,
+		AuditLog:         a.auditLog,
+		Version:          buildinfo.Version,
+	})
+	a.handler = srv.Handler
+	return nil
+}
+
+// Handler serves the proxy's routes (/v1/messages, /chat/completions,
+// /dashboard, ...) at the root of whatever it's mounted on; strip any
+// prefix first, e.g. with http.StripPrefix.
+func (a *App) Handler() http.Handler { return a.handler }
+
+// Close stops the App's token refresh and background polling, drops its
+// caches, stored responses and session pins, and closes its audit log.
+// Requests still in flight finish; stop serving Handler before calling
+// it.
+func (a *App) Close() error {
+	a.cancel()
+	a.instance.Close()
+	if a.auditLog != nil {
+		return a.auditLog.Close()
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tonghaoch/copilot-proxy-go/internal/config"
+	"github.com/tonghaoch/copilot-proxy-go/internal/service/servicetest"
+	"github.com/tonghaoch/copilot-proxy-go/internal/state"
+)
+
+// stubGitHub replaces the setup steps that reach GitHub for the test.
+func stubGitHub(t *testing.T) {
+	t.Helper()
+	prevIdentity, prevAuth, prevResolve := setupEditorIdentity, setupAuth, resolveAccountType
+	t.Cleanup(func() { setupEditorIdentity, setupAuth, resolveAccountType = prevIdentity, prevAuth, prevResolve })
+	setupEditorIdentity = func(s *state.State, cfg *config.Config, lookup bool) { s.SetVSCodeVersion("1.0.0") }
+	setupAuth = func(ctx context.Context, s *state.State, token string) error {
+		s.SetGithubToken(token)
+		s.SetCopilotToken("copilot-" + token)
+		return nil
+	}
+	resolveAccountType = func(s *state.State, requested string) { s.SetAccountType("individual") }
+}
+
+// newApp returns an App for token, with its own data directory and fake
+// as its upstream, closed when the test ends.
+func newApp(t *testing.T, token string, fake *servicetest.Fake, sets ...string) *App {
+	t.Helper()
+	app, err := New(Options{GitHubToken: token, DataDir: t.TempDir(), ConfigSets: sets, backend: fake})
+	if err != nil {
+		t.Fatalf("New(%s): %v", token, err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return app
+}
+
+func TestInstancesSideBySide(t *testing.T) {
+	stubGitHub(t)
+	instances := []struct {
+		token, model, smallModel string
+		requests                 int
+	}{
+		{"token-a", "model-a", "small-a", 1},
+		{"token-b", "model-b", "small-b", 2},
+	}
+	apps := make([]*App, len(instances))
+	fakes := make([]*servicetest.Fake, len(instances))
+	for i, in := range instances {
+		fake := &servicetest.Fake{}
+		fake.SetModels([]state.Model{{ID: in.model, SupportedEndpoints: []string{"/chat/completions"}}}, nil)
+		for range in.requests {
+			fake.Script(servicetest.ChatCompletions, servicetest.JSON(
+				`{"id":"c1","model":"`+in.model+`","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`))
+		}
+		apps[i], fakes[i] = newApp(t, in.token, fake, "smallModel="+in.smallModel), fake
+	}
+
+	// Requests interleave, each app answering from its own account
+	for round := range 2 {
+		for i, in := range instances {
+			if round >= in.requests {
+				continue
+			}
+			w := httptest.NewRecorder()
+			body := `{"model":"` + in.model + `","messages":[{"role":"user","content":"hi"}]}`
+			apps[i].Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: chat completion status %d: %s", in.token, w.Code, w.Body)
+			}
+		}
+	}
+
+	for i, in := range instances {
+		app := apps[i]
+		if got := len(fakes[i].Calls()); got != in.requests {
+			t.Errorf("%s: backend got %d calls, want %d", in.token, got, in.requests)
+		}
+		if got := app.instance.State.GetGithubToken(); got != in.token {
+			t.Errorf("%s: state has GitHub token %q", in.token, got)
+		}
+		if got := app.instance.Config.Get().SmallModel; got != in.smallModel {
+			t.Errorf("%s: smallModel = %q, want %q", in.token, got, in.smallModel)
+		}
+
+		w := httptest.NewRecorder()
+		app.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+		var models struct {
+			Data []struct{ ID string } `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &models); err != nil {
+			t.Fatalf("%s: decoding /v1/models: %v: %s", in.token, err, w.Body)
+		}
+		if len(models.Data) != 1 || models.Data[0].ID != in.model {
+			t.Errorf("%s: /v1/models lists %+v, want only %s", in.token, models.Data, in.model)
+		}
+
+		w = httptest.NewRecorder()
+		app.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+		var stats struct {
+			TotalRequests int64 `json:"total_requests"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("%s: decoding /api/stats: %v: %s", in.token, err, w.Body)
+		}
+		if stats.TotalRequests != int64(in.requests) {
+			t.Errorf("%s: /api/stats counts %d requests, want %d", in.token, stats.TotalRequests, in.requests)
+		}
+	}
+
+	if state.Global.GetGithubToken() != "" {
+		t.Error("an instance's token leaked into state.Global")
+	}
+	if got := config.Get().SmallModel; got == "small-a" || got == "small-b" {
+		t.Errorf("an instance's smallModel leaked into the process config: %q", got)
+	}
+}
+
+func TestStoredResponsesStayWithTheirInstance(t *testing.T) {
+	stubGitHub(t)
+	models := []state.Model{{ID: "gpt-5", SupportedEndpoints: []string{"/responses"}}}
+	fakeA, fakeB := &servicetest.Fake{}, &servicetest.Fake{}
+	fakeA.SetModels(models, nil)
+	fakeB.SetModels(models, nil)
+	fakeA.Script(servicetest.Responses, servicetest.JSON(
+		`{"id":"resp_up","object":"response","status":"completed","model":"gpt-5","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`))
+	a, b := newApp(t, "token-a", fakeA), newApp(t, "token-b", fakeB)
+
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(`{"model":"gpt-5","input":"hi","store":true}`)))
+	var stored struct{ ID string }
+	if err := json.Unmarshal(w.Body.Bytes(), &stored); err != nil || stored.ID == "" {
+		t.Fatalf("storing a response: status %d: %s", w.Code, w.Body)
+	}
+
+	// The other instance can't continue it, and doesn't call upstream
+	w = httptest.NewRecorder()
+	body := `{"model":"gpt-5","input":"and then?","previous_response_id":"` + stored.ID + `"}`
+	b.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("previous_response_id of another instance: status %d, want 400: %s", w.Code, w.Body)
+	}
+	if calls := fakeB.Calls(); len(calls) != 0 {
+		t.Errorf("the other instance called upstream %d times", len(calls))
+	}
+
+	// Once closed, an App has dropped it too
+	a.Close()
+	fakeA.Script(servicetest.Responses, servicetest.JSON(`{"id":"resp_up2","object":"response","status":"completed","output":[]}`))
+	w = httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("previous_response_id after Close: status %d, want 400: %s", w.Code, w.Body)
+	}
+}